@@ -0,0 +1,326 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package archive fetches blockfiles archived to remote storage so they can be
+// queried, decompressing them as they're downloaded, and keeps the most
+// recently fetched ones in a local scratch directory for follow-up queries.
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var v = base.V // verbose logging
+
+var (
+	archiveCacheHits    = stats.S.Get("archive_cache_hits")
+	archiveCacheMisses  = stats.S.Get("archive_cache_misses")
+	archiveCacheBytes   = stats.S.Get("archive_cache_bytes")
+	archiveFetchedBytes = stats.S.Get("archive_fetched_bytes")
+	archiveFetchNanos   = stats.S.Get("archive_fetch_nanos")
+)
+
+// ErrNotArchived is returned by Fetch for files the archive doesn't have.
+var ErrNotArchived = errors.New("not archived")
+
+// compressions are the extensions archived files may have, in the order
+// they're tried, and how to decompress each.
+var compressions = []struct {
+	ext        string
+	decompress func(ctx context.Context, f *Fetcher, r io.Reader, w io.Writer) error
+}{
+	{".zst", func(ctx context.Context, f *Fetcher, r io.Reader, w io.Writer) error {
+		cmd := exec.CommandContext(ctx, f.zstd, "-d", "-c")
+		var stderr bytes.Buffer
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = r, w, &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%q failed: %v: %s", f.zstd, err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil
+	}},
+	{".gz", func(_ context.Context, _ *Fetcher, r io.Reader, w io.Writer) error {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, gz)
+		return err
+	}},
+	{"", func(_ context.Context, _ *Fetcher, r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}},
+}
+
+// Fetcher fetches archived blockfiles, with their indexes, from a URL.  The
+// blockfile a thread wrote as <name> (relative to its packets directory) is
+// archived at <url>/<thread>/packets/<name>, and its index at
+// <url>/<thread>/index/<name>, each optionally compressed with zstd (with a
+// ".zst" extension) or gzip (".gz").  Files without an archived index are
+// indexed as they're opened.
+//
+// Fetched files are decompressed as they're downloaded into a scratch
+// directory, which holds up to a given number of bytes of them, evicting the
+// least recently used first.
+type Fetcher struct {
+	url      string
+	dir      string
+	maxBytes int64
+	client   *http.Client
+	zstd     string // Command decompressing zstd from stdin to stdout.
+
+	mu sync.Mutex
+	// protected by mu
+	bytes   int64
+	lru     *list.List // of *fetched, most recently used first
+	fetched map[string]*list.Element
+}
+
+// fetched is a file in the scratch directory, or being fetched into it.
+type fetched struct {
+	key   string
+	dir   string
+	bytes int64
+	ready chan struct{} // Closed once the fetch is done, setting err.
+	err   error
+}
+
+// NewFetcher returns a Fetcher of the files archived at 'url', keeping up to
+// maxBytes of them in 'dir', which is emptied first.  Downloads are made with
+// 'client', and zstd-compressed files are decompressed by running
+// 'zstdCommand' (like "zstd") with "-d -c".
+func NewFetcher(url, dir string, maxBytes int64, client *http.Client, zstdCommand string) (*Fetcher, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("could not empty archive scratch directory: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("could not create archive scratch directory: %v", err)
+	}
+	return &Fetcher{
+		url:      strings.TrimSuffix(url, "/"),
+		dir:      dir,
+		maxBytes: maxBytes,
+		client:   client,
+		zstd:     zstdCommand,
+		lru:      list.New(),
+		fetched:  map[string]*list.Element{},
+	}, nil
+}
+
+// Fetch returns the local paths of the blockfile the given thread archived as
+// 'name', and of its index (or "" if it has none), fetching them if they're
+// not in the scratch directory.  It returns ErrNotArchived if the archive
+// doesn't have the file.  The returned files may be evicted by later fetches,
+// so should be opened right away; open files are kept until they're closed.
+func (f *Fetcher) Fetch(ctx context.Context, thread int, name string) (packets, index string, _ error) {
+	key := strconv.Itoa(thread) + "/" + name
+	for {
+		f.mu.Lock()
+		e := f.fetched[key]
+		if e == nil {
+			break
+		}
+		f.lru.MoveToFront(e)
+		fe := e.Value.(*fetched)
+		f.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return "", "", ctx.Err()
+		case <-fe.ready:
+		}
+		if fe.err == nil {
+			archiveCacheHits.Increment()
+			return fe.paths(name)
+		}
+		// The fetch we waited for failed:  try again ourselves.
+	}
+	// f.mu is held.
+	archiveCacheMisses.Increment()
+	fe := &fetched{
+		key:   key,
+		dir:   filepath.Join(f.dir, strconv.Itoa(thread), url.PathEscape(name)),
+		ready: make(chan struct{}),
+	}
+	f.fetched[key] = f.lru.PushFront(fe)
+	f.mu.Unlock()
+
+	fe.bytes, fe.err = f.fetch(ctx, thread, name, fe)
+	f.mu.Lock()
+	if fe.err != nil {
+		if e := f.fetched[key]; e != nil && e.Value == fe {
+			f.lru.Remove(e)
+			delete(f.fetched, key)
+		}
+		os.RemoveAll(fe.dir)
+	} else {
+		f.bytes += fe.bytes
+		f.evict()
+	}
+	close(fe.ready)
+	f.mu.Unlock()
+	if fe.err != nil {
+		return "", "", fe.err
+	}
+	return fe.paths(name)
+}
+
+// paths returns the paths of a fetched blockfile and index.
+func (fe *fetched) paths(name string) (packets, index string, _ error) {
+	packets = filepath.Join(fe.dir, "packets")
+	index = filepath.Join(fe.dir, "index", filepath.Base(name))
+	if _, err := os.Stat(index); err != nil {
+		index = ""
+	}
+	return packets, index, nil
+}
+
+// evict removes the least recently used fetched files until those left fit in
+// maxBytes.  Files still being fetched are left alone.  f.mu must be held.
+func (f *Fetcher) evict() {
+	for e := f.lru.Back(); e != nil && f.bytes > f.maxBytes; {
+		prev := e.Prev()
+		if fe := e.Value.(*fetched); isClosed(fe.ready) {
+			v(1, "Evicting archived %q", fe.key)
+			f.lru.Remove(e)
+			delete(f.fetched, fe.key)
+			f.bytes -= fe.bytes
+			os.RemoveAll(fe.dir)
+		}
+		e = prev
+	}
+	archiveCacheBytes.Set(f.bytes)
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+// fetch downloads a blockfile and its index into fe.dir, returning their
+// total size.
+func (f *Fetcher) fetch(ctx context.Context, thread int, name string, fe *fetched) (int64, error) {
+	defer archiveFetchNanos.NanoTimer()()
+	escaped := (&url.URL{Path: filepath.ToSlash(name)}).EscapedPath()
+	remote := func(dir string) string { return fmt.Sprintf("%s/%d/%s/%s", f.url, thread, dir, escaped) }
+	packets, err := f.download(ctx, remote("packets"), filepath.Join(fe.dir, "packets"), f.maxBytes)
+	if err != nil {
+		return 0, err
+	}
+	index, err := f.download(ctx, remote("index"), filepath.Join(fe.dir, "index", filepath.Base(name)), f.maxBytes-packets)
+	if err == ErrNotArchived {
+		v(1, "Archived %q of thread %d has no index", name, thread)
+	} else if err != nil {
+		return 0, err
+	}
+	v(1, "Fetched archived %q of thread %d, %d bytes", name, thread, packets+index)
+	return packets + index, nil
+}
+
+// download fetches the first of the compressed or uncompressed versions of
+// 'url' which exists, decompressing it into 'path', which may be no bigger
+// than 'limit'.
+func (f *Fetcher) download(ctx context.Context, url, path string, limit int64) (int64, error) {
+	for _, c := range compressions {
+		req, err := http.NewRequest("GET", url+c.ext, nil)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := f.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, fmt.Errorf("fetching %q: %v", url+c.ext, err)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			continue
+		} else if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			return 0, fmt.Errorf("fetching %q: %v: %s", url+c.ext, resp.Status, bytes.TrimSpace(body))
+		}
+		n, err := f.decompress(ctx, c.decompress, resp.Body, path, limit)
+		resp.Body.Close()
+		if err != nil {
+			return 0, fmt.Errorf("fetching %q: %v", url+c.ext, err)
+		}
+		return n, nil
+	}
+	return 0, ErrNotArchived
+}
+
+// decompress writes what 'decompress' makes of 'r' to 'path', failing once
+// it's written more than 'limit' bytes.
+func (f *Fetcher) decompress(ctx context.Context, decompress func(context.Context, *Fetcher, io.Reader, io.Writer) error, r io.Reader, path string, limit int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, err
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	w := &limitedWriter{w: out, limit: limit}
+	if err := decompress(ctx, f, &countingReader{r: r}, w); err != nil {
+		if w.n > limit {
+			return 0, fmt.Errorf("larger than the %d byte archive cache", f.maxBytes)
+		}
+		return 0, err
+	}
+	return w.n, out.Close()
+}
+
+// limitedWriter fails writes once more than 'limit' bytes are written.
+type limitedWriter struct {
+	w        io.Writer
+	n, limit int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n += int64(len(p)); l.n > l.limit {
+		return 0, fmt.Errorf("too large")
+	}
+	return l.w.Write(p)
+}
+
+// countingReader counts the bytes fetched from the archive.
+type countingReader struct {
+	r io.Reader
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	archiveFetchedBytes.IncrementBy(int64(n))
+	return n, err
+}
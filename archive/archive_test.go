@@ -0,0 +1,111 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFetch(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(bytes.Repeat([]byte("b"), 600))
+	w.Close()
+	files := map[string][]byte{
+		"/0/packets/a":          bytes.Repeat([]byte("a"), 500),
+		"/0/index/a":            []byte("index"),
+		"/0/packets/old/b.gz":   gz.Bytes(),
+		"/1/packets/huge":       bytes.Repeat([]byte("h"), 2000),
+		"/1/packets/corrupt.gz": []byte("not gzip"),
+	}
+	gets := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		gets[r.URL.Path]++
+		w.Write(data)
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	f, err := NewFetcher(srv.URL+"/", filepath.Join(dir, "scratch"), 1024, srv.Client(), "zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, test := range []struct {
+		thread   int
+		name     string
+		size     int
+		hasIndex bool
+	}{
+		{0, "a", 500, true},
+		{0, "a", 500, true}, // From the cache.
+		{0, "old/b", 600, false},
+	} {
+		packets, index, err := f.Fetch(ctx, test.thread, test.name)
+		if err != nil {
+			t.Fatalf("%d/%s: %v", test.thread, test.name, err)
+		}
+		if data, err := ioutil.ReadFile(packets); err != nil || len(data) != test.size {
+			t.Errorf("%d/%s: fetched %d bytes (%v), want %d", test.thread, test.name, len(data), err, test.size)
+		}
+		if (index != "") != test.hasIndex {
+			t.Errorf("%d/%s: got index %q", test.thread, test.name, index)
+		}
+	}
+	if gets["/0/packets/a"] != 1 {
+		t.Errorf("fetched %d times, want once", gets["/0/packets/a"])
+	}
+	// Fetching b pushed the cache over 1024 bytes, evicting a.
+	if _, _, err := f.Fetch(ctx, 0, "a"); err != nil || gets["/0/packets/a"] != 2 {
+		t.Errorf("evicted file fetched %d times (%v), want twice", gets["/0/packets/a"], err)
+	}
+	if _, _, err := f.Fetch(ctx, 1, "a"); err != ErrNotArchived {
+		t.Errorf("missing file got %v", err)
+	}
+	for _, name := range []string{"huge", "corrupt"} {
+		if _, _, err := f.Fetch(ctx, 1, name); err == nil || err == ErrNotArchived {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+
+	if _, err := exec.LookPath("zstd"); err != nil {
+		t.Skip("no zstd command")
+	}
+	cmd := exec.Command("zstd", "-c")
+	cmd.Stdin = bytes.NewReader(bytes.Repeat([]byte("z"), 100))
+	zst, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/2/packets/c.zst"] = zst
+	if packets, _, err := f.Fetch(ctx, 2, "c"); err != nil {
+		t.Error(err)
+	} else if data, _ := ioutil.ReadFile(packets); !bytes.Equal(data, bytes.Repeat([]byte("z"), 100)) {
+		t.Errorf("decompressed %q", data)
+	}
+}
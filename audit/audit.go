@@ -0,0 +1,257 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package audit keeps a tamper-evident log of packet extractions.  Each entry
+// records who extracted what, along with a manifest (size and SHA-256) of the
+// exact bytes they were sent.  Entries are sequence-numbered, each includes
+// the hash of the one before it, and each is signed with an Ed25519 key, so
+// any edit, deletion, or reordering is detectable during later review.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+)
+
+var v = base.V // verbose logging
+
+// Entry is a single audited extraction.
+type Entry struct {
+	Seq    uint64 // Starts at 1, incremented by one for each entry.
+	Time   time.Time
+	Client string // Common name of the client certificate.
+	Remote string // Client address.
+	Query  string
+	Format string `json:",omitempty"`
+	// Transforms are those applied to the results, if any.
+	Transforms []string `json:",omitempty"`
+	// Bytes and SHA256 (hex) describe the exact response body sent, so an
+	// extracted file can be matched to its entry.
+	Bytes  int64
+	SHA256 string
+	// ResultSHA256 is the canonical hash of the packets returned (see
+	// base.ResultHash), if the client asked for one.
+	ResultSHA256 string `json:",omitempty"`
+	Error        string `json:",omitempty"`
+	// Prev is the hex SHA-256 of the previous entry's line in the log, or
+	// empty for the first entry.
+	Prev string `json:",omitempty"`
+	// Signature is the Ed25519 signature of the JSON encoding of the entry
+	// with no signature.
+	Signature []byte `json:",omitempty"`
+}
+
+func (e Entry) signedBytes() ([]byte, error) {
+	e.Signature = nil
+	return json.Marshal(e)
+}
+
+// Log is an append-only audit log, stored as one JSON entry per line.
+type Log struct {
+	mu   sync.Mutex
+	f    *os.File
+	key  ed25519.PrivateKey
+	seq  uint64 // Of the last entry written.
+	prev string // Hash of the last entry written.
+}
+
+// Open opens the audit log at the given path, creating it if necessary, which
+// will sign new entries with 'key'.  Existing entries are verified first, so
+// we never extend a log which has been tampered with.
+func Open(path string, key ed25519.PrivateKey) (*Log, error) {
+	l := &Log{key: key}
+	if f, err := os.Open(path); err == nil {
+		l.seq, l.prev, err = verify(f, key.Public().(ed25519.PublicKey))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("audit log %q failed verification: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read audit log %q: %v", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log %q: %v", path, err)
+	}
+	l.f = f
+	v(1, "Opened audit log %q with %d entries", path, l.seq)
+	return l, nil
+}
+
+// Add fills in the sequence number, time, previous hash, and signature of an
+// entry, then appends it to the log, returning its sequence number.
+func (l *Log) Add(e Entry) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq = l.seq + 1
+	e.Time = time.Now().UTC()
+	e.Prev = l.prev
+	signed, err := e.signedBytes()
+	if err != nil {
+		return 0, err
+	}
+	e.Signature = ed25519.Sign(l.key, signed)
+	line, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	if _, err := l.f.Write(line); err != nil {
+		return 0, fmt.Errorf("could not write audit entry: %v", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return 0, fmt.Errorf("could not sync audit log: %v", err)
+	}
+	l.seq, l.prev = e.Seq, lineHash(line)
+	return e.Seq, nil
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// lineHash returns the hex SHA-256 of an entry's line, without its newline.
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(bytes.TrimSuffix(line, []byte{'\n'}))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify checks every entry in an audit log against the given public key,
+// returning the number of entries.  It fails on the first entry which has been
+// altered, or which doesn't follow on from the entry before it.
+func Verify(r io.Reader, pub ed25519.PublicKey) (int, error) {
+	seq, _, err := verify(r, pub)
+	return int(seq), err
+}
+
+func verify(r io.Reader, pub ed25519.PublicKey) (seq uint64, prev string, _ error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24) // Queries can be long.
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return seq, prev, fmt.Errorf("entry after %d: invalid JSON: %v", seq, err)
+		}
+		if e.Seq != seq+1 {
+			return seq, prev, fmt.Errorf("entry after %d: has sequence number %d", seq, e.Seq)
+		}
+		if e.Prev != prev {
+			return seq, prev, fmt.Errorf("entry %d: previous hash doesn't match entry %d", e.Seq, seq)
+		}
+		signed, err := e.signedBytes()
+		if err != nil {
+			return seq, prev, err
+		}
+		if !ed25519.Verify(pub, signed, e.Signature) {
+			return seq, prev, fmt.Errorf("entry %d: invalid signature", e.Seq)
+		}
+		seq, prev = e.Seq, lineHash(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return seq, prev, fmt.Errorf("entry after %d: %v", seq, err)
+	}
+	return seq, prev, nil
+}
+
+// Manifest computes the size and SHA-256 of everything written through it, for
+// an Entry's Bytes and SHA256.
+type Manifest struct {
+	w     io.Writer
+	sum   hash.Hash
+	bytes int64
+}
+
+// NewManifest returns a Manifest which passes writes through to w.
+func NewManifest(w io.Writer) *Manifest {
+	return &Manifest{w: w, sum: sha256.New()}
+}
+
+// Write implements io.Writer.
+func (m *Manifest) Write(p []byte) (int, error) {
+	n, err := m.w.Write(p)
+	m.sum.Write(p[:n])
+	m.bytes += int64(n)
+	return n, err
+}
+
+// Fill sets e's Bytes and SHA256 to describe everything written so far.
+func (m *Manifest) Fill(e *Entry) {
+	e.Bytes = m.bytes
+	e.SHA256 = hex.EncodeToString(m.sum.Sum(nil))
+}
+
+// LoadPrivateKey reads a PEM-encoded PKCS#8 Ed25519 private key, like those
+// written by "openssl genpkey -algorithm ed25519".
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse audit key %q: %v", path, err)
+	}
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("audit key %q is not an Ed25519 key", path)
+	}
+	return k, nil
+}
+
+// LoadPublicKey reads a PEM-encoded PKIX Ed25519 public key, like those
+// written by "openssl pkey -pubout".
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse audit public key %q: %v", path, err)
+	}
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("audit public key %q is not an Ed25519 key", path)
+	}
+	return k, nil
+}
+
+func readPEM(path, typ string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%q contains no PEM %s", path, typ)
+	}
+	return block.Bytes, nil
+}
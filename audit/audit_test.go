@@ -0,0 +1,97 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	d, err := ioutil.TempDir("", "audit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "audit.log")
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Open(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	m := NewManifest(&out)
+	m.Write([]byte("packets"))
+	e := Entry{Client: "analyst", Query: "port 80"}
+	m.Fill(&e)
+	sum := sha256.Sum256([]byte("packets"))
+	if e.Bytes != 7 || e.SHA256 != hex.EncodeToString(sum[:]) || out.String() != "packets" {
+		t.Errorf("wrong manifest %d %q for %q", e.Bytes, e.SHA256, out.String())
+	}
+	if seq, err := l.Add(e); err != nil {
+		t.Fatal(err)
+	} else if seq != 1 {
+		t.Errorf("got seq %d, want 1", seq)
+	}
+	l.Close()
+
+	// Reopening continues the chain.
+	if l, err = Open(path, key); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := l.Add(Entry{Query: "host 1.2.3.4"}); err != nil {
+		t.Fatal(err)
+	} else if seq != 2 {
+		t.Errorf("got seq %d, want 2", seq)
+	}
+	l.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Verify(bytes.NewReader(data), pub); err != nil || n != 2 {
+		t.Errorf("verifying untouched log: got %d, %v", n, err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	for _, test := range []struct {
+		desc     string
+		tampered string
+	}{
+		{"edited", strings.Replace(string(data), "port 80", "port 81", 1)},
+		{"deleted", lines[1]},
+		{"reordered", lines[1] + lines[0]},
+	} {
+		if _, err := Verify(strings.NewReader(test.tampered), pub); err == nil {
+			t.Errorf("%s log verified", test.desc)
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte(lines[1]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, key); err == nil {
+		t.Error("opened tampered log")
+	}
+}
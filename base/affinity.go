@@ -0,0 +1,90 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseCPUList parses a list of CPUs in the kernel's cpulist format (as used
+// by taskset -c and /sys/devices/system/node/node*/cpulist), like "0-3,8".
+func ParseCPUList(s string) (cpus []int, _ error) {
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		start, err := strconv.Atoi(from)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid CPU list %q", s)
+		}
+		end, err := strconv.Atoi(to)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid CPU list %q", s)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// IOPriority is an I/O scheduling class and level, as set by ionice.  The
+// kernel only honors them with an I/O scheduler which supports priorities
+// (BFQ, or the older CFQ); others ignore them.
+type IOPriority struct {
+	Class int // One of the IOPrioClass constants.
+	Level int // 0 (highest) to 7, for the realtime and best-effort classes.
+}
+
+// I/O scheduling classes, from linux/ioprio.h.
+const (
+	IOPrioClassBestEffort = 2
+	IOPrioClassIdle       = 3
+)
+
+// ParseIOPriority parses an I/O priority in the form "idle", "best-effort",
+// or "best-effort:N" for a level N from 0 to 7 (the default is 4, like the
+// kernel's for a process with a nice of 0).  The realtime class isn't
+// allowed:  it's for keeping other I/O away from a disk, not for reads which
+// should yield to stenotype's writes.
+func ParseIOPriority(s string) (IOPriority, error) {
+	class, level := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		class, level = s[:i], s[i+1:]
+	}
+	switch {
+	case class == "idle" && level == "":
+		return IOPriority{Class: IOPrioClassIdle}, nil
+	case class == "best-effort" && level == "":
+		return IOPriority{Class: IOPrioClassBestEffort, Level: 4}, nil
+	case class == "best-effort":
+		n, err := strconv.Atoi(level)
+		if err != nil || n < 0 || n > 7 {
+			return IOPriority{}, fmt.Errorf("invalid I/O priority level in %q", s)
+		}
+		return IOPriority{Class: IOPrioClassBestEffort, Level: n}, nil
+	}
+	return IOPriority{}, fmt.Errorf("invalid I/O priority %q", s)
+}
+
+func (p IOPriority) String() string {
+	if p.Class == IOPrioClassIdle {
+		return "idle"
+	}
+	return fmt.Sprintf("best-effort:%d", p.Level)
+}
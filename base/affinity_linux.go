@@ -0,0 +1,66 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+// PinToCPUs locks the calling goroutine to its OS thread, then restricts that
+// thread to only run on the given CPUs.  The goroutine is never unlocked, so
+// when it exits, its thread is destroyed instead of going back to the runtime
+// with the restricted affinity.
+func PinToCPUs(cpus []int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		return fmt.Errorf("could not set CPU affinity to %v: %v", cpus, err)
+	}
+	return nil
+}
+
+// SetIOPriority locks the calling goroutine to its OS thread, then sets that
+// thread's I/O priority, like PinToCPUs does its affinity.  Reads done by the
+// goroutine afterwards are scheduled at that priority relative to other
+// processes' I/O on the same disk.
+func SetIOPriority(p IOPriority) error {
+	runtime.LockOSThread()
+	// A 'which' of 0 with IOPRIO_WHO_PROCESS is the calling thread.
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(p.Class<<ioprioClassShift|p.Level))
+	if errno != 0 {
+		return fmt.Errorf("could not set I/O priority to %v: %v", p, errno)
+	}
+	return nil
+}
+
+// ioPriority returns the calling thread's I/O priority.
+func ioPriority() (IOPriority, error) {
+	r, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		return IOPriority{}, errno
+	}
+	return IOPriority{Class: int(r) >> ioprioClassShift, Level: int(r) & (1<<ioprioClassShift - 1)}, nil
+}
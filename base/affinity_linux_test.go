@@ -0,0 +1,62 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPinToCPUs(t *testing.T) {
+	errs := make(chan error)
+	go func() {
+		if err := PinToCPUs([]int{0}); err != nil {
+			errs <- err
+			return
+		}
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err != nil {
+			errs <- err
+		} else if set.Count() != 1 || !set.IsSet(0) {
+			errs <- fmt.Errorf("wrong affinity, %d CPUs set", set.Count())
+		} else {
+			errs <- nil
+		}
+	}()
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSetIOPriority(t *testing.T) {
+	errs := make(chan error)
+	want := IOPriority{Class: IOPrioClassBestEffort, Level: 7}
+	go func() {
+		if err := SetIOPriority(want); err != nil {
+			errs <- err
+			return
+		}
+		got, err := ioPriority()
+		if err == nil && got != want {
+			err = fmt.Errorf("wrong I/O priority %v", got)
+		}
+		errs <- err
+	}()
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,32 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package base
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// PinToCPUs is only supported on Linux.
+func PinToCPUs(cpus []int) error {
+	return fmt.Errorf("could not set CPU affinity to %v: not supported on %s", cpus, runtime.GOOS)
+}
+
+// SetIOPriority is only supported on Linux.
+func SetIOPriority(p IOPriority) error {
+	return fmt.Errorf("could not set I/O priority to %v: not supported on %s", p, runtime.GOOS)
+}
@@ -0,0 +1,97 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+type arrivalOrderKey struct{}
+
+// WithArrivalOrder returns a context for lookups whose results needn't be in
+// time order, so each file's packets can be returned as soon as they're read
+// rather than after those of every earlier file.
+func WithArrivalOrder(ctx context.Context) context.Context {
+	return context.WithValue(ctx, arrivalOrderKey{}, true)
+}
+
+// ArrivalOrder returns whether lookups with the context may return packets in
+// the order they're read, see WithArrivalOrder.
+func ArrivalOrder(ctx context.Context) bool {
+	arrival, _ := ctx.Value(arrivalOrderKey{}).(bool)
+	return arrival
+}
+
+// FanInPacketChans passes along the packets of each of the chans from 'in' as
+// they arrive, reading all of them at once, until they're all closed.  Each
+// chan's packets keep their order, but those of different chans are
+// interleaved as they come.  The first error from any of them stops the rest.
+func FanInPacketChans(ctx context.Context, in <-chan *PacketChan) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var failed error
+		stop := make(chan struct{})
+		fail := func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if failed == nil {
+				failed = err
+				close(stop)
+			}
+		}
+		for c := range in {
+			wg.Add(1)
+			go func(c *PacketChan) {
+				defer wg.Done()
+				defer c.Discard()
+				for {
+					var pkt *Packet
+					select {
+					case pkt = <-c.Receive():
+					case <-ctx.Done():
+						return
+					case <-stop:
+						return
+					}
+					if pkt == nil {
+						if err := c.Err(); err != nil {
+							fail(err)
+						}
+						return
+					}
+					select {
+					case out.C <- pkt:
+					case <-ctx.Done():
+						pkt.Release()
+						return
+					case <-stop:
+						pkt.Release()
+						return
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+		if failed == nil {
+			failed = ctx.Err()
+		}
+		out.Close(failed)
+	}()
+	return out
+}
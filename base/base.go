@@ -25,28 +25,35 @@ import (
 	"sort"
 	"strconv"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
 	"golang.org/x/net/context"
 )
 
 var VerboseLogging = flag.Int("v", -1, "log many verbose logs")
 
-// V provides verbose logging which can be turned on/off with the -v flag.
+// V provides verbose logging which can be turned on/off with the -v flag, or
+// while running with SetVerbosity and SetModuleVerbosity.
 func V(level int, fmt string, args ...interface{}) {
-	if *VerboseLogging >= level {
+	if verbosityAt(1) >= level {
 		log.Printf(fmt, args...)
 	}
 }
 
 // Packet is a single packet with its metadata.
+//
+// A packet sent on a PacketChan belongs to whoever receives it, which may pass
+// it on in turn.  The final consumer may Release it once it's done with it
+// and its data, as the PacketsTo* writers do after writing each packet, so
+// anything else wanting to keep a packet it sees (like CopyWritten's
+// functions) must copy it.
 type Packet struct {
-	Data                 []byte // The actual bytes that make up the packet
-	gopacket.CaptureInfo        // Metadata about when/how the packet was captured
+	Data                 []byte       // The actual bytes that make up the packet
+	gopacket.CaptureInfo              // Metadata about when/how the packet was captured
+	Source               PacketSource // Where the packet was read from, if known.
+	pooled               *[]byte      // Buffer Data was taken from, see NewPooledPacket.
 }
 
 // PacketChan provides an async method for passing multiple ordered packets
@@ -59,6 +66,9 @@ type PacketChan struct {
 	C    chan<- *Packet
 	err  error
 	done chan struct{}
+	hash *ResultHash // Set by HashWritten.
+	// copies are called with each packet written, see CopyWritten.
+	copies []func(*Packet)
 }
 
 // Receive provides the channel from which to read packets.  It always
@@ -99,7 +109,8 @@ func NewPacketChan(buffer int) *PacketChan {
 func (p *PacketChan) Discard() {
 	go func() {
 		discarded := 0
-		for _ = range p.c {
+		for pkt := range p.c {
+			pkt.Release()
 			discarded++
 		}
 		if discarded > 0 {
@@ -294,22 +305,39 @@ func (a Positions) Intersect(b Positions) (out Positions) {
 	return out
 }
 
-func PathDiskFreePercentage(path string) (int, error) {
-	var stat syscall.Statfs_t
-	if err := syscall.Statfs(path, &stat); err != nil {
-		return 0, err
+// Difference returns the positions in a which aren't in b.  a and b must be
+// sorted in advance, and a must not be AllPositions.  Returned slice will be
+// sorted.
+// a may be returned by Difference, but neither a nor b will be modified.
+func (a Positions) Difference(b Positions) (out Positions) {
+	switch {
+	case b.IsAllPositions():
+		return NoPositions
+	case len(a) == 0 || len(b) == 0:
+		return a
 	}
-	return int(100 * stat.Bavail / stat.Blocks), nil
+	out = make(Positions, 0, len(a))
+	ib := 0
+	for _, pos := range a {
+		for ib < len(b) && b[ib] < pos {
+			ib++
+		}
+		if ib < len(b) && b[ib] == pos {
+			continue
+		}
+		out = append(out, pos)
+	}
+	return out
 }
 
-// snapLen is the max packet size we'll return in pcap files to users.
+// snapLen is the default max packet size we'll return in pcap files to users.
 const snapLen = 65536
 
 // PacketsToFile writes all packets from 'in' to 'out', writing out all packets
-// in a valid PCAP file format.
+// in a valid PCAP file format, described by OutputLinkLayer.
 func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
 	w := pcapgo.NewWriter(out)
-	w.WriteFileHeader(snapLen, layers.LinkTypeEthernet)
+	w.WriteFileHeader(uint32(OutputLinkLayer.SnapLen), OutputLinkLayer.Output)
 	count := 0
 	defer in.Discard()
 	defer func() {
@@ -321,17 +349,17 @@ func PacketsToFile(in *PacketChan, out io.Writer, limit Limit) error {
 		return nil
 	}
 	for p := range in.Receive() {
-		if len(p.Data) > snapLen {
-			p.Data = p.Data[:snapLen]
-		}
-		if err := w.WritePacket(p.CaptureInfo, p.Data); err != nil {
+		ci, data := OutputLinkLayer.frame(p)
+		if err := w.WritePacket(ci, data); err != nil {
 			// This can happen if our pipe is broken, and we don't want to blow stack
 			// traces all over our users when that happens, so Error/Exit instead of
 			// Fatal.
 			return fmt.Errorf("error writing packet: %v", err)
 		}
+		in.wrote(p)
+		p.Release()
 		count++
-		if limit.ShouldStopAfter(Limit{Bytes: int64(len(p.Data) + pcapHeaderSize), Packets: 1}) {
+		if limit.ShouldStopAfter(Limit{Bytes: int64(len(data) + pcapHeaderSize), Packets: 1}) {
 			return nil
 		}
 	}
@@ -15,12 +15,23 @@
 package base
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 	"golang.org/x/net/context"
 )
 
@@ -33,9 +44,9 @@ func testPacketData(t *testing.T) []*Packet {
 		{Timestamp: time.Unix(789, 789), CaptureLength: 3, Length: 3},
 	}
 
-	out := []*Packet{&Packet{[]byte{1, 2, 3}, ci[0]},
-		&Packet{[]byte{4, 5, 6}, ci[1]},
-		&Packet{[]byte{7, 8, 9}, ci[2]}}
+	out := []*Packet{&Packet{Data: []byte{1, 2, 3}, CaptureInfo: ci[0]},
+		&Packet{Data: []byte{4, 5, 6}, CaptureInfo: ci[1]},
+		&Packet{Data: []byte{7, 8, 9}, CaptureInfo: ci[2]}}
 	return out
 }
 
@@ -92,6 +103,44 @@ func TestMergePacketChans(t *testing.T) {
 	comparePacketChans(t, want, got)
 }
 
+func TestFanInPacketChans(t *testing.T) {
+	packets := testPacketData(t)
+	inputs := make(chan *PacketChan, 2)
+	slow, fast := NewPacketChan(100), NewPacketChan(100)
+	inputs <- slow
+	inputs <- fast
+	close(inputs)
+	fast.Send(packets[1])
+	fast.Close(nil)
+	got := FanInPacketChans(ctx, inputs)
+	// The fast chan's packets arrive without waiting for the slow one.
+	if p := <-got.Receive(); p != packets[1] {
+		t.Fatalf("got %v first, want %v", p, packets[1])
+	}
+	slow.Send(packets[0])
+	slow.Close(nil)
+	if p := <-got.Receive(); p != packets[0] {
+		t.Fatalf("got %v second, want %v", p, packets[0])
+	}
+	if p, ok := <-got.Receive(); ok || got.Err() != nil {
+		t.Errorf("got %v, %v after all packets", p, got.Err())
+	}
+
+	inputs = make(chan *PacketChan, 2)
+	failed, open := NewPacketChan(100), NewPacketChan(100)
+	inputs <- failed
+	inputs <- open
+	close(inputs)
+	failed.Close(errors.New("read failed"))
+	got = FanInPacketChans(ctx, inputs)
+	for range got.Receive() {
+	}
+	if got.Err() == nil {
+		t.Errorf("error not passed on")
+	}
+	open.Close(nil)
+}
+
 func TestUnion(t *testing.T) {
 	for _, test := range []struct {
 		a, b, want Positions
@@ -151,6 +200,38 @@ func TestIntersect(t *testing.T) {
 	}
 }
 
+func TestDifference(t *testing.T) {
+	for _, test := range []struct {
+		a, b, want Positions
+	}{
+		{
+			Positions{1, 2, 3, 4},
+			Positions{0, 2, 4, 5},
+			Positions{1, 3},
+		},
+		{
+			Positions{1, 2},
+			Positions{3, 4},
+			Positions{1, 2},
+		},
+		{
+			Positions{1, 2},
+			Positions{},
+			Positions{1, 2},
+		},
+		{
+			Positions{1, 2},
+			AllPositions,
+			Positions{},
+		},
+	} {
+		got := test.a.Difference(test.b)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("nope:\n   a: %v\n   b: %v\n got: %v\nwant: %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
 func TestPacketsToFile(t *testing.T) {
 	var out bytes.Buffer
 	packets := testPacketData(t)
@@ -171,6 +252,136 @@ func TestPacketsToFile(t *testing.T) {
 	}
 }
 
+// hashResults writes packets in the given format, returning the result hash.
+func hashResults(packets []*Packet, format string, limit Limit) string {
+	pc := NewPacketChan(len(packets))
+	for _, p := range packets {
+		pc.Send(&Packet{Data: append([]byte(nil), p.Data...), CaptureInfo: p.CaptureInfo})
+	}
+	pc.Close(nil)
+	h := NewResultHash()
+	HashWritten(pc, h)
+	switch format {
+	case "pcapng":
+		PacketsToPcapng(pc, ioutil.Discard, limit, Provenance{})
+	case "text":
+		PacketsToText(pc, ioutil.Discard, limit)
+	default:
+		PacketsToFile(pc, ioutil.Discard, limit)
+	}
+	return h.Sum()
+}
+
+func TestResultHash(t *testing.T) {
+	packets := testPacketData(t)
+	// With no packets sharing a timestamp, the hash is that of the PCAP.
+	pc := NewPacketChan(len(packets))
+	for _, p := range packets {
+		pc.Send(p)
+	}
+	pc.Close(nil)
+	var out bytes.Buffer
+	PacketsToFile(pc, &out, Limit{})
+	sum := sha256.Sum256(out.Bytes())
+	want := hex.EncodeToString(sum[:])
+	for _, format := range []string{"pcap", "pcapng", "text"} {
+		if got := hashResults(packets, format, Limit{}); got != want {
+			t.Errorf("%s hash %v, want %v", format, got, want)
+		}
+	}
+	// Packets sharing a timestamp may come in any order.
+	tied := []*Packet{packets[0], {Data: []byte{0, 0, 1}, CaptureInfo: packets[0].CaptureInfo}, packets[1]}
+	reordered := []*Packet{tied[1], tied[0], tied[2]}
+	if a, b := hashResults(tied, "pcap", Limit{}), hashResults(reordered, "pcap", Limit{}); a != b {
+		t.Errorf("reordering simultaneous packets changed hash from %v to %v", a, b)
+	}
+	// Only packets actually written count.
+	if got, want := hashResults(packets, "pcap", Limit{Packets: 2}), hashResults(packets[:2], "pcap", Limit{}); got != want {
+		t.Errorf("limited hash %v, want %v", got, want)
+	}
+}
+
+func TestPacketText(t *testing.T) {
+	eth := &layers.Ethernet{
+		SrcMAC:       []byte{0, 1, 2, 3, 4, 5},
+		DstMAC:       []byte{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    []byte{10, 0, 0, 1},
+		DstIP:    []byte{10, 0, 0, 2},
+	}
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, Seq: 100, Ack: 7, SYN: true, ACK: true, Window: 512}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload("hi")); err != nil {
+		t.Fatal(err)
+	}
+	p := &Packet{Data: buf.Bytes()}
+	p.Timestamp = time.Date(2015, 1, 1, 13, 14, 15, 123456000, time.UTC)
+	p.Length = len(p.Data)
+	want := "2015-01-01 13:14:15.123456 IP 10.0.0.1.1234 > 10.0.0.2.80: Flags [S.], seq 100:102, ack 7, win 512, length 2"
+	if got := PacketText(p); got != want {
+		t.Errorf("wrong text:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestDecapsulate(t *testing.T) {
+	inner := []byte{
+		6, 7, 8, 9, 10, 11, 0, 1, 2, 3, 4, 5, 0x08, 0x00, // ethernet
+		0x45, 0, 0, 20, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, // ipv4
+	}
+	outer := []byte{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 0x08, 0x00, // ethernet
+		0x45, 0, 0, 0, 0, 0, 0, 0, 64, 47, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, // ipv4, proto GRE
+		0x10, 0x00, 0x88, 0xbe, 0, 0, 0, 1, // GRE with sequence number, ERSPAN II
+		0x10, 0x01, 0, 0, 0, 0, 0, 0, // ERSPAN II header
+	}
+	p := &Packet{Data: append(outer, inner...)}
+	p.Length = len(p.Data)
+	p.CaptureLength = len(p.Data)
+	Decapsulate(p)
+	if !bytes.Equal(p.Data, inner) || p.Length != len(inner) || p.CaptureLength != len(inner) {
+		t.Errorf("wrong decapsulation:\nwant: %v\ngot:  %v (%+v)", inner, p.Data, p.CaptureInfo)
+	}
+	// Non-encapsulated packets should be left alone.
+	Decapsulate(p)
+	if !bytes.Equal(p.Data, inner) {
+		t.Errorf("non-encapsulated packet modified: %v", p.Data)
+	}
+	// 4in4 tunnels keep the outer ethernet header.
+	tunnel := append(append([]byte{}, outer[:34]...), inner[14:]...)
+	tunnel[23] = 4 // IPv4 protocol number for IP-in-IP
+	p = &Packet{Data: tunnel}
+	Decapsulate(p)
+	if want := append(append([]byte{}, outer[:14]...), inner[14:]...); !bytes.Equal(p.Data, want) {
+		t.Errorf("wrong tunnel decapsulation:\nwant: %v\ngot:  %v", want, p.Data)
+	}
+	// Teredo tunnels IPv6 over UDP, possibly after an origin indication.
+	ip6 := make([]byte, 40)
+	ip6[0] = 0x60
+	teredo := append(append([]byte{}, outer[:34]...),
+		0x0d, 0xd8, 0xc0, 0x00, 0, 0, 0, 0, // udp from port 3544
+		0, 0, 0x12, 0x34, 1, 2, 3, 4, // origin indication
+	)
+	teredo[23] = 17
+	p = &Packet{Data: append(teredo, ip6...)}
+	Decapsulate(p)
+	if want := append(append([]byte{}, outer[:12]...), append([]byte{0x86, 0xdd}, ip6...)...); !bytes.Equal(p.Data, want) {
+		t.Errorf("wrong teredo decapsulation:\nwant: %v\ngot:  %v", want, p.Data)
+	}
+	// Other UDP is left alone.
+	teredo[35] = 0
+	p = &Packet{Data: append(teredo, ip6...)}
+	if Decapsulate(p); len(p.Data) != len(teredo)+len(ip6) {
+		t.Errorf("non-teredo UDP packet decapsulated")
+	}
+}
+
 func TestContextDone(t *testing.T) {
 	ctx := NewContext(0)
 	if ContextDone(ctx) {
@@ -186,3 +397,772 @@ func TestContextDone(t *testing.T) {
 		t.Fatal("should have timed out by now")
 	}
 }
+
+func TestQueryTimings(t *testing.T) {
+	var q QueryTimings
+	ctx := WithQueryTimings(ctx, &q)
+	if QueryTimingsFrom(ctx) != &q {
+		t.Fatal("context lost query timings")
+	}
+	if FileTimingsFrom(ctx) != nil {
+		t.Fatal("context has unexpected file timings")
+	}
+	f := q.File(1, "b")
+	if FileTimingsFrom(WithFileTimings(ctx, f)) != f {
+		t.Fatal("context lost file timings")
+	}
+	f.Record(3, time.Second, 2*time.Second, 3*time.Second)
+	q.File(0, "c").Record(1, 1, 1, 1)
+	q.File(1, "a").Record(2, time.Second, time.Second, time.Second)
+	got := q.Summary()
+	want := QueryTimingsSummary{
+		Threads: []ThreadTimings{
+			{Thread: 0, Files: 1, Packets: 1, IndexLookup: 1, PacketRead: 1, ChannelSend: 1},
+			{Thread: 1, Files: 2, Packets: 5, IndexLookup: 2 * time.Second, PacketRead: 3 * time.Second, ChannelSend: 4 * time.Second},
+		},
+		Files: []FileTimings{
+			{Thread: 0, File: "c", Packets: 1, IndexLookup: 1, PacketRead: 1, ChannelSend: 1},
+			{Thread: 1, File: "a", Packets: 2, IndexLookup: time.Second, PacketRead: time.Second, ChannelSend: time.Second},
+			{Thread: 1, File: "b", Packets: 3, IndexLookup: time.Second, PacketRead: 2 * time.Second, ChannelSend: 3 * time.Second},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong summary:\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
+func udpPacket(t *testing.T, sec int64, src, dst byte, sport, dport layers.UDPPort) *Packet {
+	eth := &layers.Ethernet{
+		SrcMAC:       []byte{0, 1, 2, 3, 4, 5},
+		DstMAC:       []byte{6, 7, 8, 9, 10, 11},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    []byte{10, 0, 0, src},
+		DstIP:    []byte{10, 0, 0, dst},
+	}
+	udp := &layers.UDP{SrcPort: sport, DstPort: dport}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, udp); err != nil {
+		t.Fatal(err)
+	}
+	p := &Packet{Data: buf.Bytes()}
+	p.Timestamp = time.Unix(sec, 0)
+	return p
+}
+
+func TestGroupPacketsByFlow(t *testing.T) {
+	in := []*Packet{
+		udpPacket(t, 1, 1, 2, 1000, 53),
+		udpPacket(t, 2, 3, 4, 1000, 53),
+		udpPacket(t, 3, 2, 1, 53, 1000), // reply, same flow as 1
+		udpPacket(t, 4, 1, 2, 1001, 53), // new source port, new flow
+		udpPacket(t, 5, 4, 3, 53, 1000),
+		udpPacket(t, 6, 1, 2, 1000, 53),
+	}
+	// Unlimited, spilling after a few packets, and spilling from the start.
+	for _, budget := range []*MemoryBudget{nil, NewMemoryBudget(400), NewMemoryBudget(0)} {
+		c := NewPacketChan(len(in))
+		for _, p := range in {
+			c.Send(p)
+		}
+		c.Close(nil)
+		var got []int64
+		out := GroupPacketsByFlow(WithMemoryBudget(ctx, budget), c)
+		for p := range out.Receive() {
+			got = append(got, p.Timestamp.Unix())
+			if want := in[p.Timestamp.Unix()-1]; !bytes.Equal(p.Data, want.Data) || p.Length != want.Length {
+				t.Errorf("packet %d mismatch", p.Timestamp.Unix())
+			}
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if want := []int64{1, 3, 6, 2, 5, 4}; !reflect.DeepEqual(got, want) {
+			t.Errorf("wrong flow order:\nwant: %v\ngot:  %v", want, got)
+		}
+	}
+}
+
+func TestFirstPacketsPerFlow(t *testing.T) {
+	in := []*Packet{
+		udpPacket(t, 1, 1, 2, 1000, 53),
+		udpPacket(t, 2, 3, 4, 1000, 53),
+		udpPacket(t, 3, 2, 1, 53, 1000), // reply, same flow as 1
+		udpPacket(t, 4, 1, 2, 1001, 53), // new source port, new flow
+		udpPacket(t, 5, 4, 3, 53, 1000),
+		udpPacket(t, 6, 1, 2, 1000, 53),
+		udpPacket(t, 7, 3, 4, 1000, 53),
+	}
+	for _, test := range []struct {
+		n    int
+		want []int64
+	}{
+		{1, []int64{1, 2, 4}},
+		{2, []int64{1, 2, 3, 4, 5}},
+		{3, []int64{1, 2, 3, 4, 5, 6, 7}},
+	} {
+		c := NewPacketChan(len(in))
+		for _, p := range in {
+			c.Send(p)
+		}
+		c.Close(nil)
+		var got []int64
+		out := FirstPacketsPerFlow(c, test.n)
+		for p := range out.Receive() {
+			got = append(got, p.Timestamp.Unix())
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("first %d per flow: want %v got %v", test.n, test.want, got)
+		}
+	}
+}
+
+func TestPacketsToFlowTar(t *testing.T) {
+	in := NewPacketChan(10)
+	for _, p := range []*Packet{
+		udpPacket(t, 1, 1, 2, 1000, 53),
+		udpPacket(t, 2, 2, 1, 53, 1000),
+		udpPacket(t, 3, 3, 4, 1000, 53),
+	} {
+		p.CaptureLength, p.Length = len(p.Data), len(p.Data)
+		in.Send(p)
+	}
+	in.Close(nil)
+	var buf bytes.Buffer
+	if err := PacketsToFlowTar(in, &buf, Limit{}); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	var names []string
+	var counts []int
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		r, err := pcapgo.NewReader(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, _, err := r.ReadPacketData(); err == nil; _, _, err = r.ReadPacketData() {
+			n++
+		}
+		counts = append(counts, n)
+	}
+	if want := []string{"000001_udp_10.0.0.1_1000_10.0.0.2_53.pcap", "000002_udp_10.0.0.3_1000_10.0.0.4_53.pcap"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+	if want := []int{2, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got packets per file %v, want %v", counts, want)
+	}
+}
+
+func TestPacketsToChunkTar(t *testing.T) {
+	size := int64(16 + len(udpPacket(t, 0, 1, 2, 1000, 53).Data)) // With its PCAP header.
+	for _, test := range []struct {
+		maxBytes    int64
+		maxDuration time.Duration
+		want        []int // Packets per chunk.
+	}{
+		{0, 0, []int{5}},
+		{0, 5 * time.Second, []int{3, 2}},
+		{24 + 2*size, 0, []int{2, 2, 1}},
+		{1, 0, []int{1, 1, 1, 1, 1}},
+	} {
+		in := NewPacketChan(10)
+		for _, sec := range []int64{1, 2, 3, 10, 11} {
+			p := udpPacket(t, sec, 1, 2, 1000, 53)
+			p.CaptureLength, p.Length = len(p.Data), len(p.Data)
+			in.Send(p)
+		}
+		in.Close(nil)
+		var buf bytes.Buffer
+		if err := PacketsToChunkTar(in, &buf, Limit{}, test.maxBytes, test.maxDuration); err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(&buf)
+		var counts []int
+		var manifest []Chunk
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if hdr.Name == ChunkManifestName {
+				if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			r, err := pcapgo.NewReader(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			for _, _, err := r.ReadPacketData(); err == nil; _, _, err = r.ReadPacketData() {
+				n++
+			}
+			counts = append(counts, n)
+		}
+		if !reflect.DeepEqual(counts, test.want) {
+			t.Errorf("%d bytes, %v: got packets per chunk %v, want %v", test.maxBytes, test.maxDuration, counts, test.want)
+		}
+		if len(manifest) != len(counts) {
+			t.Fatalf("%d bytes, %v: got manifest %+v for %d chunks", test.maxBytes, test.maxDuration, manifest, len(counts))
+		}
+		for i, c := range manifest {
+			if c.Name != fmt.Sprintf("%06d.pcap", i+1) || c.Packets != counts[i] || c.End.Before(c.Start) {
+				t.Errorf("%d bytes, %v: bad manifest entry %+v", test.maxBytes, test.maxDuration, c)
+			}
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	a, b := NewHistogram(time.Minute), NewHistogram(time.Minute)
+	a.Add(at(61), 1, 100)
+	a.Add(at(0), 2, 200)
+	b.Add(at(119), 3, 300)
+	b.Add(at(600), 1, 50)
+	a.Merge(b)
+	want := []HistogramBucket{
+		{at(0).UTC(), 2, 200},
+		{at(60).UTC(), 4, 400},
+		{at(600).UTC(), 1, 50},
+	}
+	if got := a.Buckets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v got %v", want, got)
+	}
+	// Only buckets entirely in the window are kept.
+	a.Clip(at(30), at(630))
+	if got := a.Buckets(); !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("clipped: want %v got %v", want[1:2], got)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100)
+	if err := b.Reserve(60); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Reserve(60); err == nil {
+		t.Errorf("reserved past limit")
+	} else if _, ok := err.(*MemoryLimitError); !ok {
+		t.Errorf("wrong error type %T", err)
+	}
+	b.Release(50)
+	if err := b.Reserve(60); err != nil {
+		t.Error(err)
+	}
+	if got := b.Peak(); got != 70 {
+		t.Errorf("wrong peak: want 70 got %d", got)
+	}
+	var unlimited *MemoryBudget
+	if err := unlimited.Reserve(1 << 62); err != nil {
+		t.Error(err)
+	}
+	unlimited.Release(1 << 62)
+}
+
+func TestParseCPUList(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []int
+	}{
+		{"0", []int{0}},
+		{"0-3,8", []int{0, 1, 2, 3, 8}},
+		{"2,4-5\n", []int{2, 4, 5}},
+		{"", nil},
+		{"3-1", nil},
+		{"a", nil},
+		{"1,", nil},
+		{"-1", nil},
+	} {
+		got, err := ParseCPUList(test.in)
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.in, got)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: want %v got %v", test.in, test.want, got)
+		}
+	}
+}
+
+func TestParseIOPriority(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want IOPriority
+		ok   bool
+	}{
+		{"idle", IOPriority{Class: IOPrioClassIdle}, true},
+		{"best-effort", IOPriority{Class: IOPrioClassBestEffort, Level: 4}, true},
+		{"best-effort:7", IOPriority{Class: IOPrioClassBestEffort, Level: 7}, true},
+		{"best-effort:8", IOPriority{}, false},
+		{"idle:3", IOPriority{}, false},
+		{"realtime", IOPriority{}, false},
+		{"", IOPriority{}, false},
+	} {
+		got, err := ParseIOPriority(test.in)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", test.in, got)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if got != test.want {
+			t.Errorf("%q: want %v got %v", test.in, test.want, got)
+		}
+	}
+}
+
+func TestQueryProgress(t *testing.T) {
+	var p QueryProgress
+	p.Start(0, "a", time.Unix(10, 0))
+	p.Start(1, "b", time.Unix(20, 0))
+	p.Start(0, "c", time.Unix(30, 0))
+	p.Finish(0, "a", time.Unix(10, 0))
+	p.Returned(&Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(15, 0)}})
+	p.Returned(&Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(12, 0)}})
+	want := PartialSummary{
+		CompleteBefore: time.Unix(15, 0),
+		SkippedFiles: []SkippedFile{
+			{Thread: 1, File: "b", Start: time.Unix(20, 0)},
+			{Thread: 0, File: "c", Start: time.Unix(30, 0)},
+		},
+	}
+	if got := p.Summary(true); !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong summary:\nwant: %+v\ngot:  %+v", want, got)
+	}
+	p.Finish(1, "b", time.Unix(20, 0))
+	p.Finish(0, "c", time.Unix(30, 0))
+	if got := p.Summary(true); !got.Complete || len(got.SkippedFiles) != 0 {
+		t.Errorf("want complete summary, got %+v", got)
+	}
+	if got := p.Summary(false); got.Complete {
+		t.Errorf("query which didn't finish marked complete")
+	}
+}
+
+func TestPacketsToPcapng(t *testing.T) {
+	in := []*Packet{udpPacket(t, 1, 1, 2, 1000, 53), udpPacket(t, 2, 2, 1, 53, 1000)}
+	in[1].Timestamp = time.Unix(2, 123456789)
+	in[0].Source = PacketSource{Thread: 2, File: "/path/PKT2/1420117331000000", Offset: 4096}
+	c := NewPacketChan(len(in))
+	for _, p := range in {
+		p.Length = len(p.Data) + 10
+		c.Send(p)
+	}
+	c.Close(nil)
+	prov := Provenance{Query: "port 53 and host 10.0.0.1", SensorID: "sensor-1", Version: "1.2.3"}
+	var buf bytes.Buffer
+	if err := PacketsToPcapng(c, &buf, Limit{}, prov); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := json.Marshal(prov)
+	if !bytes.Contains(buf.Bytes(), info) {
+		t.Errorf("provenance %s missing from output", info)
+	}
+	if comment := "thread 2, blockfile 1420117331000000 @ 4096"; !bytes.Contains(buf.Bytes(), []byte(comment)) {
+		t.Errorf("packet comment %q missing from output", comment)
+	}
+	r, err := pcapgo.NewNgReader(bytes.NewReader(buf.Bytes()), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range in {
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(data, want.Data) || !ci.Timestamp.Equal(want.Timestamp) || ci.Length != want.Length {
+			t.Errorf("packet %d mismatch: got %v %v", i, ci.Timestamp, ci.Length)
+		}
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestLinkLayer(t *testing.T) {
+	defer func(l LinkLayer) { OutputLinkLayer = l }(OutputLinkLayer)
+	eth := udpPacket(t, 1, 1, 2, 1000, 53)
+	ip := eth.Data[14:]
+	sll := append([]byte{0, 0, 0, 1, 0, 6, 0, 1, 2, 3, 4, 5, 0, 0, 8, 0}, ip...)
+	for _, test := range []struct {
+		capture, output string
+		snaplen         int
+		data            []byte
+		wantType        layers.LinkType
+		want            []byte
+		wantLen         int
+	}{
+		{"", "", 0, eth.Data, layers.LinkTypeEthernet, eth.Data, len(eth.Data)},
+		{"raw", "", 0, ip, layers.LinkTypeRaw, ip, len(ip)},
+		{"LINKTYPE_RAW", "ethernet", 0, ip, layers.LinkTypeEthernet, append(make([]byte, 12), append([]byte{8, 0}, ip...)...), len(ip) + 14},
+		{"linux_sll", "1", 0, sll, layers.LinkTypeEthernet, append([]byte{0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4, 5, 8, 0}, ip...), len(ip) + 14},
+		{"ethernet", "", 20, eth.Data, layers.LinkTypeEthernet, eth.Data[:20], len(eth.Data)},
+	} {
+		var err error
+		if OutputLinkLayer, err = NewLinkLayer(test.capture, test.output, test.snaplen, "tun0"); err != nil {
+			t.Fatalf("%q to %q: %v", test.capture, test.output, err)
+		}
+		c := NewPacketChan(1)
+		c.Send(&Packet{Data: test.data, CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(1, 0), CaptureLength: len(test.data), Length: len(test.data)}})
+		c.Close(nil)
+		var buf bytes.Buffer
+		if err := PacketsToFile(c, &buf, Limit{}); err != nil {
+			t.Fatal(err)
+		}
+		r, err := pcapgo.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.LinkType() != test.wantType || int(r.Snaplen()) != OutputLinkLayer.SnapLen {
+			t.Errorf("%q to %q: got link type %v snaplen %d", test.capture, test.output, r.LinkType(), r.Snaplen())
+		}
+		data, ci, err := r.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, test.want) || ci.Length != test.wantLen {
+			t.Errorf("%q to %q: got packet %v of length %d, want %v of length %d", test.capture, test.output, data, ci.Length, test.want, test.wantLen)
+		}
+	}
+	for _, test := range []struct{ capture, output string }{
+		{"ethernet", "raw"},
+		{"token_ring", ""},
+		{"256", ""},
+	} {
+		if _, err := NewLinkLayer(test.capture, test.output, 0, ""); err == nil {
+			t.Errorf("%q to %q: expected error", test.capture, test.output)
+		}
+	}
+	if _, err := NewLinkLayer("", "", maxSnapLen+1, ""); err == nil {
+		t.Errorf("expected error for snaplen %d", maxSnapLen+1)
+	}
+}
+
+func TestSetVerbosity(t *testing.T) {
+	defer SetVerbosity(Verbosity())
+	SetVerbosity(3)
+	if got := Verbosity(); got != 3 {
+		t.Errorf("got verbosity %d, want 3", got)
+	}
+}
+
+func TestModuleVerbosity(t *testing.T) {
+	defer SetVerbosity(Verbosity())
+	SetVerbosity(1)
+	SetModuleVerbosity("base", 5)
+	defer ClearModuleVerbosity("base")
+	if got := ModuleVerbosity("base"); got != 5 {
+		t.Errorf("got base verbosity %d, want 5", got)
+	}
+	if got := ModuleVerbosity("blockfile"); got != 1 {
+		t.Errorf("got blockfile verbosity %d, want 1", got)
+	}
+	if got := verbosityAt(0); got != 5 {
+		t.Errorf("got caller verbosity %d, want 5", got)
+	}
+	ClearModuleVerbosity("base")
+	if got := verbosityAt(0); got != 1 {
+		t.Errorf("got caller verbosity %d after clear, want 1", got)
+	}
+}
+
+func TestResumePacketChan(t *testing.T) {
+	in := NewPacketChan(10)
+	for _, micros := range []int64{1, 2, 2, 2, 3} {
+		in.Send(&Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(0, micros*1000+int64(len(in.c)))}})
+	}
+	in.Close(nil)
+	// Resume after the client received the packets at 1 and the first at 2.
+	var c Cursor
+	c.Advance(time.Unix(0, 1000))
+	c.Advance(time.Unix(0, 2000))
+	if c.Skip != 1 {
+		t.Fatalf("got cursor %+v, want skip 1", c)
+	}
+	var got []int64
+	for p := range ResumePacketChan(in, c).Receive() {
+		got = append(got, p.Timestamp.UnixNano()/1000)
+	}
+	if want := []int64{2, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got packets at %v, want %v", got, want)
+	}
+}
+
+func TestWindowPacketChan(t *testing.T) {
+	in := NewPacketChan(10)
+	for _, sec := range []int64{1, 2, 3, 4} {
+		in.Send(&Packet{CaptureInfo: gopacket.CaptureInfo{Timestamp: time.Unix(sec, 0)}})
+	}
+	in.Close(nil)
+	var got []int64
+	for p := range WindowPacketChan(in, time.Unix(2, 0), time.Unix(4, 0)).Receive() {
+		got = append(got, p.Timestamp.Unix())
+	}
+	if want := []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got packets at %v, want %v", got, want)
+	}
+}
+
+func TestWatchStalls(t *testing.T) {
+	send := func(n int) *PacketChan {
+		in := NewPacketChan(n)
+		for i := 0; i < n; i++ {
+			in.Send(&Packet{})
+		}
+		in.Close(nil)
+		return in
+	}
+	// A consumer which pauses past the timeout is reported, but gets
+	// everything.
+	stalls := 0
+	out := WatchStalls(send(150), 10*time.Millisecond, func() error { stalls++; return nil })
+	time.Sleep(15 * time.Millisecond)
+	got := 0
+	for range out.Receive() {
+		got++
+	}
+	if got != 150 || out.Err() != nil {
+		t.Errorf("got %d packets and error %v, want 150 and nil", got, out.Err())
+	}
+	if stalls == 0 {
+		t.Error("got no stalls")
+	}
+	// An aborting one gets what was buffered, then the error.
+	stall := &StallError{Timeout: 10 * time.Millisecond}
+	out = WatchStalls(send(150), stall.Timeout, func() error { return stall })
+	time.Sleep(50 * time.Millisecond)
+	got = 0
+	for range out.Receive() {
+		got++
+	}
+	if got != 100 || out.Err() != stall {
+		t.Errorf("got %d packets and error %v, want 100 and %v", got, out.Err(), stall)
+	}
+}
+
+func TestClockUTC(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	want := time.Date(2015, 7, 1, 14, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		clock Clock
+		t     time.Time
+	}{
+		{Clock{}, want.In(ny)},
+		{Clock{Source: "utc"}, want},
+		{Clock{Source: "tai"}, want.Add(37 * time.Second)},
+		// 10am in New York in the summer, recorded as 10am UTC.
+		{Clock{Source: "local", Location: ny}, time.Date(2015, 7, 1, 10, 0, 0, 0, time.UTC)},
+	} {
+		got := test.clock.UTC(test.t)
+		if !got.Equal(want) || got.Location() != time.UTC {
+			t.Errorf("%+v converted %v to %v, want %v", test.clock, test.t, got, want)
+		}
+	}
+}
+
+// serializeIP returns an Ethernet frame of a TCP (IPv4) or UDP (IPv6) packet
+// between the given addresses, with valid checksums.
+func serializeIP(t *testing.T, src, dst net.IP, payload []byte) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC: net.HardwareAddr{0, 0x1b, 0x21, 1, 2, 3},
+		DstMAC: net.HardwareAddr{0, 0x1b, 0x21, 4, 5, 6},
+	}
+	var network gopacket.NetworkLayer
+	var transport gopacket.SerializableLayer
+	if src.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+		tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, ACK: true, Window: 100}
+		tcp.SetNetworkLayerForChecksum(ip)
+		network, transport = ip, tcp
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: src, DstIP: dst}
+		udp := &layers.UDP{SrcPort: 1234, DstPort: 53}
+		udp.SetNetworkLayerForChecksum(ip)
+		network, transport = ip, udp
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, network.(gopacket.SerializableLayer), transport, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTransforms(t *testing.T) {
+	// From the Crypto-PAn reference implementation's sample trace.
+	key := []byte{21, 34, 23, 141, 51, 164, 207, 128, 19, 10, 91, 22, 73, 144, 125, 16, 216, 152, 143, 131, 121, 121, 101, 39, 98, 87, 76, 45, 42, 132, 34, 2}
+	cp, err := NewCryptoPAN(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for orig, want := range map[string]string{
+		"128.11.68.132":   "135.242.180.132",
+		"129.118.74.4":    "134.136.186.123",
+		"130.132.252.244": "133.68.164.234",
+	} {
+		if got := net.IP(cp.Anonymize(net.ParseIP(orig).To4())); got.String() != want {
+			t.Errorf("anonymized %v to %v, want %v", orig, got, want)
+		}
+	}
+	a, b := cp.Anonymize(net.ParseIP("2001:db8::1")), cp.Anonymize(net.ParseIP("2001:db8::2"))
+	if !bytes.Equal(a[:15], b[:15]) || a[15] == b[15] {
+		t.Errorf("IPv6 prefix not preserved: %v, %v", net.IP(a), net.IP(b))
+	}
+
+	if _, err := TransformNames([]string{"cryptopan", "bogus"}); err == nil {
+		t.Errorf("unknown transform accepted")
+	}
+	names, err := TransformNames([]string{"cryptopan", "zero_payload", "cryptopan"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(names, []string{"zero_payload", "cryptopan"}) {
+		t.Errorf("got names %v", names)
+	}
+	if _, err := NewTransforms(names, nil); err == nil {
+		t.Errorf("cryptopan allowed without a key")
+	}
+
+	// Anonymized packets have the same checksums as if they'd been sent
+	// between the anonymized addresses.
+	for _, addrs := range [][2]string{{"10.1.2.3", "192.168.7.8"}, {"2001:db8::1", "fe80::1234"}} {
+		src, dst := net.ParseIP(addrs[0]), net.ParseIP(addrs[1])
+		if v4 := src.To4(); v4 != nil {
+			src, dst = v4, dst.To4()
+		}
+		tr, err := NewTransforms([]string{"mask_macs", "cryptopan"}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &Packet{Data: serializeIP(t, src, dst, []byte("secret"))}
+		tr.Transform(p)
+		want := serializeIP(t, cp.Anonymize(src), cp.Anonymize(dst), []byte("secret"))
+		copy(want[3:6], []byte{0, 0, 0})
+		copy(want[9:12], []byte{0, 0, 0})
+		if !bytes.Equal(p.Data, want) {
+			t.Errorf("%v: got packet\n%x\nwant\n%x", addrs, p.Data, want)
+		}
+
+		zero, _ := NewTransforms([]string{"zero_payload"}, nil)
+		zero.Transform(p)
+		if !bytes.HasSuffix(p.Data, make([]byte, 6)) || !bytes.Equal(p.Data[:len(p.Data)-6], want[:len(want)-6]) {
+			t.Errorf("%v: payload not zeroed: %x", addrs, p.Data)
+		}
+	}
+}
+
+func TestPayloadSlice(t *testing.T) {
+	for _, addrs := range [][2]string{{"10.1.2.3", "192.168.7.8"}, {"2001:db8::1", "fe80::1234"}} {
+		src, dst := net.ParseIP(addrs[0]), net.ParseIP(addrs[1])
+		if v4 := src.To4(); v4 != nil {
+			src, dst = v4, dst.To4()
+		}
+		full := serializeIP(t, src, dst, []byte("SSH-2.0-OpenSSH_9.6"))
+		headers := len(full) - len("SSH-2.0-OpenSSH_9.6")
+		for _, test := range []struct {
+			offset, length int
+			want           string
+		}{
+			{0, 7, "SSH-2.0"},
+			{4, 3, "\x00\x00\x00\x002.0"},
+			{8, -1, "\x00\x00\x00\x00\x00\x00\x00\x00OpenSSH_9.6"},
+			{0, 0, ""},
+			{100, 10, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		} {
+			p := &Packet{Data: append([]byte{}, full...)}
+			p.CaptureLength, p.Length = len(full), len(full)
+			PayloadSlice(test.offset, test.length).Transform(p)
+			if !bytes.Equal(p.Data[:headers], full[:headers]) {
+				t.Errorf("%v %d,%d: headers changed", addrs, test.offset, test.length)
+			}
+			if got := string(p.Data[headers:]); got != test.want {
+				t.Errorf("%v %d,%d: got payload %q, want %q", addrs, test.offset, test.length, got, test.want)
+			}
+			if p.CaptureLength != len(p.Data) || p.Length != len(full) {
+				t.Errorf("%v %d,%d: got lengths %d/%d", addrs, test.offset, test.length, p.CaptureLength, p.Length)
+			}
+		}
+	}
+}
+
+func TestPooledPacket(t *testing.T) {
+	for _, n := range []int{0, 1, 256, 257, 1514, maxPooledSize, maxPooledSize + 1} {
+		p := NewPooledPacket(n)
+		if len(p.Data) != n {
+			t.Errorf("packet of %d bytes has %d", n, len(p.Data))
+		}
+		if pooled := p.pooled != nil; pooled != (n <= maxPooledSize) {
+			t.Errorf("packet of %d bytes pooled: %v", n, pooled)
+		}
+		p.Release()
+		if n <= maxPooledSize && p.Data != nil {
+			t.Errorf("packet of %d bytes still has data after release", n)
+		}
+		p.Release() // No-op.
+	}
+	if c := sizeClass(cap(*NewPooledPacket(1514).pooled)); c != sizeClass(1514) {
+		t.Errorf("1514 byte packet in size class %d, want %d", c, sizeClass(1514))
+	}
+	// Releasing packets that weren't pooled is fine.
+	(&Packet{Data: []byte{1}}).Release()
+}
+
+func TestFileNames(t *testing.T) {
+	start := time.Unix(1420117331, 123456000)
+	for _, test := range []struct {
+		template, sensor, want string
+	}{
+		{DefaultFileNameTemplate, "", "1420117331123456"},
+		{"{sensor}_t{thread}_{utc}", "dc1-tap", "dc1-tap_t3_20150101T130211.123456Z"},
+		{"{micros}.t{thread}", "", "1420117331123456.t3"},
+	} {
+		f, err := NewFileNames(test.template, test.sensor)
+		if err != nil {
+			t.Fatalf("%q: %v", test.template, err)
+		}
+		name := f.Name(start, 3)
+		if name != test.want {
+			t.Errorf("%q: got name %q, want %q", test.template, name, test.want)
+		}
+		if got, err := f.Time(name); err != nil || !got.Equal(start) {
+			t.Errorf("%q: got time %v (%v) from %q, want %v", test.template, got, err, name, start)
+		}
+		// Files named before the template changed are still understood.
+		if got, err := f.Time("1420117331123456"); err != nil || !got.Equal(start) {
+			t.Errorf("%q: got time %v (%v) from default name", test.template, got, err)
+		}
+		if _, err := f.Time("dhcp"); err == nil {
+			t.Errorf("%q: got time from %q", test.template, "dhcp")
+		}
+	}
+	for _, template := range []string{"t{thread}", "{micros}_{utc}", "{micros}{bogus}", ".{micros}", "PKT{micros}", "{sensor}/{micros}"} {
+		if _, err := NewFileNames(template, "a/b"); err == nil {
+			t.Errorf("%q accepted", template)
+		}
+	}
+}
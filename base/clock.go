@@ -0,0 +1,44 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"time"
+)
+
+// TAIOffset is how far TAI is ahead of UTC, which it has been since the leap
+// second at the end of 2016.
+const TAIOffset = 37 * time.Second
+
+// Clock describes what the capture timestamps in blockfiles are measured in,
+// so they can be converted to UTC.
+type Clock struct {
+	// Source is "utc" (or empty), "tai", or "local" for wall clock time in
+	// Location, recorded as though it were UTC.
+	Source   string
+	Location *time.Location
+}
+
+// UTC converts a capture timestamp to UTC.
+func (c Clock) UTC(t time.Time) time.Time {
+	switch c.Source {
+	case "tai":
+		t = t.Add(-TAIOffset)
+	case "local":
+		u := t.UTC()
+		t = time.Date(u.Year(), u.Month(), u.Day(), u.Hour(), u.Minute(), u.Second(), u.Nanosecond(), c.Location)
+	}
+	return t.UTC()
+}
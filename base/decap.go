@@ -0,0 +1,207 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/binary"
+)
+
+const (
+	ethernetHeaderLen = 14
+
+	etherTypeIPv4   = 0x0800
+	etherTypeIPv6   = 0x86DD
+	etherTypeVLAN   = 0x8100
+	etherTypeQinQ   = 0x88A8
+	ipProtoIPIP     = 4
+	ipProtoIPv6     = 41
+	ipProtoGRE      = 47
+	greTypeERSPAN2  = 0x88BE // ERSPAN types I and II
+	greTypeERSPAN3  = 0x22EB // ERSPAN type III
+	greChecksumFlag = 0x8000
+	greKeyFlag      = 0x2000
+	greSequenceFlag = 0x1000
+	teredoPort      = 3544
+)
+
+// TransformPacketChan returns a new PacketChan which passes along every packet
+// from 'in' after calling 'fn' on it.  'fn' may modify the packet in place.
+func TransformPacketChan(in *PacketChan, fn func(*Packet)) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for p := range in.Receive() {
+			fn(p)
+			out.Send(p)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// ipPayload returns the IP protocol and payload of an Ethernet frame, skipping
+// any VLAN tags.  ok is false if the frame isn't a valid IPv4/IPv6 packet.
+func ipPayload(data []byte) (proto byte, payload []byte, ok bool) {
+	if len(data) < ethernetHeaderLen {
+		return 0, nil, false
+	}
+	etherType := binary.BigEndian.Uint16(data[12:])
+	data = data[ethernetHeaderLen:]
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < 4 {
+			return 0, nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[2:])
+		data = data[4:]
+	}
+	switch etherType {
+	case etherTypeIPv4:
+		if len(data) < 20 {
+			return 0, nil, false
+		}
+		ihl := int(data[0]&0x0F) * 4
+		if ihl < 20 || len(data) < ihl {
+			return 0, nil, false
+		}
+		return data[9], data[ihl:], true
+	case etherTypeIPv6:
+		if len(data) < 40 {
+			return 0, nil, false
+		}
+		return data[6], data[40:], true
+	}
+	return 0, nil, false
+}
+
+// ERSPANFrame returns the Ethernet frame encapsulated within an ERSPAN (type
+// I, II, or III) packet.  ok is false if data is not an ERSPAN packet.
+func ERSPANFrame(data []byte) (inner []byte, ok bool) {
+	proto, gre, ok := ipPayload(data)
+	if !ok || proto != ipProtoGRE || len(gre) < 4 {
+		return nil, false
+	}
+	flags := binary.BigEndian.Uint16(gre)
+	greType := binary.BigEndian.Uint16(gre[2:])
+	offset := 4
+	if flags&greChecksumFlag != 0 {
+		offset += 4
+	}
+	if flags&greKeyFlag != 0 {
+		offset += 4
+	}
+	hasSequence := flags&greSequenceFlag != 0
+	if hasSequence {
+		offset += 4
+	}
+	switch greType {
+	case greTypeERSPAN2:
+		// Type II has an 8-byte ERSPAN header, type I (no sequence) has none.
+		if hasSequence {
+			offset += 8
+		}
+	case greTypeERSPAN3:
+		if len(gre) < offset+12 {
+			return nil, false
+		}
+		// The low bit of the last header byte flags an optional 8-byte
+		// platform-specific subheader.
+		hasSubheader := gre[offset+11]&1 != 0
+		offset += 12
+		if hasSubheader {
+			offset += 8
+		}
+	default:
+		return nil, false
+	}
+	if len(gre) < offset+ethernetHeaderLen {
+		return nil, false
+	}
+	return gre[offset:], true
+}
+
+// teredoPayload returns the IPv6 packet within the payload of a UDP packet
+// to or from the Teredo port, skipping any authentication and origin
+// indication headers before it (RFC 4380 section 5.1.1).  ok is false if
+// there's no IPv6 packet.
+func teredoPayload(udp []byte) (payload []byte, ok bool) {
+	if len(udp) < 8 {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(udp) != teredoPort && binary.BigEndian.Uint16(udp[2:]) != teredoPort {
+		return nil, false
+	}
+	payload = udp[8:]
+	// Both headers start with a zero byte, which an IPv6 header can't.
+	if len(payload) >= 4 && payload[0] == 0 && payload[1] == 1 {
+		// Client ID and authentication value lengths, then a nonce and a
+		// confirmation byte after them.
+		length := 4 + int(payload[2]) + int(payload[3]) + 9
+		if len(payload) < length {
+			return nil, false
+		}
+		payload = payload[length:]
+	}
+	if len(payload) >= 8 && payload[0] == 0 && payload[1] == 0 {
+		payload = payload[8:]
+	}
+	if len(payload) < 40 || payload[0]>>4 != 6 {
+		return nil, false
+	}
+	return payload, true
+}
+
+// TunnelFrame returns the packet tunneled within an IP-in-IP, 6in4, 4in6, or
+// Teredo packet, with the outer packet's Ethernet addresses prepended.  ok is
+// false if data is not such a tunneled packet.
+func TunnelFrame(data []byte) (inner []byte, ok bool) {
+	proto, payload, ok := ipPayload(data)
+	if !ok {
+		return nil, false
+	}
+	var etherType uint16
+	switch proto {
+	case ipProtoIPIP:
+		etherType = etherTypeIPv4
+	case ipProtoIPv6:
+		etherType = etherTypeIPv6
+	case ipProtoUDP:
+		if payload, ok = teredoPayload(payload); !ok {
+			return nil, false
+		}
+		etherType = etherTypeIPv6
+	default:
+		return nil, false
+	}
+	inner = make([]byte, ethernetHeaderLen+len(payload))
+	copy(inner, data[:12])
+	binary.BigEndian.PutUint16(inner[12:], etherType)
+	copy(inner[ethernetHeaderLen:], payload)
+	return inner, true
+}
+
+// Decapsulate replaces the data of an ERSPAN, IP-tunneled, or Teredo packet
+// with the frame it encapsulates.  Other packets are left untouched.
+func Decapsulate(p *Packet) {
+	inner, ok := ERSPANFrame(p.Data)
+	if !ok {
+		if inner, ok = TunnelFrame(p.Data); !ok {
+			return
+		}
+	}
+	stripped := len(p.Data) - len(inner)
+	p.Data = inner
+	p.CaptureLength = len(inner)
+	p.Length -= stripped
+}
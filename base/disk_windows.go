@@ -0,0 +1,41 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// PathDiskSpace returns the bytes available to us and the total bytes on the
+// filesystem containing path.
+func PathDiskSpace(path string) (avail, total int64, _ error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var free, size uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &size, nil); err != nil {
+		return 0, 0, err
+	}
+	return int64(free), int64(size), nil
+}
+
+func PathDiskFreePercentage(path string) (int, error) {
+	avail, total, err := PathDiskSpace(path)
+	if err != nil {
+		return 0, err
+	}
+	return int(100 * avail / total), nil
+}
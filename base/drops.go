@@ -0,0 +1,71 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"time"
+)
+
+// TimeRange is a span of time, inclusive.
+type TimeRange struct {
+	Start, End time.Time
+}
+
+// Overlaps returns whether r overlaps the range from start to end, either of
+// which may be zero for an open range.
+func (r TimeRange) Overlaps(start, end time.Time) bool {
+	return (start.IsZero() || !r.End.Before(start)) && (end.IsZero() || !r.Start.After(end))
+}
+
+// DropStats counts capture blocks, and those the kernel flagged as written
+// while it was dropping packets (TP_STATUS_LOSING, set until stenotype next
+// reads the socket's statistics).  The kernel doesn't record how many packets
+// were dropped, so the fraction of losing blocks is the best measure of drops
+// we have.
+type DropStats struct {
+	Blocks       int64
+	LosingBlocks int64
+	// Losing are the time ranges of the packets in each losing block.
+	Losing []TimeRange `json:",omitempty"`
+}
+
+// Add adds the blocks counted in o to d.
+func (d *DropStats) Add(o DropStats) {
+	d.Blocks += o.Blocks
+	d.LosingBlocks += o.LosingBlocks
+	d.Losing = append(d.Losing, o.Losing...)
+}
+
+// LosingFraction returns the fraction of blocks which were losing.
+func (d DropStats) LosingFraction() float64 {
+	if d.Blocks == 0 {
+		return 0
+	}
+	return float64(d.LosingBlocks) / float64(d.Blocks)
+}
+
+// Within returns the losing blocks with packets between start and end (either
+// of which may be zero for an open range).  Blocks is left alone, since only
+// losing blocks have their times recorded.
+func (d DropStats) Within(start, end time.Time) DropStats {
+	out := DropStats{Blocks: d.Blocks}
+	for _, r := range d.Losing {
+		if r.Overlaps(start, end) {
+			out.LosingBlocks++
+			out.Losing = append(out.Losing, r)
+		}
+	}
+	return out
+}
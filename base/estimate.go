@@ -0,0 +1,103 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sort"
+	"time"
+)
+
+// PCAP framing overhead, for estimating the size of PCAP output.
+const (
+	PcapFileHeaderSize   = 24
+	PcapPacketHeaderSize = 16
+)
+
+// Estimate is an estimate of how big a query's results are, made from index
+// lookups without reading every matched packet.
+type Estimate struct {
+	Packets int64 // Packets matched, which is exact.
+	Bytes   int64 // Estimated size of the results as PCAP.
+	Sampled int64 // Packets whose lengths were read to estimate Bytes.
+	Files   int   // Files with at least one matching packet.
+}
+
+// Add adds another estimate into this one.
+func (e *Estimate) Add(o Estimate) {
+	e.Packets += o.Packets
+	e.Bytes += o.Bytes
+	e.Sampled += o.Sampled
+	e.Files += o.Files
+}
+
+// HistogramBucket counts the packets a query matched in one time bucket.
+type HistogramBucket struct {
+	Start   time.Time
+	Packets int64
+	Bytes   int64 // Estimated size of the bucket's packets as PCAP.
+}
+
+// Histogram counts a query's matches per time bucket of a fixed width.
+type Histogram struct {
+	width   time.Duration
+	buckets map[int64]*HistogramBucket // Keyed by start, in nanoseconds.
+}
+
+// NewHistogram returns an empty histogram with buckets of the given width.
+func NewHistogram(width time.Duration) *Histogram {
+	return &Histogram{width: width, buckets: map[int64]*HistogramBucket{}}
+}
+
+// Add counts packets totalling 'bytes' in the bucket holding 'ts'.
+func (h *Histogram) Add(ts time.Time, packets, bytes int64) {
+	start := ts.Truncate(h.width)
+	b := h.buckets[start.UnixNano()]
+	if b == nil {
+		b = &HistogramBucket{Start: start.UTC()}
+		h.buckets[start.UnixNano()] = b
+	}
+	b.Packets += packets
+	b.Bytes += bytes
+}
+
+// Merge adds another histogram of the same width into this one.
+func (h *Histogram) Merge(o *Histogram) {
+	for _, b := range o.buckets {
+		h.Add(b.Start, b.Packets, b.Bytes)
+	}
+}
+
+// Clip removes the buckets which don't fall entirely in the time range from
+// start to end, either of which may be zero for an open range.
+func (h *Histogram) Clip(start, end time.Time) {
+	for k, b := range h.buckets {
+		if !InWindow(b.Start, start, end) || (!end.IsZero() && b.Start.Add(h.width).After(end)) {
+			delete(h.buckets, k)
+		}
+	}
+}
+
+// Len returns how many buckets have packets.
+func (h *Histogram) Len() int { return len(h.buckets) }
+
+// Buckets returns the buckets with packets, in time order.
+func (h *Histogram) Buckets() []HistogramBucket {
+	out := make([]HistogramBucket, 0, len(h.buckets))
+	for _, b := range h.buckets {
+		out = append(out, *b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
@@ -0,0 +1,151 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultFileNameTemplate names blockfiles (and their indexes) by the
+// microseconds since the epoch when stenotype started writing them, as
+// stenotype always has.
+const DefaultFileNameTemplate = "{micros}"
+
+// UTCFileTimeLayout is the time layout the {utc} placeholder of a file name
+// template is written in.
+const UTCFileTimeLayout = "20060102T150405.000000Z"
+
+// FileNames is a blockfile naming scheme, from a template with placeholders:
+//
+//	{micros}  when the file was started, in microseconds since the epoch
+//	{utc}     when the file was started, in UTC, like 20150101T135211.123456Z
+//	{thread}  the stenographer thread writing the file
+//	{sensor}  the sensor's ID
+//
+// Templates must have exactly one of {micros} or {utc}.  Everything else in a
+// name is the same for all of a thread's files, so names sort in the order
+// the files were started.
+type FileNames struct {
+	template string
+	sensor   string
+	re       *regexp.Regexp // Matches names, capturing their time.
+	utc      bool           // Whether the time is {utc} rather than {micros}.
+}
+
+var fileNamePlaceholder = regexp.MustCompile(`\{[^}]*\}`)
+
+// validFileName matches file names which are safe to use on any filesystem
+// and in URLs, which nothing would take as hidden files.
+var validFileName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// NewFileNames returns the naming scheme of a template, for the given sensor.
+func NewFileNames(template, sensor string) (*FileNames, error) {
+	f := &FileNames{template: template, sensor: sensor}
+	pattern, times := "^", 0
+	rest := template
+	for rest != "" {
+		loc := fileNamePlaceholder.FindStringIndex(rest)
+		if loc == nil {
+			pattern += regexp.QuoteMeta(rest)
+			break
+		}
+		pattern += regexp.QuoteMeta(rest[:loc[0]])
+		switch p := rest[loc[0]:loc[1]]; p {
+		case "{micros}":
+			pattern += `(\d+)`
+			times++
+		case "{utc}":
+			pattern += `(\d{8}T\d{6}\.\d{6}Z)`
+			f.utc = true
+			times++
+		case "{thread}":
+			pattern += `\d+`
+		case "{sensor}":
+			pattern += regexp.QuoteMeta(sensor)
+		default:
+			return nil, fmt.Errorf("unknown placeholder %s in file name template %q", p, template)
+		}
+		rest = rest[loc[1]:]
+	}
+	if times != 1 {
+		return nil, fmt.Errorf("file name template %q must have exactly one of {micros} or {utc}", template)
+	}
+	// Index paths are derived from blockfile paths by replacing PKT with IDX
+	// (see indexfile.IndexPathFromBlockfilePath), so names mustn't have either.
+	example := f.Name(time.Now(), 0)
+	if !validFileName.MatchString(example) || strings.Contains(example, "PKT") || strings.Contains(example, "IDX") {
+		return nil, fmt.Errorf("file name template %q gives invalid names like %q", template, example)
+	}
+	f.re = regexp.MustCompile(pattern + "$")
+	return f, nil
+}
+
+// defaultFileNames is the scheme of DefaultFileNameTemplate.
+var defaultFileNames = func() *FileNames {
+	f, err := NewFileNames(DefaultFileNameTemplate, "")
+	if err != nil {
+		panic(err)
+	}
+	return f
+}()
+
+// DefaultFileNames returns the naming scheme of DefaultFileNameTemplate.
+func DefaultFileNames() *FileNames {
+	return defaultFileNames
+}
+
+// Default returns whether the scheme is the default one.
+func (f *FileNames) Default() bool {
+	return f.template == DefaultFileNameTemplate
+}
+
+// Template returns the template for the given thread's files, with only its
+// time left to fill in, as stenotype is given it.
+func (f *FileNames) Template(thread int) string {
+	return strings.NewReplacer("{sensor}", f.sensor, "{thread}", strconv.Itoa(thread)).Replace(f.template)
+}
+
+// Name returns the name of the file the given thread started at 't'.
+func (f *FileNames) Name(t time.Time, thread int) string {
+	return strings.NewReplacer(
+		"{micros}", strconv.FormatInt(t.UnixNano()/1000, 10),
+		"{utc}", t.UTC().Format(UTCFileTimeLayout),
+	).Replace(f.Template(thread))
+}
+
+// Time returns when stenotype started writing the blockfile with the given
+// name (without any directory).  Names of the default scheme are always
+// understood, so files written before the scheme was changed keep working.
+func (f *FileNames) Time(name string) (time.Time, error) {
+	if micros, err := strconv.ParseInt(name, 10, 64); err == nil {
+		return time.Unix(0, micros*1000), nil
+	}
+	m := f.re.FindStringSubmatch(name)
+	if m == nil {
+		return time.Time{}, fmt.Errorf("blockfile name %q doesn't match template %q", name, f.template)
+	}
+	if f.utc {
+		return time.Parse(UTCFileTimeLayout, m[1])
+	}
+	micros, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("blockfile name %q: %v", name, err)
+	}
+	return time.Unix(0, micros*1000), nil
+}
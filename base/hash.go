@@ -0,0 +1,106 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sort"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// ResultHash computes a SHA-256 of query results in a canonical form, so two
+// extractions of the same packets can be shown to be identical whatever
+// format they were returned in.  The canonical form is the PCAP file
+// PacketsToFile would write, with packets sharing a timestamp (whose order
+// depends on which thread returned them first) sorted by their contents.
+// Packets must be added in time order.
+type ResultHash struct {
+	h hash.Hash
+	w *pcapgo.Writer
+	// pending holds the packets with the latest timestamp seen, which can't be
+	// hashed until we know no more share it.
+	pending []*Packet
+}
+
+// NewResultHash returns a ResultHash of no packets.
+func NewResultHash() *ResultHash {
+	r := &ResultHash{h: sha256.New()}
+	r.w = pcapgo.NewWriter(r.h)
+	r.w.WriteFileHeader(uint32(OutputLinkLayer.SnapLen), OutputLinkLayer.Output)
+	return r
+}
+
+// Add adds a packet to the hash.
+func (r *ResultHash) Add(p *Packet) {
+	if len(r.pending) > 0 && !r.pending[0].Timestamp.Equal(p.Timestamp) {
+		r.flush()
+	}
+	ci, data := OutputLinkLayer.frame(p)
+	// Writers may reuse the packet once it's written, so keep our own copy.
+	r.pending = append(r.pending, &Packet{
+		Data:        append([]byte(nil), data...),
+		CaptureInfo: ci,
+	})
+}
+
+func (r *ResultHash) flush() {
+	sort.SliceStable(r.pending, func(i, j int) bool {
+		return bytes.Compare(r.pending[i].Data, r.pending[j].Data) < 0
+	})
+	for _, p := range r.pending {
+		r.w.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     p.Timestamp,
+			CaptureLength: len(p.Data),
+			Length:        p.Length,
+		}, p.Data)
+	}
+	r.pending = r.pending[:0]
+}
+
+// Sum returns the hex SHA-256 of all packets added so far.
+func (r *ResultHash) Sum() string {
+	r.flush()
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+// HashWritten makes the PacketsTo* writers add each packet they write from
+// 'in' to 'r', so the hash covers exactly what the client was sent, even when
+// a limit cuts the results short.  It must be called before writing starts.
+func HashWritten(in *PacketChan, r *ResultHash) {
+	in.hash = r
+}
+
+// CopyWritten makes the PacketsTo* writers call 'fn' with each packet they
+// write from 'in', as HashWritten does.  Writers may reuse the packet once fn
+// returns, so it must copy anything it keeps.  It must be called before
+// writing starts.
+func CopyWritten(in *PacketChan, fn func(*Packet)) {
+	in.copies = append(in.copies, fn)
+}
+
+// wrote records that a writer has written a packet from the channel.
+func (p *PacketChan) wrote(pkt *Packet) {
+	if p.hash != nil {
+		p.hash.Add(pkt)
+	}
+	for _, fn := range p.copies {
+		fn(pkt)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxSnapLen is the largest snapshot length libpcap accepts.
+const maxSnapLen = 262144
+
+// linkTypeNames are the link types which may be given by name, as the
+// lowercase LINKTYPE_ name without its prefix.
+var linkTypeNames = map[string]layers.LinkType{
+	"null":      layers.LinkTypeNull,
+	"ethernet":  layers.LinkTypeEthernet,
+	"ppp":       layers.LinkTypePPP,
+	"raw":       layers.LinkTypeRaw,
+	"loop":      layers.LinkTypeLoop,
+	"linux_sll": layers.LinkTypeLinuxSLL,
+	"ipv4":      layers.LinkTypeIPv4,
+	"ipv6":      layers.LinkTypeIPv6,
+}
+
+// ParseLinkType parses a link type given by name (like "linux_sll" or
+// "LINKTYPE_LINUX_SLL") or by number.
+func ParseLinkType(s string) (layers.LinkType, error) {
+	name := strings.TrimPrefix(strings.ToLower(s), "linktype_")
+	if t, ok := linkTypeNames[name]; ok {
+		return t, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("unknown link type %q", s)
+	}
+	return layers.LinkType(n), nil
+}
+
+// LinkLayer describes the link-layer headers of captured packets, and how
+// they're declared in PCAP and pcapng output.
+type LinkLayer struct {
+	// Capture is the link type of the packets in blockfiles, and Output the
+	// link type they're written as, converted from Capture if it differs.
+	Capture, Output layers.LinkType
+	// SnapLen is the snapshot length output declares, and truncates packets
+	// to.
+	SnapLen int
+	// Interface is the name of the capture interface, if known, which pcapng
+	// output records.
+	Interface string
+}
+
+// OutputLinkLayer is how PCAP and pcapng output describe packets.
+var OutputLinkLayer = LinkLayer{
+	Capture: layers.LinkTypeEthernet,
+	Output:  layers.LinkTypeEthernet,
+	SnapLen: snapLen,
+}
+
+// NewLinkLayer returns the LinkLayer for packets captured with link type
+// 'capture' on 'iface', written as link type 'output' truncated to 'snaplen'.
+// Unset link types default to Ethernet, output defaults to capture, and an
+// unset snaplen to 65536.  The only conversions supported are to Ethernet,
+// from raw IP and Linux cooked captures.
+func NewLinkLayer(capture, output string, snaplen int, iface string) (LinkLayer, error) {
+	l := LinkLayer{Capture: layers.LinkTypeEthernet, SnapLen: snaplen, Interface: iface}
+	var err error
+	if capture != "" {
+		if l.Capture, err = ParseLinkType(capture); err != nil {
+			return l, err
+		}
+	}
+	l.Output = l.Capture
+	if output != "" {
+		if l.Output, err = ParseLinkType(output); err != nil {
+			return l, err
+		}
+	}
+	if l.Output != l.Capture && (l.Output != layers.LinkTypeEthernet || toEthernet[l.Capture] == nil) {
+		return l, fmt.Errorf("can't convert link type %v to %v", l.Capture, l.Output)
+	}
+	if l.SnapLen == 0 {
+		l.SnapLen = snapLen
+	} else if l.SnapLen < 0 || l.SnapLen > maxSnapLen {
+		return l, fmt.Errorf("snaplen %d out of range (1 to %d)", l.SnapLen, maxSnapLen)
+	}
+	return l, nil
+}
+
+// toEthernet converts packets of the link types which may be output as
+// Ethernet, returning nil if the packet can't be converted.
+var toEthernet = map[layers.LinkType]func([]byte) []byte{
+	layers.LinkTypeRaw: func(data []byte) []byte {
+		if len(data) == 0 {
+			return nil
+		}
+		switch data[0] >> 4 {
+		case 4:
+			return ethernetFrame(nil, layers.EthernetTypeIPv4, data)
+		case 6:
+			return ethernetFrame(nil, layers.EthernetTypeIPv6, data)
+		}
+		return nil
+	},
+	layers.LinkTypeIPv4: func(data []byte) []byte {
+		return ethernetFrame(nil, layers.EthernetTypeIPv4, data)
+	},
+	layers.LinkTypeIPv6: func(data []byte) []byte {
+		return ethernetFrame(nil, layers.EthernetTypeIPv6, data)
+	},
+	layers.LinkTypeLinuxSLL: func(data []byte) []byte {
+		// The cooked header is the packet type, ARPHRD type, address length,
+		// 8 bytes of (padded) source address, and the protocol.
+		const sllHeaderSize = 16
+		if len(data) < sllHeaderSize {
+			return nil
+		}
+		var src []byte
+		if binary.BigEndian.Uint16(data[4:]) == 6 {
+			src = data[6:12]
+		}
+		return ethernetFrame(src, layers.EthernetType(binary.BigEndian.Uint16(data[14:])), data[sllHeaderSize:])
+	},
+}
+
+// ethernetFrame prepends an Ethernet header to payload, with a zero
+// destination and the given source (zero if nil).
+func ethernetFrame(src []byte, typ layers.EthernetType, payload []byte) []byte {
+	const ethernetHeaderSize = 14
+	out := make([]byte, ethernetHeaderSize+len(payload))
+	copy(out[6:12], src)
+	binary.BigEndian.PutUint16(out[12:], uint16(typ))
+	copy(out[ethernetHeaderSize:], payload)
+	return out
+}
+
+// frame returns the packet as it should be written in output:  converted to
+// the output link type and truncated to the snapshot length, with its capture
+// info adjusted to match.  Packets which can't be converted are written as
+// they were captured.
+func (l LinkLayer) frame(p *Packet) (gopacket.CaptureInfo, []byte) {
+	ci, data := p.CaptureInfo, p.Data
+	if l.Output != l.Capture {
+		if converted := toEthernet[l.Capture](data); converted != nil {
+			ci.Length += len(converted) - len(data)
+			data = converted
+		}
+	}
+	if len(data) > l.SnapLen {
+		data = data[:l.SnapLen]
+	}
+	ci.CaptureLength = len(data)
+	return ci, data
+}
@@ -0,0 +1,105 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/mars-suite/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	memoryLimitHits = stats.S.Get("query_memory_limit_hits")
+	memorySpills    = stats.S.Get("query_memory_spills")
+)
+
+// MemoryLimitError is returned when a query tries to use more scratch memory
+// than its MemoryBudget allows.
+type MemoryLimitError struct {
+	Limit, Used, Wanted int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("query memory limit of %d bytes exceeded: %d bytes in use, %d more requested", e.Limit, e.Used, e.Wanted)
+}
+
+// MemoryBudget tracks the scratch memory (positions, buffered packets, etc.)
+// used by a single query, so a large query fails (or spills to disk) rather
+// than running the whole daemon out of memory.  A nil *MemoryBudget is
+// unlimited.
+type MemoryBudget struct {
+	mu               sync.Mutex
+	limit, used, max int64
+}
+
+// NewMemoryBudget returns a budget allowing up to limit bytes in use at once.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit}
+}
+
+// Reserve records that n more bytes are in use, or returns a
+// *MemoryLimitError (reserving nothing) if that would exceed the limit.
+func (b *MemoryBudget) Reserve(n int64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		memoryLimitHits.Increment()
+		return &MemoryLimitError{Limit: b.limit, Used: b.used, Wanted: n}
+	}
+	b.used += n
+	if b.used > b.max {
+		b.max = b.used
+	}
+	return nil
+}
+
+// Release records that n previously reserved bytes are no longer in use.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// Peak returns the most memory that has been in use at once.
+func (b *MemoryBudget) Peak() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.max
+}
+
+type memoryBudgetKey struct{}
+
+// WithMemoryBudget returns a context which charges query memory use to b.
+func WithMemoryBudget(ctx context.Context, b *MemoryBudget) context.Context {
+	return context.WithValue(ctx, memoryBudgetKey{}, b)
+}
+
+// MemoryBudgetFrom returns the MemoryBudget within the context, or nil
+// (unlimited) if there isn't one.
+func MemoryBudgetFrom(ctx context.Context) *MemoryBudget {
+	b, _ := ctx.Value(memoryBudgetKey{}).(*MemoryBudget)
+	return b
+}
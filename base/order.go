@@ -0,0 +1,262 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+)
+
+// SpillDirectory is where queries write scratch data once they exceed their
+// MemoryBudget.  If empty, the system temporary directory is used.
+var SpillDirectory = ""
+
+// flowKey identifies a bidirectional flow.  Both directions of a flow map to
+// the same key.
+type flowKey struct {
+	network, transport gopacket.Flow
+}
+
+// packetFlowKey returns the flow the given packet is a part of.  Packets
+// without a network layer all share the zero flowKey.
+func packetFlowKey(p *Packet) (k flowKey) {
+	pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	if n := pkt.NetworkLayer(); n != nil {
+		k.network = n.NetworkFlow()
+	}
+	if t := pkt.TransportLayer(); t != nil {
+		k.transport = t.TransportFlow()
+	}
+	src, dst := k.network.Endpoints()
+	if dst.LessThan(src) {
+		k.network, k.transport = k.network.Reverse(), k.transport.Reverse()
+	} else if src == dst {
+		if tsrc, tdst := k.transport.Endpoints(); tdst.LessThan(tsrc) {
+			k.transport = k.transport.Reverse()
+		}
+	}
+	return k
+}
+
+// PacketFlow returns the network and transport flows of the bidirectional flow
+// the given packet is a part of, oriented the same way for both directions.
+func PacketFlow(p *Packet) (network, transport gopacket.Flow) {
+	k := packetFlowKey(p)
+	return k.network, k.transport
+}
+
+// PacketFlowID names the bidirectional flow the given packet is a part of,
+// the same for both directions, like "tcp_10.0.0.1_1234_10.0.0.2_80".  It's
+// "" for packets without a network layer.
+func PacketFlowID(p *Packet) string {
+	k := packetFlowKey(p)
+	if k.network == (gopacket.Flow{}) {
+		return ""
+	}
+	return flowName(k)
+}
+
+// packetOverhead roughly accounts for the memory a buffered packet uses beyond
+// its data.
+const packetOverhead = 128
+
+// spillHeaderSize is the size of each packet's header in a spill file:  its
+// timestamp in nanoseconds, its length, and its capture length.
+const spillHeaderSize = 16
+
+// flowBuffer holds packets grouped by flow, spilling their contents to a file
+// once they exceed the query's memory budget.  Spilled packets are kept as
+// their offset in the spill file.
+type flowBuffer struct {
+	budget   *MemoryBudget
+	order    []flowKey
+	flows    map[flowKey][]flowEntry
+	reserved int64
+	spill    *os.File
+	spillEnd int64
+}
+
+type flowEntry struct {
+	p   *Packet // nil if spilled
+	off int64
+}
+
+func (f *flowBuffer) add(p *Packet) error {
+	k := packetFlowKey(p)
+	if _, ok := f.flows[k]; !ok {
+		f.order = append(f.order, k)
+	}
+	e := flowEntry{p: p}
+	if f.spill == nil {
+		if err := f.budget.Reserve(int64(len(p.Data) + packetOverhead)); err == nil {
+			f.reserved += int64(len(p.Data) + packetOverhead)
+		} else if err := f.startSpilling(); err != nil {
+			return err
+		}
+	}
+	if f.spill != nil {
+		off, err := f.write(p)
+		if err != nil {
+			return err
+		}
+		e = flowEntry{off: off}
+	}
+	f.flows[k] = append(f.flows[k], e)
+	return nil
+}
+
+// startSpilling moves all buffered packets to a new spill file, releasing the
+// memory they held.
+func (f *flowBuffer) startSpilling() error {
+	spill, err := ioutil.TempFile(SpillDirectory, "stenographer-spill-")
+	if err != nil {
+		return fmt.Errorf("query memory limit exceeded, and could not spill to disk: %v", err)
+	}
+	// Unlink the file immediately, so it's cleaned up however we exit.
+	os.Remove(spill.Name())
+	f.spill = spill
+	memorySpills.Increment()
+	V(1, "flow grouping exceeded memory budget, spilling to disk")
+	for _, k := range f.order {
+		entries := f.flows[k]
+		for i, e := range entries {
+			if e.p == nil {
+				continue
+			}
+			off, err := f.write(e.p)
+			if err != nil {
+				return err
+			}
+			entries[i] = flowEntry{off: off}
+		}
+	}
+	f.budget.Release(f.reserved)
+	f.reserved = 0
+	return nil
+}
+
+func (f *flowBuffer) write(p *Packet) (int64, error) {
+	buf := make([]byte, spillHeaderSize+len(p.Data))
+	binary.BigEndian.PutUint64(buf, uint64(p.Timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(buf[8:], uint32(p.Length))
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(p.Data)))
+	copy(buf[spillHeaderSize:], p.Data)
+	if _, err := f.spill.Write(buf); err != nil {
+		return 0, fmt.Errorf("could not spill packet to disk: %v", err)
+	}
+	off := f.spillEnd
+	f.spillEnd += int64(len(buf))
+	return off, nil
+}
+
+func (f *flowBuffer) read(e flowEntry) (*Packet, error) {
+	if e.p != nil {
+		return e.p, nil
+	}
+	var hdr [spillHeaderSize]byte
+	if _, err := f.spill.ReadAt(hdr[:], e.off); err != nil {
+		return nil, fmt.Errorf("could not read spilled packet: %v", err)
+	}
+	p := &Packet{Data: make([]byte, binary.BigEndian.Uint32(hdr[12:]))}
+	if _, err := f.spill.ReadAt(p.Data, e.off+spillHeaderSize); err != nil {
+		return nil, fmt.Errorf("could not read spilled packet: %v", err)
+	}
+	p.Timestamp = time.Unix(0, int64(binary.BigEndian.Uint64(hdr[:])))
+	p.Length = int(binary.BigEndian.Uint32(hdr[8:]))
+	p.CaptureLength = len(p.Data)
+	return p, nil
+}
+
+func (f *flowBuffer) close() {
+	f.budget.Release(f.reserved)
+	if f.spill != nil {
+		f.spill.Close()
+	}
+}
+
+// GroupPacketsByFlow returns a new PacketChan with all packets from 'in'
+// grouped by their (bidirectional) 5-tuple flow.  Flows are ordered by the
+// time of their first packet, and packets within a flow keep their order from
+// 'in', so time-sorted input results in time-sorted flows.  Since no flow is
+// complete until 'in' is, all packets are buffered before any are sent:  in
+// memory while the context's MemoryBudget allows, then in a file in
+// SpillDirectory.
+func GroupPacketsByFlow(ctx context.Context, in *PacketChan) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		f := &flowBuffer{budget: MemoryBudgetFrom(ctx), flows: map[flowKey][]flowEntry{}}
+		defer f.close()
+		for p := range in.Receive() {
+			if err := f.add(p); err != nil {
+				out.Close(err)
+				return
+			}
+		}
+		if err := in.Err(); err != nil {
+			out.Close(err)
+			return
+		}
+		V(1, "grouped packets into %d flows", len(f.order))
+		for _, k := range f.order {
+			for _, e := range f.flows[k] {
+				p, err := f.read(e)
+				if err != nil {
+					out.Close(err)
+					return
+				}
+				select {
+				case out.C <- p:
+				case <-ctx.Done():
+					out.Close(ctx.Err())
+					return
+				}
+			}
+			delete(f.flows, k)
+		}
+		out.Close(nil)
+	}()
+	return out
+}
+
+// FirstPacketsPerFlow returns a new PacketChan passing along only the first
+// 'n' packets from 'in' of each (bidirectional) 5-tuple flow, which is often
+// all that's needed to see a flow's handshake or banner.  Unlike
+// GroupPacketsByFlow, it streams:  only a count per flow is kept.
+func FirstPacketsPerFlow(in *PacketChan, n int) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		seen := map[flowKey]int{}
+		for p := range in.Receive() {
+			k := packetFlowKey(p)
+			if seen[k] >= n {
+				continue
+			}
+			seen[k]++
+			out.Send(p)
+		}
+		V(1, "passed the first %d packets of %d flows", n, len(seen))
+		out.Close(in.Err())
+	}()
+	return out
+}
@@ -0,0 +1,118 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// QueryProgress tracks how far a query got, so a query cut short by a
+// deadline can say what its results are missing.
+type QueryProgress struct {
+	mu    sync.Mutex
+	files map[progressFile]bool // Files looked at, to whether they finished.
+	last  time.Time
+}
+
+type progressFile struct {
+	thread int
+	file   string
+	start  time.Time
+}
+
+// SkippedFile is a file a query didn't finish looking at.
+type SkippedFile struct {
+	Thread int
+	File   string
+	Start  time.Time // When the file's first packet was written.
+}
+
+// PartialSummary describes what a query's results are missing.  Since
+// results are returned in time order, everything before CompleteBefore was
+// returned.
+type PartialSummary struct {
+	Complete       bool
+	CompleteBefore time.Time `json:",omitempty"`
+	SkippedFiles   []SkippedFile
+}
+
+// Start records that the query needs to look at a file.
+func (p *QueryProgress) Start(thread int, file string, start time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.files == nil {
+		p.files = map[progressFile]bool{}
+	}
+	p.files[progressFile{thread, file, start}] = false
+}
+
+// Finish records that the query has finished looking at a file.
+func (p *QueryProgress) Finish(thread int, file string, start time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files[progressFile{thread, file, start}] = true
+}
+
+// Returned records a packet being returned to the client.
+func (p *QueryProgress) Returned(pkt *Packet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pkt.Timestamp.After(p.last) {
+		p.last = pkt.Timestamp
+	}
+}
+
+// Summary returns what the query is missing so far.  'finished' is whether
+// the query ran to completion without hitting its deadline.
+func (p *QueryProgress) Summary(finished bool) PartialSummary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var s PartialSummary
+	for f, done := range p.files {
+		if !done {
+			s.SkippedFiles = append(s.SkippedFiles, SkippedFile{Thread: f.thread, File: f.file, Start: f.start})
+		}
+	}
+	sort.Slice(s.SkippedFiles, func(i, j int) bool {
+		a, b := s.SkippedFiles[i], s.SkippedFiles[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		return a.Thread < b.Thread
+	})
+	s.Complete = finished && len(s.SkippedFiles) == 0
+	if !s.Complete {
+		s.CompleteBefore = p.last
+	}
+	return s
+}
+
+type queryProgressKey struct{}
+
+// WithQueryProgress returns a context which records query progress in p.
+func WithQueryProgress(ctx context.Context, p *QueryProgress) context.Context {
+	return context.WithValue(ctx, queryProgressKey{}, p)
+}
+
+// QueryProgressFrom returns the QueryProgress within the context, or nil if
+// progress isn't being tracked.
+func QueryProgressFrom(ctx context.Context) *QueryProgress {
+	p, _ := ctx.Value(queryProgressKey{}).(*QueryProgress)
+	return p
+}
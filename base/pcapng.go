@@ -0,0 +1,194 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/google/gopacket"
+)
+
+// Version is the version of stenographer, set at build time with
+//
+//	go build -ldflags "-X github.com/mars-suite/stenographer/base.Version=..."
+var Version = "unknown"
+
+// Provenance describes where a capture came from.  It's written into the
+// Section Header Block of pcapng output, so captures remain self-describing
+// once shared.
+type Provenance struct {
+	Query    string
+	SensorID string
+	Version  string
+	// TimeZone is the sensor's local time zone, and UTCOffset its offset (like
+	// "-05:00") when the capture was written.  Packet timestamps are UTC.
+	TimeZone  string `json:",omitempty"`
+	UTCOffset string `json:",omitempty"`
+	// HardwareClock is what the sensor's packet timestamps were measured in
+	// before being converted to UTC.
+	HardwareClock string `json:",omitempty"`
+}
+
+// pcapng block types and option codes, from
+// https://datatracker.ietf.org/doc/draft-ietf-opsawg-pcapng/
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngOptEnd            = 0
+	pcapngOptComment        = 1
+	pcapngOptShbUserAppl    = 4
+	pcapngOptIfName         = 2
+	pcapngOptIfTsResol      = 9
+	pcapngOptCustomUTF8Copy = 2988 // Custom UTF-8 option, copied when rewriting.
+
+	// provenancePEN is the IANA Private Enterprise Number custom provenance
+	// options are scoped to (Google).
+	provenancePEN = 11129
+)
+
+var pcapngOrder = binary.LittleEndian
+
+// pcapngWriter writes a single-section, single-interface pcapng stream, whose
+// interface is described by OutputLinkLayer.
+type pcapngWriter struct {
+	w *bufio.Writer
+}
+
+func pad4(n int) int { return (n + 3) &^ 3 }
+
+// pcapngOption appends a pcapng option to buf.
+func pcapngOption(buf []byte, code uint16, value []byte) []byte {
+	var hdr [4]byte
+	pcapngOrder.PutUint16(hdr[:], code)
+	pcapngOrder.PutUint16(hdr[2:], uint16(len(value)))
+	buf = append(buf, hdr[:]...)
+	buf = append(buf, value...)
+	return append(buf, make([]byte, pad4(len(value))-len(value))...)
+}
+
+// block writes out a block with the given type and body.
+func (p *pcapngWriter) block(typ uint32, body []byte) error {
+	body = append(body, make([]byte, pad4(len(body))-len(body))...)
+	var hdr [8]byte
+	pcapngOrder.PutUint32(hdr[:], typ)
+	pcapngOrder.PutUint32(hdr[4:], uint32(len(body)+12))
+	p.w.Write(hdr[:])
+	p.w.Write(body)
+	_, err := p.w.Write(hdr[4:])
+	return err
+}
+
+func (p *pcapngWriter) writeHeader(prov Provenance) error {
+	shb := make([]byte, 16)
+	pcapngOrder.PutUint32(shb, pcapngByteOrderMagic)
+	pcapngOrder.PutUint16(shb[4:], 1)          // major version
+	pcapngOrder.PutUint16(shb[6:], 0)          // minor version
+	pcapngOrder.PutUint64(shb[8:], ^uint64(0)) // section length unknown
+	shb = pcapngOption(shb, pcapngOptShbUserAppl, []byte("stenographer "+prov.Version))
+	info, err := json.Marshal(prov)
+	if err != nil {
+		return fmt.Errorf("could not encode provenance: %v", err)
+	}
+	custom := make([]byte, 4, 4+len(info))
+	pcapngOrder.PutUint32(custom, provenancePEN)
+	if len(custom)+len(info) > 0xffff {
+		// Options are limited to 64K, and queries almost never come close.
+		return fmt.Errorf("provenance too long (%d bytes)", len(info))
+	}
+	shb = pcapngOption(shb, pcapngOptCustomUTF8Copy, append(custom, info...))
+	shb = pcapngOption(shb, pcapngOptEnd, nil)
+	if err := p.block(pcapngSectionHeader, shb); err != nil {
+		return err
+	}
+	idb := make([]byte, 8)
+	pcapngOrder.PutUint16(idb, uint16(OutputLinkLayer.Output))
+	pcapngOrder.PutUint32(idb[4:], uint32(OutputLinkLayer.SnapLen))
+	if name := OutputLinkLayer.Interface; name != "" && len(name) <= 0xffff {
+		idb = pcapngOption(idb, pcapngOptIfName, []byte(name))
+	}
+	idb = pcapngOption(idb, pcapngOptIfTsResol, []byte{9}) // nanoseconds
+	idb = pcapngOption(idb, pcapngOptEnd, nil)
+	return p.block(pcapngInterfaceDesc, idb)
+}
+
+// writePacket writes a packet, with a comment option if 'comment' isn't empty.
+func (p *pcapngWriter) writePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	epb := make([]byte, 20, 20+pad4(len(data))+pad4(len(comment))+8)
+	ts := uint64(ci.Timestamp.UnixNano())
+	pcapngOrder.PutUint32(epb, 0) // interface ID
+	pcapngOrder.PutUint32(epb[4:], uint32(ts>>32))
+	pcapngOrder.PutUint32(epb[8:], uint32(ts))
+	pcapngOrder.PutUint32(epb[12:], uint32(len(data)))
+	pcapngOrder.PutUint32(epb[16:], uint32(ci.Length))
+	epb = append(epb, data...)
+	if comment != "" {
+		epb = append(epb, make([]byte, pad4(len(data))-len(data))...)
+		epb = pcapngOption(epb, pcapngOptComment, []byte(comment))
+		epb = pcapngOption(epb, pcapngOptEnd, nil)
+	}
+	return p.block(pcapngEnhancedPacket, epb)
+}
+
+// packetComment describes where a packet was read from, for its pcapng
+// comment, or returns "" if that's not known.
+func packetComment(p *Packet) string {
+	if p.Source.File == "" {
+		return ""
+	}
+	return fmt.Sprintf("thread %d, blockfile %s @ %d", p.Source.Thread, filepath.Base(p.Source.File), p.Source.Offset)
+}
+
+// PacketsToPcapng writes all packets from 'in' to 'out' as a pcapng file,
+// recording provenance in its section header, and each packet's source (see
+// PacketSource), if known, in a comment on it.  Like PacketsToFile, it stops
+// once 'limit' is hit.
+func PacketsToPcapng(in *PacketChan, out io.Writer, limit Limit, prov Provenance) error {
+	w := &pcapngWriter{w: bufio.NewWriter(out)}
+	defer w.w.Flush()
+	defer in.Discard()
+	if err := w.writeHeader(prov); err != nil {
+		return err
+	}
+	const epbOverhead = 32
+	count := 0
+	defer func() {
+		V(1, "wrote %d packets to pcapng", count)
+	}()
+	for p := range in.Receive() {
+		ci, data := OutputLinkLayer.frame(p)
+		comment := packetComment(p)
+		if err := w.writePacket(ci, data, comment); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+		in.wrote(p)
+		p.Release()
+		count++
+		size := pad4(len(data)) + epbOverhead
+		if comment != "" {
+			size += pad4(len(comment)) + 8
+		}
+		if limit.ShouldStopAfter(Limit{Bytes: int64(size), Packets: 1}) {
+			return nil
+		}
+	}
+	return in.Err()
+}
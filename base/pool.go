@@ -0,0 +1,67 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import "sync"
+
+// Packet data buffers are pooled in power-of-two size classes, from
+// minPooledSize up to maxPooledSize.  Anything bigger is allocated directly.
+const (
+	minPooledShift = 8 // 256 bytes
+	maxPooledShift = 16
+	maxPooledSize  = 1 << maxPooledShift
+)
+
+var packetBuffers [maxPooledShift - minPooledShift + 1]sync.Pool
+
+// sizeClass returns the index in packetBuffers of the smallest class holding
+// n bytes.
+func sizeClass(n int) int {
+	c := 0
+	for n > 1<<(minPooledShift+c) {
+		c++
+	}
+	return c
+}
+
+// NewPooledPacket returns a packet with 'n' bytes of data taken from a pool of
+// buffers, for the reader to fill in.  Its data goes back to the pool when the
+// packet is Released.  Readers copying packets out of the file at high rates
+// use it so that buffers are reused rather than left to the garbage collector.
+func NewPooledPacket(n int) *Packet {
+	if n > maxPooledSize {
+		return &Packet{Data: make([]byte, n)}
+	}
+	c := sizeClass(n)
+	buf, _ := packetBuffers[c].Get().(*[]byte)
+	if buf == nil {
+		b := make([]byte, 1<<(minPooledShift+c))
+		buf = &b
+	}
+	return &Packet{Data: (*buf)[:n], pooled: buf}
+}
+
+// Release returns the packet's data to the pool it came from, if it came from
+// one.  Neither the packet nor any slice of its data may be used afterwards.
+// Releasing packets is optional (unreleased ones are garbage collected as
+// usual), and safe for packets which weren't pooled.
+func (p *Packet) Release() {
+	if p.pooled == nil {
+		return
+	}
+	buf := p.pooled
+	p.pooled, p.Data = nil, nil
+	packetBuffers[sizeClass(cap(*buf))].Put(buf)
+}
@@ -0,0 +1,63 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"time"
+)
+
+// Cursor marks a position in a query's time-ordered results, so an
+// interrupted query can be resumed:  it falls just after the Skip'th packet
+// with timestamp Time.  Timestamps are compared to the microsecond, the
+// resolution of PCAP output, so clients can build cursors from what they've
+// received.
+type Cursor struct {
+	Time time.Time
+	Skip int
+}
+
+// Advance moves the cursor past a packet with the given timestamp, which must
+// not be before the cursor.
+func (c *Cursor) Advance(ts time.Time) {
+	ts = ts.Truncate(time.Microsecond)
+	if ts.Equal(c.Time) {
+		c.Skip++
+	} else {
+		c.Time, c.Skip = ts, 1
+	}
+}
+
+// ResumePacketChan returns a new PacketChan which passes along the packets
+// from 'in' that fall after the cursor, dropping those up to and including
+// it.  Packets from 'in' should be ordered by time.
+func ResumePacketChan(in *PacketChan, c Cursor) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		skipped := 0
+		for p := range in.Receive() {
+			ts := p.Timestamp.Truncate(time.Microsecond)
+			if ts.Before(c.Time) {
+				continue
+			} else if ts.Equal(c.Time) && skipped < c.Skip {
+				skipped++
+				continue
+			}
+			out.Send(p)
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
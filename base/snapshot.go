@@ -0,0 +1,80 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SnapshotFile is a blockfile a query read, as it was when the query pinned
+// it.
+type SnapshotFile struct {
+	Thread  int
+	File    string
+	Size    int64
+	ModTime time.Time
+}
+
+// QuerySnapshot records the blockfiles a query pinned as it started, which
+// are exactly the files it reads, however files are rotated or cleaned up
+// while it runs.  A nil *QuerySnapshot records nothing.
+type QuerySnapshot struct {
+	mu    sync.Mutex
+	files []SnapshotFile
+}
+
+// Add records a file.
+func (s *QuerySnapshot) Add(f SnapshotFile) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, f)
+}
+
+// List returns the files recorded so far, by thread and then name.
+func (s *QuerySnapshot) List() []SnapshotFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]SnapshotFile, len(s.files))
+	copy(out, s.files)
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Thread != out[j].Thread {
+			return out[i].Thread < out[j].Thread
+		}
+		return out[i].File < out[j].File
+	})
+	return out
+}
+
+type querySnapshotKey struct{}
+
+// WithQuerySnapshot returns a context which records the files a query reads
+// in s.
+func WithQuerySnapshot(ctx context.Context, s *QuerySnapshot) context.Context {
+	return context.WithValue(ctx, querySnapshotKey{}, s)
+}
+
+// QuerySnapshotFrom returns the QuerySnapshot within the context, or nil if
+// there isn't one.
+func QuerySnapshotFrom(ctx context.Context) *QuerySnapshot {
+	s, _ := ctx.Value(querySnapshotKey{}).(*QuerySnapshot)
+	return s
+}
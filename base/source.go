@@ -0,0 +1,51 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"golang.org/x/net/context"
+)
+
+// CaptureSource is where a blockfile being looked up came from:  the capture
+// thread which wrote it, and the directory it's in, for queries limited to
+// one NIC queue or disk.
+type CaptureSource struct {
+	Thread    int
+	Directory string
+}
+
+// PacketSource is where a query read a packet from:  its blockfile, its
+// offset in that file, and the thread which wrote it.  It's the zero value
+// (with no File) for packets whose source isn't known.
+type PacketSource struct {
+	Thread int
+	File   string
+	Offset int64
+}
+
+type captureSourceKey struct{}
+
+// WithCaptureSource returns a context for looking up a query in a blockfile
+// from the given source.
+func WithCaptureSource(ctx context.Context, s CaptureSource) context.Context {
+	return context.WithValue(ctx, captureSourceKey{}, s)
+}
+
+// CaptureSourceFrom returns the source of the blockfile a lookup with the
+// context is in, or false if it's not known.
+func CaptureSourceFrom(ctx context.Context) (CaptureSource, bool) {
+	s, ok := ctx.Value(captureSourceKey{}).(CaptureSource)
+	return s, ok
+}
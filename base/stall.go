@@ -0,0 +1,75 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"fmt"
+	"time"
+)
+
+// StallError ends the results of a query whose consumer stopped reading them
+// for longer than its stall timeout.
+type StallError struct {
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("query aborted: client read no results for over %v", e.Timeout)
+}
+
+// WatchStalls returns a new PacketChan which passes along every packet from
+// 'in', calling 'onStall' whenever its consumer goes longer than 'timeout'
+// without taking one.  If onStall returns an error, the new channel is closed
+// with it and the rest of 'in' is discarded;  onStall should also cancel
+// whatever is producing 'in', so it stops reading.  Otherwise, the packet
+// waits on, and onStall is called again after each further timeout.
+func WatchStalls(in *PacketChan, timeout time.Duration, onStall func() error) *PacketChan {
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for p := range in.Receive() {
+			select {
+			case out.C <- p:
+				continue
+			default:
+			}
+			// The consumer is behind, so wait for it, but not forever.
+			if err := sendBefore(out, p, timeout, onStall); err != nil {
+				out.Close(err)
+				return
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
+
+// sendBefore sends 'p' on 'out', calling 'onStall' each time that takes longer
+// than 'timeout', until it returns an error.
+func sendBefore(out *PacketChan, p *Packet, timeout time.Duration, onStall func() error) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case out.C <- p:
+			return nil
+		case <-timer.C:
+			if err := onStall(); err != nil {
+				return err
+			}
+			timer.Reset(timeout)
+		}
+	}
+}
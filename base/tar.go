@@ -0,0 +1,275 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// flowTarMemory is how much of a flow's PCAP PacketsToFlowTar holds in memory
+// before spilling the rest to a file in SpillDirectory.
+const flowTarMemory = 16 << 20
+
+// flowPcap buffers a PCAP file in an archive, such as that of one flow, until
+// its size is known.
+type flowPcap struct {
+	key   flowKey
+	name  string
+	start time.Time
+	buf   bytes.Buffer
+	spill *os.File
+	size  int64
+	w     *pcapgo.Writer
+}
+
+func newFlowPcap(k flowKey, n int, start time.Time) *flowPcap {
+	f := newPcapEntry(fmt.Sprintf("%06d_%s.pcap", n, flowName(k)), start)
+	f.key = k
+	return f
+}
+
+func newPcapEntry(name string, start time.Time) *flowPcap {
+	f := &flowPcap{name: name, start: start}
+	f.w = pcapgo.NewWriter(f)
+	f.w.WriteFileHeader(uint32(OutputLinkLayer.SnapLen), OutputLinkLayer.Output)
+	return f
+}
+
+// flowName describes a flow in a file name, like "tcp_10.0.0.1_1234_10.0.0.2_80".
+// Colons in IPv6 addresses become dots, since some platforms don't allow them.
+func flowName(k flowKey) string {
+	if k.network == (gopacket.Flow{}) {
+		return "unknown"
+	}
+	src, dst := k.network.Endpoints()
+	parts := []string{src.String(), dst.String()}
+	if k.transport != (gopacket.Flow{}) {
+		tsrc, tdst := k.transport.Endpoints()
+		parts = []string{strings.ToLower(k.transport.EndpointType().String()), src.String(), tsrc.String(), dst.String(), tdst.String()}
+	}
+	return strings.Replace(strings.Join(parts, "_"), ":", ".", -1)
+}
+
+func (f *flowPcap) Write(p []byte) (int, error) {
+	f.size += int64(len(p))
+	if f.spill == nil && f.buf.Len()+len(p) > flowTarMemory {
+		spill, err := ioutil.TempFile(SpillDirectory, "stenographer-spill-")
+		if err != nil {
+			return 0, fmt.Errorf("flow too large to buffer, and could not spill to disk: %v", err)
+		}
+		// Unlink the file immediately, so it's cleaned up however we exit.
+		os.Remove(spill.Name())
+		f.spill = spill
+		memorySpills.Increment()
+		if _, err := f.buf.WriteTo(spill); err != nil {
+			return 0, fmt.Errorf("could not spill flow to disk: %v", err)
+		}
+	}
+	if f.spill != nil {
+		return f.spill.Write(p)
+	}
+	return f.buf.Write(p)
+}
+
+// writeTo writes the flow's PCAP file to an archive.
+func (f *flowPcap) writeTo(tw *tar.Writer) error {
+	hdr := &tar.Header{Name: f.name, Mode: 0644, Size: f.size, ModTime: f.start, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("error writing archive: %v", err)
+	}
+	var r io.Reader = &f.buf
+	if f.spill != nil {
+		if _, err := f.spill.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("could not read spilled flow: %v", err)
+		}
+		r = f.spill
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("error writing archive: %v", err)
+	}
+	return nil
+}
+
+func (f *flowPcap) close() {
+	if f.spill != nil {
+		f.spill.Close()
+	}
+}
+
+// PacketsToFlowTar writes all packets from 'in' to 'out' as a tar archive with
+// a PCAP file (described by OutputLinkLayer) for each flow, so conversations
+// can be opened individually.  Packets should be grouped by flow, as
+// GroupPacketsByFlow does:  a new file is started whenever the flow changes.
+// Since tar headers give their files' sizes, each flow's file is buffered
+// until the flow ends, spilling to SpillDirectory if it's large.
+func PacketsToFlowTar(in *PacketChan, out io.Writer, limit Limit) error {
+	defer in.Discard()
+	tw := tar.NewWriter(out)
+	var cur *flowPcap
+	defer func() {
+		if cur != nil {
+			cur.close()
+		}
+	}()
+	// finish writes out the current flow's file.
+	finish := func() error {
+		err := cur.writeTo(tw)
+		cur.close()
+		cur = nil
+		return err
+	}
+	flows := 0
+	const pcapHeaderSize = 16 // same for file header and per-packet header
+	for p := range in.Receive() {
+		if k := packetFlowKey(p); cur == nil || k != cur.key {
+			if cur != nil {
+				if err := finish(); err != nil {
+					return err
+				}
+			}
+			flows++
+			cur = newFlowPcap(k, flows, p.Timestamp)
+		}
+		ci, data := OutputLinkLayer.frame(p)
+		if err := cur.w.WritePacket(ci, data); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+		in.wrote(p)
+		p.Release()
+		if limit.ShouldStopAfter(Limit{Bytes: int64(len(data) + pcapHeaderSize), Packets: 1}) {
+			break
+		}
+	}
+	if cur != nil {
+		if err := finish(); err != nil {
+			return err
+		}
+	}
+	V(1, "wrote %d flows to archive", flows)
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error writing archive: %v", err)
+	}
+	return in.Err()
+}
+
+// ChunkManifestName is the name of the manifest PacketsToChunkTar writes after
+// its chunks.
+const ChunkManifestName = "manifest.json"
+
+// Chunk describes one PCAP file written by PacketsToChunkTar, in its manifest.
+type Chunk struct {
+	Name       string
+	Start, End time.Time // Of its first and last packets.
+	Packets    int
+	Bytes      int64 // Of the whole PCAP file.
+}
+
+// PacketsToChunkTar writes all packets from 'in' to 'out' as a tar archive of
+// numbered PCAP files (described by OutputLinkLayer) of consecutive packets,
+// like "000001.pcap", so huge results can be handled a piece at a time.  A new
+// file is started whenever adding the next packet would make the current one
+// bigger than maxBytes, or span more than maxDuration; either may be zero for
+// no limit, and a file always holds at least one packet.  The archive ends
+// with a JSON list of each file's Chunk, named ChunkManifestName.  Each file
+// is buffered until it's complete, spilling to SpillDirectory if it's large.
+func PacketsToChunkTar(in *PacketChan, out io.Writer, limit Limit, maxBytes int64, maxDuration time.Duration) error {
+	defer in.Discard()
+	tw := tar.NewWriter(out)
+	var cur *flowPcap
+	defer func() {
+		if cur != nil {
+			cur.close()
+		}
+	}()
+	var manifest []Chunk
+	// finish writes out the current chunk.
+	finish := func() error {
+		err := cur.writeTo(tw)
+		manifest[len(manifest)-1].Bytes = cur.size
+		cur.close()
+		cur = nil
+		return err
+	}
+	const pcapHeaderSize = 16 // same for file header and per-packet header
+	for p := range in.Receive() {
+		ci, data := OutputLinkLayer.frame(p)
+		size := int64(len(data) + pcapHeaderSize)
+		if cur != nil {
+			c := &manifest[len(manifest)-1]
+			start, end := c.Start, c.End
+			if p.Timestamp.Before(start) {
+				start = p.Timestamp
+			} else if p.Timestamp.After(end) {
+				end = p.Timestamp
+			}
+			if (maxBytes > 0 && cur.size+size > maxBytes) || (maxDuration > 0 && end.Sub(start) > maxDuration) {
+				if err := finish(); err != nil {
+					return err
+				}
+			} else {
+				c.Start, c.End = start, end
+			}
+		}
+		if cur == nil {
+			name := fmt.Sprintf("%06d.pcap", len(manifest)+1)
+			cur = newPcapEntry(name, p.Timestamp)
+			manifest = append(manifest, Chunk{Name: name, Start: p.Timestamp, End: p.Timestamp})
+		}
+		if err := cur.w.WritePacket(ci, data); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+		manifest[len(manifest)-1].Packets++
+		in.wrote(p)
+		p.Release()
+		if limit.ShouldStopAfter(Limit{Bytes: size, Packets: 1}) {
+			break
+		}
+	}
+	if cur != nil {
+		if err := finish(); err != nil {
+			return err
+		}
+	}
+	V(1, "wrote %d chunks to archive", len(manifest))
+	if manifest == nil {
+		manifest = []Chunk{}
+	}
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode chunk manifest: %v", err)
+	}
+	hdr := &tar.Header{Name: ChunkManifestName, Mode: 0644, Size: int64(len(encoded)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("error writing archive: %v", err)
+	}
+	if _, err := tw.Write(encoded); err != nil {
+		return fmt.Errorf("error writing archive: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error writing archive: %v", err)
+	}
+	return in.Err()
+}
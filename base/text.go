@@ -0,0 +1,170 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// textTimeFormat matches the timestamps printed by 'tcpdump -tttt'.
+const textTimeFormat = "2006-01-02 15:04:05.000000"
+
+// PacketsToText writes all packets from 'in' to 'out' as one-line text
+// decodes, in a format similar to that of 'tcpdump -n -S -tttt':  TCP
+// sequence numbers are absolute, since packets aren't tracked by flow.  Limits
+// are applied against the size of the packets that are decoded, not the size
+// of the text that is written.
+func PacketsToText(in *PacketChan, out io.Writer, limit Limit) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	count := 0
+	defer in.Discard()
+	defer func() {
+		V(1, "wrote %d packets as text", count)
+	}()
+	for p := range in.Receive() {
+		if _, err := fmt.Fprintln(w, PacketText(p)); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+		in.wrote(p)
+		n := len(p.Data)
+		p.Release()
+		count++
+		if limit.ShouldStopAfter(Limit{Bytes: int64(n), Packets: 1}) {
+			return nil
+		}
+	}
+	return in.Err()
+}
+
+// PacketsToFunc calls 'write' with each packet from 'in' until 'limit' is
+// reached, counting each packet's captured bytes against it like
+// PacketsToText.  Other packages' output formats use it so the packets they
+// write are still passed to HashWritten and CopyWritten.
+func PacketsToFunc(in *PacketChan, limit Limit, write func(*Packet) error) error {
+	defer in.Discard()
+	for p := range in.Receive() {
+		if err := write(p); err != nil {
+			return fmt.Errorf("error writing packet: %v", err)
+		}
+		in.wrote(p)
+		n := len(p.Data)
+		p.Release()
+		if limit.ShouldStopAfter(Limit{Bytes: int64(n), Packets: 1}) {
+			return nil
+		}
+	}
+	return in.Err()
+}
+
+// PacketText returns a single-line, human-readable decode of the given packet.
+func PacketText(p *Packet) string {
+	pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	return p.Timestamp.Format(textTimeFormat) + " " + describePacket(pkt, p.Length)
+}
+
+func describePacket(pkt gopacket.Packet, length int) string {
+	var src, dst, proto string
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst, proto = l.SrcIP.String(), l.DstIP.String(), "IP"
+	case *layers.IPv6:
+		src, dst, proto = l.SrcIP.String(), l.DstIP.String(), "IP6"
+	default:
+		if arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+			return describeARP(arp, length)
+		}
+		if eth, ok := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+			return fmt.Sprintf("ethertype %v (0x%04x), length %d", eth.EthernetType, uint16(eth.EthernetType), length)
+		}
+		return fmt.Sprintf("unknown, length %d", length)
+	}
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		return fmt.Sprintf("%s %s.%d > %s.%d: %s", proto, src, l.SrcPort, dst, l.DstPort, describeTCP(l))
+	case *layers.UDP:
+		return fmt.Sprintf("%s %s.%d > %s.%d: UDP, length %d", proto, src, l.SrcPort, dst, l.DstPort, len(l.Payload))
+	}
+	if icmp, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		desc := icmp.TypeCode.String()
+		switch icmp.TypeCode.Type() {
+		case layers.ICMPv4TypeEchoRequest, layers.ICMPv4TypeEchoReply:
+			desc = fmt.Sprintf("%s, id %d, seq %d", desc, icmp.Id, icmp.Seq)
+		}
+		return fmt.Sprintf("%s %s > %s: ICMP %s, length %d", proto, src, dst, desc, len(icmp.Contents)+len(icmp.Payload))
+	}
+	if icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		return fmt.Sprintf("%s %s > %s: ICMP6, %v, length %d", proto, src, dst, icmp.TypeCode, len(icmp.Contents)+len(icmp.Payload))
+	}
+	return fmt.Sprintf("%s %s > %s: %v, length %d", proto, src, dst, nextLayerType(pkt), len(pkt.NetworkLayer().LayerPayload()))
+}
+
+// nextLayerType returns the type of the layer after the network layer.
+func nextLayerType(pkt gopacket.Packet) gopacket.LayerType {
+	ls := pkt.Layers()
+	for i, l := range ls {
+		if l == pkt.NetworkLayer() && i+1 < len(ls) {
+			return ls[i+1].LayerType()
+		}
+	}
+	return gopacket.LayerTypeZero
+}
+
+func describeTCP(t *layers.TCP) string {
+	var flags strings.Builder
+	for _, f := range []struct {
+		set bool
+		c   byte
+	}{
+		{t.FIN, 'F'}, {t.SYN, 'S'}, {t.RST, 'R'}, {t.PSH, 'P'},
+		{t.ACK, '.'}, {t.URG, 'U'}, {t.ECE, 'E'}, {t.CWR, 'W'},
+	} {
+		if f.set {
+			flags.WriteByte(f.c)
+		}
+	}
+	if flags.Len() == 0 {
+		flags.WriteString("none")
+	}
+	out := fmt.Sprintf("Flags [%s]", flags.String())
+	if n := len(t.Payload); n > 0 {
+		out += fmt.Sprintf(", seq %d:%d", t.Seq, t.Seq+uint32(n))
+	} else if t.SYN || t.FIN || t.RST {
+		out += fmt.Sprintf(", seq %d", t.Seq)
+	}
+	if t.ACK {
+		out += fmt.Sprintf(", ack %d", t.Ack)
+	}
+	return out + fmt.Sprintf(", win %d, length %d", t.Window, len(t.Payload))
+}
+
+func describeARP(a *layers.ARP, length int) string {
+	switch a.Operation {
+	case layers.ARPRequest:
+		return fmt.Sprintf("ARP, Request who-has %v tell %v, length %d",
+			net.IP(a.DstProtAddress), net.IP(a.SourceProtAddress), length)
+	case layers.ARPReply:
+		return fmt.Sprintf("ARP, Reply %v is-at %v, length %d",
+			net.IP(a.SourceProtAddress), net.HardwareAddr(a.SourceHwAddress), length)
+	}
+	return fmt.Sprintf("ARP, op %d, length %d", a.Operation, length)
+}
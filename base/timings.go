@@ -0,0 +1,142 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// FileTimings breaks down the time a single query spent within one blockfile.
+type FileTimings struct {
+	Thread      int
+	File        string
+	Packets     int
+	IndexLookup time.Duration // Time spent looking up positions in the index.
+	PacketRead  time.Duration // Time spent reading packets from the packet file.
+	ChannelSend time.Duration // Time spent blocked sending packets downstream.
+
+	q *QueryTimings
+}
+
+// Record sets the timings for this file.  Files which haven't recorded their
+// timings by the time a summary is taken show up with zero times.
+func (f *FileTimings) Record(packets int, indexLookup, packetRead, channelSend time.Duration) {
+	f.q.mu.Lock()
+	defer f.q.mu.Unlock()
+	f.Packets = packets
+	f.IndexLookup = indexLookup
+	f.PacketRead = packetRead
+	f.ChannelSend = channelSend
+}
+
+// ThreadTimings totals the FileTimings of all files within one thread.
+type ThreadTimings struct {
+	Thread      int
+	Files       int
+	Packets     int
+	IndexLookup time.Duration
+	PacketRead  time.Duration
+	ChannelSend time.Duration
+}
+
+// QueryTimings collects FileTimings for all blockfiles touched by a query.
+// It's safe for concurrent use.
+type QueryTimings struct {
+	mu    sync.Mutex
+	files []*FileTimings
+}
+
+// File returns a new FileTimings for the given thread and file, which will be
+// included in this query's timings.  Timings should be set with Record.
+func (q *QueryTimings) File(thread int, file string) *FileTimings {
+	f := &FileTimings{Thread: thread, File: file, q: q}
+	q.mu.Lock()
+	q.files = append(q.files, f)
+	q.mu.Unlock()
+	return f
+}
+
+// QueryTimingsSummary is the JSON-friendly summary of a QueryTimings.
+type QueryTimingsSummary struct {
+	Threads []ThreadTimings
+	Files   []FileTimings
+}
+
+// Summary returns the timings of all files, sorted by thread and file, along
+// with per-thread totals.
+func (q *QueryTimings) Summary() (s QueryTimingsSummary) {
+	q.mu.Lock()
+	for _, f := range q.files {
+		f := *f
+		f.q = nil
+		s.Files = append(s.Files, f)
+	}
+	q.mu.Unlock()
+	sort.Slice(s.Files, func(i, j int) bool {
+		if s.Files[i].Thread != s.Files[j].Thread {
+			return s.Files[i].Thread < s.Files[j].Thread
+		}
+		return s.Files[i].File < s.Files[j].File
+	})
+	for _, f := range s.Files {
+		if len(s.Threads) == 0 || s.Threads[len(s.Threads)-1].Thread != f.Thread {
+			s.Threads = append(s.Threads, ThreadTimings{Thread: f.Thread})
+		}
+		t := &s.Threads[len(s.Threads)-1]
+		t.Files++
+		t.Packets += f.Packets
+		t.IndexLookup += f.IndexLookup
+		t.PacketRead += f.PacketRead
+		t.ChannelSend += f.ChannelSend
+	}
+	return s
+}
+
+type timingsKey int
+
+const (
+	queryTimingsKey timingsKey = iota
+	fileTimingsKey
+)
+
+// WithQueryTimings returns a context which requests that lookups performed
+// with it record their timings into 't'.
+func WithQueryTimings(ctx context.Context, t *QueryTimings) context.Context {
+	return context.WithValue(ctx, queryTimingsKey, t)
+}
+
+// QueryTimingsFrom returns the QueryTimings attached to the given context, or
+// nil if timings weren't requested.
+func QueryTimingsFrom(ctx context.Context) *QueryTimings {
+	t, _ := ctx.Value(queryTimingsKey).(*QueryTimings)
+	return t
+}
+
+// WithFileTimings returns a context which requests that a blockfile lookup
+// performed with it record its timings into 't'.
+func WithFileTimings(ctx context.Context, t *FileTimings) context.Context {
+	return context.WithValue(ctx, fileTimingsKey, t)
+}
+
+// FileTimingsFrom returns the FileTimings attached to the given context, or
+// nil if timings weren't requested.
+func FileTimingsFrom(ctx context.Context) *FileTimings {
+	t, _ := ctx.Value(fileTimingsKey).(*FileTimings)
+	return t
+}
@@ -0,0 +1,341 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+
+	// CryptoPANKeySize is the size of the key the "cryptopan" transform needs:
+	// a 16-byte AES key followed by 16 bytes of padding secret.
+	CryptoPANKeySize = 32
+)
+
+// Transform rewrites a packet in place before it's output, for example to
+// anonymize it before results are shared.
+type Transform interface {
+	Transform(p *Packet)
+}
+
+// TransformFunc adapts a function to a Transform.
+type TransformFunc func(*Packet)
+
+// Transform calls f(p).
+func (f TransformFunc) Transform(p *Packet) { f(p) }
+
+// transforms are the available transforms by name, in the order they're
+// applied.  Each is given the CryptoPAN key, if one is configured.
+var transforms = []struct {
+	name string
+	new  func(cryptoPANKey []byte) (Transform, error)
+}{
+	{"zero_payload", func([]byte) (Transform, error) { return TransformFunc(zeroPayload), nil }},
+	{"mask_macs", func([]byte) (Transform, error) { return TransformFunc(maskMACs), nil }},
+	{"cryptopan", func(key []byte) (Transform, error) { return NewCryptoPAN(key) }},
+}
+
+// TransformNames canonicalizes a list of transform names:  it drops
+// duplicates, and sorts them into the order they're applied in.  It fails if
+// any name is unknown.
+func TransformNames(names []string) ([]string, error) {
+	order := map[string]int{}
+	for i, t := range transforms {
+		order[t.name] = i
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, name := range names {
+		if _, ok := order[name]; !ok {
+			var known []string
+			for _, t := range transforms {
+				known = append(known, t.name)
+			}
+			return nil, fmt.Errorf("unknown transform %q, only %s", name, strings.Join(known, ", "))
+		}
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return order[out[i]] < order[out[j]] })
+	return out, nil
+}
+
+// NewTransforms returns a Transform applying each of the named transforms,
+// which should be canonicalized by TransformNames.  Transforms may keep state
+// (like the CryptoPAN address cache), so each query should have its own.
+func NewTransforms(names []string, cryptoPANKey []byte) (Transform, error) {
+	var all []Transform
+	for _, name := range names {
+		for _, t := range transforms {
+			if t.name != name {
+				continue
+			}
+			tr, err := t.new(cryptoPANKey)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			all = append(all, tr)
+		}
+	}
+	return TransformFunc(func(p *Packet) {
+		for _, t := range all {
+			t.Transform(p)
+		}
+	}), nil
+}
+
+// ParseCryptoPANKey parses a CryptoPAN key, given either as raw bytes or hex.
+func ParseCryptoPANKey(data []byte) ([]byte, error) {
+	if len(data) == CryptoPANKeySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != CryptoPANKeySize {
+		return nil, fmt.Errorf("CryptoPAN key must be %d bytes, raw or hex", CryptoPANKeySize)
+	}
+	return key, nil
+}
+
+// ipHeader finds the IP header of an Ethernet frame, skipping any VLAN tags.
+// It returns the header's offset and length, and the IP version (4 or 6), or
+// zero if the frame isn't a valid IPv4/IPv6 packet.  Unlike ipPayload, IPv6
+// extension headers are counted as payload.
+func ipHeader(data []byte) (offset, length, version int) {
+	if len(data) < ethernetHeaderLen {
+		return 0, 0, 0
+	}
+	etherType := binary.BigEndian.Uint16(data[12:])
+	offset = ethernetHeaderLen
+	for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+		if len(data) < offset+4 {
+			return 0, 0, 0
+		}
+		etherType = binary.BigEndian.Uint16(data[offset+2:])
+		offset += 4
+	}
+	switch etherType {
+	case etherTypeIPv4:
+		if len(data) < offset+20 {
+			return 0, 0, 0
+		}
+		ihl := int(data[offset]&0x0F) * 4
+		if ihl < 20 || len(data) < offset+ihl {
+			return 0, 0, 0
+		}
+		return offset, ihl, 4
+	case etherTypeIPv6:
+		if len(data) < offset+40 {
+			return 0, 0, 0
+		}
+		return offset, 40, 6
+	}
+	return 0, 0, 0
+}
+
+// payloadStart returns where the payload of a packet starts:  after the
+// transport (TCP or UDP) header of IP packets, or after the IP header for
+// other protocols.  Other frames' payloads start after the Ethernet header.
+// It may be past the end of the data.
+func payloadStart(data []byte) int {
+	off, length, version := ipHeader(data)
+	if version == 0 {
+		return ethernetHeaderLen
+	}
+	proto, ok := transportProtocol(data, off, version)
+	start := off + length
+	switch {
+	case !ok:
+	case proto == ipProtoTCP && len(data) >= start+20:
+		start += int(data[start+12]>>4) * 4
+	case proto == ipProtoUDP:
+		start += 8
+	}
+	return start
+}
+
+// zeroPayload zeroes the payload of a packet, see payloadStart.
+func zeroPayload(p *Packet) {
+	if start := payloadStart(p.Data); start < len(p.Data) {
+		zero(p.Data[start:])
+	}
+}
+
+// PayloadSlice returns a Transform which keeps only 'length' bytes of each
+// packet's payload (see payloadStart), starting 'offset' bytes in, or all of
+// it from there if length is negative.  Headers are kept as they are.  Payload
+// before the offset is zeroed rather than removed, so packets still decode,
+// and packets are truncated after the slice, with their original lengths
+// kept, as if captured with a short snapshot length.
+func PayloadSlice(offset, length int) Transform {
+	return TransformFunc(func(p *Packet) {
+		start := payloadStart(p.Data)
+		if start >= len(p.Data) {
+			return
+		}
+		from := start + offset
+		if from > len(p.Data) {
+			from = len(p.Data)
+		}
+		zero(p.Data[start:from])
+		if length >= 0 && from+length < len(p.Data) {
+			p.Data = p.Data[:from+length]
+			p.CaptureLength = len(p.Data)
+		}
+	})
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// maskMACs zeroes the device-specific lower half of Ethernet addresses,
+// keeping the vendor's OUI and the group and locally administered bits.
+func maskMACs(p *Packet) {
+	if len(p.Data) < ethernetHeaderLen {
+		return
+	}
+	zero(p.Data[3:6])
+	zero(p.Data[9:12])
+}
+
+// CryptoPAN anonymizes the addresses in IP headers with Crypto-PAn, which is
+// prefix-preserving:  addresses sharing an N-bit prefix are anonymized to
+// addresses sharing an N-bit prefix, so subnets can still be told apart.
+// IPv6 addresses are anonymized by the same scheme extended to 128 bits.
+// Transport checksums are updated to match, where the transport header was
+// captured.
+type CryptoPAN struct {
+	block cipher.Block
+	pad   [aes.BlockSize]byte
+	cache map[string][]byte
+}
+
+// NewCryptoPAN returns a CryptoPAN transform with the given key.
+func NewCryptoPAN(key []byte) (*CryptoPAN, error) {
+	if len(key) != CryptoPANKeySize {
+		return nil, fmt.Errorf("no %d-byte key configured", CryptoPANKeySize)
+	}
+	block, err := aes.NewCipher(key[:16])
+	if err != nil {
+		return nil, err
+	}
+	c := &CryptoPAN{block: block, cache: map[string][]byte{}}
+	block.Encrypt(c.pad[:], key[16:])
+	return c, nil
+}
+
+// Anonymize returns the anonymized form of a 4- or 16-byte address.
+func (c *CryptoPAN) Anonymize(addr []byte) []byte {
+	if out, ok := c.cache[string(addr)]; ok {
+		return out
+	}
+	out := make([]byte, len(addr))
+	var in, enc [aes.BlockSize]byte
+	for pos := 0; pos < 8*len(addr); pos++ {
+		// Encrypt the first 'pos' bits of the address, padded out with the
+		// pad's remaining bits, and take the first bit of the result.
+		in = c.pad
+		whole, bits := pos/8, pos%8
+		copy(in[:whole], addr[:whole])
+		if bits > 0 {
+			mask := byte(0xFF) << (8 - bits)
+			in[whole] = addr[whole]&mask | c.pad[whole]&^mask
+		}
+		c.block.Encrypt(enc[:], in[:])
+		out[whole] |= (enc[0] >> 7) << (7 - bits)
+	}
+	for i := range out {
+		out[i] ^= addr[i]
+	}
+	c.cache[string(addr)] = out
+	return out
+}
+
+// Transform anonymizes the source and destination addresses of an IP packet,
+// updating its checksums.
+func (c *CryptoPAN) Transform(p *Packet) {
+	off, length, version := ipHeader(p.Data)
+	var addrs []byte // The source and destination addresses.
+	switch version {
+	case 4:
+		addrs = p.Data[off+12 : off+20]
+	case 6:
+		addrs = p.Data[off+8 : off+40]
+	default:
+		return
+	}
+	old := append([]byte(nil), addrs...)
+	half := len(addrs) / 2
+	copy(addrs, c.Anonymize(old[:half]))
+	copy(addrs[half:], c.Anonymize(old[half:]))
+	if version == 4 {
+		updateChecksum(p.Data[off+10:], old, addrs)
+	}
+	// TCP and UDP checksums cover the addresses too, in their pseudo-header.
+	proto, ok := transportProtocol(p.Data, off, version)
+	transport := off + length
+	switch {
+	case !ok:
+	case proto == ipProtoTCP && len(p.Data) >= transport+18:
+		updateChecksum(p.Data[transport+16:], old, addrs)
+	case proto == ipProtoUDP && len(p.Data) >= transport+8:
+		sum := p.Data[transport+6:]
+		if version == 4 && sum[0] == 0 && sum[1] == 0 {
+			return // No checksum.
+		}
+		updateChecksum(sum, old, addrs)
+		if sum[0] == 0 && sum[1] == 0 {
+			sum[0], sum[1] = 0xFF, 0xFF
+		}
+	}
+}
+
+// transportProtocol returns the protocol of the IP packet at 'off', and
+// whether the packet starts with its header:  it doesn't if it's a later
+// IPv4 fragment.
+func transportProtocol(data []byte, off, version int) (byte, bool) {
+	if version == 6 {
+		return data[off+6], true
+	}
+	fragment := binary.BigEndian.Uint16(data[off+6:]) & 0x1FFF
+	return data[off+9], fragment == 0
+}
+
+// updateChecksum updates the Internet checksum at the start of 'field' for
+// the checksummed bytes 'old' having changed to 'new', as in RFC 1624.
+func updateChecksum(field, old, new []byte) {
+	sum := uint32(^binary.BigEndian.Uint16(field))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	binary.BigEndian.PutUint16(field, ^uint16(sum))
+}
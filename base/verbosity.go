@@ -0,0 +1,141 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// flagVerbosity marks verbosity as unset, deferring to the -v flag.
+const flagVerbosity = math.MinInt32
+
+var (
+	// verbosity overrides the -v flag once SetVerbosity has been called.
+	verbosity int32 = flagVerbosity
+
+	// moduleVerbosity holds per-module overrides of the verbosity, keyed by
+	// package name.  hasModuleVerbosity is nonzero if there are any, so V
+	// only finds its caller's module when it might matter.
+	moduleMu           sync.RWMutex
+	moduleVerbosity    = map[string]int{}
+	hasModuleVerbosity int32
+
+	// callerModules caches the module of each V call site.
+	callerModules sync.Map // map[uintptr]string
+)
+
+// Verbosity returns the current verbose logging level.
+func Verbosity() int {
+	if level := atomic.LoadInt32(&verbosity); level != flagVerbosity {
+		return int(level)
+	}
+	return *VerboseLogging
+}
+
+// SetVerbosity changes the verbose logging level while running, overriding
+// the -v flag.
+func SetVerbosity(level int) {
+	atomic.StoreInt32(&verbosity, int32(level))
+}
+
+// SetModuleVerbosity sets the verbose logging level of a single module (the
+// name of a stenographer package, like "blockfile"), overriding the global
+// level in either direction.
+func SetModuleVerbosity(module string, level int) {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	moduleVerbosity[module] = level
+	atomic.StoreInt32(&hasModuleVerbosity, 1)
+}
+
+// ClearModuleVerbosity returns a module to the global verbose logging level.
+func ClearModuleVerbosity(module string) {
+	moduleMu.Lock()
+	defer moduleMu.Unlock()
+	delete(moduleVerbosity, module)
+	if len(moduleVerbosity) == 0 {
+		atomic.StoreInt32(&hasModuleVerbosity, 0)
+	}
+}
+
+// ModuleVerbosity returns the verbose logging level of the given module.
+func ModuleVerbosity(module string) int {
+	moduleMu.RLock()
+	level, ok := moduleVerbosity[module]
+	moduleMu.RUnlock()
+	if !ok {
+		return Verbosity()
+	}
+	return level
+}
+
+// ModuleVerbosities returns all per-module verbose logging levels.
+func ModuleVerbosities() map[string]int {
+	moduleMu.RLock()
+	defer moduleMu.RUnlock()
+	out := make(map[string]int, len(moduleVerbosity))
+	for m, level := range moduleVerbosity {
+		out[m] = level
+	}
+	return out
+}
+
+// verbosityAt returns the verbose logging level for code 'skip' frames above
+// its caller.
+func verbosityAt(skip int) int {
+	if atomic.LoadInt32(&hasModuleVerbosity) == 0 {
+		return Verbosity()
+	}
+	pc, _, _, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return Verbosity()
+	}
+	module, ok := callerModules.Load(pc)
+	if !ok {
+		module = moduleOf(pc)
+		callerModules.Store(pc, module)
+	}
+	return ModuleVerbosity(module.(string))
+}
+
+// moduleOf returns the package name of the function containing pc.
+func moduleOf(pc uintptr) string {
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return ""
+	}
+	// Names look like "github.com/mars-suite/stenographer/blockfile.(*BlockFile).Lookup".
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// resetVerbosity returns the global verbose logging level, and all modules',
+// to the -v flag's level.
+func resetVerbosity() {
+	atomic.StoreInt32(&verbosity, flagVerbosity)
+	for m := range ModuleVerbosities() {
+		ClearModuleVerbosity(m)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package base
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleVerbositySignals makes SIGUSR1 raise the global verbose logging level
+// by one, and SIGUSR2 return it (and all modules) to the -v flag's level, for
+// when the HTTP API itself is what needs debugging.
+func HandleVerbositySignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGUSR1 {
+				SetVerbosity(Verbosity() + 1)
+			} else {
+				resetVerbosity()
+			}
+			log.Printf("Got %v, verbose logging level now %d", sig, Verbosity())
+		}
+	}()
+}
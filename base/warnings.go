@@ -0,0 +1,68 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// QueryWarning describes part of a query's data which couldn't be searched,
+// without failing the whole query.
+type QueryWarning struct {
+	File       string
+	Start, End time.Time // Time range the file covers.
+	Reason     string
+}
+
+// QueryWarnings collects warnings for a single query.  A nil *QueryWarnings
+// drops all warnings.
+type QueryWarnings struct {
+	mu       sync.Mutex
+	warnings []QueryWarning
+}
+
+// Add records a warning.
+func (w *QueryWarnings) Add(warning QueryWarning) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, warning)
+}
+
+// List returns all warnings recorded so far.
+func (w *QueryWarnings) List() []QueryWarning {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]QueryWarning(nil), w.warnings...)
+}
+
+type queryWarningsKey struct{}
+
+// WithQueryWarnings returns a context which records query warnings in w.
+func WithQueryWarnings(ctx context.Context, w *QueryWarnings) context.Context {
+	return context.WithValue(ctx, queryWarningsKey{}, w)
+}
+
+// QueryWarningsFrom returns the QueryWarnings within the context, or nil if
+// there isn't one.
+func QueryWarningsFrom(ctx context.Context) *QueryWarnings {
+	w, _ := ctx.Value(queryWarningsKey{}).(*QueryWarnings)
+	return w
+}
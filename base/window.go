@@ -0,0 +1,45 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"time"
+)
+
+// InWindow returns whether 'ts' falls in the time range from start to end,
+// either of which may be zero for an open range.
+func InWindow(ts, start, end time.Time) bool {
+	return (start.IsZero() || !ts.Before(start)) && (end.IsZero() || ts.Before(end))
+}
+
+// WindowPacketChan returns a new PacketChan which passes along the packets
+// from 'in' with timestamps in the time range from start to end (see
+// InWindow), dropping the rest.
+func WindowPacketChan(in *PacketChan, start, end time.Time) *PacketChan {
+	if start.IsZero() && end.IsZero() {
+		return in
+	}
+	out := NewPacketChan(100)
+	go func() {
+		defer in.Discard()
+		for p := range in.Receive() {
+			if InWindow(p.Timestamp, start, end) {
+				out.Send(p)
+			}
+		}
+		out.Close(in.Err())
+	}()
+	return out
+}
@@ -0,0 +1,179 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+)
+
+// blockPackets returns the offsets within a block of each of its packets, or
+// false if it isn't a complete, well-formed block.  Blocks of a file stenotype
+// is still writing may be unwritten (zeroed) or only partially written.
+func blockPackets(block []byte) ([]int, bool) {
+	desc := (*blockDesc)(unsafe.Pointer(&block[0]))
+	hdr := (*blockHeader)(unsafe.Pointer(&desc.hdr[0]))
+	n := int(hdr.num_pkts)
+	if hdr.block_status&statusUser == 0 || n == 0 || int(hdr.blk_len) > len(block) {
+		return nil, false
+	}
+	offsets := make([]int, 0, n)
+	off := int(hdr.offset_to_first_pkt)
+	for i := 0; i < n; i++ {
+		if off < blockHeaderSize || off+packetHeaderSize > len(block) {
+			return nil, false
+		}
+		pkt := (*packetHeader)(unsafe.Pointer(&block[off]))
+		if off+int(pkt.tp_mac)+int(pkt.tp_snaplen) > len(block) {
+			return nil, false
+		}
+		offsets = append(offsets, off)
+		if i < n-1 {
+			if pkt.tp_next_offset == 0 {
+				return nil, false
+			}
+			off += int(pkt.tp_next_offset)
+		}
+	}
+	return offsets, true
+}
+
+// ActiveFile follows a blockfile stenotype is still writing, indexing each
+// block once it's completely written, so the newest packets can be queried
+// before the file is finished and gets its own index.  The index only covers
+// the outer headers indexfile.Writer understands.
+type ActiveFile struct {
+	name     string // The hidden name stenotype writes the file under.
+	finished string // The name stenotype renames it to once it's finished.
+	fc       *filecache.Cache
+	opts     Options
+	mu       sync.Mutex
+	f        *os.File // For scanning, nil once closed.
+	w        *indexfile.Writer
+	size     int64                // Bytes of complete blocks indexed so far.
+	index    *indexfile.IndexFile // Index of the first 'size' bytes, or nil if stale.
+}
+
+// OpenActive starts following the blockfile stenotype is writing at
+// 'filename'.
+func OpenActive(filename string, fc *filecache.Cache, opts Options) (*ActiveFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not open active blockfile: %v", err)
+	}
+	v(1, "Following active blockfile %q", filename)
+	finished := filepath.Join(filepath.Dir(filename), strings.TrimPrefix(filepath.Base(filename), "."))
+	return &ActiveFile{name: filename, finished: finished, fc: fc, opts: opts, f: f, w: indexfile.NewWriter()}, nil
+}
+
+// Name returns the name of the file being followed.
+func (a *ActiveFile) Name() string {
+	return a.name
+}
+
+// scan indexes any blocks completed since the last scan.  It stops at the
+// first block which isn't complete yet, to try again next time.
+func (a *ActiveFile) scan() error {
+	block := make([]byte, BlockSize)
+	for {
+		if _, err := a.f.ReadAt(block, a.size); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read block at %v: %v", a.size, err)
+		}
+		offsets, ok := blockPackets(block)
+		if !ok {
+			return nil
+		}
+		for _, off := range offsets {
+			pkt := (*packetHeader)(unsafe.Pointer(&block[off]))
+			start := off + int(pkt.tp_mac)
+			if err := a.w.AddPacket(block[start:start+int(pkt.tp_snaplen)], a.size+int64(off)); err != nil {
+				return err
+			}
+		}
+		a.size += BlockSize
+		a.index = nil
+	}
+}
+
+// Snapshot indexes any newly completed blocks, and returns a BlockFile of all
+// complete blocks so far, which the caller should close when done with.
+func (a *ActiveFile) Snapshot() (*BlockFile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil, errors.New("active blockfile closed")
+	}
+	if err := a.scan(); err != nil {
+		return nil, fmt.Errorf("could not index active blockfile %q: %v", a.name, err)
+	}
+	if a.index == nil {
+		// Index under the finished file's index name, which saved sets key
+		// positions by, and start when the finished file's name says.
+		a.index = a.w.Index(indexfile.IndexPathFromBlockfilePath(a.finished))
+		a.index.SetStarted(a.opts.started(a.finished))
+	}
+	f, name, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return &BlockFile{
+		f:    f,
+		i:    a.index,
+		name: name,
+		opts: a.opts,
+		done: make(chan struct{}),
+		size: a.size,
+		mod:  time.Now(),
+	}, nil
+}
+
+// open opens the file for reading under whichever name it has now, since
+// stenotype may rename it at any time.  It's opened immediately, so the
+// snapshot's reads aren't affected by a rename after this.
+func (a *ActiveFile) open() (*filecache.CachedFile, string, error) {
+	var err error
+	for _, name := range []string{a.name, a.finished} {
+		f := a.fc.Open(name)
+		if _, err = f.Stat(); err == nil {
+			return f, name, nil
+		}
+		f.Close()
+	}
+	return nil, "", fmt.Errorf("could not open active blockfile %q: %v", a.name, err)
+}
+
+// Close stops following the file.  Snapshots remain usable until closed.
+func (a *ActiveFile) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
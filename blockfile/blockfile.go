@@ -20,22 +20,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/google/gopacket"
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/indexfile"
-	"github.com/google/stenographer/query"
-	"github.com/google/stenographer/stats"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/query"
+	"github.com/mars-suite/stenographer/stats"
+	"github.com/mars-suite/stenographer/tracing"
 	"golang.org/x/net/context"
 )
 
-// #include <linux/if_packet.h>
-import "C"
-
 var (
 	v                = base.V // Verbose logging
 	packetReadNanos  = stats.S.Get("packet_read_nanos")
@@ -43,26 +44,107 @@ var (
 	packetsRead      = stats.S.Get("packets_read")
 	packetsScanned   = stats.S.Get("packets_scanned")
 	packetBlocksRead = stats.S.Get("packets_blocks_read")
+
+	malformedBlocksSkipped  = stats.S.Get("malformed_blocks_skipped")
+	malformedPacketsSkipped = stats.S.Get("malformed_packets_skipped")
 )
 
+// Options are how blockfiles are read.
+type Options struct {
+	// Clock is what the packet timestamps stenotype records are measured in.
+	// Packets are returned with timestamps converted to UTC.
+	Clock base.Clock
+	// FileNames is the naming scheme of the blockfiles, whose names say when
+	// they were started.  Nil means the default scheme.
+	FileNames *base.FileNames
+	// ClockSkew is how far file timestamps may stray from the timestamps of
+	// the packets within them.
+	ClockSkew time.Duration
+	// ReadCache, if set, holds recently read regions of blockfiles in memory.
+	ReadCache *RegionCache
+	// Index is how the blockfiles' indexes are read.
+	Index indexfile.Options
+}
+
+// DefaultOptions returns the Options of stenographer's default
+// configuration, for tools reading blockfiles outside of it.
+func DefaultOptions() Options {
+	return Options{ClockSkew: time.Minute}
+}
+
+// Names returns the naming scheme of the blockfiles.
+func (o Options) Names() *base.FileNames {
+	if o.FileNames == nil {
+		return base.DefaultFileNames()
+	}
+	return o.FileNames
+}
+
+// started returns when the named blockfile may have been started, from the
+// time in its name, allowing for clock skew (see indexfile.SetStarted).  The
+// range is zero if the name has no time.
+func (o Options) started(filename string) base.TimeRange {
+	t, err := o.Names().Time(filepath.Base(filename))
+	if err != nil {
+		return base.TimeRange{}
+	}
+	return base.TimeRange{Start: t.Add(-o.ClockSkew), End: t.Add(o.ClockSkew)}
+}
+
+// packetTimestamp returns the UTC time of a packet from its header.
+func (b *BlockFile) packetTimestamp(pkt *packetHeader) time.Time {
+	return b.opts.Clock.UTC(time.Unix(int64(pkt.tp_sec), int64(pkt.tp_nsec)))
+}
+
 // BlockFile provides an interface to a single stenotype file on disk and its
 // associated index.
 type BlockFile struct {
 	name string
+	opts Options
 	f    *filecache.CachedFile
 	i    *indexfile.IndexFile
 	mu   sync.RWMutex // Stops Close() from invalidating a file before a current query is done with it.
 	done chan struct{}
 	size int64
+	mod  time.Time
+
+	corruptMu sync.Mutex
+	corrupt   error // Set once an index lookup fails.
+
+	dropsMu sync.Mutex
+	drops   *base.DropStats // Set once Drops has counted them.
+
+	pinMu   sync.Mutex
+	pins    int      // Queries holding the file open, see Pin.
+	closed  bool     // Set once Close is called.
+	onClose []func() // Run once the file is actually closed, see AfterClose.
 }
 
 // NewBlockFile opens up a named block file (and its index), returning a handle
 // which can be used to look up packets.
-func NewBlockFile(filename string, fc *filecache.Cache) (*BlockFile, error) {
+func NewBlockFile(filename string, fc *filecache.Cache, opts Options) (*BlockFile, error) {
+	return OpenBlockFile(filename, indexfile.IndexPathFromBlockfilePath(filename), fc, opts)
+}
+
+// OpenBlockFile is like NewBlockFile, but reads the blockfile's index from
+// indexPath rather than the usual IDX path.  If indexPath is empty, the
+// blockfile is indexed in memory as it's opened, which takes a full read of
+// it.  This is for files copied off a sensor, which may have lost
+// stenographer's directory layout, or their indexes.
+func OpenBlockFile(filename, indexPath string, fc *filecache.Cache, opts Options) (*BlockFile, error) {
 	v(1, "Blockfile opening: %q", filename)
-	i, err := indexfile.NewIndexFile(indexfile.IndexPathFromBlockfilePath(filename), fc)
-	if err != nil {
-		return nil, fmt.Errorf("could not open index for %q: %v", filename, err)
+	var i *indexfile.IndexFile
+	if indexPath != "" {
+		// Open the index and the blockfile together, so neither is replaced
+		// without the other in between.
+		unlock, err := indexfile.RLockIndex(indexPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not open index for %q: %v", filename, err)
+		}
+		defer unlock()
+		if i, err = indexfile.NewIndexFile(indexPath, fc, opts.Index); err != nil {
+			return nil, fmt.Errorf("could not open index for %q: %v", filename, err)
+		}
 	}
 	f := fc.Open(filename)
 	s, err := f.Stat()
@@ -70,13 +152,64 @@ func NewBlockFile(filename string, fc *filecache.Cache) (*BlockFile, error) {
 		f.Close()
 		return nil, fmt.Errorf("could not stat file %q: %v", filename, err)
 	}
-	return &BlockFile{
+	b := &BlockFile{
 		f:    f,
 		i:    i,
 		name: filename,
+		opts: opts,
 		done: make(chan struct{}),
 		size: s.Size(),
-	}, nil
+		mod:  s.ModTime(),
+	}
+	if i == nil {
+		w := indexfile.NewWriter()
+		err := b.scanPackets(context.Background(), func(pos int64, data []byte) error {
+			return w.AddPacket(data, pos)
+		})
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not index %q: %v", filename, err)
+		}
+		b.i = w.Index(filename)
+	}
+	b.i.SetPacketScanner(b.scanPackets)
+	b.i.SetStarted(opts.started(filename))
+	return b, nil
+}
+
+// OpenKnownBlockFile is like NewBlockFile, but for a file whose size and
+// modification time are already known (as from a manifest of files written
+// by an earlier run), so it touches neither the file nor its index until
+// they're first used.  Errors opening the index are returned by lookups.
+func OpenKnownBlockFile(filename string, fc *filecache.Cache, opts Options, size int64, mod time.Time) *BlockFile {
+	v(1, "Blockfile opening known file: %q", filename)
+	i := indexfile.NewLazyIndexFile(indexfile.IndexPathFromBlockfilePath(filename), fc, opts.Index)
+	b := &BlockFile{
+		f:    fc.OpenKnown(filename, size, mod),
+		i:    i,
+		name: filename,
+		opts: opts,
+		done: make(chan struct{}),
+		size: size,
+		mod:  mod,
+	}
+	i.SetPacketScanner(b.scanPackets)
+	i.SetStarted(opts.started(filename))
+	return b
+}
+
+// scanPackets implements indexfile.PacketScanner, for building the file's flow
+// index and backfilling its index.  It's called by index lookups, so b.mu must
+// be locked.
+func (b *BlockFile) scanPackets(ctx context.Context, fn func(pos int64, data []byte) error) error {
+	pkts := &allPacketsIter{BlockFile: b, ctx: ctx}
+	defer pkts.release()
+	for pkts.Next() {
+		if err := fn(pkts.position(), pkts.Packet().Data); err != nil {
+			return err
+		}
+	}
+	return pkts.Err()
 }
 
 // Name returns the name of the file underlying this blockfile.
@@ -89,34 +222,193 @@ func (b *BlockFile) Size() int64 {
 	return b.size
 }
 
-// readPacket reads a single packet from the file at the given position.
-// It updates the passed in CaptureInfo with information on the packet.
-func (b *BlockFile) readPacket(pos int64, ci *gopacket.CaptureInfo) ([]byte, error) {
+// ModTime returns the time the blockfile was last modified, which is roughly
+// the time of the last packet written to it.
+func (b *BlockFile) ModTime() time.Time {
+	return b.mod
+}
+
+// Replaced returns whether reads have failed because the blockfile or its index
+// has been replaced (as by stenodefrag or stenoreindex) since it was opened.
+// Such files need reopening, see filecache.ReplacedError.
+func (b *BlockFile) Replaced() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.f != nil && b.replacedLocked()
+}
+
+// replacedLocked is Replaced for callers holding b.mu, with the file open.
+func (b *BlockFile) replacedLocked() bool {
+	return b.f.Replaced() || b.i.Replaced()
+}
+
+// Corrupt returns why the blockfile's index appears to be corrupt, or nil if
+// it's fine as far as we know.  Corrupt files are skipped by lookups.
+func (b *BlockFile) Corrupt() error {
+	b.corruptMu.Lock()
+	defer b.corruptMu.Unlock()
+	return b.corrupt
+}
+
+// markCorrupt records why the blockfile's index appears to be corrupt.  b.mu
+// must be locked.
+func (b *BlockFile) markCorrupt(err error) {
+	if b.replacedLocked() {
+		return // Not corrupt, just rewritten while open.
+	}
+	b.corruptMu.Lock()
+	defer b.corruptMu.Unlock()
+	b.corrupt = err
+}
+
+// Verify reads through the blockfile's entire index, marking the file corrupt
+// if that fails.
+func (b *BlockFile) Verify(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return nil // Closed.
+	}
+	err := b.i.Verify(ctx)
+	if err != nil && ctx.Err() == nil {
+		err = fmt.Errorf("index verification failure: %v", err)
+		log.Printf("Blockfile %q: %v", b.name, err)
+		b.markCorrupt(err)
+	}
+	return err
+}
+
+// skip records that some or all of the blockfile's packets are missing from a
+// query's results, and why.
+func (b *BlockFile) skip(ctx context.Context, reason error) {
+	w := base.QueryWarning{File: b.name, End: b.mod, Reason: reason.Error()}
+	if ts, err := b.opts.Names().Time(filepath.Base(b.name)); err == nil {
+		w.Start = ts
+	}
+	base.QueryWarningsFrom(ctx).Add(w)
+}
+
+// readPacketHeader reads the header of the packet at the given position.
+func (b *BlockFile) readPacketHeader(pos int64) (*packetHeader, error) {
 	// 28 bytes actually isn't the entire packet header, but it's all the fields
 	// that we care about.
+	var dataBuf [28]byte
+	if _, err := b.readAt(dataBuf[:], pos); err != nil {
+		return nil, err
+	}
+	return (*packetHeader)(unsafe.Pointer(&dataBuf[0])), nil
+}
+
+// errMalformedPacket is returned by readPacket for positions without a valid
+// packet header, as when the packet was in a hole of a sparse file or a block
+// a crash left unwritten.
+var errMalformedPacket = errors.New("no valid packet header")
+
+// readPacket reads a single packet from the file at the given position, into
+// a pooled buffer (see base.NewPooledPacket).
+func (b *BlockFile) readPacket(pos int64) (*base.Packet, error) {
 	packetsRead.Increment()
 	defer packetReadNanos.NanoTimer()()
-	var dataBuf [28]byte
-	_, err := b.f.ReadAt(dataBuf[:], pos)
+	pkt, err := b.readPacketHeader(pos)
 	if err != nil {
 		return nil, err
 	}
-	pkt := (*C.struct_tpacket3_hdr)(unsafe.Pointer(&dataBuf[0]))
-	*ci = gopacket.CaptureInfo{
-		Timestamp:     time.Unix(int64(pkt.tp_sec), int64(pkt.tp_nsec)),
+	if int(pkt.tp_mac) < packetHeaderSize || int(pkt.tp_mac)+int(pkt.tp_snaplen) > BlockSize {
+		return nil, errMalformedPacket
+	}
+	out := base.NewPooledPacket(int(pkt.tp_snaplen))
+	out.CaptureInfo = gopacket.CaptureInfo{
+		Timestamp:     b.packetTimestamp(pkt),
 		Length:        int(pkt.tp_len),
 		CaptureLength: int(pkt.tp_snaplen),
 	}
-	out := make([]byte, ci.CaptureLength)
-	pos += int64(pkt.tp_mac)
-	_, err = b.f.ReadAt(out, pos)
-	return out, err
+	if _, err := b.readAt(out.Data, pos+int64(pkt.tp_mac)); err != nil {
+		out.Release()
+		return nil, err
+	}
+	return out, nil
+}
+
+// readAt reads packet data from the file, through the ReadCache if there is
+// one.
+func (b *BlockFile) readAt(buf []byte, off int64) (int, error) {
+	if b.opts.ReadCache == nil {
+		return b.f.ReadAt(buf, off)
+	}
+	return b.opts.ReadCache.ReadAt(b.name, b.f, b.size, buf, off)
 }
 
-// Close cleans up this blockfile.
+// Pin keeps the blockfile open until a matching Unpin, even if it's closed in
+// between, so a query can read a consistent set of files however they're
+// rotated out or cleaned up while it runs.  It returns false, without pinning
+// the file, if it's already been closed.
+func (b *BlockFile) Pin() bool {
+	b.pinMu.Lock()
+	defer b.pinMu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.pins++
+	return true
+}
+
+// Unpin releases a Pin, closing the file if it was closed while pinned and
+// this was the last pin.
+func (b *BlockFile) Unpin() {
+	b.pinMu.Lock()
+	b.pins--
+	last := b.closed && b.pins == 0
+	b.pinMu.Unlock()
+	if last {
+		if err := b.close(); err != nil {
+			log.Printf("Blockfile %q: error closing once unpinned: %v", b.name, err)
+		}
+	}
+}
+
+// AfterClose runs f once the blockfile has actually been closed, which is
+// right away if it already has.  Deleting a file's data in f, rather than on
+// Close, keeps it readable by queries that have it pinned.
+func (b *BlockFile) AfterClose(f func()) {
+	b.pinMu.Lock()
+	if !b.closed || b.pins > 0 {
+		b.onClose = append(b.onClose, f)
+		b.pinMu.Unlock()
+		return
+	}
+	b.pinMu.Unlock()
+	f()
+}
+
+// Close cleans up this blockfile.  If it's pinned, that's put off until the
+// last pin is released, and new pins fail.
 func (b *BlockFile) Close() (err error) {
+	b.pinMu.Lock()
+	b.closed = true
+	pinned := b.pins > 0
+	b.pinMu.Unlock()
+	if pinned {
+		v(2, "Blockfile closing once unpinned: %q", b.name)
+		return nil
+	}
+	return b.close()
+}
+
+func (b *BlockFile) close() (err error) {
+	defer func() {
+		b.pinMu.Lock()
+		onClose := b.onClose
+		b.onClose = nil
+		b.pinMu.Unlock()
+		for _, f := range onClose {
+			f()
+		}
+	}()
 	v(2, "Blockfile closing: %q", b.name)
 	close(b.done)
+	if b.opts.ReadCache != nil {
+		b.opts.ReadCache.forget(b.name)
+	}
 	b.mu.Lock()
 	defer b.mu.Unlock()
 	v(3, "Blockfile closing file descriptors: %q", b.name)
@@ -130,63 +422,107 @@ func (b *BlockFile) Close() (err error) {
 	return
 }
 
-// allPacketsIter implements Iter.
+// blockBuffers holds block-sized buffers for reading whole blocks, so scans of
+// entire files don't allocate a megabyte per block.
+var blockBuffers = sync.Pool{New: func() interface{} { return new([BlockSize]byte) }}
+
+// allPacketsIter implements Iter.  It reads each block into a single buffer
+// from blockBuffers, so the data of the packets it returns is only valid until
+// it moves on to the next block:  packets which outlive that must be copied
+// (see packetSlab).  The buffer is returned to the pool by release, which
+// Next calls once it's done.
 type allPacketsIter struct {
 	*BlockFile
-	blockData        []byte
-	block            *C.struct_tpacket_hdr_v1
-	pkt              *C.struct_tpacket3_hdr
-	blockPacketsRead int
-	blockOffset      int64
-	packetOffset     int // offset of packet in block
-	err              error
-	done             bool
+	ctx          context.Context // checked between blocks, if set
+	buf          *[BlockSize]byte
+	blockData    []byte
+	block        *blockHeader
+	offsets      []int // offsets of the block's unread packets
+	pkt          *packetHeader
+	packet       base.Packet // returned by Packet
+	blockOffset  int64
+	packetOffset int // offset of packet in block
+	skipped      int // malformed blocks skipped
+	err          error
+	done         bool
 }
 
 func (a *allPacketsIter) Next() bool {
 	defer packetScanNanos.NanoTimer()()
 	if a.err != nil || a.done {
+		a.release()
 		return false
 	}
-	for a.block == nil || a.blockPacketsRead == int(a.block.num_pkts) {
+	for len(a.offsets) == 0 {
+		if a.blockOffset >= a.size {
+			// Active files are only read up to their last complete block.
+			a.done = true
+			a.release()
+			return false
+		}
+		if a.ctx != nil && a.ctx.Err() != nil {
+			a.err = a.ctx.Err()
+			a.release()
+			return false
+		}
 		packetBlocksRead.Increment()
-		a.blockData = make([]byte, 1<<20)
-		_, err := a.f.ReadAt(a.blockData[:], a.blockOffset)
+		if a.buf == nil {
+			a.buf = blockBuffers.Get().(*[BlockSize]byte)
+			a.blockData = a.buf[:]
+		}
+		_, err := a.readAt(a.blockData, a.blockOffset)
 		if err == io.EOF {
 			a.done = true
+			a.release()
 			return false
 		} else if err != nil {
 			a.err = fmt.Errorf("could not read block at %v: %v", a.blockOffset, err)
+			a.release()
 			return false
 		}
-		baseHdr := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&a.blockData[0]))
-		a.block = (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&baseHdr.hdr[0]))
-		a.blockOffset += 1 << 20
-		a.blockPacketsRead = 0
-		a.pkt = nil
-	}
-	a.blockPacketsRead++
-	if a.pkt == nil {
-		a.packetOffset = int(a.block.offset_to_first_pkt)
-	} else if a.pkt.tp_next_offset != 0 {
-		a.packetOffset += int(a.pkt.tp_next_offset)
-	} else {
-		a.err = errors.New("block format currently not supported")
-		return false
+		baseHdr := (*blockDesc)(unsafe.Pointer(&a.blockData[0]))
+		a.block = (*blockHeader)(unsafe.Pointer(&baseHdr.hdr[0]))
+		offsets, ok := blockPackets(a.blockData)
+		if !ok && (a.block.block_status&statusUser == 0 || a.block.num_pkts != 0) {
+			// Holes in sparse files, and blocks a crash left unwritten or
+			// half-written, read as zeroes.  They're skipped rather than
+			// failing the whole read.  Blocks written empty are fine.
+			v(1, "Blockfile %q skipping malformed block at %v", a.name, a.blockOffset)
+			malformedBlocksSkipped.Increment()
+			a.skipped++
+		}
+		a.offsets = offsets
+		a.blockOffset += BlockSize
 	}
-	a.pkt = (*C.struct_tpacket3_hdr)(unsafe.Pointer(&a.blockData[a.packetOffset]))
+	a.packetOffset, a.offsets = a.offsets[0], a.offsets[1:]
+	a.pkt = (*packetHeader)(unsafe.Pointer(&a.blockData[a.packetOffset]))
 	packetsScanned.Increment()
 	return true
 }
 
+// Packet returns the current packet.  Both it and its data are reused by the
+// iterator, so they're only valid until the next call to Next.
 func (a *allPacketsIter) Packet() *base.Packet {
 	start := a.packetOffset + int(a.pkt.tp_mac)
-	buf := a.blockData[start : start+int(a.pkt.tp_snaplen)]
-	p := &base.Packet{Data: buf}
-	p.CaptureInfo.Timestamp = time.Unix(int64(a.pkt.tp_sec), int64(a.pkt.tp_nsec))
-	p.CaptureInfo.Length = int(a.pkt.tp_len)
-	p.CaptureInfo.CaptureLength = int(a.pkt.tp_snaplen)
-	return p
+	a.packet = base.Packet{Data: a.blockData[start : start+int(a.pkt.tp_snaplen)]}
+	a.packet.CaptureInfo.Timestamp = a.packetTimestamp(a.pkt)
+	a.packet.CaptureInfo.Length = int(a.pkt.tp_len)
+	a.packet.CaptureInfo.CaptureLength = int(a.pkt.tp_snaplen)
+	return &a.packet
+}
+
+// release returns the iterator's block buffer to the pool.  It's safe to call
+// more than once, and the iterator must not be used afterwards.
+func (a *allPacketsIter) release() {
+	if a.buf != nil {
+		blockBuffers.Put(a.buf)
+		a.buf, a.blockData, a.pkt, a.offsets = nil, nil, nil, nil
+	}
+}
+
+// position returns the position of the current packet in the blockfile.
+func (a *allPacketsIter) position() int64 {
+	return a.blockOffset - BlockSize + int64(a.packetOffset)
 }
 
 func (a *allPacketsIter) Err() error {
@@ -194,21 +530,114 @@ func (a *allPacketsIter) Err() error {
 }
 
 // AllPackets returns a packet channel to which all packets in the blockfile are
-// sent.
-func (b *BlockFile) AllPackets() *base.PacketChan {
+// sent.  Reading stops, closing the channel with the context's error, if ctx
+// is canceled, so callers that stop receiving early should cancel it (or
+// Discard the channel) to release the file.  The file is read a block at a
+// time through a pooled buffer, so memory use is bounded by the channel's
+// capacity rather than the size of the file.
+func (b *BlockFile) AllPackets(ctx context.Context) *base.PacketChan {
 	b.mu.RLock()
 	c := base.NewPacketChan(100)
 	go func() {
 		defer b.mu.RUnlock()
-		pkts := &allPacketsIter{BlockFile: b}
+		if b.f == nil {
+			c.Close(nil) // Closed.
+			return
+		}
+		pkts := &allPacketsIter{BlockFile: b, ctx: ctx}
+		defer pkts.release()
+		var slab packetSlab
 		for pkts.Next() {
-			c.Send(pkts.Packet())
+			select {
+			case <-ctx.Done():
+				c.Close(ctx.Err())
+				return
+			case <-b.done:
+				c.Close(fmt.Errorf("blockfile %q closed", b.name))
+				return
+			case c.C <- slab.copy(pkts.Packet()):
+			}
 		}
 		c.Close(pkts.Err())
 	}()
 	return c
 }
 
+// Compact writes a copy of the blockfile and its index to the given paths,
+// with packets packed as densely as possible into full blocks.  stenotype
+// flushes blocks early when traffic is low, so blockfiles can have a lot of
+// unused space at the end of each block.  Returns the size of the new
+// blockfile.
+func (b *BlockFile) Compact(packetPath, indexPath string) (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	f, err := os.Create(packetPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not create blockfile: %v", err)
+	}
+	defer f.Close()
+	w := NewWriter(f)
+	positions := map[int64]int64{}
+	pkts := &allPacketsIter{BlockFile: b}
+	defer pkts.release()
+	for pkts.Next() {
+		p := pkts.Packet()
+		pos, err := w.WritePacket(p.CaptureInfo, p.Data)
+		if err != nil {
+			return 0, err
+		}
+		if pkts.block.block_status&statusLosing != 0 {
+			// Keep track of drops, if not exactly which packets they preceded.
+			w.MarkLosing()
+		}
+		positions[pkts.position()] = pos
+	}
+	if err := pkts.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("could not close blockfile: %v", err)
+	}
+	if err := b.i.Rewrite(indexPath, positions); err != nil {
+		return 0, err
+	}
+	return w.Size(), nil
+}
+
+// Backfill writes a copy of the blockfile's index to the given path, with
+// keys of the given types (see indexfile.ParseKeyTypes) added for all its
+// packets.  Returns how many positions were added.
+func (b *BlockFile) Backfill(ctx context.Context, indexPath string, keyTypes []byte) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.i.Backfill(ctx, indexPath, keyTypes)
+}
+
+// BuildAppIndex builds the app index of the blockfile's index (see
+// indexfile.AppProtocolIndexes), if it doesn't have one yet.
+func (b *BlockFile) BuildAppIndex(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return nil // Closed.
+	}
+	return b.i.BuildAppIndex(ctx)
+}
+
+// BuildQUICIndex builds the QUIC index of the blockfile's index (see
+// indexfile.QUICConnectionIDIndexes), if it doesn't have one yet.
+func (b *BlockFile) BuildQUICIndex(ctx context.Context) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return nil // Closed.
+	}
+	return b.i.BuildQUICIndex(ctx)
+}
+
 // Positions returns the positions in the blockfile of all packets matched by
 // the passed-in query.
 func (b *BlockFile) Positions(ctx context.Context, q query.Query) (base.Positions, error) {
@@ -217,6 +646,35 @@ func (b *BlockFile) Positions(ctx context.Context, q query.Query) (base.Position
 	return b.positionsLocked(ctx, q)
 }
 
+// SetPositions returns the name of the blockfile's index and the positions in
+// the blockfile of all packets matched by a query, for saving as a query set.
+// As with LookupPositions, corrupt files are skipped with a warning.
+func (b *BlockFile) SetPositions(ctx context.Context, q query.Query) (string, base.Positions, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return "", nil, nil
+	}
+	if err := b.Corrupt(); err != nil {
+		b.skip(ctx, err)
+		return b.i.Name(), nil, nil
+	}
+	positions, err := b.positionsLocked(ctx, q)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", nil, ctx.Err()
+		} else if _, ok := err.(*base.MemoryLimitError); ok {
+			return "", nil, err
+		}
+		err = fmt.Errorf("index lookup failure: %v", err)
+		log.Printf("Blockfile %q: %v", b.name, err)
+		b.markCorrupt(err)
+		b.skip(ctx, err)
+		return b.i.Name(), nil, nil
+	}
+	return b.i.Name(), positions, nil
+}
+
 // positionsLocked returns the positions in the blockfile of all packets matched by
 // the passed-in query.  b.mu must be locked.
 func (b *BlockFile) positionsLocked(ctx context.Context, q query.Query) (base.Positions, error) {
@@ -227,24 +685,181 @@ func (b *BlockFile) positionsLocked(ctx context.Context, q query.Query) (base.Po
 	return q.LookupIn(ctx, b.i)
 }
 
+// Seen returns the timestamps of the first and last packets in the blockfile
+// matched by the passed-in query, reading just those packets' headers, or
+// false if none match.  Files with corrupt indexes are skipped, as by Lookup.
+func (b *BlockFile) Seen(ctx context.Context, q query.Query) (first, last time.Time, ok bool, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.Corrupt(); err != nil {
+		b.skip(ctx, err)
+		return first, last, false, nil
+	}
+	positions, err := b.positionsLocked(ctx, q)
+	if err != nil {
+		if ctx.Err() != nil {
+			return first, last, false, ctx.Err()
+		}
+		err = fmt.Errorf("index lookup failure: %v", err)
+		b.markCorrupt(err)
+		b.skip(ctx, err)
+		return first, last, false, nil
+	}
+	if len(positions) == 0 {
+		return first, last, false, nil
+	}
+	if positions.IsAllPositions() {
+		// Finding the last packet would mean reading the whole last block, so
+		// make do with when the file was last written.
+		_, pos, err := b.readBlockHeader(0)
+		if err == nil {
+			first, err = b.packetTime(pos)
+		}
+		return first, b.mod, err == nil, err
+	}
+	if first, err = b.packetTime(positions[0]); err == nil {
+		last, err = b.packetTime(positions[len(positions)-1])
+	}
+	return first, last, err == nil, err
+}
+
+// packetTime returns the timestamp of the packet at the given position.
+func (b *BlockFile) packetTime(pos int64) (time.Time, error) {
+	pkt, err := b.readPacketHeader(pos)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading packet from %q @ %v: %v", b.name, pos, err)
+	}
+	return b.packetTimestamp(pkt), nil
+}
+
 // Lookup returns all packets in the blockfile matched by the passed-in query.
+// If the context carries base.FileTimings, time spent in index lookup, packet
+// reads, and channel sends is recorded there.
 func (b *BlockFile) Lookup(ctx context.Context, q query.Query, out *base.PacketChan) {
+	b.LookupPositions(ctx, q).Read(ctx, out)
+}
+
+// PendingLookup is a blockfile lookup whose index positions have been found,
+// but whose packets haven't been read yet.  Splitting the two allows index
+// lookups for one file to overlap with packet reads from another.  Exactly one
+// of Read or Discard must be called on it.
+type PendingLookup struct {
+	b          *BlockFile
+	positions  base.Positions
+	err        error // Set if the lookup failed, or was skipped (nil error).
+	done       bool  // Set if there's nothing to read.
+	start      time.Time
+	lookupTime time.Duration
+	budget     *base.MemoryBudget
+	reserved   int64
+}
+
+// LookupPositions does the index lookup part of Lookup, returning a
+// PendingLookup whose Read does the rest.
+func (b *BlockFile) LookupPositions(ctx context.Context, q query.Query) *PendingLookup {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
 
-	var ci gopacket.CaptureInfo
+	p := &PendingLookup{b: b, start: time.Now()}
 	v(2, "Blockfile %q looking up query %q", b.name, q.String())
-	start := time.Now()
+	_, span := tracing.Start(ctx, "lookup")
+	span.SetAttribute("steno.file", b.name)
+	defer span.End()
+	if err := b.Corrupt(); err != nil {
+		b.skip(ctx, err)
+		p.done = true
+		return p
+	}
 	positions, err := b.positionsLocked(ctx, q)
+	p.lookupTime = time.Since(p.start)
 	if err != nil {
-		out.Close(fmt.Errorf("index lookup failure: %v", err))
+		span.SetError(err)
+		p.done = true
+		if ctx.Err() != nil {
+			p.err = ctx.Err()
+			return p
+		} else if _, ok := err.(*base.MemoryLimitError); ok {
+			p.err = err
+			return p
+		}
+		// A broken index shouldn't fail the whole query, so skip this file and
+		// warn about it.
+		err = fmt.Errorf("index lookup failure: %v", err)
+		log.Printf("Blockfile %q: %v", b.name, err)
+		b.markCorrupt(err)
+		b.skip(ctx, err)
+		return p
+	}
+	p.budget = base.MemoryBudgetFrom(ctx)
+	if err := p.budget.Reserve(int64(8 * len(positions))); err != nil {
+		p.err = fmt.Errorf("looking up %d packets in %q: %v", len(positions), b.name, err)
+		p.done = true
+		return p
+	}
+	p.reserved = int64(8 * len(positions))
+	p.positions = positions
+	if !positions.IsAllPositions() {
+		span.SetAttribute("steno.positions", len(positions))
+	}
+	return p
+}
+
+// Discard releases the memory held by a lookup which won't be read.
+func (p *PendingLookup) Discard() {
+	p.budget.Release(p.reserved)
+	p.reserved = 0
+}
+
+// Read reads all packets found by the lookup into out, then closes it.  If
+// the blockfile was closed since the lookup, nothing is read.
+func (p *PendingLookup) Read(ctx context.Context, out *base.PacketChan) {
+	defer p.Discard()
+	b := p.b
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	timings := base.FileTimingsFrom(ctx)
+	var readTime, sendTime time.Duration
+	packets := 0
+	_, span := tracing.Start(ctx, "read")
+	span.SetAttribute("steno.file", b.name)
+	defer func() {
+		span.SetAttribute("steno.packets", packets)
+		span.End()
+	}()
+	lap := func(*time.Duration) {}
+	if timings != nil {
+		last := time.Now()
+		lap = func(d *time.Duration) {
+			now := time.Now()
+			*d += now.Sub(last)
+			last = now
+		}
+		defer func() { timings.Record(packets, p.lookupTime, readTime, sendTime) }()
+	}
+	if p.done {
+		out.Close(p.err)
 		return
 	}
-	if positions.IsAllPositions() {
+	if b.i == nil || b.f == nil {
+		// If we're closed, just return nothing.
+		out.Close(nil)
+		return
+	}
+	src := base.PacketSource{File: b.name}
+	if s, ok := base.CaptureSourceFrom(ctx); ok {
+		src.Thread = s.Thread
+	}
+	if p.positions.IsAllPositions() {
 		v(2, "Blockfile %q reading all packets", b.name)
 		iter := &allPacketsIter{BlockFile: b}
+		defer iter.release()
+		var slab packetSlab
 	all_packets_loop:
 		for iter.Next() {
+			lap(&readTime)
+			pkt := slab.copy(iter.Packet())
+			pkt.Source, pkt.Source.Offset = src, iter.position()
 			select {
 			case <-ctx.Done():
 				v(2, "Blockfile %q canceling packet read", b.name)
@@ -252,42 +867,76 @@ func (b *BlockFile) Lookup(ctx context.Context, q query.Query, out *base.PacketC
 			case <-b.done:
 				v(2, "Blockfile %q closing, breaking out of query", b.name)
 				break all_packets_loop
-			case out.C <- iter.Packet():
+			case out.C <- pkt:
+				packets++
 			}
+			lap(&sendTime)
 		}
 		if iter.Err() != nil {
 			out.Close(fmt.Errorf("error reading all packets from %q: %v", b.name, iter.Err()))
 			return
 		}
+		if iter.skipped > 0 {
+			b.skip(ctx, fmt.Errorf("%d malformed or zero-filled blocks skipped", iter.skipped))
+		}
 	} else {
-		v(2, "Blockfile %q reading %v packets", b.name, len(positions))
+		v(2, "Blockfile %q reading %v packets", b.name, len(p.positions))
+		skipped := 0
 	query_packets_loop:
-		for _, pos := range positions {
-			buffer, err := b.readPacket(pos, &ci)
-			if err != nil {
+		for _, pos := range p.positions {
+			pkt, err := b.readPacket(pos)
+			lap(&readTime)
+			if err == errMalformedPacket {
+				v(1, "Blockfile %q skipping malformed packet at %v", b.name, pos)
+				malformedPacketsSkipped.Increment()
+				skipped++
+				continue
+			} else if err != nil {
 				v(2, "Blockfile %q error reading packet: %v", b.name, err)
 				out.Close(fmt.Errorf("error reading packets from %q @ %v: %v", b.name, pos, err))
 				return
 			}
+			pkt.Source, pkt.Source.Offset = src, pos
 			select {
 			case <-ctx.Done():
 				v(2, "Blockfile %q canceling packet read", b.name)
+				pkt.Release()
 				break query_packets_loop
 			case <-b.done:
 				v(2, "Blockfile %q closing, breaking out of query", b.name)
+				pkt.Release()
 				break query_packets_loop
-			case out.C <- &base.Packet{Data: buffer, CaptureInfo: ci}:
+			case out.C <- pkt:
+				packets++
 			}
+			lap(&sendTime)
+		}
+		if skipped > 0 {
+			b.skip(ctx, fmt.Errorf("%d packets at malformed or zero-filled positions skipped", skipped))
 		}
 	}
-	v(2, "Blockfile %q finished reading all packets in %v", b.name, time.Since(start))
+	v(2, "Blockfile %q finished reading all packets in %v", b.name, time.Since(p.start))
 	out.Close(ctx.Err())
 }
 
-// DumpIndex dumps out a "human-readable" debug version of the blockfile's index
-// to the given writer.
-func (b *BlockFile) DumpIndex(out io.Writer, start, finish []byte) {
+// DumpIndex dumps the keys of the blockfile's index from start to finish to
+// the given writer, in one of the indexfile.Dump formats.
+func (b *BlockFile) DumpIndex(out io.Writer, start, finish []byte, format string) error {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	b.i.Dump(out, start, finish)
+	if b.i == nil {
+		return fmt.Errorf("blockfile %q closed", b.name)
+	}
+	return b.i.Dump(out, start, finish, format)
+}
+
+// IndexStats returns the statistics of the blockfile's index the query
+// planner uses (see indexfile.Stats), or nil if it has none.
+func (b *BlockFile) IndexStats() *indexfile.Stats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.i == nil {
+		return nil // Closed.
+	}
+	return b.i.Stats()
 }
@@ -15,24 +15,54 @@
 package blockfile
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"golang.org/x/net/context"
 
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/query"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/query"
 )
 
 var ctx = context.Background()
 
-const (
-	filename = "../testdata/PKT0/dhcp"
-)
+// testdata is a copy of the repository's testdata directory, since opening
+// indexes writes lock files beside them.
+var testdata string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := exec.Command("cp", "-r", "../testdata", dir).Run(); err != nil {
+		log.Fatalf("could not copy testdata: %v", err)
+	}
+	testdata = filepath.Join(dir, "testdata")
+	filename = filepath.Join(testdata, "PKT0", "dhcp")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// filename is the test blockfile, set by TestMain.
+var filename string
 
 func testBlockFile(t *testing.T, filename string) *BlockFile {
-	blk, err := NewBlockFile(filename, filecache.NewCache(10))
+	blk, err := NewBlockFile(filename, filecache.NewCache(10), Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,3 +91,845 @@ func TestPositions(t *testing.T) {
 		}
 	}
 }
+
+func TestPendingLookup(t *testing.T) {
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk := testBlockFile(t, filename)
+	out := base.NewPacketChan(100)
+	blk.LookupPositions(ctx, q).Read(ctx, out)
+	count := 0
+	for range out.Receive() {
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	} else if count != 4 {
+		t.Errorf("got %d packets, want 4", count)
+	}
+
+	// Closing the file between lookup and read leaves nothing to read.
+	p := blk.LookupPositions(ctx, q)
+	blk.Close()
+	out = base.NewPacketChan(100)
+	p.Read(ctx, out)
+	if pkt := <-out.Receive(); pkt != nil {
+		t.Errorf("got packet from closed file")
+	} else if err := out.Err(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPin(t *testing.T) {
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk := testBlockFile(t, filename)
+	if !blk.Pin() {
+		t.Fatal("could not pin open file")
+	}
+	closed := false
+	blk.AfterClose(func() { closed = true })
+	// A pinned file stays readable through Close, until it's unpinned.
+	p := blk.LookupPositions(ctx, q)
+	blk.Close()
+	if closed {
+		t.Errorf("pinned file closed")
+	} else if blk.Pin() {
+		t.Errorf("pinned closed file")
+	}
+	out := base.NewPacketChan(100)
+	p.Read(ctx, out)
+	count := 0
+	for range out.Receive() {
+		count++
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	} else if count != 4 {
+		t.Errorf("got %d packets from pinned file, want 4", count)
+	}
+	blk.Unpin()
+	if !closed {
+		t.Errorf("file not closed once unpinned")
+	}
+}
+
+func TestReadPackets(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookedUp := base.NewPacketChan(100)
+	blk.Lookup(ctx, q, lookedUp)
+	var want [][]byte
+	for p := range lookedUp.Receive() {
+		want = append(want, p.Data)
+	}
+	read := func(positions []int64, count int) (got [][]byte, _ error) {
+		out := base.NewPacketChan(100)
+		blk.ReadPackets(ctx, positions, count, out)
+		for p := range out.Receive() {
+			got = append(got, p.Data)
+		}
+		return got, out.Err()
+	}
+	if got, err := read([]int64{1049448, 1048624}, 1); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, [][]byte{want[2], want[0]}) {
+		t.Errorf("wrong packets read by position")
+	}
+	// Ranges stop at the end of the file.
+	if got, err := read([]int64{1049024}, 2); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want[1:3]) {
+		t.Errorf("wrong range of %d packets read", len(got))
+	}
+	if got, err := read([]int64{1048624}, 1000); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong range of %d packets read to the end", len(got))
+	}
+	for _, pos := range []int64{1048625, 0, 1 << 40} {
+		if _, err := read([]int64{pos}, 1); err == nil {
+			t.Errorf("read packet at bad position %d", pos)
+		}
+	}
+}
+
+func TestWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "PKT0", "1420000000000000")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	idx := indexfile.NewWriter()
+	var want [][]byte
+	// Enough packets to spill over into a second block.
+	for i := 0; i < 1000; i++ {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make([]byte, 6), DstMAC: make([]byte, 6), EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{10, 0, 0, 2}},
+			&layers.UDP{SrcPort: layers.UDPPort(1000 + i%2), DstPort: 53},
+			gopacket.Payload(make([]byte, 1000))); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		pos, err := w.WritePacket(ci, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := idx.AddPacket(data, pos); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			want = append(want, data)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if got := w.Size(); got != 2*BlockSize {
+		t.Errorf("wrong size: want %d got %d", 2*BlockSize, got)
+	}
+	if err := idx.WriteFile(indexfile.IndexPathFromBlockfilePath(name)); err != nil {
+		t.Fatal(err)
+	}
+	blk := testBlockFile(t, name)
+	defer blk.Close()
+	q, err := query.NewQuery("port 1001 and udp and host 10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := base.NewPacketChan(100)
+	go blk.Lookup(ctx, q, out)
+	var got [][]byte
+	for p := range out.Receive() {
+		got = append(got, p.Data)
+		if p.Timestamp.Unix()%2 != 1 {
+			t.Errorf("wrong packet timestamp %v", p.Timestamp)
+		}
+	}
+	if err := out.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of packets: want %d got %d", len(want), len(got))
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("packet %d mismatch", i)
+		}
+	}
+	// Packets read from the pooled block buffers are still intact once the
+	// buffers have been reused for later blocks.
+	var all []*base.Packet
+	for p := range blk.AllPackets(ctx).Receive() {
+		all = append(all, p)
+	}
+	if len(all) != 1000 {
+		t.Errorf("wrong number of packets in blockfile: want 1000 got %d", len(all))
+	}
+	for i, p := range all {
+		if p.Timestamp.Unix() != int64(i) || len(p.Data) != len(want[0]) || (i%2 == 1 && !bytes.Equal(p.Data, want[i/2])) {
+			t.Fatalf("packet %d corrupt", i)
+		}
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	all = nil
+	pkts := blk.AllPackets(canceled)
+	for p := range pkts.Receive() {
+		all = append(all, p)
+	}
+	if pkts.Err() != context.Canceled || len(all) == 1000 {
+		t.Errorf("canceled read got %d packets, error %v", len(all), pkts.Err())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "PKT0", "dhcp")
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	size, err := blk.Compact(name, indexfile.IndexPathFromBlockfilePath(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != BlockSize {
+		t.Errorf("wrong compacted size: want %d got %d", BlockSize, size)
+	}
+	if fi, err := os.Stat(name); err != nil {
+		t.Fatal(err)
+	} else if fi.Size() != size {
+		t.Errorf("file size %d doesn't match returned size %d", fi.Size(), size)
+	}
+	compacted := testBlockFile(t, name)
+	defer compacted.Close()
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := func(b *BlockFile) (out [][]byte) {
+		c := base.NewPacketChan(100)
+		go b.Lookup(ctx, q, c)
+		for p := range c.Receive() {
+			out = append(out, p.Data)
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	want, got := packets(blk), packets(compacted)
+	if len(want) == 0 || !reflect.DeepEqual(got, want) {
+		t.Errorf("compacted lookup mismatch: want %d packets got %d", len(want), len(got))
+	}
+}
+
+func TestVerify(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	if err := blk.Verify(ctx); err != nil {
+		t.Errorf("verifying valid index: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Write a copy of the test file to break.
+	name := filepath.Join(dir, "PKT0", "dhcp")
+	if _, err := blk.Compact(name, indexfile.IndexPathFromBlockfilePath(name)); err != nil {
+		t.Fatal(err)
+	}
+	broken := testBlockFile(t, name)
+	defer broken.Close()
+	// Break the index's data blocks, which are only read once needed.
+	if err := os.Truncate(indexfile.IndexPathFromBlockfilePath(name), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := broken.Verify(ctx); err == nil {
+		t.Error("verified truncated index")
+	}
+	if broken.Corrupt() == nil {
+		t.Error("failed verification didn't mark file corrupt")
+	}
+}
+
+func TestActiveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, ".1420000000000000")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var blocks bytes.Buffer
+	w := NewWriter(&blocks)
+	// Three blocks, the last of which is only written halfway at first.
+	var inFirstTwo int
+	var port1001 [2]int // In the first two blocks, and in all three.
+	for i := 0; i < 2500; i++ {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make([]byte, 6), DstMAC: make([]byte, 6), EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: []byte{10, 0, 0, 1}, DstIP: []byte{10, 0, 0, 2}},
+			&layers.UDP{SrcPort: layers.UDPPort(1000 + i%2), DstPort: 53},
+			gopacket.Payload(make([]byte, 1000))); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		pos, err := w.WritePacket(ci, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos < 2*BlockSize {
+			inFirstTwo++
+			port1001[0] += i % 2
+		}
+		port1001[1] += i % 2
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := blocks.Bytes()
+	if len(data) != 3*BlockSize {
+		t.Fatalf("wrote %d bytes, want 3 blocks", len(data))
+	}
+	if _, err := f.Write(data[:2*BlockSize+BlockSize/2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, BlockSize/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := OpenActive(name, filecache.NewCache(10), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	count := func(qs string) int {
+		q, err := query.NewQuery(qs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk, err := a.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer blk.Close()
+		out := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, out)
+		n := 0
+		for range out.Receive() {
+			n++
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if got, want := count("port 1001"), port1001[0]; got != want {
+		t.Errorf("got %d packets from two complete blocks, want %d", got, want)
+	}
+	if got, want := count("after 2000-01-01T00:00:00Z"), inFirstTwo; got != want {
+		t.Errorf("got %d packets reading two complete blocks, want %d", got, want)
+	}
+
+	if _, err := f.WriteAt(data[2*BlockSize:], 2*BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := count("port 1001"), port1001[1]; got != want {
+		t.Errorf("got %d packets once the third block was written, want %d", got, want)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Copy the test file under a timestamp name, so time queries can match it.
+	name := filepath.Join(dir, "PKT0", "1400000000000000")
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	if _, err := blk.Compact(name, indexfile.IndexPathFromBlockfilePath(name)); err != nil {
+		t.Fatal(err)
+	}
+	timed := testBlockFile(t, name)
+	defer timed.Close()
+	pcapSize := func(b *BlockFile, q query.Query) (packets, size int64) {
+		c := base.NewPacketChan(100)
+		go b.Lookup(ctx, q, c)
+		for p := range c.Receive() {
+			packets++
+			size += base.PcapPacketHeaderSize + int64(len(p.Data))
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return packets, size
+	}
+	for _, test := range []struct {
+		b       *BlockFile
+		query   string
+		samples int
+		exact   bool
+	}{
+		{blk, "port 67", 100, true},
+		{blk, "port 67", 1, false},
+		{blk, "port 69", 100, true},
+		{timed, "after 2000-01-01T00:00:00Z", 100, false},
+	} {
+		q, err := query.NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		est, err := test.b.Estimate(ctx, q, test.samples)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets, size := pcapSize(test.b, q)
+		if est.Packets != packets {
+			t.Errorf("%q: estimated %d packets, want %d", test.query, est.Packets, packets)
+		}
+		if est.Sampled > int64(test.samples) || (packets > 0 && est.Sampled == 0) {
+			t.Errorf("%q: sampled %d packets with a limit of %d", test.query, est.Sampled, test.samples)
+		}
+		if test.exact && est.Bytes != size {
+			t.Errorf("%q: estimated %d bytes, want %d", test.query, est.Bytes, size)
+		} else if est.Bytes < size/4 || est.Bytes > size*4 {
+			t.Errorf("%q: estimated %d bytes, nowhere near %d", test.query, est.Bytes, size)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	for _, test := range []string{"port 67", "port 69", "after 2000-01-01T00:00:00Z"} {
+		q, err := query.NewQuery(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, c)
+		exact := base.NewHistogram(time.Second)
+		var first, last time.Time
+		for p := range c.Receive() {
+			exact.Add(p.Timestamp, 1, base.PcapPacketHeaderSize+int64(len(p.Data)))
+			if first.IsZero() {
+				first = p.Timestamp
+			}
+			last = p.Timestamp
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		var want int64
+		for _, b := range exact.Buckets() {
+			want += b.Packets
+		}
+		h := base.NewHistogram(time.Second)
+		if err := blk.Histogram(ctx, q, h); err != nil {
+			t.Fatal(err)
+		}
+		var got int64
+		for _, b := range h.Buckets() {
+			got += b.Packets
+			if b.Start.Before(first.Truncate(time.Second)) || b.Start.After(last) {
+				t.Errorf("%q: bucket %v outside %v-%v", test, b.Start, first, last)
+			}
+		}
+		if got != want {
+			t.Errorf("%q: histogram has %d packets, want %d", test, got, want)
+		}
+	}
+}
+
+func TestSeen(t *testing.T) {
+	blk := testBlockFile(t, filename)
+	defer blk.Close()
+	for _, qs := range []string{"port 67", "port 69"} {
+		q, err := query.NewQuery(qs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want []time.Time
+		c := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, c)
+		for p := range c.Receive() {
+			want = append(want, p.Timestamp)
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		first, last, ok, err := blk.Seen(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (len(want) > 0) {
+			t.Errorf("%q: seen %v with %d packets", qs, ok, len(want))
+		} else if ok && (!first.Equal(want[0]) || !last.Equal(want[len(want)-1])) {
+			t.Errorf("%q: seen from %v to %v, want %v to %v", qs, first, last, want[0], want[len(want)-1])
+		}
+	}
+}
+
+func TestDrops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "PKT0", "1420000000000000")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	idx := indexfile.NewWriter()
+	var first time.Time
+	// Enough packets to spill over into a second block, which is flagged.
+	for i := 0; i < 1000; i++ {
+		data := make([]byte, 1000)
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		pos, err := w.WritePacket(ci, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos >= BlockSize {
+			w.MarkLosing()
+			if first.IsZero() {
+				first = ci.Timestamp
+			}
+		}
+		if err := idx.AddPacket(data, pos); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := idx.WriteFile(indexfile.IndexPathFromBlockfilePath(name)); err != nil {
+		t.Fatal(err)
+	}
+	blk := testBlockFile(t, name)
+	defer blk.Close()
+	got, err := blk.Drops()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Blocks != 2 || got.LosingBlocks != 1 || len(got.Losing) != 1 {
+		t.Fatalf("got drops %+v, want 1 of 2 blocks losing", got)
+	}
+	if r := got.Losing[0]; !r.Start.Equal(first) || !r.End.Equal(time.Unix(999, 0)) {
+		t.Errorf("got losing range %v to %v, want %v to %v", r.Start, r.End, first, time.Unix(999, 0))
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	cache := NewRegionCache(2 * cacheRegionSize)
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(blk *BlockFile) (data [][]byte) {
+		out := base.NewPacketChan(100)
+		blk.LookupPositions(ctx, q).Read(ctx, out)
+		for p := range out.Receive() {
+			data = append(data, p.Data)
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	blk, err := NewBlockFile(filename, filecache.NewCache(10), Options{ReadCache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncached := read(blk)
+	if cache.bytes != cacheRegionSize {
+		t.Errorf("got %d bytes cached, want %d", cache.bytes, cacheRegionSize)
+	}
+	if cached := read(blk); !reflect.DeepEqual(cached, uncached) || len(cached) != 4 {
+		t.Errorf("cached packets differ:\nwant: %x\n got: %x", uncached, cached)
+	}
+	blk.Close()
+	if cache.bytes != 0 || len(cache.regions) != 0 {
+		t.Errorf("closed file still cached")
+	}
+
+	// The least recently used regions are evicted, and data past the given
+	// size isn't cached at all.
+	data := make([]byte, 4*cacheRegionSize-10)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	r := bytes.NewReader(data)
+	buf := make([]byte, 20)
+	for _, off := range []int64{cacheRegionSize - 10, 0, 2*cacheRegionSize + 5, 4*cacheRegionSize - 30} {
+		if _, err := cache.ReadAt("f", r, 3*cacheRegionSize, buf, off); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf, data[off:off+20]) {
+			t.Errorf("wrong data at %d: %x", off, buf)
+		}
+	}
+	if _, err := cache.ReadAt("f", r, 3*cacheRegionSize, buf, 4*cacheRegionSize-15); err != io.EOF {
+		t.Errorf("read past end got error %v, want EOF", err)
+	}
+	for _, off := range []int64{0, 2 * cacheRegionSize} {
+		if cache.regions[regionKey{"f", off}] == nil {
+			t.Errorf("region %d not cached", off)
+		}
+	}
+	if len(cache.regions) != 2 {
+		t.Errorf("got %d regions cached, want 2", len(cache.regions))
+	}
+}
+
+func TestHoles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "PKT0", "1420000000000000")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f)
+	var positions base.Positions
+	// Three blocks of packets, of which the second is zeroed below.
+	for i := 0; i < 2500; i++ {
+		data := make([]byte, 1000)
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(int64(i), 0), CaptureLength: len(data), Length: len(data)}
+		pos, err := w.WritePacket(ci, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		positions = append(positions, pos)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, BlockSize), BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := indexfile.NewWriter().WriteFile(indexfile.IndexPathFromBlockfilePath(name)); err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for _, pos := range positions {
+		if pos < BlockSize || pos >= 2*BlockSize {
+			want++
+		}
+	}
+	blk := testBlockFile(t, name)
+	defer blk.Close()
+	for _, test := range []struct {
+		positions base.Positions
+		warning   string
+	}{
+		{base.AllPositions, "1 malformed or zero-filled blocks skipped"},
+		{positions, fmt.Sprintf("%d packets at malformed or zero-filled positions skipped", len(positions)-want)},
+	} {
+		warnings := &base.QueryWarnings{}
+		wctx := base.WithQueryWarnings(ctx, warnings)
+		out := base.NewPacketChan(100)
+		go (&PendingLookup{b: blk, positions: test.positions}).Read(wctx, out)
+		got := 0
+		for range out.Receive() {
+			got++
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		} else if got != want {
+			t.Errorf("got %d packets, want %d", got, want)
+		}
+		if w := warnings.List(); len(w) != 1 || w[0].Reason != test.warning {
+			t.Errorf("got warnings %+v, want %q", w, test.warning)
+		}
+	}
+}
+
+func TestOpenBlockFile(t *testing.T) {
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := base.Positions{1048624, 1049024, 1049448, 1049848}
+	// With the index elsewhere, and with none at all.
+	for _, idx := range []string{filepath.Join(testdata, "IDX0", "dhcp"), ""} {
+		blk, err := OpenBlockFile(filename, idx, filecache.NewCache(10), Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := blk.Positions(ctx, q); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("index %q: wrong packet positions.\nwant: %v\n got: %v\n", idx, want, got)
+		}
+		blk.Close()
+	}
+}
+
+func TestStarted(t *testing.T) {
+	names, err := base.NewFileNames("{sensor}-{utc}", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{FileNames: names, ClockSkew: time.Minute}
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name string
+		want base.TimeRange
+	}{
+		{"s1-20150101T000000.000000Z", base.TimeRange{Start: started.Add(-time.Minute), End: started.Add(time.Minute)}},
+		// Files named before the template was set are still understood.
+		{"1420070400000000", base.TimeRange{Start: started.Add(-time.Minute), End: started.Add(time.Minute)}},
+		{"s2-20150101T000000.000000Z", base.TimeRange{}},
+	} {
+		name := filepath.Join(dir, test.name)
+		if err := ioutil.WriteFile(name, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		blk, err := OpenBlockFile(name, "", filecache.NewCache(10), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := blk.i.Started(); !got.Start.Equal(test.want.Start) || !got.End.Equal(test.want.End) {
+			t.Errorf("%q: got started %v, want %v", test.name, got, test.want)
+		}
+		blk.Close()
+	}
+}
+
+func TestReplaced(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, d := range []string{"PKT0", "IDX0"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copyFile := func(src, dst string) {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := filepath.Join(dir, "PKT0", "dhcp")
+	copyFile(filename, name)
+	copyFile(filepath.Join(testdata, "IDX0", "dhcp"), filepath.Join(dir, "IDX0", "dhcp"))
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// With room for only one open file, the index and blockfile are reopened
+	// each time the other is read.
+	blk, err := NewBlockFile(name, filecache.NewCache(1), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blk.Close()
+	lookup := func() error {
+		out := base.NewPacketChan(100)
+		go blk.Lookup(ctx, q, out)
+		for range out.Receive() {
+		}
+		return out.Err()
+	}
+	if err := lookup(); err != nil {
+		t.Fatal(err)
+	}
+	// Even an identical copy moved into place isn't read as the original.
+	copyFile(filename, name+".new")
+	if err := os.Rename(name+".new", name); err != nil {
+		t.Fatal(err)
+	}
+	if err := lookup(); err == nil {
+		t.Error("read packets from replaced blockfile")
+	}
+	if !blk.Replaced() {
+		t.Error("blockfile not marked replaced")
+	}
+	if err := blk.Corrupt(); err != nil {
+		t.Errorf("replaced blockfile marked corrupt: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/mars-suite/stenographer/stats"
+)
+
+// cacheRegionSize is the size (and alignment) of the regions of blockfiles
+// RegionCache holds.
+const cacheRegionSize = 64 << 10
+
+var (
+	readCacheHits   = stats.S.Get("read_cache_hits")
+	readCacheMisses = stats.S.Get("read_cache_misses")
+	readCacheBytes  = stats.S.Get("read_cache_bytes")
+)
+
+type regionKey struct {
+	name   string
+	offset int64
+}
+
+type region struct {
+	key  regionKey
+	data []byte
+}
+
+// RegionCache is a LRU cache of fixed-size regions of blockfiles, bounded by
+// the total size of the regions it holds, so repeated queries over the same
+// few minutes of traffic don't go back to disk.
+type RegionCache struct {
+	maxBytes int64
+
+	mu sync.Mutex
+	// protected by mu
+	bytes   int64
+	lru     *list.List // of *region, most recently used first
+	regions map[regionKey]*list.Element
+}
+
+// NewRegionCache returns a cache holding up to maxBytes of blockfile data.
+func NewRegionCache(maxBytes int64) *RegionCache {
+	return &RegionCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		regions:  map[regionKey]*list.Element{},
+	}
+}
+
+// get returns the cached region of the named file, or nil.
+func (c *RegionCache) get(key regionKey) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.regions[key]
+	if e == nil {
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*region).data
+}
+
+// add caches a region, evicting the least recently used ones to make room.
+func (c *RegionCache) add(key regionKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.regions[key]; ok || int64(len(data)) > c.maxBytes {
+		return
+	}
+	for c.bytes+int64(len(data)) > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.regions[key] = c.lru.PushFront(&region{key, data})
+	c.bytes += int64(len(data))
+	readCacheBytes.Set(c.bytes)
+}
+
+// remove drops a cached region.  c.mu must be held.
+func (c *RegionCache) remove(e *list.Element) {
+	r := c.lru.Remove(e).(*region)
+	delete(c.regions, r.key)
+	c.bytes -= int64(len(r.data))
+	readCacheBytes.Set(c.bytes)
+}
+
+// forget drops all cached regions of the named file.
+func (c *RegionCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.lru.Front(); e != nil; {
+		next := e.Next()
+		if e.Value.(*region).key.name == name {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// region returns the region of the named file starting at 'offset', reading
+// it from f if it's not cached.  Only regions within the first 'size' bytes of
+// the file are cached:  past that, an active file is still being written, and
+// the region may be short.
+func (c *RegionCache) region(name string, f io.ReaderAt, size, offset int64) ([]byte, error) {
+	key := regionKey{name, offset}
+	if data := c.get(key); data != nil {
+		readCacheHits.Increment()
+		return data, nil
+	}
+	readCacheMisses.Increment()
+	data := make([]byte, cacheRegionSize)
+	n, err := f.ReadAt(data, offset)
+	if err == io.EOF && n > 0 {
+		return data[:n], nil
+	} else if err != nil {
+		return nil, err
+	}
+	if offset+cacheRegionSize <= size {
+		c.add(key, data)
+	}
+	return data, nil
+}
+
+// ReadAt reads len(buf) bytes of the named file at 'off' through the cache,
+// like io.ReaderAt, caching only data within its first 'size' bytes.  Cached
+// data is copied, never shared.
+func (c *RegionCache) ReadAt(name string, f io.ReaderAt, size int64, buf []byte, off int64) (n int, _ error) {
+	for n < len(buf) {
+		pos := off + int64(n)
+		start := pos - pos%cacheRegionSize
+		data, err := c.region(name, f, size, start)
+		if err != nil {
+			return n, err
+		}
+		within := int(pos - start)
+		if within >= len(data) {
+			return n, io.EOF
+		}
+		n += copy(buf[n:], data[within:])
+	}
+	return n, nil
+}
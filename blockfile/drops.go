@@ -0,0 +1,85 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/mars-suite/stenographer/base"
+)
+
+// Drops counts the file's blocks, and those the kernel flagged as written
+// while it was dropping packets, along with the time range of each flagged
+// block's packets.  Only block headers are read, along with the whole of any
+// flagged blocks, and the result is remembered for next time.
+func (b *BlockFile) Drops() (base.DropStats, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	b.dropsMu.Lock()
+	defer b.dropsMu.Unlock()
+	if b.drops != nil {
+		return *b.drops, nil
+	}
+	if b.f == nil {
+		return base.DropStats{}, nil // Closed.
+	}
+	var d base.DropStats
+	buf := make([]byte, blockHeaderSize)
+	for off := int64(0); off+BlockSize <= b.size; off += BlockSize {
+		if _, err := b.f.ReadAt(buf, off); err != nil {
+			return d, fmt.Errorf("could not read block header at %v: %v", off, err)
+		}
+		desc := (*blockDesc)(unsafe.Pointer(&buf[0]))
+		hdr := (*blockHeader)(unsafe.Pointer(&desc.hdr[0]))
+		if hdr.block_status&statusUser == 0 || hdr.num_pkts == 0 {
+			continue
+		}
+		d.Blocks++
+		if hdr.block_status&statusLosing == 0 {
+			continue
+		}
+		r, err := b.blockTimes(off)
+		if err != nil {
+			return d, err
+		}
+		d.LosingBlocks++
+		d.Losing = append(d.Losing, r)
+	}
+	b.drops = &d
+	return d, nil
+}
+
+// blockTimes returns the time range of the packets in the block at 'off'.
+func (b *BlockFile) blockTimes(off int64) (r base.TimeRange, _ error) {
+	block := make([]byte, BlockSize)
+	if _, err := b.f.ReadAt(block, off); err != nil {
+		return r, fmt.Errorf("could not read block at %v: %v", off, err)
+	}
+	offsets, ok := blockPackets(block)
+	if !ok {
+		return r, fmt.Errorf("malformed block at %v", off)
+	}
+	for _, o := range offsets {
+		ts := b.packetTimestamp((*packetHeader)(unsafe.Pointer(&block[o])))
+		if r.Start.IsZero() || ts.Before(r.Start) {
+			r.Start = ts
+		}
+		if ts.After(r.End) {
+			r.End = ts
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
+)
+
+// Estimate estimates the size of the packets in the blockfile matched by the
+// passed-in query, reading the lengths of at most 'samples' of them.  The
+// packet count comes straight from the index, or from block headers when the
+// query matches every packet, in which case the first packet of evenly spaced
+// blocks is sampled.  Files with corrupt indexes are skipped, as by Lookup.
+func (b *BlockFile) Estimate(ctx context.Context, q query.Query, samples int) (est base.Estimate, _ error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.Corrupt(); err != nil {
+		b.skip(ctx, err)
+		return est, nil
+	}
+	positions, err := b.positionsLocked(ctx, q)
+	if err != nil {
+		if ctx.Err() != nil {
+			return est, ctx.Err()
+		}
+		err = fmt.Errorf("index lookup failure: %v", err)
+		b.markCorrupt(err)
+		b.skip(ctx, err)
+		return est, nil
+	}
+	var sampled []int64 // Positions of packets to sample.
+	if positions.IsAllPositions() {
+		var firsts []int64
+		for off := int64(0); off < b.size; off += BlockSize {
+			n, first, err := b.readBlockHeader(off)
+			if err != nil {
+				return est, err
+			}
+			est.Packets += n
+			if n > 0 {
+				firsts = append(firsts, first)
+			}
+		}
+		sampled = spread(firsts, samples)
+	} else {
+		est.Packets = int64(len(positions))
+		sampled = spread(positions, samples)
+	}
+	if est.Packets == 0 {
+		return est, nil
+	}
+	est.Files = 1
+	var snaplens int64
+	for _, pos := range sampled {
+		if ctx.Err() != nil {
+			return est, ctx.Err()
+		}
+		pkt, err := b.readPacketHeader(pos)
+		if err != nil {
+			return est, fmt.Errorf("error reading packet from %q @ %v: %v", b.name, pos, err)
+		}
+		snaplens += int64(pkt.tp_snaplen)
+	}
+	est.Sampled = int64(len(sampled))
+	est.Bytes = est.Packets * base.PcapPacketHeaderSize
+	if est.Sampled > 0 {
+		est.Bytes += est.Packets * snaplens / est.Sampled
+	}
+	return est, nil
+}
+
+// spread returns at most n positions spaced evenly through 'positions'.
+func spread(positions []int64, n int) []int64 {
+	if len(positions) <= n {
+		return positions
+	}
+	out := make([]int64, n)
+	for i := range out {
+		out[i] = positions[i*len(positions)/n]
+	}
+	return out
+}
+
+// readBlockHeader returns the number of packets in the block at the given
+// offset, and the position of its first packet.
+func (b *BlockFile) readBlockHeader(off int64) (packets int64, first int64, _ error) {
+	buf := make([]byte, blockHeaderSize)
+	if _, err := b.f.ReadAt(buf, off); err != nil {
+		return 0, 0, fmt.Errorf("could not read block header at %v: %v", off, err)
+	}
+	desc := (*blockDesc)(unsafe.Pointer(&buf[0]))
+	hdr := (*blockHeader)(unsafe.Pointer(&desc.hdr[0]))
+	return int64(hdr.num_pkts), off + int64(hdr.offset_to_first_pkt), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+
+	"github.com/mars-suite/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// ReadPackets sends the packet at each of the given positions to 'out',
+// followed by the count-1 packets after it in the file, then closes it.  This
+// fetches packets directly, as positions from an earlier lookup found them,
+// without looking anything up in the index.  Positions must be those of
+// packets:  rather than returning whatever bytes are there, the block holding
+// each position is scanned for it, and it's an error if there's no packet
+// there.
+func (b *BlockFile) ReadPackets(ctx context.Context, positions []int64, count int, out *base.PacketChan) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.f == nil {
+		out.Close(fmt.Errorf("blockfile %q closed", b.name))
+		return
+	}
+	var slab packetSlab
+	for _, pos := range positions {
+		if pos < 0 || pos >= b.size {
+			out.Close(fmt.Errorf("position %d outside blockfile %q", pos, b.name))
+			return
+		}
+		iter := &allPacketsIter{BlockFile: b, ctx: ctx, blockOffset: pos - pos%BlockSize}
+		defer iter.release()
+		sent := 0
+		for sent < count && iter.Next() {
+			if iter.position() < pos {
+				continue
+			} else if sent == 0 && iter.position() != pos {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				out.Close(ctx.Err())
+				return
+			case out.C <- slab.copy(iter.Packet()):
+				sent++
+			}
+		}
+		if iter.Err() != nil {
+			out.Close(fmt.Errorf("error reading packets from %q @ %v: %v", b.name, pos, iter.Err()))
+			return
+		} else if sent == 0 {
+			out.Close(fmt.Errorf("no packet at position %d in %q", pos, b.name))
+			return
+		}
+	}
+	out.Close(nil)
+}
@@ -0,0 +1,106 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
+)
+
+// Histogram adds the packets in the blockfile matched by the passed-in query
+// to 'h', without reading them all.  Packet positions come from the index, and
+// since packets are written in time order, only the first and last matched
+// packet headers in each block are read:  the rest are timed by
+// interpolating between them, and sized by their average length.  When the
+// query matches every packet, each block's packets are all counted at the
+// time of its first.  Files with corrupt indexes are skipped, as by Lookup.
+func (b *BlockFile) Histogram(ctx context.Context, q query.Query, h *base.Histogram) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if err := b.Corrupt(); err != nil {
+		b.skip(ctx, err)
+		return nil
+	}
+	positions, err := b.positionsLocked(ctx, q)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = fmt.Errorf("index lookup failure: %v", err)
+		b.markCorrupt(err)
+		b.skip(ctx, err)
+		return nil
+	}
+	if positions.IsAllPositions() {
+		for off := int64(0); off < b.size; off += BlockSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			n, first, err := b.readBlockHeader(off)
+			if err != nil {
+				return err
+			} else if n == 0 {
+				continue
+			}
+			pkt, err := b.readPacketHeader(first)
+			if err != nil {
+				return fmt.Errorf("error reading packet from %q @ %v: %v", b.name, first, err)
+			}
+			h.Add(b.packetTimestamp(pkt), n, n*(base.PcapPacketHeaderSize+int64(pkt.tp_snaplen)))
+		}
+		return nil
+	}
+	for len(positions) > 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		// Take the positions in the first block.
+		end := 1
+		for end < len(positions) && positions[end]/BlockSize == positions[0]/BlockSize {
+			end++
+		}
+		block := positions[:end]
+		positions = positions[end:]
+		first, last := block[0], block[len(block)-1]
+		firstPkt, err := b.readPacketHeader(first)
+		if err != nil {
+			return fmt.Errorf("error reading packet from %q @ %v: %v", b.name, first, err)
+		}
+		start, snaplens := b.packetTimestamp(firstPkt), int64(firstPkt.tp_snaplen)
+		span, sampled := time.Duration(0), int64(1)
+		if last != first {
+			lastPkt, err := b.readPacketHeader(last)
+			if err != nil {
+				return fmt.Errorf("error reading packet from %q @ %v: %v", b.name, last, err)
+			}
+			span = b.packetTimestamp(lastPkt).Sub(start)
+			snaplens += int64(lastPkt.tp_snaplen)
+			sampled++
+		}
+		size := base.PcapPacketHeaderSize + snaplens/sampled
+		for _, pos := range block {
+			ts := start
+			if last != first {
+				ts = start.Add(time.Duration(float64(span) * float64(pos-first) / float64(last-first)))
+			}
+			h.Add(ts, 1, size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import "github.com/mars-suite/stenographer/base"
+
+const (
+	slabSize    = 64 << 10
+	slabPackets = 128
+)
+
+// packetSlab copies packets out of an allPacketsIter's reused block buffer, so
+// they can be sent on to a PacketChan.  Rather than allocating each packet and
+// its data separately, it carves them out of larger slabs, which are garbage
+// collected once all the packets in them are.
+type packetSlab struct {
+	data    []byte
+	packets []base.Packet
+}
+
+// copy returns a copy of p which doesn't share its data.
+func (s *packetSlab) copy(p *base.Packet) *base.Packet {
+	if len(s.packets) == 0 {
+		s.packets = make([]base.Packet, slabPackets)
+	}
+	c := &s.packets[0]
+	s.packets = s.packets[1:]
+	c.CaptureInfo = p.CaptureInfo
+	switch n := len(p.Data); {
+	case n > slabSize/4:
+		// Don't waste the rest of a slab on a big packet.
+		c.Data = append([]byte(nil), p.Data...)
+		return c
+	case n > len(s.data):
+		s.data = make([]byte, slabSize)
+	}
+	c.Data = s.data[:len(p.Data):len(p.Data)]
+	copy(c.Data, p.Data)
+	s.data = s.data[len(p.Data):]
+	return c
+}
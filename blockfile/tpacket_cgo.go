@@ -0,0 +1,37 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && cgo
+
+package blockfile
+
+// #include <linux/if_packet.h>
+import "C"
+
+// On Linux, blockfiles are read with the kernel's own definitions of the
+// TPACKET_V3 structures stenotype writes them in.
+type (
+	blockDesc    = C.struct_tpacket_block_desc
+	blockHeader  = C.struct_tpacket_hdr_v1
+	packetHeader = C.struct_tpacket3_hdr
+
+	u16 = C.__u16
+	u32 = C.__u32
+	u64 = C.__u64
+)
+
+const (
+	statusUser   = C.TP_STATUS_USER
+	statusLosing = C.TP_STATUS_LOSING
+)
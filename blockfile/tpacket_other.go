@@ -0,0 +1,71 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux || !cgo
+
+package blockfile
+
+// Elsewhere, and without cgo, blockfiles are read with pure-Go copies of the
+// TPACKET_V3 structures from <linux/if_packet.h>, laid out identically, so
+// clients and analysis tools can read blockfiles copied off a sensor.  Like
+// stenotype's, they're in host byte order, which is little-endian on every
+// platform we build for.
+type (
+	u16 = uint16
+	u32 = uint32
+	u64 = uint64
+)
+
+// blockDesc is struct tpacket_block_desc.
+type blockDesc struct {
+	version        u32
+	offset_to_priv u32
+	hdr            [40]byte // union tpacket_bd_header_u, holding a blockHeader
+}
+
+// blockTimestamp is struct tpacket_bd_ts.
+type blockTimestamp struct {
+	ts_sec  u32
+	ts_nsec u32
+}
+
+// blockHeader is struct tpacket_hdr_v1.
+type blockHeader struct {
+	block_status        u32
+	num_pkts            u32
+	offset_to_first_pkt u32
+	blk_len             u32
+	seq_num             u64
+	ts_first_pkt        blockTimestamp
+	ts_last_pkt         blockTimestamp
+}
+
+// packetHeader is struct tpacket3_hdr.
+type packetHeader struct {
+	tp_next_offset u32
+	tp_sec         u32
+	tp_nsec        u32
+	tp_snaplen     u32
+	tp_len         u32
+	tp_status      u32
+	tp_mac         u16
+	tp_net         u16
+	hv1            [12]byte // struct tpacket_hdr_variant1
+	tp_padding     [8]byte
+}
+
+const (
+	statusUser   = 1 << 0 // TP_STATUS_USER
+	statusLosing = 1 << 2 // TP_STATUS_LOSING
+)
@@ -0,0 +1,146 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package blockfile
+
+import (
+	"fmt"
+	"io"
+	"unsafe"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	// BlockSize is the size of each block within a blockfile.
+	BlockSize = 1 << 20
+
+	tpacketAlignment = 16
+)
+
+var (
+	blockHeaderSize  = tpacketAlign(int(unsafe.Sizeof(blockDesc{})))
+	packetHeaderSize = tpacketAlign(int(unsafe.Sizeof(packetHeader{})))
+)
+
+func tpacketAlign(n int) int {
+	return (n + tpacketAlignment - 1) &^ (tpacketAlignment - 1)
+}
+
+// Writer writes packets to a blockfile in the same TPACKET_V3 block format
+// that stenotype writes, so they can be read back with BlockFile.
+type Writer struct {
+	w       io.Writer
+	block   []byte
+	offset  int   // Offset of the next packet within block.
+	last    int   // Offset of the last packet written within block, or 0.
+	written int64 // Bytes of completed blocks written to w.
+	blocks  uint64
+	losing  bool // Whether the current block is flagged TP_STATUS_LOSING.
+}
+
+// NewWriter returns a Writer which writes blocks to w.
+func NewWriter(w io.Writer) *Writer {
+	bw := &Writer{w: w, block: make([]byte, BlockSize)}
+	bw.reset()
+	return bw
+}
+
+func (w *Writer) reset() {
+	for i := range w.block {
+		w.block[i] = 0
+	}
+	w.offset = blockHeaderSize
+	w.last = 0
+	w.losing = false
+}
+
+func (w *Writer) blockHeader() *blockHeader {
+	desc := (*blockDesc)(unsafe.Pointer(&w.block[0]))
+	return (*blockHeader)(unsafe.Pointer(&desc.hdr[0]))
+}
+
+// Size returns the size the blockfile will have if closed now.
+func (w *Writer) Size() int64 {
+	if w.last == 0 {
+		return w.written
+	}
+	return w.written + BlockSize
+}
+
+// WritePacket adds a packet to the blockfile, returning its position within
+// the file for use in an index.
+func (w *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte) (int64, error) {
+	size := tpacketAlign(packetHeaderSize + len(data))
+	if blockHeaderSize+size > BlockSize {
+		return 0, fmt.Errorf("packet of %d bytes doesn't fit in a block", len(data))
+	}
+	if w.offset+size > BlockSize {
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	hdr := w.blockHeader()
+	if hdr.num_pkts == 0 {
+		hdr.offset_to_first_pkt = u32(w.offset)
+	} else {
+		prev := (*packetHeader)(unsafe.Pointer(&w.block[w.last]))
+		prev.tp_next_offset = u32(w.offset - w.last)
+	}
+	hdr.num_pkts++
+	pkt := (*packetHeader)(unsafe.Pointer(&w.block[w.offset]))
+	pkt.tp_sec = u32(ci.Timestamp.Unix())
+	pkt.tp_nsec = u32(ci.Timestamp.Nanosecond())
+	pkt.tp_snaplen = u32(len(data))
+	pkt.tp_len = u32(ci.Length)
+	pkt.tp_mac = u16(packetHeaderSize)
+	copy(w.block[w.offset+packetHeaderSize:], data)
+	pos := w.written + int64(w.offset)
+	w.last = w.offset
+	w.offset += size
+	return pos, nil
+}
+
+// MarkLosing flags the block the last packet was written to as having been
+// written while the kernel was dropping packets, as stenotype's blocks are.
+func (w *Writer) MarkLosing() {
+	w.losing = true
+}
+
+// flush writes out the current block, if it has any packets in it.
+func (w *Writer) flush() error {
+	if w.last == 0 {
+		return nil
+	}
+	w.blocks++
+	hdr := w.blockHeader()
+	hdr.block_status = statusUser
+	if w.losing {
+		hdr.block_status |= statusLosing
+	}
+	hdr.blk_len = u32(w.offset)
+	hdr.seq_num = u64(w.blocks)
+	if _, err := w.w.Write(w.block); err != nil {
+		return fmt.Errorf("could not write block: %v", err)
+	}
+	w.written += BlockSize
+	w.reset()
+	return nil
+}
+
+// Close writes out any partially filled block.  It does not close the
+// underlying io.Writer.
+func (w *Writer) Close() error {
+	return w.flush()
+}
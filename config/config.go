@@ -17,13 +17,16 @@
 package config
 
 import (
-	"bytes"
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/google/stenographer/base"
+	"github.com/mars-suite/stenographer/base"
 )
 
 var v = base.V // verbose logging
@@ -45,6 +48,674 @@ type ThreadConfig struct {
 	IndexDirectory     string
 	DiskFreePercentage int `json:",omitempty"`
 	MaxDirectoryFiles  int `json:",omitempty"`
+	// QueryCPUs optionally restricts the reads done for queries against this
+	// thread's files to a list of CPUs (like "8-15"), keeping them away from
+	// stenotype's capture cores.
+	QueryCPUs string `json:",omitempty"`
+	// QueryIOPriority optionally sets the I/O priority of those reads (like
+	// "idle" or "best-effort:7"), so they yield to stenotype's writes to
+	// the same disk.
+	QueryIOPriority string `json:",omitempty"`
+}
+
+// ExportConfig configures an exporter, which archives each blockfile before
+// the disk cleaner deletes it.
+type ExportConfig struct {
+	// Type is "upload" (PUT each file as a gzipped PCAP under URL), "gcs" or
+	// "azure" (upload each file as a gzipped PCAP to the Google Cloud Storage
+	// bucket or Azure Blob Storage container at URL), "flows" (write a JSON
+	// summary of each file's flows to Directory), "parquet" (write each file's
+	// packet metadata as a Parquet table to Directory), or "extract" (write
+	// each file's packets matching Query to a PCAP in Directory).
+	Type      string
+	URL       string `json:",omitempty"`
+	Directory string `json:",omitempty"`
+	Query     string `json:",omitempty"`
+	// BytesPerSecond optionally limits the bandwidth of an uploading exporter,
+	// and Schedule varies the limit by time of day:  while one of its windows
+	// covers the current time, the first such window's limit applies instead.
+	// A limit of 0 is unlimited.
+	BytesPerSecond int64             `json:",omitempty"`
+	Schedule       []BandwidthWindow `json:",omitempty"`
+	// TokenFile optionally holds an OAuth 2.0 access token gcs and azure
+	// exporters authenticate with.  It's read again for every file, so it may
+	// be refreshed by something else.  Azure URLs may carry a SAS token
+	// instead.
+	TokenFile string `json:",omitempty"`
+	// Metadata is custom metadata set on each object gcs and azure exporters
+	// upload, and Retention optionally keeps each from being deleted or
+	// overwritten, for regulatory holds.
+	Metadata  map[string]string `json:",omitempty"`
+	Retention *RetentionConfig  `json:",omitempty"`
+}
+
+// RetentionConfig sets the retention of objects uploaded by gcs exporters
+// (with object retention and holds) and azure exporters (with immutability
+// policies and legal holds).  The bucket or container must allow them.
+type RetentionConfig struct {
+	// Period, if set, is how long (like "2160h") after its upload each object
+	// must be kept.  Unless Locked, it can be shortened or removed later by
+	// the storage account's administrators; once Locked, it can't be.
+	Period string `json:",omitempty"`
+	Locked bool   `json:",omitempty"`
+	// LegalHold places a hold on each object (a temporary hold on GCS), which
+	// keeps it regardless of Period until the hold is released.
+	LegalHold bool `json:",omitempty"`
+}
+
+// PeriodDuration returns the parsed Period, or zero if it's unset.
+func (r RetentionConfig) PeriodDuration() (time.Duration, error) {
+	if r.Period == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(r.Period)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention period %q", r.Period)
+	}
+	return d, nil
+}
+
+func (r RetentionConfig) validate() error {
+	d, err := r.PeriodDuration()
+	if err != nil {
+		return err
+	}
+	if r.Locked && d == 0 {
+		return fmt.Errorf("locked retention needs a Period")
+	}
+	return nil
+}
+
+// BandwidthWindow is a time of day during which an upload exporter's
+// bandwidth limit differs, like a trickle during business hours.
+type BandwidthWindow struct {
+	// Start and End are times of day like "08:00" in the sensor's TimeZone.
+	// Windows ending before they start run past midnight.
+	Start, End string
+	// Days optionally restricts the window to days of the week, like "Mon".
+	// Windows running past midnight belong to the day they start.
+	Days           []string `json:",omitempty"`
+	BytesPerSecond int64
+}
+
+// parseTimeOfDay parses a BandwidthWindow time of day into the time since
+// midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseWeekday parses a BandwidthWindow day, like "Mon" or "monday".
+func parseWeekday(s string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if name := d.String(); strings.EqualFold(s, name) || strings.EqualFold(s, name[:3]) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid day %q", s)
+}
+
+func (w BandwidthWindow) validate() error {
+	if _, err := parseTimeOfDay(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseTimeOfDay(w.End); err != nil {
+		return err
+	}
+	for _, d := range w.Days {
+		if _, err := parseWeekday(d); err != nil {
+			return err
+		}
+	}
+	if w.BytesPerSecond < 0 {
+		return fmt.Errorf("negative BytesPerSecond")
+	}
+	return nil
+}
+
+// onDay returns whether the window applies when it starts on day 'd'.
+func (w BandwidthWindow) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, s := range w.Days {
+		if day, _ := parseWeekday(s); day == d { // Checked by validate.
+			return true
+		}
+	}
+	return false
+}
+
+// covers returns whether the window covers 't', in the sensor's time zone.
+func (w BandwidthWindow) covers(t time.Time) bool {
+	start, _ := parseTimeOfDay(w.Start) // Checked by validate.
+	end, _ := parseTimeOfDay(w.End)
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	switch {
+	case start <= end:
+		return since >= start && since < end && w.onDay(t.Weekday())
+	case since >= start:
+		return w.onDay(t.Weekday())
+	default: // Early the morning after the window started.
+		return since < end && w.onDay((t.Weekday()+6)%7)
+	}
+}
+
+// BandwidthAt returns the upload bandwidth limit in bytes per second at 't',
+// which should be in the sensor's time zone, or 0 if it's unlimited.
+func (e ExportConfig) BandwidthAt(t time.Time) int64 {
+	for _, w := range e.Schedule {
+		if w.covers(t) {
+			return w.BytesPerSecond
+		}
+	}
+	return e.BytesPerSecond
+}
+
+// ArchiveConfig configures fetching archived blockfiles for queries which name
+// them.
+type ArchiveConfig struct {
+	// URL is where archived files are fetched from:  the blockfile thread
+	// <thread> wrote as <file> is at <URL>/<thread>/packets/<file>, and its
+	// index at <URL>/<thread>/index/<file>, either optionally compressed with
+	// gzip (with a ".gz" extension) or zstd (".zst").
+	URL string
+	// ScratchDirectory holds fetched files, decompressed, up to CacheMB (1024
+	// by default) of them, evicting the least recently used first.  It's
+	// emptied at startup.
+	ScratchDirectory string
+	CacheMB          int `json:",omitempty"`
+	// ZstdCommand decompresses zstd files, defaulting to "zstd".
+	ZstdCommand string `json:",omitempty"`
+}
+
+const defaultArchiveCacheMB = 1024
+
+// CacheBytes returns the size of the archive's scratch directory in bytes.
+func (a ArchiveConfig) CacheBytes() int64 {
+	if a.CacheMB == 0 {
+		return defaultArchiveCacheMB << 20
+	}
+	return int64(a.CacheMB) << 20
+}
+
+func (a ArchiveConfig) validate() error {
+	if a.URL == "" || a.ScratchDirectory == "" {
+		return fmt.Errorf("archive needs a URL and ScratchDirectory")
+	}
+	if _, err := url.Parse(a.URL); err != nil {
+		return fmt.Errorf("invalid URL %q: %v", a.URL, err)
+	}
+	if a.CacheMB < 0 {
+		return fmt.Errorf("negative CacheMB %d", a.CacheMB)
+	}
+	return nil
+}
+
+// FlowShippingConfig configures shipping a summary record of each flow in
+// every new blockfile to a ClickHouse table or an Elasticsearch index.
+type FlowShippingConfig struct {
+	// Type is "clickhouse" (inserts into Table through ClickHouse's HTTP
+	// interface at URL) or "elasticsearch" (bulk indexes into the index Table
+	// at URL).
+	Type  string
+	URL   string
+	Table string
+	// BatchSize is how many records are sent at once, defaulting to 10000.
+	// Partial batches are sent after FlushInterval (a duration like "30s", the
+	// default).
+	BatchSize     int    `json:",omitempty"`
+	FlushInterval string `json:",omitempty"`
+}
+
+// FlushIntervalDuration returns the parsed FlushInterval, or zero if it's
+// unset.
+func (f FlowShippingConfig) FlushIntervalDuration() (time.Duration, error) {
+	if f.FlushInterval == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(f.FlushInterval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid flush interval %q", f.FlushInterval)
+	}
+	return d, nil
+}
+
+func (f FlowShippingConfig) validate() error {
+	switch f.Type {
+	case "clickhouse", "elasticsearch":
+	default:
+		return fmt.Errorf("invalid type %q", f.Type)
+	}
+	if f.URL == "" || f.Table == "" {
+		return fmt.Errorf("%s flow shipping needs a URL and Table", f.Type)
+	}
+	if f.BatchSize < 0 {
+		return fmt.Errorf("negative batch size %d", f.BatchSize)
+	}
+	_, err := f.FlushIntervalDuration()
+	return err
+}
+
+// TracingConfig configures exporting OpenTelemetry spans of each query to an
+// OTLP/HTTP collector.
+type TracingConfig struct {
+	// Endpoint is the collector's traces URL, like
+	// "http://otel-collector:4318/v1/traces".  Spans are sent as JSON, with
+	// Headers (say, for authentication) added to each request.
+	Endpoint string
+	Headers  map[string]string `json:",omitempty"`
+	// SampleRate is the fraction of queries traced, defaulting to 1.  Queries
+	// with a traceparent header are traced if it says they're sampled.
+	SampleRate float64 `json:",omitempty"`
+	// BatchSize is how many spans are sent at once, defaulting to 512.
+	// Partial batches are sent after FlushInterval (a duration like "5s", the
+	// default).
+	BatchSize     int    `json:",omitempty"`
+	FlushInterval string `json:",omitempty"`
+}
+
+// FlushIntervalDuration returns the parsed FlushInterval, or zero if it's
+// unset.
+func (t TracingConfig) FlushIntervalDuration() (time.Duration, error) {
+	if t.FlushInterval == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(t.FlushInterval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid flush interval %q", t.FlushInterval)
+	}
+	return d, nil
+}
+
+func (t TracingConfig) validate() error {
+	if t.Endpoint == "" {
+		return fmt.Errorf("no endpoint")
+	}
+	if t.SampleRate < 0 || t.SampleRate > 1 {
+		return fmt.Errorf("sample rate %v not between 0 and 1", t.SampleRate)
+	}
+	if t.BatchSize < 0 {
+		return fmt.Errorf("negative batch size %d", t.BatchSize)
+	}
+	_, err := t.FlushIntervalDuration()
+	return err
+}
+
+// QuerySinkConfig configures a destination queries may copy their results to
+// as they're returned, by naming it in their "sinks" parameter.
+type QuerySinkConfig struct {
+	// Name is how queries select the sink.
+	Name string
+	// Type is "file" (write each query's results to a PCAP in Directory) or
+	// "kafka" (produce them to Topic through the Kafka REST Proxy at URL, as
+	// PCAP messages of up to BatchSize packets, defaulting to 1000).
+	Type      string
+	Directory string `json:",omitempty"`
+	URL       string `json:",omitempty"`
+	Topic     string `json:",omitempty"`
+	BatchSize int    `json:",omitempty"`
+	// BufferPackets is how many packets may wait for the sink before it's cut
+	// off as having fallen behind, defaulting to 10000.
+	BufferPackets int `json:",omitempty"`
+}
+
+func (q QuerySinkConfig) validate() error {
+	if q.Name == "" {
+		return fmt.Errorf("no name")
+	}
+	switch q.Type {
+	case "file":
+		if q.Directory == "" {
+			return fmt.Errorf("file sink needs a Directory")
+		}
+	case "kafka":
+		if q.URL == "" || q.Topic == "" {
+			return fmt.Errorf("kafka sink needs a URL and Topic")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", q.Type)
+	}
+	if q.BatchSize < 0 {
+		return fmt.Errorf("negative batch size %d", q.BatchSize)
+	}
+	if q.BufferPackets < 0 {
+		return fmt.Errorf("negative buffer size %d", q.BufferPackets)
+	}
+	return nil
+}
+
+// TransformConfig configures transforms, like anonymization, applied to query
+// results.  See base.TransformNames for the transforms available.
+type TransformConfig struct {
+	// CryptoPANKeyPath is a file holding the 32-byte key (raw, or in hex) the
+	// "cryptopan" transform anonymizes addresses with.  It's needed for
+	// queries to use that transform.
+	CryptoPANKeyPath string `json:",omitempty"`
+	// Clients lists the transforms always applied to the results of each
+	// client (by certificate common name), and Default those for clients not
+	// listed.  Queries may ask for more, but can't avoid these.
+	Default []string            `json:",omitempty"`
+	Clients map[string][]string `json:",omitempty"`
+}
+
+// Enforced returns the transforms always applied to a client's results.
+func (t TransformConfig) Enforced(client string) []string {
+	if names, ok := t.Clients[client]; ok {
+		return names
+	}
+	return t.Default
+}
+
+func (t TransformConfig) validate() error {
+	lists := map[string][]string{"default": t.Default}
+	for client, names := range t.Clients {
+		lists[fmt.Sprintf("client %q", client)] = names
+	}
+	for who, names := range lists {
+		if _, err := base.TransformNames(names); err != nil {
+			return fmt.Errorf("%s: %v", who, err)
+		}
+		for _, name := range names {
+			if name == "cryptopan" && t.CryptoPANKeyPath == "" {
+				return fmt.Errorf("%s: cryptopan needs a CryptoPANKeyPath", who)
+			}
+		}
+	}
+	return nil
+}
+
+// EmbargoConfig limits which packets queries may return by age, for privacy
+// or process reasons, even while they're still on disk.  Ages are durations
+// like "30m", or whole days like "90d".
+type EmbargoConfig struct {
+	// MinAge keeps packets newer than this from being returned.
+	MinAge string `json:",omitempty"`
+	// MaxAge keeps packets older than this from being returned.
+	MaxAge string `json:",omitempty"`
+}
+
+// parseAge parses an EmbargoConfig age.
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q", s)
+	}
+	return d, nil
+}
+
+// Ages returns the parsed MinAge and MaxAge, which are zero if unset.
+func (c EmbargoConfig) Ages() (min, max time.Duration, err error) {
+	if c.MinAge != "" {
+		if min, err = parseAge(c.MinAge); err != nil {
+			return 0, 0, err
+		}
+	}
+	if c.MaxAge != "" {
+		if max, err = parseAge(c.MaxAge); err != nil {
+			return 0, 0, err
+		}
+	}
+	return min, max, nil
+}
+
+// Window returns the range of packet timestamps queries may return at 'now',
+// with zero times for open ends.
+func (c EmbargoConfig) Window(now time.Time) (start, end time.Time) {
+	min, max, _ := c.Ages() // Checked by validate.
+	if min > 0 {
+		end = now.Add(-min)
+	}
+	if max > 0 {
+		start = now.Add(-max)
+	}
+	return start, end
+}
+
+func (c EmbargoConfig) validate() error {
+	min, max, err := c.Ages()
+	if err != nil {
+		return err
+	} else if max > 0 && max <= min {
+		return fmt.Errorf("MaxAge %q not after MinAge %q", c.MaxAge, c.MinAge)
+	}
+	return nil
+}
+
+// QueryRangeConfig limits the span of time a single query may cover, so a
+// query left without time bounds can't accidentally extract all history.
+type QueryRangeConfig struct {
+	// Max is the longest span allowed from a query's start to its end (or
+	// now, if it has none), as a duration or a number of days like "7d".
+	// Queries without a start are rejected.
+	Max string
+	// Privileged lists the clients (by certificate common name) allowed to
+	// query any span of time.
+	Privileged []string `json:",omitempty"`
+}
+
+// MaxDuration returns the parsed Max.
+func (c QueryRangeConfig) MaxDuration() (time.Duration, error) {
+	max, err := parseAge(c.Max)
+	if err == nil && max == 0 {
+		err = fmt.Errorf("no Max")
+	}
+	return max, err
+}
+
+// Exempt returns whether a client may query any span of time.
+func (c QueryRangeConfig) Exempt(client string) bool {
+	for _, p := range c.Privileged {
+		if p == client {
+			return true
+		}
+	}
+	return false
+}
+
+func (c QueryRangeConfig) validate() error {
+	_, err := c.MaxDuration()
+	return err
+}
+
+// RetentionSLOConfig configures a retention service level objective:  every
+// thread's oldest file should be at least MinAge old.
+type RetentionSLOConfig struct {
+	// MinAge is the retention promised, as a duration or a number of days
+	// like "3d".
+	MinAge string
+	// Interval is how often (as a duration, default "5m") retention is
+	// checked.
+	Interval string `json:",omitempty"`
+	// Webhook, if set, is a URL a JSON report is POSTed to whenever the SLO
+	// starts or stops being met.
+	Webhook string `json:",omitempty"`
+}
+
+// Durations returns the parsed MinAge and Interval.
+func (c RetentionSLOConfig) Durations() (minAge, interval time.Duration, err error) {
+	if minAge, err = parseAge(c.MinAge); err != nil {
+		return 0, 0, err
+	} else if minAge == 0 {
+		return 0, 0, fmt.Errorf("no MinAge")
+	}
+	interval = 5 * time.Minute
+	if c.Interval != "" {
+		if interval, err = time.ParseDuration(c.Interval); err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("invalid interval %q", c.Interval)
+		}
+	}
+	return minAge, interval, nil
+}
+
+func (c RetentionSLOConfig) validate() error {
+	if _, _, err := c.Durations(); err != nil {
+		return err
+	}
+	if c.Webhook != "" {
+		if u, err := url.Parse(c.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook %q", c.Webhook)
+		}
+	}
+	return nil
+}
+
+// IndexLagConfig configures what lookups do about blockfiles stenotype has
+// finished writing, but whose indexes it hasn't written yet.
+type IndexLagConfig struct {
+	// Policy is "report" (the default) to search only indexed files, warning
+	// about the rest, "wait" to wait up to MaxWait for their indexes first,
+	// or "scan" to index them in memory, like files still being written.
+	Policy string
+	// MaxWait is how long (as a duration, default "30s") the "wait" policy
+	// waits for indexes.
+	MaxWait string `json:",omitempty"`
+}
+
+// MaxWaitDuration returns the parsed MaxWait.
+func (c IndexLagConfig) MaxWaitDuration() (time.Duration, error) {
+	if c.MaxWait == "" {
+		return 30 * time.Second, nil
+	}
+	d, err := time.ParseDuration(c.MaxWait)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid max wait %q", c.MaxWait)
+	}
+	return d, nil
+}
+
+func (c IndexLagConfig) validate() error {
+	switch c.Policy {
+	case "", "report", "wait", "scan":
+	default:
+		return fmt.Errorf("invalid policy %q", c.Policy)
+	}
+	_, err := c.MaxWaitDuration()
+	return err
+}
+
+// CanaryConfig configures a self-test query, run periodically over recent
+// traffic, which should always find packets.  If it finds none, capture or
+// indexing has silently stopped working.
+type CanaryConfig struct {
+	// Query should be cheap and match traffic the sensor always sees, like
+	// its own NTP ("udp and port 123").  It's limited to the last Window of
+	// traffic.
+	Query string
+	// Interval is how often (as a duration like "5m", the default) the query
+	// runs, and Window how far back (default "10m") it looks.  Window must be
+	// longer than a blockfile takes to fill, since packets aren't found until
+	// their file is finished.
+	Interval string `json:",omitempty"`
+	Window   string `json:",omitempty"`
+}
+
+// Durations returns the parsed Interval and Window, with their defaults.
+func (c CanaryConfig) Durations() (interval, window time.Duration, err error) {
+	interval, window = 5*time.Minute, 10*time.Minute
+	if c.Interval != "" {
+		if interval, err = time.ParseDuration(c.Interval); err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("invalid interval %q", c.Interval)
+		}
+	}
+	if c.Window != "" {
+		if window, err = time.ParseDuration(c.Window); err != nil || window <= 0 {
+			return 0, 0, fmt.Errorf("invalid window %q", c.Window)
+		}
+	}
+	return interval, window, nil
+}
+
+func (c CanaryConfig) validate() error {
+	if c.Query == "" {
+		return fmt.Errorf("no query")
+	}
+	_, _, err := c.Durations()
+	return err
+}
+
+// RateLimit limits a client's use of the query API.  Zero limits are
+// unlimited.
+type RateLimit struct {
+	QueriesPerMinute int   `json:",omitempty"`
+	BytesPerDay      int64 `json:",omitempty"` // Of query results, per UTC day.
+}
+
+// RateLimitConfig sets the rate limits of each client, identified by the
+// common name of its certificate.
+type RateLimitConfig struct {
+	Default RateLimit            // For clients not listed in Clients.
+	Clients map[string]RateLimit `json:",omitempty"`
+}
+
+func (r RateLimitConfig) validate() error {
+	for name, lim := range r.Clients {
+		if lim.QueriesPerMinute < 0 || lim.BytesPerDay < 0 {
+			return fmt.Errorf("negative limit for client %q", name)
+		}
+	}
+	if r.Default.QueriesPerMinute < 0 || r.Default.BytesPerDay < 0 {
+		return fmt.Errorf("negative default limit")
+	}
+	return nil
+}
+
+// ProfilingConfig enables the /debug/pprof endpoints, and optionally logging
+// the worst lock contention seen every so often.
+type ProfilingConfig struct {
+	// Clients are the certificate common names allowed to profile.  If empty,
+	// any client with a valid certificate may.
+	Clients []string `json:",omitempty"`
+	// MinInterval is how long (as a duration like "1m", the default) each
+	// client must wait between profiles.
+	MinInterval string `json:",omitempty"`
+	// MaxCPUSeconds caps how long a CPU profile may run, defaulting to 30.
+	MaxCPUSeconds int `json:",omitempty"`
+	// BlockProfileRate and MutexProfileFraction are passed to
+	// runtime.SetBlockProfileRate and runtime.SetMutexProfileFraction,
+	// defaulting to 1000 and 100.
+	BlockProfileRate     int `json:",omitempty"`
+	MutexProfileFraction int `json:",omitempty"`
+	// ContentionLogInterval, if set, is how often (as a duration like "10m")
+	// the ContentionLogTop (default 5) call sites which spent longest waiting
+	// on locks and channels since the last time are logged.
+	ContentionLogInterval string `json:",omitempty"`
+	ContentionLogTop      int    `json:",omitempty"`
+}
+
+// Intervals returns the parsed MinInterval and ContentionLogInterval, with
+// their defaults.  The contention log interval is zero if it's disabled.
+func (p ProfilingConfig) Intervals() (min, contention time.Duration, err error) {
+	min = time.Minute
+	if p.MinInterval != "" {
+		if min, err = time.ParseDuration(p.MinInterval); err != nil || min < 0 {
+			return 0, 0, fmt.Errorf("invalid minimum interval %q", p.MinInterval)
+		}
+	}
+	if p.ContentionLogInterval != "" {
+		if contention, err = time.ParseDuration(p.ContentionLogInterval); err != nil || contention <= 0 {
+			return 0, 0, fmt.Errorf("invalid contention log interval %q", p.ContentionLogInterval)
+		}
+	}
+	return min, contention, nil
+}
+
+func (p ProfilingConfig) validate() error {
+	if p.MaxCPUSeconds < 0 || p.BlockProfileRate < 0 || p.MutexProfileFraction < 0 || p.ContentionLogTop < 0 {
+		return fmt.Errorf("negative limit or rate")
+	}
+	_, _, err := p.Intervals()
+	return err
 }
 
 // RpcConfig is a json-decoded configuration for running the gRPC server.
@@ -61,6 +732,9 @@ type RpcConfig struct {
 
 // Config is a json-decoded configuration for running stenographer.
 type Config struct {
+	// Version is the schema version the configuration is written for (see
+	// Version), 1 if it's unset.
+	Version         int `json:",omitempty"`
 	Rpc             *RpcConfig
 	StenotypePath   string
 	Threads         []ThreadConfig
@@ -71,19 +745,236 @@ type Config struct {
 	Host            string // Location to listen.
 	CertPath        string // Directory where client and server certs are stored.
 	MaxOpenFiles    int    // Max number of file descriptors opened at once
+	LabelsPath      string // File to persist labels in, labels are disabled if empty
+	// MaxConcurrentStreams limits how many requests (such as queries) each
+	// HTTP/2 connection may have in flight at once.  Defaults to 250.
+	MaxConcurrentStreams int `json:",omitempty"`
+	// ClockSkew is how far (as a duration like "5m") packet and file timestamps
+	// may stray from capture order before we flag them.  Time-based queries
+	// widen their file pruning by this much.  Defaults to one minute.
+	ClockSkew string `json:",omitempty"`
+	// TimeZone is the IANA name (like "America/New_York") of the sensor's local
+	// time zone.  Query times without a UTC offset are read in it, and it's
+	// recorded in pcapng output.  Defaults to UTC.
+	TimeZone string `json:",omitempty"`
+	// HardwareClock declares what the packet timestamps stenotype records are
+	// measured in:  "utc" (the default), "tai" for PTP-disciplined NICs, or
+	// "local" for NICs set to wall clock time in TimeZone.  Timestamps are
+	// converted to UTC when packets are read, so results from sensors with
+	// different clocks line up.
+	HardwareClock string `json:",omitempty"`
+	// LinkType is the link-layer header type of captured packets, by name
+	// ("ethernet", "linux_sll", "raw", "ipv4", "ipv6", "null", "loop", "ppp")
+	// or DLT number, which PCAP and pcapng output declare.  Defaults to
+	// "ethernet"; captures without Ethernet headers, like those from tunnel
+	// interfaces, need it set for output to be parsed correctly.
+	// OutputLinkType, if set, converts packets to another link type in output,
+	// which is only supported to "ethernet" from "raw", "ipv4", "ipv6", or
+	// "linux_sll", for tools which only understand Ethernet.
+	LinkType       string `json:",omitempty"`
+	OutputLinkType string `json:",omitempty"`
+	// SnapLen is the snapshot length output declares, and truncates packets
+	// to.  Defaults to 65536.
+	SnapLen int `json:",omitempty"`
+	// IndexBackend selects how indexes are read:  "leveldb" (the default) reads
+	// stenotype's leveldb tables directly, "mmap" reads memory-mapped sorted
+	// copies of them, and "sharded" reads memory-mapped copies split by key
+	// type, so lookups only page in the key types they need.
+	IndexBackend string `json:",omitempty"`
+	// CompositeKeyPorts lists the TCP/UDP ports of hot services to build
+	// composite address and port keys for, so queries like "host X and port
+	// 443" are a single lookup.  Each file's composite index is built from its
+	// blockfile the first time it's needed.
+	CompositeKeyPorts []int `json:",omitempty"`
+	// AppProtocolIndex tags each flow with its application protocol (DNS,
+	// TLS, HTTP, SSH, or QUIC), guessed from its payloads rather than its
+	// ports, so "app tls" queries work.  Each new file's app index is built
+	// from its blockfile once stenotype has written it.
+	AppProtocolIndex bool `json:",omitempty"`
+	// QUICConnectionIDIndex indexes QUIC packets by the connection ID they're
+	// sent to, so "quic cid" queries can follow a connection across address
+	// and port changes.  Each new file's QUIC index is built from its
+	// blockfile once stenotype has written it.
+	QUICConnectionIDIndex bool `json:",omitempty"`
+	// IndexStats makes the query planner build key statistics for each index
+	// which doesn't have them the first time it plans a query against it,
+	// rather than running intersections in the order the query gives.
+	IndexStats bool `json:",omitempty"`
+	// IndexBudgetPercent, if set, limits index disk usage to this percentage
+	// of packet data.  When indexes outgrow it, stenotype is restarted without
+	// its optional key types (--index_tcp_flags, then --index_host_direction,
+	// --index_port_direction, --index_gtp, --index_macs, and --index_tunnels)
+	// one at a time until they fit.
+	IndexBudgetPercent float64 `json:",omitempty"`
+	// QueryMemoryLimitMB limits the scratch memory each query may use, failing
+	// (or spilling to QuerySpillDirectory, where possible) queries which need
+	// more.  Queries are unlimited if zero.
+	QueryMemoryLimitMB  int    `json:",omitempty"`
+	QuerySpillDirectory string `json:",omitempty"` // Defaults to the system temp directory.
+	// QueryStallTimeout, if set, is how long (like "30s") a query's client may
+	// go without reading results before the query counts as stalled.  Stalls
+	// are logged and counted, and with AbortStalledQueries, the query is also
+	// aborted with an error, freeing the disk reads and memory it holds.
+	QueryStallTimeout   string `json:",omitempty"`
+	AbortStalledQueries bool   `json:",omitempty"`
+	// ReadCacheMB, if set, caches this much recently read packet data in
+	// memory, for queries which extract the same traffic repeatedly.
+	ReadCacheMB int `json:",omitempty"`
+	// QueryPlanCacheSize, if set, caches this many parsed queries by their
+	// text, for templated queries which are run again and again.
+	QueryPlanCacheSize int `json:",omitempty"`
+	// SensorID identifies this sensor in query output, defaulting to the
+	// hostname.
+	SensorID string `json:",omitempty"`
+	// FileNameTemplate, if set, is how stenotype names blockfiles and their
+	// indexes, from the placeholders {micros} or {utc} (when the file was
+	// started), {thread}, and {sensor} (see base.FileNames).  Defaults to
+	// "{micros}".
+	FileNameTemplate string `json:",omitempty"`
+	// TLS optionally restricts the TLS versions, cipher suites, and curves the
+	// HTTP and gRPC servers accept.
+	TLS *TLSConfig `json:",omitempty"`
+	// OutboundProxy is an optional http://, https://, or socks5:// proxy URL
+	// (with optional user:password) for connections to collectors and other
+	// remote services.
+	OutboundProxy string `json:",omitempty"`
+	// AuditLogPath, if set, is where a signed, hash-chained record of every
+	// query's extraction is appended.  AuditKeyPath is the PEM Ed25519 private
+	// key entries are signed with.
+	AuditLogPath string `json:",omitempty"`
+	AuditKeyPath string `json:",omitempty"`
+	// WorkloadLogPath, if set, records every query, anonymized, to be
+	// replayed against a test corpus when checking a new version (see
+	// "stenoctl replay").  Addresses are anonymized with CryptoPAn under the
+	// key in WorkloadKeyPath (32 bytes, raw or hex), or a random key if that's
+	// unset.
+	WorkloadLogPath string `json:",omitempty"`
+	WorkloadKeyPath string `json:",omitempty"`
+	// Exporters archive each blockfile before the disk cleaner deletes it, and
+	// files aren't deleted until they've all run.  If an export fails, the file
+	// is deleted anyway unless ExportRequired is set, in which case it's kept
+	// and retried.
+	Exporters      []ExportConfig `json:",omitempty"`
+	ExportRequired bool           `json:",omitempty"`
+	// Archive, if set, lets queries read blockfiles archived to remote
+	// storage, fetching them on demand.
+	Archive *ArchiveConfig `json:",omitempty"`
+	// HostResolverURL or HostResolverCommand, if set, resolve host names in
+	// queries (like "host webserver01") to the addresses they had over the
+	// query's time range, from a CMDB or IPAM.  See README.md for the protocol.
+	HostResolverURL     string `json:",omitempty"`
+	HostResolverCommand string `json:",omitempty"`
+	// FlowShipping, if set, ships a summary of the flows in each new blockfile
+	// to ClickHouse or Elasticsearch, through OutboundProxy if that's set.
+	FlowShipping *FlowShippingConfig `json:",omitempty"`
+	// RateLimits, if set, limits how many queries each client may run per
+	// minute, and how many bytes of results it may get per day.
+	RateLimits *RateLimitConfig `json:",omitempty"`
+	// Profiling, if set, serves Go profiles under /debug/pprof.  They're not
+	// served otherwise.
+	Profiling *ProfilingConfig `json:",omitempty"`
+	// Tracing, if set, exports OpenTelemetry spans of each query's parsing,
+	// planning, per-blockfile index lookups and packet reads, and streaming.
+	Tracing *TracingConfig `json:",omitempty"`
+	// QuerySinks are destinations, like an archive directory or a Kafka topic,
+	// which queries may copy their results to as well as returning them.
+	QuerySinks []QuerySinkConfig `json:",omitempty"`
+	// Transforms, if set, configures transforms (like anonymization) applied
+	// to query results, either when queries ask for them or always, by client.
+	Transforms *TransformConfig `json:",omitempty"`
+	// Canary, if set, periodically runs a query which should always find
+	// packets, and raises an error event when it doesn't.
+	Canary *CanaryConfig `json:",omitempty"`
+	// Embargo, if set, keeps queries from returning packets newer or older
+	// than the given ages.
+	Embargo *EmbargoConfig `json:",omitempty"`
+	// QueryRange, if set, rejects queries spanning too much time, unless
+	// their client is privileged.
+	QueryRange *QueryRangeConfig `json:",omitempty"`
+	// RetentionSLO, if set, checks that every thread keeps packets for at
+	// least a minimum time, and alerts when one doesn't.
+	RetentionSLO *RetentionSLOConfig `json:",omitempty"`
+	// IndexLag, if set, changes how queries handle files whose indexes
+	// haven't been written yet.  By default they're skipped with a warning.
+	IndexLag *IndexLagConfig `json:",omitempty"`
+}
+
+// ClockSkewDuration returns the parsed ClockSkew, or zero if it's unset.
+func (c Config) ClockSkewDuration() (time.Duration, error) {
+	if c.ClockSkew == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.ClockSkew)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock skew %q in configuration: %v", c.ClockSkew, err)
+	} else if d < 0 {
+		return 0, fmt.Errorf("negative clock skew %q in configuration", c.ClockSkew)
+	}
+	return d, nil
+}
+
+// QueryStallTimeoutDuration returns the parsed QueryStallTimeout, or zero if
+// it's unset.
+func (c Config) QueryStallTimeoutDuration() (time.Duration, error) {
+	if c.QueryStallTimeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.QueryStallTimeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid query stall timeout %q in configuration", c.QueryStallTimeout)
+	}
+	return d, nil
+}
+
+// Location returns the sensor's time zone, from TimeZone.
+func (c Config) Location() (*time.Location, error) {
+	if c.TimeZone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q in configuration: %v", c.TimeZone, err)
+	}
+	return loc, nil
+}
+
+// Clock returns how packet timestamps convert to UTC, from HardwareClock and
+// TimeZone.
+func (c Config) Clock() (base.Clock, error) {
+	loc, err := c.Location()
+	if err != nil {
+		return base.Clock{}, err
+	}
+	switch c.HardwareClock {
+	case "", "utc", "tai", "local":
+	default:
+		return base.Clock{}, fmt.Errorf("invalid hardware clock %q in configuration", c.HardwareClock)
+	}
+	return base.Clock{Source: c.HardwareClock, Location: loc}, nil
+}
+
+// LinkLayer returns how output describes captured packets, from LinkType,
+// OutputLinkType, SnapLen, and Interface.
+func (c Config) LinkLayer() (base.LinkLayer, error) {
+	l, err := base.NewLinkLayer(c.LinkType, c.OutputLinkType, c.SnapLen, c.Interface)
+	if err != nil {
+		return l, fmt.Errorf("invalid link layer in configuration: %v", err)
+	}
+	return l, nil
 }
 
 // ReadConfigFile reads in the given JSON encoded configuration file and returns
-// the Config object associated with the decoded configuration data.
+// the Config object associated with the decoded configuration data.  Values may
+// reference environment variables, like "${NAME}" or "${NAME:-default}", and
+// fields the Config doesn't have are errors.
 func ReadConfigFile(filename string) (*Config, error) {
 	v(0, "Reading config %q", filename)
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("could not read config file %q: %v", filename, err)
 	}
-	dec := json.NewDecoder(bytes.NewReader(data))
-	var out Config
-	if err := dec.Decode(&out); err != nil {
+	out, err := decode(data)
+	if err != nil {
 		return nil, fmt.Errorf("could not decode config file %q: %v", filename, err)
 	}
 	if out.MaxOpenFiles <= 0 {
@@ -97,7 +988,7 @@ func ReadConfigFile(filename string) (*Config, error) {
 			out.Threads[i].MaxDirectoryFiles = defaultMaxDirectoryFiles
 		}
 	}
-	return &out, nil
+	return out, nil
 }
 
 // Validate checks the configuration for common errors.
@@ -109,15 +1000,218 @@ func (c Config) Validate() error {
 		if thread.IndexDirectory == "" {
 			return fmt.Errorf("No index directory specified for thread %d in configuration", n)
 		}
+		if thread.QueryCPUs != "" {
+			if _, err := base.ParseCPUList(thread.QueryCPUs); err != nil {
+				return fmt.Errorf("invalid QueryCPUs for thread %d in configuration: %v", n, err)
+			}
+		}
+		if thread.QueryIOPriority != "" {
+			if _, err := base.ParseIOPriority(thread.QueryIOPriority); err != nil {
+				return fmt.Errorf("invalid QueryIOPriority for thread %d in configuration: %v", n, err)
+			}
+		}
 	}
 
 	if len(c.TestimonySocket) > 0 && len(c.Interface) > 0 {
 		return fmt.Errorf("Can't use both \"Interface\" and \"TestimonySocket\" options")
 	}
 
+	if _, err := c.ClockSkewDuration(); err != nil {
+		return err
+	}
+
+	if _, err := c.QueryStallTimeoutDuration(); err != nil {
+		return err
+	} else if c.AbortStalledQueries && c.QueryStallTimeout == "" {
+		return fmt.Errorf("AbortStalledQueries needs a QueryStallTimeout")
+	}
+
+	if _, err := c.Clock(); err != nil {
+		return err
+	}
+
+	if c.FileNameTemplate != "" {
+		if _, err := base.NewFileNames(c.FileNameTemplate, c.SensorID); err != nil {
+			return fmt.Errorf("invalid file name template in configuration: %v", err)
+		}
+	}
+	if _, err := c.LinkLayer(); err != nil {
+		return err
+	}
+
+	if err := c.TLS.Apply(&tls.Config{}); err != nil {
+		return err
+	}
+
+	if c.IndexBudgetPercent < 0 {
+		return fmt.Errorf("negative IndexBudgetPercent %v in configuration", c.IndexBudgetPercent)
+	}
+
+	if c.QueryMemoryLimitMB < 0 {
+		return fmt.Errorf("negative QueryMemoryLimitMB %d in configuration", c.QueryMemoryLimitMB)
+	}
+
+	if c.ReadCacheMB < 0 {
+		return fmt.Errorf("negative ReadCacheMB %d in configuration", c.ReadCacheMB)
+	}
+	if c.QueryPlanCacheSize < 0 {
+		return fmt.Errorf("negative QueryPlanCacheSize %d in configuration", c.QueryPlanCacheSize)
+	}
+
+	if (c.AuditLogPath == "") != (c.AuditKeyPath == "") {
+		return fmt.Errorf("AuditLogPath and AuditKeyPath must be set together in configuration")
+	}
+
+	if c.HostResolverURL != "" && c.HostResolverCommand != "" {
+		return fmt.Errorf("Can't use both \"HostResolverURL\" and \"HostResolverCommand\" options")
+	}
+
+	for n, e := range c.Exporters {
+		if err := e.validate(); err != nil {
+			return fmt.Errorf("exporter %d in configuration: %v", n, err)
+		}
+	}
+
+	if c.Archive != nil {
+		if err := c.Archive.validate(); err != nil {
+			return fmt.Errorf("archive in configuration: %v", err)
+		}
+	}
+
+	if c.FlowShipping != nil {
+		if err := c.FlowShipping.validate(); err != nil {
+			return fmt.Errorf("flow shipping in configuration: %v", err)
+		}
+	}
+
+	if c.RateLimits != nil {
+		if err := c.RateLimits.validate(); err != nil {
+			return fmt.Errorf("rate limits in configuration: %v", err)
+		}
+	}
+
+	if c.Profiling != nil {
+		if err := c.Profiling.validate(); err != nil {
+			return fmt.Errorf("profiling in configuration: %v", err)
+		}
+	}
+
+	if c.Tracing != nil {
+		if err := c.Tracing.validate(); err != nil {
+			return fmt.Errorf("tracing in configuration: %v", err)
+		}
+	}
+
+	if c.Transforms != nil {
+		if err := c.Transforms.validate(); err != nil {
+			return fmt.Errorf("transforms in configuration: %v", err)
+		}
+	}
+
+	if c.Canary != nil {
+		if err := c.Canary.validate(); err != nil {
+			return fmt.Errorf("canary in configuration: %v", err)
+		}
+	}
+
+	if c.Embargo != nil {
+		if err := c.Embargo.validate(); err != nil {
+			return fmt.Errorf("embargo in configuration: %v", err)
+		}
+	}
+	if c.QueryRange != nil {
+		if err := c.QueryRange.validate(); err != nil {
+			return fmt.Errorf("query range in configuration: %v", err)
+		}
+	}
+	if c.RetentionSLO != nil {
+		if err := c.RetentionSLO.validate(); err != nil {
+			return fmt.Errorf("retention SLO in configuration: %v", err)
+		}
+	}
+	if c.IndexLag != nil {
+		if err := c.IndexLag.validate(); err != nil {
+			return fmt.Errorf("index lag in configuration: %v", err)
+		}
+	}
+
+	sinks := map[string]bool{}
+	for n, q := range c.QuerySinks {
+		if err := q.validate(); err != nil {
+			return fmt.Errorf("query sink %d in configuration: %v", n, err)
+		} else if sinks[q.Name] {
+			return fmt.Errorf("duplicate query sink %q in configuration", q.Name)
+		}
+		sinks[q.Name] = true
+	}
+
+	switch c.IndexBackend {
+	case "", "leveldb", "mmap", "sharded":
+	default:
+		return fmt.Errorf("invalid index backend %q in configuration", c.IndexBackend)
+	}
+	if c.MaxConcurrentStreams < 0 {
+		return fmt.Errorf("invalid MaxConcurrentStreams %d in configuration", c.MaxConcurrentStreams)
+	}
+	for _, port := range c.CompositeKeyPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid composite key port %d in configuration", port)
+		}
+	}
+
 	if host := net.ParseIP(c.Host); host == nil {
 		return fmt.Errorf("invalid listening location %q in configuration", c.Host)
 	}
 
 	return nil
 }
+
+func (e ExportConfig) validate() error {
+	switch e.Type {
+	case "upload", "gcs", "azure":
+		if e.URL == "" {
+			return fmt.Errorf("%s exporter needs a URL", e.Type)
+		}
+		if u, err := url.Parse(e.URL); err != nil {
+			return fmt.Errorf("invalid URL %q: %v", e.URL, err)
+		} else if e.Type == "gcs" && (u.Scheme != "gs" || u.Host == "") {
+			return fmt.Errorf("gcs exporter URL %q isn't gs://<bucket>[/<prefix>]", e.URL)
+		} else if e.Type == "azure" && strings.Trim(u.Path, "/") == "" {
+			return fmt.Errorf("azure exporter URL %q has no container", e.URL)
+		}
+		if e.Type == "upload" && (e.TokenFile != "" || len(e.Metadata) > 0 || e.Retention != nil) {
+			return fmt.Errorf("only gcs and azure exporters take a TokenFile, Metadata, or Retention")
+		}
+		if e.Retention != nil {
+			if err := e.Retention.validate(); err != nil {
+				return fmt.Errorf("retention: %v", err)
+			}
+		}
+		if e.BytesPerSecond < 0 {
+			return fmt.Errorf("negative BytesPerSecond")
+		}
+		for n, w := range e.Schedule {
+			if err := w.validate(); err != nil {
+				return fmt.Errorf("schedule window %d: %v", n, err)
+			}
+		}
+		return nil
+	case "flows", "parquet":
+		if e.Directory == "" {
+			return fmt.Errorf("%s exporter needs a Directory", e.Type)
+		}
+	case "extract":
+		if e.Directory == "" || e.Query == "" {
+			return fmt.Errorf("extract exporter needs a Directory and Query")
+		}
+	default:
+		return fmt.Errorf("invalid type %q", e.Type)
+	}
+	if e.BytesPerSecond != 0 || len(e.Schedule) > 0 {
+		return fmt.Errorf("only uploading exporters take a bandwidth limit")
+	}
+	if e.TokenFile != "" || len(e.Metadata) > 0 || e.Retention != nil {
+		return fmt.Errorf("only gcs and azure exporters take a TokenFile, Metadata, or Retention")
+	}
+	return nil
+}
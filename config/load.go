@@ -0,0 +1,143 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Version is the newest configuration schema version this build understands.
+// Configurations declare theirs in their Version field; those without one are
+// read as version 1, the format from before versions were declared.  Changes
+// which would make an older configuration mean something different, rather
+// than just adding optional fields, bump it.
+const Version = 1
+
+// envVar matches environment variable references in configurations, like
+// "${NAME}" or "${NAME:-default}".  A leading "$$" escapes a literal "${".
+var envVar = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// interpolate replaces each reference to an environment variable in 'data'
+// with its value, JSON-escaped so it can be used within strings.  Defaults are
+// used as they're written.  It's an error to reference a variable which isn't
+// set and has no default.
+func interpolate(data []byte, lookup func(string) (string, bool)) ([]byte, error) {
+	var out []byte
+	last := 0
+	for _, m := range envVar.FindAllSubmatchIndex(data, -1) {
+		out = append(out, data[last:m[0]]...)
+		last = m[1]
+		if bytes.HasPrefix(data[m[0]:], []byte("$$")) {
+			out = append(out, data[m[0]+1:m[1]]...)
+			continue
+		}
+		name := string(data[m[2]:m[3]])
+		value, ok := lookup(name)
+		switch {
+		case ok:
+			quoted, _ := json.Marshal(value)
+			out = append(out, quoted[1:len(quoted)-1]...)
+		case m[4] >= 0:
+			out = append(out, data[m[4]+2:m[5]]...)
+		default:
+			return nil, fmt.Errorf("line %d: environment variable %s is not set", lineOf(data, int64(m[0])), name)
+		}
+	}
+	return append(out, data[last:]...), nil
+}
+
+// lineOf returns the line of 'data' holding the given byte offset.
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
+
+// decode parses a JSON configuration, after interpolating environment
+// variables.  Unlike a plain json.Unmarshal, unknown fields (usually typos,
+// which would otherwise silently leave options unset) are errors, and errors
+// say which line they're on.
+func decode(data []byte) (*Config, error) {
+	data, err := interpolate(data, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var out Config
+	if err := dec.Decode(&out); err != nil {
+		return nil, describeError(data, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("line %d: unexpected data after configuration", lineOf(data, dec.InputOffset()))
+	}
+	if out.Version < 0 || out.Version > Version {
+		return nil, fmt.Errorf("configuration version %d not supported; this stenographer understands versions up to %d", out.Version, Version)
+	}
+	if out.Version == 0 {
+		out.Version = 1
+	}
+	return &out, nil
+}
+
+// describeError adds the line an error decoding 'data' occurred on, and
+// rephrases it for people editing configurations rather than Go programmers.
+func describeError(data []byte, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Errorf("line %d: %v", lineOf(data, e.Offset), e)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("line %d: %s should be %s, not a JSON %s", lineOf(data, e.Offset), e.Field, typeName(e.Type.Kind().String()), e.Value)
+	}
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		name, _ := strconv.Unquote(strings.TrimPrefix(msg, "json: unknown field "))
+		loc := regexp.MustCompile(`"` + regexp.QuoteMeta(name) + `"\s*:`).FindIndex(data)
+		if loc == nil {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		return fmt.Errorf("line %d: unknown field %q", lineOf(data, int64(loc[0])), name)
+	}
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("line %d: unexpected end of configuration", lineOf(data, int64(len(data))))
+	}
+	return err
+}
+
+// typeName describes the Go kinds configuration fields have in JSON terms.
+func typeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"):
+		return "an integer"
+	case strings.HasPrefix(kind, "float"):
+		return "a number"
+	case kind == "string":
+		return "a string"
+	case kind == "bool":
+		return "true or false"
+	case kind == "slice", kind == "array":
+		return "a list"
+	case kind == "struct", kind == "map", kind == "ptr":
+		return "an object"
+	}
+	return kind
+}
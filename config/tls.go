@@ -0,0 +1,90 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLSConfig is an optional TLS policy for stenographer's HTTP and gRPC
+// servers.  Unset fields keep Go's defaults.
+type TLSConfig struct {
+	MinVersion string `json:",omitempty"` // "1.0", "1.1", "1.2", or "1.3"
+	// CipherSuites lists allowed TLS 1.0-1.2 cipher suites by their IANA names,
+	// like "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384".  TLS 1.3 suites aren't
+	// configurable.
+	CipherSuites []string `json:",omitempty"`
+	// CurvePreferences lists key exchange curves in order of preference, from
+	// "X25519", "P256", "P384", and "P521".
+	CurvePreferences []string `json:",omitempty"`
+	// OCSPStaple is a file holding a DER-encoded OCSP response for the server
+	// certificate, stapled to TLS handshakes.  It's re-read whenever it
+	// changes, so it can be refreshed by an external job.
+	OCSPStaple string `json:",omitempty"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Apply sets the policy's options on the given tls.Config.
+func (t *TLSConfig) Apply(c *tls.Config) error {
+	if t == nil {
+		return nil
+	}
+	if t.MinVersion != "" {
+		version, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return fmt.Errorf("invalid TLS MinVersion %q", t.MinVersion)
+		}
+		c.MinVersion = version
+	}
+	if len(t.CipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			suites[s.Name] = s.ID
+		}
+		c.CipherSuites = nil
+		for _, name := range t.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("unknown TLS cipher suite %q", name)
+			}
+			c.CipherSuites = append(c.CipherSuites, id)
+		}
+	}
+	if len(t.CurvePreferences) > 0 {
+		c.CurvePreferences = nil
+		for _, name := range t.CurvePreferences {
+			curve, ok := tlsCurves[name]
+			if !ok {
+				return fmt.Errorf("unknown TLS curve %q", name)
+			}
+			c.CurvePreferences = append(c.CurvePreferences, curve)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,462 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package decrypt decrypts the TLS sessions in query results with secrets from
+// a key log, for environments which collect key logs centrally.  TCP streams
+// are reassembled per flow, and the application data of sessions using
+// AES-GCM cipher suites (TLS 1.2 or 1.3) is decrypted.
+package decrypt
+
+import (
+	"archive/tar"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	v = base.V // verbose logging
+
+	decryptSessions          = stats.S.Get("decrypt_sessions")
+	decryptSessionsDecrypted = stats.S.Get("decrypt_sessions_decrypted")
+)
+
+// Record is application data decrypted from a TLS session.
+type Record struct {
+	Time       time.Time // Of the packet which completed the record.
+	FromClient bool
+	Data       []byte
+}
+
+// Session is a TLS session found in packets, with whatever of its
+// application data could be decrypted.
+type Session struct {
+	Client, Server string // Addresses and ports, like "10.0.0.1:51234".
+	Start          time.Time
+	Version        string `json:",omitempty"` // Like "TLS 1.3".
+	CipherSuite    string `json:",omitempty"`
+	Records        []Record
+	// Error, if set, says why the session, or the rest of it, couldn't be
+	// decrypted.
+	Error string `json:",omitempty"`
+}
+
+// segment is a TCP segment's payload.
+type segment struct {
+	seq  uint32
+	data []byte
+	ts   time.Time
+}
+
+// stream collects the segments one side of a TCP connection sends.
+type stream struct {
+	addr  string
+	start time.Time
+	syn   bool
+	isn   uint32
+	segs  []segment
+}
+
+// streamTime records that a stream's data up to 'end' had arrived by 'ts'.
+type streamTime struct {
+	end int
+	ts  time.Time
+}
+
+// reassemble returns the data a stream sent, in order, up to the first gap
+// in what was captured, and when each part of it arrived.  gap is set if
+// there was one.
+func (s *stream) reassemble() (data []byte, times []streamTime, gap bool) {
+	if len(s.segs) == 0 {
+		return nil, nil, false
+	}
+	start := s.isn + 1
+	if !s.syn {
+		// Without the SYN, start with the earliest data captured, allowing for
+		// sequence numbers wrapping.
+		start = s.segs[0].seq
+		for _, seg := range s.segs[1:] {
+			if int32(seg.seq-start) < 0 {
+				start = seg.seq
+			}
+		}
+	}
+	sort.SliceStable(s.segs, func(i, j int) bool { return s.segs[i].seq-start < s.segs[j].seq-start })
+	for _, seg := range s.segs {
+		off := int(seg.seq - start)
+		if off > len(data) {
+			return data, times, true
+		} else if end := off + len(seg.data); end > len(data) {
+			// Only take what's new, in case of retransmissions.
+			data = append(data, seg.data[len(data)-off:]...)
+			times = append(times, streamTime{end: end, ts: seg.ts})
+		}
+	}
+	return data, times, false
+}
+
+// timeAt returns when the data up to 'end' had arrived.
+func timeAt(times []streamTime, end int) time.Time {
+	i := sort.Search(len(times), func(i int) bool { return times[i].end >= end })
+	if i == len(times) {
+		i--
+	}
+	return times[i].ts
+}
+
+// flow collects the packets of a TCP flow.
+type flow struct {
+	network, transport gopacket.Flow
+	streams            []*stream // In order of their first packet.
+}
+
+func (f *flow) add(p *base.Packet) {
+	pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	n := pkt.NetworkLayer()
+	tcp, ok := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if n == nil || !ok {
+		return
+	}
+	src, _ := n.NetworkFlow().Endpoints()
+	addr := net.JoinHostPort(src.String(), strconv.Itoa(int(tcp.SrcPort)))
+	var s *stream
+	for _, st := range f.streams {
+		if st.addr == addr {
+			s = st
+		}
+	}
+	if s == nil {
+		s = &stream{addr: addr, start: p.Timestamp}
+		f.streams = append(f.streams, s)
+	}
+	if tcp.SYN {
+		s.syn, s.isn = true, tcp.Seq
+	}
+	if len(tcp.Payload) > 0 {
+		s.segs = append(s.segs, segment{seq: tcp.Seq, data: append([]byte{}, tcp.Payload...), ts: p.Timestamp})
+	}
+}
+
+var versionNames = map[uint16]string{
+	0x0301:       "TLS 1.0",
+	0x0302:       "TLS 1.1",
+	versionTLS12: "TLS 1.2",
+	versionTLS13: "TLS 1.3",
+}
+
+func versionName(v uint16) string {
+	if name, ok := versionNames[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// session decrypts the TLS session in a flow, returning nil if the flow
+// doesn't start with a TLS ClientHello.
+func (f *flow) session(keyLog *KeyLog) *Session {
+	var client, server *stream
+	var clientData, serverData []byte
+	var clientTimes, serverTimes []streamTime
+	var gaps []string
+	for _, s := range f.streams {
+		data, times, gap := s.reassemble()
+		if gap {
+			gaps = append(gaps, s.addr)
+		}
+		if _, ok := clientRandom(plainHandshake(splitRecords(data))); ok && client == nil {
+			client, clientData, clientTimes = s, data, times
+		} else if server == nil {
+			server, serverData, serverTimes = s, data, times
+		}
+	}
+	if client == nil {
+		return nil
+	}
+	decryptSessions.Increment()
+	sess := &Session{Client: client.addr, Start: client.start}
+	if server == nil {
+		sess.Error = "server's packets not captured"
+		return sess
+	}
+	sess.Server = server.addr
+	clientRecords, serverRecords := splitRecords(clientData), splitRecords(serverData)
+	random, _ := clientRandom(plainHandshake(clientRecords))
+	hello, ok := parseServerHello(plainHandshake(serverRecords))
+	if !ok {
+		sess.Error = "no ServerHello"
+		return sess
+	}
+	sess.Version, sess.CipherSuite = versionName(hello.version), tls.CipherSuiteName(hello.suite)
+	s, ok := suites[hello.suite]
+	switch {
+	case !ok:
+		sess.Error = fmt.Sprintf("unsupported cipher suite %s", sess.CipherSuite)
+		return sess
+	case s.tls13 != (hello.version == versionTLS13):
+		sess.Error = fmt.Sprintf("unsupported version %s", sess.Version)
+		return sess
+	}
+	var errs []error
+	if s.tls13 {
+		errs = append(errs,
+			sess.decrypt13(keyLog, s, random, labelClientHandshakeSecret, labelClientTrafficSecret, true, clientRecords, clientTimes),
+			sess.decrypt13(keyLog, s, random, labelServerHandshakeSecret, labelServerTrafficSecret, false, serverRecords, serverTimes))
+	} else if master := keyLog.secret(random, labelMasterSecret); master == nil {
+		errs = append(errs, fmt.Errorf("no key for session"))
+	} else if ck, sk, err := tls12Keys(s, master, random, hello.random); err != nil {
+		errs = append(errs, err)
+	} else {
+		errs = append(errs,
+			sess.decrypt12(ck, true, clientRecords, clientTimes),
+			sess.decrypt12(sk, false, serverRecords, serverTimes))
+	}
+	for _, err := range errs {
+		if err != nil && sess.Error == "" {
+			sess.Error = err.Error()
+		}
+	}
+	if sess.Error == "" && len(gaps) > 0 {
+		sess.Error = fmt.Sprintf("packets from %s missing, stopped there", gaps[0])
+	}
+	if len(sess.Records) > 0 {
+		decryptSessionsDecrypted.Increment()
+	}
+	sort.SliceStable(sess.Records, func(i, j int) bool { return sess.Records[i].Time.Before(sess.Records[j].Time) })
+	return sess
+}
+
+// decrypt12 decrypts the records one side of a TLS 1.2 session sent after
+// its ChangeCipherSpec.
+func (sess *Session) decrypt12(k *keys, fromClient bool, records []record, times []streamTime) error {
+	encrypted := false
+	for _, r := range records {
+		if !encrypted {
+			encrypted = r.typ == recordChangeCipherSpec
+			continue
+		}
+		typ, plaintext, err := k.open(r)
+		if err != nil {
+			return fmt.Errorf("could not decrypt record: %v", err)
+		}
+		if typ == recordApplicationData {
+			sess.Records = append(sess.Records, Record{Time: timeAt(times, r.end), FromClient: fromClient, Data: plaintext})
+		}
+	}
+	return nil
+}
+
+// decrypt13 decrypts the records one side of a TLS 1.3 session sent, first
+// with its handshake keys, then its application keys from when those work.
+// Either secret may be missing from the key log:  without the handshake
+// secret, records are skipped until the application keys work.
+func (sess *Session) decrypt13(keyLog *KeyLog, s suite, random []byte, handshakeLabel, trafficLabel string, fromClient bool, records []record, times []streamTime) error {
+	var phases []*keys
+	for _, label := range []string{handshakeLabel, trafficLabel} {
+		if secret := keyLog.secret(random, label); secret != nil {
+			k, err := tls13Keys(s, secret)
+			if err != nil {
+				return err
+			}
+			phases = append(phases, k)
+		}
+	}
+	if keyLog.secret(random, trafficLabel) == nil {
+		return fmt.Errorf("no key for session")
+	}
+	cur, opened := 0, false
+	for _, r := range records {
+		if r.typ != recordApplicationData {
+			continue // Plaintext handshake, or compatibility ChangeCipherSpec.
+		}
+		typ, plaintext, err := phases[cur].open(r)
+		for next := cur + 1; err != nil && next < len(phases); next++ {
+			if typ, plaintext, err = phases[next].open(r); err == nil {
+				cur = next
+			}
+		}
+		if err != nil {
+			if !opened {
+				continue // Still in the handshake, whose keys we don't have.
+			}
+			return fmt.Errorf("could not decrypt record: %v", err)
+		}
+		opened = true
+		switch typ {
+		case recordApplicationData:
+			sess.Records = append(sess.Records, Record{Time: timeAt(times, r.end), FromClient: fromClient, Data: plaintext})
+		case recordHandshake:
+			if len(plaintext) > 0 && plaintext[0] == handshakeKeyUpdate && cur == len(phases)-1 {
+				if phases[cur], err = phases[cur].update(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Decrypt reads the packets from 'in', which should be grouped by flow (as
+// base.GroupPacketsByFlow does), and calls 'fn' with the TLS session of each
+// TCP flow which has one, decrypted with secrets from 'keyLog' where possible.
+// Each flow's packets are held in memory until the flow ends.
+func Decrypt(in *base.PacketChan, keyLog *KeyLog, fn func(*Session) error) error {
+	defer in.Discard()
+	var cur *flow
+	finish := func() error {
+		if cur == nil {
+			return nil
+		}
+		sess := cur.session(keyLog)
+		cur = nil
+		if sess == nil {
+			return nil
+		}
+		return fn(sess)
+	}
+	for p := range in.Receive() {
+		network, transport := base.PacketFlow(p)
+		if cur == nil || network != cur.network || transport != cur.transport {
+			if err := finish(); err != nil {
+				return err
+			}
+			cur = &flow{network: network, transport: transport}
+		}
+		cur.add(p)
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	return in.Err()
+}
+
+// Writer writes decrypted sessions in an output format.
+type Writer interface {
+	Write(*Session) error
+	Close() error
+}
+
+// ndjsonRecord is a line of NDJSON output:  a decrypted record, or a session
+// which couldn't be (entirely) decrypted.
+type ndjsonRecord struct {
+	Time           time.Time
+	Client, Server string
+	Version        string `json:",omitempty"`
+	CipherSuite    string `json:",omitempty"`
+	From           string `json:",omitempty"` // "client" or "server"
+	Data           []byte `json:",omitempty"`
+	Error          string `json:",omitempty"`
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+// NewNDJSONWriter returns a Writer writing each decrypted record as a line of
+// JSON, with the session's endpoints and the record's (base64) Data.  Sessions
+// which couldn't be decrypted get a line with their Error, after any records
+// that could be.
+func NewNDJSONWriter(w io.Writer) Writer {
+	return &ndjsonWriter{enc: json.NewEncoder(w)}
+}
+
+func (w *ndjsonWriter) Write(s *Session) error {
+	line := ndjsonRecord{Client: s.Client, Server: s.Server, Version: s.Version, CipherSuite: s.CipherSuite}
+	for _, r := range s.Records {
+		line.Time, line.Data, line.From = r.Time, r.Data, "server"
+		if r.FromClient {
+			line.From = "client"
+		}
+		if err := w.enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	if s.Error != "" {
+		line.Time, line.Data, line.From, line.Error = s.Start, nil, "", s.Error
+		return w.enc.Encode(line)
+	}
+	return nil
+}
+
+func (w *ndjsonWriter) Close() error { return nil }
+
+type tarWriter struct {
+	tw       *tar.Writer
+	sessions int
+}
+
+// NewTarWriter returns a Writer writing a tar archive with the reassembled
+// plaintext each side of each session sent, in files named for the session's
+// number and endpoints, like "000001_10.0.0.1_51234_10.0.0.2_443.client".
+// Sessions with errors also get a ".error" file saying what went wrong.
+func NewTarWriter(w io.Writer) Writer {
+	return &tarWriter{tw: tar.NewWriter(w)}
+}
+
+func (w *tarWriter) Write(s *Session) error {
+	w.sessions++
+	name := fmt.Sprintf("%06d_%s_%s", w.sessions, endpointName(s.Client), endpointName(s.Server))
+	var client, server []byte
+	for _, r := range s.Records {
+		if r.FromClient {
+			client = append(client, r.Data...)
+		} else {
+			server = append(server, r.Data...)
+		}
+	}
+	files := []struct {
+		ext  string
+		data []byte
+	}{{".client", client}, {".server", server}}
+	if s.Error != "" {
+		files = append(files, struct {
+			ext  string
+			data []byte
+		}{".error", []byte(s.Error + "\n")})
+	}
+	for _, f := range files {
+		hdr := &tar.Header{Name: name + f.ext, Mode: 0644, Size: int64(len(f.data)), ModTime: s.Start, Typeflag: tar.TypeReg}
+		if err := w.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := w.tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *tarWriter) Close() error { return w.tw.Close() }
+
+// endpointName formats an address and port for a file name, with colons in
+// IPv6 addresses as dots, since some platforms don't allow them.
+func endpointName(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	b := []byte(host + "_" + port)
+	for i := range b {
+		if b[i] == ':' {
+			b[i] = '.'
+		}
+	}
+	return string(b)
+}
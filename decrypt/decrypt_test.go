@@ -0,0 +1,211 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decrypt
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mars-suite/stenographer/base"
+)
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// recorder records what's written to a connection, from either end.
+type recorder struct {
+	mu     sync.Mutex
+	writes []write
+}
+
+type write struct {
+	fromClient bool
+	data       []byte
+}
+
+type recordedConn struct {
+	net.Conn
+	r          *recorder
+	fromClient bool
+}
+
+func (c *recordedConn) Write(b []byte) (int, error) {
+	c.r.mu.Lock()
+	c.r.writes = append(c.r.writes, write{c.fromClient, append([]byte{}, b...)})
+	c.r.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// session runs a TLS session, an HTTP-like request and response, returning
+// what was sent and the client's key log.
+func session(t *testing.T, client *tls.Config) ([]write, string) {
+	var keyLog bytes.Buffer
+	client.KeyLogWriter = &keyLog
+	client.InsecureSkipVerify = true
+	server := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	r := &recorder{}
+	c, s := net.Pipe()
+	done := make(chan error)
+	go func() {
+		conn := tls.Server(&recordedConn{s, r, false}, server)
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			done <- err
+			return
+		}
+		_, err := conn.Write([]byte("response"))
+		done <- err
+	}()
+	conn := tls.Client(&recordedConn{c, r, true}, client)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.Close()
+	return r.writes, keyLog.String()
+}
+
+// tcpPackets returns the packets of a TCP connection carrying 'writes'.
+func tcpPackets(t *testing.T, writes []write) *base.PacketChan {
+	out := base.NewPacketChan(len(writes) + 2)
+	seq := map[bool]uint32{true: 1000, false: 5000}
+	ts := time.Unix(1000, 0)
+	send := func(fromClient, syn bool, data []byte) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+		tcp := &layers.TCP{SrcPort: 51234, DstPort: 443, Seq: seq[fromClient], SYN: syn, ACK: !syn, Window: 65535}
+		if !fromClient {
+			ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+			tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		}
+		tcp.SetNetworkLayerForChecksum(ip)
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 1, 2, 3, 4, 5}, DstMAC: net.HardwareAddr{6, 7, 8, 9, 10, 11}, EthernetType: layers.EthernetTypeIPv4}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp, gopacket.Payload(data)); err != nil {
+			t.Fatal(err)
+		}
+		p := &base.Packet{Data: buf.Bytes()}
+		p.Timestamp, p.CaptureLength, p.Length = ts, len(p.Data), len(p.Data)
+		out.Send(p)
+		ts = ts.Add(time.Millisecond)
+		seq[fromClient] += uint32(len(data))
+		if syn {
+			seq[fromClient]++
+		}
+	}
+	send(true, true, nil)
+	send(false, true, nil)
+	for _, w := range writes {
+		send(w.fromClient, false, w.data)
+	}
+	out.Close(nil)
+	return out
+}
+
+func decryptAll(t *testing.T, packets *base.PacketChan, keyLog string) []*Session {
+	keys, err := ParseKeyLog(strings.NewReader(keyLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []*Session
+	if err := Decrypt(packets, keys, func(s *Session) error {
+		sessions = append(sessions, s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func TestDecrypt(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"TLS 1.2", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}},
+		{"TLS 1.2", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}},
+		{"TLS 1.3", &tls.Config{MinVersion: tls.VersionTLS13}},
+	} {
+		writes, keyLog := session(t, test.config)
+		sessions := decryptAll(t, tcpPackets(t, writes), keyLog)
+		if len(sessions) != 1 {
+			t.Fatalf("%s: got %d sessions, want 1", test.name, len(sessions))
+		}
+		s := sessions[0]
+		if strings.Contains(s.CipherSuite, "CHACHA20") {
+			t.Skip("TLS 1.3 negotiated ChaCha20, which can't be decrypted")
+		}
+		if s.Version != test.name || s.Client != "10.0.0.1:51234" || s.Server != "10.0.0.2:443" || s.Error != "" {
+			t.Errorf("%s: got session %+v", test.name, s)
+		}
+		if len(s.Records) != 2 || !s.Records[0].FromClient || string(s.Records[0].Data) != "hello" || s.Records[1].FromClient || string(s.Records[1].Data) != "response" {
+			t.Errorf("%s: got records %+v", test.name, s.Records)
+		}
+		// Without keys, sessions are still listed.
+		sessions = decryptAll(t, tcpPackets(t, writes), "")
+		if len(sessions) != 1 || sessions[0].Error != "no key for session" || len(sessions[0].Records) != 0 {
+			t.Errorf("%s: without keys, got sessions %+v", test.name, sessions)
+		}
+	}
+}
+
+func TestParseKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	k, err := ParseKeyLog(strings.NewReader("# comment\n\nCLIENT_RANDOM " + random + " 0102\nEXPORTER_SECRET " + random + " 03\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Len() != 1 || !bytes.Equal(k.secret(bytes.Repeat([]byte{0xab}, 32), labelMasterSecret), []byte{1, 2}) {
+		t.Errorf("got key log %+v", k)
+	}
+	if _, err := ParseKeyLog(strings.NewReader("CLIENT_RANDOM abcd 0102\n")); err == nil {
+		t.Errorf("short client random accepted")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decrypt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Key log labels of the secrets we can decrypt with.
+const (
+	labelMasterSecret          = "CLIENT_RANDOM" // TLS 1.2 and earlier
+	labelClientHandshakeSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	labelServerHandshakeSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	labelClientTrafficSecret   = "CLIENT_TRAFFIC_SECRET_0"
+	labelServerTrafficSecret   = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// maxKeyLogLine limits the length of a key log line.  Real ones are under
+// 200 bytes.
+const maxKeyLogLine = 1024
+
+// KeyLog holds the secrets from a key log, by the client random of the
+// session they're for.
+type KeyLog struct {
+	secrets map[string]map[string][]byte // By client random, then label.
+}
+
+// ParseKeyLog reads a key log in the NSS format (as written to SSLKEYLOGFILE
+// by browsers, curl, OpenSSL, and Go's tls.Config.KeyLogWriter):  lines of a
+// label, a hex client random, and a hex secret.  Comments, blank lines, and
+// labels we have no use for are skipped.
+func ParseKeyLog(r io.Reader) (*KeyLog, error) {
+	k := &KeyLog{secrets: map[string]map[string][]byte{}}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, maxKeyLogLine), maxKeyLogLine)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch fields[0] {
+		case labelMasterSecret, labelClientHandshakeSecret, labelServerHandshakeSecret, labelClientTrafficSecret, labelServerTrafficSecret:
+		default:
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("key log line %d: want 3 fields, got %d", line, len(fields))
+		}
+		random, err := hex.DecodeString(fields[1])
+		if err != nil || len(random) != 32 {
+			return nil, fmt.Errorf("key log line %d: invalid client random", line)
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("key log line %d: invalid secret", line)
+		}
+		if k.secrets[string(random)] == nil {
+			k.secrets[string(random)] = map[string][]byte{}
+		}
+		k.secrets[string(random)][fields[0]] = secret
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read key log: %v", err)
+	}
+	return k, nil
+}
+
+// Len returns how many sessions the key log has secrets for.
+func (k *KeyLog) Len() int { return len(k.secrets) }
+
+// secret returns the secret with the given label for the session with the
+// given client random, or nil if there isn't one.
+func (k *KeyLog) secret(random []byte, label string) []byte {
+	return k.secrets[string(random)][label]
+}
@@ -0,0 +1,291 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+)
+
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+	handshakeKeyUpdate   = 24
+
+	extensionSupportedVersions = 0x002b
+
+	versionTLS12 = 0x0303
+	versionTLS13 = 0x0304
+
+	recordHeaderLen = 5
+	// maxRecordLen is the longest a TLS record's body may be:  16K of
+	// plaintext, plus room for compression and encryption overhead.
+	maxRecordLen = 16384 + 2048
+
+	gcmTagLen           = 16
+	gcmExplicitNonceLen = 8 // TLS 1.2 only
+)
+
+// record is a TLS record, and the offset in its direction's stream it ends
+// at.
+type record struct {
+	typ     byte
+	version uint16
+	body    []byte
+	end     int
+}
+
+// splitRecords splits a reassembled TCP stream into TLS records, stopping at
+// the first incomplete or invalid one.
+func splitRecords(stream []byte) (out []record) {
+	for off := 0; off+recordHeaderLen <= len(stream); {
+		typ := stream[off]
+		n := int(binary.BigEndian.Uint16(stream[off+3:]))
+		end := off + recordHeaderLen + n
+		if typ < recordChangeCipherSpec || typ > recordApplicationData || stream[off+1] != 3 || n > maxRecordLen || end > len(stream) {
+			break
+		}
+		out = append(out, record{typ: typ, version: binary.BigEndian.Uint16(stream[off+1:]), body: stream[off+recordHeaderLen : end], end: end})
+		off = end
+	}
+	return out
+}
+
+// plainHandshake returns the handshake messages sent before encryption
+// starts, which is at the first ChangeCipherSpec (TLS 1.2) or application
+// data record (TLS 1.3).  Messages may span records, so they're returned
+// concatenated.
+func plainHandshake(records []record) []byte {
+	var out []byte
+	for _, r := range records {
+		if r.typ != recordHandshake {
+			break
+		}
+		out = append(out, r.body...)
+	}
+	return out
+}
+
+// handshakeMessage returns the type and body of the first handshake message
+// in 'data', and the data after it.
+func handshakeMessage(data []byte) (typ byte, body, rest []byte, ok bool) {
+	if len(data) < 4 {
+		return 0, nil, nil, false
+	}
+	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if len(data) < 4+n {
+		return 0, nil, nil, false
+	}
+	return data[0], data[4 : 4+n], data[4+n:], true
+}
+
+// clientRandom returns the random of a ClientHello, the first handshake
+// message a client sends.
+func clientRandom(handshake []byte) ([]byte, bool) {
+	typ, body, _, ok := handshakeMessage(handshake)
+	if !ok || typ != handshakeClientHello || len(body) < 2+32 {
+		return nil, false
+	}
+	return body[2 : 2+32], true
+}
+
+// serverHello is what we need from a ServerHello.
+type serverHello struct {
+	random  []byte
+	version uint16 // Negotiated, from supported_versions for TLS 1.3.
+	suite   uint16
+}
+
+func parseServerHello(handshake []byte) (h serverHello, ok bool) {
+	typ, body, _, ok := handshakeMessage(handshake)
+	if !ok || typ != handshakeServerHello || len(body) < 2+32+1 {
+		return h, false
+	}
+	h.version = binary.BigEndian.Uint16(body)
+	h.random = body[2 : 2+32]
+	body = body[2+32:]
+	sessionID := int(body[0])
+	if len(body) < 1+sessionID+3 {
+		return h, false
+	}
+	h.suite = binary.BigEndian.Uint16(body[1+sessionID:])
+	exts := body[1+sessionID+3:]
+	if len(exts) < 2 {
+		return h, true // No extensions.
+	}
+	exts = exts[2:]
+	for len(exts) >= 4 {
+		typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			break
+		}
+		if typ == extensionSupportedVersions && n == 2 {
+			h.version = binary.BigEndian.Uint16(exts[4:])
+		}
+		exts = exts[4+n:]
+	}
+	return h, true
+}
+
+// suite describes a cipher suite we can decrypt:  the AES-GCM ones, since
+// every TLS library supports them and the standard library can decrypt them.
+type suite struct {
+	keyLen int
+	hash   func() hash.Hash
+	tls13  bool
+}
+
+var suites = map[uint16]suite{
+	0x1301: {16, sha256.New, true},     // TLS_AES_128_GCM_SHA256
+	0x1302: {32, sha512.New384, true},  // TLS_AES_256_GCM_SHA384
+	0x009C: {16, sha256.New, false},    // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009D: {32, sha512.New384, false}, // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0x009E: {16, sha256.New, false},    // TLS_DHE_RSA_WITH_AES_128_GCM_SHA256
+	0x009F: {32, sha512.New384, false}, // TLS_DHE_RSA_WITH_AES_256_GCM_SHA384
+	0xC02B: {16, sha256.New, false},    // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xC02C: {32, sha512.New384, false}, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xC02F: {16, sha256.New, false},    // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xC030: {32, sha512.New384, false}, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+}
+
+// prf12 is the TLS 1.2 pseudorandom function (RFC 5246 section 5).
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	var out []byte
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+	return out[:n]
+}
+
+// expandLabel is HKDF-Expand-Label (RFC 8446 section 7.1) with an empty
+// context.
+func expandLabel(h func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(n >> 8), byte(n), byte(len(label))}
+	info = append(append(info, label...), 0)
+	mac := hmac.New(h, secret)
+	var out, t []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
+
+// keys decrypts the records one side of a session sends.
+type keys struct {
+	aead  cipher.AEAD
+	iv    []byte
+	seq   uint64
+	suite suite
+	// secret is the TLS 1.3 traffic secret the keys came from, for following
+	// key updates.
+	secret []byte
+}
+
+func newKeys(s suite, key, iv, secret []byte) (*keys, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &keys{aead: aead, iv: iv, suite: s, secret: secret}, nil
+}
+
+// tls12Keys derives the client's and server's keys from a TLS 1.2 master
+// secret (RFC 5246 section 6.3, RFC 5288 section 3).
+func tls12Keys(s suite, master, clientRandom, serverRandom []byte) (client, server *keys, err error) {
+	k := s.keyLen
+	block := prf12(s.hash, master, "key expansion", append(append([]byte{}, serverRandom...), clientRandom...), 2*k+8)
+	if client, err = newKeys(s, block[:k], block[2*k:2*k+4], nil); err != nil {
+		return nil, nil, err
+	}
+	server, err = newKeys(s, block[k:2*k], block[2*k+4:2*k+8], nil)
+	return client, server, err
+}
+
+// tls13Keys derives keys from a TLS 1.3 traffic secret (RFC 8446 section
+// 7.3).
+func tls13Keys(s suite, secret []byte) (*keys, error) {
+	return newKeys(s, expandLabel(s.hash, secret, "key", s.keyLen), expandLabel(s.hash, secret, "iv", 12), secret)
+}
+
+// update returns the keys following a TLS 1.3 KeyUpdate.
+func (k *keys) update() (*keys, error) {
+	return tls13Keys(k.suite, expandLabel(k.suite.hash, k.secret, "traffic upd", k.suite.hash().Size()))
+}
+
+// open decrypts a record, returning its real content type and plaintext.
+func (k *keys) open(r record) (typ byte, plaintext []byte, err error) {
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], k.seq)
+	if k.suite.tls13 {
+		nonce := append([]byte{}, k.iv...)
+		for i := range seq {
+			nonce[len(nonce)-8+i] ^= seq[i]
+		}
+		aad := []byte{r.typ, byte(r.version >> 8), byte(r.version), byte(len(r.body) >> 8), byte(len(r.body))}
+		if plaintext, err = k.aead.Open(nil, nonce, r.body, aad); err != nil {
+			return 0, nil, err
+		}
+		// The real content type follows the content, then any padding.
+		plaintext = bytes.TrimRight(plaintext, "\x00")
+		if len(plaintext) == 0 {
+			return 0, nil, fmt.Errorf("record has no content type")
+		}
+		k.seq++
+		return plaintext[len(plaintext)-1], plaintext[:len(plaintext)-1], nil
+	}
+	if len(r.body) < gcmExplicitNonceLen+gcmTagLen {
+		return 0, nil, fmt.Errorf("record too short")
+	}
+	nonce := append(append([]byte{}, k.iv...), r.body[:gcmExplicitNonceLen]...)
+	n := len(r.body) - gcmExplicitNonceLen - gcmTagLen
+	aad := append(seq[:], r.typ, byte(r.version>>8), byte(r.version), byte(n>>8), byte(n))
+	if plaintext, err = k.aead.Open(nil, nonce, r.body[gcmExplicitNonceLen:], aad); err != nil {
+		return 0, nil, err
+	}
+	k.seq++
+	return r.typ, plaintext, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/query"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	canaryRuns     = stats.S.Get("canary_runs")
+	canaryFailures = stats.S.Get("canary_failures")
+	canaryFailing  = stats.S.Get("canary_failing")
+)
+
+// canary periodically runs a query over recent traffic which should always
+// find packets, catching capture or indexing which has silently stopped:  an
+// interface which went quiet, or files which are written but can't be read.
+type canary struct {
+	query            string
+	interval, window time.Duration
+	failing          bool // Whether the last run found nothing.
+	parser           *query.Parser
+}
+
+func newCanary(c config.CanaryConfig, parser *query.Parser) (*canary, error) {
+	interval, window, err := c.Durations()
+	if err != nil {
+		return nil, err
+	}
+	k := &canary{query: c.Query, interval: interval, window: window, parser: parser}
+	if _, err := k.parse(time.Now()); err != nil {
+		return nil, fmt.Errorf("invalid query %q: %v", c.Query, err)
+	}
+	return k, nil
+}
+
+// parse returns the canary's query, limited to the window before 'now'.
+func (k *canary) parse(now time.Time) (query.Query, error) {
+	since := now.Add(-k.window).UTC().Format(time.RFC3339)
+	return k.parser.Parse(fmt.Sprintf("(%s) and after %s", k.query, since))
+}
+
+// checkCanary runs the canary query, raising an error event if it finds no
+// packets.  Until stenotype has been running for a whole window, an empty
+// result is expected, so it's not checked.
+func (d *Env) checkCanary() {
+	k := d.canary
+	if time.Since(d.started) < k.window {
+		return
+	}
+	canaryRuns.Increment()
+	q, err := k.parse(time.Now())
+	if err != nil {
+		// Only host names can fail once the query's parsed at startup.
+		log.Printf("Canary query %q failed to parse: %v", k.query, err)
+		return
+	}
+	ctx := base.NewContext(k.interval)
+	defer ctx.Cancel()
+	// The canary checks capture, so it isn't subject to the embargo.
+	packets := d.lookup(ctx, q)
+	_, found := <-packets.Receive()
+	ctx.Cancel()
+	packets.Discard()
+	if !found {
+		err = packets.Err()
+	}
+	switch {
+	case found:
+		if k.failing {
+			log.Printf("Canary query %q finds packets again", k.query)
+		}
+		k.failing = false
+		canaryFailing.Set(0)
+		return
+	case err != nil:
+		err = fmt.Errorf("failed: %v", err)
+	default:
+		err = fmt.Errorf("found no packets in the last %v", k.window)
+	}
+	canaryFailures.Increment()
+	canaryFailing.Set(1)
+	k.failing = true
+	log.Printf("Canary query %q %v", k.query, err)
+	events.H.Add(events.Error, "Canary query %q %v", k.query, err)
+}
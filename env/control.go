@@ -0,0 +1,324 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/httputil"
+	"github.com/mars-suite/stenographer/thread"
+)
+
+// activeQuery is a query currently being served.
+type activeQuery struct {
+	ID      string
+	Query   string
+	Remote  string
+	Started time.Time
+	cancel  func()
+}
+
+// activeQueries tracks running queries so they can be listed and canceled.
+// The zero value is ready to use.
+type activeQueries struct {
+	mu sync.Mutex
+	m  map[string]*activeQuery
+}
+
+// add starts tracking a query, returning its ID.  cancel is called if the
+// query is canceled.
+func (a *activeQueries) add(query, remote string, cancel func()) string {
+	q := &activeQuery{
+		ID:      uuid.New().String(),
+		Query:   query,
+		Remote:  remote,
+		Started: time.Now(),
+		cancel:  cancel,
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.m == nil {
+		a.m = map[string]*activeQuery{}
+	}
+	a.m[q.ID] = q
+	return q.ID
+}
+
+func (a *activeQueries) remove(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.m, id)
+}
+
+// list returns all running queries, oldest first.
+func (a *activeQueries) list() (out []activeQuery) {
+	a.mu.Lock()
+	for _, q := range a.m {
+		out = append(out, *q)
+	}
+	a.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Started.Before(out[j].Started) })
+	return out
+}
+
+// cancel cancels the query with the given ID, returning false if there's no
+// such query.
+func (a *activeQueries) cancel(id string) bool {
+	a.mu.Lock()
+	q := a.m[id]
+	a.mu.Unlock()
+	if q == nil {
+		return false
+	}
+	q.cancel()
+	return true
+}
+
+// Status summarizes the state of a running stenographer.
+type Status struct {
+	Version  string
+	SensorID string
+	Started  time.Time
+	Threads  []thread.Status
+	Queries  int
+	// TimeZone is the sensor's local time zone, which query times without a
+	// UTC offset are read in, and HardwareClock what its packet timestamps are
+	// measured in before being converted to UTC.
+	TimeZone      string
+	HardwareClock string
+	// DroppedIndexKeyTypes are the stenotype flags of optional key types no
+	// longer indexed, to keep indexes within Config.IndexBudgetPercent.
+	DroppedIndexKeyTypes []string `json:",omitempty"`
+}
+
+// VerifyResult reports on verifying all indexes.  Failed files are quarantined
+// the next time their thread syncs with disk.
+type VerifyResult struct {
+	Checked int
+	Failed  []VerifyFailure
+}
+
+// VerifyFailure is a single index which failed verification.
+type VerifyFailure struct {
+	Thread int
+	File   string
+	Error  string
+}
+
+// TierResult reports on tiering a time range, see Thread.Tier.
+type TierResult struct {
+	Files []thread.TieredFile
+}
+
+// exportControlHandlers exports handlers used by stenoctl to control the
+// running server.
+func (e *Env) exportControlHandlers(mux *http.ServeMux) {
+	mux.Handle("/status", acceptingJSON(func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		s := Status{
+			Version:              base.Version,
+			SensorID:             e.sensor,
+			Started:              e.started,
+			Queries:              len(e.queries.list()),
+			TimeZone:             e.parser.Location().String(),
+			HardwareClock:        e.hardwareClock(),
+			DroppedIndexKeyTypes: e.budget.droppedKeyTypes(),
+		}
+		for _, t := range e.threads {
+			s.Threads = append(s.Threads, t.Status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	}))
+	mux.Handle("/queries", acceptingJSON(func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(e.queries.list())
+		case "DELETE":
+			id := r.URL.Query().Get("id")
+			if !e.queries.cancel(id) {
+				http.Error(w, fmt.Sprintf("no running query %q", id), http.StatusNotFound)
+				return
+			}
+			log.Printf("Canceled query %v", id)
+		default:
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		if r.Method != "POST" {
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := e.cert.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Reloaded server certificate")
+	})
+	mux.Handle("/verify", acceptingJSON(func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		if r.Method != "POST" {
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := httputil.Context(w, r, time.Hour)
+		defer ctx.Cancel()
+		var result VerifyResult
+		for _, t := range e.threads {
+			checked, failed, err := t.VerifyIndexes(ctx)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result.Checked += checked
+			for file, err := range failed {
+				result.Failed = append(result.Failed, VerifyFailure{Thread: t.ID(), File: file, Error: err.Error()})
+				events.H.Add(events.Error, "Thread %v index for %q failed verification: %v", t.ID(), file, err)
+			}
+		}
+		sort.Slice(result.Failed, func(i, j int) bool {
+			if result.Failed[i].Thread != result.Failed[j].Thread {
+				return result.Failed[i].Thread < result.Failed[j].Thread
+			}
+			return result.Failed[i].File < result.Failed[j].File
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}))
+	mux.Handle("/tier", acceptingJSON(e.handleTier))
+}
+
+// handleTier exports every file with packets between the 'start' and 'end'
+// URL parameters (RFC3339 times, either of which may be left out for an open
+// range, but not both) now, rather than once the disk cleaner gets to them.
+// With 'evict=true', files are deleted locally once they're exported.
+func (e *Env) handleTier(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	if r.Method != "POST" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	var times [2]time.Time
+	for i, param := range []string{"start", "end"} {
+		if v := r.URL.Query().Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q", param, v), http.StatusBadRequest)
+				return
+			}
+			times[i] = t.UTC()
+		}
+	}
+	if times[0].IsZero() && times[1].IsZero() {
+		http.Error(w, "missing start or end", http.StatusBadRequest)
+		return
+	}
+	evict := false
+	if v := r.URL.Query().Get("evict"); v != "" {
+		var err error
+		if evict, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid evict %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(e.conf.Exporters) == 0 {
+		http.Error(w, "no exporters configured", http.StatusConflict)
+		return
+	}
+	ctx := httputil.Context(w, r, 6*time.Hour)
+	defer ctx.Cancel()
+	log.Printf("Tiering files from %v to %v (evict: %v)", times[0], times[1], evict)
+	var result TierResult
+	for _, t := range e.threads {
+		files, err := t.Tier(ctx, times[0], times[1], evict)
+		result.Files = append(result.Files, files...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// serveVerbosity returns the current verbose logging level for GET requests,
+// and changes it to the 'level' URL parameter for POST requests.  With a
+// 'module' URL parameter, these apply to just that module, and DELETE returns
+// the module to the global level.  A GET without a module also lists all
+// per-module levels, one "<module> <level>" per line.
+func serveVerbosity(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+	module := r.URL.Query().Get("module")
+	switch r.Method {
+	case "GET":
+	case "POST":
+		level, err := strconv.Atoi(r.URL.Query().Get("level"))
+		if err != nil {
+			http.Error(w, "invalid level", http.StatusBadRequest)
+			return
+		}
+		if module != "" {
+			base.SetModuleVerbosity(module, level)
+			log.Printf("Verbose logging level of %q set to %d", module, level)
+		} else {
+			base.SetVerbosity(level)
+			log.Printf("Verbose logging level set to %d", level)
+		}
+	case "DELETE":
+		if module == "" {
+			http.Error(w, "missing module", http.StatusBadRequest)
+			return
+		}
+		base.ClearModuleVerbosity(module)
+		log.Printf("Verbose logging level of %q reset", module)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	if module != "" {
+		fmt.Fprintln(w, base.ModuleVerbosity(module))
+		return
+	}
+	fmt.Fprintln(w, base.Verbosity())
+	modules := base.ModuleVerbosities()
+	names := make([]string, 0, len(modules))
+	for m := range modules {
+		names = append(names, m)
+	}
+	sort.Strings(names)
+	for _, m := range names {
+		fmt.Fprintf(w, "%s %d\n", m, modules[m])
+	}
+}
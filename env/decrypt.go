@@ -0,0 +1,163 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mars-suite/stenographer/audit"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/decrypt"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/httputil"
+)
+
+// maxKeyLogSize limits the size of a key log uploaded to /decrypt.
+const maxKeyLogSize = 16 << 20
+
+// decryptFormats are the output formats of /decrypt and their media types,
+// as for queryFormats.
+var decryptFormats = []struct{ name, mediaType string }{
+	{"ndjson", "application/x-ndjson"},
+	{"tar", "application/x-tar"},
+}
+
+// handleDecrypt decrypts the TLS sessions in a query's results with the
+// secrets in a key log, returning their plaintext application data.  The
+// query is given by the 'q' URL parameter, and the key log (in the
+// SSLKEYLOGFILE format) is POSTed as the body.  It's only used for this
+// request, and never stored.  Output is NDJSON (one line per decrypted
+// record) or a tar archive of each session's reassembled streams, chosen as
+// for /query.  Quotas and auditing work as for /query; clients whose results
+// are always transformed can't use it (see Env.untransformed).
+func (e *Env) handleDecrypt(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "key log must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	vals := r.URL.Query()
+	var format, contentType string
+	if name := vals.Get("format"); name != "" {
+		for _, f := range decryptFormats {
+			if f.name == name {
+				format, contentType = f.name, f.mediaType
+			}
+		}
+		if format == "" {
+			http.Error(w, fmt.Sprintf("unsupported format %q; supported formats: ndjson, tar", name), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var offers []string
+		for _, f := range decryptFormats {
+			offers = append(offers, f.mediaType)
+		}
+		var err error
+		if contentType, err = httputil.Negotiate(r, offers...); err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		for _, f := range decryptFormats {
+			if f.mediaType == contentType {
+				format = f.name
+			}
+		}
+	}
+	queryString := vals.Get("q")
+	q, err := e.parser.Parse(queryString)
+	if err != nil {
+		http.Error(w, "could not parse query", http.StatusBadRequest)
+		return
+	}
+	keys, err := decrypt.ParseKeyLog(io.LimitReader(r.Body, maxKeyLogSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if keys.Len() == 0 {
+		http.Error(w, "no usable secrets in key log", http.StatusBadRequest)
+		return
+	}
+	client := clientIdentity(r)
+	if !e.checkQueryRange(w, q, client) {
+		return
+	}
+	if e.quota != nil {
+		if _, ok := e.startQuota(w, client); !ok {
+			return
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	defer e.queries.remove(e.queries.add(queryString, r.RemoteAddr, ctx.Cancel))
+	packets := base.GroupPacketsByFlow(ctx, e.Lookup(ctx, q))
+	var body io.Writer = w
+	if e.quota != nil {
+		counter := &byteCounter{w: w}
+		body = counter
+		defer func() { e.quota.Charge(client, counter.n) }()
+	}
+	var manifest *audit.Manifest
+	if e.audit != nil {
+		w.Header().Add("Trailer", auditTrailer)
+		manifest = audit.NewManifest(body)
+		body = manifest
+	}
+	w.Header().Add("Trailer", errorTrailer)
+	w.Header().Set("Content-Type", contentType)
+	out := decrypt.NewNDJSONWriter(body)
+	if format == "tar" {
+		out = decrypt.NewTarWriter(body)
+	}
+	sessions := 0
+	err = decrypt.Decrypt(packets, keys, func(s *decrypt.Session) error {
+		sessions++
+		return out.Write(s)
+	})
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		log.Printf("Decrypting %q failed: %v", q, err)
+		w.Header().Set(errorTrailer, err.Error())
+	}
+	v(1, "Decrypted %d TLS sessions matching %q", sessions, q)
+	if manifest != nil {
+		entry := audit.Entry{
+			Remote: r.RemoteAddr,
+			Client: client,
+			Query:  "/decrypt?" + r.URL.RawQuery,
+			Format: format,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		manifest.Fill(&entry)
+		seq, err := e.audit.Add(entry)
+		if err != nil {
+			log.Printf("Decryption of %q could not be audited: %v", q, err)
+			events.H.Add(events.Error, "Decryption of %q could not be audited: %v", q, err)
+			return
+		}
+		w.Header().Set(auditTrailer, strconv.FormatUint(seq, 10))
+	}
+}
@@ -23,28 +23,53 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/certs"
-	"github.com/google/stenographer/config"
-	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/httputil"
-	"github.com/google/stenographer/query"
-	"github.com/google/stenographer/stats"
-	"github.com/google/stenographer/thread"
+	"github.com/mars-suite/stenographer/archive"
+	"github.com/mars-suite/stenographer/audit"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/certs"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/export"
+	"github.com/mars-suite/stenographer/fanout"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/flowship"
+	"github.com/mars-suite/stenographer/httputil"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/labels"
+	"github.com/mars-suite/stenographer/profiling"
+	"github.com/mars-suite/stenographer/query"
+	"github.com/mars-suite/stenographer/quota"
+	"github.com/mars-suite/stenographer/stats"
+	"github.com/mars-suite/stenographer/thread"
+	"github.com/mars-suite/stenographer/tracing"
+	"github.com/mars-suite/stenographer/workload"
 	"golang.org/x/net/context"
+	"golang.org/x/net/http2"
 )
 
 var (
 	v               = base.V // verbose logging
 	rmHiddenFiles   = stats.S.Get("removed_hidden_files")
 	rmMismatchFiles = stats.S.Get("removed_mismatched_files")
+
+	rateLimitedQueries  = stats.S.Get("rate_limited_queries")
+	rangeLimitedQueries = stats.S.Get("range_limited_queries")
+	queryStalls         = stats.S.Get("query_stalls")
+	queryStallAborts    = stats.S.Get("query_stall_aborts")
 )
 
 const (
@@ -65,20 +90,110 @@ func (e *Env) Serve() error {
 	if err != nil {
 		return fmt.Errorf("cannot verify client cert: %v", err)
 	}
+	if err := e.conf.TLS.Apply(tlsConfig); err != nil {
+		return err
+	}
+	var ocspFile string
+	if e.conf.TLS != nil {
+		ocspFile = e.conf.TLS.OCSPStaple
+	}
+	e.cert, err = certs.NewServerCertificate(
+		filepath.Join(e.conf.CertPath, serverCertFilename),
+		filepath.Join(e.conf.CertPath, serverKeyFilename),
+		ocspFile)
+	if err != nil {
+		return fmt.Errorf("cannot load server cert: %v", err)
+	}
+	// Serving through GetCertificate lets the certificate be reloaded.
+	tlsConfig.GetCertificate = e.cert.GetCertificate
 	server := &http.Server{
 		Addr:      fmt.Sprintf("%s:%d", e.conf.Host, e.conf.Port),
 		TLSConfig: tlsConfig,
 	}
+	// Clients firing many small queries can multiplex them over one HTTP/2
+	// connection, each with its own flow control, rather than paying for a
+	// TLS handshake per query.
+	if err := http2.ConfigureServer(server, &http2.Server{
+		MaxConcurrentStreams: uint32(e.conf.MaxConcurrentStreams),
+	}); err != nil {
+		return fmt.Errorf("cannot serve HTTP/2: %v", err)
+	}
+	// /query negotiates its own output format; everything else only responds
+	// in one.
 	http.HandleFunc("/query", e.handleQuery)
-	http.Handle("/debug/stats", stats.S)
-	return server.ListenAndServeTLS(
-		filepath.Join(e.conf.CertPath, serverCertFilename),
-		filepath.Join(e.conf.CertPath, serverKeyFilename))
+	http.Handle("/estimate", acceptingJSON(e.handleEstimate))
+	http.Handle("/histogram", acceptingJSON(e.handleHistogram))
+	http.HandleFunc("/packets", e.handlePackets)
+	http.Handle("/decrypt", e.untransformed(http.HandlerFunc(e.handleDecrypt)))
+	http.Handle("/seen", acceptingJSON(e.handleSeen))
+	http.Handle("/drops", acceptingJSON(e.handleDrops))
+	http.Handle("/sets", acceptingJSON(e.handleSets))
+	http.Handle("/debug/stats", httputil.Accepting(stats.S, httputil.Text))
+	http.Handle("/events", httputil.Accepting(events.H, httputil.JSON))
+	if e.labels != nil {
+		http.Handle("/labels", httputil.Accepting(e.labels, httputil.JSON))
+	}
+	e.exportControlHandlers(http.DefaultServeMux)
+	return server.ListenAndServeTLS("", "")
+}
+
+// queryFormats are the output formats of /query and their media types, in
+// order of preference when negotiating one from the Accept header.  The first
+// is the default.  PCAP is also offered as application/octet-stream, which is
+// what it was served as before formats were negotiated.
+var queryFormats = []struct{ name, mediaType string }{
+	{"pcap", "application/vnd.tcpdump.pcap"},
+	{"pcapng", "application/x-pcapng"},
+	{"text", httputil.Text},
+	{"ndjson", "application/x-ndjson"},
+	{"parquet", "application/vnd.apache.parquet"},
+	{"tar", "application/x-tar"},
+	{"pcap", "application/octet-stream"},
+}
+
+// queryFormat returns the output format of a query, and the media type to
+// serve it as.  A 'format' URL parameter naming one takes precedence over the
+// Accept header.
+func queryFormat(r *http.Request) (format, mediaType string, _ error) {
+	var names, offers []string
+	for _, f := range queryFormats {
+		names = append(names, f.name)
+		offers = append(offers, f.mediaType)
+	}
+	if name := r.URL.Query().Get("format"); name != "" {
+		for _, f := range queryFormats {
+			if f.name == name {
+				return f.name, f.mediaType, nil
+			}
+		}
+		return "", "", fmt.Errorf("unsupported format %q; supported formats: %s", name, strings.Join(names[:len(names)-1], ", "))
+	}
+	mediaType, err := httputil.Negotiate(r, offers...)
+	if err != nil {
+		return "", "", err
+	}
+	for _, f := range queryFormats {
+		if f.mediaType == mediaType {
+			format = f.name
+		}
+	}
+	return format, mediaType, nil
+}
+
+// acceptingJSON wraps a handler which responds with JSON, rejecting requests
+// which don't accept it.
+func acceptingJSON(h http.HandlerFunc) http.Handler {
+	return httputil.Accepting(h, httputil.JSON)
 }
 
 func (e *Env) handleQuery(w http.ResponseWriter, r *http.Request) {
 	w = httputil.Log(w, r, true)
 	defer log.Print(w)
+	span := e.tracer.StartRequest(r, "query")
+	defer span.End()
+	if span != nil {
+		w.Header().Set(traceHeader, span.TraceID())
+	}
 
 	limit, err := base.LimitFromHeaders(r.Header)
 	if err != nil {
@@ -86,28 +201,741 @@ func (e *Env) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	format, contentType, err := queryFormat(r)
+	if err != nil {
+		status := http.StatusNotAcceptable
+		if r.URL.Query().Get("format") != "" {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	opts, err := parseQueryOptions(r.URL.Query(), format, contentType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	queryBytes, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "could not read request body", http.StatusBadRequest)
 		return
 	}
-	q, err := query.NewQuery(string(queryBytes))
+	parse := span.StartChild("parse")
+	q, err := e.parser.Parse(string(queryBytes))
+	parse.SetError(err)
+	parse.End()
+	if err != nil {
+		span.SetError(err)
+		http.Error(w, "could not parse query", http.StatusBadRequest)
+		return
+	}
+	span.SetAttribute("steno.query", q.String())
+	if opts.resume != nil {
+		// Don't bother reading files entirely before the cursor.
+		if q, err = e.parser.Parse(fmt.Sprintf("(%s) and after %s", queryBytes, opts.resume.Time.UTC().Format(time.RFC3339Nano))); err != nil {
+			http.Error(w, "could not parse resumed query", http.StatusBadRequest)
+			return
+		}
+	}
+	client := clientIdentity(r)
+	span.SetAttribute("steno.client", client)
+	if !e.checkQueryRange(w, q, client) {
+		return
+	}
+	transformNames, transform, err := e.queryTransforms(opts.transforms, client)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if transform != nil {
+		w.Header().Set(transformsHeader, strings.Join(transformNames, ","))
+	}
+	span.SetAttribute("steno.format", format)
+	if e.quota != nil {
+		status, ok := e.startQuota(w, client)
+		if !ok {
+			return
+		}
+		if status.BytesLimit > 0 && (limit.Bytes == 0 || limit.Bytes > status.BytesRemaining) {
+			// Stop once the client's out of bytes for today.
+			limit.Bytes = status.BytesRemaining
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	queryID := e.queries.add(string(queryBytes), r.RemoteAddr, ctx.Cancel)
+	defer e.queries.remove(queryID)
+	var sinks *fanout.Fanout
+	if len(opts.sinks) > 0 {
+		if sinks, err = fanout.New(e.conf.QuerySinks, opts.sinks, e.client, queryID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var lookupCtx context.Context = tracing.WithSpan(ctx, span)
+	if e.conf.QueryMemoryLimitMB > 0 {
+		budget := base.NewMemoryBudget(int64(e.conf.QueryMemoryLimitMB) << 20)
+		lookupCtx = base.WithMemoryBudget(lookupCtx, budget)
+		defer func() { v(1, "Query %q peak memory use: %d bytes", q, budget.Peak()) }()
+	}
+	// Errors after we've started writing packets can only be reported in
+	// trailers, as can files we had to skip.
+	w.Header().Add("Trailer", errorTrailer)
+	w.Header().Add("Trailer", warningsTrailer)
+	w.Header().Add("Trailer", dropsTrailer)
+	defer e.annotateDrops(ctx, w, q)
+	warnings := &base.QueryWarnings{}
+	lookupCtx = base.WithQueryWarnings(lookupCtx, warnings)
+	defer func() {
+		if list := warnings.List(); len(list) > 0 {
+			log.Printf("Query %q skipped files: %s", q, setJSONTrailer(w, warningsTrailer, list))
+		}
+	}()
+	lookupCtx, cancelOpts := opts.withContext(lookupCtx, w)
+	defer cancelOpts()
+	defer opts.setTrailers(w, q)
+	lookupCtx, cancelLookup := context.WithCancel(lookupCtx)
+	defer cancelLookup()
+	var packets *base.PacketChan
+	if len(opts.files) > 0 {
+		if packets, err = e.LookupFiles(lookupCtx, q, opts.files); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		packets = e.Lookup(lookupCtx, q)
+	}
+	packets = opts.process(lookupCtx, packets, transform)
+	if stallTimeout, _ := e.conf.QueryStallTimeoutDuration(); stallTimeout > 0 { // Checked by Validate.
+		stalled := time.Duration(0)
+		packets = base.WatchStalls(packets, stallTimeout, func() error {
+			stalled += stallTimeout
+			queryStalls.Increment()
+			log.Printf("Query %q stalled:  %v read no results for %v", q, r.RemoteAddr, stalled)
+			if !e.conf.AbortStalledQueries {
+				return nil
+			}
+			queryStallAborts.Increment()
+			cancelLookup()
+			return &base.StallError{Timeout: stallTimeout}
+		})
+	}
+	if opts.hash != nil {
+		w.Header().Add("Trailer", hashTrailer)
+		base.HashWritten(packets, opts.hash)
+	}
+	if sinks != nil {
+		w.Header().Add("Trailer", sinksTrailer)
+		sinks.Copy(packets)
+	}
+	// Only plain queries are recorded:  resumed, per-file, partial, and
+	// flow_head ones can't be replayed from the query alone.
+	var recorded *workload.Entry
+	if e.workload != nil && opts.replayable() {
+		recorded = &workload.Entry{Time: time.Now(), Query: string(queryBytes)}
+		base.CopyWritten(packets, func(*base.Packet) { recorded.Packets++ })
+	}
+	var sideChannel *export.SideChannel
+	if opts.metadata != "" {
+		if sideChannel, err = export.NewSideChannel(packets, e.sensor); err != nil {
+			http.Error(w, fmt.Sprintf("could not record packet metadata: %v", err), http.StatusInternalServerError)
+			return
+		}
+		defer sideChannel.Close()
+	}
+	var body io.Writer = w
+	if e.quota != nil {
+		counter := &byteCounter{w: w}
+		body = counter
+		defer func() { e.quota.Charge(client, counter.n) }()
+	}
+	var manifest *audit.Manifest
+	if e.audit != nil {
+		w.Header().Add("Trailer", auditTrailer)
+		manifest = audit.NewManifest(body)
+		body = manifest
+	}
+	stream := span.StartChild("stream")
+	switch {
+	case sideChannel != nil:
+		err = writeMultipart(w.Header(), packets, body, opts.contentType, limit, sideChannel)
+	case opts.chunked():
+		w.Header().Set("Content-Type", opts.contentType)
+		err = base.PacketsToChunkTar(packets, body, limit, opts.chunkBytes, opts.chunkDuration)
+	default:
+		w.Header().Set("Content-Type", opts.contentType)
+		err = e.writePackets(packets, body, opts.format, limit, string(queryBytes))
+	}
+	stream.SetError(err)
+	stream.End()
+	if opts.partial != nil {
+		finished := err == nil
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			// We hit our partial results deadline, which isn't an error.
+			err = nil
+		}
+		setJSONTrailer(w, partialTrailer, opts.partial.Summary(finished))
+	}
+	if sinks != nil {
+		setJSONTrailer(w, sinksTrailer, sinks.Close(err))
+	}
+	if err != nil {
+		log.Printf("Query %q failed: %v", q, err)
+		w.Header().Set(errorTrailer, err.Error())
+		span.SetError(err)
+	}
+	if recorded != nil {
+		recorded.Duration = time.Since(recorded.Time)
+		if err != nil {
+			recorded.Error = err.Error()
+		}
+		if err := e.workload.Record(*recorded); err != nil {
+			log.Printf("Query %q could not be recorded: %v", q, err)
+		}
+	}
+	var resultSum string
+	if opts.hash != nil {
+		resultSum = opts.hash.Sum()
+		w.Header().Set(hashTrailer, resultSum)
+	}
+	if manifest != nil {
+		entry := audit.Entry{
+			Remote:       r.RemoteAddr,
+			Client:       client,
+			Query:        string(queryBytes),
+			Format:       format,
+			Transforms:   transformNames,
+			ResultSHA256: resultSum,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		manifest.Fill(&entry)
+		seq, err := e.audit.Add(entry)
+		if err != nil {
+			log.Printf("Query %q could not be audited: %v", q, err)
+			events.H.Add(events.Error, "Query %q could not be audited: %v", q, err)
+			return
+		}
+		w.Header().Set(auditTrailer, strconv.FormatUint(seq, 10))
+	}
+}
+
+// queryTransforms returns the transforms a client's query results go
+// through:  those it asked for and any enforced on it, in canonical order.
+// The transform is nil if there are none.
+func (e *Env) queryTransforms(requested []string, client string) ([]string, base.Transform, error) {
+	names := requested
+	if e.conf.Transforms != nil {
+		names = append(names, e.conf.Transforms.Enforced(client)...)
+	}
+	if len(names) == 0 {
+		return nil, nil, nil
+	}
+	names, err := base.TransformNames(names)
+	if err != nil {
+		return nil, nil, err
+	}
+	transform, err := base.NewTransforms(names, e.cryptoPANKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return names, transform, nil
+}
+
+// writePackets writes packets in one of the queryFormats.  'query' is what
+// produced them, as recorded in PCAPNG output.
+func (e *Env) writePackets(packets *base.PacketChan, out io.Writer, format string, limit base.Limit, query string) error {
+	switch format {
+	case "text":
+		return base.PacketsToText(packets, out, limit)
+	case "pcapng":
+		return base.PacketsToPcapng(packets, out, limit, base.Provenance{
+			Query:         query,
+			SensorID:      e.sensor,
+			Version:       base.Version,
+			TimeZone:      e.parser.Location().String(),
+			UTCOffset:     time.Now().In(e.parser.Location()).Format("-07:00"),
+			HardwareClock: e.hardwareClock(),
+		})
+	case "ndjson":
+		return export.PacketsToNDJSON(packets, out, limit)
+	case "parquet":
+		return export.PacketsToParquet(packets, out, limit)
+	case "tar":
+		return base.PacketsToFlowTar(packets, out, limit)
+	}
+	return base.PacketsToFile(packets, out, limit)
+}
+
+// writeMultipart writes packets as a multipart/mixed response of two parts:  a
+// PCAP of type 'pcapType', then the packets' metadata from 'sideChannel' as
+// newline-delimited JSON.  If writing the PCAP fails, the response is left
+// without its closing boundary.
+func writeMultipart(h http.Header, packets *base.PacketChan, out io.Writer, pcapType string, limit base.Limit, sideChannel *export.SideChannel) error {
+	mw := multipart.NewWriter(out)
+	h.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {pcapType}})
+	if err != nil {
+		return err
+	}
+	if err := base.PacketsToFile(packets, part, limit); err != nil {
+		return err
+	}
+	if part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/x-ndjson"}}); err != nil {
+		return err
+	}
+	if _, err := sideChannel.WriteTo(part); err != nil {
+		return fmt.Errorf("could not write packet metadata: %v", err)
+	}
+	return mw.Close()
+}
+
+// annotateDrops sets the dropsTrailer if packets were dropped during the
+// query's time range, since its results may then be missing packets.
+func (e *Env) annotateDrops(ctx context.Context, w http.ResponseWriter, q query.Query) {
+	start, end := query.TimeBounds(q)
+	drops, err := e.Drops(ctx, start, end)
+	if err != nil {
+		log.Printf("Query %q could not check drops: %v", q, err)
+		return
+	} else if drops.LosingBlocks == 0 {
+		return
+	}
+	encoded := setJSONTrailer(w, dropsTrailer, newDropsResult(start, end, drops, maxDropTrailerRanges))
+	v(1, "Query %q time range had drops: %s", q, encoded)
+}
+
+// clientIdentity returns the common name of the request's client certificate,
+// or "" if it has none.
+func clientIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return ""
+}
+
+// startQuota counts a query against the client's quota, returning its quota
+// status, which is also set in the response headers.  If the client's out of
+// quota, it responds with an error and returns false.
+func (e *Env) startQuota(w http.ResponseWriter, client string) (quota.Status, bool) {
+	status, err := e.quota.Start(client)
+	status.SetHeaders(w.Header())
+	if exceeded, ok := err.(*quota.ExceededError); ok {
+		v(1, "Rejecting query: %v", err)
+		rateLimitedQueries.Increment()
+		w.Header().Set("Retry-After", strconv.Itoa(int(exceeded.RetryAfter.Seconds())+1))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return status, false
+	}
+	return status, true
+}
+
+// checkQueryRange rejects a query whose time bounds span more than
+// Config.QueryRange allows, unless its client is privileged, responding with
+// an error and returning false.
+func (e *Env) checkQueryRange(w http.ResponseWriter, q query.Query, client string) bool {
+	c := e.conf.QueryRange
+	if c == nil || c.Exempt(client) {
+		return true
+	}
+	max, _ := c.MaxDuration() // Checked by validate.
+	start, end := query.TimeBounds(q)
+	var err error
+	if start.IsZero() {
+		err = fmt.Errorf("query has no start time, and may span at most %v (add one like 'after 3h ago')", c.Max)
+	} else if end.IsZero() {
+		end = time.Now()
+	}
+	if span := end.Sub(start); err == nil && span > max {
+		err = fmt.Errorf("query spans %v, more than the %v allowed", span.Round(time.Second), c.Max)
+	}
+	if err != nil {
+		v(1, "Rejecting query %q from %q: %v", q, client, err)
+		rangeLimitedQueries.Increment()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// byteCounter counts the bytes written through it.
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (b *byteCounter) Write(p []byte) (int, error) {
+	n, err := b.w.Write(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// SeenResult is the response to a /seen request.
+type SeenResult struct {
+	Host        string
+	Seen        bool
+	First, Last *time.Time          `json:",omitempty"` // Set if Seen.
+	Warnings    []base.QueryWarning `json:",omitempty"` // Files skipped.
+}
+
+// validSeenHost matches the addresses and host names /seen accepts, so the
+// host can't smuggle in any other query syntax.
+var validSeenHost = regexp.MustCompile(`^[0-9A-Za-z.:_-]+$`)
+
+// handleSeen returns when a host (the 'host' URL parameter) was first and last
+// seen across all retained packets, using only index lookups and a couple of
+// packet headers.  It's the cheapest way to check an indicator.
+func (e *Env) handleSeen(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+
+	host := r.URL.Query().Get("host")
+	if !validSeenHost.MatchString(host) {
+		http.Error(w, fmt.Sprintf("invalid host %q", host), http.StatusBadRequest)
+		return
+	}
+	q, err := e.parser.Parse("host " + host)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid host %q: %v", host, err), http.StatusBadRequest)
+		return
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	warnings := &base.QueryWarnings{}
+	first, last, ok, err := e.Seen(base.WithQueryWarnings(ctx, warnings), q)
+	if err != nil {
+		log.Printf("Seen check of %q failed: %v", host, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := SeenResult{Host: host, Seen: ok, Warnings: warnings.List()}
+	if ok {
+		result.First, result.Last = &first, &last
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// DropsResult is the response to a /drops request, and is returned in the
+// dropsTrailer of queries whose time range had drops.
+type DropsResult struct {
+	Start, End     *time.Time `json:",omitempty"` // Unset for open ranges.
+	Blocks         int64
+	LosingBlocks   int64
+	LosingFraction float64
+	Losing         []base.TimeRange `json:",omitempty"`
+}
+
+// Limits on how many losing blocks' time ranges are listed in a DropsResult
+// from /drops, or in the dropsTrailer.  The most recent are kept.
+const (
+	maxDropRanges        = 1000
+	maxDropTrailerRanges = 10
+)
+
+func newDropsResult(start, end time.Time, d base.DropStats, max int) DropsResult {
+	r := DropsResult{
+		Blocks:         d.Blocks,
+		LosingBlocks:   d.LosingBlocks,
+		LosingFraction: d.LosingFraction(),
+		Losing:         d.Losing,
+	}
+	if !start.IsZero() {
+		r.Start = &start
+	}
+	if !end.IsZero() {
+		r.End = &end
+	}
+	if len(r.Losing) > max {
+		r.Losing = r.Losing[len(r.Losing)-max:]
+	}
+	return r
+}
+
+// handleDrops reports how many capture blocks were written while the kernel
+// was dropping packets between the 'start' and 'end' URL parameters (RFC3339
+// times, either of which may be left out for an open range).
+func (e *Env) handleDrops(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+
+	var times [2]time.Time
+	for i, param := range []string{"start", "end"} {
+		if v := r.URL.Query().Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s %q", param, v), http.StatusBadRequest)
+				return
+			}
+			times[i] = t.UTC()
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	drops, err := e.Drops(ctx, times[0], times[1])
+	if err != nil {
+		log.Printf("Drops check failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newDropsResult(times[0], times[1], drops, maxDropRanges))
+}
+
+// handleSets manages saved query sets, which later queries can be limited to
+// with "in set:<id>", or exclude with "and not in set:<id>".  POST saves the
+// packets matched by a query (the 'q' URL parameter, or the request body as
+// for /query) and returns the new set, GET lists sets, and DELETE removes the
+// set given by the 'id' URL parameter.
+func (e *Env) handleSets(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, r.Method == "POST")
+	defer log.Print(w)
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(query.Sets.List())
+		return
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if !query.Sets.Delete(id) {
+			http.Error(w, fmt.Sprintf("no set %q", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("Deleted set %v", id)
+		return
+	case "POST":
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	queryString := r.URL.Query().Get("q")
+	if queryString == "" {
+		queryBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+		queryString = string(queryBytes)
+	}
+	q, err := e.parser.Parse(queryString)
+	if err != nil {
+		http.Error(w, "could not parse query", http.StatusBadRequest)
+		return
+	}
+	if e.quota != nil {
+		if _, ok := e.startQuota(w, clientIdentity(r)); !ok {
+			return
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	defer e.queries.remove(e.queries.add(queryString, r.RemoteAddr, ctx.Cancel))
+	positions, err := e.Positions(ctx, q)
+	if err != nil {
+		log.Printf("Saving set of %q failed: %v", q, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	set, err := query.Sets.Save(queryString, positions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	log.Printf("Saved set %v of %q: %d packets in %d files", set.ID, q, set.Packets, set.Files)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// EstimateResult is the response to an /estimate request.
+type EstimateResult struct {
+	base.Estimate
+	Warnings []base.QueryWarning `json:",omitempty"` // Files skipped.
+}
+
+// handleEstimate estimates the size of a query's results without reading
+// them, so users can be warned before a huge extraction.  The query is given
+// by the 'q' URL parameter, or the request body as for /query, and the
+// 'samples' URL parameter sets how many packet lengths are read per file.
+func (e *Env) handleEstimate(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+
+	vals := r.URL.Query()
+	samples := defaultEstimateSamples
+	if s := vals.Get("samples"); s != "" {
+		var err error
+		if samples, err = strconv.Atoi(s); err != nil || samples < 1 || samples > maxEstimateSamples {
+			http.Error(w, fmt.Sprintf("invalid samples %q", s), http.StatusBadRequest)
+			return
+		}
+	}
+	queryString := vals.Get("q")
+	if queryString == "" {
+		queryBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+		queryString = string(queryBytes)
+	}
+	q, err := e.parser.Parse(queryString)
+	if err != nil {
+		http.Error(w, "could not parse query", http.StatusBadRequest)
+		return
+	}
+	if e.quota != nil {
+		if _, ok := e.startQuota(w, clientIdentity(r)); !ok {
+			return
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	defer e.queries.remove(e.queries.add(queryString, r.RemoteAddr, ctx.Cancel))
+	warnings := &base.QueryWarnings{}
+	est, err := e.Estimate(base.WithQueryWarnings(ctx, warnings), q, samples)
+	if err != nil {
+		log.Printf("Estimate of %q failed: %v", q, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v(1, "Query %q estimated at %d packets, %d bytes", q, est.Packets, est.Bytes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EstimateResult{Estimate: est, Warnings: warnings.List()})
+}
+
+// HistogramResult is the response to a /histogram request.
+type HistogramResult struct {
+	Bucket   string // Bucket width, as a duration.
+	Buckets  []base.HistogramBucket
+	Warnings []base.QueryWarning `json:",omitempty"` // Files skipped.
+	// EmbargoStart and EmbargoEnd, if set, bound the packets queries may
+	// currently return (see config.EmbargoConfig), so timelines can show
+	// what's withheld.
+	EmbargoStart, EmbargoEnd *time.Time `json:",omitempty"`
+}
+
+// handleHistogram counts the packets matching a query per time bucket, from
+// indexes and sampled packet headers, so results can be charted over time
+// before any are extracted.  The query is given by the 'q' URL parameter, or
+// the request body as for /query, and the 'bucket' URL parameter sets the
+// bucket width (a duration, defaulting to a minute).  Only buckets with
+// packets are returned.
+func (e *Env) handleHistogram(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, true)
+	defer log.Print(w)
+
+	vals := r.URL.Query()
+	width := defaultHistogramBucket
+	if b := vals.Get("bucket"); b != "" {
+		var err error
+		if width, err = time.ParseDuration(b); err != nil || width < time.Second {
+			http.Error(w, fmt.Sprintf("invalid bucket %q", b), http.StatusBadRequest)
+			return
+		}
+	}
+	queryString := vals.Get("q")
+	if queryString == "" {
+		queryBytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "could not read request body", http.StatusBadRequest)
+			return
+		}
+		queryString = string(queryBytes)
+	}
+	q, err := e.parser.Parse(queryString)
 	if err != nil {
 		http.Error(w, "could not parse query", http.StatusBadRequest)
 		return
 	}
+	if e.quota != nil {
+		if _, ok := e.startQuota(w, clientIdentity(r)); !ok {
+			return
+		}
+	}
 	ctx := httputil.Context(w, r, time.Minute*15)
 	defer ctx.Cancel()
-	packets := e.Lookup(ctx, q)
-	w.Header().Set("Content-Type", "application/octet-stream")
-	base.PacketsToFile(packets, w, limit)
+	defer e.queries.remove(e.queries.add(queryString, r.RemoteAddr, ctx.Cancel))
+	warnings := &base.QueryWarnings{}
+	hist, err := e.Histogram(base.WithQueryWarnings(ctx, warnings), q, width)
+	if err != nil {
+		log.Printf("Histogram of %q failed: %v", q, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v(1, "Query %q matched packets in %d buckets of %v", q, hist.Len(), width)
+	w.Header().Set("Content-Type", "application/json")
+	result := HistogramResult{Bucket: width.String(), Buckets: hist.Buckets(), Warnings: warnings.List()}
+	start, end := e.embargo()
+	if !start.IsZero() {
+		result.EmbargoStart = &start
+	}
+	if !end.IsZero() {
+		result.EmbargoEnd = &end
+	}
+	json.NewEncoder(w).Encode(result)
 }
 
+const (
+	// defaultEstimateSamples is how many packet lengths /estimate reads per
+	// file by default, and maxEstimateSamples how many it may be asked to.
+	defaultEstimateSamples = 100
+	maxEstimateSamples     = 100000
+
+	// defaultHistogramBucket is the width of /histogram's buckets by default.
+	defaultHistogramBucket = time.Minute
+
+	// timingsTrailer is the HTTP trailer in which query timings are returned.
+	timingsTrailer = "Steno-Query-Timings"
+	// snapshotTrailer is the HTTP trailer listing the blockfiles a query read.
+	snapshotTrailer = "Steno-Query-Snapshot"
+	// errorTrailer is the HTTP trailer in which query failures are returned.
+	errorTrailer = "Steno-Query-Error"
+	// warningsTrailer is the HTTP trailer listing files a query skipped.
+	warningsTrailer = "Steno-Query-Warnings"
+	// dropsTrailer is the HTTP trailer describing drops during the query's
+	// time range, if there were any.
+	dropsTrailer = "Steno-Query-Drops"
+	// partialTrailer is the HTTP trailer summarizing what a partial_ok query
+	// skipped.
+	partialTrailer = "Steno-Query-Partial"
+	// hashTrailer is the HTTP trailer in which the SHA-256 of a query's
+	// canonical results is returned.
+	hashTrailer = "Steno-Query-SHA256"
+	// auditTrailer is the HTTP trailer giving the sequence number of a query's
+	// audit log entry.
+	auditTrailer = "Steno-Audit-Entry"
+	// sinksTrailer is the HTTP trailer reporting how copying a query's results
+	// to its sinks went.
+	sinksTrailer = "Steno-Query-Sinks"
+	// transformsHeader is the HTTP header listing the transforms applied to a
+	// query's results.
+	transformsHeader = "Steno-Transforms"
+	// traceHeader is the HTTP header giving the ID of a traced query's trace.
+	traceHeader = "Steno-Trace-ID"
+
+	// defaultPartialDeadline is how long partial_ok queries run without an
+	// explicit deadline.
+	defaultPartialDeadline = 10 * time.Second
+)
+
 // New returns a new Env for use in running Stenotype.
 func New(c config.Config) (_ *Env, returnedErr error) {
 	if err := c.Validate(); err != nil {
 		return nil, err
 	}
+	for _, port := range c.CompositeKeyPorts {
+		indexfile.CompositePorts[uint16(port)] = true
+	}
+	indexfile.IndexStats = c.IndexStats
+	indexfile.AppProtocolIndexes = c.AppProtocolIndex
+	indexfile.QUICConnectionIDIndexes = c.QUICConnectionIDIndex
+	base.SpillDirectory = c.QuerySpillDirectory
+	base.OutputLinkLayer, _ = c.LinkLayer()
+	if c.QueryPlanCacheSize > 0 {
+		query.Plans = query.NewPlanCache(c.QueryPlanCacheSize)
+	}
 	dirname, err := ioutil.TempDir("", "stenographer")
 	if err != nil {
 		return nil, fmt.Errorf("couldn't create temp directory: %v", err)
@@ -118,25 +946,174 @@ func New(c config.Config) (_ *Env, returnedErr error) {
 			os.RemoveAll(dirname)
 		}
 	}()
-	threads, err := thread.Threads(c.Threads, dirname, filecache.NewCache(c.MaxOpenFiles))
-	if err != nil {
-		return nil, err
-	}
 	d := &Env{
 		conf:    c,
 		name:    dirname,
-		threads: threads,
 		done:    make(chan bool),
+		sensor:  c.SensorID,
+		budget:  newIndexBudget(),
+		restart: make(chan struct{}, 1),
+		started: time.Now(),
+	}
+	if d.client, err = httputil.NewClient(c.OutboundProxy); err != nil {
+		return nil, err
+	}
+	if d.sensor == "" {
+		if host, err := os.Hostname(); err != nil {
+			log.Printf("Could not get hostname for sensor ID: %v", err)
+		} else {
+			d.sensor = host
+		}
+	}
+	if d.files, err = d.blockfileOptions(); err != nil {
+		return nil, err
+	}
+	d.parser = &query.Parser{TimeZone: d.files.Clock.Location}
+	if c.HostResolverURL != "" {
+		d.parser.Resolver = &query.HTTPResolver{URL: c.HostResolverURL, Client: d.client}
+	} else if c.HostResolverCommand != "" {
+		d.parser.Resolver = &query.ExecResolver{Command: c.HostResolverCommand}
+	}
+	threads, err := thread.Threads(c.Threads, dirname, filecache.NewCache(c.MaxOpenFiles), d.files, d.parser)
+	if err != nil {
+		return nil, err
+	}
+	d.threads = threads
+	if c.LabelsPath != "" {
+		if d.labels, err = labels.Open(c.LabelsPath); err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			thread.SetLabels(d.labels)
+		}
+	}
+	if c.AuditLogPath != "" {
+		key, err := audit.LoadPrivateKey(c.AuditKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		if d.audit, err = audit.Open(c.AuditLogPath, key); err != nil {
+			return nil, err
+		}
+	}
+	if c.RateLimits != nil {
+		d.quota = quota.New(*c.RateLimits)
+	}
+	if c.WorkloadLogPath != "" {
+		var key []byte
+		if c.WorkloadKeyPath != "" {
+			data, err := ioutil.ReadFile(c.WorkloadKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("could not read workload key: %v", err)
+			}
+			if key, err = base.ParseCryptoPANKey(data); err != nil {
+				return nil, err
+			}
+		}
+		if d.workload, err = workload.Open(c.WorkloadLogPath, key); err != nil {
+			return nil, err
+		}
+	}
+	if c.Transforms != nil && c.Transforms.CryptoPANKeyPath != "" {
+		data, err := ioutil.ReadFile(c.Transforms.CryptoPANKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CryptoPAN key: %v", err)
+		}
+		if d.cryptoPANKey, err = base.ParseCryptoPANKey(data); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Exporters) > 0 {
+		var exporters []export.Exporter
+		for _, ec := range c.Exporters {
+			e, err := export.New(ec, d.client, d.sensor, d.parser)
+			if err != nil {
+				return nil, err
+			}
+			exporters = append(exporters, e)
+		}
+		for _, thread := range threads {
+			thread.SetExporters(exporters, c.ExportRequired)
+		}
+	}
+	if c.Archive != nil {
+		zstd := c.Archive.ZstdCommand
+		if zstd == "" {
+			zstd = "zstd"
+		}
+		a, err := archive.NewFetcher(c.Archive.URL, c.Archive.ScratchDirectory, c.Archive.CacheBytes(), d.client, zstd)
+		if err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			thread.SetArchive(a)
+		}
+	}
+	if c.FlowShipping != nil {
+		shipper, err := flowship.New(*c.FlowShipping, d.client, d.sensor)
+		if err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			thread.SetFlowShipper(shipper)
+		}
+	}
+	if c.IndexLag != nil {
+		wait, err := c.IndexLag.MaxWaitDuration()
+		if err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			thread.SetIndexLag(c.IndexLag.Policy, wait)
+		}
+	}
+	go d.syncFilesOnChange()
+	if c.IndexBudgetPercent > 0 {
+		go d.callEvery(d.checkIndexBudget, indexBudgetCheckFrequency)
+	}
+	if c.Canary != nil {
+		if d.canary, err = newCanary(*c.Canary, d.parser); err != nil {
+			return nil, fmt.Errorf("canary in configuration: %v", err)
+		}
+		go d.callEvery(d.checkCanary, d.canary.interval)
+	}
+	if c.RetentionSLO != nil {
+		if d.retention, err = newRetentionSLO(*c.RetentionSLO); err != nil {
+			return nil, fmt.Errorf("retention SLO in configuration: %v", err)
+		}
+		go d.callEvery(d.checkRetentionSLO, d.retention.interval)
+	}
+	if c.Tracing != nil {
+		if d.tracer, err = tracing.New(*c.Tracing, d.client, d.sensor); err != nil {
+			return nil, err
+		}
+	}
+	if c.Profiling != nil {
+		if d.profiler, err = profiling.New(*c.Profiling); err != nil {
+			return nil, err
+		}
+		if _, interval, _ := c.Profiling.Intervals(); interval > 0 {
+			go d.callEvery(d.profiler.LogContention, interval)
+		}
 	}
-	go d.callEvery(d.syncFiles, fileSyncFrequency)
 	return d, nil
 }
 
-// args is the set of command line arguments to pass to stentype.
-func (d *Env) args() []string {
-	res := append(d.conf.Flags,
-		fmt.Sprintf("--threads=%d", len(d.conf.Threads)),
-		fmt.Sprintf("--dir=%s", d.Path()))
+// args is the set of command line arguments to pass to stentype, to capture
+// to the threads with the given IDs, linked into 'dir' in order.
+func (d *Env) args(dir string, ids []int) []string {
+	res := append(d.budget.filter(d.conf.Flags),
+		fmt.Sprintf("--threads=%d", len(ids)),
+		fmt.Sprintf("--dir=%s", dir))
+	if names := d.files.Names(); !names.Default() {
+		// Stenotype numbers the threads it's given from 0, so it's given each
+		// one's template with the thread's own ID already filled in.
+		var templates []string
+		for _, id := range ids {
+			templates = append(templates, names.Template(id))
+		}
+		res = append(res, "--filename_templates="+strings.Join(templates, ","))
+	}
 
 	if len(d.conf.Interface) > 0 {
 		res = append(res, fmt.Sprintf("--iface=%s", d.conf.Interface))
@@ -149,9 +1126,8 @@ func (d *Env) args() []string {
 
 // stenotype returns a exec.Cmd which runs the stenotype binary with all of
 // the appropriate flags.
-func (d *Env) stenotype() *exec.Cmd {
+func (d *Env) stenotype(args []string) *exec.Cmd {
 	v(0, "Starting stenotype")
-	args := d.args()
 	v(1, "Starting as %q with args %q", d.conf.StenotypePath, args)
 	return exec.Command(d.conf.StenotypePath, args...)
 }
@@ -163,14 +1139,80 @@ type Env struct {
 	threads []*thread.Thread
 	done    chan bool
 	fc      *filecache.Cache
+	labels  *labels.Store
+	audit   *audit.Log
+	quota   *quota.Limiter // nil if unlimited.
+	// workload records queries, if WorkloadLogPath is set.
+	workload *workload.Recorder
+	// cryptoPANKey is the key of the "cryptopan" transform, if configured.
+	cryptoPANKey []byte
+	// profiler serves /debug/pprof, and is nil if profiling isn't enabled.
+	profiler *profiling.Profiler
+	// tracer exports query spans, and is nil if tracing isn't enabled.
+	tracer  *tracing.Tracer
+	sensor  string
+	files   blockfile.Options // How blockfiles are read, in the sensor's clock.
+	parser  *query.Parser     // Parses queries in the sensor's time zone.
+	client  *http.Client      // For outbound connections, see config.OutboundProxy.
+	cert    *certs.ServerCertificate
+	queries activeQueries
+	budget  *indexBudget
+	canary  *canary
+	// isolation guards capturing, the IDs of the threads stenotype was last
+	// started with, leaving out those whose disks have failed.  It's nil
+	// until stenotype first runs.
+	isolation sync.Mutex
+	capturing []int
+	// restart asks the running stenotype to restart as threads' disks fail
+	// or recover, see checkIsolation.
+	restart chan struct{}
+	// retention checks the retention SLO, if one is configured.
+	retention *retentionSLO
+	started   time.Time
 	// StenotypeOutput is the writer that stenotype STDOUT/STDERR will be
 	// redirected to.
 	StenotypeOutput io.Writer
 }
 
+// blockfileOptions returns how blockfiles are read, from the configuration.
+// The sensor ID must be known, since file name templates may include it.
+func (d *Env) blockfileOptions() (blockfile.Options, error) {
+	c := d.conf
+	opts := blockfile.DefaultOptions()
+	opts.Clock, _ = c.Clock() // Checked by Validate.
+	if skew, _ := c.ClockSkewDuration(); skew > 0 {
+		opts.ClockSkew = skew
+	}
+	opts.Index = indexfile.Options{
+		Mmap:    c.IndexBackend == "mmap",
+		Sharded: c.IndexBackend == "sharded",
+	}
+	if c.ReadCacheMB > 0 {
+		opts.ReadCache = blockfile.NewRegionCache(int64(c.ReadCacheMB) << 20)
+	}
+	if c.FileNameTemplate != "" {
+		var err error
+		if opts.FileNames, err = base.NewFileNames(c.FileNameTemplate, d.sensor); err != nil {
+			return opts, fmt.Errorf("invalid file name template in configuration: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+// hardwareClock returns what packet timestamps are measured in before being
+// converted to UTC.
+func (d *Env) hardwareClock() string {
+	if d.files.Clock.Source == "" {
+		return "utc"
+	}
+	return d.files.Clock.Source
+}
+
 // Close closes the directory.  This should only be done when stenotype has
-// stopped using it.  After this call, Env should no longer be used.
+// stopped using it.  After this call, Env should no longer be used.  Its
+// background goroutines, like file syncing, are stopped.
 func (d *Env) Close() error {
+	close(d.done)
 	return os.RemoveAll(d.name)
 }
 
@@ -189,13 +1231,13 @@ func (d *Env) callEvery(cb func(), freq time.Duration) {
 }
 
 func removeHiddenFilesFrom(dir string) {
-	files, err := ioutil.ReadDir(dir)
+	files, err := os.ReadDir(dir)
 	if err != nil {
 		log.Printf("Hidden file cleanup failed, could not read directory: %v", err)
 		return
 	}
 	for _, file := range files {
-		if file.Mode().IsRegular() && strings.HasPrefix(file.Name(), ".") {
+		if file.Type().IsRegular() && strings.HasPrefix(file.Name(), ".") {
 			filename := filepath.Join(dir, file.Name())
 			if err := os.Remove(filename); err != nil {
 				log.Printf("Unable to remove hidden file %q: %v", filename, err)
@@ -207,6 +1249,45 @@ func removeHiddenFilesFrom(dir string) {
 	}
 }
 
+// removeStaleDerivedIndexes removes mmapped and sharded indexes (see
+// indexfile.Options), flow
+// indexes (see indexfile.FlowPath), composite indexes (see
+// indexfile.CompositePorts), app indexes (see indexfile.AppProtocolIndexes),
+// QUIC indexes (see indexfile.QUICConnectionIDIndexes), index statistics (see
+// indexfile.Stats), and lock files (see indexfile.LockIndex) whose leveldb
+// index no longer exists in indexFiles.
+func removeStaleDerivedIndexes(dir string, indexFiles map[string]bool) {
+	for _, derived := range []struct{ kind, dir string }{
+		{"mmap", indexfile.MmapDirectory(dir)},
+		{"sharded", indexfile.ShardDirectory(dir)},
+		{"flow", indexfile.FlowDirectory(dir)},
+		{"composite", indexfile.CompositeDirectory(dir)},
+		{"app", indexfile.AppDirectory(dir)},
+		{"quic", indexfile.QUICDirectory(dir)},
+		{"stats", indexfile.StatsDirectory(dir)},
+		{"lock", indexfile.LockDirectory(dir)},
+	} {
+		files, err := namesIn(derived.dir)
+		if err != nil {
+			continue // Most likely they've never been used.
+		}
+		for file := range files {
+			index := file
+			if i := strings.IndexByte(file, '.'); i > 0 {
+				index = file[:i] // A shard or composite index, named for its key type or port.
+			}
+			if indexFiles[index] {
+				continue
+			}
+			filename := filepath.Join(derived.dir, file)
+			v(2, "Removing stale %s index %q", derived.kind, filename)
+			if err := os.Remove(filename); err != nil {
+				log.Printf("Unable to remove stale %s index %q: %v", derived.kind, filename, err)
+			}
+		}
+	}
+}
+
 func filesIn(dir string) (map[string]os.FileInfo, error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -221,36 +1302,58 @@ func filesIn(dir string) (map[string]os.FileInfo, error) {
 	return out, nil
 }
 
+// namesIn is like filesIn, but only returns the names of the files, which
+// saves a stat per file.
+func namesIn(dir string) (map[string]bool, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := map[string]bool{}
+	for _, file := range files {
+		if file.Type().IsRegular() {
+			out[file.Name()] = true
+		}
+	}
+	return out, nil
+}
+
 // removeOldFiles removes hidden files from previous runs, as well as packet
 // files without indexes and vice versa.
 func (d *Env) removeOldFiles() {
-	for _, thread := range d.conf.Threads {
+	for i, thread := range d.conf.Threads {
+		if d.threads[i].Degraded() != nil {
+			continue
+		}
 		v(1, "Checking %q/%q for stale pkt/idx files...", thread.PacketsDirectory, thread.IndexDirectory)
 		removeHiddenFilesFrom(thread.PacketsDirectory)
 		removeHiddenFilesFrom(thread.IndexDirectory)
-		packetFiles, err := filesIn(thread.PacketsDirectory)
+		packetFiles, err := namesIn(thread.PacketsDirectory)
 		if err != nil {
 			log.Printf("could not get files from %q: %v", thread.PacketsDirectory, err)
 			continue
 		}
-		indexFiles, err := filesIn(thread.IndexDirectory)
+		indexFiles, err := namesIn(thread.IndexDirectory)
 		if err != nil {
 			log.Printf("could not get files from %q: %v", thread.IndexDirectory, err)
 			continue
 		}
 		var mismatchedFilesToRemove []string
 		for file := range packetFiles {
-			if indexFiles[file] == nil {
+			if !indexFiles[file] {
 				mismatchedFilesToRemove = append(mismatchedFilesToRemove, filepath.Join(thread.PacketsDirectory, file))
 				log.Printf("Removing packet file %q without index found in %q", file, thread.PacketsDirectory)
+				events.H.Add(events.DeleteFile, "Removing packet file %q without index found in %q", file, thread.PacketsDirectory)
 			}
 		}
 		for file := range indexFiles {
-			if packetFiles[file] == nil {
+			if !packetFiles[file] {
 				mismatchedFilesToRemove = append(mismatchedFilesToRemove, filepath.Join(thread.IndexDirectory, file))
 				log.Printf("Removing index file %q without packets found in %q", file, thread.IndexDirectory)
+				events.H.Add(events.DeleteFile, "Removing index file %q without packets found in %q", file, thread.IndexDirectory)
 			}
 		}
+		removeStaleDerivedIndexes(thread.IndexDirectory, indexFiles)
 		for _, file := range mismatchedFilesToRemove {
 			v(2, "Removing file %q", file)
 			if err := os.Remove(file); err != nil {
@@ -266,6 +1369,7 @@ func (d *Env) syncFiles() {
 	for _, t := range d.threads {
 		t.SyncFiles()
 	}
+	d.checkIsolation()
 }
 
 // Path returns the underlying directory path for the given Env.
@@ -273,26 +1377,310 @@ func (d *Env) Path() string {
 	return d.name
 }
 
+// embargo returns the range of packet timestamps queries may currently
+// return (see config.EmbargoConfig), with zero times for open ends.
+func (d *Env) embargo() (start, end time.Time) {
+	if d.conf.Embargo == nil {
+		return start, end
+	}
+	return d.conf.Embargo.Window(time.Now())
+}
+
 // Lookup looks up the given query in all blockfiles currently known in this
-// Env.
+// Env, returning only packets outside the embargo.  Threads whose disks have
+// failed are skipped, with a query warning, by this and the other queries.
 func (d *Env) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
+	start, end := d.embargo()
+	return base.WindowPacketChan(d.lookup(ctx, query.Within(q, start, end)), start, end)
+}
+
+// lookup is Lookup, ignoring the embargo.  Threads start their lookups
+// concurrently, so those waiting for lagging indexes (see
+// config.IndexLagConfig) wait at the same time rather than one after another.
+func (d *Env) lookup(ctx context.Context, q query.Query) *base.PacketChan {
+	threads := d.healthyThreads(ctx)
+	inputs := make([]*base.PacketChan, len(threads))
+	var wg sync.WaitGroup
+	for i, t := range threads {
+		wg.Add(1)
+		go func(i int, t *thread.Thread) {
+			defer wg.Done()
+			inputs[i] = t.Lookup(ctx, q)
+		}(i, t)
+	}
+	wg.Wait()
+	return mergeThreads(ctx, inputs)
+}
+
+// mergeThreads combines the results of each thread in time order, or as they
+// arrive if the context allows it (see base.WithArrivalOrder).
+func mergeThreads(ctx context.Context, inputs []*base.PacketChan) *base.PacketChan {
+	if !base.ArrivalOrder(ctx) {
+		return base.MergePacketChans(ctx, inputs)
+	}
+	in := make(chan *base.PacketChan, len(inputs))
+	for _, c := range inputs {
+		in <- c
+	}
+	close(in)
+	return base.FanInPacketChans(ctx, in)
+}
+
+// Estimate estimates the size of the PCAP Lookup would return for the given
+// query, reading the lengths of at most 'samples' packets per file.
+func (d *Env) Estimate(ctx context.Context, q query.Query, samples int) (base.Estimate, error) {
+	start, end := d.embargo()
+	q = query.Within(q, start, end)
+	threads := d.healthyThreads(ctx)
+	ests := make([]base.Estimate, len(threads))
+	errs := make([]error, len(threads))
+	var wg sync.WaitGroup
+	for i, t := range threads {
+		wg.Add(1)
+		go func(i int, t *thread.Thread) {
+			defer wg.Done()
+			ests[i], errs[i] = t.Estimate(ctx, q, samples)
+		}(i, t)
+	}
+	wg.Wait()
+	est := base.Estimate{Bytes: base.PcapFileHeaderSize}
+	for i := range ests {
+		if errs[i] != nil {
+			return base.Estimate{}, errs[i]
+		}
+		est.Add(ests[i])
+	}
+	return est, nil
+}
+
+// Histogram counts the packets matching the given query in every thread's
+// files, in time buckets of the given width.  Buckets overlapping the embargo
+// are left out.
+func (d *Env) Histogram(ctx context.Context, q query.Query, width time.Duration) (*base.Histogram, error) {
+	start, end := d.embargo()
+	q = query.Within(q, start, end)
+	threads := d.healthyThreads(ctx)
+	hists := make([]*base.Histogram, len(threads))
+	errs := make([]error, len(threads))
+	var wg sync.WaitGroup
+	for i, t := range threads {
+		wg.Add(1)
+		go func(i int, t *thread.Thread) {
+			defer wg.Done()
+			hists[i] = base.NewHistogram(width)
+			errs[i] = t.Histogram(ctx, q, hists[i])
+		}(i, t)
+	}
+	wg.Wait()
+	out := base.NewHistogram(width)
+	for i := range hists {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		out.Merge(hists[i])
+	}
+	out.Clip(start, end)
+	return out, nil
+}
+
+// Positions returns the positions of packets matching the given query in
+// every thread's files, keyed by index name.
+func (d *Env) Positions(ctx context.Context, q query.Query) (query.FilePositions, error) {
+	start, end := d.embargo()
+	q = query.Within(q, start, end)
+	threads := d.healthyThreads(ctx)
+	results := make([]query.FilePositions, len(threads))
+	errs := make([]error, len(threads))
+	var wg sync.WaitGroup
+	for i, t := range threads {
+		wg.Add(1)
+		go func(i int, t *thread.Thread) {
+			defer wg.Done()
+			results[i], errs[i] = t.Positions(ctx, q)
+		}(i, t)
+	}
+	wg.Wait()
+	out := query.FilePositions{}
+	for i, positions := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for name, pos := range positions {
+			out[name] = pos
+		}
+	}
+	return out, nil
+}
+
+// Seen returns when packets matching the given query were first and last seen
+// in any thread, or false if they weren't.  Times are clamped to the bounds
+// of the embargo.
+func (d *Env) Seen(ctx context.Context, q query.Query) (first, last time.Time, ok bool, _ error) {
+	start, end := d.embargo()
+	q = query.Within(q, start, end)
+	type result struct {
+		first, last time.Time
+		ok          bool
+		err         error
+	}
+	threads := d.healthyThreads(ctx)
+	results := make([]result, len(threads))
+	var wg sync.WaitGroup
+	for i, t := range threads {
+		wg.Add(1)
+		go func(i int, t *thread.Thread) {
+			defer wg.Done()
+			r := &results[i]
+			r.first, r.last, r.ok, r.err = t.Seen(ctx, q)
+		}(i, t)
+	}
+	wg.Wait()
+	for _, r := range results {
+		if r.err != nil {
+			return first, last, false, r.err
+		} else if !r.ok {
+			continue
+		}
+		if !ok || r.first.Before(first) {
+			first = r.first
+		}
+		if !ok || r.last.After(last) {
+			last = r.last
+		}
+		ok = true
+	}
+	if ok && !start.IsZero() && first.Before(start) {
+		first = start
+	}
+	if ok && !end.IsZero() && last.After(end) {
+		last = end
+	}
+	return first, last, ok, nil
+}
+
+// Drops counts capture blocks, and those written while the kernel was
+// dropping packets, across all threads over the given time range (see
+// thread.Drops).
+func (d *Env) Drops(ctx context.Context, start, end time.Time) (base.DropStats, error) {
+	var out base.DropStats
+	for _, t := range d.healthyThreads(ctx) {
+		drops, err := t.Drops(ctx, start, end)
+		if err != nil {
+			return out, err
+		}
+		out.Add(drops)
+	}
+	sort.Slice(out.Losing, func(i, j int) bool { return out.Losing[i].Start.Before(out.Losing[j].Start) })
+	return out, nil
+}
+
+// LookupFiles is like Lookup, but only looks at an explicit list of files,
+// bypassing time-based selection (though not the embargo).  See Thread.SelectFiles for the format of
+// each spec.  Specs starting with thread.ArchivePrefix name archived files
+// instead, which are fetched from the archive.  Every spec must match a file
+// in at least one thread.
+func (d *Env) LookupFiles(ctx context.Context, q query.Query, specs []string) (*base.PacketChan, error) {
+	const archivePrefix = thread.ArchivePrefix
+	var local, archived []string
+	for _, spec := range specs {
+		if strings.HasPrefix(spec, archivePrefix) {
+			archived = append(archived, spec)
+		} else {
+			local = append(local, spec)
+		}
+	}
+	specs = append(local[:len(local):len(local)], archived...)
+	threads := d.healthyThreads(ctx)
+	matched := make([]bool, len(specs))
+	selected := make([][]string, len(threads))
+	for i, thread := range threads {
+		files, m, err := thread.SelectFiles(local)
+		if err != nil {
+			return nil, err
+		}
+		selected[i] = files
+		for j := range m {
+			matched[j] = matched[j] || m[j]
+		}
+		for j, spec := range archived {
+			ok, err := thread.FetchArchived(ctx, strings.TrimPrefix(spec, archivePrefix))
+			if err != nil {
+				return nil, err
+			} else if ok {
+				selected[i] = append(selected[i], spec)
+				matched[len(local)+j] = true
+			}
+		}
+	}
+	for j, spec := range specs {
+		if !matched[j] {
+			return nil, fmt.Errorf("no blockfiles found for %q", spec)
+		}
+	}
+	start, end := d.embargo()
+	q = query.Within(q, start, end)
 	var inputs []*base.PacketChan
-	for _, thread := range d.threads {
-		inputs = append(inputs, thread.Lookup(ctx, q))
+	for i, thread := range threads {
+		packets, err := thread.LookupFiles(ctx, q, selected[i])
+		if err != nil {
+			for _, in := range inputs {
+				in.Discard()
+			}
+			return nil, err
+		}
+		inputs = append(inputs, packets)
+	}
+	return base.WindowPacketChan(mergeThreads(ctx, inputs), start, end), nil
+}
+
+// ReadPackets reads packets by position from a blockfile of the thread with
+// the given ID, as Thread.ReadPackets does, leaving out embargoed packets.
+func (d *Env) ReadPackets(ctx context.Context, thread int, name string, positions []int64, count int) (*base.PacketChan, error) {
+	for _, t := range d.threads {
+		if t.ID() == thread {
+			if err := t.Degraded(); err != nil {
+				return nil, fmt.Errorf("thread %d disk has failed: %v", thread, err)
+			}
+			packets, err := t.ReadPackets(ctx, name, positions, count)
+			if err != nil {
+				return nil, err
+			}
+			start, end := d.embargo()
+			return base.WindowPacketChan(packets, start, end), nil
+		}
 	}
-	return base.MergePacketChans(ctx, inputs)
+	return nil, fmt.Errorf("no thread %d", thread)
+}
+
+// untransformed wraps a handler serving raw packets or addresses, so clients
+// whose query results are always transformed (see config.TransformConfig)
+// can't use it to get around that.
+func (d *Env) untransformed(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.conf.Transforms != nil && len(d.conf.Transforms.Enforced(clientIdentity(r))) > 0 {
+			http.Error(w, "not available to clients with enforced transforms", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
 }
 
 // ExportDebugHandlers exports a few debugging handlers to an HTTP ServeMux.
 func (d *Env) ExportDebugHandlers(mux *http.ServeMux) {
-	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+	mux.Handle("/debug/config", acceptingJSON(func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, false)
 		defer log.Print(w)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(d.conf)
-	})
+	}))
+	mux.HandleFunc("/debug/verbosity", serveVerbosity)
+	if d.profiler != nil {
+		mux.Handle("/debug/pprof/", d.profiler.Handler(clientIdentity))
+	}
+	threads := http.NewServeMux()
 	for _, thread := range d.threads {
-		thread.ExportDebugHandlers(mux)
+		thread.ExportDebugHandlers(threads)
+		mux.Handle(fmt.Sprintf("/debug/t%d/", thread.ID()), d.untransformed(threads))
 	}
 	oldestTimestamp := stats.S.Get("oldest_timestamp")
 	go func() {
@@ -310,10 +1698,13 @@ func (d *Env) ExportDebugHandlers(mux *http.ServeMux) {
 }
 
 // MinLastFileSeen returns the timestamp of the oldest among the newest files
-// created by all threads.
+// created by all threads whose disks haven't failed, or zero if they all have.
 func (d *Env) MinLastFileSeen() time.Time {
 	var t time.Time
 	for _, thread := range d.threads {
+		if thread.Degraded() != nil {
+			continue
+		}
 		ls := thread.FileLastSeen()
 		if t.IsZero() || ls.Before(t) {
 			t = ls
@@ -332,9 +1723,11 @@ func (d *Env) runStaleFileCheck(cmd *exec.Cmd, done chan struct{}) {
 		select {
 		case <-ticker.C:
 			v(2, "Checking stenotype for stale files...")
-			diff := time.Now().Sub(d.MinLastFileSeen())
-			if diff > maxFileLastSeenDuration {
+			last := d.MinLastFileSeen()
+			diff := time.Now().Sub(last)
+			if !last.IsZero() && diff > maxFileLastSeenDuration {
 				log.Printf("Restarting stenotype due to stale file.  Age: %v", diff)
+				events.H.Add(events.Error, "Restarting stenotype due to stale file.  Age: %v", diff)
 				if err := cmd.Process.Kill(); err != nil {
 					log.Fatalf("Failed to kill stenotype,  stale file found: %v", err)
 				}
@@ -353,10 +1746,27 @@ const (
 )
 
 // runStenotypeOnce runs the stenotype binary a single time, returning any
-// errors associated with its running.
+// errors associated with its running.  Threads whose disks have failed are
+// left out, and if they all have, it waits for one to recover instead.
 func (d *Env) runStenotypeOnce() error {
+	ids := d.captureThreads()
+	d.isolation.Lock()
+	d.capturing = ids
+	d.isolation.Unlock()
+	if len(ids) == 0 {
+		log.Printf("Not running stenotype, all threads' disks have failed")
+		events.H.Add(events.Error, "Not running stenotype, all threads' disks have failed")
+		<-d.restart
+		return errRestarted
+	}
 	d.removeOldFiles()
-	cmd := d.stenotype()
+	dir, err := d.captureDir(ids)
+	if err != nil {
+		return fmt.Errorf("cannot isolate threads: %v", err)
+	}
+	args := d.args(dir, ids)
+	events.H.Add(events.StenotypeRun, "Running stenotype %v", args)
+	cmd := d.stenotype(args)
 	done := make(chan struct{})
 	defer close(done)
 	// Start running stenotype.
@@ -366,14 +1776,36 @@ func (d *Env) runStenotypeOnce() error {
 		return fmt.Errorf("cannot start stenotype: %v", err)
 	}
 	go d.runStaleFileCheck(cmd, done)
-	if err := cmd.Wait(); err != nil {
+	restarted := make(chan struct{})
+	go func() {
+		select {
+		case <-d.budget.restart:
+			close(restarted)
+			if err := cmd.Process.Kill(); err != nil {
+				log.Fatalf("Failed to kill stenotype to reduce indexing: %v", err)
+			}
+		case <-d.restart:
+			close(restarted)
+			if err := cmd.Process.Kill(); err != nil {
+				log.Fatalf("Failed to kill stenotype to isolate threads: %v", err)
+			}
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	select {
+	case <-restarted:
+		return errRestarted
+	default:
+	}
+	if err != nil {
 		return fmt.Errorf("stenotype wait failed: %v", err)
 	}
 	return fmt.Errorf("stenotype stopped")
 }
 
 // RunStenotype keeps the stenotype binary running, restarting it if necessary
-// but trying not to allow crash loops.
+// but trying not to allow crash loops.  Restarts we asked for don't count.
 func (d *Env) RunStenotype() {
 	for {
 		start := time.Now()
@@ -381,7 +1813,8 @@ func (d *Env) RunStenotype() {
 		err := d.runStenotypeOnce()
 		duration := time.Since(start)
 		log.Printf("Stenotype stopped after %v: %v", duration, err)
-		if duration < minStenotypeRuntimeForRestart {
+		events.H.Add(events.StenotypeStop, "Stenotype stopped after %v: %v", duration, err)
+		if duration < minStenotypeRuntimeForRestart && err != errRestarted {
 			log.Fatalf("Stenotype ran for too little time, crashing to avoid stenotype crash loop")
 		}
 	}
@@ -0,0 +1,183 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mars-suite/stenographer/audit"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/httputil"
+)
+
+// maxFetchPositions limits how many positions one /packets request may fetch
+// packets from.
+const maxFetchPositions = 10000
+
+// handlePackets fetches packets directly by their positions in a blockfile,
+// without running a query, for tools which kept the positions of earlier
+// results.  The URL parameters are the 'thread' the file belongs to (which
+// may be left out if there's only one), the 'file' (relative to that thread's
+// packets directory, as for /query's 'files'), the 'offset' of each packet
+// (comma-separated or repeated), and how many packets to return starting at
+// each offset, 'count', which defaults to 1.  Output formats, transforms,
+// limits, quotas, and auditing work as for /query.
+func (e *Env) handlePackets(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, false)
+	defer log.Print(w)
+
+	limit, err := base.LimitFromHeaders(r.Header)
+	if err != nil {
+		http.Error(w, "Invalid Limit Headers", http.StatusBadRequest)
+		return
+	}
+	vals := r.URL.Query()
+	format, contentType, err := queryFormat(r)
+	if err != nil {
+		status := http.StatusNotAcceptable
+		if vals.Get("format") != "" {
+			status = http.StatusBadRequest
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	thread := 0
+	if t := vals.Get("thread"); t != "" {
+		if thread, err = strconv.Atoi(t); err != nil {
+			http.Error(w, fmt.Sprintf("invalid thread %q", t), http.StatusBadRequest)
+			return
+		}
+	} else if len(e.threads) > 1 {
+		http.Error(w, "thread required", http.StatusBadRequest)
+		return
+	}
+	file := vals.Get("file")
+	if file == "" {
+		http.Error(w, "file required", http.StatusBadRequest)
+		return
+	}
+	var positions []int64
+	for _, o := range vals["offset"] {
+		for _, s := range strings.Split(o, ",") {
+			pos, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || pos < 0 {
+				http.Error(w, fmt.Sprintf("invalid offset %q", s), http.StatusBadRequest)
+				return
+			}
+			positions = append(positions, pos)
+		}
+	}
+	if len(positions) == 0 || len(positions) > maxFetchPositions {
+		http.Error(w, fmt.Sprintf("between 1 and %d offsets required", maxFetchPositions), http.StatusBadRequest)
+		return
+	}
+	count := 1
+	if c := vals.Get("count"); c != "" {
+		if count, err = strconv.Atoi(c); err != nil || count <= 0 {
+			http.Error(w, fmt.Sprintf("invalid count %q", c), http.StatusBadRequest)
+			return
+		}
+	}
+	var transformNames []string
+	for _, t := range vals["transform"] {
+		transformNames = append(transformNames, strings.Split(t, ",")...)
+	}
+	client := clientIdentity(r)
+	if e.conf.Transforms != nil {
+		transformNames = append(transformNames, e.conf.Transforms.Enforced(client)...)
+	}
+	var transform base.Transform
+	if len(transformNames) > 0 {
+		if transformNames, err = base.TransformNames(transformNames); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if transform, err = base.NewTransforms(transformNames, e.cryptoPANKey); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(transformsHeader, strings.Join(transformNames, ","))
+	}
+	if e.quota != nil {
+		status, ok := e.startQuota(w, client)
+		if !ok {
+			return
+		}
+		if status.BytesLimit > 0 && (limit.Bytes == 0 || limit.Bytes > status.BytesRemaining) {
+			limit.Bytes = status.BytesRemaining
+		}
+	}
+	ctx := httputil.Context(w, r, time.Minute*15)
+	defer ctx.Cancel()
+	packets, err := e.ReadPackets(ctx, thread, file, positions, count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if transform != nil {
+		packets = base.TransformPacketChan(packets, transform.Transform)
+	}
+	if format == "tar" {
+		packets = base.GroupPacketsByFlow(ctx, packets)
+	}
+	// What was fetched, in place of a query, for PCAPNG provenance and audits.
+	fetch := "/packets?" + r.URL.RawQuery
+	var body io.Writer = w
+	if e.quota != nil {
+		counter := &byteCounter{w: w}
+		body = counter
+		defer func() { e.quota.Charge(client, counter.n) }()
+	}
+	var manifest *audit.Manifest
+	if e.audit != nil {
+		w.Header().Add("Trailer", auditTrailer)
+		manifest = audit.NewManifest(body)
+		body = manifest
+	}
+	// A bad offset is only found once earlier ones' packets have been sent.
+	w.Header().Add("Trailer", errorTrailer)
+	w.Header().Set("Content-Type", contentType)
+	if err = e.writePackets(packets, body, format, limit, fetch); err != nil {
+		log.Printf("Fetch %q failed: %v", fetch, err)
+		w.Header().Set(errorTrailer, err.Error())
+	}
+	if manifest != nil {
+		entry := audit.Entry{
+			Remote:     r.RemoteAddr,
+			Client:     client,
+			Query:      fetch,
+			Format:     format,
+			Transforms: transformNames,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		manifest.Fill(&entry)
+		seq, err := e.audit.Add(entry)
+		if err != nil {
+			log.Printf("Fetch %q could not be audited: %v", fetch, err)
+			events.H.Add(events.Error, "Fetch %q could not be audited: %v", fetch, err)
+			return
+		}
+		w.Header().Set(auditTrailer, strconv.FormatUint(seq, 10))
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+const (
+	indexBudgetCheckFrequency = 5 * time.Minute
+	// minIndexBudgetSample is how many blockfiles must have been written since
+	// indexing last changed before we judge whether it fits the budget.
+	minIndexBudgetSample = 10
+)
+
+var (
+	indexBytes             = stats.S.Get("index_bytes")
+	packetBytes            = stats.S.Get("packet_bytes")
+	indexBudgetUsedPercent = stats.S.Get("index_budget_used_percent")
+	indexBudgetDropped     = stats.S.Get("index_budget_dropped_key_types")
+	indexBudgetExceeded    = stats.S.Get("index_budget_exceeded")
+)
+
+// optionalIndexFlags are the stenotype flags which add optional key types to
+// indexes, in the order they're given up when indexes outgrow their budget.
+var optionalIndexFlags = []string{"--index_tcp_flags", "--index_host_direction", "--index_port_direction", "--index_gtp", "--index_macs", "--index_tunnels"}
+
+// indexBudget tracks which optional key types have been dropped to keep index
+// disk usage within Config.IndexBudgetPercent of packet data.
+type indexBudget struct {
+	mu      sync.Mutex
+	dropped []string  // Flags removed from stenotype's arguments.
+	since   time.Time // When indexing last changed.
+	// restart asks the running stenotype to restart with reduced indexing.
+	restart chan struct{}
+}
+
+func newIndexBudget() *indexBudget {
+	return &indexBudget{since: time.Now(), restart: make(chan struct{}, 1)}
+}
+
+// filter removes dropped flags from stenotype's flags.
+func (b *indexBudget) filter(flags []string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []string
+	for _, flag := range flags {
+		if !isDroppedFlag(b.dropped, flag) {
+			out = append(out, flag)
+		}
+	}
+	return out
+}
+
+// droppedKeyTypes returns the flags of key types no longer indexed.
+func (b *indexBudget) droppedKeyTypes() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.dropped...)
+}
+
+func isDroppedFlag(dropped []string, flag string) bool {
+	for _, d := range dropped {
+		if flag == d || strings.HasPrefix(flag, d+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// nextToDrop returns the first optional key type flag in flags which hasn't
+// been dropped yet, or "" if there are none.
+func nextToDrop(flags, dropped []string) string {
+	for _, opt := range optionalIndexFlags {
+		if isDroppedFlag(dropped, opt) {
+			continue
+		}
+		for _, flag := range flags {
+			if isDroppedFlag([]string{opt}, flag) {
+				return opt
+			}
+		}
+	}
+	return ""
+}
+
+// diskUsage sums the sizes of packet files and their indexes across threads,
+// both in total and for files written after 'since', whose indexes reflect
+// the current indexing options.
+type diskUsage struct {
+	packets, indexes       int64
+	newFiles               int
+	newPackets, newIndexes int64
+}
+
+func (d *Env) diskUsage(since time.Time) (u diskUsage) {
+	for i, thread := range d.conf.Threads {
+		if d.threads[i].Degraded() != nil {
+			continue // Its disk has failed, and reading it may block.
+		}
+		packetFiles, err := filesIn(thread.PacketsDirectory)
+		if err != nil {
+			log.Printf("Index budget could not read %q: %v", thread.PacketsDirectory, err)
+			continue
+		}
+		indexFiles, err := filesIn(thread.IndexDirectory)
+		if err != nil {
+			log.Printf("Index budget could not read %q: %v", thread.IndexDirectory, err)
+			continue
+		}
+		for name, pkt := range packetFiles {
+			idx, ok := indexFiles[name]
+			if !ok {
+				continue // Still being written, or about to be cleaned up.
+			}
+			u.packets += pkt.Size()
+			u.indexes += idx.Size()
+			if started, err := d.files.Names().Time(name); err == nil && !started.Before(since) {
+				u.newFiles++
+				u.newPackets += pkt.Size()
+				u.newIndexes += idx.Size()
+			}
+		}
+	}
+	return u
+}
+
+// checkIndexBudget compares index disk usage to Config.IndexBudgetPercent,
+// and if indexes written since indexing last changed exceed it, restarts
+// stenotype without the next optional key type.  Key types aren't re-enabled
+// until stenographer restarts, so indexing doesn't flap around the budget.
+func (d *Env) checkIndexBudget() {
+	b := d.budget
+	b.mu.Lock()
+	since := b.since
+	b.mu.Unlock()
+	u := d.diskUsage(since)
+	indexBytes.Set(u.indexes)
+	packetBytes.Set(u.packets)
+	if u.packets > 0 {
+		indexBudgetUsedPercent.Set(u.indexes * 100 / u.packets)
+	}
+	if u.newFiles < minIndexBudgetSample || u.newPackets == 0 {
+		return
+	}
+	used := float64(u.newIndexes) * 100 / float64(u.newPackets)
+	if used <= d.conf.IndexBudgetPercent {
+		indexBudgetExceeded.Set(0)
+		return
+	}
+	indexBudgetExceeded.Set(1)
+
+	b.mu.Lock()
+	flag := nextToDrop(d.conf.Flags, b.dropped)
+	if flag == "" {
+		b.mu.Unlock()
+		log.Printf("Indexes use %.1f%% of packet data, over the %v%% budget, with no optional key types left to drop", used, d.conf.IndexBudgetPercent)
+		return
+	}
+	b.dropped = append(b.dropped, flag)
+	b.since = time.Now()
+	indexBudgetDropped.Set(int64(len(b.dropped)))
+	b.mu.Unlock()
+
+	log.Printf("Indexes use %.1f%% of packet data, over the %v%% budget, restarting stenotype without %s", used, d.conf.IndexBudgetPercent, flag)
+	events.H.Add(events.Error, "Indexes use %.1f%% of packet data, over the %v%% budget, restarting stenotype without %s", used, d.conf.IndexBudgetPercent, flag)
+	select {
+	case b.restart <- struct{}{}:
+	default: // A restart is already pending.
+	}
+}
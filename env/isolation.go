@@ -0,0 +1,112 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/stats"
+	"github.com/mars-suite/stenographer/thread"
+	"golang.org/x/net/context"
+)
+
+var degradedThreads = stats.S.Get("degraded_threads")
+
+// isolatedDir is the subdirectory of the Env's directory stenotype is run in
+// while some threads' disks have failed, holding links to just the healthy
+// threads' directories, renumbered from 0.
+const isolatedDir = "isolated"
+
+// errRestarted is returned by runStenotypeOnce when stenotype was stopped on
+// purpose, to restart it with different arguments.
+var errRestarted = errors.New("stenotype restarted")
+
+// healthyThreads returns the threads whose disks haven't failed.  Each
+// degraded thread is noted in the context's query warnings, since its packets
+// are left out.
+func (d *Env) healthyThreads(ctx context.Context) (out []*thread.Thread) {
+	for _, t := range d.threads {
+		if err := t.Degraded(); err != nil {
+			base.QueryWarningsFrom(ctx).Add(base.QueryWarning{
+				File:   d.conf.Threads[t.ID()].PacketsDirectory,
+				Reason: fmt.Sprintf("thread %d skipped, its disk has failed: %v", t.ID(), err),
+			})
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// captureThreads returns the IDs of the threads stenotype should capture to,
+// those whose disks haven't failed.
+func (d *Env) captureThreads() []int {
+	ids := []int{}
+	for _, t := range d.threads {
+		if t.Degraded() == nil {
+			ids = append(ids, t.ID())
+		}
+	}
+	return ids
+}
+
+// captureDir returns the directory to run stenotype in to capture to the
+// given threads.  That's the Env's own directory if they're all of them,
+// otherwise isolatedDir, relinked to hold just them.
+func (d *Env) captureDir(ids []int) (string, error) {
+	if len(ids) == len(d.threads) {
+		return d.name, nil
+	}
+	dir := filepath.Join(d.name, isolatedDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return "", fmt.Errorf("could not remove %q: %v", dir, err)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return "", fmt.Errorf("could not create %q: %v", dir, err)
+	}
+	for i, id := range ids {
+		if err := d.threads[id].Link(dir, i); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// checkIsolation restarts stenotype if threads' disks have failed or
+// recovered since it started, so it stops writing to failed disks and
+// resumes writing to recovered ones.
+func (d *Env) checkIsolation() {
+	ids := d.captureThreads()
+	degradedThreads.Set(int64(len(d.threads) - len(ids)))
+	d.isolation.Lock()
+	capturing := d.capturing
+	d.isolation.Unlock()
+	if capturing == nil || reflect.DeepEqual(ids, capturing) {
+		return // Not running, or no change.
+	}
+	log.Printf("Restarting stenotype to capture to threads %v rather than %v", ids, capturing)
+	events.H.Add(events.Error, "Restarting stenotype to capture to threads %v rather than %v", ids, capturing)
+	select {
+	case d.restart <- struct{}{}:
+	default: // A restart is already pending.
+	}
+}
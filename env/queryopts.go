@@ -0,0 +1,348 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
+)
+
+// queryOptions are the URL parameters of a /query request, which shape how
+// its results are looked up, processed, and written.
+type queryOptions struct {
+	format, contentType string // One of queryFormats.
+	metadata            string // "ndjson" for a side channel, or "".
+	frames              string // "inner", "outer", or "".
+	order               string // "time", "flow", "arrival", or "".
+
+	chunkBytes    int64 // Limits of each tar chunk, if chunked.
+	chunkDuration time.Duration
+
+	resume   *base.Cursor        // Where to resume results from, or nil.
+	partial  *base.QueryProgress // Set if partial results are OK.
+	deadline time.Duration       // How long partial queries run.
+	flowHead int                 // Packets returned per flow, or 0 for all.
+	slice    base.Transform      // Payload slice, or nil.
+
+	files, transforms, sinks []string
+
+	hash     *base.ResultHash
+	timings  *base.QueryTimings
+	snapshot *base.QuerySnapshot
+}
+
+// parseQueryOptions reads the URL parameters of a /query request whose
+// results are written in 'format', served as 'contentType'.  Errors are the
+// client's fault.
+func parseQueryOptions(vals url.Values, format, contentType string) (*queryOptions, error) {
+	o := &queryOptions{
+		format:      format,
+		contentType: contentType,
+		metadata:    vals.Get("metadata"),
+		frames:      vals.Get("frames"),
+		order:       vals.Get("order"),
+		deadline:    defaultPartialDeadline,
+		files:       listParam(vals, "files"),
+		transforms:  listParam(vals, "transform"),
+		sinks:       listParam(vals, "sinks"),
+	}
+	switch {
+	case o.metadata == "":
+	case o.metadata != "ndjson":
+		return nil, fmt.Errorf("unsupported metadata %q", o.metadata)
+	case format != "pcap":
+		return nil, fmt.Errorf("metadata=ndjson can only be used with format=pcap")
+	}
+	switch o.frames {
+	case "", "outer", "inner":
+	default:
+		return nil, fmt.Errorf("unsupported frames %q", o.frames)
+	}
+	switch o.order {
+	case "", "time", "flow", "arrival":
+	default:
+		return nil, fmt.Errorf("unsupported order %q", o.order)
+	}
+	if err := o.parseChunks(vals); err != nil {
+		return nil, err
+	}
+	if err := o.parseResume(vals); err != nil {
+		return nil, err
+	}
+	if err := o.parsePartial(vals); err != nil {
+		return nil, err
+	}
+	if err := intParam(vals, "flow_head", 1, &o.flowHead); err != nil {
+		return nil, err
+	} else if o.flowHead > 0 && o.resume != nil {
+		// Flows which started before the cursor would be counted from it.
+		return nil, fmt.Errorf("flow_head can't be used with resume_time")
+	}
+	if vals.Get("payload_offset") != "" || vals.Get("payload_length") != "" {
+		offset, length := 0, -1
+		if err := intParam(vals, "payload_offset", 0, &offset); err != nil {
+			return nil, err
+		}
+		if err := intParam(vals, "payload_length", 0, &length); err != nil {
+			return nil, err
+		}
+		o.slice = base.PayloadSlice(offset, length)
+	}
+	if want, err := boolParam(vals, "hash"); err != nil {
+		return nil, err
+	} else if want {
+		if o.order == "flow" || o.order == "arrival" {
+			// The canonical result stream is time-ordered.
+			return nil, fmt.Errorf("hash can't be used with order=%s", o.order)
+		}
+		o.hash = base.NewResultHash()
+	}
+	if want, err := boolParam(vals, "timings"); err != nil {
+		return nil, err
+	} else if want {
+		o.timings = &base.QueryTimings{}
+	}
+	if want, err := boolParam(vals, "snapshot"); err != nil {
+		return nil, err
+	} else if want {
+		o.snapshot = &base.QuerySnapshot{}
+	}
+	return o, nil
+}
+
+// parseChunks reads chunk_bytes and chunk_duration, which split tar output
+// into chunks, and settles the order of unchunked tar output.
+func (o *queryOptions) parseChunks(vals url.Values) error {
+	var chunkBytes int
+	if err := intParam(vals, "chunk_bytes", 1, &chunkBytes); err != nil {
+		return err
+	}
+	o.chunkBytes = int64(chunkBytes)
+	if err := durationParam(vals, "chunk_duration", &o.chunkDuration); err != nil {
+		return err
+	}
+	if o.chunked() && o.format != "tar" {
+		return fmt.Errorf("chunk_bytes and chunk_duration can only be used with format=tar")
+	}
+	if o.format == "tar" && !o.chunked() {
+		// Each flow's packets must be together to go in a file of their own.
+		if o.order == "time" {
+			return fmt.Errorf("format=tar can't be used with order=time")
+		}
+		o.order = "flow"
+	}
+	return nil
+}
+
+// parseResume reads resume_time and resume_skip, the cursor a query resumes
+// from.
+func (o *queryOptions) parseResume(vals url.Values) error {
+	rt := vals.Get("resume_time")
+	if rt == "" {
+		return nil
+	}
+	resume := &base.Cursor{}
+	var err error
+	if resume.Time, err = time.Parse(time.RFC3339Nano, rt); err != nil {
+		return fmt.Errorf("invalid resume_time %q", rt)
+	}
+	if err := intParam(vals, "resume_skip", 0, &resume.Skip); err != nil {
+		return err
+	}
+	if o.order == "flow" || o.order == "arrival" {
+		// Only time-ordered results can be resumed from a timestamp.
+		return fmt.Errorf("resume_time can't be used with order=%s", o.order)
+	}
+	o.resume = resume
+	return nil
+}
+
+// parsePartial reads partial_ok and deadline, which let a query return what
+// it found in time.
+func (o *queryOptions) parsePartial(vals url.Values) error {
+	want, err := boolParam(vals, "partial_ok")
+	if err != nil {
+		return err
+	}
+	if err := durationParam(vals, "deadline", &o.deadline); err != nil {
+		return err
+	} else if !want && vals.Get("deadline") != "" {
+		return fmt.Errorf("deadline requires partial_ok")
+	}
+	if !want {
+		return nil
+	}
+	switch o.order {
+	case "flow":
+		// No flow is complete until all packets have been seen.
+		return fmt.Errorf("partial_ok can't be used with order=flow")
+	case "arrival":
+		// Without time order, there's no time before which results are complete.
+		return fmt.Errorf("partial_ok can't be used with order=arrival")
+	}
+	o.partial = &base.QueryProgress{}
+	return nil
+}
+
+// withContext attaches the per-query state the options ask for to ctx,
+// declaring the trailers it's reported in (see setTrailers).  The returned
+// function releases the partial results deadline.
+func (o *queryOptions) withContext(ctx context.Context, w http.ResponseWriter) (context.Context, context.CancelFunc) {
+	cancel := context.CancelFunc(func() {})
+	if o.timings != nil {
+		// Timings are only known once all packets have been written, so they're
+		// sent as a trailer rather than corrupting the PCAP stream.
+		w.Header().Add("Trailer", timingsTrailer)
+		ctx = base.WithQueryTimings(ctx, o.timings)
+	}
+	if o.snapshot != nil {
+		w.Header().Add("Trailer", snapshotTrailer)
+		ctx = base.WithQuerySnapshot(ctx, o.snapshot)
+	}
+	if o.partial != nil {
+		// The summary depends on how writing results went, so the caller sets
+		// it.
+		w.Header().Add("Trailer", partialTrailer)
+		ctx, cancel = context.WithTimeout(base.WithQueryProgress(ctx, o.partial), o.deadline)
+	}
+	if o.order == "arrival" {
+		ctx = base.WithArrivalOrder(ctx)
+	}
+	return ctx, cancel
+}
+
+// setTrailers sets the timings and snapshot trailers declared by withContext,
+// once query q's results have been written.
+func (o *queryOptions) setTrailers(w http.ResponseWriter, q query.Query) {
+	if o.timings != nil {
+		v(1, "Query %q timings: %s", q, setJSONTrailer(w, timingsTrailer, o.timings.Summary()))
+	}
+	if o.snapshot != nil {
+		setJSONTrailer(w, snapshotTrailer, o.snapshot.List())
+	}
+}
+
+// chunked returns whether tar output is split into chunks.
+func (o *queryOptions) chunked() bool {
+	return o.chunkBytes > 0 || o.chunkDuration > 0
+}
+
+// replayable returns whether the query can be replayed from its text alone,
+// as when it's recorded in a workload.
+func (o *queryOptions) replayable() bool {
+	return o.resume == nil && len(o.files) == 0 && o.partial == nil && o.flowHead == 0
+}
+
+// process applies the options which work on a query's packets as they're
+// looked up, followed by 'transform' if it's set.
+func (o *queryOptions) process(ctx context.Context, packets *base.PacketChan, transform base.Transform) *base.PacketChan {
+	if o.resume != nil {
+		packets = base.ResumePacketChan(packets, *o.resume)
+	}
+	if o.partial != nil {
+		packets = base.TransformPacketChan(packets, o.partial.Returned)
+	}
+	if o.frames == "inner" {
+		packets = base.TransformPacketChan(packets, base.Decapsulate)
+	}
+	if o.flowHead > 0 {
+		packets = base.FirstPacketsPerFlow(packets, o.flowHead)
+	}
+	if o.slice != nil {
+		packets = base.TransformPacketChan(packets, o.slice.Transform)
+	}
+	if transform != nil {
+		packets = base.TransformPacketChan(packets, transform.Transform)
+	}
+	if o.order == "flow" {
+		packets = base.GroupPacketsByFlow(ctx, packets)
+	}
+	return packets
+}
+
+// listParam returns the values of a URL parameter which may be given more
+// than once, each a comma-separated list.
+func listParam(vals url.Values, name string) (out []string) {
+	for _, v := range vals[name] {
+		out = append(out, strings.Split(v, ",")...)
+	}
+	return out
+}
+
+// boolParam returns the value of a boolean URL parameter, false if it's
+// unset.
+func boolParam(vals url.Values, name string) (bool, error) {
+	s := vals.Get(name)
+	if s == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return b, nil
+}
+
+// intParam sets *n to the value of an integer URL parameter, which must be at
+// least 'min', leaving it alone if the parameter's unset.
+func intParam(vals url.Values, name string, min int, n *int) error {
+	s := vals.Get(name)
+	if s == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < min {
+		return fmt.Errorf("invalid %s %q", name, s)
+	}
+	*n = i
+	return nil
+}
+
+// durationParam sets *d to the value of a positive duration URL parameter,
+// leaving it alone if the parameter's unset.
+func durationParam(vals url.Values, name string, d *time.Duration) error {
+	s := vals.Get(name)
+	if s == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil || parsed <= 0 {
+		return fmt.Errorf("invalid %s %q", name, s)
+	}
+	*d = parsed
+	return nil
+}
+
+// setJSONTrailer sets an HTTP trailer to the JSON encoding of 'value',
+// returning the encoding, or "" if it couldn't be encoded.
+func setJSONTrailer(w http.ResponseWriter, trailer string, value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("could not encode %s trailer: %v", trailer, err)
+		return ""
+	}
+	w.Header().Set(trailer, string(encoded))
+	return string(encoded)
+}
@@ -0,0 +1,145 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	retentionSLOCompliant  = stats.S.Get("retention_slo_compliant")
+	retentionSLOViolations = stats.S.Get("retention_slo_violations")
+	retentionMinSeconds    = stats.S.Get("retention_min_seconds")
+)
+
+// retentionSLO checks every thread's retention, the age of its oldest file,
+// against a configured minimum.
+type retentionSLO struct {
+	minAge, interval time.Duration
+	webhook          string
+	violated         bool // Whether the last check found a thread short.
+}
+
+func newRetentionSLO(c config.RetentionSLOConfig) (*retentionSLO, error) {
+	minAge, interval, err := c.Durations()
+	if err != nil {
+		return nil, err
+	}
+	return &retentionSLO{minAge: minAge, interval: interval, webhook: c.Webhook}, nil
+}
+
+// RetentionReport is what the retention SLO webhook is sent when the SLO
+// starts or stops being met.
+type RetentionReport struct {
+	Sensor    string
+	Time      time.Time
+	MinAge    string // The retention promised.
+	Compliant bool
+	Threads   []ThreadRetention
+}
+
+// ThreadRetention is the retention of one thread.
+type ThreadRetention struct {
+	Thread    int
+	Oldest    time.Time `json:",omitempty"` // Zero if the thread has no files.
+	Retention string
+	Compliant bool
+}
+
+// checkRetentionSLO compares each thread's retention with the SLO.  A thread
+// short of it is only in violation once it's had the chance to meet it:
+// either stenographer has been running for MinAge, or the thread has already
+// deleted files to make room.
+func (d *Env) checkRetentionSLO() {
+	s := d.retention
+	now := time.Now()
+	report := RetentionReport{Sensor: d.sensor, Time: now, MinAge: s.minAge.String(), Compliant: true}
+	var min time.Duration
+	for i, t := range d.threads {
+		st := t.Status()
+		tr := ThreadRetention{Thread: st.ID, Oldest: st.Oldest, Compliant: true}
+		var age time.Duration
+		if !st.Oldest.IsZero() {
+			age = now.Sub(st.Oldest)
+		}
+		if i == 0 || age < min {
+			min = age
+		}
+		tr.Retention = age.Round(time.Second).String()
+		if age < s.minAge && (st.Pruned || now.Sub(d.started) >= s.minAge) {
+			tr.Compliant, report.Compliant = false, false
+		}
+		report.Threads = append(report.Threads, tr)
+	}
+	retentionMinSeconds.Set(int64(min / time.Second))
+	if report.Compliant {
+		retentionSLOCompliant.Set(1)
+	} else {
+		retentionSLOCompliant.Set(0)
+	}
+	if report.Compliant != s.violated {
+		return // No change.
+	}
+	s.violated = !report.Compliant
+	if s.violated {
+		retentionSLOViolations.Increment()
+		log.Printf("Retention SLO of %v violated: shortest thread retention %v", s.minAge, min.Round(time.Second))
+		events.H.Add(events.Error, "Retention SLO of %v violated: shortest thread retention %v", s.minAge, min.Round(time.Second))
+	} else {
+		log.Printf("Retention SLO of %v met again", s.minAge)
+	}
+	if s.webhook != "" {
+		if err := d.postRetentionReport(report); err != nil {
+			log.Printf("Retention SLO webhook failed: %v", err)
+			events.H.Add(events.Error, "Retention SLO webhook failed: %v", err)
+		}
+	}
+}
+
+func (d *Env) postRetentionReport(report RetentionReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", d.retention.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	ctx := base.NewContext(time.Minute)
+	defer ctx.Cancel()
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("posting to %q: %v", d.retention.webhook, resp.Status)
+	}
+	return nil
+}
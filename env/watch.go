@@ -0,0 +1,101 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"log"
+	"time"
+
+	"github.com/mars-suite/stenographer/stats"
+	"github.com/mars-suite/stenographer/thread"
+)
+
+var watchedSyncs = stats.S.Get("watched_file_syncs")
+
+const (
+	// watchedSyncFrequency is how often threads' files are synced when their
+	// directories are watched for new files, for disk cleanup and in case an
+	// event was missed.
+	watchedSyncFrequency = time.Minute
+	// watchSettleTime is how long after a change is seen to wait for more
+	// before syncing, since stenotype renames a blockfile and then its index.
+	watchSettleTime = 100 * time.Millisecond
+)
+
+// syncFilesOnChange syncs threads' files as soon as stenotype adds to their
+// directories, so new files are queryable without waiting for the next poll,
+// and polls only every watchedSyncFrequency.  If the directories can't be
+// watched, it falls back to polling every fileSyncFrequency.
+func (d *Env) syncFilesOnChange() {
+	dirs := make([][2]string, len(d.threads))
+	for i, t := range d.threads {
+		c := d.conf.Threads[t.ID()]
+		dirs[i] = [2]string{c.PacketsDirectory, c.IndexDirectory}
+	}
+	w, err := newFileWatcher(d.threads, dirs)
+	if err != nil {
+		log.Printf("Not watching for new files, polling every %v instead: %v", fileSyncFrequency, err)
+		d.callEvery(d.syncFiles, fileSyncFrequency)
+		return
+	}
+	changes := make(chan map[*thread.Thread]bool)
+	go func() {
+		err := w.changes(changes, d.done)
+		select {
+		case <-d.done:
+			// Reads fail once the watcher's closed on shutdown.
+		default:
+			log.Printf("Stopped watching for new files, polling every %v instead: %v", fileSyncFrequency, err)
+		}
+		close(changes)
+	}()
+	d.syncFiles()
+	ticker := time.NewTicker(watchedSyncFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			w.close()
+			return
+		case <-ticker.C:
+			d.syncFiles()
+		case changed, ok := <-changes:
+			if !ok {
+				d.callEvery(d.syncFiles, fileSyncFrequency)
+				return
+			}
+			// Gather up the rest of a burst of changes.
+			settle := time.After(watchSettleTime)
+		settling:
+			for {
+				select {
+				case more, ok := <-changes:
+					if !ok {
+						break settling
+					}
+					for t := range more {
+						changed[t] = true
+					}
+				case <-settle:
+					break settling
+				}
+			}
+			for t := range changed {
+				watchedSyncs.Increment()
+				t.SyncFiles()
+			}
+		}
+	}
+}
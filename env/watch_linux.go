@@ -0,0 +1,91 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/mars-suite/stenographer/thread"
+	"golang.org/x/sys/unix"
+)
+
+// watchEvents are the changes that can mean a thread has new files:
+// stenotype creates hidden files while writing, then renames them.
+const watchEvents = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// fileWatcher watches threads' packet and index directories with inotify.
+type fileWatcher struct {
+	f       *os.File
+	threads map[int32]*thread.Thread // By watch descriptor.
+}
+
+// newFileWatcher starts watching the directories of the given threads.
+func newFileWatcher(threads []*thread.Thread, dirs [][2]string) (*fileWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify unavailable: %v", err)
+	}
+	// Non-blocking, so reads go through the runtime's poller.
+	w := &fileWatcher{f: os.NewFile(uintptr(fd), "inotify"), threads: map[int32]*thread.Thread{}}
+	for i, t := range threads {
+		for _, dir := range dirs[i] {
+			wd, err := unix.InotifyAddWatch(fd, dir, watchEvents)
+			if err != nil {
+				w.close()
+				return nil, fmt.Errorf("could not watch %q: %v", dir, err)
+			}
+			w.threads[int32(wd)] = t
+		}
+	}
+	return w, nil
+}
+
+// changes sends each batch of threads with changed directories, until reading
+// events fails or 'done' is closed.
+func (w *fileWatcher) changes(out chan<- map[*thread.Thread]bool, done <-chan bool) error {
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return err
+		}
+		changed := map[*thread.Thread]bool{}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				// Events were lost, so any thread might have changed.
+				for _, t := range w.threads {
+					changed[t] = true
+				}
+			} else if t := w.threads[ev.Wd]; t != nil {
+				changed[t] = true
+			}
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+		}
+		if len(changed) > 0 {
+			select {
+			case out <- changed:
+			case <-done:
+				return nil
+			}
+		}
+	}
+}
+
+func (w *fileWatcher) close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,38 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package env
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/mars-suite/stenographer/thread"
+)
+
+// fileWatcher is only implemented with inotify, so elsewhere threads' files
+// are always polled for.
+type fileWatcher struct{}
+
+func newFileWatcher(threads []*thread.Thread, dirs [][2]string) (*fileWatcher, error) {
+	return nil, fmt.Errorf("watching directories not supported on %s", runtime.GOOS)
+}
+
+func (w *fileWatcher) changes(out chan<- map[*thread.Thread]bool, done <-chan bool) error {
+	return fmt.Errorf("watching directories not supported on %s", runtime.GOOS)
+}
+
+func (w *fileWatcher) close() error { return nil }
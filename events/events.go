@@ -0,0 +1,115 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events keeps a short in-memory history of significant daemon events
+// (file rotations, deletions, stenotype restarts, errors), which can be
+// queried over HTTP to quickly answer "what happened at 02:00?".
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	NewFile       = "new_file"
+	DeleteFile    = "delete_file"
+	StenotypeRun  = "stenotype_start"
+	StenotypeStop = "stenotype_stop"
+	Error         = "error"
+)
+
+// Event is a single thing that happened.
+type Event struct {
+	Time    time.Time
+	Type    string
+	Message string
+}
+
+// History is a fixed-size ring buffer of events, dropping the oldest events
+// once full.
+type History struct {
+	mu     sync.Mutex
+	events []Event
+	next   int // Index in events to write the next event to.
+	full   bool
+}
+
+// New returns a History holding up to size events.
+func New(size int) *History {
+	return &History{events: make([]Event, size)}
+}
+
+// Add records a new event of the given type.
+func (h *History) Add(typ string, format string, args ...interface{}) {
+	e := Event{Time: time.Now(), Type: typ, Message: fmt.Sprintf(format, args...)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events[h.next] = e
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Between returns all events within [start, end] in the order they happened.
+// If typ is not empty, only events of that type are returned.
+func (h *History) Between(start, end time.Time, typ string) (out []Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	events := h.events[:h.next]
+	if h.full {
+		events = append(append([]Event{}, h.events[h.next:]...), events...)
+	}
+	for _, e := range events {
+		if e.Time.Before(start) || e.Time.After(end) || (typ != "" && e.Type != typ) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ServeHTTP makes History an http.Handler, returning events as JSON.  Events
+// can be filtered with the 'start' and 'end' (RFC3339) and 'type' URL
+// parameters.
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+	start, err := parseTime(vals.Get("start"), time.Time{})
+	if err != nil {
+		http.Error(w, "bad start", http.StatusBadRequest)
+		return
+	}
+	end, err := parseTime(vals.Get("end"), time.Unix(1<<62, 0))
+	if err != nil {
+		http.Error(w, "bad end", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.Between(start, end, vals.Get("type")))
+}
+
+// H is a History singleton.
+var H = New(10000)
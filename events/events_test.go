@@ -0,0 +1,52 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package events
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func messages(events []Event) (out []string) {
+	for _, e := range events {
+		out = append(out, e.Message)
+	}
+	return out
+}
+
+func TestHistory(t *testing.T) {
+	h := New(3)
+	all := func() []string { return messages(h.Between(time.Time{}, time.Now(), "")) }
+	if got := all(); got != nil {
+		t.Errorf("empty history returned %q", got)
+	}
+	h.Add(NewFile, "a")
+	h.Add(Error, "b %d", 1)
+	if got, want := all(), []string{"a", "b 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %q got %q", want, got)
+	}
+	h.Add(NewFile, "c")
+	h.Add(DeleteFile, "d")
+	if got, want := all(), []string{"b 1", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ring buffer: want %q got %q", want, got)
+	}
+	if got, want := messages(h.Between(time.Time{}, time.Now(), NewFile)), []string{"c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("type filter: want %q got %q", want, got)
+	}
+	if got := messages(h.Between(time.Now().Add(time.Hour), time.Now().Add(2*time.Hour), "")); got != nil {
+		t.Errorf("time filter returned %q", got)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mars-suite/stenographer/config"
+	"golang.org/x/net/context"
+)
+
+// gcsEndpoint is where Cloud Storage's JSON API is served.
+var gcsEndpoint = "https://storage.googleapis.com"
+
+// azureVersion is the Blob Storage REST API version requested, the first to
+// set immutability policies and legal holds as blobs are written.
+const azureVersion = "2020-10-02"
+
+// azureBlockSize is the size of the blocks Azure uploads are sent in.
+const azureBlockSize = 4 << 20
+
+// objectName returns the name a file is stored under in a bucket or
+// container, below 'prefix':  <sensor>/<thread>/<name>.pcap.gz, like upload
+// URLs.
+func objectName(prefix, sensor string, f File) string {
+	return path.Join(prefix, sensor, strconv.Itoa(f.Thread), f.Name+".pcap.gz")
+}
+
+// readToken returns the access token in 'file', or "" if there's no file.
+func readToken(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("could not read token: %v", err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// send makes a request with the given access token, returning the response's
+// headers if it succeeded.
+func send(ctx context.Context, client *http.Client, req *http.Request, token string) (http.Header, error) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return resp.Header, nil
+}
+
+// retainUntil returns when an object uploaded now may be deleted under
+// 'r', or the zero time if it has no retention period.
+func retainUntil(r *config.RetentionConfig) time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	if d, _ := r.PeriodDuration(); d > 0 { // Checked by validate.
+		return time.Now().Add(d).UTC()
+	}
+	return time.Time{}
+}
+
+// gcsUploader uploads each file as a gzipped PCAP to a Cloud Storage bucket,
+// with a resumable upload session:  the object's metadata (including its
+// retention and hold) starts the session, then the file is sent to it in one
+// request.
+type gcsUploader struct {
+	bucket, prefix string
+	client         *http.Client
+	sensor         string
+	loc            *time.Location // The sensor's time zone.
+	c              config.ExportConfig
+}
+
+func newGCSUploader(c config.ExportConfig, client *http.Client, sensor string, loc *time.Location) (*gcsUploader, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &gcsUploader{bucket: u.Host, prefix: strings.Trim(u.Path, "/"), client: client, sensor: sensor, loc: loc, c: c}, nil
+}
+
+func (u *gcsUploader) String() string { return "upload to " + u.c.URL }
+
+func (u *gcsUploader) Export(ctx context.Context, f File) error {
+	name := objectName(u.prefix, u.sensor, f)
+	token, err := readToken(u.c.TokenFile)
+	if err != nil {
+		return err
+	}
+	object := map[string]interface{}{"name": name, "contentType": "application/gzip"}
+	if len(u.c.Metadata) > 0 {
+		object["metadata"] = u.c.Metadata
+	}
+	if until := retainUntil(u.c.Retention); !until.IsZero() {
+		mode := "Unlocked"
+		if u.c.Retention.Locked {
+			mode = "Locked"
+		}
+		object["retention"] = map[string]string{"mode": mode, "retainUntilTime": until.Format(time.RFC3339)}
+	}
+	if u.c.Retention != nil && u.c.Retention.LegalHold {
+		object["temporaryHold"] = true
+	}
+	body, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable", gcsEndpoint, url.PathEscape(u.bucket)), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set("X-Upload-Content-Type", "application/gzip")
+	header, err := send(ctx, u.client, req, token)
+	if err != nil {
+		return fmt.Errorf("starting upload of gs://%s/%s: %v", u.bucket, name, err)
+	}
+	session := header.Get("Location")
+	if session == "" {
+		return fmt.Errorf("starting upload of gs://%s/%s: no upload session", u.bucket, name)
+	}
+	pcap := gzippedPCAP(ctx, f)
+	defer pcap.Close()
+	if req, err = http.NewRequest("PUT", session, newShapedReader(ctx, pcap, u.c, u.loc)); err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	if _, err := send(ctx, u.client, req, token); err != nil {
+		return fmt.Errorf("uploading gs://%s/%s: %v", u.bucket, name, err)
+	}
+	v(1, "Uploaded gs://%s/%s", u.bucket, name)
+	return nil
+}
+
+// azureUploader uploads each file as a gzipped PCAP to an Azure Blob Storage
+// container, as a block blob:  the file is sent in blocks, then committed
+// with a block list setting the blob's metadata, immutability policy, and
+// legal hold.
+type azureUploader struct {
+	container *url.URL // Including any prefix, and any SAS token.
+	client    *http.Client
+	sensor    string
+	loc       *time.Location // The sensor's time zone.
+	c         config.ExportConfig
+}
+
+func newAzureUploader(c config.ExportConfig, client *http.Client, sensor string, loc *time.Location) (*azureUploader, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &azureUploader{container: u, client: client, sensor: sensor, loc: loc, c: c}, nil
+}
+
+func (u *azureUploader) String() string {
+	return "upload to " + u.container.Scheme + "://" + u.container.Host + u.container.Path
+}
+
+func (u *azureUploader) Export(ctx context.Context, f File) error {
+	blob := *u.container
+	blob.Path = "/" + objectName(strings.Trim(u.container.Path, "/"), u.sensor, f)
+	name := blob.Host + blob.Path // Without the SAS token, for errors.
+	token, err := readToken(u.c.TokenFile)
+	if err != nil {
+		return err
+	}
+	pcap := gzippedPCAP(ctx, f)
+	defer pcap.Close()
+	r := newShapedReader(ctx, pcap, u.c, u.loc)
+	buf := make([]byte, azureBlockSize)
+	var ids []string
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+			if err := u.put(ctx, blob, url.Values{"comp": {"block"}, "blockid": {id}}, buf[:n], nil, token); err != nil {
+				return fmt.Errorf("uploading block %d of %q: %v", len(ids), name, err)
+			}
+			ids = append(ids, id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("uploading %q: %v", name, err)
+		}
+	}
+	var list bytes.Buffer
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range ids {
+		fmt.Fprintf(&list, "<Latest>%s</Latest>", id)
+	}
+	list.WriteString("</BlockList>")
+	header := http.Header{}
+	header.Set("X-Ms-Blob-Content-Type", "application/gzip")
+	for k, val := range u.c.Metadata {
+		header["x-ms-meta-"+k] = []string{val} // Names keep their case.
+	}
+	if until := retainUntil(u.c.Retention); !until.IsZero() {
+		mode := "Unlocked"
+		if u.c.Retention.Locked {
+			mode = "Locked"
+		}
+		header.Set("X-Ms-Immutability-Policy-Until-Date", until.Format(http.TimeFormat))
+		header.Set("X-Ms-Immutability-Policy-Mode", mode)
+	}
+	if u.c.Retention != nil && u.c.Retention.LegalHold {
+		header.Set("X-Ms-Legal-Hold", "true")
+	}
+	if err := u.put(ctx, blob, url.Values{"comp": {"blocklist"}}, list.Bytes(), header, token); err != nil {
+		return fmt.Errorf("committing %q: %v", name, err)
+	}
+	v(1, "Uploaded %q in %d blocks", name, len(ids))
+	return nil
+}
+
+// put PUTs 'body' to the blob with the given query parameters added to its
+// URL, and the given headers.
+func (u *azureUploader) put(ctx context.Context, blob url.URL, params url.Values, body []byte, header http.Header, token string) error {
+	query := blob.Query()
+	for k, vals := range params {
+		query[k] = vals
+	}
+	blob.RawQuery = query.Encode()
+	req, err := http.NewRequest("PUT", blob.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, vals := range header {
+		req.Header[k] = vals
+	}
+	req.Header.Set("X-Ms-Version", azureVersion)
+	req.Header.Set("X-Ms-Date", time.Now().UTC().Format(http.TimeFormat))
+	_, err = send(ctx, u.client, req, token)
+	return err
+}
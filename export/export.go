@@ -0,0 +1,391 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export archives blockfiles somewhere colder before the disk cleaner
+// deletes them, as a compressed PCAP upload (to a web server, Cloud Storage, or
+// Azure Blob Storage), a flow summary, a Parquet table of packet metadata, or
+// an extract of just the packets matching a query.
+package export
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/parquet"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
+)
+
+var v = base.V // verbose logging
+
+// File is a blockfile to export.
+type File struct {
+	Thread    int
+	Name      string
+	Blockfile *blockfile.BlockFile
+}
+
+// Exporter archives blockfiles.  Export must have finished with the file by
+// the time it returns, since the file may be deleted immediately after.
+type Exporter interface {
+	Export(ctx context.Context, f File) error
+	String() string
+}
+
+// New returns the exporter described by the given config.  Uploads are made
+// with 'client', under a path including 'sensor', and their bandwidth
+// schedules are in the time zone of 'parser', which parses extract queries.
+func New(c config.ExportConfig, client *http.Client, sensor string, parser *query.Parser) (Exporter, error) {
+	loc := parser.Location()
+	switch c.Type {
+	case "upload":
+		return &uploader{url: strings.TrimSuffix(c.URL, "/"), client: client, sensor: sensor, loc: loc, c: c}, nil
+	case "gcs":
+		return newGCSUploader(c, client, sensor, loc)
+	case "azure":
+		return newAzureUploader(c, client, sensor, loc)
+	case "flows":
+		return &flowSummarizer{dir: c.Directory}, nil
+	case "parquet":
+		return &metadataWriter{dir: c.Directory}, nil
+	case "extract":
+		q, err := parser.Parse(c.Query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extract query %q: %v", c.Query, err)
+		}
+		return &extractor{dir: c.Directory, q: q}, nil
+	}
+	return nil, fmt.Errorf("invalid exporter type %q", c.Type)
+}
+
+// uploader PUTs each file as a gzipped PCAP to
+// <url>/<sensor>/<thread>/<name>.pcap.gz, within the config's bandwidth
+// limits.
+//
+// Uploads interrupted partway through are resumed:  before each PUT, the
+// uploader asks the server how much of the file it already has with a HEAD
+// request, and if a 2xx response has an Upload-Offset header, it sends only
+// the rest, with the same Upload-Offset header and a matching Content-Range.
+// Servers which don't support this (responding to HEAD without the header,
+// or with an error) get the whole file every time.
+type uploader struct {
+	url    string
+	client *http.Client
+	sensor string
+	loc    *time.Location // The sensor's time zone.
+	c      config.ExportConfig
+}
+
+func (u *uploader) String() string { return "upload to " + u.url }
+
+func (u *uploader) Export(ctx context.Context, f File) error {
+	url := fmt.Sprintf("%s/%s/%d/%s.pcap.gz", u.url, u.sensor, f.Thread, f.Name)
+	offset, err := u.uploaded(ctx, url)
+	if err != nil {
+		return err
+	}
+	pr := gzippedPCAP(ctx, f)
+	defer pr.Close()
+	if offset > 0 {
+		// The gzipped PCAP is the same every time, so skip what the server
+		// already has.
+		if _, err := io.CopyN(ioutil.Discard, pr, offset); err != nil {
+			return fmt.Errorf("resuming %q at %d: %v", url, offset, err)
+		}
+		uploadResumedBytes.IncrementBy(offset)
+		v(1, "Resuming upload of %q at %d", url, offset)
+	}
+	req, err := http.NewRequest("PUT", url, newShapedReader(ctx, pr, u.c, u.loc))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "gzip")
+	if offset > 0 {
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-*/*", offset))
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("uploading %q: %v", url, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("uploading %q: %v", url, resp.Status)
+	}
+	v(1, "Uploaded %q", url)
+	return nil
+}
+
+// gzippedPCAP returns a reader of the file's packets as a gzipped PCAP, which
+// must be closed.
+func gzippedPCAP(ctx context.Context, f File) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := base.PacketsToFile(f.Blockfile.AllPackets(ctx), gz, base.Limit{})
+		if err == nil {
+			err = gz.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// uploaded returns how much of 'url' the server already has from an
+// interrupted upload, or 0 if it has none or doesn't support resuming.
+func (u *uploader) uploaded(ctx context.Context, url string) (int64, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("checking %q: %v", url, err)
+	}
+	resp.Body.Close()
+	header := resp.Header.Get("Upload-Offset")
+	if resp.StatusCode/100 != 2 || header == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("checking %q: invalid Upload-Offset %q", url, header)
+	}
+	return offset, nil
+}
+
+// writeFile atomically writes dir/<thread>/<name><ext> with 'write', so a
+// failed export never leaves a partial file behind.
+func writeFile(dir string, f File, ext string, write func(io.Writer) error) error {
+	dir = filepath.Join(dir, strconv.Itoa(f.Thread))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+f.Name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, f.Name+ext))
+}
+
+// Flow is a flow's entry in a flow summary.  Both directions of a flow share
+// an entry.
+type Flow struct {
+	Network, Transport string
+	Packets, Bytes     int64
+	First, Last        time.Time
+}
+
+// flowSummarizer writes each file's flows to <dir>/<thread>/<name>.flows.json,
+// one JSON Flow per line in order of their first packet.
+type flowSummarizer struct {
+	dir string
+}
+
+func (s *flowSummarizer) String() string { return "flow summary in " + s.dir }
+
+func (s *flowSummarizer) Export(ctx context.Context, f File) error {
+	flows, err := SummarizeFlows(ctx, f.Blockfile)
+	if err != nil {
+		return err
+	}
+	return writeFile(s.dir, f, ".flows.json", func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, fl := range flows {
+			if err := enc.Encode(fl); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SummarizeFlows returns the flows of all packets in a blockfile, in order of
+// their first packet.
+func SummarizeFlows(ctx context.Context, bf *blockfile.BlockFile) ([]*Flow, error) {
+	type key struct{ network, transport gopacket.Flow }
+	flows := map[key]*Flow{}
+	var order []*Flow
+	packets := bf.AllPackets(ctx)
+	defer packets.Discard()
+	for p := range packets.Receive() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var k key
+		k.network, k.transport = base.PacketFlow(p)
+		fl := flows[k]
+		if fl == nil {
+			fl = &Flow{Network: k.network.String(), Transport: k.transport.String(), First: p.Timestamp}
+			flows[k] = fl
+			order = append(order, fl)
+		}
+		fl.Packets++
+		fl.Bytes += int64(p.Length)
+		if p.Timestamp.Before(fl.First) {
+			fl.First = p.Timestamp
+		}
+		if p.Timestamp.After(fl.Last) {
+			fl.Last = p.Timestamp
+		}
+	}
+	if err := packets.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].First.Before(order[j].First) })
+	return order, nil
+}
+
+// metadataColumns are the columns of a Parquet metadata export.  Addresses and
+// protocol are null for non-IP packets, ports for packets which aren't TCP or
+// UDP, TCP flags for non-TCP packets, and VLAN for untagged packets.
+var metadataColumns = []parquet.Column{
+	{Name: "timestamp", Type: parquet.Timestamp},
+	{Name: "src_ip", Type: parquet.String, Optional: true},
+	{Name: "dst_ip", Type: parquet.String, Optional: true},
+	{Name: "src_port", Type: parquet.Int32, Optional: true},
+	{Name: "dst_port", Type: parquet.Int32, Optional: true},
+	{Name: "protocol", Type: parquet.Int32, Optional: true},
+	{Name: "length", Type: parquet.Int32},
+	{Name: "capture_length", Type: parquet.Int32},
+	{Name: "tcp_flags", Type: parquet.Int32, Optional: true},
+	{Name: "vlan", Type: parquet.Int32, Optional: true},
+}
+
+// metadataWriter writes each file's packet metadata, without payloads, to
+// <dir>/<thread>/<name>.parquet, one row per packet in metadataColumns.
+type metadataWriter struct {
+	dir string
+}
+
+func (m *metadataWriter) String() string { return "packet metadata in " + m.dir }
+
+func (m *metadataWriter) Export(ctx context.Context, f File) error {
+	return writeFile(m.dir, f, ".parquet", func(w io.Writer) error {
+		pw := parquet.NewWriter(w, metadataColumns)
+		packets := f.Blockfile.AllPackets(ctx)
+		defer packets.Discard()
+		for p := range packets.Receive() {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err := pw.Write(packetMetadata(p)...); err != nil {
+				return err
+			}
+		}
+		if err := packets.Err(); err != nil {
+			return err
+		}
+		return pw.Close()
+	})
+}
+
+// packetMetadata returns a packet's row in a metadata export.
+func packetMetadata(p *base.Packet) []interface{} {
+	row := make([]interface{}, len(metadataColumns))
+	row[0] = p.Timestamp
+	row[6] = int32(p.Length)
+	row[7] = int32(p.CaptureLength)
+	pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	if l, ok := pkt.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q); ok {
+		row[9] = int32(l.VLANIdentifier)
+	}
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		row[1], row[2], row[5] = l.SrcIP.String(), l.DstIP.String(), int32(l.Protocol)
+	case *layers.IPv6:
+		row[1], row[2], row[5] = l.SrcIP.String(), l.DstIP.String(), int32(l.NextHeader)
+	}
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		row[3], row[4] = int32(l.SrcPort), int32(l.DstPort)
+		if len(l.Contents) > 13 {
+			row[8] = int32(l.Contents[13])
+		}
+	case *layers.UDP:
+		row[3], row[4] = int32(l.SrcPort), int32(l.DstPort)
+	}
+	return row
+}
+
+// PacketsToParquet writes the metadata of the packets from 'in', without
+// payloads, as a Parquet file with the columns of a metadata export.
+func PacketsToParquet(in *base.PacketChan, out io.Writer, limit base.Limit) error {
+	pw := parquet.NewWriter(out, metadataColumns)
+	if err := base.PacketsToFunc(in, limit, func(p *base.Packet) error {
+		return pw.Write(packetMetadata(p)...)
+	}); err != nil {
+		return err
+	}
+	return pw.Close()
+}
+
+// PacketsToNDJSON writes the metadata of the packets from 'in' as
+// newline-delimited JSON, one object per packet with the non-null columns of
+// a metadata export.
+func PacketsToNDJSON(in *base.PacketChan, out io.Writer, limit base.Limit) error {
+	enc := json.NewEncoder(out)
+	return base.PacketsToFunc(in, limit, func(p *base.Packet) error {
+		obj := map[string]interface{}{}
+		for i, value := range packetMetadata(p) {
+			if value != nil {
+				obj[metadataColumns[i].Name] = value
+			}
+		}
+		return enc.Encode(obj)
+	})
+}
+
+// extractor writes each file's packets matching a query to
+// <dir>/<thread>/<name>.pcap, such as just the traffic of a few subnets.
+type extractor struct {
+	dir string
+	q   query.Query
+}
+
+func (e *extractor) String() string { return fmt.Sprintf("extract of %v in %s", e.q, e.dir) }
+
+func (e *extractor) Export(ctx context.Context, f File) error {
+	return writeFile(e.dir, f, ".pcap", func(w io.Writer) error {
+		packets := base.NewPacketChan(100)
+		ctx := base.WithCaptureSource(ctx, base.CaptureSource{Thread: f.Thread, Directory: filepath.Dir(f.Blockfile.Name())})
+		go f.Blockfile.Lookup(ctx, e.q, packets)
+		return base.PacketsToFile(packets, w, base.Limit{})
+	})
+}
@@ -0,0 +1,488 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
+)
+
+var ctx = context.Background()
+
+func testFile(t *testing.T) File {
+	// Opened from a copy, since opening it writes a lock file beside its index.
+	dir := t.TempDir()
+	if err := exec.Command("cp", "-r", "../testdata", dir).Run(); err != nil {
+		t.Fatalf("could not copy testdata: %v", err)
+	}
+	bf, err := blockfile.NewBlockFile(filepath.Join(dir, "testdata", "PKT0", "dhcp"), filecache.NewCache(10), blockfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bf.Close() })
+	return File{Thread: 0, Name: "dhcp", Blockfile: bf}
+}
+
+func countPackets(t *testing.T, r io.Reader) int {
+	pr, err := pcapgo.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		if _, _, err := pr.ReadPacketData(); err == io.EOF {
+			return n
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+func allPackets(t *testing.T, f File) int {
+	n := 0
+	c := f.Blockfile.AllPackets(context.Background())
+	for range c.Receive() {
+		n++
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestUpload(t *testing.T) {
+	f := testFile(t)
+	var gotPath string
+	var gotPackets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			http.NotFound(w, r)
+			return
+		}
+		gotPath = r.URL.Path
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		gotPackets = countPackets(t, gz)
+	}))
+	defer srv.Close()
+	e, err := New(config.ExportConfig{Type: "upload", URL: srv.URL + "/archive/"}, srv.Client(), "sensor1", &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/archive/sensor1/0/dhcp.pcap.gz"; gotPath != want {
+		t.Errorf("uploaded to %q, want %q", gotPath, want)
+	}
+	if want := allPackets(t, f); gotPackets != want {
+		t.Errorf("uploaded %d packets, want %d", gotPackets, want)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "full", http.StatusInsufficientStorage)
+	}))
+	defer failing.Close()
+	e, _ = New(config.ExportConfig{Type: "upload", URL: failing.URL}, failing.Client(), "sensor1", &query.Parser{})
+	if err := e.Export(ctx, f); err == nil {
+		t.Error("upload to failing server succeeded")
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	f := testFile(t)
+	var full []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			full, _ = ioutil.ReadAll(r.Body)
+		}
+	}))
+	defer srv.Close()
+	e, _ := New(config.ExportConfig{Type: "upload", URL: srv.URL}, srv.Client(), "sensor1", &query.Parser{})
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+
+	// A server with half the file should only be sent the rest.
+	half := len(full) / 2
+	var rest []byte
+	var gotOffset, gotRange string
+	resuming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Upload-Offset", strconv.Itoa(half))
+			return
+		}
+		gotOffset, gotRange = r.Header.Get("Upload-Offset"), r.Header.Get("Content-Range")
+		rest, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer resuming.Close()
+	e, _ = New(config.ExportConfig{Type: "upload", URL: resuming.URL}, resuming.Client(), "sensor1", &query.Parser{})
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(half); gotOffset != want {
+		t.Errorf("resumed with Upload-Offset %q, want %q", gotOffset, want)
+	}
+	if want := fmt.Sprintf("bytes %d-*/*", half); gotRange != want {
+		t.Errorf("resumed with Content-Range %q, want %q", gotRange, want)
+	}
+	if !bytes.Equal(rest, full[half:]) {
+		t.Errorf("resumed with %d bytes, want the last %d of the file", len(rest), len(full)-half)
+	}
+}
+
+func TestShapedReader(t *testing.T) {
+	data := make([]byte, 3000)
+	read := func(c config.ExportConfig) time.Duration {
+		start := time.Now()
+		got, err := ioutil.ReadAll(newShapedReader(ctx, bytes.NewReader(data), c, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(got) != len(data) {
+			t.Fatalf("read %d bytes, want %d", len(got), len(data))
+		}
+		return time.Since(start)
+	}
+	if d := read(config.ExportConfig{BytesPerSecond: 10000}); d < 200*time.Millisecond {
+		t.Errorf("read %d bytes at 10000/s in %v", len(data), d)
+	}
+	// A window around now lifts the limit.
+	now := time.Now().UTC()
+	window := config.BandwidthWindow{Start: now.Add(-time.Hour).Format("15:04"), End: now.Add(time.Hour).Format("15:04")}
+	if d := read(config.ExportConfig{BytesPerSecond: 100, Schedule: []config.BandwidthWindow{window}}); d > 100*time.Millisecond {
+		t.Errorf("read %d bytes unlimited in %v", len(data), d)
+	}
+	// A window on another day doesn't.
+	window.Days = []string{now.Add(-72 * time.Hour).Weekday().String()}
+	c, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := ioutil.ReadAll(newShapedReader(c, bytes.NewReader(data), config.ExportConfig{BytesPerSecond: 100, Schedule: []config.BandwidthWindow{window}}, time.UTC)); err != context.DeadlineExceeded {
+		t.Errorf("read at 100/s outside window got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestGCSUpload(t *testing.T) {
+	f := testFile(t)
+	token := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(token, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var object struct {
+		Name, ContentType string
+		Metadata          map[string]string
+		Retention         struct{ Mode, RetainUntilTime string }
+		TemporaryHold     bool
+	}
+	var gotPackets int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("%s %v: authorization %q", r.Method, r.URL, got)
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/upload/storage/v1/b/bucket/o" && r.URL.Query().Get("uploadType") == "resumable":
+			if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Location", srv.URL+"/session/1")
+		case r.Method == "PUT" && r.URL.Path == "/session/1":
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			gotPackets = countPackets(t, gz)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(endpoint string) { gcsEndpoint = endpoint }(gcsEndpoint)
+	gcsEndpoint = srv.URL
+	e, err := New(config.ExportConfig{
+		Type: "gcs", URL: "gs://bucket/steno/", TokenFile: token,
+		Metadata:  map[string]string{"case": "IR-1"},
+		Retention: &config.RetentionConfig{Period: "24h", Locked: true, LegalHold: true},
+	}, srv.Client(), "sensor1", &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if want := "steno/sensor1/0/dhcp.pcap.gz"; object.Name != want {
+		t.Errorf("uploaded %q, want %q", object.Name, want)
+	}
+	if object.Metadata["case"] != "IR-1" || object.Retention.Mode != "Locked" || !object.TemporaryHold {
+		t.Errorf("uploaded with metadata %v, retention %v, hold %v", object.Metadata, object.Retention, object.TemporaryHold)
+	}
+	if until, err := time.Parse(time.RFC3339, object.Retention.RetainUntilTime); err != nil || until.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("retained until %q (%v)", object.Retention.RetainUntilTime, err)
+	}
+	if want := allPackets(t, f); gotPackets != want {
+		t.Errorf("uploaded %d packets, want %d", gotPackets, want)
+	}
+}
+
+func TestAzureUpload(t *testing.T) {
+	f := testFile(t)
+	blocks := map[string][]byte{}
+	var committed http.Header
+	var gotPath string
+	var gotPackets int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Method != "PUT" || q.Get("sig") != "abc" || r.Header.Get("X-Ms-Version") == "" {
+			t.Errorf("%s %v: unexpected request", r.Method, r.URL)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		switch q.Get("comp") {
+		case "block":
+			blocks[q.Get("blockid")] = body
+		case "blocklist":
+			var list struct{ Latest []string }
+			if err := xml.Unmarshal(body, &list); err != nil {
+				t.Error(err)
+			}
+			var blob []byte
+			for _, id := range list.Latest {
+				blob = append(blob, blocks[id]...)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(blob))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			gotPath, gotPackets, committed = r.URL.Path, countPackets(t, gz), r.Header
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	e, err := New(config.ExportConfig{
+		Type: "azure", URL: srv.URL + "/container/steno?sig=abc",
+		Metadata:  map[string]string{"caseId": "IR-1"},
+		Retention: &config.RetentionConfig{Period: "24h"},
+	}, srv.Client(), "sensor1", &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if want := "/container/steno/sensor1/0/dhcp.pcap.gz"; gotPath != want {
+		t.Errorf("uploaded to %q, want %q", gotPath, want)
+	}
+	if want := allPackets(t, f); gotPackets != want {
+		t.Errorf("uploaded %d packets, want %d", gotPackets, want)
+	}
+	if committed.Get("X-Ms-Meta-Caseid") != "IR-1" || committed.Get("X-Ms-Immutability-Policy-Mode") != "Unlocked" ||
+		committed.Get("X-Ms-Immutability-Policy-Until-Date") == "" || committed.Get("X-Ms-Legal-Hold") != "" {
+		t.Errorf("committed with headers %v", committed)
+	}
+}
+
+func TestFlows(t *testing.T) {
+	f := testFile(t)
+	dir := t.TempDir()
+	e, err := New(config.ExportConfig{Type: "flows", Directory: dir}, nil, "", &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Open(filepath.Join(dir, "0", "dhcp.flows.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	var packets int64
+	var prev Flow
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var fl Flow
+		if err := json.Unmarshal(scanner.Bytes(), &fl); err != nil {
+			t.Fatal(err)
+		}
+		if fl.First.Before(prev.First) || fl.Last.Before(fl.First) {
+			t.Errorf("flow %+v out of order after %+v", fl, prev)
+		}
+		packets += fl.Packets
+		prev = fl
+	}
+	if want := allPackets(t, f); packets != int64(want) {
+		t.Errorf("flows have %d packets, want %d", packets, want)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	f := testFile(t)
+	dir := t.TempDir()
+	if _, err := New(config.ExportConfig{Type: "extract", Directory: dir, Query: "port"}, nil, "", &query.Parser{}); err == nil {
+		t.Error("bad query accepted")
+	}
+	e, err := New(config.ExportConfig{Type: "extract", Directory: dir, Query: "port 67"}, nil, "", &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Open(filepath.Join(dir, "0", "dhcp.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if n := countPackets(t, out); n == 0 || n > allPackets(t, f) {
+		t.Errorf("extracted %d packets", n)
+	}
+}
+
+func TestParquet(t *testing.T) {
+	f := testFile(t)
+	dir := t.TempDir()
+	e, err := New(config.ExportConfig{Type: "parquet", Directory: dir}, nil, "", &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Export(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "0", "dhcp.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) < 8 || string(data[:4]) != "PAR1" || string(data[len(data)-4:]) != "PAR1" {
+		t.Errorf("not a parquet file: %q...", data[:4])
+	}
+
+	c := f.Blockfile.AllPackets(context.Background())
+	udp := 0
+	for p := range c.Receive() {
+		row := packetMetadata(p)
+		if row[1] == nil || row[2] == nil || row[8] != nil || row[9] != nil {
+			t.Errorf("wrong metadata for packet: %v", row)
+		}
+		if row[5] == int32(17) {
+			udp++
+			if row[3] == nil || row[4] == nil {
+				t.Errorf("no ports for UDP packet: %v", row)
+			}
+		}
+		if row[6].(int32) < row[7].(int32) {
+			t.Errorf("length %v less than capture length %v", row[6], row[7])
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if udp == 0 {
+		t.Error("no UDP packets found")
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	f := testFile(t)
+	var out bytes.Buffer
+	if err := PacketsToNDJSON(f.Blockfile.AllPackets(context.Background()), &out, base.Limit{Packets: 2}); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&out)
+	n := 0
+	for ; scanner.Scan(); n++ {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &obj); err != nil {
+			t.Fatalf("line %d: %v", n, err)
+		}
+		if obj["timestamp"] == nil || obj["src_ip"] == nil {
+			t.Errorf("line %d missing columns: %v", n, obj)
+		}
+		if _, ok := obj["tcp_flags"]; ok {
+			t.Errorf("line %d has null column: %v", n, obj)
+		}
+	}
+	if n != 2 {
+		t.Errorf("got %d lines, want 2", n)
+	}
+}
+
+func TestSideChannel(t *testing.T) {
+	f := testFile(t)
+	q, err := query.NewQuery("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := base.WithCaptureSource(context.Background(), base.CaptureSource{Thread: 3})
+	packets := base.NewPacketChan(100)
+	go f.Blockfile.Lookup(ctx, q, packets)
+	sc, err := NewSideChannel(packets, "sensor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	var pcap, metadata bytes.Buffer
+	if err := base.PacketsToFile(packets, &pcap, base.Limit{Packets: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sc.WriteTo(&metadata); err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(&metadata)
+	n := 0
+	for ; scanner.Scan(); n++ {
+		var r sideChannelRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("line %d: %v", n, err)
+		}
+		if r.Index != n || r.Sensor != "sensor1" || !strings.HasPrefix(r.Flow, "udp_") {
+			t.Errorf("line %d: got %+v", n, r)
+		}
+		if p := r.Provenance; p == nil || p.Thread != 3 || p.File != f.Blockfile.Name() || p.Offset <= 0 {
+			t.Errorf("line %d: got provenance %+v", n, p)
+		}
+	}
+	if want := countPackets(t, &pcap); n != want || n != 3 {
+		t.Errorf("got %d metadata lines for %d packets, want 3", n, want)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"io"
+	"time"
+
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	uploadBytes          = stats.S.Get("export_upload_bytes")
+	uploadResumedBytes   = stats.S.Get("export_upload_resumed_bytes")
+	uploadThrottledNanos = stats.S.Get("export_upload_throttled_nanos")
+)
+
+// shapedReader paces reads from 'r' to an upload exporter's bandwidth limit
+// at the time of each read, so a schedule's window starting or ending
+// mid-upload takes effect immediately.  The schedule is in time zone 'loc'.
+type shapedReader struct {
+	ctx  context.Context
+	r    io.Reader
+	c    config.ExportConfig
+	loc  *time.Location
+	next time.Time // When the bytes read so far are paid for.
+}
+
+func newShapedReader(ctx context.Context, r io.Reader, c config.ExportConfig, loc *time.Location) *shapedReader {
+	return &shapedReader{ctx: ctx, r: r, c: c, loc: loc}
+}
+
+func (s *shapedReader) Read(p []byte) (int, error) {
+	now := time.Now()
+	rate := s.c.BandwidthAt(now.In(s.loc))
+	if rate <= 0 {
+		s.next = time.Time{}
+		n, err := s.r.Read(p)
+		uploadBytes.IncrementBy(int64(n))
+		return n, err
+	}
+	// Read at most a tenth of a second's worth at a time, so the pace is even
+	// and a lower limit doesn't wait out a burst read at a higher one.
+	if max := rate/10 + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	if wait := s.next.Sub(now); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-s.ctx.Done():
+			return 0, s.ctx.Err()
+		case <-timer.C:
+		}
+		uploadThrottledNanos.IncrementBy(int64(wait))
+	} else {
+		s.next = now
+	}
+	n, err := s.r.Read(p)
+	uploadBytes.IncrementBy(int64(n))
+	s.next = s.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	return n, err
+}
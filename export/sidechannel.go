@@ -0,0 +1,107 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mars-suite/stenographer/base"
+)
+
+// sideChannelRecord is a packet's line in a metadata side channel.
+type sideChannelRecord struct {
+	Index      int                `json:"index"` // Of the packet in the PCAP, from 0.
+	Timestamp  time.Time          `json:"timestamp"`
+	Sensor     string             `json:"sensor,omitempty"`
+	Provenance *sideChannelSource `json:"provenance,omitempty"`
+	VLANs      []uint16           `json:"vlans,omitempty"` // Outermost first.
+	Flow       string             `json:"flow,omitempty"`
+}
+
+type sideChannelSource struct {
+	Thread int    `json:"thread"`
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+}
+
+// SideChannel records metadata PCAP can't carry about each packet written
+// from a PacketChan, as newline-delimited JSON keyed by the packet's index in
+// the output:  the blockfile and offset it was read from, its VLAN tags, and
+// the ID of its flow (see base.PacketFlowID).  Since the metadata is only
+// complete once all packets are written, it's spilled to an unlinked file in
+// base.SpillDirectory rather than held in memory.
+type SideChannel struct {
+	sensor string
+	f      *os.File
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	n      int
+	err    error
+}
+
+// NewSideChannel returns a side channel recording the metadata of each packet
+// written from 'in', which must not have started being written yet.
+func NewSideChannel(in *base.PacketChan, sensor string) (*SideChannel, error) {
+	f, err := ioutil.TempFile(base.SpillDirectory, "stenographer-metadata-")
+	if err != nil {
+		return nil, err
+	}
+	// Unlink the file immediately, so it's cleaned up however we exit.
+	os.Remove(f.Name())
+	s := &SideChannel{sensor: sensor, f: f, buf: bufio.NewWriter(f)}
+	s.enc = json.NewEncoder(s.buf)
+	base.CopyWritten(in, s.add)
+	return s, nil
+}
+
+func (s *SideChannel) add(p *base.Packet) {
+	r := sideChannelRecord{Index: s.n, Timestamp: p.Timestamp, Sensor: s.sensor, Flow: base.PacketFlowID(p)}
+	s.n++
+	if p.Source.File != "" {
+		r.Provenance = &sideChannelSource{Thread: p.Source.Thread, File: p.Source.File, Offset: p.Source.Offset}
+	}
+	pkt := gopacket.NewPacket(p.Data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	for _, l := range pkt.Layers() {
+		if d, ok := l.(*layers.Dot1Q); ok {
+			r.VLANs = append(r.VLANs, d.VLANIdentifier)
+		}
+	}
+	if err := s.enc.Encode(r); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// WriteTo writes the metadata recorded so far to 'w'.
+func (s *SideChannel) WriteTo(w io.Writer) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, io.NewSectionReader(s.f, 0, 1<<62))
+}
+
+// Close releases the side channel's spill file.
+func (s *SideChannel) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,307 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fanout copies a query's results to configured sinks, like an archive
+// directory or a Kafka topic, as they're returned to the client.  Each sink has
+// its own queue and goroutine, so one which is slow or failing is cut off
+// rather than holding up the query or the other sinks.
+package fanout
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	v             = base.V // verbose logging
+	sinkPackets   = stats.S.Get("query_sink_packets")
+	sinkFailures  = stats.S.Get("query_sink_failures")
+	errFellBehind = errors.New("sink fell behind, cut off")
+)
+
+const (
+	defaultBatchSize     = 1000
+	defaultBufferPackets = 10000
+	produceTimeout       = time.Minute
+)
+
+// Status reports what a sink did with a query's results.
+type Status struct {
+	Name    string
+	Packets int
+	// Location is where the results went:  a file, or a Kafka topic.
+	Location string
+	Error    string `json:",omitempty"`
+}
+
+// run writes the packets of 'in' somewhere, returning once they've all been
+// written or it fails.
+type run func(in *base.PacketChan) error
+
+type sink struct {
+	status Status
+	in     *base.PacketChan
+	closed bool          // Set once 'in' is closed.
+	done   chan struct{} // Closed once run returns, with its error in err.
+	err    error
+}
+
+// close stops sending the sink packets, with the given error.
+func (s *sink) close(err error) {
+	if !s.closed {
+		s.closed = true
+		s.in.Close(err)
+	}
+}
+
+// Fanout copies one query's results to its sinks.
+type Fanout struct {
+	sinks []*sink
+}
+
+// New starts a Fanout copying results to the sinks named in 'names', from
+// those configured.  Results are labeled with 'id', which should be unique to
+// the query, and Kafka sinks send them with 'client'.
+func New(configs []config.QuerySinkConfig, names []string, client *http.Client, id string) (*Fanout, error) {
+	byName := map[string]config.QuerySinkConfig{}
+	for _, c := range configs {
+		byName[c.Name] = c
+	}
+	f := &Fanout{}
+	runs := map[*sink]run{}
+	for _, name := range names {
+		c, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown query sink %q", name)
+		}
+		buffer := c.BufferPackets
+		if buffer == 0 {
+			buffer = defaultBufferPackets
+		}
+		s := &sink{
+			status: Status{Name: name},
+			in:     base.NewPacketChan(buffer),
+			done:   make(chan struct{}),
+		}
+		switch c.Type {
+		case "file":
+			path := filepath.Join(c.Directory, id+".pcap")
+			s.status.Location = path
+			runs[s] = func(in *base.PacketChan) error { return writeFile(path, in) }
+		case "kafka":
+			k := &kafka{
+				url:       strings.TrimSuffix(c.URL, "/") + "/topics/" + url.PathEscape(c.Topic),
+				client:    client,
+				key:       id,
+				batchSize: c.BatchSize,
+			}
+			if k.batchSize == 0 {
+				k.batchSize = defaultBatchSize
+			}
+			s.status.Location = "kafka topic " + c.Topic
+			runs[s] = k.run
+		default:
+			return nil, fmt.Errorf("invalid query sink type %q", c.Type)
+		}
+		f.sinks = append(f.sinks, s)
+	}
+	for s, r := range runs {
+		go func(s *sink, r run) {
+			defer close(s.done)
+			s.err = r(s.in)
+		}(s, r)
+	}
+	return f, nil
+}
+
+// Copy copies the packets written from 'in' to the sinks.  It must be called
+// before writing starts.
+func (f *Fanout) Copy(in *base.PacketChan) {
+	base.CopyWritten(in, f.add)
+}
+
+// add queues a packet for each sink which is still running, cutting off any
+// whose queue is full.
+func (f *Fanout) add(p *base.Packet) {
+	var cp *base.Packet // Shared by all sinks, which don't modify it.
+	for _, s := range f.sinks {
+		if s.closed {
+			continue
+		}
+		select {
+		case <-s.done:
+			s.close(nil) // Failed.
+			continue
+		default:
+		}
+		if cp == nil {
+			cp = &base.Packet{Data: append([]byte(nil), p.Data...), CaptureInfo: p.CaptureInfo}
+		}
+		select {
+		case s.in.C <- cp:
+			s.status.Packets++
+		default:
+			v(1, "Query sink %q fell behind after %d packets", s.status.Name, s.status.Packets)
+			s.close(errFellBehind)
+		}
+	}
+}
+
+// Close tells the sinks there are no more packets, 'err' being why the query's
+// results ended early if they did, and waits for them to finish.  It returns
+// their statuses, in the order they were named.
+func (f *Fanout) Close(err error) []Status {
+	out := make([]Status, len(f.sinks))
+	for i, s := range f.sinks {
+		s.close(err)
+		<-s.done
+		sinkPackets.IncrementBy(int64(s.status.Packets))
+		out[i] = s.status
+		if s.err != nil {
+			sinkFailures.Increment()
+			out[i].Error = s.err.Error()
+		}
+	}
+	return out
+}
+
+// writeFile writes a PCAP of the packets to 'path', atomically, so a failed
+// sink never leaves a partial file behind.
+func writeFile(path string, in *base.PacketChan) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		in.Discard()
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		in.Discard()
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := base.PacketsToFile(in, tmp, base.Limit{}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// kafka produces packets to a topic through the Kafka REST Proxy, in batches,
+// each message a PCAP of one batch keyed by the query's ID.
+type kafka struct {
+	url       string
+	client    *http.Client
+	key       string
+	batchSize int
+}
+
+func (k *kafka) run(in *base.PacketChan) error {
+	defer in.Discard()
+	var batch []*base.Packet
+	for p := range in.Receive() {
+		batch = append(batch, p)
+		if len(batch) == k.batchSize {
+			if err := k.produce(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := in.Err(); err != nil {
+		return err
+	} else if len(batch) == 0 {
+		return nil
+	}
+	return k.produce(batch)
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type kafkaRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaResponse struct {
+	Offsets []struct {
+		Error string `json:"error"`
+	} `json:"offsets"`
+}
+
+func (k *kafka) produce(batch []*base.Packet) error {
+	pkts := base.NewPacketChan(len(batch))
+	for _, p := range batch {
+		pkts.Send(p)
+	}
+	pkts.Close(nil)
+	var pcap bytes.Buffer
+	if err := base.PacketsToFile(pkts, &pcap, base.Limit{}); err != nil {
+		return err
+	}
+	body, err := json.Marshal(kafkaRequest{Records: []kafkaRecord{{
+		Key:   base64.StdEncoding.EncodeToString([]byte(k.key)),
+		Value: base64.StdEncoding.EncodeToString(pcap.Bytes()),
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", k.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	ctx := base.NewContext(produceTimeout)
+	defer ctx.Cancel()
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	var produced kafkaResponse
+	if err := json.Unmarshal(respBody, &produced); err != nil {
+		return fmt.Errorf("invalid produce response: %v", err)
+	}
+	for _, o := range produced.Offsets {
+		if o.Error != "" {
+			return fmt.Errorf("could not produce message: %s", o.Error)
+		}
+	}
+	return nil
+}
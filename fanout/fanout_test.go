@@ -0,0 +1,143 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fanout
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+)
+
+// query writes n packets through a Fanout, as a query would.
+func query(t *testing.T, f *Fanout, n int) {
+	pkts := base.NewPacketChan(n)
+	for i := 0; i < n; i++ {
+		data := []byte{byte(i), 1, 2, 3}
+		pkts.Send(&base.Packet{Data: data, CaptureInfo: gopacket.CaptureInfo{
+			Timestamp:     time.Unix(int64(i), 0),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}})
+	}
+	pkts.Close(nil)
+	f.Copy(pkts)
+	if err := base.PacketsToFile(pkts, ioutil.Discard, base.Limit{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countPackets returns how many packets a PCAP has.
+func countPackets(t *testing.T, pcap []byte) int {
+	r, err := pcapgo.NewReader(bytes.NewReader(pcap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestFanout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fanout_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var mu sync.Mutex
+	var messages [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/evidence" {
+			t.Errorf("produced to %q", r.URL.Path)
+		}
+		var req kafkaRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid produce request: %v", err)
+		}
+		for _, rec := range req.Records {
+			if key, _ := base64.StdEncoding.DecodeString(rec.Key); string(key) != "q1" {
+				t.Errorf("got key %q, want q1", key)
+			}
+			value, _ := base64.StdEncoding.DecodeString(rec.Value)
+			mu.Lock()
+			messages = append(messages, value)
+			mu.Unlock()
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":1}]}`))
+	}))
+	defer srv.Close()
+	configs := []config.QuerySinkConfig{
+		{Name: "archive", Type: "file", Directory: dir},
+		{Name: "kafka", Type: "kafka", URL: srv.URL, Topic: "evidence", BatchSize: 4},
+		{Name: "broken", Type: "kafka", URL: "http://127.0.0.1:1", Topic: "evidence", BufferPackets: 1},
+	}
+	if _, err := New(configs, []string{"archive", "unknown"}, srv.Client(), "q1"); err == nil {
+		t.Errorf("unknown sink accepted")
+	}
+	f, err := New(configs, []string{"archive", "kafka", "broken"}, srv.Client(), "q1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	query(t, f, 10)
+	got := f.Close(nil)
+
+	if len(got) != 3 {
+		t.Fatalf("got statuses %+v", got)
+	}
+	for i, want := range []Status{
+		{Name: "archive", Packets: 10, Location: filepath.Join(dir, "q1.pcap")},
+		{Name: "kafka", Packets: 10, Location: "kafka topic evidence"},
+	} {
+		if got[i] != want {
+			t.Errorf("got status %+v, want %+v", got[i], want)
+		}
+	}
+	// The broken sink fails, or falls behind, without affecting the others.
+	if got[2].Error == "" {
+		t.Errorf("broken sink got status %+v", got[2])
+	}
+	pcap, err := ioutil.ReadFile(filepath.Join(dir, "q1.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	} else if n := countPackets(t, pcap); n != 10 {
+		t.Errorf("archived %d packets, want 10", n)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("produced %d messages, want 3", len(messages))
+	}
+	total := 0
+	for _, m := range messages {
+		total += countPackets(t, m)
+	}
+	if total != 10 {
+		t.Errorf("produced %d packets, want 10", total)
+	}
+}
@@ -22,7 +22,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/google/stenographer/base"
+	"github.com/mars-suite/stenographer/base"
 )
 
 var v = base.V
@@ -38,6 +38,26 @@ type CachedFile struct {
 	// protected by mu
 	filename string
 	f        *os.File
+	// info identifies the file first opened, so it's never reopened (after
+	// being closed to make room for others) as a different file renamed into
+	// its place.  If known, the file first opened must have size and mod.
+	info     os.FileInfo
+	known    bool
+	size     int64
+	mod      time.Time
+	replaced bool
+}
+
+// ReplacedError is returned by reads of a file which has been replaced, as by
+// a rename over it, since it was first opened (or, for files opened with
+// OpenKnown, since it was last seen).  Data from the old and new files could
+// be inconsistent, so rather than mixing them, reads fail.
+type ReplacedError struct {
+	Filename string
+}
+
+func (e *ReplacedError) Error() string {
+	return fmt.Sprintf("file %q has been replaced since it was opened", e.Filename)
 }
 
 func NewCache(maxOpened int) *Cache {
@@ -85,6 +105,22 @@ func (c *Cache) Open(filename string) *CachedFile {
 	return &CachedFile{cache: c, filename: filename}
 }
 
+// OpenKnown is like Open, but for a file whose size and modification time are
+// already known, which it must still have when it's opened.
+func (c *Cache) OpenKnown(filename string, size int64, mod time.Time) *CachedFile {
+	cf := c.Open(filename)
+	cf.known, cf.size, cf.mod = true, size, mod
+	return cf
+}
+
+// Replaced returns whether reads have failed because the file has been
+// replaced, see ReplacedError.
+func (cf *CachedFile) Replaced() bool {
+	cf.mu.RLock()
+	defer cf.mu.RUnlock()
+	return cf.replaced
+}
+
 func (cf *CachedFile) readLockedFile() error {
 	cf.cache.mu.Lock()
 	cf.moveToFront()
@@ -142,11 +178,27 @@ func (cf *CachedFile) openFile() error {
 		return nil
 	}
 	v(2, "Opening %q", cf.filename)
+	if cf.replaced {
+		return &ReplacedError{cf.filename}
+	}
 	newF, err := os.Open(cf.filename)
 	if err != nil {
 		v(1, "Open of %q failed: %v", cf.filename, err)
 		return err
 	}
+	info, err := newF.Stat()
+	if err != nil {
+		newF.Close()
+		return err
+	}
+	if (cf.info != nil && !os.SameFile(cf.info, info)) ||
+		(cf.info == nil && cf.known && (info.Size() != cf.size || !info.ModTime().Equal(cf.mod))) {
+		v(1, "File %q replaced since it was opened", cf.filename)
+		newF.Close()
+		cf.replaced = true
+		return &ReplacedError{cf.filename}
+	}
+	cf.info = info
 	cf.f = newF
 	cf.moveToFront()
 	cf.cache.opened++
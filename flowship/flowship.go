@@ -0,0 +1,313 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package flowship ships a summary record of each flow in new blockfiles to
+// ClickHouse or Elasticsearch, in batches, so a sensor can serve as a
+// NetFlow-like source as well as a full packet one.
+package flowship
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/export"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	v                = base.V // verbose logging
+	shippedFlows     = stats.S.Get("flow_records_shipped")
+	droppedFlows     = stats.S.Get("flow_records_dropped")
+	flowShipFailures = stats.S.Get("flow_ship_failures")
+)
+
+const (
+	defaultBatchSize     = 10000
+	defaultFlushInterval = 30 * time.Second
+	// queueSize is how many files may wait to be summarized.  Files arriving
+	// while it's full aren't shipped.
+	queueSize = 16
+	// shipAttempts is how many times a batch is sent before it's dropped.
+	shipAttempts     = 3
+	shipTimeout      = time.Minute
+	summarizeTimeout = time.Hour
+)
+
+var shipRetryDelay = 5 * time.Second
+
+// Record is the record shipped for each flow.  Both directions of a flow share
+// a record.
+type Record struct {
+	Sensor    string    `json:"sensor"`
+	Thread    int       `json:"thread"`
+	File      string    `json:"file"`
+	Network   string    `json:"network"`
+	Transport string    `json:"transport"`
+	Packets   int64     `json:"packets"`
+	Bytes     int64     `json:"bytes"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+// sink sends a batch of records somewhere.
+type sink interface {
+	request(records []Record) (*http.Request, error)
+	// check returns an error if the response reports a failure, despite a 2xx
+	// status.
+	check(body []byte) error
+}
+
+// Shipper summarizes the flows of each file it's given and ships them.
+type Shipper struct {
+	sink      sink
+	client    *http.Client
+	sensor    string
+	batchSize int
+	interval  time.Duration
+	files     chan export.File
+	batch     []Record
+}
+
+// New returns a Shipper configured by c, which sends records with 'client',
+// labeled with 'sensor'.  Its background goroutine is started immediately.
+func New(c config.FlowShippingConfig, client *http.Client, sensor string) (*Shipper, error) {
+	s := &Shipper{
+		client:    client,
+		sensor:    sensor,
+		batchSize: c.BatchSize,
+		files:     make(chan export.File, queueSize),
+	}
+	switch c.Type {
+	case "clickhouse":
+		s.sink = &clickhouse{url: c.URL, table: c.Table}
+	case "elasticsearch":
+		s.sink = &elasticsearch{url: strings.TrimSuffix(c.URL, "/"), index: c.Table}
+	default:
+		return nil, fmt.Errorf("invalid flow shipping type %q", c.Type)
+	}
+	if s.batchSize == 0 {
+		s.batchSize = defaultBatchSize
+	}
+	var err error
+	if s.interval, err = c.FlushIntervalDuration(); err != nil {
+		return nil, err
+	} else if s.interval == 0 {
+		s.interval = defaultFlushInterval
+	}
+	go s.run()
+	return s, nil
+}
+
+// Add queues a newly written file to have its flows shipped.  It never blocks,
+// and drops the file if the queue is full.
+func (s *Shipper) Add(f export.File) {
+	select {
+	case s.files <- f:
+	default:
+		log.Printf("Flow shipping queue full, not shipping flows of thread %v %q", f.Thread, f.Name)
+		events.H.Add(events.Error, "Flow shipping queue full, not shipping flows of thread %v %q", f.Thread, f.Name)
+	}
+}
+
+func (s *Shipper) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case f := <-s.files:
+			s.summarize(f)
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// summarize adds the flows of a file to the current batch, shipping batches
+// as they fill up.
+func (s *Shipper) summarize(f export.File) {
+	ctx := base.NewContext(summarizeTimeout)
+	defer ctx.Cancel()
+	flows, err := export.SummarizeFlows(ctx, f.Blockfile)
+	if err != nil {
+		log.Printf("Could not summarize flows of thread %v %q: %v", f.Thread, f.Name, err)
+		return
+	}
+	v(1, "Shipping %d flows of thread %v %q", len(flows), f.Thread, f.Name)
+	for _, fl := range flows {
+		s.batch = append(s.batch, Record{
+			Sensor:    s.sensor,
+			Thread:    f.Thread,
+			File:      f.Name,
+			Network:   fl.Network,
+			Transport: fl.Transport,
+			Packets:   fl.Packets,
+			Bytes:     fl.Bytes,
+			First:     fl.First,
+			Last:      fl.Last,
+		})
+		if len(s.batch) == s.batchSize {
+			s.flush()
+		}
+	}
+}
+
+// flush ships the current batch, retrying a few times before dropping it.
+func (s *Shipper) flush() {
+	if len(s.batch) == 0 {
+		return
+	}
+	var err error
+	for i := 0; i < shipAttempts; i++ {
+		if i > 0 {
+			time.Sleep(shipRetryDelay)
+		}
+		if err = s.ship(s.batch); err == nil {
+			shippedFlows.IncrementBy(int64(len(s.batch)))
+			s.batch = s.batch[:0]
+			return
+		}
+		flowShipFailures.Increment()
+		v(0, "Shipping %d flow records failed: %v", len(s.batch), err)
+	}
+	log.Printf("Dropping %d flow records: %v", len(s.batch), err)
+	events.H.Add(events.Error, "Dropping %d flow records: %v", len(s.batch), err)
+	droppedFlows.IncrementBy(int64(len(s.batch)))
+	s.batch = s.batch[:0]
+}
+
+func (s *Shipper) ship(records []Record) error {
+	req, err := s.sink.request(records)
+	if err != nil {
+		return err
+	}
+	ctx := base.NewContext(shipTimeout)
+	defer ctx.Cancel()
+	resp, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return s.sink.check(body)
+}
+
+// clickhouse inserts records through ClickHouse's HTTP interface, as
+// JSONEachRow.  The table's columns should match Record's JSON names.
+type clickhouse struct {
+	url, table string
+}
+
+func (c *clickhouse) request(records []Record) (*http.Request, error) {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return nil, err
+	}
+	vals := u.Query()
+	vals.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", c.table))
+	vals.Set("date_time_input_format", "best_effort") // For RFC3339 times.
+	u.RawQuery = vals.Encode()
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	return http.NewRequest("POST", u.String(), &body)
+}
+
+func (c *clickhouse) check([]byte) error { return nil }
+
+// elasticsearch indexes records with the bulk API.  Each record's document
+// ID identifies its flow, so retried batches overwrite rather than duplicate
+// records.
+type elasticsearch struct {
+	url, index string
+}
+
+type bulkAction struct {
+	Index struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	} `json:"index"`
+}
+
+func (e *elasticsearch) request(records []Record) (*http.Request, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		var action bulkAction
+		action.Index.Index = e.index
+		action.Index.ID = fmt.Sprintf("%s/%d/%s/%s/%s", r.Sensor, r.Thread, r.File, r.Network, r.Transport)
+		if err := enc.Encode(action); err != nil {
+			return nil, err
+		}
+		if err := enc.Encode(r); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("POST", e.url+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	return req, nil
+}
+
+// check fails if any record failed to index, since bulk requests succeed
+// overall even when individual items fail.
+func (e *elasticsearch) check(body []byte) error {
+	var resp struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  json.RawMessage
+		}
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("invalid bulk response: %v", err)
+	}
+	if !resp.Errors {
+		return nil
+	}
+	failed := 0
+	var first string
+	for _, item := range resp.Items {
+		for _, result := range item {
+			if result.Status/100 != 2 {
+				if failed == 0 {
+					first = string(result.Error)
+				}
+				failed++
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d records failed to index, first error: %s", failed, len(resp.Items), first)
+}
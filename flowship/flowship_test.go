@@ -0,0 +1,143 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flowship
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/export"
+	"github.com/mars-suite/stenographer/filecache"
+	"golang.org/x/net/context"
+)
+
+func testFile(t *testing.T) export.File {
+	// Opened from a copy, since opening it writes a lock file beside its index.
+	dir := t.TempDir()
+	if err := exec.Command("cp", "-r", "../testdata", dir).Run(); err != nil {
+		t.Fatalf("could not copy testdata: %v", err)
+	}
+	bf, err := blockfile.NewBlockFile(filepath.Join(dir, "testdata", "PKT0", "dhcp"), filecache.NewCache(10), blockfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bf.Close() })
+	return export.File{Thread: 1, Name: "dhcp", Blockfile: bf}
+}
+
+type request struct {
+	r     *http.Request
+	lines []json.RawMessage
+}
+
+// collector returns a server which passes each request it gets to the
+// returned channel, responding with 'response'.
+func collector(t *testing.T, response string) (*httptest.Server, chan request) {
+	reqs := make(chan request, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{r: r}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			req.lines = append(req.lines, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+		}
+		reqs <- req
+		w.Write([]byte(response))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+func receive(t *testing.T, reqs chan request) request {
+	select {
+	case r := <-reqs:
+		return r
+	case <-time.After(10 * time.Second):
+		t.Fatal("no records shipped")
+	}
+	panic("unreachable")
+}
+
+func TestClickHouse(t *testing.T) {
+	f := testFile(t)
+	flows, err := export.SummarizeFlows(context.Background(), f.Blockfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, reqs := collector(t, "")
+	s, err := New(config.FlowShippingConfig{Type: "clickhouse", URL: srv.URL, Table: "steno.flows", FlushInterval: "10ms"}, srv.Client(), "sensor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(f)
+	req := receive(t, reqs)
+	if got, want := req.r.URL.Query().Get("query"), "INSERT INTO steno.flows FORMAT JSONEachRow"; got != want {
+		t.Errorf("got query %q, want %q", got, want)
+	}
+	if len(req.lines) != len(flows) {
+		t.Fatalf("shipped %d records, want %d", len(req.lines), len(flows))
+	}
+	for i, line := range req.lines {
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Sensor != "sensor1" || r.Thread != 1 || r.File != "dhcp" || r.Network != flows[i].Network || r.Packets != flows[i].Packets {
+			t.Errorf("record %d is %+v, flow %+v", i, r, flows[i])
+		}
+	}
+}
+
+func TestElasticsearch(t *testing.T) {
+	f := testFile(t)
+	srv, reqs := collector(t, `{"errors": false, "items": []}`)
+	s, err := New(config.FlowShippingConfig{Type: "elasticsearch", URL: srv.URL + "/", Table: "flows", BatchSize: 2}, srv.Client(), "sensor1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(f)
+	req := receive(t, reqs)
+	if req.r.URL.Path != "/_bulk" {
+		t.Errorf("posted to %q", req.r.URL.Path)
+	}
+	if len(req.lines) != 4 {
+		t.Fatalf("got %d lines, want an action and record for each of 2 flows", len(req.lines))
+	}
+	var action bulkAction
+	if err := json.Unmarshal(req.lines[0], &action); err != nil {
+		t.Fatal(err)
+	}
+	if action.Index.Index != "flows" || action.Index.ID == "" {
+		t.Errorf("bad action %s", req.lines[0])
+	}
+}
+
+func TestElasticsearchErrors(t *testing.T) {
+	e := &elasticsearch{}
+	if err := e.check([]byte(`{"errors": false}`)); err != nil {
+		t.Error(err)
+	}
+	err := e.check([]byte(`{"errors": true, "items": [{"index": {"status": 201}}, {"index": {"status": 400, "error": {"type": "mapper_parsing_exception"}}}]}`))
+	if err == nil {
+		t.Error("failed item not reported")
+	}
+}
@@ -5,16 +5,15 @@ go 1.19
 require (
 	github.com/golang/leveldb v0.0.0-20170107010102-259d9253d719
 	github.com/golang/protobuf v1.5.2
+	github.com/golang/snappy v0.0.4
 	github.com/google/gopacket v1.1.19
-	github.com/google/stenographer v1.0.1
 	github.com/google/uuid v1.3.0
 	golang.org/x/net v0.0.0-20220809184613-07c6da5e1ced
+	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10
 	google.golang.org/grpc v1.48.0
 )
 
 require (
-	github.com/golang/snappy v0.0.4 // indirect
-	golang.org/x/sys v0.0.0-20220728004956-3c1f35247d10 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
@@ -0,0 +1,117 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media types of stenographer's responses.
+const (
+	JSON = "application/json"
+	Text = "text/plain"
+)
+
+// Negotiate picks the media type to respond with from 'offers', the types a
+// handler can produce in its order of preference, using the request's Accept
+// header (RFC 7231 section 5.3.2).  Requests without one get the first offer,
+// as do those accepting several offers equally.  If none of the offers is
+// acceptable, the error lists them.
+func Negotiate(r *http.Request, offers ...string) (string, error) {
+	accept := strings.Join(r.Header["Accept"], ",")
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], nil
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := quality(ranges, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no acceptable response type for Accept %q; supported types: %s", accept, strings.Join(offers, ", "))
+	}
+	return best, nil
+}
+
+// Accepting wraps a handler which only responds with the given media types,
+// so requests accepting none of them fail with 406 Not Acceptable before it
+// runs.
+func Accepting(h http.Handler, types ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Negotiate(r, types...); err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// mediaRange is one of the comma-separated entries of an Accept header, like
+// "text/*;q=0.5".
+type mediaRange struct {
+	typ, subtype string
+	q            float64
+}
+
+func parseAccept(accept string) (ranges []mediaRange) {
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok {
+			continue // Not a media range, so it can't match anything.
+		}
+		m := mediaRange{typ: typ, subtype: subtype, q: 1}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.ToLower(name) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(value, 64); err == nil && q >= 0 && q <= 1 {
+				m.q = q
+			}
+		}
+		ranges = append(ranges, m)
+	}
+	return ranges
+}
+
+// quality returns the quality the most specific range matching 'offer' gives
+// it, or 0 if none do.
+func quality(ranges []mediaRange, offer string) float64 {
+	typ, subtype, _ := strings.Cut(offer, "/")
+	q, specificity := 0.0, -1
+	for _, m := range ranges {
+		var s int
+		switch {
+		case m.typ == typ && m.subtype == subtype:
+			s = 2
+		case m.typ == typ && m.subtype == "*":
+			s = 1
+		case m.typ == "*" && m.subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+		if s > specificity {
+			q, specificity = m.q, s
+		}
+	}
+	return q
+}
@@ -0,0 +1,313 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mars-suite/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// AppProtocolIndexes enables app indexes, which tag packets with the
+// application protocol of their flow (see AppProtocols), as guessed from the
+// first few payloads of each flow rather than from port numbers.  Like flow
+// indexes, they aren't written by stenotype:  each file's is built from its
+// blockfile, and kept in a hidden subdirectory of the index directory (see
+// AppPath).  They're in the mmapped index format, with a one-byte key per
+// protocol.  It should only be changed before any indexes are opened.
+var AppProtocolIndexes = false
+
+// AppProtocols are the application protocols app indexes can tag, by name.
+var AppProtocols = map[string]byte{
+	"dns":  1,
+	"tls":  2,
+	"http": 3,
+	"ssh":  4,
+	"quic": 5,
+}
+
+// ParseAppProtocol returns the app index key of the named application
+// protocol.
+func ParseAppProtocol(name string) (byte, error) {
+	if p, ok := AppProtocols[strings.ToLower(name)]; ok {
+		return p, nil
+	}
+	var known []string
+	for n := range AppProtocols {
+		known = append(known, n)
+	}
+	sort.Strings(known)
+	return 0, fmt.Errorf("unknown application protocol %q, only %s", name, strings.Join(known, ", "))
+}
+
+// appDetectPayloads is how many packets with payloads of each flow are
+// examined to guess its application protocol.
+const appDetectPayloads = 4
+
+const appDir = ".app"
+
+// AppDirectory returns the directory app indexes for the indexes in indexDir
+// are stored in.
+func AppDirectory(indexDir string) string {
+	return filepath.Join(indexDir, appDir)
+}
+
+// AppPath returns where the app index for the given index is stored.
+func AppPath(indexPath string) string {
+	return filepath.Join(AppDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// AppPositions returns the positions in the block file of all packets in
+// flows of the given application protocol (see ParseAppProtocol).
+func (i *IndexFile) AppPositions(ctx context.Context, proto byte) (base.Positions, error) {
+	m, err := i.appIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return i.positionsIn(ctx, m, []byte{proto}, []byte{proto})
+}
+
+// BuildAppIndex builds the index's app index, if it doesn't exist yet, so
+// the first query needing it doesn't have to wait.
+func (i *IndexFile) BuildAppIndex(ctx context.Context) error {
+	_, err := i.appIndex(ctx)
+	return err
+}
+
+// appIndex returns the app index, building it if it doesn't exist yet.
+func (i *IndexFile) appIndex(ctx context.Context) (*mmapReader, error) {
+	if !AppProtocolIndexes {
+		return nil, fmt.Errorf("application protocols aren't indexed")
+	}
+	i.appMu.Lock()
+	defer i.appMu.Unlock()
+	if i.app != nil {
+		return i.app, nil
+	}
+	path := AppPath(i.name)
+	m, err := openMmapIndex(path)
+	if os.IsNotExist(err) {
+		if err = i.buildAppIndex(ctx, path); err == nil {
+			m, err = openMmapIndex(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.app = m
+	return m, nil
+}
+
+// appFlow is a flow being tagged with its application protocol.
+type appFlow struct {
+	proto     byte
+	examined  int // Payloads examined so far.
+	positions []uint32
+}
+
+// buildAppIndex writes the app index for the index's blockfile to 'path'.
+func (i *IndexFile) buildAppIndex(ctx context.Context, path string) error {
+	if i.scan == nil {
+		return fmt.Errorf("no app index for %q, and no way to build one", i.name)
+	}
+	defer indexAppBuildNanos.NanoTimer()()
+	start := time.Now()
+	flows := map[[2]gopacket.Flow]*appFlow{}
+	err := i.scan(ctx, func(pos int64, data []byte) error {
+		if pos < 0 || pos >= 1<<32 {
+			return fmt.Errorf("position %d out of range", pos)
+		}
+		var k [2]gopacket.Flow
+		k[0], k[1] = base.PacketFlow(&base.Packet{Data: data})
+		f := flows[k]
+		if f == nil {
+			f = &appFlow{}
+			flows[k] = f
+		}
+		f.positions = append(f.positions, uint32(pos))
+		if f.proto == 0 && f.examined < appDetectPayloads {
+			if udp, payload := transportPayload(data); len(payload) > 0 {
+				f.examined++
+				f.proto = detectAppProtocol(udp, payload)
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("could not build app index for %q: %v", i.name, err)
+	}
+	positions := map[byte][]uint32{}
+	for _, f := range flows {
+		if f.proto != 0 {
+			positions[f.proto] = append(positions[f.proto], f.positions...)
+		}
+	}
+	protos := make([]byte, 0, len(positions))
+	for proto := range positions {
+		protos = append(protos, proto)
+	}
+	sort.Slice(protos, func(i, j int) bool { return protos[i] < protos[j] })
+	var keys, values [][]byte
+	for _, proto := range protos {
+		p := positions[proto]
+		sort.Slice(p, func(i, j int) bool { return p[i] < p[j] })
+		value := make([]byte, 4*len(p))
+		for j, pos := range p {
+			binary.BigEndian.PutUint32(value[4*j:], pos)
+		}
+		keys = append(keys, []byte{proto})
+		values = append(values, value)
+	}
+	// Files without any tagged flows get empty indexes, so they aren't built
+	// again.
+	if err := writeMmapEntries(keys, values, path); err != nil {
+		return err
+	}
+	v(1, "Built app index %q of %d flows in %v", path, len(flows), time.Since(start))
+	return nil
+}
+
+// transportPayload returns the payload of the Ethernet frame's outermost TCP
+// or UDP header, if it has one, and whether it's UDP.
+func transportPayload(data []byte) (udp bool, payload []byte) {
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		return false, l.LayerPayload()
+	case *layers.UDP:
+		return true, l.LayerPayload()
+	}
+	return false, nil
+}
+
+// httpPrefixes start HTTP requests and responses, and the HTTP/2 connection
+// preface.
+var httpPrefixes = [][]byte{
+	[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "),
+	[]byte("PRI * HTTP/2"), []byte("HTTP/1."),
+}
+
+// detectAppProtocol guesses the application protocol of a TCP or UDP payload,
+// returning 0 if it doesn't look like any of AppProtocols.
+func detectAppProtocol(udp bool, payload []byte) byte {
+	if udp {
+		switch {
+		case isQUICLongHeader(payload):
+			return AppProtocols["quic"]
+		case isDNSMessage(payload):
+			return AppProtocols["dns"]
+		}
+		return 0
+	}
+	if bytes.HasPrefix(payload, []byte("SSH-")) {
+		return AppProtocols["ssh"]
+	}
+	for _, prefix := range httpPrefixes {
+		if bytes.HasPrefix(payload, prefix) {
+			return AppProtocols["http"]
+		}
+	}
+	switch {
+	case isTLSRecord(payload):
+		return AppProtocols["tls"]
+	case len(payload) > 2 && int(binary.BigEndian.Uint16(payload)) >= len(payload)-2 && isDNSMessage(payload[2:]):
+		// DNS over TCP, after its length prefix.
+		return AppProtocols["dns"]
+	}
+	return 0
+}
+
+// isTLSRecord returns whether 'b' starts with a plausible TLS record header:
+// a known content type, a TLS 1.x (or SSL 3) version, and a length within the
+// limit for encrypted records.
+func isTLSRecord(b []byte) bool {
+	if len(b) < 5 || b[0] < 20 || b[0] > 23 || b[1] != 3 || b[2] > 4 {
+		return false
+	}
+	n := binary.BigEndian.Uint16(b[3:])
+	return n > 0 && n <= 1<<14+256
+}
+
+// isQUICLongHeader returns whether 'b' starts with a QUIC long header (RFC
+// 9000 section 17.2) of a known version, as the handshake packets starting
+// each connection have.
+func isQUICLongHeader(b []byte) bool {
+	if len(b) < 7 || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch version := binary.BigEndian.Uint32(b[1:]); {
+	case version == 0x00000001, version == 0x6b3343cf: // QUIC v1 and v2.
+	case version&0xffffff00 == 0xff000000: // IETF drafts.
+	default:
+		return false
+	}
+	return b[5] <= 20 // The destination connection ID's length.
+}
+
+// isDNSMessage returns whether 'b' looks like a DNS message (RFC 1035 section
+// 4.1) with a single, well-formed question.
+func isDNSMessage(b []byte) bool {
+	if len(b) < 12 {
+		return false
+	}
+	switch opcode := b[2] >> 3 & 0xf; opcode {
+	case 0, 1, 2, 4, 5:
+	default:
+		return false
+	}
+	if binary.BigEndian.Uint16(b[4:]) != 1 {
+		return false // Everyone sends exactly one question.
+	}
+	for _, off := range []int{6, 8, 10} {
+		if binary.BigEndian.Uint16(b[off:]) > 256 {
+			return false
+		}
+	}
+	// The question's name is a series of labels, ending with an empty one,
+	// followed by its type and class.
+	off := 12
+	for {
+		if off >= len(b) {
+			return false
+		}
+		n := int(b[off])
+		off++
+		if n == 0 {
+			break
+		} else if n > 63 {
+			return false
+		}
+		off += n
+	}
+	if off+4 > len(b) {
+		return false
+	}
+	switch class := binary.BigEndian.Uint16(b[off+2:]) &^ 0x8000; class { // mDNS sets the top bit.
+	case 1, 3, 4, 254, 255:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// backfillKeyTypes are the key types Backfill can add to existing indexes, by
+// name.
+var backfillKeyTypes = map[string][]byte{
+	"vlan":           {keyVLAN},
+	"mpls":           {keyMPLS},
+	"mac":            {keyMAC},
+	"port_direction": {keySrcPort, keyDstPort},
+	"host_direction": {keySrcIPv4, keyDstIPv4, keySrcIPv6, keyDstIPv6},
+	"tcpflags":       {keyTCPFlag},
+}
+
+// ParseKeyTypes parses a comma-separated list of key type names which Backfill
+// can add, like "vlan,mpls".
+func ParseKeyTypes(names string) ([]byte, error) {
+	var out []byte
+	for _, name := range strings.Split(names, ",") {
+		types, ok := backfillKeyTypes[strings.TrimSpace(name)]
+		if !ok {
+			var known []string
+			for n := range backfillKeyTypes {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("can't backfill key type %q, only %s", name, strings.Join(known, ", "))
+		}
+		out = append(out, types...)
+	}
+	return out, nil
+}
+
+// Backfill writes a copy of this index to the named file, with keys of the
+// given types added for every packet in its blockfile, so indexes written
+// before those key types were enabled can answer queries on them.  Existing
+// keys are kept, so backfilling a key type which was already indexed changes
+// nothing.  Returns how many positions were added.  The whole index is held
+// in memory while it's rewritten.
+func (i *IndexFile) Backfill(ctx context.Context, filename string, keyTypes []byte) (added int, _ error) {
+	if i.scan == nil {
+		return 0, fmt.Errorf("no way to read the packets of %q", i.name)
+	}
+	types := map[byte]bool{}
+	w := NewWriter()
+	for _, t := range keyTypes {
+		types[t] = true
+		w.macs = w.macs || t == keyMAC
+		w.directions = w.directions || t == keySrcPort || t == keyDstPort
+		w.hosts = w.hosts || t >= keySrcIPv4 && t <= keyDstIPv6
+		w.tcpFlags = w.tcpFlags || t == keyTCPFlag
+	}
+	if err := i.scan(ctx, func(pos int64, data []byte) error {
+		if err := w.AddPacket(data, pos); err != nil {
+			return err
+		}
+		return ctx.Err()
+	}); err != nil {
+		return 0, fmt.Errorf("could not read packets of %q: %v", i.name, err)
+	}
+	found := w.keys
+	w.keys = map[string][]uint32{}
+	ss, err := i.reader()
+	if err != nil {
+		return 0, err
+	}
+	iter := ss.Find([]byte{}, nil)
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		if len(key) == 1 && key[0] == keyVersion {
+			continue // Rewritten by WriteFile.
+		} else if len(value)%4 != 0 {
+			iter.Close()
+			return 0, fmt.Errorf("index key %x has invalid value length %d", key, len(value))
+		}
+		positions := make([]uint32, len(value)/4)
+		for j := range positions {
+			positions[j] = binary.BigEndian.Uint32(value[4*j:])
+		}
+		w.keys[string(key)] = positions
+	}
+	if err := iter.Close(); err != nil {
+		return 0, fmt.Errorf("could not read index: %v", err)
+	}
+	for key, positions := range found {
+		if !types[key[0]] {
+			continue
+		}
+		merged := mergePositions(w.keys[key], positions)
+		added += len(merged) - len(w.keys[key])
+		w.keys[key] = merged
+	}
+	return added, w.WriteFile(filename)
+}
+
+// mergePositions merges two sorted lists of positions, dropping duplicates.
+func mergePositions(a, b []uint32) []uint32 {
+	out := make([]uint32, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		var next uint32
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0] <= b[0]:
+			next, a = a[0], a[1:]
+		default:
+			next, b = b[0], b[1:]
+		}
+		if len(out) == 0 || out[len(out)-1] != next {
+			out = append(out, next)
+		}
+	}
+	return out
+}
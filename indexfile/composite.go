@@ -0,0 +1,199 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// CompositePorts are the TCP/UDP ports of hot services to build composite
+// (address and port) keys for, so a query like "host X and port 443" is a
+// single lookup rather than the intersection of two huge position lists.  It
+// should only be changed before any indexes are opened.
+//
+// Composite indexes, like flow indexes, aren't written by stenotype:  each
+// file's is built from its blockfile the first time it's needed, one per
+// port, and kept in a hidden subdirectory of the index directory (see
+// CompositePath).  They're in the mmapped index format, with keys of the port
+// followed by an IPv4 or IPv6 address key, for every pair of the two in a
+// packet's outer headers.
+var CompositePorts = map[uint16]bool{}
+
+const compositeDir = ".composite"
+
+// CompositeDirectory returns the directory composite indexes for the indexes
+// in indexDir are stored in.
+func CompositeDirectory(indexDir string) string {
+	return filepath.Join(indexDir, compositeDir)
+}
+
+// CompositePath returns where the composite index of the given port for the
+// given index is stored.
+func CompositePath(indexPath string, port uint16) string {
+	name := filepath.Base(indexPath) + "." + strconv.Itoa(int(port))
+	return filepath.Join(CompositeDirectory(filepath.Dir(indexPath)), name)
+}
+
+// CompositeFiles returns the composite indexes of the given index which exist.
+func CompositeFiles(indexPath string) []string {
+	files, _ := filepath.Glob(filepath.Join(CompositeDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath)+".*"))
+	return files
+}
+
+// compositeKey returns the composite key of a port and an address index key.
+func compositeKey(port uint16, ipKey []byte) []byte {
+	key := make([]byte, 2, 2+len(ipKey))
+	binary.BigEndian.PutUint16(key, port)
+	return append(key, ipKey...)
+}
+
+// CompositePositions returns the positions in the block file of all packets
+// with the given TCP/UDP port and outer IPs in the given range, which must be
+// in CompositePorts.  The same restrictions as IPPositions apply to from and
+// to.
+func (i *IndexFile) CompositePositions(ctx context.Context, port uint16, from, to net.IP) (base.Positions, error) {
+	var ipType byte
+	switch {
+	case !CompositePorts[port]:
+		return nil, fmt.Errorf("no composite keys for port %d", port)
+	case len(from) != len(to):
+		return nil, fmt.Errorf("IP length mismatch")
+	case bytes.Compare(from, to) > 0:
+		return nil, fmt.Errorf("from IP greater than to IP")
+	case len(from) == 16:
+		ipType = keyIPv6
+	case len(from) == 4:
+		ipType = keyIPv4
+	default:
+		return nil, fmt.Errorf("Invalid IP length")
+	}
+	m, err := i.composite(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+	return i.positionsIn(ctx, m,
+		compositeKey(port, append([]byte{ipType}, from...)),
+		compositeKey(port, append([]byte{ipType}, to...)))
+}
+
+// composite returns the composite index of the given port, building the
+// composite indexes of all CompositePorts if it doesn't exist yet.
+func (i *IndexFile) composite(ctx context.Context, port uint16) (*mmapReader, error) {
+	i.compositeMu.Lock()
+	defer i.compositeMu.Unlock()
+	if m := i.composites[port]; m != nil {
+		return m, nil
+	}
+	path := CompositePath(i.name, port)
+	m, err := openMmapIndex(path)
+	if os.IsNotExist(err) {
+		if err = i.buildCompositeIndexes(ctx); err == nil {
+			m, err = openMmapIndex(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if i.composites == nil {
+		i.composites = map[uint16]*mmapReader{}
+	}
+	i.composites[port] = m
+	return m, nil
+}
+
+// buildCompositeIndexes writes the composite indexes of each of the
+// CompositePorts which doesn't have one yet, in one pass over the blockfile.
+func (i *IndexFile) buildCompositeIndexes(ctx context.Context) error {
+	if i.scan == nil {
+		return fmt.Errorf("no composite index for %q, and no way to build one", i.name)
+	}
+	defer indexCompositeBuildNanos.NanoTimer()()
+	start := time.Now()
+	missing := map[uint16]bool{}
+	for port := range CompositePorts {
+		if _, err := os.Stat(CompositePath(i.name, port)); os.IsNotExist(err) {
+			missing[port] = true
+		}
+	}
+	// Index each packet as the index writer would, and pair up its address and
+	// port keys.
+	w := NewWriter()
+	keys := map[string][]uint32{}
+	var ips, ports [][]byte
+	err := i.scan(ctx, func(pos int64, data []byte) error {
+		for k := range w.keys {
+			delete(w.keys, k)
+		}
+		w.flows = flowGrouper{}
+		if err := w.AddPacket(data, pos); err != nil {
+			return err
+		}
+		ips, ports = ips[:0], ports[:0]
+		for k := range w.keys {
+			switch k[0] {
+			case keyIPv4, keyIPv6:
+				ips = append(ips, []byte(k))
+			case keyPort:
+				if port := binary.BigEndian.Uint16([]byte(k[1:])); missing[port] {
+					ports = append(ports, []byte(k[1:]))
+				}
+			}
+		}
+		for _, port := range ports {
+			for _, ip := range ips {
+				key := string(port) + string(ip)
+				keys[key] = append(keys[key], uint32(pos))
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("could not build composite index for %q: %v", i.name, err)
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	portKeys, portValues := map[uint16][][]byte{}, map[uint16][][]byte{}
+	for _, k := range sorted {
+		port := binary.BigEndian.Uint16([]byte(k))
+		value := make([]byte, 4*len(keys[k]))
+		for j, pos := range keys[k] {
+			binary.BigEndian.PutUint32(value[4*j:], pos)
+		}
+		portKeys[port] = append(portKeys[port], []byte(k))
+		portValues[port] = append(portValues[port], value)
+	}
+	// Ports without packets get empty indexes, so they aren't built again.
+	for port := range missing {
+		if err := writeMmapEntries(portKeys[port], portValues[port], CompositePath(i.name, port)); err != nil {
+			return err
+		}
+	}
+	v(1, "Built %d composite indexes for %q of %d keys in %v", len(missing), i.name, len(keys), time.Since(start))
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Formats Dump writes indexes in.
+const (
+	DumpText = "text" // Each key in hex, one per line.
+	DumpJSON = "json" // A JSON list of DumpEntry, one per line.
+	DumpCSV  = "csv"  // DumpEntry fields, after a header line.
+)
+
+// keyTypeNames names the key types in dumps.
+var keyTypeNames = map[byte]string{
+	keyVersion:    "version",
+	ProtocolKeys:  "proto",
+	PortKeys:      "port",
+	VLANKeys:      "vlan",
+	IPv4Keys:      "ip4",
+	MPLSKeys:      "mpls",
+	IPv6Keys:      "ip6",
+	InnerIPv4Keys: "inner_ip4",
+	InnerIPv6Keys: "inner_ip6",
+	MACKeys:       "mac",
+	TEIDKeys:      "teid",
+	SrcPortKeys:   "src_port",
+	DstPortKeys:   "dst_port",
+	SrcIPv4Keys:   "src_ip4",
+	DstIPv4Keys:   "dst_ip4",
+	SrcIPv6Keys:   "src_ip6",
+	DstIPv6Keys:   "dst_ip6",
+	TCPFlagKeys:   "tcp_flag",
+}
+
+// DumpEntry describes an index key, as Dump writes it in JSON and CSV.
+type DumpEntry struct {
+	Type  string // Key type, like "ip4" or "port", or the type number if unknown.
+	Key   string // The key's value, like "10.0.0.1" or "443".
+	Raw   string // The whole key in hex, including its type.
+	Count int    // Packets with the key, or 0 for the version record.
+}
+
+// dumpEntry describes a key and its value.
+func dumpEntry(key, value []byte) DumpEntry {
+	e := DumpEntry{Raw: hex.EncodeToString(key), Count: len(value) / 4}
+	if len(key) == 0 {
+		return e
+	}
+	t, data := key[0], key[1:]
+	var ok bool
+	if e.Type, ok = keyTypeNames[t]; !ok {
+		e.Type = strconv.Itoa(int(t))
+	}
+	switch {
+	case t == keyVersion && len(value) >= 4:
+		e.Key, e.Count = strconv.FormatUint(uint64(binary.BigEndian.Uint32(value)), 10), 0
+	case len(data) == 1 && t == ProtocolKeys:
+		e.Key = strconv.Itoa(int(data[0]))
+	case len(data) == 2 && (t == PortKeys || t == VLANKeys || t == SrcPortKeys || t == DstPortKeys):
+		e.Key = strconv.Itoa(int(binary.BigEndian.Uint16(data)))
+	case len(data) == 4 && (t == MPLSKeys || t == TEIDKeys):
+		e.Key = strconv.FormatUint(uint64(binary.BigEndian.Uint32(data)), 10)
+	case len(data) == 4 && (t == IPv4Keys || t == InnerIPv4Keys || t == SrcIPv4Keys || t == DstIPv4Keys),
+		len(data) == 16 && (t == IPv6Keys || t == InnerIPv6Keys || t == SrcIPv6Keys || t == DstIPv6Keys):
+		e.Key = net.IP(data).String()
+	case len(data) == 6 && t == MACKeys:
+		e.Key = net.HardwareAddr(data).String()
+	case len(data) == 1 && t == TCPFlagKeys:
+		e.Key = tcpFlagName(data[0])
+	default:
+		e.Key = hex.EncodeToString(data)
+	}
+	return e
+}
+
+// Dump writes the index's keys from 'start' to 'finish' inclusive (or to the
+// end, if 'finish' is empty) in the given format.
+func (i *IndexFile) Dump(out io.Writer, start, finish []byte, format string) error {
+	ss, err := i.reader()
+	if err != nil {
+		return err
+	}
+	var write func(key, value []byte) error
+	done := func() error { return nil }
+	switch format {
+	case DumpText:
+		write = func(key, _ []byte) error {
+			_, err := fmt.Fprintf(out, "%v\n", hex.EncodeToString(key))
+			return err
+		}
+	case DumpJSON:
+		sep := "[\n"
+		write = func(key, value []byte) error {
+			data, err := json.Marshal(dumpEntry(key, value))
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(out, "%s%s", sep, data)
+			sep = ",\n"
+			return err
+		}
+		done = func() error {
+			if sep == "[\n" {
+				_, err := io.WriteString(out, "[]\n")
+				return err
+			}
+			_, err := io.WriteString(out, "\n]\n")
+			return err
+		}
+	case DumpCSV:
+		w := csv.NewWriter(out)
+		w.Write([]string{"Type", "Key", "Raw", "Count"})
+		write = func(key, value []byte) error {
+			e := dumpEntry(key, value)
+			return w.Write([]string{e.Type, e.Key, e.Raw, strconv.Itoa(e.Count)})
+		}
+		done = func() error {
+			w.Flush()
+			return w.Error()
+		}
+	default:
+		return fmt.Errorf("unknown dump format %q", format)
+	}
+	iter := ss.Find(start, nil)
+	for iter.Next() && (len(finish) == 0 || bytes.Compare(iter.Key(), finish) <= 0) {
+		if err := write(iter.Key(), iter.Value()); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return done()
+}
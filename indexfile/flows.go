@@ -0,0 +1,216 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/mars-suite/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// Flow indexes group the packets in a blockfile by bidirectional flow (see
+// base.PacketFlow), so queries can select packets by the number of packets in
+// their flow.  stenotype doesn't write them, so each is built from its
+// blockfile the first time it's needed, and kept in a hidden subdirectory of
+// the index directory (see FlowPath).
+//
+// The flow index format is:
+//
+//	magic   [8]byte  "STENOFL1"
+//	flows   []flow   to the end of the file, largest first
+//
+// where each flow is a uint32 count of its packets followed by their uint32
+// positions in order.  All integers are big endian.
+var flowMagic = []byte("STENOFL1")
+
+const flowDir = ".flows"
+
+// FlowDirectory returns the directory flow indexes for the indexes in
+// indexDir are stored in.
+func FlowDirectory(indexDir string) string {
+	return filepath.Join(indexDir, flowDir)
+}
+
+// FlowPath returns where the flow index for the given index is stored.
+func FlowPath(indexPath string) string {
+	return filepath.Join(FlowDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// PacketScanner calls fn with the position and Ethernet frame of each packet
+// in a blockfile, in order, stopping if fn returns an error.
+type PacketScanner func(ctx context.Context, fn func(pos int64, data []byte) error) error
+
+// flowGrouper groups packet positions by flow.
+type flowGrouper map[[2]gopacket.Flow][]uint32
+
+func (g flowGrouper) add(data []byte, pos uint32) {
+	var k [2]gopacket.Flow
+	k[0], k[1] = base.PacketFlow(&base.Packet{Data: data})
+	g[k] = append(g[k], pos)
+}
+
+// flows returns the positions of each flow's packets, largest flow first.
+func (g flowGrouper) flows() [][]uint32 {
+	out := make([][]uint32, 0, len(g))
+	for _, positions := range g {
+		out = append(out, positions)
+	}
+	sort.Slice(out, func(i, j int) bool { return len(out[i]) > len(out[j]) })
+	return out
+}
+
+// flowPositions returns the positions of packets in flows of between min and
+// max packets, inclusive.
+func flowPositions(flows [][]uint32, min, max int) base.Positions {
+	out := base.Positions{}
+	for _, f := range flows {
+		if len(f) < min {
+			break
+		} else if len(f) > max {
+			continue
+		}
+		for _, pos := range f {
+			out = append(out, int64(pos))
+		}
+	}
+	out.Sort()
+	return out
+}
+
+// writeFlowIndex writes 'flows' (largest first) to a new flow index at
+// 'filename', via a hidden temporary file so it's never seen half-written.
+func writeFlowIndex(flows [][]uint32, filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return fmt.Errorf("could not create flow index directory: %v", err)
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not create flow index: %v", err)
+	}
+	defer os.Remove(tmp) // no-op once renamed into place
+	w := bufio.NewWriter(f)
+	w.Write(flowMagic)
+	for _, positions := range flows {
+		binary.Write(w, binary.BigEndian, uint32(len(positions)))
+		binary.Write(w, binary.BigEndian, positions)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write flow index: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close flow index: %v", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("could not move flow index into place: %v", err)
+	}
+	return nil
+}
+
+// readFlowIndex reads the flows with at least min packets from a flow index.
+func readFlowIndex(filename string, min int) ([][]uint32, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, flowMagic) {
+		return nil, fmt.Errorf("flow index %q has bad magic", filename)
+	}
+	var flows [][]uint32
+	for data = data[len(flowMagic):]; len(data) > 0; {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("flow index %q truncated", filename)
+		}
+		n := int(binary.BigEndian.Uint32(data))
+		if n < min {
+			break
+		}
+		data = data[4:]
+		if len(data) < 4*n {
+			return nil, fmt.Errorf("flow index %q truncated", filename)
+		}
+		positions := make([]uint32, n)
+		for i := range positions {
+			positions[i] = binary.BigEndian.Uint32(data[4*i:])
+		}
+		flows = append(flows, positions)
+		data = data[4*n:]
+	}
+	return flows, nil
+}
+
+// SetPacketScanner gives the index a way to read its blockfile's packets,
+// which FlowPositions needs to build a flow index if there isn't one yet.
+func (i *IndexFile) SetPacketScanner(s PacketScanner) {
+	i.scan = s
+}
+
+// FlowPositions returns the positions in the block file of all packets in
+// flows with between min and max packets in the file, inclusive.
+func (i *IndexFile) FlowPositions(ctx context.Context, min, max int) (base.Positions, error) {
+	if i.flows != nil {
+		return flowPositions(i.flows, min, max), nil
+	}
+	i.flowMu.Lock()
+	defer i.flowMu.Unlock()
+	path := FlowPath(i.name)
+	flows, err := readFlowIndex(path, min)
+	if os.IsNotExist(err) {
+		if err = i.buildFlowIndex(ctx, path); err == nil {
+			flows, err = readFlowIndex(path, min)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return flowPositions(flows, min, max), nil
+}
+
+// buildFlowIndex writes the flow index for the index's blockfile to 'path'.
+func (i *IndexFile) buildFlowIndex(ctx context.Context, path string) error {
+	if i.scan == nil {
+		return fmt.Errorf("no flow index for %q, and no way to build one", i.name)
+	}
+	defer indexFlowBuildNanos.NanoTimer()()
+	start := time.Now()
+	g := flowGrouper{}
+	err := i.scan(ctx, func(pos int64, data []byte) error {
+		if pos < 0 || pos >= 1<<32 {
+			return fmt.Errorf("position %d out of range", pos)
+		}
+		g.add(data, uint32(pos))
+		return ctx.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("could not build flow index for %q: %v", i.name, err)
+	}
+	flows := g.flows()
+	if err := writeFlowIndex(flows, path); err != nil {
+		return err
+	}
+	v(1, "Built flow index %q of %d flows in %v", path, len(flows), time.Since(start))
+	return nil
+}
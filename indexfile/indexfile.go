@@ -19,16 +19,17 @@ package indexfile
 import (
 	"bytes"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
-	"io"
+	"log"
 	"net"
 	"strings"
+	"sync"
 
+	"github.com/golang/leveldb/db"
 	"github.com/golang/leveldb/table"
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/stats"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/stats"
 	"golang.org/x/net/context"
 )
 
@@ -37,6 +38,16 @@ var (
 	indexReadNanos    = stats.S.Get("indexfile_read_nanos")
 	indexReads        = stats.S.Get("indexfile_reads")
 	indexCurrentReads = stats.S.Get("indexfile_current_reads")
+
+	indexMmapBuildNanos  = stats.S.Get("indexfile_mmap_build_nanos")
+	indexShardBuildNanos = stats.S.Get("indexfile_shard_build_nanos")
+	indexShardsOpened    = stats.S.Get("indexfile_shards_opened")
+
+	indexCompositeBuildNanos = stats.S.Get("indexfile_composite_build_nanos")
+	indexFlowBuildNanos      = stats.S.Get("indexfile_flow_build_nanos")
+	indexAppBuildNanos       = stats.S.Get("indexfile_app_build_nanos")
+	indexQUICBuildNanos      = stats.S.Get("indexfile_quic_build_nanos")
+	indexStatsBuildNanos     = stats.S.Get("indexfile_stats_build_nanos")
 )
 
 // Major version number of the file format that we support.
@@ -45,7 +56,33 @@ const majorVersionNumber = 2
 // IndexFile wraps a stenotype index, allowing it to be queried.
 type IndexFile struct {
 	name string
-	ss   *table.Reader
+	// started is when the index's blockfile may have been started, see
+	// SetStarted.
+	started base.TimeRange
+	ss      kvReader
+	file    *filecache.CachedFile // ss's file, if it's not in memory.
+	// open, if set, opens ss on first use, see NewLazyIndexFile.
+	open     func() (kvReader, error)
+	openOnce sync.Once
+	openErr  error
+	// flows is the flow index of in-memory indexes, which aren't stored on
+	// disk.  Other indexes build theirs with scan.
+	flows  [][]uint32
+	scan   PacketScanner
+	flowMu sync.Mutex // Held while reading or building the flow index.
+	// composites are the composite indexes opened so far, by port.
+	composites  map[uint16]*mmapReader
+	compositeMu sync.Mutex // Held while opening or building composite indexes.
+	// app is the app index, once it's been opened.
+	app   *mmapReader
+	appMu sync.Mutex // Held while opening or building the app index.
+	// quic is the QUIC index, once it's been opened.
+	quic   *mmapReader
+	quicMu sync.Mutex // Held while opening or building the QUIC index.
+	// stats are the index's statistics, once statsLoaded, see Stats.
+	stats       *Stats
+	statsLoaded bool
+	statsMu     sync.Mutex
 }
 
 // IndexPathFromBlockfilePath returns the path to an index file based on the path to a
@@ -60,10 +97,56 @@ func BlockfilePathFromIndexPath(p string) string {
 	return strings.Replace(p, "IDX", "PKT", 1)
 }
 
+// Options are how index files are read.  The zero Options read them directly
+// from stenotype's leveldb tables.
+type Options struct {
+	// Mmap reads indexes from memory-mapped sorted files rather than directly
+	// from stenotype's leveldb tables.  Each sorted file is built from its
+	// leveldb table the first time the index is opened, and kept in a hidden
+	// subdirectory of the index directory (see MmapPath).  Lookups are then a
+	// binary search over an in-memory key table, rather than leveldb's block
+	// reads, which read far more data than index lookups need.
+	Mmap bool
+	// Sharded reads indexes from memory-mapped files split by key type.  Each
+	// key type (IPv4 addresses, ports, protocols, and so on) gets its own file
+	// in the mmapped index format, and a file is only mapped once a lookup
+	// needs that key type, so port-only queries never page in the far larger
+	// IP keyspace, and vice versa.  Shards are built like Mmap's sorted files,
+	// in their own hidden subdirectory (see ShardPath).  It takes precedence
+	// over Mmap.
+	Sharded bool
+}
+
 // NewIndexFile returns a new handle to the named index file.
-func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
+func NewIndexFile(filename string, fc *filecache.Cache, opts Options) (*IndexFile, error) {
+	f := fc.Open(filename)
+	ss, err := openIndex(filename, f, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexFile{ss: ss, name: filename, file: f}, nil
+}
+
+// NewLazyIndexFile returns a new handle to the named index file, which isn't
+// opened (or checked) until it's first used.  Lookups return any error
+// opening it.
+func NewLazyIndexFile(filename string, fc *filecache.Cache, opts Options) *IndexFile {
+	f := fc.Open(filename)
+	return &IndexFile{name: filename, file: f, open: func() (kvReader, error) {
+		unlock, err := RLockIndex(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		return openIndex(filename, f, opts)
+	}}
+}
+
+// openIndex opens the named index file, read through 'f', with the backend
+// 'opts' choose, after checking its version.
+func openIndex(filename string, f *filecache.CachedFile, opts Options) (kvReader, error) {
 	v(1, "opening index %q", filename)
-	ss := table.NewReader(fc.Open(filename), nil)
+	ss := table.NewReader(f, nil)
 	if versions, err := ss.Get([]byte{0}, nil); err != nil {
 		return nil, fmt.Errorf("invalid index file %q missing versions record: %v", filename, err)
 	} else if len(versions) != 8 {
@@ -73,7 +156,7 @@ func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
 	} else {
 		v(3, "index file %q has file format version %d:%d", filename, major, minor)
 	}
-	if *base.VerboseLogging >= 10 {
+	if base.ModuleVerbosity("indexfile") >= 10 {
 		iter := ss.Find([]byte{}, nil)
 		v(4, "=== %q ===", filename)
 		for iter.Next() {
@@ -81,8 +164,31 @@ func NewIndexFile(filename string, fc *filecache.Cache) (*IndexFile, error) {
 		}
 		v(4, "  ERR: %v", iter.Close())
 	}
-	index := &IndexFile{ss: ss, name: filename}
-	return index, nil
+	if opts.Sharded {
+		if sh, err := openSharded(filename, ss); err != nil {
+			log.Printf("Falling back to leveldb for index %q: %v", filename, err)
+		} else {
+			ss.Close()
+			return sh, nil
+		}
+	} else if opts.Mmap {
+		if mm, err := openMmap(filename, ss); err != nil {
+			log.Printf("Falling back to leveldb for index %q: %v", filename, err)
+		} else {
+			ss.Close()
+			return mm, nil
+		}
+	}
+	return ss, nil
+}
+
+// reader returns the index's reader, opening it first if it was opened
+// lazily.
+func (i *IndexFile) reader() (kvReader, error) {
+	if i.open != nil {
+		i.openOnce.Do(func() { i.ss, i.openErr = i.open() })
+	}
+	return i.ss, i.openErr
 }
 
 // Name returns the name of the file underlying this index.
@@ -90,10 +196,58 @@ func (i *IndexFile) Name() string {
 	return i.name
 }
 
+// SetStarted records when the index's blockfile may have been started, which
+// time-based queries prune by:  a range around the time in its name, allowing
+// for clock skew.
+func (i *IndexFile) SetStarted(r base.TimeRange) {
+	i.started = r
+}
+
+// Started returns when the index's blockfile may have been started, see
+// SetStarted.  Both ends are zero if that's unknown.
+func (i *IndexFile) Started() base.TimeRange {
+	return i.started
+}
+
+// Replaced returns whether lookups have failed because the index file was
+// replaced while it was open, see filecache.ReplacedError.
+func (i *IndexFile) Replaced() bool {
+	return i.file != nil && i.file.Replaced()
+}
+
 // IPPositions returns the positions in the block file of all packets with IPs
 // between the given ranges.  Both IPs must be 4 or 16 bytes long, both must be
 // the same length, and from must be <= to.
 func (i *IndexFile) IPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
+	return i.ipPositions(ctx, from, to, 4, 6)
+}
+
+// InnerIPPositions returns the positions in the block file of all packets
+// tunneled (IP-in-IP, 6in4, 4in6) between inner IPs in the given range.  The
+// same restrictions as IPPositions apply to from and to.
+func (i *IndexFile) InnerIPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
+	return i.ipPositions(ctx, from, to, 7, 8)
+}
+
+// SrcIPPositions returns the positions in the block file of all packets with
+// outer source IPs in the given range.  Only indexes with host direction keys
+// (see HasHostDirections) have any.  The same restrictions as IPPositions
+// apply to from and to.
+func (i *IndexFile) SrcIPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
+	return i.ipPositions(ctx, from, to, keySrcIPv4, keySrcIPv6)
+}
+
+// DstIPPositions returns the positions in the block file of all packets with
+// outer destination IPs in the given range.  Only indexes with host direction
+// keys (see HasHostDirections) have any.  The same restrictions as
+// IPPositions apply to from and to.
+func (i *IndexFile) DstIPPositions(ctx context.Context, from, to net.IP) (base.Positions, error) {
+	return i.ipPositions(ctx, from, to, keyDstIPv4, keyDstIPv6)
+}
+
+// ipPositions looks up an IP range, using index type ip4Type for IPv4 ranges
+// and ip6Type for IPv6 ranges.
+func (i *IndexFile) ipPositions(ctx context.Context, from, to net.IP, ip4Type, ip6Type byte) (base.Positions, error) {
 	var version byte
 	switch {
 	case len(from) != len(to):
@@ -101,9 +255,9 @@ func (i *IndexFile) IPPositions(ctx context.Context, from, to net.IP) (base.Posi
 	case bytes.Compare(from, to) > 0:
 		return nil, fmt.Errorf("from IP greater than to IP")
 	case len(from) == 16:
-		version = 6
+		version = ip6Type
 	case len(from) == 4:
-		version = 4
+		version = ip4Type
 	default:
 		return nil, fmt.Errorf("Invalid IP length")
 	}
@@ -128,6 +282,53 @@ func (i *IndexFile) PortPositions(ctx context.Context, port uint16) (base.Positi
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
+// SrcPortPositions returns the positions in the block file of all packets with
+// the given TCP or UDP source port.  Only indexes with port direction keys
+// (see HasPortDirections) have any.
+func (i *IndexFile) SrcPortPositions(ctx context.Context, port uint16) (base.Positions, error) {
+	var buf [3]byte
+	binary.BigEndian.PutUint16(buf[1:], port)
+	buf[0] = keySrcPort
+	return i.positionsSingleKey(ctx, buf[:])
+}
+
+// DstPortPositions returns the positions in the block file of all packets with
+// the given TCP or UDP destination port.  Only indexes with port direction
+// keys (see HasPortDirections) have any.
+func (i *IndexFile) DstPortPositions(ctx context.Context, port uint16) (base.Positions, error) {
+	var buf [3]byte
+	binary.BigEndian.PutUint16(buf[1:], port)
+	buf[0] = keyDstPort
+	return i.positionsSingleKey(ctx, buf[:])
+}
+
+// HasPortDirections returns whether the index has port direction keys, which
+// stenotype only writes with --index_port_direction.
+func (i *IndexFile) HasPortDirections() (bool, error) {
+	return i.hasKeyTypes(keySrcPort, keyDstPort)
+}
+
+// HasHostDirections returns whether the index has host direction keys, which
+// stenotype only writes with --index_host_direction.
+func (i *IndexFile) HasHostDirections() (bool, error) {
+	return i.hasKeyTypes(keySrcIPv4, keyDstIPv6)
+}
+
+// hasKeyTypes returns whether the index has any keys with types between
+// 'first' and 'last'.
+func (i *IndexFile) hasKeyTypes(first, last byte) (bool, error) {
+	ss, err := i.reader()
+	if err != nil {
+		return false, err
+	}
+	iter := ss.Find([]byte{first}, nil)
+	found := iter.Next() && iter.Key()[0] <= last
+	if err := iter.Close(); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
 // VLANPositions returns the positions in the block file of all packets with
 // the given VLAN number.
 func (i *IndexFile) VLANPositions(ctx context.Context, port uint16) (base.Positions, error) {
@@ -146,17 +347,77 @@ func (i *IndexFile) MPLSPositions(ctx context.Context, mpls uint32) (base.Positi
 	return i.positionsSingleKey(ctx, buf[:])
 }
 
-// Dump writes out a debug version of the entire index to the given writer.
-func (i *IndexFile) Dump(out io.Writer, start, finish []byte) {
-	for iter := i.ss.Find(start, nil); iter.Next() && bytes.Compare(iter.Key(), finish) <= 0; {
-		fmt.Fprintf(out, "%v\n", hex.EncodeToString(iter.Key()))
+// TEIDPositions returns the positions in the block file of all GTP-U packets
+// with the given tunnel endpoint ID.
+func (i *IndexFile) TEIDPositions(ctx context.Context, teid uint32) (base.Positions, error) {
+	var buf [5]byte
+	binary.BigEndian.PutUint32(buf[1:], teid)
+	buf[0] = 10
+	return i.positionsSingleKey(ctx, buf[:])
+}
+
+// MACPositions returns the positions in the block file of all packets with
+// the given source or destination MAC address.
+func (i *IndexFile) MACPositions(ctx context.Context, mac net.HardwareAddr) (base.Positions, error) {
+	if len(mac) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %v", mac)
+	}
+	var buf [7]byte
+	copy(buf[1:], mac)
+	buf[0] = 9
+	return i.positionsSingleKey(ctx, buf[:])
+}
+
+// Verify reads through the entire index, returning an error if it can't be
+// read or holds position lists which stenotype couldn't have written.
+func (i *IndexFile) Verify(ctx context.Context) error {
+	var last []byte
+	ss, err := i.reader()
+	if err != nil {
+		return err
 	}
+	iter := ss.Find([]byte{}, nil)
+	for iter.Next() && !base.ContextDone(ctx) {
+		key, value := iter.Key(), iter.Value()
+		if last != nil && bytes.Compare(last, key) >= 0 {
+			iter.Close()
+			return fmt.Errorf("index key %x out of order after %x", key, last)
+		}
+		last = append(last[:0], key...)
+		if len(key) == 1 && key[0] == keyVersion {
+			continue // The version record's value isn't a list of positions.
+		} else if len(value) == 0 || len(value)%4 != 0 {
+			iter.Close()
+			return fmt.Errorf("index key %x has invalid value length %d", key, len(value))
+		}
+		for j := 4; j < len(value); j += 4 {
+			if binary.BigEndian.Uint32(value[j-4:]) > binary.BigEndian.Uint32(value[j:]) {
+				iter.Close()
+				return fmt.Errorf("index key %x has unsorted positions", key)
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		iter.Close()
+		return err
+	}
+	return iter.Close()
 }
 
 // positions returns a set of positions to look for packets, based on a
 // lookup of all blockfile positions stored between (inclusively) index
 // keys 'from' and 'to'.
-func (i *IndexFile) positions(ctx context.Context, from, to []byte) (out base.Positions, _ error) {
+func (i *IndexFile) positions(ctx context.Context, from, to []byte) (base.Positions, error) {
+	ss, err := i.reader()
+	if err != nil {
+		return nil, err
+	}
+	return i.positionsIn(ctx, ss, from, to)
+}
+
+// positionsIn is like positions, but looks up keys in 'ss' rather than the
+// index itself.
+func (i *IndexFile) positionsIn(ctx context.Context, ss kvReader, from, to []byte) (out base.Positions, _ error) {
 	v(4, "%q multi key iterator %v:%v start", i.name, from, to)
 	if len(from) != len(to) {
 		return nil, fmt.Errorf("invalid from/to lengths don't match: %v %v", from, to)
@@ -167,12 +428,28 @@ func (i *IndexFile) positions(ctx context.Context, from, to []byte) (out base.Po
 		indexReads.Increment()
 	}()
 	defer indexReadNanos.NanoTimer()()
-	iter := i.ss.Find(from, nil)
+	// Track the memory used by positions while we merge them.  Callers account
+	// for the final result themselves.
+	budget := base.MemoryBudgetFrom(ctx)
+	var reserved int64
+	defer func() { budget.Release(reserved) }()
+	var iter db.Iterator
+	if sh, ok := ss.(*shardedReader); ok {
+		iter = sh.findRange(from, to)
+	} else {
+		iter = ss.Find(from, nil)
+	}
 	for iter.Next() && !base.ContextDone(ctx) {
 		if to != nil && bytes.Compare(iter.Key(), to) > 0 {
 			v(4, "%q multi key iterator %v:%v hit limit with %v", i.name, from, to, iter.Key())
 			break
 		}
+		size := int64(len(iter.Value()) / 4 * 8 * 2) // current, plus its share of out
+		if err := budget.Reserve(size); err != nil {
+			iter.Close()
+			return nil, err
+		}
+		reserved += size
 		current := make(base.Positions, len(iter.Value())/4)
 		for i := 0; i < len(iter.Value()); i += 4 {
 			current[i/4] = int64(binary.BigEndian.Uint32(iter.Value()[i : i+4]))
@@ -212,5 +489,30 @@ func parseIP(in string) net.IP {
 
 // Close the indexfile.
 func (i *IndexFile) Close() error {
+	i.compositeMu.Lock()
+	for _, m := range i.composites {
+		m.Close()
+	}
+	i.composites = nil
+	i.compositeMu.Unlock()
+	i.appMu.Lock()
+	if i.app != nil {
+		i.app.Close()
+		i.app = nil
+	}
+	i.appMu.Unlock()
+	i.quicMu.Lock()
+	if i.quic != nil {
+		i.quic.Close()
+		i.quic = nil
+	}
+	i.quicMu.Unlock()
+	if i.open != nil {
+		// Never open a lazy index just to close it.
+		i.openOnce.Do(func() { i.openErr = fmt.Errorf("index %q closed", i.name) })
+	}
+	if i.ss == nil {
+		return nil
+	}
 	return i.ss.Close()
 }
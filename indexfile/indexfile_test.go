@@ -16,28 +16,102 @@ package indexfile
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/golang/leveldb/table"
 	"golang.org/x/net/context"
 
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/filecache"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/filecache"
 )
 
 var ctx = context.Background()
 
+// testdata is a copy of the repository's testdata directory, since opening
+// indexes writes lock files beside them.
+var testdata string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "indexfile_test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := exec.Command("cp", "-r", "../testdata", dir).Run(); err != nil {
+		log.Fatalf("could not copy testdata: %v", err)
+	}
+	testdata = filepath.Join(dir, "testdata")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func testIndexFile(t *testing.T, filename string) *IndexFile {
-	idx, err := NewIndexFile(filename, filecache.NewCache(10))
+	return testIndexFileWith(t, filename, Options{})
+}
+
+// testIndexFileWith is testIndexFile, reading the index as 'opts' say.
+func testIndexFileWith(t *testing.T, filename string, opts Options) *IndexFile {
+	idx, err := NewIndexFile(filename, filecache.NewCache(10), opts)
 	if err != nil {
 		t.Fatal(err)
 	}
 	return idx
 }
 
+// writeTestIndex writes an index file containing the given keys (hex-encoded)
+// and positions to a temporary directory, returning its name.  The caller
+// should remove the file's directory when done with it.
+func writeTestIndex(t *testing.T, entries map[string][]uint32) string {
+	dir, err := ioutil.TempDir("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "1420000000000000")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := table.NewWriter(f, nil)
+	keys := []string{"00"}
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		k, err := hex.DecodeString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := []byte{0, 0, 0, majorVersionNumber, 0, 0, 0, 0}
+		if key != "00" {
+			value = make([]byte, 4*len(entries[key]))
+			for i, pos := range entries[key] {
+				binary.BigEndian.PutUint32(value[i*4:], pos)
+			}
+		}
+		if err := w.Set(k, value, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
 func TestIPPositions(t *testing.T) {
-	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	idx := testIndexFile(t, filepath.Join(testdata, "IDX0", "dhcp"))
 	defer idx.Close()
 	for _, test := range []struct {
 		start string
@@ -55,8 +129,87 @@ func TestIPPositions(t *testing.T) {
 	}
 }
 
+func TestInnerIPPositions(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"040a000001":                         {100, 200}, // outer 10.0.0.1
+		"07c0a80001":                         {200},      // inner 192.168.0.1
+		"07c0a80002":                         {200, 300}, // inner 192.168.0.2
+		"0800000000000000000000000000000001": {400},      // inner ::1
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	for _, test := range []struct {
+		start string
+		end   string
+		want  base.Positions
+	}{
+		{"192.168.0.1", "192.168.0.254", base.Positions{200, 300}},
+		{"10.0.0.1", "10.0.0.1", nil},
+		{"::1", "::1", base.Positions{400}},
+	} {
+		if got, err := idx.InnerIPPositions(ctx, parseIP(test.start), parseIP(test.end)); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong inner IP positions.\nwant: %v\n got: %v\n", test.want, got)
+		}
+	}
+}
+
+func TestMACPositions(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"09001122334455": {100, 200},
+		"09ffffffffffff": {200, 300},
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	for _, test := range []struct {
+		mac  string
+		want base.Positions
+	}{
+		{"00:11:22:33:44:55", base.Positions{100, 200}},
+		{"ff:ff:ff:ff:ff:ff", base.Positions{200, 300}},
+		{"00:11:22:33:44:56", nil},
+	} {
+		mac, err := net.ParseMAC(test.mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := idx.MACPositions(ctx, mac); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong MAC positions.\nwant: %v\n got: %v\n", test.want, got)
+		}
+	}
+}
+
+func TestTEIDPositions(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"0a00003039": {100, 200},
+		"0affffffff": {300},
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	for _, test := range []struct {
+		teid uint32
+		want base.Positions
+	}{
+		{12345, base.Positions{100, 200}},
+		{0xffffffff, base.Positions{300}},
+		{12346, nil},
+	} {
+		if got, err := idx.TEIDPositions(ctx, test.teid); err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("wrong TEID positions.\nwant: %v\n got: %v\n", test.want, got)
+		}
+	}
+}
+
 func TestMPLSPositions(t *testing.T) {
-	idx := testIndexFile(t, "../testdata/IDX0/mpls")
+	idx := testIndexFile(t, filepath.Join(testdata, "IDX0", "mpls"))
 	defer idx.Close()
 	for _, test := range []struct {
 		label uint32
@@ -73,8 +226,62 @@ func TestMPLSPositions(t *testing.T) {
 	}
 }
 
+func TestPortDirections(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"0201bb": {100, 200},
+		"0b01bb": {100},
+		"0c01bb": {200},
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	if ok, err := idx.HasPortDirections(); err != nil || !ok {
+		t.Errorf("HasPortDirections got %v, %v", ok, err)
+	}
+	if got, err := idx.SrcPortPositions(ctx, 443); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+		t.Errorf("src port 443 got %v, %v", got, err)
+	}
+	if got, err := idx.DstPortPositions(ctx, 443); err != nil || !reflect.DeepEqual(got, base.Positions{200}) {
+		t.Errorf("dst port 443 got %v, %v", got, err)
+	}
+
+	undirected := writeTestIndex(t, map[string][]uint32{"0201bb": {100, 200}})
+	defer os.RemoveAll(filepath.Dir(undirected))
+	idx = testIndexFile(t, undirected)
+	defer idx.Close()
+	if ok, err := idx.HasPortDirections(); err != nil || ok {
+		t.Errorf("HasPortDirections of index without them got %v, %v", ok, err)
+	}
+}
+
+func TestHostDirections(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"040a000001": {100, 200},
+		"040a000002": {100, 200},
+		"0d0a000001": {100},
+		"0e0a000001": {200},
+		"0e0a000002": {100},
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	if ok, err := idx.HasHostDirections(); err != nil || !ok {
+		t.Errorf("HasHostDirections got %v, %v", ok, err)
+	}
+	if ok, err := idx.HasPortDirections(); err != nil || ok {
+		t.Errorf("HasPortDirections of index without them got %v, %v", ok, err)
+	}
+	from, to := net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 1}
+	if got, err := idx.SrcIPPositions(ctx, from, to); err != nil || !reflect.DeepEqual(got, base.Positions{100}) {
+		t.Errorf("src 10.0.0.0-10.0.0.1 got %v, %v", got, err)
+	}
+	if got, err := idx.DstIPPositions(ctx, from, to); err != nil || !reflect.DeepEqual(got, base.Positions{200}) {
+		t.Errorf("dst 10.0.0.0-10.0.0.1 got %v, %v", got, err)
+	}
+}
+
 func TestVLANPositions(t *testing.T) {
-	idx := testIndexFile(t, "../testdata/IDX0/vlan")
+	idx := testIndexFile(t, filepath.Join(testdata, "IDX0", "vlan"))
 	defer idx.Close()
 	for _, test := range []struct {
 		id   uint16
@@ -92,7 +299,7 @@ func TestVLANPositions(t *testing.T) {
 }
 
 func TestProtoPositions(t *testing.T) {
-	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	idx := testIndexFile(t, filepath.Join(testdata, "IDX0", "dhcp"))
 	defer idx.Close()
 	for _, test := range []struct {
 		proto byte
@@ -110,7 +317,7 @@ func TestProtoPositions(t *testing.T) {
 }
 
 func TestPortPositions(t *testing.T) {
-	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	idx := testIndexFile(t, filepath.Join(testdata, "IDX0", "dhcp"))
 	defer idx.Close()
 	for _, test := range []struct {
 		port uint16
@@ -128,14 +335,679 @@ func TestPortPositions(t *testing.T) {
 }
 
 func TestDump(t *testing.T) {
-	idx := testIndexFile(t, "../testdata/IDX0/dhcp")
+	idx := testIndexFile(t, filepath.Join(testdata, "IDX0", "dhcp"))
 	want := "00\n0111\n013a\n"
 	var w bytes.Buffer
 	start, _ := hex.DecodeString("00")
 	end, _ := hex.DecodeString("02")
-	idx.Dump(&w, start, end)
+	if err := idx.Dump(&w, start, end, DumpText); err != nil {
+		t.Fatal(err)
+	}
 	got := w.String()
 	if got != want {
 		t.Fatalf("invalid dump.\nwant %q\n got: %q\n", want, got)
 	}
+	start, _ = hex.DecodeString("01")
+	end, _ = hex.DecodeString("020043")
+	for format, want := range map[string]string{
+		DumpJSON: `[
+{"Type":"proto","Key":"17","Raw":"0111","Count":4},
+{"Type":"proto","Key":"58","Raw":"013a","Count":2},
+{"Type":"port","Key":"67","Raw":"020043","Count":4}
+]
+`,
+		DumpCSV: "Type,Key,Raw,Count\nproto,17,0111,4\nproto,58,013a,2\nport,67,020043,4\n",
+	} {
+		w.Reset()
+		if err := idx.Dump(&w, start, end, format); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.String(); got != want {
+			t.Errorf("invalid %s dump.\nwant %q\n got: %q\n", format, want, got)
+		}
+	}
+	if err := idx.Dump(&w, nil, nil, "xml"); err == nil {
+		t.Error("dumped in unknown format")
+	}
+}
+
+func TestMmapIndex(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"0111":       {1, 5},
+		"020035":     {1, 2, 3},
+		"040a000001": {2},
+		"040a000002": {3, 4},
+		"06" + "20010db8000000000000000000000001": {5},
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFileWith(t, filename, Options{Mmap: true})
+	defer idx.Close()
+	if _, ok := idx.ss.(*mmapReader); !ok {
+		t.Fatalf("index not mmapped")
+	}
+	if _, err := os.Stat(MmapPath(filename)); err != nil {
+		t.Errorf("mmap index not written: %v", err)
+	}
+	for _, test := range []struct {
+		got  func() (base.Positions, error)
+		want base.Positions
+	}{
+		{func() (base.Positions, error) { return idx.ProtoPositions(ctx, 0x11) }, base.Positions{1, 5}},
+		{func() (base.Positions, error) { return idx.ProtoPositions(ctx, 6) }, nil},
+		{func() (base.Positions, error) { return idx.PortPositions(ctx, 53) }, base.Positions{1, 2, 3}},
+		{func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.0"), parseIP("10.0.0.255"))
+		}, base.Positions{2, 3, 4}},
+		{func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("2001:db8::"), parseIP("2001:db8::ffff"))
+		}, base.Positions{5}},
+		{func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.3"), parseIP("10.0.0.255"))
+		}, nil},
+	} {
+		if got, err := test.got(); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("want %v got %v", test.want, got)
+		}
+	}
+	var w bytes.Buffer
+	idx.Dump(&w, []byte{0}, []byte{2}, DumpText)
+	if got, want := w.String(), "00\n0111\n"; got != want {
+		t.Errorf("invalid dump.\nwant %q\n got: %q\n", want, got)
+	}
+}
+
+func TestShardedIndex(t *testing.T) {
+	filename := writeTestIndex(t, map[string][]uint32{
+		"0111":       {1, 5},
+		"020035":     {1, 2, 3},
+		"040a000001": {2},
+		"040a000002": {3, 4},
+		"06" + "20010db8000000000000000000000001": {5},
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFileWith(t, filename, Options{Sharded: true})
+	defer idx.Close()
+	sh, ok := idx.ss.(*shardedReader)
+	if !ok {
+		t.Fatalf("index not sharded")
+	}
+	if got, want := ShardFiles(filename), 6; len(got) != want {
+		t.Errorf("got shard files %v, want %d", got, want)
+	}
+	// Only the shards a lookup needs are mapped.
+	if got, err := idx.PortPositions(ctx, 53); err != nil || !reflect.DeepEqual(got, base.Positions{1, 2, 3}) {
+		t.Errorf("port lookup got %v, %v", got, err)
+	}
+	if len(sh.shards) != 1 || sh.shards[keyPort] == nil {
+		t.Errorf("port lookup mapped shards %v", sh.shards)
+	}
+	for _, test := range []struct {
+		got  func() (base.Positions, error)
+		want base.Positions
+	}{
+		{func() (base.Positions, error) { return idx.ProtoPositions(ctx, 0x11) }, base.Positions{1, 5}},
+		{func() (base.Positions, error) { return idx.ProtoPositions(ctx, 6) }, nil},
+		{func() (base.Positions, error) { return idx.VLANPositions(ctx, 1) }, nil},
+		{func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.0"), parseIP("10.0.0.255"))
+		}, base.Positions{2, 3, 4}},
+		{func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("2001:db8::"), parseIP("2001:db8::ffff"))
+		}, base.Positions{5}},
+		{func() (base.Positions, error) {
+			return idx.IPPositions(ctx, parseIP("10.0.0.3"), parseIP("10.0.0.255"))
+		}, nil},
+	} {
+		if got, err := test.got(); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("want %v got %v", test.want, got)
+		}
+	}
+	// Iterating runs on through the shards.
+	var w bytes.Buffer
+	idx.Dump(&w, []byte{1}, []byte{5}, DumpText)
+	if got, want := w.String(), "0111\n020035\n040a000001\n040a000002\n"; got != want {
+		t.Errorf("invalid dump.\nwant %q\n got: %q\n", want, got)
+	}
+	if err := idx.Verify(ctx); err != nil {
+		t.Errorf("sharded index failed verification: %v", err)
+	}
+}
+
+func TestWriterIPv6Extensions(t *testing.T) {
+	ip6 := func(next byte, rest ...byte) []byte {
+		data := make([]byte, 14+40)
+		data[12], data[13] = 0x86, 0xdd // IPv6 ethertype
+		data[14] = 0x60
+		binary.BigEndian.PutUint16(data[14+4:], uint16(len(rest)))
+		data[14+6] = next
+		data[14+7] = 64
+		data[14+8+15] = 1  // src ::1
+		data[14+24+15] = 2 // dst ::2
+		return append(data, rest...)
+	}
+	udp := []byte{0x04, 0xd2, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00} // 1234 -> 53
+	hopByHop := append([]byte{17, 0, 1, 4, 0, 0, 0, 0}, udp...)
+	firstFragment := append([]byte{17, 0, 0x00, 0x01, 0, 0, 0, 1}, udp...)
+	for _, test := range []struct {
+		name      string
+		data      []byte
+		wantProto byte
+		wantPorts bool
+	}{
+		{"plain", ip6(17, udp...), 17, true},
+		{"hop-by-hop", ip6(0, hopByHop...), 17, true},
+		{"fragment", ip6(44, firstFragment...), 17, true},
+		{"hop-by-hop then fragment", ip6(0, append([]byte{44, 0, 1, 4, 0, 0, 0, 0}, firstFragment...)...), 17, true},
+		{"destination options", ip6(60, append([]byte{17, 0, 1, 4, 0, 0, 0, 0}, udp...)...), 17, true},
+		{"authentication", ip6(51, append([]byte{17, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, udp...)...), 17, true},
+		{"later fragment", ip6(44, append([]byte{17, 0, 0x00, 0x09, 0, 0, 0, 1}, udp...)...), 44, false},
+		{"truncated", ip6(0, 17, 3, 0, 0), 0, false},
+	} {
+		w := NewWriter()
+		if err := w.AddPacket(test.data, 0); err != nil {
+			t.Fatal(err)
+		}
+		if len(w.keys[string([]byte{keyProtocol, test.wantProto})]) != 1 {
+			t.Errorf("%s: protocol %d not indexed, got keys %q", test.name, test.wantProto, w.keys)
+		}
+		for _, port := range []string{"\x04\xd2", "\x00\x35"} {
+			if got := len(w.keys[string([]byte{keyPort})+port]) == 1; got != test.wantPorts {
+				t.Errorf("%s: port %q indexed = %v, want %v", test.name, port, got, test.wantPorts)
+			}
+		}
+		if len(w.keys[string([]byte{keyIPv6})+string(net.ParseIP("::2"))]) != 1 {
+			t.Errorf("%s: destination IP not indexed", test.name)
+		}
+	}
+}
+
+// udp4 returns an Ethernet frame of a UDP packet between 10.0.0.src and
+// 10.0.0.dst.
+func udp4(src, dst byte, sport, dport uint16) []byte {
+	data := make([]byte, 14+20+8)
+	data[12], data[13] = 0x08, 0x00 // IPv4 ethertype
+	ip := data[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], 28)
+	ip[8], ip[9] = 64, 17
+	copy(ip[12:], []byte{10, 0, 0, src})
+	copy(ip[16:], []byte{10, 0, 0, dst})
+	binary.BigEndian.PutUint16(ip[20:], sport)
+	binary.BigEndian.PutUint16(ip[22:], dport)
+	binary.BigEndian.PutUint16(ip[24:], 8)
+	return data
+}
+
+func TestFlowIndex(t *testing.T) {
+	// Three flows, of 3 (both directions), 2, and 1 packets.
+	packets := [][]byte{
+		udp4(1, 2, 1000, 53),
+		udp4(2, 1, 53, 1000),
+		udp4(3, 4, 2000, 80),
+		udp4(1, 2, 1000, 53),
+		udp4(5, 6, 3000, 443),
+		udp4(3, 4, 2000, 80),
+	}
+	tests := []struct {
+		min, max int
+		want     base.Positions
+	}{
+		{1, 1 << 30, base.Positions{0, 100, 200, 300, 400, 500}},
+		{3, 1 << 30, base.Positions{0, 100, 300}},
+		{2, 2, base.Positions{200, 500}},
+		{1, 2, base.Positions{200, 400, 500}},
+		{4, 1 << 30, base.Positions{}},
+	}
+	check := func(name string, idx *IndexFile) {
+		for _, test := range tests {
+			if got, err := idx.FlowPositions(ctx, test.min, test.max); err != nil {
+				t.Errorf("%s: %v", name, err)
+			} else if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: flows of %d-%d packets: want %v got %v", name, test.min, test.max, test.want, got)
+			}
+		}
+	}
+
+	w := NewWriter()
+	for i, data := range packets {
+		if err := w.AddPacket(data, int64(i*100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("in-memory", w.Index("1420000000000000"))
+
+	filename := writeTestIndex(t, nil)
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	scans := 0
+	idx.SetPacketScanner(func(ctx context.Context, fn func(int64, []byte) error) error {
+		scans++
+		for i, data := range packets {
+			if err := fn(int64(i*100), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	check("on disk", idx)
+	if _, err := os.Stat(FlowPath(filename)); err != nil {
+		t.Errorf("flow index not written: %v", err)
+	}
+	if scans != 1 {
+		t.Errorf("blockfile scanned %d times, want once", scans)
+	}
+}
+
+func TestCompositeIndex(t *testing.T) {
+	packets := [][]byte{
+		udp4(1, 2, 1000, 443),
+		udp4(2, 1, 443, 1000),
+		udp4(3, 4, 2000, 443),
+		udp4(1, 2, 1001, 80),
+		udp4(1, 3, 1002, 443),
+	}
+	CompositePorts = map[uint16]bool{443: true, 8443: true}
+	defer func() { CompositePorts = map[uint16]bool{} }()
+	filename := writeTestIndex(t, nil)
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	scans := 0
+	idx.SetPacketScanner(func(ctx context.Context, fn func(int64, []byte) error) error {
+		scans++
+		for i, data := range packets {
+			if err := fn(int64(i*100), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	ip := func(b byte) net.IP { return net.IP{10, 0, 0, b} }
+	for _, test := range []struct {
+		port     uint16
+		from, to net.IP
+		want     base.Positions
+	}{
+		{443, ip(1), ip(1), base.Positions{0, 100, 400}},
+		{443, ip(3), ip(3), base.Positions{200, 400}},
+		{443, ip(2), ip(4), base.Positions{0, 100, 200, 400}},
+		{443, ip(5), ip(9), nil},
+		{8443, ip(1), ip(1), nil},
+	} {
+		if got, err := idx.CompositePositions(ctx, test.port, test.from, test.to); err != nil {
+			t.Errorf("port %d, %v-%v: %v", test.port, test.from, test.to, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("port %d, %v-%v: want %v got %v", test.port, test.from, test.to, test.want, got)
+		}
+	}
+	if _, err := idx.CompositePositions(ctx, 80, ip(1), ip(1)); err == nil {
+		t.Errorf("port without composite keys looked up")
+	}
+	if files := CompositeFiles(filename); len(files) != 2 {
+		t.Errorf("got composite indexes %v, want 2", files)
+	}
+	if scans != 1 {
+		t.Errorf("blockfile scanned %d times, want once", scans)
+	}
+}
+
+// withPayload returns an IPv4 TCP (proto 6) or UDP (17) Ethernet frame
+// carrying 'payload'.
+func withPayload(proto, src, dst byte, sport, dport uint16, payload []byte) []byte {
+	hdr := 8
+	if proto == 6 {
+		hdr = 20
+	}
+	data := make([]byte, 14+20+hdr, 14+20+hdr+len(payload))
+	data[12], data[13] = 0x08, 0x00 // IPv4 ethertype
+	ip := data[14:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+hdr+len(payload)))
+	ip[8], ip[9] = 64, proto
+	copy(ip[12:], []byte{10, 0, 0, src})
+	copy(ip[16:], []byte{10, 0, 0, dst})
+	binary.BigEndian.PutUint16(ip[20:], sport)
+	binary.BigEndian.PutUint16(ip[22:], dport)
+	if proto == 6 {
+		ip[32] = 5 << 4 // data offset
+	} else {
+		binary.BigEndian.PutUint16(ip[24:], uint16(hdr+len(payload)))
+	}
+	return append(data, payload...)
+}
+
+func TestAppIndex(t *testing.T) {
+	dnsQuery := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	packets := [][]byte{
+		withPayload(6, 1, 2, 40000, 8443, nil), // SYN
+		withPayload(6, 1, 2, 40000, 8443, []byte{0x16, 3, 1, 0, 4, 1, 0, 0, 0}),
+		withPayload(17, 3, 4, 5000, 5353, dnsQuery),
+		withPayload(6, 5, 6, 41000, 22, []byte("\x00garbage")),
+		withPayload(17, 7, 8, 6000, 443, []byte{0xc3, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}),
+		withPayload(6, 2, 1, 8443, 40000, []byte{0x17, 3, 3, 0, 2, 0xab, 0xcd}),
+		withPayload(6, 9, 10, 42000, 8080, []byte("GET / HTTP/1.1\r\n")),
+		withPayload(6, 11, 12, 43000, 2222, []byte("SSH-2.0-OpenSSH_9.6\r\n")),
+		withPayload(6, 13, 14, 44000, 53, append([]byte{0, byte(len(dnsQuery))}, dnsQuery...)),
+	}
+	filename := writeTestIndex(t, nil)
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	idx.SetPacketScanner(func(ctx context.Context, fn func(int64, []byte) error) error {
+		for i, data := range packets {
+			if err := fn(int64(i*100), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, err := idx.AppPositions(ctx, AppProtocols["tls"]); err == nil {
+		t.Errorf("app index used while disabled")
+	}
+	AppProtocolIndexes = true
+	defer func() { AppProtocolIndexes = false }()
+	for _, test := range []struct {
+		app  string
+		want base.Positions
+	}{
+		{"tls", base.Positions{0, 100, 500}},
+		{"dns", base.Positions{200, 800}},
+		{"quic", base.Positions{400}},
+		{"http", base.Positions{600}},
+		{"ssh", base.Positions{700}},
+	} {
+		proto, err := ParseAppProtocol(test.app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := idx.AppPositions(ctx, proto); err != nil {
+			t.Errorf("%s: %v", test.app, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: want %v got %v", test.app, test.want, got)
+		}
+	}
+	if _, err := os.Stat(AppPath(filename)); err != nil {
+		t.Errorf("app index not written: %v", err)
+	}
+}
+
+func TestQUICIndex(t *testing.T) {
+	initial := []byte{1, 2, 3, 4, 5, 6, 7, 8} // The client's first destination.
+	client := []byte{0xc1, 0xc2, 0xc3, 0xc4}
+	server := []byte{0x51, 0x52, 0x53, 0x54, 0x55, 0x56}
+	long := func(dcid, scid []byte) []byte {
+		b := append([]byte{0xc3, 0, 0, 0, 1, byte(len(dcid))}, dcid...)
+		b = append(b, byte(len(scid)))
+		return append(append(b, scid...), 0, 0, 0)
+	}
+	short := func(dcid []byte) []byte {
+		return append(append([]byte{0x41}, dcid...), 0xaa, 0xbb, 0xcc, 0xdd)
+	}
+	packets := [][]byte{
+		withPayload(17, 1, 2, 50000, 443, long(initial, client)),
+		withPayload(17, 2, 1, 443, 50000, long(client, server)),
+		withPayload(17, 1, 2, 50000, 443, short(server)),
+		withPayload(17, 2, 1, 443, 50000, short(client)),
+		withPayload(17, 3, 2, 61000, 443, short(server)), // Migrated.
+		withPayload(17, 2, 3, 443, 61000, short(client)),
+		withPayload(17, 4, 5, 1000, 53, []byte{0x41, 0x51, 0x52}), // Not QUIC.
+	}
+	filename := writeTestIndex(t, nil)
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	idx.SetPacketScanner(func(ctx context.Context, fn func(int64, []byte) error) error {
+		for i, data := range packets {
+			if err := fn(int64(i*100), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if _, err := idx.QUICConnectionIDPositions(ctx, server); err == nil {
+		t.Errorf("QUIC index used while disabled")
+	}
+	QUICConnectionIDIndexes = true
+	defer func() { QUICConnectionIDIndexes = false }()
+	for _, test := range []struct {
+		cid  []byte
+		want base.Positions
+	}{
+		{initial, base.Positions{0}},
+		{client, base.Positions{100, 300, 500}},
+		{server, base.Positions{200, 400}},
+		{server[:4], nil},
+	} {
+		if got, err := idx.QUICConnectionIDPositions(ctx, test.cid); err != nil {
+			t.Errorf("%x: %v", test.cid, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%x: want %v got %v", test.cid, test.want, got)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	w := NewWriter()
+	for i, data := range [][]byte{
+		udp4(1, 2, 1000, 53),
+		udp4(2, 1, 53, 1000),
+		udp4(1, 3, 1001, 53),
+		udp4(1, 4, 1002, 53),
+	} {
+		if err := w.AddPacket(data, int64(i*100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := w.Stats()
+	if s.Packets != 4 {
+		t.Errorf("got %d packets, want 4", s.Packets)
+	}
+	if got, want := s.Keys(IPv4Keys), (KeyStats{Keys: 4, Positions: 8, Min: 1, Median: 1, P90: 2, P99: 2, Max: 4}); got != want {
+		t.Errorf("got IPv4 key stats %+v, want %+v", got, want)
+	}
+	if got := s.PerKey(PortKeys); got != 2 { // 8 positions for 4 ports.
+		t.Errorf("got %d positions per port, want 2", got)
+	}
+	if got := s.Keys(MACKeys); got.Keys != 0 {
+		t.Errorf("got MAC key stats %+v", got)
+	}
+	// Stats written beside an index are read back, while those of indexes
+	// without them are only built if IndexStats is set.
+	dir, err := ioutil.TempDir("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	with, without := filepath.Join(dir, "1"), filepath.Join(dir, "2")
+	for _, name := range []string{with, without} {
+		if err := w.WriteFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteStats(with); err != nil {
+		t.Fatal(err)
+	}
+	if got := testIndexFile(t, with).Stats(); !reflect.DeepEqual(got, s) {
+		t.Errorf("read stats %+v, want %+v", got, s)
+	}
+	if got := testIndexFile(t, without).Stats(); got != nil {
+		t.Errorf("got stats %+v of index without them", got)
+	}
+	IndexStats = true
+	defer func() { IndexStats = false }()
+	built := testIndexFile(t, without).Stats()
+	if built == nil || built.Keys(IPv4Keys) != s.Keys(IPv4Keys) || built.Packets != 4 {
+		t.Errorf("built stats %+v, want %+v", built, s)
+	}
+	if _, err := os.Stat(StatsPath(without)); err != nil {
+		t.Errorf("built stats not stored: %v", err)
+	}
+}
+
+func TestTCPFlags(t *testing.T) {
+	tcp := func(flags byte) []byte {
+		data := make([]byte, 14+20+20)
+		data[12], data[13] = 0x08, 0x00 // IPv4 ethertype
+		ip := data[14:]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], 40)
+		ip[8], ip[9] = 64, 6
+		copy(ip[12:], []byte{10, 0, 0, 1})
+		copy(ip[16:], []byte{10, 0, 0, 2})
+		ip[20+12] = 5 << 4 // data offset
+		ip[20+13] = flags
+		return data
+	}
+	for _, tcpFlags := range []bool{false, true} {
+		w := NewWriter()
+		w.tcpFlags = tcpFlags
+		for i, flags := range []byte{0x02, 0x12, 0x10, 0x11} { // SYN, SYN-ACK, ACK, FIN-ACK
+			if err := w.AddPacket(tcp(flags), int64(i*100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		idx := w.Index("IDX0/1")
+		if has, err := idx.HasTCPFlags(); err != nil || has != tcpFlags {
+			t.Errorf("HasTCPFlags() = %v, %v; want %v", has, err, tcpFlags)
+		}
+		if !tcpFlags {
+			continue
+		}
+		for name, want := range map[string]base.Positions{
+			"syn": {0, 100},
+			"ack": {100, 200, 300},
+			"fin": {300},
+			"rst": nil,
+		} {
+			flag, err := ParseTCPFlag(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := idx.TCPFlagPositions(ctx, flag)
+			if err != nil {
+				t.Fatal(err)
+			} else if got.Len() != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+				t.Errorf("%s: got positions %v, want %v", name, got, want)
+			}
+		}
+	}
+	if _, err := ParseTCPFlag("ns"); err == nil {
+		t.Error("parsed unknown TCP flag")
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	vlan := func(id uint16, src byte) []byte {
+		data := make([]byte, 14+4+20)
+		data[5], data[11] = 2, src // destination and source MACs
+		data[12], data[13] = 0x81, 0x00
+		binary.BigEndian.PutUint16(data[14:], id)
+		data[16], data[17] = 0x08, 0x00 // IPv4 ethertype
+		ip := data[18:]
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], 20)
+		ip[8], ip[9] = 64, 6
+		copy(ip[12:], []byte{10, 0, 0, 1})
+		copy(ip[16:], []byte{10, 0, 0, 2})
+		return data
+	}
+	packets := [][]byte{vlan(100, 1), vlan(100, 3), vlan(200, 1)}
+	filename := writeTestIndex(t, map[string][]uint32{
+		"040a000001": {0, 100, 200},
+		"030064":     {0}, // Only partly indexed.
+	})
+	defer os.RemoveAll(filepath.Dir(filename))
+	idx := testIndexFile(t, filename)
+	defer idx.Close()
+	idx.SetPacketScanner(func(ctx context.Context, fn func(int64, []byte) error) error {
+		for i, data := range packets {
+			if err := fn(int64(i*100), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	types, err := ParseKeyTypes("vlan,mac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseKeyTypes("vlan,tcpoptions"); err == nil {
+		t.Errorf("expected error for unknown key type")
+	}
+	out := filename + ".new"
+	added, err := idx.Backfill(ctx, out, types)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// VLANs 100 (1 new position) and 200 (1), and MACs ...01 (2), ...02 (3),
+	// and ...03 (1).
+	if added != 8 {
+		t.Errorf("added %d positions, want 8", added)
+	}
+	got := testIndexFile(t, out)
+	defer got.Close()
+	mac := func(b byte) net.HardwareAddr { return net.HardwareAddr{0, 0, 0, 0, 0, b} }
+	for _, test := range []struct {
+		name   string
+		lookup func() (base.Positions, error)
+		want   base.Positions
+	}{
+		{"ip", func() (base.Positions, error) { return got.IPPositions(ctx, net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 1}) }, base.Positions{0, 100, 200}},
+		{"vlan 100", func() (base.Positions, error) { return got.VLANPositions(ctx, 100) }, base.Positions{0, 100}},
+		{"vlan 200", func() (base.Positions, error) { return got.VLANPositions(ctx, 200) }, base.Positions{200}},
+		{"mac 1", func() (base.Positions, error) { return got.MACPositions(ctx, mac(1)) }, base.Positions{0, 200}},
+		{"mac 2", func() (base.Positions, error) { return got.MACPositions(ctx, mac(2)) }, base.Positions{0, 100, 200}},
+		{"proto", func() (base.Positions, error) { return got.ProtoPositions(ctx, 6) }, nil}, // Not backfilled.
+	} {
+		if pos, err := test.lookup(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(pos, test.want) {
+			t.Errorf("%s: want %v got %v", test.name, test.want, pos)
+		}
+	}
+}
+
+func TestLockIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "indexfile_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(timeout time.Duration) { IndexLockTimeout = timeout }(IndexLockTimeout)
+	IndexLockTimeout = 200 * time.Millisecond
+	path := filepath.Join(dir, "1420000000000000")
+
+	unlock, err := LockIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RLockIndex(path); err == nil {
+		t.Error("opened index while it was being replaced")
+	}
+	unlock()
+	// Readers share the lock, but keep writers out.
+	unlock1, err := RLockIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2, err := RLockIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockIndex(path); err == nil {
+		t.Error("replaced index while it was being opened")
+	}
+	unlock1()
+	unlock2()
+	unlock, err = LockIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
 }
@@ -0,0 +1,107 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mars-suite/stenographer/stats"
+)
+
+// IndexLockTimeout is how long RLockIndex waits for a writer replacing an
+// index (or its blockfile) to finish, and LockIndex waits for readers opening
+// it, before giving up.
+var IndexLockTimeout = 30 * time.Second
+
+const (
+	lockDir           = ".locks"
+	lockRetryInterval = 50 * time.Millisecond
+)
+
+var indexLockWaits = stats.S.Get("indexfile_lock_waits")
+
+// LockDirectory returns the directory lock files for the indexes in indexDir
+// are kept in.
+func LockDirectory(indexDir string) string {
+	return filepath.Join(indexDir, lockDir)
+}
+
+// LockPath returns the lock file of the given index, see LockIndex.
+func LockPath(indexPath string) string {
+	return filepath.Join(LockDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// LockIndex takes the exclusive lock on an index, which anything replacing the
+// index or its blockfile (like stenoreindex or stenodefrag) must hold while
+// it moves the new files into place.  Readers hold the lock shared (see
+// RLockIndex) while opening an index and its blockfile, so they never see one
+// replaced without the other.  It returns a function releasing the lock.
+//
+// Locks are advisory locks on a file per index (see LockPath), and only
+// coordinate between processes on Unix.  Elsewhere, they always succeed.
+func LockIndex(indexPath string) (func(), error) {
+	return lockIndex(indexPath, true)
+}
+
+// RLockIndex takes the shared lock on an index, see LockIndex.  If the lock
+// file can't be created, as in a read-only copy of a sensor's files, there can
+// be no writers to coordinate with, so the index is opened unlocked.
+func RLockIndex(indexPath string) (func(), error) {
+	return lockIndex(indexPath, false)
+}
+
+func lockIndex(indexPath string, exclusive bool) (func(), error) {
+	path := LockPath(indexPath)
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		if !exclusive {
+			v(1, "opening index %q unlocked: %v", indexPath, err)
+			return func() {}, nil
+		}
+		return nil, fmt.Errorf("could not create lock file for index %q: %v", indexPath, err)
+	}
+	deadline := time.Now().Add(IndexLockTimeout)
+	for waited := false; ; waited = true {
+		ok, err := tryLock(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not lock index %q: %v", indexPath, err)
+		} else if ok {
+			break
+		}
+		if !waited {
+			indexLockWaits.Increment()
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			if exclusive {
+				return nil, fmt.Errorf("index %q still in use after %v", indexPath, IndexLockTimeout)
+			}
+			return nil, fmt.Errorf("index %q still being replaced after %v; try again once that's finished", indexPath, IndexLockTimeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+	return func() {
+		unlock(f)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/leveldb/db"
+)
+
+// kvReader is the read interface shared by leveldb tables and mmapped indexes.
+type kvReader interface {
+	Find(key []byte, o *db.ReadOptions) db.Iterator
+	Get(key []byte, o *db.ReadOptions) ([]byte, error)
+	Close() error
+}
+
+// The mmapped index format is:
+//
+//	magic   [8]byte       "STENOMM1"
+//	count   uint32        number of keys
+//	entries [count]entry  sorted by key
+//	data    []byte        keys and values pointed to by entries
+//
+// where each entry is four uint32s: key offset, key length, value offset, and
+// value length, with offsets from the start of the file.  All integers are big
+// endian.  Values are the same sorted position lists leveldb stores.
+var mmapMagic = []byte("STENOMM1")
+
+const (
+	mmapHeaderSize = 12
+	mmapEntrySize  = 16
+	mmapDir        = ".mmap"
+)
+
+// MmapDirectory returns the directory mmapped versions of the indexes in
+// indexDir are stored in.
+func MmapDirectory(indexDir string) string {
+	return filepath.Join(indexDir, mmapDir)
+}
+
+// MmapPath returns where the mmapped version of the given leveldb index is
+// stored.
+func MmapPath(indexPath string) string {
+	return filepath.Join(MmapDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// writeMmapIndex writes the contents of 'in' to a new mmapped index at
+// 'filename', via a hidden temporary file so it's never seen half-written.
+func writeMmapIndex(in kvReader, filename string) error {
+	var keys, values [][]byte
+	iter := in.Find([]byte{}, nil)
+	for iter.Next() {
+		keys = append(keys, append([]byte{}, iter.Key()...))
+		values = append(values, append([]byte{}, iter.Value()...))
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	return writeMmapEntries(keys, values, filename)
+}
+
+// writeMmapEntries writes sorted keys and their values to a new mmapped index
+// at 'filename'.
+func writeMmapEntries(keys, values [][]byte, filename string) error {
+	size := 0
+	for i := range keys {
+		size += len(keys[i]) + len(values[i])
+	}
+	dataStart := mmapHeaderSize + mmapEntrySize*len(keys)
+	if int64(dataStart)+int64(size) >= 1<<32 {
+		return fmt.Errorf("index too large to mmap (%d bytes)", dataStart+size)
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return fmt.Errorf("could not create mmap index directory: %v", err)
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename))
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("could not create mmap index: %v", err)
+	}
+	defer os.Remove(tmp) // no-op once renamed into place
+	w := bufio.NewWriter(f)
+	w.Write(mmapMagic)
+	binary.Write(w, binary.BigEndian, uint32(len(keys)))
+	off := uint32(dataStart)
+	for i := range keys {
+		kl, vl := uint32(len(keys[i])), uint32(len(values[i]))
+		binary.Write(w, binary.BigEndian, [4]uint32{off, kl, off + kl, vl})
+		off += kl + vl
+	}
+	for i := range keys {
+		w.Write(keys[i])
+		w.Write(values[i])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write mmap index: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close mmap index: %v", err)
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("could not move mmap index into place: %v", err)
+	}
+	return nil
+}
+
+// mmapReader reads a memory-mapped sorted index.
+type mmapReader struct {
+	data []byte
+	n    int
+}
+
+func openMmapIndex(filename string) (*mmapReader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // the mapping stays valid after close.
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < mmapHeaderSize {
+		return nil, fmt.Errorf("mmap index %q too short", filename)
+	}
+	data, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, fmt.Errorf("could not mmap %q: %v", filename, err)
+	}
+	m := &mmapReader{data: data, n: int(binary.BigEndian.Uint32(data[8:]))}
+	if !bytes.Equal(data[:8], mmapMagic) {
+		m.Close()
+		return nil, fmt.Errorf("mmap index %q has bad magic", filename)
+	}
+	if mmapHeaderSize+mmapEntrySize*m.n > len(data) {
+		m.Close()
+		return nil, fmt.Errorf("mmap index %q truncated", filename)
+	}
+	for i := 0; i < m.n; i++ {
+		e := m.entry(i)
+		if int64(e[0])+int64(e[1]) > int64(len(data)) || int64(e[2])+int64(e[3]) > int64(len(data)) {
+			m.Close()
+			return nil, fmt.Errorf("mmap index %q entry %d out of range", filename, i)
+		}
+	}
+	return m, nil
+}
+
+func (m *mmapReader) entry(i int) (e [4]uint32) {
+	b := m.data[mmapHeaderSize+mmapEntrySize*i:]
+	for j := range e {
+		e[j] = binary.BigEndian.Uint32(b[4*j:])
+	}
+	return e
+}
+
+func (m *mmapReader) key(i int) []byte {
+	e := m.entry(i)
+	return m.data[e[0] : e[0]+e[1]]
+}
+
+func (m *mmapReader) value(i int) []byte {
+	e := m.entry(i)
+	return m.data[e[2] : e[2]+e[3]]
+}
+
+// Find returns an iterator starting at the first key >= 'key'.
+func (m *mmapReader) Find(key []byte, _ *db.ReadOptions) db.Iterator {
+	i := sort.Search(m.n, func(i int) bool { return bytes.Compare(m.key(i), key) >= 0 })
+	return &mmapIter{m: m, i: i - 1}
+}
+
+// Get returns the value for exactly 'key'.
+func (m *mmapReader) Get(key []byte, _ *db.ReadOptions) ([]byte, error) {
+	i := sort.Search(m.n, func(i int) bool { return bytes.Compare(m.key(i), key) >= 0 })
+	if i == m.n || !bytes.Equal(m.key(i), key) {
+		return nil, db.ErrNotFound
+	}
+	return m.value(i), nil
+}
+
+// Close unmaps the index.  Keys and values returned from it are invalid
+// afterwards.
+func (m *mmapReader) Close() error {
+	return unmapFile(m.data)
+}
+
+// mmapIter implements db.Iterator.
+type mmapIter struct {
+	m *mmapReader
+	i int
+}
+
+func (it *mmapIter) Next() bool {
+	if it.i < it.m.n {
+		it.i++
+	}
+	return it.i < it.m.n
+}
+
+func (it *mmapIter) Key() []byte   { return it.m.key(it.i) }
+func (it *mmapIter) Value() []byte { return it.m.value(it.i) }
+func (it *mmapIter) Close() error  { return nil }
+
+// openMmap opens the mmapped version of the leveldb index 'ss' at 'filename',
+// building it first if it doesn't exist or is older than the index.
+func openMmap(filename string, ss kvReader) (*mmapReader, error) {
+	path := MmapPath(filename)
+	idx, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if mm, err := os.Stat(path); err != nil || mm.ModTime().Before(idx.ModTime()) {
+		v(1, "building mmap index %q", path)
+		defer indexMmapBuildNanos.NanoTimer()()
+		if err := writeMmapIndex(ss, path); err != nil {
+			return nil, err
+		}
+	}
+	return openMmapIndex(path)
+}
@@ -0,0 +1,184 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// QUICConnectionIDIndexes enables QUIC indexes, which map each QUIC
+// connection ID to the positions of packets sent to it, so a connection can
+// be followed as it migrates between addresses and ports.  Destination
+// connection IDs are read from long headers, and short header packets are
+// indexed under any connection ID (destination or source) an earlier long
+// header in the same file introduced, since short headers don't give their
+// connection ID's length.  Like app indexes, they aren't written by
+// stenotype:  each file's is built from its blockfile, and kept in a hidden
+// subdirectory of the index directory (see QUICPath).  They're in the mmapped
+// index format, keyed by connection ID.  It should only be changed before any
+// indexes are opened.
+var QUICConnectionIDIndexes = false
+
+// MaxQUICConnectionIDLength is the longest QUIC connection ID (RFC 9000
+// section 17.2).
+const MaxQUICConnectionIDLength = 20
+
+const quicDir = ".quic"
+
+// QUICDirectory returns the directory QUIC indexes for the indexes in indexDir
+// are stored in.
+func QUICDirectory(indexDir string) string {
+	return filepath.Join(indexDir, quicDir)
+}
+
+// QUICPath returns where the QUIC index for the given index is stored.
+func QUICPath(indexPath string) string {
+	return filepath.Join(QUICDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// QUICConnectionIDPositions returns the positions in the block file of all
+// QUIC packets sent to the given connection ID.
+func (i *IndexFile) QUICConnectionIDPositions(ctx context.Context, cid []byte) (base.Positions, error) {
+	if len(cid) == 0 || len(cid) > MaxQUICConnectionIDLength {
+		return nil, fmt.Errorf("invalid QUIC connection ID length %d", len(cid))
+	}
+	m, err := i.quicIndex(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return i.positionsIn(ctx, m, cid, cid)
+}
+
+// BuildQUICIndex builds the index's QUIC index, if it doesn't exist yet, so
+// the first query needing it doesn't have to wait.
+func (i *IndexFile) BuildQUICIndex(ctx context.Context) error {
+	_, err := i.quicIndex(ctx)
+	return err
+}
+
+// quicIndex returns the QUIC index, building it if it doesn't exist yet.
+func (i *IndexFile) quicIndex(ctx context.Context) (*mmapReader, error) {
+	if !QUICConnectionIDIndexes {
+		return nil, fmt.Errorf("QUIC connection IDs aren't indexed")
+	}
+	i.quicMu.Lock()
+	defer i.quicMu.Unlock()
+	if i.quic != nil {
+		return i.quic, nil
+	}
+	path := QUICPath(i.name)
+	m, err := openMmapIndex(path)
+	if os.IsNotExist(err) {
+		if err = i.buildQUICIndex(ctx, path); err == nil {
+			m, err = openMmapIndex(path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	i.quic = m
+	return m, nil
+}
+
+// buildQUICIndex writes the QUIC index for the index's blockfile to 'path'.
+func (i *IndexFile) buildQUICIndex(ctx context.Context, path string) error {
+	if i.scan == nil {
+		return fmt.Errorf("no QUIC index for %q, and no way to build one", i.name)
+	}
+	defer indexQUICBuildNanos.NanoTimer()()
+	start := time.Now()
+	cids := map[string][]uint32{}
+	known := map[string]bool{}
+	var lengths [MaxQUICConnectionIDLength + 1]bool // Of the known IDs.
+	err := i.scan(ctx, func(pos int64, data []byte) error {
+		if pos < 0 || pos >= 1<<32 {
+			return fmt.Errorf("position %d out of range", pos)
+		}
+		udp, payload := transportPayload(data)
+		if !udp || len(payload) == 0 {
+			return ctx.Err()
+		}
+		if dcid, scid, ok := quicLongHeaderIDs(payload); ok {
+			for _, id := range [][]byte{dcid, scid} {
+				if len(id) > 0 && !known[string(id)] {
+					known[string(id)] = true
+					lengths[len(id)] = true
+				}
+			}
+			if len(dcid) > 0 {
+				cids[string(dcid)] = append(cids[string(dcid)], uint32(pos))
+			}
+		} else if payload[0]&0xc0 == 0x40 {
+			// A short header, with the fixed bit set, followed by the
+			// destination connection ID.
+			for n := 1; n <= MaxQUICConnectionIDLength && n < len(payload); n++ {
+				if lengths[n] && known[string(payload[1:1+n])] {
+					cids[string(payload[1:1+n])] = append(cids[string(payload[1:1+n])], uint32(pos))
+					break
+				}
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("could not build QUIC index for %q: %v", i.name, err)
+	}
+	sorted := make([]string, 0, len(cids))
+	for cid := range cids {
+		sorted = append(sorted, cid)
+	}
+	sort.Strings(sorted)
+	var keys, values [][]byte
+	for _, cid := range sorted {
+		value := make([]byte, 4*len(cids[cid]))
+		for j, pos := range cids[cid] {
+			binary.BigEndian.PutUint32(value[4*j:], pos)
+		}
+		keys = append(keys, []byte(cid))
+		values = append(values, value)
+	}
+	// Files without any QUIC get empty indexes, so they aren't built again.
+	if err := writeMmapEntries(keys, values, path); err != nil {
+		return err
+	}
+	v(1, "Built QUIC index %q of %d connection IDs in %v", path, len(keys), time.Since(start))
+	return nil
+}
+
+// quicLongHeaderIDs returns the destination and source connection IDs of the
+// QUIC long header 'b' starts with, if it does (see isQUICLongHeader).
+func quicLongHeaderIDs(b []byte) (dcid, scid []byte, ok bool) {
+	if !isQUICLongHeader(b) {
+		return nil, nil, false
+	}
+	n := int(b[5])
+	if 6+n >= len(b) {
+		return nil, nil, false
+	}
+	dcid = b[6 : 6+n]
+	m := int(b[6+n])
+	if m > MaxQUICConnectionIDLength || 7+n+m > len(b) {
+		return nil, nil, false
+	}
+	return dcid, b[7+n : 7+n+m], true
+}
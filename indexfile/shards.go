@@ -0,0 +1,239 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/golang/leveldb/db"
+)
+
+const shardDir = ".shards"
+
+// ShardDirectory returns the directory sharded versions of the indexes in
+// indexDir are stored in.
+func ShardDirectory(indexDir string) string {
+	return filepath.Join(indexDir, shardDir)
+}
+
+// ShardPath returns where the manifest of the sharded version of the given
+// leveldb index is stored.  The manifest lists the key types present, and is
+// written last, so shards are only used once they're all written.  Each
+// key type's shard is stored beside it, with the type as an extension.
+func ShardPath(indexPath string) string {
+	return filepath.Join(ShardDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// ShardFiles returns the manifest and shard files of the sharded version of
+// the given leveldb index which exist.
+func ShardFiles(indexPath string) []string {
+	path := ShardPath(indexPath)
+	shards, _ := filepath.Glob(path + ".*")
+	if _, err := os.Stat(path); err == nil {
+		shards = append(shards, path)
+	}
+	return shards
+}
+
+func shardFile(path string, keyType byte) string {
+	return path + "." + strconv.Itoa(int(keyType))
+}
+
+// writeShardedIndex writes the contents of 'in' to a new sharded index, whose
+// manifest is at 'path'.
+func writeShardedIndex(in kvReader, path string) error {
+	var types []byte
+	keys := map[byte][][]byte{}
+	values := map[byte][][]byte{}
+	iter := in.Find([]byte{}, nil)
+	for iter.Next() {
+		if len(iter.Key()) == 0 {
+			continue
+		}
+		t := iter.Key()[0]
+		if len(keys[t]) == 0 {
+			types = append(types, t)
+		}
+		keys[t] = append(keys[t], append([]byte{}, iter.Key()...))
+		values[t] = append(values[t], append([]byte{}, iter.Value()...))
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	for _, t := range types {
+		if err := writeMmapEntries(keys[t], values[t], shardFile(path, t)); err != nil {
+			return fmt.Errorf("key type %d: %v", t, err)
+		}
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	if err := ioutil.WriteFile(tmp, types, 0600); err != nil {
+		return fmt.Errorf("could not write shard manifest: %v", err)
+	}
+	defer os.Remove(tmp) // no-op once renamed into place
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not move shard manifest into place: %v", err)
+	}
+	return nil
+}
+
+// shardedReader reads an index sharded by key type, mapping each shard the
+// first time it's needed.
+type shardedReader struct {
+	path  string
+	types []byte // Key types with shards, in order.
+
+	mu sync.Mutex
+	// protected by mu
+	shards map[byte]*mmapReader
+}
+
+// openSharded opens the sharded version of the leveldb index 'ss' at
+// 'filename', building it first if it doesn't exist or is older than the
+// index.
+func openSharded(filename string, ss kvReader) (*shardedReader, error) {
+	path := ShardPath(filename)
+	idx, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if sh, err := os.Stat(path); err != nil || sh.ModTime().Before(idx.ModTime()) {
+		v(1, "building sharded index %q", path)
+		defer indexShardBuildNanos.NanoTimer()()
+		if err := writeShardedIndex(ss, path); err != nil {
+			return nil, err
+		}
+	}
+	types, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !sort.SliceIsSorted(types, func(i, j int) bool { return types[i] < types[j] }) {
+		return nil, fmt.Errorf("shard manifest %q out of order", path)
+	}
+	return &shardedReader{path: path, types: types, shards: map[byte]*mmapReader{}}, nil
+}
+
+// shard returns the shard of the given key type, or nil if there are no keys
+// of that type.
+func (s *shardedReader) shard(t byte) (*mmapReader, error) {
+	if bytes.IndexByte(s.types, t) < 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m := s.shards[t]; m != nil {
+		return m, nil
+	}
+	m, err := openMmapIndex(shardFile(s.path, t))
+	if err != nil {
+		return nil, err
+	}
+	indexShardsOpened.Increment()
+	s.shards[t] = m
+	return m, nil
+}
+
+// Find returns an iterator starting at the first key >= 'key', which moves on
+// through the shards of later key types.
+func (s *shardedReader) Find(key []byte, _ *db.ReadOptions) db.Iterator {
+	return s.findRange(key, nil)
+}
+
+// findRange is like Find, but stops after the shard holding 'to' (if it's
+// not nil), so shards past it are never mapped.
+func (s *shardedReader) findRange(from, to []byte) db.Iterator {
+	first, last := byte(0), byte(0xFF)
+	if len(from) > 0 {
+		first = from[0]
+	}
+	if len(to) > 0 {
+		last = to[0]
+	}
+	i := sort.Search(len(s.types), func(i int) bool { return s.types[i] >= first })
+	j := sort.Search(len(s.types), func(i int) bool { return s.types[i] > last })
+	if j < i {
+		j = i
+	}
+	return &shardIter{s: s, types: s.types[i:j], key: from}
+}
+
+// Get returns the value for exactly 'key'.
+func (s *shardedReader) Get(key []byte, o *db.ReadOptions) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, db.ErrNotFound
+	}
+	m, err := s.shard(key[0])
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return nil, db.ErrNotFound
+	}
+	return m.Get(key, o)
+}
+
+// Close unmaps the shards which have been mapped.  Keys and values returned
+// from them are invalid afterwards.
+func (s *shardedReader) Close() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, m := range s.shards {
+		if e := m.Close(); e != nil {
+			err = e
+		}
+		delete(s.shards, t)
+	}
+	return err
+}
+
+// shardIter implements db.Iterator over the shards of 'types' in turn,
+// starting at 'key' in the first.
+type shardIter struct {
+	s     *shardedReader
+	types []byte
+	key   []byte
+	cur   db.Iterator
+	err   error
+}
+
+func (it *shardIter) Next() bool {
+	for it.err == nil {
+		if it.cur != nil && it.cur.Next() {
+			return true
+		}
+		if len(it.types) == 0 {
+			return false
+		}
+		m, err := it.s.shard(it.types[0])
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.cur = m.Find(it.key, nil)
+		it.types = it.types[1:]
+		it.key = nil // Later shards are read from their start.
+	}
+	return false
+}
+
+func (it *shardIter) Key() []byte   { return it.cur.Key() }
+func (it *shardIter) Value() []byte { return it.cur.Value() }
+func (it *shardIter) Close() error  { return it.err }
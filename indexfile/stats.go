@@ -0,0 +1,243 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// IndexStats makes the query planner build statistics for indexes which don't
+// have them yet the first time they're needed, rather than planning without
+// them.  Building them reads the whole index, so it's off by default:  it's
+// only worth it for files which will be queried many times.  Indexes written
+// by Writer.WriteStats always have them.  It should only be changed before any
+// indexes are opened.
+var IndexStats = false
+
+// Key types, for looking up their statistics with Stats.Keys.
+const (
+	ProtocolKeys  = keyProtocol
+	PortKeys      = keyPort
+	VLANKeys      = keyVLAN
+	IPv4Keys      = keyIPv4
+	MPLSKeys      = keyMPLS
+	IPv6Keys      = keyIPv6
+	InnerIPv4Keys = 7
+	InnerIPv6Keys = 8
+	MACKeys       = keyMAC
+	TEIDKeys      = 10
+	SrcPortKeys   = keySrcPort
+	DstPortKeys   = keyDstPort
+	SrcIPv4Keys   = keySrcIPv4
+	DstIPv4Keys   = keyDstIPv4
+	SrcIPv6Keys   = keySrcIPv6
+	DstIPv6Keys   = keyDstIPv6
+	TCPFlagKeys   = keyTCPFlag
+)
+
+const statsDir = ".stats"
+
+// StatsDirectory returns the directory statistics for the indexes in indexDir
+// are stored in.
+func StatsDirectory(indexDir string) string {
+	return filepath.Join(indexDir, statsDir)
+}
+
+// StatsPath returns where the statistics of the given index are stored.
+func StatsPath(indexPath string) string {
+	return filepath.Join(StatsDirectory(filepath.Dir(indexPath)), filepath.Base(indexPath))
+}
+
+// Stats describes the keys of an index, so the query planner can estimate
+// how many packets each part of a query matches before looking any of them
+// up.
+type Stats struct {
+	// Packets is roughly how many packets are indexed.  Indexes written by
+	// Writer know exactly, while for others it's the number of IP packets.
+	Packets int64
+	// Types has the statistics of each key type in the index, by type.
+	Types map[byte]*KeyStats
+}
+
+// KeyStats describes the keys of one type in an index.
+type KeyStats struct {
+	Keys      int64 // Distinct keys.
+	Positions int64 // Positions of all the keys together.
+	// Quantiles of the number of positions per key.
+	Min, Median, P90, P99, Max int64
+}
+
+// Keys returns the statistics of the given key type, which are empty if the
+// index has no keys of that type.
+func (s *Stats) Keys(keyType byte) KeyStats {
+	if ks := s.Types[keyType]; ks != nil {
+		return *ks
+	}
+	return KeyStats{}
+}
+
+// PerKey returns the mean number of positions per key of the given type, the
+// planner's estimate of how many packets a lookup of a single key matches.
+func (s *Stats) PerKey(keyType byte) int64 {
+	ks := s.Keys(keyType)
+	if ks.Keys == 0 {
+		return 0
+	}
+	return (ks.Positions + ks.Keys - 1) / ks.Keys
+}
+
+// statsBuilder collects the number of positions of each key of an index.
+type statsBuilder map[byte][]int64
+
+func (b statsBuilder) add(key []byte, positions int) {
+	if len(key) == 0 || key[0] == keyVersion {
+		return
+	}
+	b[key[0]] = append(b[key[0]], int64(positions))
+}
+
+// stats returns the index's statistics.  'packets' is the number of packets
+// indexed, or negative if it isn't known.
+func (b statsBuilder) stats(packets int64) *Stats {
+	s := &Stats{Packets: packets, Types: map[byte]*KeyStats{}}
+	for t, counts := range b {
+		sort.Slice(counts, func(i, j int) bool { return counts[i] < counts[j] })
+		ks := &KeyStats{Keys: int64(len(counts))}
+		for _, n := range counts {
+			ks.Positions += n
+		}
+		quantile := func(q float64) int64 { return counts[int(q*float64(len(counts)-1))] }
+		ks.Min, ks.Median, ks.P90, ks.P99, ks.Max = quantile(0), quantile(0.5), quantile(0.9), quantile(0.99), quantile(1)
+		s.Types[t] = ks
+	}
+	if packets < 0 {
+		s.Packets = s.Keys(ProtocolKeys).Positions
+	}
+	return s
+}
+
+// Stats returns the statistics of the keys written to the index so far.
+func (w *Writer) Stats() *Stats {
+	b := statsBuilder{}
+	for key, positions := range w.keys {
+		n := 0
+		for i, pos := range positions {
+			if i == 0 || pos != positions[i-1] {
+				n++ // Duplicates are dropped when written, see sorted.
+			}
+		}
+		b.add([]byte(key), n)
+	}
+	return b.stats(int64(w.packets))
+}
+
+// WriteStats writes the statistics of the index (see Stats) to where those of
+// the index at indexPath are kept.  It should be called once the index has
+// been written there, since statistics older than their index are ignored.
+func (w *Writer) WriteStats(indexPath string) error {
+	return writeStats(w.Stats(), StatsPath(indexPath))
+}
+
+func writeStats(s *Stats, path string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create stats directory: %v", err)
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write index stats: %v", err)
+	}
+	defer os.Remove(tmp) // no-op once renamed into place
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not move index stats into place: %v", err)
+	}
+	return nil
+}
+
+// Stats returns the statistics of the index, or nil if it has none.  They're
+// read from StatsPath if they're there and up to date, or else built from the
+// index if it's in memory or IndexStats is set (and then stored, for indexes
+// on disk).
+func (i *IndexFile) Stats() *Stats {
+	i.statsMu.Lock()
+	defer i.statsMu.Unlock()
+	if !i.statsLoaded {
+		var err error
+		if i.stats, err = i.loadStats(); err != nil {
+			v(1, "No stats for index %q: %v", i.name, err)
+		}
+		i.statsLoaded = true // Don't try again.
+	}
+	return i.stats
+}
+
+func (i *IndexFile) loadStats() (*Stats, error) {
+	ss, err := i.reader()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ss.(*memReader); ok {
+		return buildStats(ss)
+	}
+	path := StatsPath(i.name)
+	idx, err := os.Stat(i.name)
+	if err != nil {
+		return nil, err
+	}
+	if st, err := os.Stat(path); err == nil && !st.ModTime().Before(idx.ModTime()) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s := &Stats{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("invalid stats %q: %v", path, err)
+		}
+		return s, nil
+	}
+	if !IndexStats {
+		return nil, nil
+	}
+	start := time.Now()
+	s, err := buildStats(ss)
+	if err != nil {
+		return nil, err
+	}
+	v(1, "Built stats for %q of %d key types in %v", i.name, len(s.Types), time.Since(start))
+	return s, writeStats(s, path)
+}
+
+// buildStats reads through an index to build its statistics.
+func buildStats(ss kvReader) (*Stats, error) {
+	defer indexStatsBuildNanos.NanoTimer()()
+	b := statsBuilder{}
+	iter := ss.Find([]byte{}, nil)
+	for iter.Next() {
+		b.add(iter.Key(), len(iter.Value())/4)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("could not read index: %v", err)
+	}
+	return b.stats(-1), nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mars-suite/stenographer/base"
+	"golang.org/x/net/context"
+)
+
+// TCPFlags are the TCP flags indexes can have keys for (see HasTCPFlags), by
+// name, with the bit of the TCP header's flags byte each is.  An index has a
+// key for each flag, listing the packets with that flag set.
+var TCPFlags = map[string]byte{
+	"fin": 0x01,
+	"syn": 0x02,
+	"rst": 0x04,
+	"psh": 0x08,
+	"ack": 0x10,
+	"urg": 0x20,
+	"ece": 0x40,
+	"cwr": 0x80,
+}
+
+// ParseTCPFlag returns the bit of the named TCP flag.
+func ParseTCPFlag(name string) (byte, error) {
+	if f, ok := TCPFlags[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	var known []string
+	for n := range TCPFlags {
+		known = append(known, n)
+	}
+	sort.Strings(known)
+	return 0, fmt.Errorf("unknown TCP flag %q, only %s", name, strings.Join(known, ", "))
+}
+
+// tcpFlagName returns the name of a TCP flag bit, or the bit in hex if it
+// isn't one.
+func tcpFlagName(flag byte) string {
+	for name, f := range TCPFlags {
+		if f == flag {
+			return name
+		}
+	}
+	return fmt.Sprintf("%#02x", flag)
+}
+
+// addTCPFlags indexes each flag set in a TCP header's flags byte.
+func (w *Writer) addTCPFlags(pos uint32, flags byte) {
+	for bit := byte(1); bit != 0; bit <<= 1 {
+		if flags&bit != 0 {
+			w.add(pos, keyTCPFlag, []byte{bit})
+		}
+	}
+}
+
+// TCPFlagPositions returns the positions in the block file of all TCP packets
+// with the given flag (see ParseTCPFlag) set.  Only indexes with TCP flag keys
+// (see HasTCPFlags) have any.
+func (i *IndexFile) TCPFlagPositions(ctx context.Context, flag byte) (base.Positions, error) {
+	return i.positionsSingleKey(ctx, []byte{keyTCPFlag, flag})
+}
+
+// HasTCPFlags returns whether the index has TCP flag keys, which stenotype
+// only writes with --index_tcp_flags.
+func (i *IndexFile) HasTCPFlags() (bool, error) {
+	return i.hasKeyTypes(keyTCPFlag, keyTCPFlag)
+}
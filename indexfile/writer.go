@@ -0,0 +1,378 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package indexfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/golang/leveldb/db"
+	"github.com/golang/leveldb/table"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Index key types, which make up the first byte of each index key.
+const (
+	keyVersion  = 0
+	keyProtocol = 1
+	keyPort     = 2
+	keyVLAN     = 3
+	keyIPv4     = 4
+	keyMPLS     = 5
+	keyIPv6     = 6
+	keyMAC      = 9
+	keySrcPort  = 11
+	keyDstPort  = 12
+	keySrcIPv4  = 13
+	keyDstIPv4  = 14
+	keySrcIPv6  = 15
+	keyDstIPv6  = 16
+	keyTCPFlag  = 17
+)
+
+// ipProtocolMobility is the IPv6 mobility extension header, which gopacket
+// doesn't name.
+const ipProtocolMobility layers.IPProtocol = 135
+
+// Writer builds an index in the same format stenotype writes.  Unlike
+// stenotype, it only indexes the outermost IP and transport headers of each
+// packet.
+type Writer struct {
+	keys    map[string][]uint32
+	flows   flowGrouper // For the flow index of in-memory copies.
+	packets int
+	macs    bool // Whether to index MAC addresses, like stenotype --index_macs.
+	// Whether to index port directions, like stenotype --index_port_direction.
+	directions bool
+	// Whether to index host directions, like stenotype --index_host_direction.
+	hosts bool
+	// Whether to index TCP flags, like stenotype --index_tcp_flags.
+	tcpFlags bool
+}
+
+// NewWriter returns a new, empty index.
+func NewWriter() *Writer {
+	return &Writer{keys: map[string][]uint32{}, flows: flowGrouper{}}
+}
+
+func (w *Writer) add(pos uint32, keyType byte, value []byte) {
+	key := string(append([]byte{keyType}, value...))
+	w.keys[key] = append(w.keys[key], pos)
+}
+
+func (w *Writer) add16(pos uint32, keyType byte, value uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], value)
+	w.add(pos, keyType, buf[:])
+}
+
+// AddPacket indexes the Ethernet frame 'data', found at position 'pos' in its
+// blockfile.
+func (w *Writer) AddPacket(data []byte, pos int64) error {
+	if pos < 0 || pos >= 1<<32 {
+		return fmt.Errorf("position %d out of range", pos)
+	}
+	p := uint32(pos)
+	w.packets++
+	w.flows.add(data, p)
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	var proto layers.IPProtocol
+	seenIP := false
+	for _, l := range pkt.Layers() {
+		switch l := l.(type) {
+		case *layers.Ethernet:
+			if w.macs && len(l.SrcMAC) == 6 && len(l.DstMAC) == 6 {
+				w.add(p, keyMAC, l.SrcMAC)
+				w.add(p, keyMAC, l.DstMAC)
+			}
+		case *layers.Dot1Q:
+			w.add16(p, keyVLAN, l.VLANIdentifier)
+		case *layers.MPLS:
+			var buf [4]byte
+			binary.BigEndian.PutUint32(buf[:], l.Label)
+			w.add(p, keyMPLS, buf[:])
+		case *layers.IPv4:
+			if seenIP {
+				break
+			}
+			seenIP = true
+			w.add(p, keyIPv4, l.SrcIP.To4())
+			w.add(p, keyIPv4, l.DstIP.To4())
+			if w.hosts {
+				w.add(p, keySrcIPv4, l.SrcIP.To4())
+				w.add(p, keyDstIPv4, l.DstIP.To4())
+			}
+			proto = l.Protocol
+		case *layers.IPv6:
+			if seenIP {
+				break
+			}
+			seenIP = true
+			w.add(p, keyIPv6, l.SrcIP.To16())
+			w.add(p, keyIPv6, l.DstIP.To16())
+			if w.hosts {
+				w.add(p, keySrcIPv6, l.SrcIP.To16())
+				w.add(p, keyDstIPv6, l.DstIP.To16())
+			}
+			// gopacket stops decoding at fragment headers, and fails on
+			// hop-by-hop options it doesn't understand, so walk the extension
+			// header chain ourselves.
+			next, rest := l.NextHeader, l.LayerPayload()
+			if l.HopByHop != nil {
+				next = l.HopByHop.NextHeader
+			}
+			upper, transport := ipv6UpperLayer(next, rest)
+			w.addPorts(p, upper, transport)
+			w.add(p, keyProtocol, []byte{byte(upper)})
+			return nil
+		case *layers.TCP:
+			w.addPortPair(p, uint16(l.SrcPort), uint16(l.DstPort))
+			if w.tcpFlags && len(l.Contents) >= 14 {
+				w.addTCPFlags(p, l.Contents[13])
+			}
+		case *layers.UDP:
+			w.addPortPair(p, uint16(l.SrcPort), uint16(l.DstPort))
+		}
+		if _, ok := l.(gopacket.TransportLayer); ok {
+			break
+		}
+	}
+	if seenIP {
+		w.add(p, keyProtocol, []byte{byte(proto)})
+	}
+	return nil
+}
+
+// addPorts indexes the ports of a TCP or UDP header, and the flags of a TCP
+// one if requested.
+func (w *Writer) addPorts(pos uint32, proto layers.IPProtocol, data []byte) {
+	switch {
+	case proto == layers.IPProtocolTCP && len(data) >= 20,
+		proto == layers.IPProtocolUDP && len(data) >= 8:
+		w.addPortPair(pos, binary.BigEndian.Uint16(data[0:2]), binary.BigEndian.Uint16(data[2:4]))
+	}
+	if w.tcpFlags && proto == layers.IPProtocolTCP && len(data) >= 20 {
+		w.addTCPFlags(pos, data[13])
+	}
+}
+
+// addPortPair indexes the source and destination ports of a TCP or UDP
+// header.
+func (w *Writer) addPortPair(pos uint32, src, dst uint16) {
+	w.add16(pos, keyPort, src)
+	w.add16(pos, keyPort, dst)
+	if w.directions {
+		w.add16(pos, keySrcPort, src)
+		w.add16(pos, keyDstPort, dst)
+	}
+}
+
+// ipv6UpperLayer follows the chain of IPv6 extension headers in 'data',
+// starting with one of type 'next', returning the upper-layer protocol and
+// the data following the chain.  Like stenotype, it returns
+// IPProtocolIPv6Fragment for non-first fragments, since they don't contain
+// the upper-layer header.
+func ipv6UpperLayer(next layers.IPProtocol, data []byte) (layers.IPProtocol, []byte) {
+	for {
+		var length int
+		switch next {
+		case layers.IPProtocolIPv6Fragment:
+			if len(data) < 8 {
+				return next, nil
+			}
+			if binary.BigEndian.Uint16(data[2:4])&0xfff8 != 0 {
+				return next, nil
+			}
+			length = 8
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing,
+			layers.IPProtocolIPv6Destination, ipProtocolMobility:
+			if len(data) < 2 {
+				return next, nil
+			}
+			length = (int(data[1]) + 1) * 8
+		case layers.IPProtocolAH:
+			if len(data) < 2 {
+				return next, nil
+			}
+			length = (int(data[1]) + 2) * 4
+		default:
+			return next, data
+		}
+		if length > len(data) {
+			return next, nil
+		}
+		next, data = layers.IPProtocol(data[0]), data[length:]
+	}
+}
+
+// Packets returns the number of packets indexed so far.
+func (w *Writer) Packets() int {
+	return w.packets
+}
+
+// sorted returns the index's keys in order, starting with its version record,
+// along with their values.
+func (w *Writer) sorted() (keys, values [][]byte) {
+	var version [8]byte
+	binary.BigEndian.PutUint32(version[:], majorVersionNumber)
+	keys = append(keys, []byte{keyVersion})
+	values = append(values, version[:])
+	sortedKeys := make([]string, 0, len(w.keys))
+	for key := range w.keys {
+		sortedKeys = append(sortedKeys, key)
+	}
+	sort.Strings(sortedKeys)
+	for _, key := range sortedKeys {
+		positions := w.keys[key]
+		value := make([]byte, 0, 4*len(positions))
+		var last uint32
+		for i, pos := range positions {
+			// Positions are added in order, so duplicates (like a packet whose
+			// source and destination ports match) are always adjacent.
+			if i == 0 || pos != last {
+				value = append(value, byte(pos>>24), byte(pos>>16), byte(pos>>8), byte(pos))
+			}
+			last = pos
+		}
+		keys = append(keys, []byte(key))
+		values = append(values, value)
+	}
+	return keys, values
+}
+
+// WriteFile writes out the index as a leveldb table to the named file.
+func (w *Writer) WriteFile(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create index: %v", err)
+	}
+	ss := table.NewWriter(f, nil) // closes f when closed itself.
+	keys, values := w.sorted()
+	for i, key := range keys {
+		if err := ss.Set(key, values[i], nil); err != nil {
+			ss.Close()
+			return fmt.Errorf("could not write index key %x: %v", key, err)
+		}
+	}
+	if err := ss.Close(); err != nil {
+		return fmt.Errorf("could not finish index: %v", err)
+	}
+	return nil
+}
+
+// Index returns an in-memory copy of the index as it stands, which can be
+// queried like an index read from disk, along with its flow index.  'name' is
+// the name of the blockfile it indexes.
+func (w *Writer) Index(name string) *IndexFile {
+	keys, values := w.sorted()
+	return &IndexFile{name: name, ss: &memReader{keys: keys, values: values}, flows: w.flows.flows()}
+}
+
+// memReader reads an in-memory sorted index.
+type memReader struct {
+	keys, values [][]byte
+}
+
+func (m *memReader) search(key []byte) int {
+	return sort.Search(len(m.keys), func(i int) bool { return bytes.Compare(m.keys[i], key) >= 0 })
+}
+
+// Find returns an iterator starting at the first key >= 'key'.
+func (m *memReader) Find(key []byte, _ *db.ReadOptions) db.Iterator {
+	return &memIter{m: m, i: m.search(key) - 1}
+}
+
+// Get returns the value for exactly 'key'.
+func (m *memReader) Get(key []byte, _ *db.ReadOptions) ([]byte, error) {
+	i := m.search(key)
+	if i == len(m.keys) || !bytes.Equal(m.keys[i], key) {
+		return nil, db.ErrNotFound
+	}
+	return m.values[i], nil
+}
+
+func (m *memReader) Close() error { return nil }
+
+// memIter implements db.Iterator.
+type memIter struct {
+	m *memReader
+	i int
+}
+
+func (it *memIter) Next() bool {
+	if it.i < len(it.m.keys) {
+		it.i++
+	}
+	return it.i < len(it.m.keys)
+}
+
+func (it *memIter) Key() []byte   { return it.m.keys[it.i] }
+func (it *memIter) Value() []byte { return it.m.values[it.i] }
+func (it *memIter) Close() error  { return nil }
+
+// Rewrite writes a copy of this index to the named file, with each packet
+// position replaced by its new position from 'positions'.  Since positions
+// are stored sorted, mapped positions must keep the original packet order.
+func (i *IndexFile) Rewrite(filename string, positions map[int64]int64) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("could not create index: %v", err)
+	}
+	in, err := i.reader()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ss := table.NewWriter(f, nil) // closes f when closed itself.
+	iter := in.Find([]byte{}, nil)
+	for iter.Next() {
+		key, value := iter.Key(), append([]byte{}, iter.Value()...)
+		if len(key) == 1 && key[0] == keyVersion {
+			// The version record's value isn't a list of positions.
+		} else if len(value)%4 != 0 {
+			iter.Close()
+			ss.Close()
+			return fmt.Errorf("index key %x has invalid value length %d", key, len(value))
+		} else {
+			for j := 0; j < len(value); j += 4 {
+				old := int64(binary.BigEndian.Uint32(value[j:]))
+				pos, ok := positions[old]
+				if !ok {
+					iter.Close()
+					ss.Close()
+					return fmt.Errorf("index key %x references unknown position %d", key, old)
+				}
+				binary.BigEndian.PutUint32(value[j:], uint32(pos))
+			}
+		}
+		if err := ss.Set(key, value, nil); err != nil {
+			iter.Close()
+			ss.Close()
+			return fmt.Errorf("could not write index key %x: %v", key, err)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		ss.Close()
+		return fmt.Errorf("could not read index: %v", err)
+	}
+	if err := ss.Close(); err != nil {
+		return fmt.Errorf("could not finish index: %v", err)
+	}
+	return nil
+}
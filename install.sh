@@ -39,6 +39,7 @@ InstallPackage openssl
 
 Info "Building stenographer"
 go build
+go build -o stenoctl/stenoctl ./stenoctl
 
 Info "Building stenotype"
 pushd stenotype
@@ -119,6 +120,9 @@ sudo chmod 0755 "$BINDIR/stenoread"
 sudo cp -vf stenocurl "$BINDIR/stenocurl"
 sudo chown root:root "$BINDIR/stenocurl"
 sudo chmod 0755 "$BINDIR/stenocurl"
+sudo cp -vf stenoctl/stenoctl "$BINDIR/stenoctl"
+sudo chown root:root "$BINDIR/stenoctl"
+sudo chmod 0755 "$BINDIR/stenoctl"
 
 Info "Starting stenographer using upstart"
 # If you're not using upstart, you can replace this with:
@@ -0,0 +1,240 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package labels provides a small persistent store of labels attached to
+// blockfiles or time ranges, so retained data can be organized around
+// investigations ("incident-1234", "maintenance window", etc).
+package labels
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/httputil"
+)
+
+var v = base.V // verbose logging
+
+// Label attaches a name to either a single blockfile or a time range.
+type Label struct {
+	ID      string
+	Name    string
+	File    string    `json:",omitempty"` // Blockfile name, if labeling a file.
+	Start   time.Time // Start of labeled time range, if labeling a range.
+	End     time.Time // End of labeled time range, if labeling a range.
+	Created time.Time
+	// Hold places the labeled data under legal hold: the disk cleaner won't
+	// delete any blockfile the label applies to until it's removed.
+	Hold bool `json:",omitempty"`
+}
+
+// Matches returns true if this label applies to the named file or to any part
+// of the time range [start, end].
+func (l Label) Matches(file string, start, end time.Time) bool {
+	if l.File != "" {
+		return l.File == file
+	}
+	return !l.Start.After(end) && !l.End.Before(start)
+}
+
+func (l Label) validate() error {
+	switch {
+	case l.Name == "":
+		return fmt.Errorf("label has no name")
+	case l.File == "" && (l.Start.IsZero() || l.End.IsZero()):
+		return fmt.Errorf("label %q needs either a file or a start and end time", l.Name)
+	case l.End.Before(l.Start):
+		return fmt.Errorf("label %q ends before it starts", l.Name)
+	}
+	return nil
+}
+
+// Store is a set of labels, persisted as JSON to a single file on disk.
+type Store struct {
+	mu     sync.Mutex
+	path   string
+	labels []Label
+}
+
+// Open returns a Store persisted at the given path, loading any labels already
+// stored there.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		v(1, "No labels found at %q, starting empty", path)
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read labels %q: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &s.labels); err != nil {
+		return nil, fmt.Errorf("could not decode labels %q: %v", path, err)
+	}
+	v(1, "Loaded %d labels from %q", len(s.labels), path)
+	return s, nil
+}
+
+// saveLocked writes all labels to disk.  s.mu must be held.
+func (s *Store) saveLocked() error {
+	data, err := json.MarshalIndent(s.labels, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a hidden file then rename, so a crash never leaves us with a
+	// partially written label file.
+	tmp := filepath.Join(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write labels: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("could not move labels into place: %v", err)
+	}
+	return nil
+}
+
+// Add validates and stores a new label, returning it with its ID and creation
+// time filled in.
+func (s *Store) Add(l Label) (Label, error) {
+	if err := l.validate(); err != nil {
+		return Label{}, err
+	}
+	l.ID = uuid.New().String()
+	l.Created = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.labels = append(s.labels, l)
+	if err := s.saveLocked(); err != nil {
+		s.labels = s.labels[:len(s.labels)-1]
+		return Label{}, err
+	}
+	return l, nil
+}
+
+// Remove deletes the label with the given ID.
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.labels {
+		if l.ID == id {
+			old := s.labels
+			s.labels = append(append([]Label{}, old[:i]...), old[i+1:]...)
+			if err := s.saveLocked(); err != nil {
+				s.labels = old
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no label with ID %q", id)
+}
+
+// List returns all labels, sorted by start time and name.
+func (s *Store) List() []Label {
+	return s.filter(func(Label) bool { return true })
+}
+
+// Matching returns all labels which apply to the given file or time range.
+func (s *Store) Matching(file string, start, end time.Time) []Label {
+	return s.filter(func(l Label) bool { return l.Matches(file, start, end) })
+}
+
+// Held returns true if any legal hold applies to the given file or time range.
+func (s *Store) Held(file string, start, end time.Time) bool {
+	return len(s.filter(func(l Label) bool { return l.Hold && l.Matches(file, start, end) })) > 0
+}
+
+// filter returns all labels for which the given function returns true, sorted
+// by start time and name.
+func (s *Store) filter(match func(Label) bool) (out []Label) {
+	s.mu.Lock()
+	for _, l := range s.labels {
+		if match(l) {
+			out = append(out, l)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Start.Equal(out[j].Start) {
+			return out[i].Start.Before(out[j].Start)
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// ServeHTTP makes Store an http.Handler.  GET lists labels, optionally
+// filtered by 'file', 'start', and 'end' (RFC3339) URL parameters.  POST adds
+// the JSON-encoded label in the request body.  DELETE removes the label given
+// by the 'id' URL parameter.
+func (s *Store) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w = httputil.Log(w, r, r.Method == "POST")
+	defer log.Print(w)
+	vals := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		labels := s.List()
+		if vals.Get("file") != "" || vals.Get("start") != "" || vals.Get("end") != "" {
+			start, err := parseTime(vals.Get("start"), time.Time{})
+			if err != nil {
+				http.Error(w, "bad start", http.StatusBadRequest)
+				return
+			}
+			end, err := parseTime(vals.Get("end"), time.Unix(1<<62, 0))
+			if err != nil {
+				http.Error(w, "bad end", http.StatusBadRequest)
+				return
+			}
+			labels = s.Matching(vals.Get("file"), start, end)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(labels)
+	case "POST":
+		var l Label
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, "could not decode label", http.StatusBadRequest)
+			return
+		}
+		l, err := s.Add(l)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l)
+	case "DELETE":
+		if err := s.Remove(vals.Get("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
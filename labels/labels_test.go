@@ -0,0 +1,76 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package labels
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	d, err := ioutil.TempDir("", "labels_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(d)
+	path := filepath.Join(d, "labels.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(Label{Name: "no range"}); err == nil {
+		t.Error("added label with neither file nor time range")
+	}
+	incident, err := s.Add(Label{
+		Name:  "incident-1234",
+		Start: time.Unix(1000, 0),
+		End:   time.Unix(2000, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(Label{Name: "restored", File: "1420000000000000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen to make sure labels were persisted.
+	if s, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		file       string
+		start, end int64
+		want       int
+	}{
+		{"", 0, 999, 0},
+		{"", 0, 1000, 1},
+		{"", 1500, 1600, 1},
+		{"1420000000000000", 3000, 4000, 1},
+		{"1420000000000000", 1500, 4000, 2},
+	} {
+		if got := s.Matching(test.file, time.Unix(test.start, 0), time.Unix(test.end, 0)); len(got) != test.want {
+			t.Errorf("Matching(%q, %d, %d) got %v, want %d labels", test.file, test.start, test.end, got, test.want)
+		}
+	}
+	if err := s.Remove(incident.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.List(); len(got) != 1 || got[0].Name != "restored" {
+		t.Errorf("wrong labels after removal: %v", got)
+	}
+}
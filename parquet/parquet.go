@@ -0,0 +1,324 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package parquet writes flat tables as Apache Parquet files, for analysis
+// with tools like Spark and DuckDB.  It supports just what stenographer needs:
+// a handful of column types, optional (nullable) columns, and one
+// snappy-compressed, PLAIN-encoded page per column per row group.
+//
+// See https://github.com/apache/parquet-format for the file format.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/mars-suite/stenographer/base"
+)
+
+// Type is the type of a column's values.
+type Type int
+
+// Column types, with the Go type Write takes for each.
+const (
+	Int32     Type = iota // int32
+	Int64                 // int64
+	Timestamp             // time.Time, stored as microseconds since the epoch.
+	String                // string
+)
+
+// Column describes a column of a table.
+type Column struct {
+	Name     string
+	Type     Type
+	Optional bool // If set, the column's values may be nil.
+}
+
+// Parquet enum values.
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeByteArray = 6
+
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecSnappy = 1
+
+	pageTypeData = 0
+)
+
+const magic = "PAR1"
+
+// rowGroupSize is how many rows are buffered before being written out as a
+// row group.
+const rowGroupSize = 1 << 16
+
+// columnChunk records where a column chunk was written, for the footer.
+type columnChunk struct {
+	offset                   int64
+	uncompressed, compressed int64
+}
+
+type rowGroup struct {
+	rows    int64
+	columns []columnChunk
+}
+
+// Writer writes a table to a Parquet file.
+type Writer struct {
+	w       io.Writer
+	off     int64
+	err     error
+	columns []Column
+	values  []bytes.Buffer // PLAIN-encoded non-nil values of each column.
+	defined [][]bool       // Whether each row of each optional column is non-nil.
+	rows    int64          // Rows buffered for the current row group.
+	groups  []rowGroup
+}
+
+// NewWriter starts writing a table with the given columns to w.  Close must be
+// called to finish the file.
+func NewWriter(w io.Writer, columns []Column) *Writer {
+	pw := &Writer{
+		w:       w,
+		columns: columns,
+		values:  make([]bytes.Buffer, len(columns)),
+		defined: make([][]bool, len(columns)),
+	}
+	pw.write([]byte(magic))
+	return pw
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	n, err := w.w.Write(b)
+	w.off += int64(n)
+	w.err = err
+}
+
+// Write adds a row, with one value per column.
+func (w *Writer) Write(row ...interface{}) error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(row) != len(w.columns) {
+		return fmt.Errorf("parquet: row has %d values, want %d", len(row), len(w.columns))
+	}
+	for i, c := range w.columns {
+		if row[i] == nil && !c.Optional {
+			return fmt.Errorf("parquet: nil value for required column %q", c.Name)
+		}
+		if !valid(c.Type, row[i]) {
+			return fmt.Errorf("parquet: invalid value %v (%T) for column %q", row[i], row[i], c.Name)
+		}
+	}
+	for i, c := range w.columns {
+		if c.Optional {
+			w.defined[i] = append(w.defined[i], row[i] != nil)
+		}
+		buf := &w.values[i]
+		var b [8]byte
+		switch x := row[i].(type) {
+		case int32:
+			binary.LittleEndian.PutUint32(b[:], uint32(x))
+			buf.Write(b[:4])
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(x))
+			buf.Write(b[:])
+		case time.Time:
+			binary.LittleEndian.PutUint64(b[:], uint64(x.UnixNano()/1000))
+			buf.Write(b[:])
+		case string:
+			binary.LittleEndian.PutUint32(b[:], uint32(len(x)))
+			buf.Write(b[:4])
+			buf.WriteString(x)
+		}
+	}
+	w.rows++
+	if w.rows == rowGroupSize {
+		w.flush()
+	}
+	return w.err
+}
+
+func valid(t Type, x interface{}) bool {
+	if x == nil {
+		return true
+	}
+	switch x.(type) {
+	case int32:
+		return t == Int32
+	case int64:
+		return t == Int64
+	case time.Time:
+		return t == Timestamp
+	case string:
+		return t == String
+	}
+	return false
+}
+
+// flush writes out the buffered rows as a row group.
+func (w *Writer) flush() {
+	g := rowGroup{rows: w.rows}
+	for i, c := range w.columns {
+		var page bytes.Buffer
+		if c.Optional {
+			levels := encodeLevels(w.defined[i])
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], uint32(len(levels)))
+			page.Write(length[:])
+			page.Write(levels)
+		}
+		page.Write(w.values[i].Bytes())
+		compressed := snappy.Encode(nil, page.Bytes())
+
+		var t thriftWriter
+		t.writeStruct(func() {
+			t.i32(1, pageTypeData)
+			t.i32(2, int32(page.Len()))
+			t.i32(3, int32(len(compressed)))
+			t.structField(5, func() {
+				t.i32(1, int32(w.rows))
+				t.i32(2, encodingPlain)
+				t.i32(3, encodingRLE)
+				t.i32(4, encodingRLE)
+			})
+		})
+		chunk := columnChunk{
+			offset:       w.off,
+			uncompressed: int64(t.buf.Len() + page.Len()),
+			compressed:   int64(t.buf.Len() + len(compressed)),
+		}
+		w.write(t.buf.Bytes())
+		w.write(compressed)
+		g.columns = append(g.columns, chunk)
+		w.values[i].Reset()
+		w.defined[i] = w.defined[i][:0]
+	}
+	w.groups = append(w.groups, g)
+	w.rows = 0
+}
+
+// encodeLevels encodes the definition levels of an optional column with the
+// RLE/bit-packing hybrid encoding, using only RLE runs.
+func encodeLevels(defined []bool) []byte {
+	var out []byte
+	var b [binary.MaxVarintLen64]byte
+	for i := 0; i < len(defined); {
+		j := i + 1
+		for j < len(defined) && defined[j] == defined[i] {
+			j++
+		}
+		out = append(out, b[:binary.PutUvarint(b[:], uint64(j-i)<<1)]...)
+		if defined[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		i = j
+	}
+	return out
+}
+
+// Close writes any buffered rows and the file's footer.  It doesn't close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if w.rows > 0 {
+		w.flush()
+	}
+	var total int64
+	for _, g := range w.groups {
+		total += g.rows
+	}
+	var t thriftWriter
+	t.writeStruct(func() {
+		t.i32(1, 1) // version
+		t.structList(2, len(w.columns)+1, func(i int) {
+			if i == 0 {
+				t.binary(4, "schema")
+				t.i32(5, int32(len(w.columns)))
+				return
+			}
+			c := w.columns[i-1]
+			t.i32(1, physicalType(c.Type))
+			if c.Optional {
+				t.i32(3, repetitionOptional)
+			} else {
+				t.i32(3, repetitionRequired)
+			}
+			t.binary(4, c.Name)
+			switch c.Type {
+			case Timestamp:
+				t.i32(6, convertedTimestampMicros)
+			case String:
+				t.i32(6, convertedUTF8)
+			}
+		})
+		t.i64(3, total)
+		t.structList(4, len(w.groups), func(i int) {
+			g := w.groups[i]
+			var size int64
+			for _, c := range g.columns {
+				size += c.uncompressed
+			}
+			t.structList(1, len(g.columns), func(j int) {
+				c := g.columns[j]
+				t.i64(2, c.offset)
+				t.structField(3, func() {
+					t.i32(1, physicalType(w.columns[j].Type))
+					t.i32List(2, []int32{encodingPlain, encodingRLE})
+					t.binaryList(3, []string{w.columns[j].Name})
+					t.i32(4, codecSnappy)
+					t.i64(5, g.rows)
+					t.i64(6, c.uncompressed)
+					t.i64(7, c.compressed)
+					t.i64(9, c.offset)
+				})
+			})
+			t.i64(2, size)
+			t.i64(3, g.rows)
+		})
+		t.binary(6, "stenographer version "+base.Version)
+	})
+	w.write(t.buf.Bytes())
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(t.buf.Len()))
+	w.write(length[:])
+	w.write([]byte(magic))
+	return w.err
+}
+
+func physicalType(t Type) int32 {
+	switch t {
+	case Int32:
+		return typeInt32
+	case String:
+		return typeByteArray
+	}
+	return typeInt64
+}
@@ -0,0 +1,244 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// thriftReader decodes Thrift compact structs into maps from field ID to
+// value, with lists as []interface{}, for checking what Writer wrote.
+type thriftReader struct {
+	b []byte
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.b)
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *thriftReader) varint() int64 {
+	x := r.uvarint()
+	return int64(x>>1) ^ -int64(x&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := r.uvarint()
+		s := string(r.b[:n])
+		r.b = r.b[n:]
+		return s
+	case thriftList:
+		h := r.b[0]
+		r.b = r.b[1:]
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			out[i] = r.value(h & 0xf)
+		}
+		return out
+	case thriftStruct:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", typ))
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	out := map[int16]interface{}{}
+	var id int16
+	for {
+		h := r.b[0]
+		r.b = r.b[1:]
+		if h == 0 {
+			return out
+		}
+		if delta := int16(h >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(r.varint())
+		}
+		out[id] = r.value(h & 0xf)
+	}
+}
+
+type table struct {
+	names []string
+	rows  [][]interface{}
+}
+
+// readTable reads back a file written by Writer.
+func readTable(t *testing.T, data []byte) table {
+	if string(data[:4]) != magic || string(data[len(data)-4:]) != magic {
+		t.Fatal("missing magic")
+	}
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	r := &thriftReader{data[len(data)-8-footerLen : len(data)-8]}
+	meta := r.readStruct()
+	if len(r.b) != 0 {
+		t.Fatalf("%d bytes left after footer", len(r.b))
+	}
+	var tbl table
+	schema := meta[2].([]interface{})
+	types := map[string]int64{}
+	optional := map[string]bool{}
+	for _, s := range schema[1:] {
+		s := s.(map[int16]interface{})
+		name := s[4].(string)
+		tbl.names = append(tbl.names, name)
+		types[name] = s[1].(int64)
+		optional[name] = s[3].(int64) == repetitionOptional
+	}
+	for _, g := range meta[4].([]interface{}) {
+		g := g.(map[int16]interface{})
+		rows := int(g[3].(int64))
+		start := len(tbl.rows)
+		for i := 0; i < rows; i++ {
+			tbl.rows = append(tbl.rows, make([]interface{}, len(tbl.names)))
+		}
+		for col, c := range g[1].([]interface{}) {
+			cm := c.(map[int16]interface{})[3].(map[int16]interface{})
+			name := cm[3].([]interface{})[0].(string)
+			if name != tbl.names[col] {
+				t.Fatalf("column %d is %q, want %q", col, name, tbl.names[col])
+			}
+			r := &thriftReader{data[cm[9].(int64):]}
+			hdr := r.readStruct()
+			page, err := snappy.Decode(nil, r.b[:hdr[3].(int64)])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(page)) != hdr[2].(int64) {
+				t.Fatalf("page is %d bytes, want %d", len(page), hdr[2])
+			}
+			defined := make([]bool, rows)
+			for i := range defined {
+				defined[i] = true
+			}
+			if optional[name] {
+				n := binary.LittleEndian.Uint32(page)
+				lr := &thriftReader{page[4 : 4+n]}
+				page = page[4+n:]
+				for i := 0; i < rows; {
+					run := int(lr.uvarint() >> 1)
+					def := lr.b[0] == 1
+					lr.b = lr.b[1:]
+					for j := 0; j < run; j++ {
+						defined[i] = def
+						i++
+					}
+				}
+			}
+			for i := 0; i < rows; i++ {
+				if !defined[i] {
+					continue
+				}
+				var x interface{}
+				switch types[name] {
+				case typeInt32:
+					x, page = int32(binary.LittleEndian.Uint32(page)), page[4:]
+				case typeInt64:
+					x, page = int64(binary.LittleEndian.Uint64(page)), page[8:]
+				case typeByteArray:
+					n := binary.LittleEndian.Uint32(page)
+					x, page = string(page[4:4+n]), page[4+n:]
+				}
+				tbl.rows[start+i][col] = x
+			}
+			if len(page) != 0 {
+				t.Fatalf("column %q has %d bytes left", name, len(page))
+			}
+		}
+	}
+	if got := meta[3].(int64); got != int64(len(tbl.rows)) {
+		t.Errorf("footer says %d rows, read %d", got, len(tbl.rows))
+	}
+	return tbl
+}
+
+func TestWriter(t *testing.T) {
+	columns := []Column{
+		{Name: "ts", Type: Timestamp},
+		{Name: "name", Type: String, Optional: true},
+		{Name: "n", Type: Int32},
+		{Name: "big", Type: Int64, Optional: true},
+	}
+	start := time.Unix(1400000000, 123456000)
+	var want [][]interface{}
+	// Enough rows for a few row groups.
+	for i := 0; i < 2*rowGroupSize+100; i++ {
+		var name, big interface{}
+		if i%3 != 0 {
+			name = fmt.Sprintf("row%d", i)
+		}
+		if i > 10 && i < 20000 {
+			big = int64(i) << 40
+		}
+		want = append(want, []interface{}{start.Add(time.Duration(i) * time.Microsecond), name, int32(-i), big})
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf, columns)
+	for _, row := range want {
+		if err := w.Write(row...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(nil, "x", int32(1), nil); err == nil {
+		t.Error("nil accepted for required column")
+	}
+	if err := w.Write(start, "x", 1, nil); err == nil {
+		t.Error("int accepted for int32 column")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := readTable(t, buf.Bytes())
+	if !reflect.DeepEqual(got.names, []string{"ts", "name", "n", "big"}) {
+		t.Errorf("wrong columns %v", got.names)
+	}
+	if len(got.rows) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(got.rows), len(want))
+	}
+	for i := range want {
+		want[i][0] = want[i][0].(time.Time).UnixNano() / 1000
+		if !reflect.DeepEqual(got.rows[i], want[i]) {
+			t.Fatalf("row %d: got %v, want %v", i, got.rows[i], want[i])
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, []Column{{Name: "n", Type: Int32}})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTable(t, buf.Bytes()); len(got.rows) != 0 {
+		t.Errorf("read %d rows from empty table", len(got.rows))
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol type IDs.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes Parquet's metadata structures with the Thrift compact
+// protocol.  Structs are written with writeStruct, passing a function which
+// writes their fields in increasing field ID order.
+type thriftWriter struct {
+	buf     bytes.Buffer
+	lastIDs []int16 // Last field ID written in each enclosing struct.
+}
+
+func (t *thriftWriter) uvarint(x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+func (t *thriftWriter) varint(x int64) {
+	t.uvarint(uint64(x<<1) ^ uint64(x>>63)) // zigzag
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.lastIDs[len(t.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) writeStruct(fields func()) {
+	t.lastIDs = append(t.lastIDs, 0)
+	fields()
+	t.buf.WriteByte(0) // stop
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+func (t *thriftWriter) listHeader(typ byte, n int) {
+	if n < 15 {
+		t.buf.WriteByte(byte(n)<<4 | typ)
+		return
+	}
+	t.buf.WriteByte(0xf0 | typ)
+	t.uvarint(uint64(n))
+}
+
+func (t *thriftWriter) i32(id int16, x int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(x))
+}
+
+func (t *thriftWriter) i64(id int16, x int64) {
+	t.field(id, thriftI64)
+	t.varint(x)
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.uvarint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) structField(id int16, fields func()) {
+	t.field(id, thriftStruct)
+	t.writeStruct(fields)
+}
+
+func (t *thriftWriter) i32List(id int16, xs []int32) {
+	t.field(id, thriftList)
+	t.listHeader(thriftI32, len(xs))
+	for _, x := range xs {
+		t.varint(int64(x))
+	}
+}
+
+func (t *thriftWriter) binaryList(id int16, ss []string) {
+	t.field(id, thriftList)
+	t.listHeader(thriftBinary, len(ss))
+	for _, s := range ss {
+		t.uvarint(uint64(len(s)))
+		t.buf.WriteString(s)
+	}
+}
+
+// structList writes a list of n structs, calling 'fields' to write the fields
+// of each.
+func (t *thriftWriter) structList(id int16, n int, fields func(i int)) {
+	t.field(id, thriftList)
+	t.listHeader(thriftStruct, n)
+	for i := 0; i < n; i++ {
+		t.writeStruct(func() { fields(i) })
+	}
+}
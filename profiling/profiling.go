@@ -0,0 +1,331 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package profiling serves Go runtime profiles to authorized clients, rate
+// limited so they're safe to take from production sensors, and periodically
+// logs where goroutines spent longest waiting on locks and channels, so
+// stalls can be diagnosed without rebuilding with ad-hoc instrumentation.
+package profiling
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/httputil"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	v = base.V // verbose logging
+
+	profilesServed      = stats.S.Get("profiles_served")
+	profilesRateLimited = stats.S.Get("profiles_rate_limited")
+)
+
+const (
+	defaultMaxCPUSeconds        = 30
+	defaultBlockProfileRate     = 1000
+	defaultMutexProfileFraction = 100
+	defaultContentionLogTop     = 5
+)
+
+// profiles are the runtime/pprof profiles served besides the CPU profile.
+var profiles = []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"}
+
+// Profiler serves profiles and logs contention.
+type Profiler struct {
+	clients     map[string]bool // nil if any client may profile.
+	minInterval time.Duration
+	maxCPU      time.Duration
+	top         int
+	now         func() time.Time
+
+	mu   sync.Mutex
+	last map[string]time.Time // When each client last profiled.
+	// Contention seen at the last LogContention call.
+	contention map[string]site
+}
+
+// New returns a Profiler configured by conf, setting the runtime's block and
+// mutex profiling rates.
+func New(conf config.ProfilingConfig) (*Profiler, error) {
+	min, _, err := conf.Intervals()
+	if err != nil {
+		return nil, err
+	}
+	p := &Profiler{
+		minInterval: min,
+		maxCPU:      time.Duration(conf.MaxCPUSeconds) * time.Second,
+		top:         conf.ContentionLogTop,
+		now:         time.Now,
+		last:        map[string]time.Time{},
+	}
+	if len(conf.Clients) > 0 {
+		p.clients = map[string]bool{}
+		for _, c := range conf.Clients {
+			p.clients[c] = true
+		}
+	}
+	if p.maxCPU == 0 {
+		p.maxCPU = defaultMaxCPUSeconds * time.Second
+	}
+	if p.top == 0 {
+		p.top = defaultContentionLogTop
+	}
+	block, mutex := conf.BlockProfileRate, conf.MutexProfileFraction
+	if block == 0 {
+		block = defaultBlockProfileRate
+	}
+	if mutex == 0 {
+		mutex = defaultMutexProfileFraction
+	}
+	runtime.SetBlockProfileRate(block)
+	runtime.SetMutexProfileFraction(mutex)
+	return p, nil
+}
+
+// allow checks whether a client may take a profile now, returning how long
+// it must wait if it may not.  Allowed profiles count against the client's
+// rate limit.
+func (p *Profiler) allow(client string) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if last, ok := p.last[client]; ok {
+		if wait := last.Add(p.minInterval).Sub(now); wait > 0 {
+			return wait, false
+		}
+	}
+	p.last[client] = now
+	return 0, true
+}
+
+// Handler returns a handler for /debug/pprof/ and the profiles under it,
+// using identity to find the common name of each request's client.
+func (p *Profiler) Handler(identity func(*http.Request) string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		client := identity(r)
+		if p.clients != nil && !p.clients[client] {
+			http.Error(w, fmt.Sprintf("client %q may not profile", client), http.StatusForbidden)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+		if name == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprintln(w, "profile")
+			for _, n := range profiles {
+				fmt.Fprintln(w, n)
+			}
+			return
+		}
+		if name != "profile" && pprof.Lookup(name) == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if wait, ok := p.allow(client); !ok {
+			profilesRateLimited.Increment()
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			http.Error(w, fmt.Sprintf("client %q may profile again in %v", client, wait.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+		profilesServed.Increment()
+		if name == "profile" {
+			p.serveCPU(w, r)
+			return
+		}
+		debug, _ := strconv.Atoi(r.FormValue("debug"))
+		if debug != 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		}
+		if name == "heap" && r.FormValue("gc") != "" {
+			runtime.GC()
+		}
+		pprof.Lookup(name).WriteTo(w, debug)
+	})
+}
+
+// serveCPU serves a CPU profile of 'seconds' (default and maximum maxCPU).
+func (p *Profiler) serveCPU(w http.ResponseWriter, r *http.Request) {
+	d := p.maxCPU
+	if s := r.FormValue("seconds"); s != "" {
+		sec, err := strconv.Atoi(s)
+		if err != nil || sec <= 0 {
+			http.Error(w, fmt.Sprintf("invalid seconds %q", s), http.StatusBadRequest)
+			return
+		}
+		if t := time.Duration(sec) * time.Second; t < d {
+			d = t
+		}
+	}
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		http.Error(w, fmt.Sprintf("cannot start CPU profile: %v", err), http.StatusConflict)
+		return
+	}
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+	pprof.StopCPUProfile()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	w.Write(buf.Bytes())
+}
+
+// site is the time spent waiting at one call stack.
+type site struct {
+	kind   string // "mutex" or "block"
+	where  string
+	cycles int64
+	count  int64
+}
+
+// contention returns the contention recorded since the program started, keyed
+// by kind and call stack.
+func contention() map[string]site {
+	out := map[string]site{}
+	for _, kind := range []string{"mutex", "block"} {
+		f := runtime.BlockProfile
+		if kind == "mutex" {
+			f = runtime.MutexProfile
+		}
+		n, _ := f(nil)
+		var recs []runtime.BlockProfileRecord
+		for {
+			recs = make([]runtime.BlockProfileRecord, n+64)
+			var ok bool
+			if n, ok = f(recs); ok {
+				recs = recs[:n]
+				break
+			}
+		}
+		for _, rec := range recs {
+			stack := rec.Stack()
+			key := fmt.Sprint(kind, stack)
+			s := out[key]
+			s.kind, s.where = kind, describe(stack)
+			s.cycles += rec.Cycles
+			s.count += rec.Count
+			out[key] = s
+		}
+	}
+	return out
+}
+
+// describe names the first function in a stack outside the runtime and
+// standard library synchronization, with its caller, like
+// "thread.(*Thread).Lookup (thread.go:120) from env.(*Env).Lookup".
+func describe(stack []uintptr) string {
+	frames := runtime.CallersFrames(stack)
+	var out string
+	for {
+		f, more := frames.Next()
+		name := f.Function
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			name = name[i+1:]
+		}
+		switch {
+		case out != "":
+			return out + " from " + name
+		case name == "" || strings.HasPrefix(name, "runtime.") || strings.HasPrefix(name, "sync."):
+		default:
+			out = fmt.Sprintf("%s (%s:%d)", name, filepath.Base(f.File), f.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	if out == "" {
+		return "unknown"
+	}
+	return out
+}
+
+// topContention returns the n sites which waited longest between two
+// contention snapshots, longest first.
+func topContention(prev, cur map[string]site, n int) []site {
+	var out []site
+	for key, s := range cur {
+		s.cycles -= prev[key].cycles
+		s.count -= prev[key].count
+		if s.cycles > 0 {
+			out = append(out, s)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].cycles > out[j].cycles })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+var cyclesPerSecondRE = regexp.MustCompile(`cycles/second=(\d+)`)
+
+// cyclesPerSecond returns the rate the runtime measures contention in, which
+// it only reports in the header of text profiles, or 0 if that's missing.
+func cyclesPerSecond() float64 {
+	var buf bytes.Buffer
+	pprof.Lookup("mutex").WriteTo(&buf, 1)
+	m := cyclesPerSecondRE.FindSubmatch(buf.Bytes())
+	if m == nil {
+		return 0
+	}
+	cps, _ := strconv.ParseFloat(string(m[1]), 64)
+	return cps
+}
+
+// LogContention logs the call sites which spent longest waiting on locks
+// (mutex) and channels or other blocking operations (block) since its last
+// call.  The first call only records where things stand.
+func (p *Profiler) LogContention() {
+	cur := contention()
+	p.mu.Lock()
+	prev := p.contention
+	p.contention = cur
+	p.mu.Unlock()
+	if prev == nil {
+		return
+	}
+	top := topContention(prev, cur, p.top)
+	if len(top) == 0 {
+		v(1, "No contention since last check")
+		return
+	}
+	cps := cyclesPerSecond()
+	for i, s := range top {
+		wait := fmt.Sprintf("%d cycles", s.cycles)
+		if cps > 0 {
+			wait = time.Duration(float64(s.cycles) / cps * float64(time.Second)).Round(time.Microsecond).String()
+		}
+		log.Printf("Contention #%d (%s): %v over %d waits at %s", i+1, s.kind, wait, s.count, s.where)
+	}
+}
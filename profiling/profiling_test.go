@@ -0,0 +1,81 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package profiling
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mars-suite/stenographer/config"
+)
+
+func TestHandler(t *testing.T) {
+	p, err := New(config.ProfilingConfig{Clients: []string{"alice"}, MinInterval: "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	p.now = func() time.Time { return now }
+	var client string
+	h := p.Handler(func(*http.Request) string { return client })
+	for _, test := range []struct {
+		client, path string
+		advance      time.Duration
+		want         int
+	}{
+		{"alice", "/debug/pprof/", 0, http.StatusOK},
+		{"alice", "/debug/pprof/heap", 0, http.StatusOK},
+		{"alice", "/debug/pprof/goroutine", 30 * time.Second, http.StatusTooManyRequests},
+		{"alice", "/debug/pprof/nonexistent", 0, http.StatusNotFound},
+		{"bob", "/debug/pprof/heap", 0, http.StatusForbidden},
+		{"alice", "/debug/pprof/goroutine", 30 * time.Second, http.StatusOK},
+	} {
+		now = now.Add(test.advance)
+		client = test.client
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.path, nil))
+		if w.Code != test.want {
+			t.Errorf("%s %s: got status %d, want %d", test.client, test.path, w.Code, test.want)
+		}
+	}
+}
+
+func TestTopContention(t *testing.T) {
+	prev := map[string]site{
+		"a": {kind: "mutex", where: "a", cycles: 100, count: 1},
+		"b": {kind: "mutex", where: "b", cycles: 500, count: 5},
+	}
+	cur := map[string]site{
+		"a": {kind: "mutex", where: "a", cycles: 1100, count: 3},
+		"b": {kind: "mutex", where: "b", cycles: 500, count: 5},
+		"c": {kind: "block", where: "c", cycles: 300, count: 1},
+		"d": {kind: "block", where: "d", cycles: 2000, count: 9},
+	}
+	got := topContention(prev, cur, 2)
+	want := []site{
+		{kind: "block", where: "d", cycles: 2000, count: 9},
+		{kind: "mutex", where: "a", cycles: 1000, count: 2},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("site %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var (
+	planCacheHits   = stats.S.Get("query_plan_cache_hits")
+	planCacheMisses = stats.S.Get("query_plan_cache_misses")
+)
+
+// Plans, if set, caches parsed queries by their normalized text, so
+// templated queries run again and again (as by SOAR playbooks) skip parsing
+// and get the same plan each time.  It should only be changed before any
+// queries are run.
+var Plans *PlanCache
+
+type plan struct {
+	key string
+	q   Query
+}
+
+// PlanCache is a LRU cache of parsed queries.  Only queries which mean the
+// same thing whenever they're parsed are cached:  those with relative times,
+// saved sets, or host names are parsed afresh every time.
+type PlanCache struct {
+	size int
+
+	mu sync.Mutex
+	// protected by mu
+	lru   *list.List // of *plan, most recently used first
+	plans map[string]*list.Element
+}
+
+// NewPlanCache returns a cache holding up to 'size' parsed queries.
+func NewPlanCache(size int) *PlanCache {
+	return &PlanCache{
+		size:  size,
+		lru:   list.New(),
+		plans: map[string]*list.Element{},
+	}
+}
+
+// planKey normalizes a query's text, so queries differing only in spacing
+// share a plan.  Spacing only matters within quoted strings, which are only
+// host names (never cached) or addresses (which can't contain spaces).  The
+// time zone it's parsed in is included, since times without a UTC offset are
+// in it.
+func planKey(query string, loc *time.Location) string {
+	return loc.String() + "\x00" + strings.Join(strings.Fields(query), " ")
+}
+
+// get returns the cached plan of the query with the given key, or nil.
+func (c *PlanCache) get(key string) Query {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.plans[key]
+	if e == nil {
+		planCacheMisses.Increment()
+		return nil
+	}
+	planCacheHits.Increment()
+	c.lru.MoveToFront(e)
+	return e.Value.(*plan).q
+}
+
+// add caches a plan, evicting the least recently used ones to make room.
+func (c *PlanCache) add(key string, q Query) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.plans[key]; ok || c.size <= 0 {
+		return
+	}
+	for c.lru.Len() >= c.size {
+		delete(c.plans, c.lru.Remove(c.lru.Back()).(*plan).key)
+	}
+	c.plans[key] = c.lru.PushFront(&plan{key, q})
+}
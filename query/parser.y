@@ -30,12 +30,16 @@
 package query
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/mars-suite/stenographer/indexfile"
 )
 
 %}
@@ -43,6 +47,8 @@ import (
 %union {
 	num int
 	ip net.IP
+	ips [2]net.IP
+	mac net.HardwareAddr
 	str string
 	query Query
 	dur time.Duration
@@ -51,9 +57,16 @@ import (
 
 %type	<query>	top expr expr2
 %type <time> timestamp
+%type <ips> iprange
 
-%token <str> HOST PORT PROTO AND OR NET MASK TCP UDP ICMP BEFORE AFTER IPP AGO VLAN MPLS
+%token <str> HOST PORT PROTO AND OR NET MASK TCP UDP ICMP BEFORE AFTER IPP AGO VLAN MPLS TEID
+%token <str> INNER OUTER ETHER SRC DST
+%token <str> THREAD DISK PATH APP QUIC CID TCPFLAGS
+%token <str> NAME STRING
+%token <str> INSET NOTINSET
+%token <str> FLOWPACKETS CMP
 %token <ip> IP
+%token <mac> MAC
 %token <num> NUM
 %token <dur> DURATION
 %token <time> TIME
@@ -70,7 +83,19 @@ expr:
     expr2
 |   expr AND expr2
 {
-	$$ = intersectQuery{$1, $3}
+	if _, ok := $3.(setQuery); ok {
+		// Sets are cheap to look up, and often small, so do them first.
+		$$ = intersectQuery{$3, $1}
+	} else {
+		$$ = intersectQuery{$1, $3}
+	}
+}
+|   expr AND NOTINSET
+{
+	if matchesWholeFiles($1) {
+		parserlex.Error("cannot exclude a set from a query matching whole files, like a time range alone")
+	}
+	$$ = exceptQuery{$1, parserlex.(*parserLex).set($3)}
 }
 |   expr OR expr2
 {
@@ -78,9 +103,53 @@ expr:
 }
 
 expr2:
-    HOST IP
+    iprange
+{
+	$$ = unionQuery{ipQuery($1), innerIPQuery($1)}
+}
+|   OUTER iprange
+{
+	$$ = ipQuery($2)
+}
+|   INNER iprange
+{
+	$$ = innerIPQuery($2)
+}
+|   SRC iprange
+{
+	$$ = srcIPQuery($2)
+}
+|   DST iprange
+{
+	$$ = dstIPQuery($2)
+}
+|   HOST NAME
+{
+	$$ = hostNameQuery{name: $2}
+}
+|   OUTER HOST NAME
+{
+	$$ = hostNameQuery{name: $3, layer: "outer"}
+}
+|   INNER HOST NAME
+{
+	$$ = hostNameQuery{name: $3, layer: "inner"}
+}
+|   HOST STRING
 {
-	$$ = ipQuery{$2, $2}
+	$$ = parserlex.(*parserLex).quotedHost($2, "")
+}
+|   OUTER HOST STRING
+{
+	$$ = parserlex.(*parserLex).quotedHost($3, "outer")
+}
+|   INNER HOST STRING
+{
+	$$ = parserlex.(*parserLex).quotedHost($3, "inner")
+}
+|   ETHER HOST MAC
+{
+	$$ = macQuery($3)
 }
 |   PORT NUM
 {
@@ -89,9 +158,23 @@ expr2:
 	}
 	$$ = portQuery($2)
 }
+|   SRC PORT NUM
+{
+	if $3 < 0 || $3 >= 65536 {
+		parserlex.Error(fmt.Sprintf("invalid port %v", $3))
+	}
+	$$ = srcPortQuery($3)
+}
+|   DST PORT NUM
+{
+	if $3 < 0 || $3 >= 65536 {
+		parserlex.Error(fmt.Sprintf("invalid port %v", $3))
+	}
+	$$ = dstPortQuery($3)
+}
 |   VLAN NUM
 {
-	if $2 < 0 || $2 >= 65536 {
+	if $2 < 0 || $2 >= 4096 {
 		parserlex.Error(fmt.Sprintf("invalid vlan %v", $2))
 	}
 	$$ = vlanQuery($2)
@@ -103,6 +186,13 @@ expr2:
 	}
 	$$ = mplsQuery($2)
 }
+|   TEID NUM
+{
+	if $2 < 0 || $2 >= (1 << 32) {
+		parserlex.Error(fmt.Sprintf("invalid teid %v", $2))
+	}
+	$$ = teidQuery($2)
+}
 |   IPP PROTO NUM
 {
 	if $3 < 0 || $3 >= 256 {
@@ -110,25 +200,43 @@ expr2:
 	}
 	$$ = protocolQuery($3)
 }
-|   NET IP '/' NUM
+|   FLOWPACKETS CMP NUM
 {
-		mask := net.CIDRMask($4, len($2) * 8)
-		if mask == nil {
-			parserlex.Error(fmt.Sprintf("bad cidr: %v/%v", $2, $4))
-		}
-		from, to, err := ipsFromNet($2, mask)
-		if err != nil {
-			parserlex.Error(err.Error())
-		}
-		$$ = ipQuery{from, to}
+	if $3 < 0 || $3 >= (1 << 32) {
+		parserlex.Error(fmt.Sprintf("invalid flow packet count %v", $3))
+	}
+	$$ = flowPacketsQuery{op: $2, n: $3}
 }
-|   NET IP MASK IP
+|   INSET
 {
-		from, to, err := ipsFromNet($2, net.IPMask($4))
-		if err != nil {
-			parserlex.Error(err.Error())
-		}
-		$$ = ipQuery{from, to}
+	$$ = parserlex.(*parserLex).set($1)
+}
+|   THREAD NUM
+{
+	if $2 < 0 {
+		parserlex.Error(fmt.Sprintf("invalid thread %v", $2))
+	}
+	$$ = threadQuery($2)
+}
+|   DISK PATH
+{
+	$$ = parserlex.(*parserLex).disk($2)
+}
+|   DISK STRING
+{
+	$$ = parserlex.(*parserLex).disk($2)
+}
+|   APP NAME
+{
+	$$ = parserlex.(*parserLex).app($2)
+}
+|   QUIC CID NAME
+{
+	$$ = parserlex.(*parserLex).quicCID($3)
+}
+|   TCPFLAGS NAME
+{
+	$$ = parserlex.(*parserLex).tcpFlag($2)
 }
 |   '(' expr ')'
 {
@@ -159,6 +267,32 @@ expr2:
 	$$ = t
 }
 
+iprange:
+    HOST IP
+{
+	$$ = [2]net.IP{$2, $2}
+}
+|   NET IP '/' NUM
+{
+		mask := net.CIDRMask($4, len($2) * 8)
+		if mask == nil {
+			parserlex.Error(fmt.Sprintf("bad cidr: %v/%v", $2, $4))
+		}
+		from, to, err := ipsFromNet($2, mask)
+		if err != nil {
+			parserlex.Error(err.Error())
+		}
+		$$ = [2]net.IP{from, to}
+}
+|   NET IP MASK IP
+{
+		from, to, err := ipsFromNet($2, net.IPMask($4))
+		if err != nil {
+			parserlex.Error(err.Error())
+		}
+		$$ = [2]net.IP{from, to}
+}
+
 timestamp:
     TIME
 {
@@ -166,6 +300,7 @@ timestamp:
 }
 |   DURATION AGO
 {
+	parserlex.(*parserLex).volatile = true
 	$$ = parserlex.(*parserLex).now.Add(-$1)
 }
 
@@ -193,6 +328,11 @@ type parserLex struct {
 	pos int
 	out Query
 	err error
+	last int // The last token returned.
+	loc *time.Location // The zone of times without a UTC offset.
+	// volatile is set if the query may mean something different when parsed
+	// again:  it has relative times, saved sets, or host names.
+	volatile bool
 }
 
 // tokens provides a simple map for adding new keywords and mapping them
@@ -202,19 +342,32 @@ var tokens = map[string]int{
  "ago": AGO,
  "&&": AND,
  "and": AND,
+ "app": APP,
  "before": BEFORE,
+ "cid": CID,
+ "disk": DISK,
+ "dst": DST,
+ "ether": ETHER,
+ "flowpackets": FLOWPACKETS,
  "host": HOST,
  "icmp": ICMP,
+ "inner": INNER,
  "ip": IPP,
  "mask": MASK,
  "net": NET,
  "||": OR,
  "or": OR,
+ "outer": OUTER,
  "port": PORT,
  "vlan": VLAN,
  "mpls": MPLS,
  "proto": PROTO,
+ "quic": QUIC,
+ "src": SRC,
  "tcp": TCP,
+ "tcpflags": TCPFLAGS,
+ "teid": TEID,
+ "thread": THREAD,
  "udp": UDP,
 }
 
@@ -224,11 +377,50 @@ var tokens = map[string]int{
 //
 // The type of the input argument must be *<prefix>SymType.
 func (x *parserLex) Lex(yylval *parserSymType) (ret int) {
+	defer func() { x.last = ret }()
 	for x.pos < len(x.in) && unicode.IsSpace(rune(x.in[x.pos])) {
 		x.pos++
 	}
+	if x.pos < len(x.in) && (x.in[x.pos] == '"' || x.in[x.pos] == '\'') {
+		str, ok := x.quoted()
+		if !ok {
+			return -1
+		}
+		yylval.str = str
+		return STRING
+	}
+	if id, tok := x.setRef(); tok != 0 {
+		yylval.str = id
+		return tok
+	}
+	if x.last == DISK && x.pos < len(x.in) && x.in[x.pos] == '/' {
+		start := x.pos
+		for x.pos < len(x.in) && !unicode.IsSpace(rune(x.in[x.pos])) && x.in[x.pos] != ')' {
+			x.pos++
+		}
+		yylval.str = x.in[start:x.pos]
+		return PATH
+	}
+	if x.last == APP || x.last == CID || x.last == TCPFLAGS {
+		start := x.pos
+		for x.pos < len(x.in) && wordByte(x.in[x.pos]) {
+			x.pos++
+		}
+		if x.pos > start {
+			yylval.str = x.in[start:x.pos]
+			return NAME
+		}
+	}
+	if x.last == HOST {
+		if name := x.hostName(); name != "" {
+			yylval.str = name
+			x.volatile = true
+			return NAME
+		}
+	}
 	for t, i := range tokens {
-		if strings.HasPrefix(x.in[x.pos:], t) {
+		if strings.HasPrefix(x.in[x.pos:], t) && !(wordByte(t[len(t)-1]) && x.pos+len(t) < len(x.in) && wordByte(x.in[x.pos+len(t)])) {
+			// Keywords must be whole words:  "tcpdump" isn't "tcp dump".
 			x.pos += len(t)
 			return i
 		}
@@ -257,15 +449,19 @@ L:
 	part := x.in[s:x.pos]
 	switch {
 	case isTime:
-		t, err := time.Parse(time.RFC3339, part)
+		t, err := x.parseTime(part)
 		if err != nil {
-			x.Error(fmt.Sprintf("bad time %q", part))
+			x.Error(fmt.Sprintf("bad time %q: %v", part, err))
 		}
 		yylval.time = t
 		return TIME
 	case isIP:
 		yylval.ip = net.ParseIP(part)
 		if yylval.ip == nil {
+			if mac, err := net.ParseMAC(part); err == nil && len(mac) == 6 {
+				yylval.mac = mac
+				return MAC
+			}
 			x.Error(fmt.Sprintf("bad IP %q", part))
 			return -1
 		}
@@ -292,23 +488,327 @@ L:
 	case ':', '.', '(', ')', '/':
 		x.pos++
 		return int(c)
+	case '<', '>', '=':
+		x.pos++
+		yylval.str = string(c)
+		if c != '=' && x.pos < len(x.in) && x.in[x.pos] == '=' {
+			x.pos++
+			yylval.str += "="
+		}
+		return CMP
 	}
 	return -1
 }
 
+// localTimeLayout is the layout of times without a UTC offset.  Fractional
+// seconds are accepted too.
+const localTimeLayout = "2006-01-02T15:04:05"
+
+// parseTime parses a time just lexed.  Times are RFC3339, but the UTC offset
+// may be left out, in which case the time is in x.loc, or replaced by an
+// IANA time zone name in brackets (as in RFC 9557), like
+// "2015-01-01T09:00:00[America/New_York]", which is consumed too.
+func (x *parserLex) parseTime(part string) (time.Time, error) {
+	loc := x.loc
+	if x.pos < len(x.in) && x.in[x.pos] == '[' {
+		end := strings.IndexByte(x.in[x.pos:], ']')
+		if end < 0 {
+			return time.Time{}, fmt.Errorf("unterminated time zone")
+		}
+		name := x.in[x.pos+1 : x.pos+end]
+		x.pos += end + 1
+		var err error
+		if loc, err = time.LoadLocation(name); err != nil {
+			return time.Time{}, fmt.Errorf("unknown time zone %q", name)
+		}
+		return time.ParseInLocation(localTimeLayout, part, loc)
+	}
+	if t, err := time.Parse(time.RFC3339, part); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(localTimeLayout, part, loc)
+}
+
+// setRef lexes "in set:<id>" or "not in set:<id>", returning the ID and its
+// token, or a zero token if neither is next.  It's checked before keywords,
+// since "in" is a prefix of some of them.
+func (x *parserLex) setRef() (string, int) {
+	for _, ref := range []struct {
+		prefix string
+		tok    int
+	}{{"in set:", INSET}, {"not in set:", NOTINSET}} {
+		if !strings.HasPrefix(x.in[x.pos:], ref.prefix) {
+			continue
+		}
+		x.pos += len(ref.prefix)
+		start := x.pos
+		for x.pos < len(x.in) && validSetID(x.in[x.pos]) {
+			x.pos++
+		}
+		if x.pos == start {
+			x.Error("missing set ID")
+		}
+		return x.in[start:x.pos], ref.tok
+	}
+	return "", 0
+}
+
+// set returns a query for the saved set with the given ID.
+func (x *parserLex) set(id string) setQuery {
+	x.volatile = true
+	s := Sets.get(id)
+	if s == nil {
+		x.Error(fmt.Sprintf("unknown or expired set %q", id))
+		return setQuery{id: id}
+	}
+	return setQuery{id: id, positions: s.positions}
+}
+
+// hostName consumes and returns the host name at the current position, or
+// returns "" if there isn't one.  Anything with a colon or without a letter is
+// left to be lexed as an address.
+func (x *parserLex) hostName() string {
+	end := x.pos
+	for ; end < len(x.in); end++ {
+		c := x.in[end]
+		if c == ':' {
+			return ""
+		} else if !hostNameByte(c) {
+			break
+		}
+	}
+	name := x.in[x.pos:end]
+	if !plainHostName(name) {
+		return ""
+	}
+	x.pos = end
+	return name
+}
+
+func wordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func hostNameByte(c byte) bool {
+	return wordByte(c) || c == '.' || c == '-'
+}
+
+// plainHostName returns whether a host name can be given without quotes:
+// it's made of letters, digits, dots, dashes, and underscores, with at least
+// one letter, and isn't a keyword or an address.
+func plainHostName(name string) bool {
+	letter := false
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !hostNameByte(c) {
+			return false
+		}
+		letter = letter || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+	}
+	_, keyword := tokens[name]
+	return letter && !keyword && net.ParseIP(name) == nil
+}
+
+// quotedHost returns the query for a host given as a quoted string:  by
+// address if it is one, otherwise by name.
+func (x *parserLex) quotedHost(name, layer string) Query {
+	if name == "" {
+		x.Error("empty host name")
+		return hostNameQuery{layer: layer}
+	}
+	ip := net.ParseIP(name)
+	if ip == nil {
+		x.volatile = true
+		return hostNameQuery{name: name, layer: layer}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	r := [2]net.IP{ip, ip}
+	switch layer {
+	case "outer":
+		return ipQuery(r)
+	case "inner":
+		return innerIPQuery(r)
+	}
+	return unionQuery{ipQuery(r), innerIPQuery(r)}
+}
+
+// app returns a query for the named application protocol.
+func (x *parserLex) app(name string) Query {
+	if _, err := indexfile.ParseAppProtocol(name); err != nil {
+		x.Error(err.Error())
+	}
+	return appQuery(strings.ToLower(name))
+}
+
+// quicCID returns a query for the QUIC connection ID given in hex.
+func (x *parserLex) quicCID(id string) Query {
+	cid, err := hex.DecodeString(id)
+	if err != nil || len(cid) == 0 || len(cid) > indexfile.MaxQUICConnectionIDLength {
+		x.Error(fmt.Sprintf("invalid QUIC connection ID %q", id))
+	}
+	return quicCIDQuery(cid)
+}
+
+// tcpFlag returns a query for packets with the named TCP flag set.
+func (x *parserLex) tcpFlag(name string) Query {
+	flag, err := indexfile.ParseTCPFlag(name)
+	if err != nil {
+		x.Error(err.Error())
+	}
+	return tcpFlagQuery(flag)
+}
+
+// disk returns the query for files on the disk at 'path', which must be
+// absolute.
+func (x *parserLex) disk(path string) Query {
+	if !filepath.IsAbs(path) {
+		x.Error(fmt.Sprintf("disk path %q isn't absolute", path))
+	}
+	return diskQuery(filepath.Clean(path))
+}
+
+// escapes are the single-character escapes quoted strings may contain.
+var escapes = map[byte]byte{
+	'a': '\a', 'b': '\b', 'f': '\f', 'n': '\n', 'r': '\r', 't': '\t', 'v': '\v',
+	'\\': '\\', '\'': '\'', '"': '"',
+}
+
+// quoted lexes a string in double or single quotes at the current position,
+// returning false (having reported an error) if it's malformed.  Strings may
+// contain the same backslash escapes as Go strings, except octal ones:  the
+// single-character escapes (like \n, \\, and \"), \xHH bytes, and \uHHHH
+// and \UHHHHHHHH Unicode code points.
+func (x *parserLex) quoted() (string, bool) {
+	start := x.pos
+	quote := x.in[start]
+	var out strings.Builder
+	for i := start + 1; i < len(x.in); {
+		c := x.in[i]
+		if c == quote {
+			x.pos = i + 1
+			return out.String(), true
+		} else if c != '\\' {
+			out.WriteByte(c)
+			i++
+			continue
+		}
+		if i+1 == len(x.in) {
+			break
+		}
+		if e, ok := escapes[x.in[i+1]]; ok {
+			out.WriteByte(e)
+			i += 2
+			continue
+		}
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[x.in[i+1]]
+		if digits == 0 {
+			x.errorAt(i, fmt.Sprintf("unknown escape %q", x.in[i:i+2]))
+			return "", false
+		}
+		end := i + 2 + digits
+		if end > len(x.in) {
+			end = len(x.in)
+		}
+		n, err := strconv.ParseUint(x.in[i+2:end], 16, 32)
+		if err != nil || end-i-2 != digits {
+			x.errorAt(i, fmt.Sprintf("escape %q needs %d hex digits", x.in[i:i+2], digits))
+			return "", false
+		}
+		if x.in[i+1] == 'x' {
+			out.WriteByte(byte(n))
+		} else if n > unicode.MaxRune || n >= 0xD800 && n < 0xE000 {
+			x.errorAt(i, fmt.Sprintf("invalid code point in %q", x.in[i:end]))
+			return "", false
+		} else {
+			out.WriteRune(rune(n))
+		}
+		i = end
+	}
+	x.errorAt(start, "unterminated string")
+	return "", false
+}
+
 // Error is called by the parser on a parse error.
 func (x *parserLex) Error(s string) {
+	x.errorAt(x.pos, s)
+}
+
+// errorAt records an error at the given position in the input, if there isn't
+// one already.
+func (x *parserLex) errorAt(pos int, s string) {
 	if x.err == nil {
-		x.err = fmt.Errorf("%v at character %v (%q HERE %q)", s, x.pos, x.in[:x.pos], x.in[x.pos:])
+		x.err = fmt.Errorf("%v at character %v (%q HERE %q)", s, pos, x.in[:pos], x.in[pos:])
 	}
 }
 
-// parse parses an input string into a Query.
+// parse parses an input string into a Query, reading times without a UTC
+// offset in UTC.
 func parse(in string) (Query, error) {
-	lex := &parserLex{in: in, now: time.Now()}
+	q, _, err := parseVolatile(in, time.UTC)
+	return q, err
+}
+
+// parseVolatile is like parse, with times without a UTC offset in 'loc', but
+// also returns whether the query may mean something different when parsed
+// again, so can't be cached.
+func parseVolatile(in string, loc *time.Location) (Query, bool, error) {
+	lex := &parserLex{in: in, now: time.Now(), loc: loc}
 	parserParse(lex)
 	if lex.err != nil {
-		return nil, lex.err
+		return nil, false, lex.err
+	}
+	return lex.out, lex.volatile, nil
+}
+
+// Anonymize rewrites a query so it can be shared, say as part of a recorded
+// workload, without revealing what was looked for, while keeping its
+// structure and so the lookups it does.  Addresses are replaced by anonIP
+// (which should be prefix-preserving, so nets still contain their hosts),
+// except masks, MACs have their device-specific lower half zeroed, and host
+// names are replaced by anonName.  Relative times are replaced by the
+// absolute times they currently mean, so the query matches the same packets
+// whenever it's run.
+func Anonymize(in string, anonIP func(net.IP) net.IP, anonName func(string) string) (string, error) {
+	x := &parserLex{in: in, now: time.Now(), loc: time.UTC}
+	var out strings.Builder
+	for {
+		start, prev := x.pos, x.last
+		var lval parserSymType
+		tok := x.Lex(&lval)
+		if x.err != nil {
+			return "", x.err
+		} else if tok < 0 {
+			x.Error("invalid token")
+			return "", x.err
+		} else if tok == 0 {
+			out.WriteString(x.in[start:])
+			return out.String(), nil
+		}
+		text := x.in[start:x.pos]
+		trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+		out.WriteString(text[:len(text)-len(trimmed)])
+		switch tok {
+		case IP:
+			if prev != MASK {
+				trimmed = anonIP(lval.ip).String()
+			}
+		case MAC:
+			mac := append(net.HardwareAddr(nil), lval.mac...)
+			copy(mac[3:], []byte{0, 0, 0})
+			trimmed = mac.String()
+		case NAME, STRING:
+			trimmed = strconv.Quote(anonName(lval.str))
+		case DURATION:
+			// Peek at the next token:  "<duration> ago" becomes a time.
+			pos, last := x.pos, x.last
+			if x.Lex(&parserSymType{}) == AGO {
+				trimmed = x.now.Add(-lval.dur).UTC().Format(time.RFC3339)
+			} else {
+				x.pos, x.last = pos, last
+			}
+		}
+		out.WriteString(trimmed)
 	}
-	return lex.out, nil
 }
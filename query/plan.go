@@ -0,0 +1,172 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"github.com/mars-suite/stenographer/indexfile"
+)
+
+// Estimate returns roughly how many packets in the index q matches, from the
+// index's statistics (see indexfile.Stats), without looking anything up.  It
+// returns -1 if the index has no statistics.
+func Estimate(q Query, index *indexfile.IndexFile) int64 {
+	s := index.Stats()
+	if s == nil {
+		return -1
+	}
+	return estimate(q, s)
+}
+
+// estimate returns roughly how many packets q matches in an index with the
+// given statistics.  Queries the statistics say nothing about may match
+// every packet.
+func estimate(q Query, s *indexfile.Stats) int64 {
+	switch q := q.(type) {
+	case protocolQuery:
+		return s.PerKey(indexfile.ProtocolKeys)
+	case portQuery:
+		return s.PerKey(indexfile.PortKeys)
+	case srcPortQuery:
+		return estimateDirectedPort(s, indexfile.SrcPortKeys)
+	case dstPortQuery:
+		return estimateDirectedPort(s, indexfile.DstPortKeys)
+	case srcIPQuery:
+		return estimateDirectedIPs(q[0], q[1], s, indexfile.SrcIPv4Keys, indexfile.SrcIPv6Keys)
+	case dstIPQuery:
+		return estimateDirectedIPs(q[0], q[1], s, indexfile.DstIPv4Keys, indexfile.DstIPv6Keys)
+	case vlanQuery:
+		return s.PerKey(indexfile.VLANKeys)
+	case mplsQuery:
+		return s.PerKey(indexfile.MPLSKeys)
+	case macQuery:
+		return s.PerKey(indexfile.MACKeys)
+	case teidQuery:
+		return s.PerKey(indexfile.TEIDKeys)
+	case tcpFlagQuery:
+		return s.PerKey(indexfile.TCPFlagKeys)
+	case ipQuery:
+		return estimateIPs(q[0], q[1], s, indexfile.IPv4Keys, indexfile.IPv6Keys)
+	case innerIPQuery:
+		return estimateIPs(q[0], q[1], s, indexfile.InnerIPv4Keys, indexfile.InnerIPv6Keys)
+	case compositeQuery:
+		return estimate(intersectQuery{q.ips, q.port}, s)
+	case timeQuery, threadQuery, diskQuery:
+		// Time, thread, and disk checks never read the index, so they're free,
+		// and as likely as not to rule out the whole file.
+		return 0
+	case unionQuery:
+		var n int64
+		for _, sub := range q {
+			n += estimate(sub, s)
+		}
+		if n > s.Packets {
+			return s.Packets
+		}
+		return n
+	case intersectQuery:
+		n := s.Packets
+		for _, sub := range q {
+			if e := estimate(sub, s); e < n {
+				n = e
+			}
+		}
+		return n
+	}
+	return s.Packets
+}
+
+// estimateDirectedPort estimates the packets with a port in one direction,
+// falling back on either direction for indexes without port direction keys,
+// as the lookup does.
+func estimateDirectedPort(s *indexfile.Stats, keyType byte) int64 {
+	if s.Keys(keyType).Keys == 0 {
+		return s.PerKey(indexfile.PortKeys)
+	}
+	return s.PerKey(keyType)
+}
+
+// estimateDirectedIPs estimates the packets with addresses in a range in one
+// direction, falling back on either direction for indexes without host
+// direction keys, as the lookup does.
+func estimateDirectedIPs(from, to net.IP, s *indexfile.Stats, ip4Type, ip6Type byte) int64 {
+	if s.Keys(ip4Type).Keys == 0 && s.Keys(ip6Type).Keys == 0 {
+		return estimateIPs(from, to, s, indexfile.IPv4Keys, indexfile.IPv6Keys)
+	}
+	return estimateIPs(from, to, s, ip4Type, ip6Type)
+}
+
+// estimateIPs estimates the packets with addresses in a range, as those of
+// the number of addresses in it (up to the number of keys) each matching
+// the mean.
+func estimateIPs(from, to net.IP, s *indexfile.Stats, ip4Type, ip6Type byte) int64 {
+	keyType := ip4Type
+	if len(from) == 16 {
+		keyType = ip6Type
+	}
+	ks := s.Keys(keyType)
+	if addrs, ok := rangeSize(from, to); ok && addrs < uint64(ks.Keys) {
+		return int64(addrs) * s.PerKey(keyType)
+	}
+	return ks.Positions
+}
+
+// rangeSize returns how many addresses there are from one to the other, or
+// false if there are too many to count.
+func rangeSize(from, to net.IP) (uint64, bool) {
+	if len(from) == 4 && len(to) == 4 {
+		lo, hi := binary.BigEndian.Uint32(from), binary.BigEndian.Uint32(to)
+		return uint64(hi) - uint64(lo) + 1, hi >= lo
+	} else if len(from) != 16 || len(to) != 16 {
+		return 0, false
+	}
+	split := len(from) - 8
+	if string(from[:split]) != string(to[:split]) {
+		return 0, false
+	}
+	lo, hi := binary.BigEndian.Uint64(from[split:]), binary.BigEndian.Uint64(to[split:])
+	if hi < lo || hi-lo == 1<<64-1 {
+		return 0, false
+	}
+	return hi - lo + 1, true
+}
+
+// plan returns the parts of an intersection in the order to look them up:
+// those expected to match the fewest packets first, so the intersection
+// shrinks as fast as possible and lookups can stop as soon as it's empty.
+// Without statistics, they're left in the order they were given.
+func (a intersectQuery) plan(index *indexfile.IndexFile) intersectQuery {
+	if len(a) < 2 {
+		return a
+	}
+	s := index.Stats()
+	if s == nil {
+		return a
+	}
+	estimates := make([]int64, len(a))
+	order := make([]int, len(a))
+	for i, q := range a {
+		estimates[i], order[i] = estimate(q, s), i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return estimates[order[i]] < estimates[order[j]] })
+	planned := make(intersectQuery, len(a))
+	for i, j := range order {
+		planned[i] = a[j]
+	}
+	return planned
+}
@@ -12,7 +12,7 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-//go:generate go tool yacc -p parser parser.y
+//go:generate goyacc -p parser parser.y
 //go:generate go fmt y.go
 
 // Package query provides objects for specifying a query against stenographer.
@@ -20,15 +20,16 @@ package query
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/indexfile"
-	"github.com/google/stenographer/stats"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/stats"
 	"golang.org/x/net/context"
 )
 
@@ -85,6 +86,108 @@ func (q portQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 func (q portQuery) String() string { return fmt.Sprintf("port %d", q) }
 func (q portQuery) base() bool     { return true }
 
+// srcPortQuery matches packets with a TCP or UDP source port, and
+// dstPortQuery those with a destination port, so pivots on a server's port
+// don't also return its replies.
+type srcPortQuery uint16
+
+func (q srcPortQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return directedPositions(ctx, index, q, "port", index.HasPortDirections,
+		func() (base.Positions, error) { return index.SrcPortPositions(ctx, uint16(q)) },
+		portQuery(q))
+}
+func (q srcPortQuery) String() string { return fmt.Sprintf("src port %d", q) }
+func (q srcPortQuery) base() bool     { return true }
+
+type dstPortQuery uint16
+
+func (q dstPortQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return directedPositions(ctx, index, q, "port", index.HasPortDirections,
+		func() (base.Positions, error) { return index.DstPortPositions(ctx, uint16(q)) },
+		portQuery(q))
+}
+func (q dstPortQuery) String() string { return fmt.Sprintf("dst port %d", q) }
+func (q dstPortQuery) base() bool     { return true }
+
+// srcIPQuery matches packets with outer source addresses in a range, and
+// dstIPQuery those with outer destination addresses in it, for just a host's
+// outbound or inbound traffic.
+type srcIPQuery [2]net.IP
+
+func (q srcIPQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return directedPositions(ctx, index, q, "host", index.HasHostDirections,
+		func() (base.Positions, error) { return index.SrcIPPositions(ctx, q[0], q[1]) },
+		ipQuery(q))
+}
+func (q srcIPQuery) String() string { return fmt.Sprintf("src host %v-%v", q[0], q[1]) }
+func (q srcIPQuery) base() bool     { return true }
+
+type dstIPQuery [2]net.IP
+
+func (q dstIPQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return directedPositions(ctx, index, q, "host", index.HasHostDirections,
+		func() (base.Positions, error) { return index.DstIPPositions(ctx, q[0], q[1]) },
+		ipQuery(q))
+}
+func (q dstIPQuery) String() string { return fmt.Sprintf("dst host %v-%v", q[0], q[1]) }
+func (q dstIPQuery) base() bool     { return true }
+
+// directedPositions looks up a port or host in one direction with 'lookup',
+// if the index has direction keys for it.  Indexes written without them can
+// only match 'either', the same port or host in either direction, which is
+// noted in the query's warnings.
+func directedPositions(ctx context.Context, index *indexfile.IndexFile, q Query, kind string, hasDirections func() (bool, error), lookup func() (base.Positions, error), either Query) (base.Positions, error) {
+	directions, err := hasDirections()
+	if err != nil {
+		return nil, err
+	} else if directions {
+		return lookup()
+	}
+	base.QueryWarningsFrom(ctx).Add(base.QueryWarning{
+		File:   indexfile.BlockfilePathFromIndexPath(index.Name()),
+		Reason: fmt.Sprintf("index has no %s direction keys, so %q matched %q", kind, q, either),
+	})
+	return either.LookupIn(ctx, index)
+}
+
+// threadQuery matches all packets written by a capture thread, and diskQuery
+// all those in blockfiles in a directory at or under a path, for diagnosing
+// a single NIC queue or disk.  Like time queries, they match whole files.
+type threadQuery int
+
+func (q threadQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	src, ok := base.CaptureSourceFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("%v: capture thread of %q unknown", q, index.Name())
+	} else if src.Thread != int(q) {
+		return base.NoPositions, nil
+	}
+	return base.AllPositions, nil
+}
+func (q threadQuery) String() string { return fmt.Sprintf("thread %d", q) }
+func (q threadQuery) base() bool     { return true }
+
+type diskQuery string
+
+func (q diskQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	src, ok := base.CaptureSourceFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("%v: directory of %q unknown", q, index.Name())
+	}
+	if rel, err := filepath.Rel(string(q), src.Directory); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return base.NoPositions, nil
+	}
+	return base.AllPositions, nil
+}
+func (q diskQuery) String() string { return fmt.Sprintf("disk %s", strconv.Quote(string(q))) }
+func (q diskQuery) base() bool     { return true }
+
 type vlanQuery uint16
 
 func (q vlanQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -118,9 +221,270 @@ func (q ipQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp b
 	defer log(q, index, &bp, &err)()
 	return index.IPPositions(ctx, q[0], q[1])
 }
-func (q ipQuery) String() string { return fmt.Sprintf("host %v-%v", q[0], q[1]) }
+func (q ipQuery) String() string { return fmt.Sprintf("outer host %v-%v", q[0], q[1]) }
 func (q ipQuery) base() bool     { return true }
 
+type innerIPQuery [2]net.IP
+
+func (q innerIPQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.InnerIPPositions(ctx, q[0], q[1])
+}
+func (q innerIPQuery) String() string { return fmt.Sprintf("inner host %v-%v", q[0], q[1]) }
+func (q innerIPQuery) base() bool     { return true }
+
+type teidQuery uint32
+
+func (q teidQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.TEIDPositions(ctx, uint32(q))
+}
+func (q teidQuery) String() string { return fmt.Sprintf("teid %d", q) }
+func (q teidQuery) base() bool     { return true }
+
+type macQuery net.HardwareAddr
+
+func (q macQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.MACPositions(ctx, net.HardwareAddr(q))
+}
+func (q macQuery) String() string { return fmt.Sprintf("ether host %v", net.HardwareAddr(q)) }
+func (q macQuery) base() bool     { return true }
+
+// compositeQuery matches packets with both an outer address in a range and a
+// port, which has composite keys (see indexfile.CompositePorts).
+type compositeQuery struct {
+	ips  ipQuery
+	port portQuery
+}
+
+func (q compositeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	bp, err = index.CompositePositions(ctx, uint16(q.port), q.ips[0], q.ips[1])
+	if err != nil && ctx.Err() == nil {
+		v(1, "Composite lookup %v in %q failed, intersecting instead: %v", q, index.Name(), err)
+		return intersectQuery{q.ips, q.port}.LookupIn(ctx, index)
+	}
+	return bp, err
+}
+func (q compositeQuery) String() string { return fmt.Sprintf("(%v and %v)", q.ips, q.port) }
+func (q compositeQuery) base() bool     { return true }
+
+// promoteComposites rewrites the intersections in a query of a port with
+// composite keys and an outer address, or a union including one, into
+// composite lookups.
+func promoteComposites(q Query) Query {
+	switch q := q.(type) {
+	case unionQuery:
+		out := make(unionQuery, len(q))
+		for i, sub := range q {
+			out[i] = promoteComposites(sub)
+		}
+		return out
+	case exceptQuery:
+		return exceptQuery{promoteComposites(q.q), q.set}
+	case intersectQuery:
+		// Flatten nested intersections first, so "a and b and c" is seen whole.
+		var out intersectQuery
+		for _, sub := range q {
+			if nested, ok := sub.(intersectQuery); ok {
+				out = append(out, nested...)
+			} else {
+				out = append(out, sub)
+			}
+		}
+		for i, sub := range out {
+			out[i] = promoteComposites(sub)
+		}
+		for i, sub := range out {
+			port, ok := sub.(portQuery)
+			if !ok || !indexfile.CompositePorts[uint16(port)] {
+				continue
+			}
+			for j, other := range out {
+				if combined, ok := withPort(other, port); ok {
+					out[j] = combined
+					// The port's now looked up along with the address.
+					out = append(out[:i:i], out[i+1:]...)
+					break
+				}
+			}
+			break
+		}
+		if len(out) == 1 {
+			return out[0]
+		}
+		return out
+	}
+	return q
+}
+
+// withPort returns a query matching packets which match both q and the port,
+// using composite keys, if q is an outer address or a union including one.
+func withPort(q Query, port portQuery) (Query, bool) {
+	switch q := q.(type) {
+	case ipQuery:
+		return compositeQuery{q, port}, true
+	case unionQuery:
+		out := make(unionQuery, len(q))
+		found := false
+		for i, sub := range q {
+			if ips, ok := sub.(ipQuery); ok {
+				out[i], found = compositeQuery{ips, port}, true
+			} else {
+				out[i] = intersectQuery{sub, port}
+			}
+		}
+		return out, found
+	}
+	return nil, false
+}
+
+// flowPacketsQuery matches packets in flows with a number of packets in the
+// blockfile (op is one of "<", "<=", "=", ">=", ">") n.
+type flowPacketsQuery struct {
+	op string
+	n  int
+}
+
+func (q flowPacketsQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	min, max := 1, math.MaxInt32
+	switch q.op {
+	case "<":
+		max = q.n - 1
+	case "<=":
+		max = q.n
+	case "=":
+		min, max = q.n, q.n
+	case ">=":
+		min = q.n
+	case ">":
+		min = q.n + 1
+	}
+	if min > max {
+		return base.NoPositions, nil
+	}
+	return index.FlowPositions(ctx, min, max)
+}
+func (q flowPacketsQuery) String() string { return fmt.Sprintf("flowpackets %s %d", q.op, q.n) }
+func (q flowPacketsQuery) base() bool     { return true }
+
+// appQuery matches packets in flows of the named application protocol (see
+// indexfile.AppProtocolIndexes).
+// tcpFlagQuery matches TCP packets with a flag set.  Files indexed without TCP
+// flag keys match all TCP packets instead, and say so.
+type tcpFlagQuery byte
+
+func (q tcpFlagQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	if has, err := index.HasTCPFlags(); err != nil {
+		return nil, err
+	} else if has {
+		return index.TCPFlagPositions(ctx, byte(q))
+	}
+	base.QueryWarningsFrom(ctx).Add(base.QueryWarning{
+		File:   indexfile.BlockfilePathFromIndexPath(index.Name()),
+		Reason: fmt.Sprintf("index has no TCP flag keys, so %q matched %q", q, protocolQuery(6)),
+	})
+	return protocolQuery(6).LookupIn(ctx, index)
+}
+func (q tcpFlagQuery) String() string {
+	for name, f := range indexfile.TCPFlags {
+		if f == byte(q) {
+			return "tcpflags " + name
+		}
+	}
+	return fmt.Sprintf("tcpflags %#02x", byte(q))
+}
+func (q tcpFlagQuery) base() bool { return true }
+
+type appQuery string
+
+func (q appQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	proto, err := indexfile.ParseAppProtocol(string(q))
+	if err != nil {
+		return nil, err
+	}
+	return index.AppPositions(ctx, proto)
+}
+func (q appQuery) String() string { return fmt.Sprintf("app %s", string(q)) }
+func (q appQuery) base() bool     { return true }
+
+// quicCIDQuery matches QUIC packets sent to a connection ID (see
+// indexfile.QUICConnectionIDIndexes).
+type quicCIDQuery string
+
+func (q quicCIDQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	return index.QUICConnectionIDPositions(ctx, []byte(q))
+}
+func (q quicCIDQuery) String() string { return fmt.Sprintf("quic cid %x", string(q)) }
+func (q quicCIDQuery) base() bool     { return true }
+
+// hostNameQuery is a host given by name, which is replaced by the addresses
+// the Parser's Resolver finds for it before the query is run.
+type hostNameQuery struct {
+	name  string
+	layer string // "outer", "inner", or "" for both.
+}
+
+func (q hostNameQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (base.Positions, error) {
+	return nil, fmt.Errorf("unresolved host name %q", q.name)
+}
+func (q hostNameQuery) String() string {
+	name := q.name
+	if !plainHostName(name) {
+		name = strconv.Quote(name)
+	}
+	if q.layer != "" {
+		return q.layer + " host " + name
+	}
+	return "host " + name
+}
+func (q hostNameQuery) base() bool { return true }
+
+// resolve returns a query for all the addresses 'resolver' says the host had
+// between start and end, each limited to the time it had it.
+func (q hostNameQuery) resolve(ctx context.Context, resolver Resolver, start, end time.Time) (Query, error) {
+	if resolver == nil {
+		return nil, fmt.Errorf("cannot resolve host name %q: no host resolver configured", q.name)
+	}
+	assignments, err := resolver.Resolve(ctx, q.name, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve host name %q: %v", q.name, err)
+	} else if len(assignments) == 0 {
+		return nil, fmt.Errorf("host name %q had no addresses in the query's time range", q.name)
+	}
+	var out unionQuery
+	for _, a := range assignments {
+		ip := a.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ips := [2]net.IP{ip, ip}
+		var hq Query
+		switch q.layer {
+		case "outer":
+			hq = ipQuery(ips)
+		case "inner":
+			hq = innerIPQuery(ips)
+		default:
+			hq = unionQuery{ipQuery(ips), innerIPQuery(ips)}
+		}
+		if !a.Start.IsZero() || !a.End.IsZero() {
+			hq = intersectQuery{hq, timeQuery{a.Start, a.End}}
+		}
+		out = append(out, hq)
+	}
+	v(1, "Resolved host name %q to %v", q.name, out)
+	if len(out) == 1 {
+		return out[0], nil
+	}
+	return out, nil
+}
+
 type unionQuery []Query
 
 func (a unionQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
@@ -152,7 +516,7 @@ type intersectQuery []Query
 func (a intersectQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
 	positions := base.AllPositions
-	for _, query := range a {
+	for _, query := range a.plan(index) {
 		pos, err := query.LookupIn(ctx, index)
 		if err != nil {
 			return nil, err
@@ -177,20 +541,14 @@ type timeQuery [2]time.Time
 
 func (a timeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
 	defer log(a, index, &bp, &err)()
-	last := filepath.Base(index.Name())
-	intval, err := strconv.ParseInt(last, 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("could not parse basename %q: %v", last, err)
+	started := index.Started()
+	if started.Start.IsZero() {
+		return nil, fmt.Errorf("no start time known for %q", filepath.Base(index.Name()))
 	}
-	t := time.Unix(0, intval*1000) // converts micros -> nanos
-	// Note, we add a minute when doing 'before' queries and subtract a minute
-	// when doing 'after' queries, to make sure we actually get the time
-	// specified.
-	if !a[0].IsZero() && t.Before(a[0].Add(-time.Minute)) {
-		v(2, "time query skipping %q", index.Name())
-		return base.NoPositions, nil
-	}
-	if !a[1].IsZero() && t.After(a[1].Add(time.Minute)) {
+	// The range the file was started in allows for clock skew, to make sure we
+	// actually get the time specified even if the file's timestamp doesn't
+	// quite match its packets'.
+	if !started.Overlaps(a[0], a[1]) {
 		v(2, "time query skipping %q", index.Name())
 		return base.NoPositions, nil
 	}
@@ -198,19 +556,78 @@ func (a timeQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp
 	return base.AllPositions, nil
 }
 func (a timeQuery) String() string {
-	if a[0].IsZero() {
+	if !a[0].IsZero() && !a[1].IsZero() {
+		return fmt.Sprintf("(after %v and before %v)", a[0].Format(time.RFC3339), a[1].Format(time.RFC3339))
+	} else if a[0].IsZero() {
 		return fmt.Sprintf("before %v", a[1].Format(time.RFC3339))
 	}
 	return fmt.Sprintf("after %v", a[0].Format(time.RFC3339))
 }
 func (a timeQuery) base() bool { return true }
 
+// Within restricts a query to files which may hold packets in the time range
+// from start to end, either of which may be zero for an open range.  Like
+// "after" and "before", it skips whole files, so packets just outside the
+// range may still be returned.
+func Within(q Query, start, end time.Time) Query {
+	if start.IsZero() && end.IsZero() {
+		return q
+	}
+	return intersectQuery{q, timeQuery{start, end}}
+}
+
 // NewQuery parses the given query arg and returns a query object.
 // This query can then be passed into a blockfile to get out the set of packets
 // which match it.
 //
 // Currently, we support one simple method of parsing a query, detailed in the
 // README.md file.  Returns an error if the query string is invalid.
+//
+// It's the zero Parser's Parse, for queries of sensors in UTC without host
+// names.
 func NewQuery(query string) (Query, error) {
-	return parse(query)
+	return (&Parser{}).Parse(query)
+}
+
+// Parser parses queries as a sensor is configured to read them.  The zero
+// Parser reads times in UTC and can't resolve host names.
+type Parser struct {
+	// TimeZone is the zone query times without a UTC offset are read in, or
+	// nil for UTC.
+	TimeZone *time.Location
+	// Resolver resolves "host <name>" queries, which fail if it's nil.
+	Resolver Resolver
+}
+
+// Location returns the zone query times without a UTC offset are read in.
+func (p *Parser) Location() *time.Location {
+	if p.TimeZone == nil {
+		return time.UTC
+	}
+	return p.TimeZone
+}
+
+// Parse is like NewQuery, for the parser's sensor.  Host names are resolved
+// through its Resolver over the query's time range.  Queries are looked up
+// in, and added to, Plans, if it's set.
+func (p *Parser) Parse(query string) (Query, error) {
+	loc := p.Location()
+	var key string
+	if Plans != nil {
+		key = planKey(query, loc)
+		if q := Plans.get(key); q != nil {
+			return promoteComposites(q), nil
+		}
+	}
+	q, volatile, err := parseVolatile(query, loc)
+	if err != nil {
+		return nil, err
+	}
+	if q, err = resolveHostNames(q, p.Resolver); err != nil {
+		return nil, err
+	}
+	if Plans != nil && !volatile {
+		Plans.add(key, q)
+	}
+	return promoteComposites(q), nil
 }
@@ -15,7 +15,20 @@
 package query
 
 import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/indexfile"
 )
 
 func TestParsingValidQueries(t *testing.T) {
@@ -23,7 +36,31 @@ func TestParsingValidQueries(t *testing.T) {
 		"net 1.2.3.4/8",
 		"net 1.2.3.4 mask 255.255.254.0",
 		"host 1.2.3.4",
+		"inner host 1.2.3.4",
+		"ether host aa:bb:cc:dd:ee:ff",
+		"ether host 00:11:22:33:44:55 and port 67",
+		"teid 4294967295",
+		"vlan 100",
+		"tcpflags syn and port 443",
+		"tcpflags RST",
+		"vlan 4095 and host 1.2.3.4",
+		"teid 12345 and inner host 10.0.0.1",
+		"flowpackets > 1000",
+		"flowpackets>=3 and tcp",
+		"host 1.2.3.4 and flowpackets <= 5",
+		"flowpackets = 1",
+		"app tls",
+		"app DNS and port 5353",
+		"quic cid 8394c8f03e515708",
+		"quic cid 0a and udp",
+		"outer net 1.2.3.0/24",
+		"inner net ::1 mask ffff::",
 		"port 80",
+		"src port 443",
+		"dst port 51820 and udp",
+		"src host 1.2.3.4",
+		"dst net 10.0.0.0/8 and dst port 443",
+		"src net ::1 mask ffff::",
 		"ip proto 6",
 		"tcp",
 		"udp",
@@ -37,6 +74,14 @@ func TestParsingValidQueries(t *testing.T) {
 		"udp and port 514 or tcp and port 80",
 		"(udp && port 514) or (tcp and port 80)",
 		"(port 80 && after 2015-01-01T13:14:15Z) || (host 1.2.3.4 && before 2015-01-01T13:14:15Z)",
+		"host \"1.2.3.4\"",
+		"outer host '::1' and tcp",
+		"inner host \"10.0.0.1\"",
+		"thread 2",
+		"thread 0 and port 53",
+		"disk /data/disk3",
+		"(disk /data/disk3) and tcp",
+		"disk \"/mnt/steno disk\" or thread 1",
 	} {
 		if q, err := NewQuery(test); err != nil {
 			t.Fatalf("could not parse valid query %q: %v", test, err)
@@ -55,6 +100,36 @@ func TestParsingInvalidQuery(t *testing.T) {
 		"protocol -1",
 		"protocol 256",
 		"last 4",
+		"inner port 80",
+		"ether host 1.2.3.4",
+		"ether host 00:11:22:33:44:55:66:77",
+		"teid 4294967296",
+		"teid",
+		"vlan 4096",
+		"tcpflags",
+		"tcpflags nope",
+		"vlan",
+		"flowpackets 10",
+		"flowpackets > 4294967296",
+		"flowpackets => 10",
+		"app",
+		"app smtp",
+		"quic cid",
+		"quic cid 0g",
+		"quic cid 123",
+		"quic cid 000102030405060708090a0b0c0d0e0f1011121314",
+		"host webserver01", // No resolver configured.
+		"ether host db01",
+		"host \"\"",
+		"host \"web01",
+		"host 'web\\q01'",
+		"tcpdump",
+		"host web01\"",
+		"thread",
+		"thread -1",
+		"disk",
+		"disk data/disk3",
+		"disk 'data'",
 	} {
 		if q, err := NewQuery(test); err == nil {
 			t.Fatalf("parsed invalid query %q: %v", test, q)
@@ -63,3 +138,408 @@ func TestParsingInvalidQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestQuotedStrings(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{`"web01"`, "web01"},
+		{`'web01'`, "web01"},
+		{`"it's"`, "it's"},
+		{`'say "hi"'`, `say "hi"`},
+		{`"a\"b\\c\'d"`, `a"b\c'd`},
+		{`"\t\n\x41\u00e9\U0001F600"`, "\t\nA\u00e9\U0001F600"},
+		{`"host name with spaces"`, "host name with spaces"},
+	} {
+		x := &parserLex{in: test.in}
+		var lval parserSymType
+		if tok := x.Lex(&lval); tok != STRING || lval.str != test.want || x.pos != len(test.in) {
+			t.Errorf("%s: got token %v %q at %d, want %q", test.in, tok, lval.str, x.pos, test.want)
+		}
+	}
+	// Errors point at what's wrong, not wherever the lexer gave up.
+	for _, test := range []struct {
+		query, want string
+	}{
+		{`host "web01`, `unterminated string at character 5 ("host " HERE "\"web01")`},
+		{`host "web\q01"`, `unknown escape "\\q" at character 9 ("host \"web" HERE "\\q01\"")`},
+		{`host "\x4" and tcp`, `escape "\\x" needs 2 hex digits at character 6 ("host \"" HERE "\\x4\" and tcp")`},
+		{`host "\uD800"`, `invalid code point in "\\uD800" at character 6 ("host \"" HERE "\\uD800\"")`},
+		{`host ""`, `empty host name at character 7 ("host \"\"" HERE "")`},
+	} {
+		_, err := parse(test.query)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s: got error %v, want %v", test.query, err, test.want)
+		}
+	}
+	if got := (hostNameQuery{name: "web 01", layer: "inner"}).String(); got != `inner host "web 01"` {
+		t.Errorf("quoted host name printed as %s", got)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	anonIP := func(ip net.IP) net.IP {
+		out := append(net.IP(nil), ip...)
+		out[0] ^= 0xFF
+		return out
+	}
+	anonName := func(name string) string { return "anon-" + fmt.Sprint(len(name)) }
+	for _, test := range []struct {
+		in, want string
+	}{
+		{"host 1.2.3.4 and port 80", "host 254.2.3.4 and port 80"},
+		{"net 10.0.0.0 mask 255.0.0.0 or inner net ::1/64", "net 245.0.0.0 mask 255.0.0.0 or inner net ff00::1/64"},
+		{"ether host aa:bb:cc:dd:ee:ff", "ether host aa:bb:cc:00:00:00"},
+		{"(host web01 or outer host 'web 02') && tcp", `(host "anon-5" or outer host "anon-6") && tcp`},
+		{"udp and after 2015-01-01T13:14:15Z", "udp and after 2015-01-01T13:14:15Z"},
+	} {
+		got, err := Anonymize(test.in, anonIP, anonName)
+		if err != nil || got != test.want {
+			t.Errorf("%q: got %q, %v, want %q", test.in, got, err, test.want)
+		}
+	}
+	got, err := Anonymize("after 3h ago and port 53", anonIP, anonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ts string
+	if _, err := fmt.Sscanf(got, "after %s and port 53", &ts); err != nil {
+		t.Fatalf("relative time not replaced: %q", got)
+	}
+	if at, err := time.Parse(time.RFC3339, ts); err != nil || time.Since(at) < 3*time.Hour-time.Minute || time.Since(at) > 3*time.Hour+time.Minute {
+		t.Errorf("relative time replaced with %q", ts)
+	}
+	if _, err := Anonymize("host 1.2.3", anonIP, anonName); err == nil {
+		t.Errorf("invalid query anonymized")
+	}
+}
+
+func TestTimeZones(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	want := time.Date(2015, 1, 1, 14, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		query string
+		zone  *time.Location
+	}{
+		{"after 2015-01-01T14:00:00Z", ny},
+		{"after 2015-01-01T09:00:00-05:00", time.UTC},
+		{"after 2015-01-01T14:00:00", time.UTC},
+		{"after 2015-01-01T09:00:00", ny},
+		{"after 2015-01-01T09:00:00[America/New_York]", time.UTC},
+		{"after 2015-01-01T09:00:00.000[America/New_York] and port 80", time.UTC},
+	} {
+		q, _, err := parseVolatile(test.query, test.zone)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if start, _ := TimeBounds(q); !start.Equal(want) {
+			t.Errorf("%q in %v: got %v, want %v", test.query, test.zone, start, want)
+		}
+	}
+	for _, test := range []string{
+		"after 2015-01-01T09:00:00[Nowhere/Special]",
+		"after 2015-01-01T09:00:00[America/New_York",
+		"after 2015-01-01T09:00:00Z[America/New_York]",
+	} {
+		if q, err := parse(test); err == nil {
+			t.Errorf("parsed invalid query %q: %v", test, q)
+		}
+	}
+}
+
+// fakeResolver has two addresses for "web01", changing over at 'switched',
+// and records the time range it was asked about.
+type fakeResolver struct {
+	switched   time.Time
+	start, end time.Time
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, name string, start, end time.Time) ([]Assignment, error) {
+	r.start, r.end = start, end
+	if name != "web01" {
+		return nil, nil
+	}
+	return []Assignment{
+		{IP: net.ParseIP("10.0.0.1"), End: r.switched},
+		{IP: net.ParseIP("10.0.0.2"), Start: r.switched},
+	}, nil
+}
+
+func TestHostNames(t *testing.T) {
+	switched := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	r := &fakeResolver{switched: switched}
+	p := &Parser{Resolver: r}
+	for _, test := range []struct {
+		query, want string
+		start, end  time.Time
+	}{
+		{"host web01", "((outer host 10.0.0.1-10.0.0.1 or inner host 10.0.0.1-10.0.0.1) and before 2015-01-01T12:00:00Z) or " +
+			"((outer host 10.0.0.2-10.0.0.2 or inner host 10.0.0.2-10.0.0.2) and after 2015-01-01T12:00:00Z)", time.Time{}, time.Time{}},
+		{"outer host web01 and after 2015-01-01T13:00:00Z", "((outer host 10.0.0.1-10.0.0.1 and before 2015-01-01T12:00:00Z) or " +
+			"(outer host 10.0.0.2-10.0.0.2 and after 2015-01-01T12:00:00Z)) and after 2015-01-01T13:00:00Z", switched.Add(time.Hour), time.Time{}},
+		{"(inner host web01 and before 2015-01-01T11:00:00Z) or before 2015-01-01T10:00:00Z", "", time.Time{}, switched.Add(-time.Hour)},
+	} {
+		q, err := p.Parse(test.query)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		if got := q.String(); test.want != "" && got != "("+test.want+")" {
+			t.Errorf("%q: got %v, want (%v)", test.query, got, test.want)
+		}
+		if !r.start.Equal(test.start) || !r.end.Equal(test.end) {
+			t.Errorf("%q: resolved over %v-%v, want %v-%v", test.query, r.start, r.end, test.start, test.end)
+		}
+	}
+	if _, err := NewQuery("host db01"); err == nil {
+		t.Error("unknown host name resolved")
+	}
+	if q, err := NewQuery("host 1.2.3.4"); err != nil || q.String() != "(outer host 1.2.3.4-1.2.3.4 or inner host 1.2.3.4-1.2.3.4)" {
+		t.Errorf("host address got %v, %v", q, err)
+	}
+}
+
+func TestCompositePromotion(t *testing.T) {
+	indexfile.CompositePorts = map[uint16]bool{443: true}
+	defer func() { indexfile.CompositePorts = map[uint16]bool{} }()
+	for _, test := range []struct{ query, want string }{
+		{"outer host 1.2.3.4 and port 443", "(outer host 1.2.3.4-1.2.3.4 and port 443)"},
+		{"port 443 and tcp and net 10.0.0.0/8", "(ip proto 6 and ((outer host 10.0.0.0-10.255.255.255 and port 443) or (inner host 10.0.0.0-10.255.255.255 and port 443)))"},
+		{"host 1.2.3.4 and port 443", "((outer host 1.2.3.4-1.2.3.4 and port 443) or (inner host 1.2.3.4-1.2.3.4 and port 443))"},
+		{"host 1.2.3.4 and port 80", "((outer host 1.2.3.4-1.2.3.4 or inner host 1.2.3.4-1.2.3.4) and port 80)"},
+		{"inner host 1.2.3.4 and port 443", "(inner host 1.2.3.4-1.2.3.4 and port 443)"},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if got := q.String(); got != test.want {
+			t.Errorf("%q: got %v, want %v", test.query, got, test.want)
+		}
+	}
+}
+
+func TestPlanCache(t *testing.T) {
+	Plans = NewPlanCache(2)
+	defer func() { Plans = nil }()
+	for _, query := range []string{
+		"port 80 and tcp",
+		"  port 80   and tcp ",
+		"host 1.2.3.4",
+		"after 1h ago",
+		"host 1.2.3.4",
+		"port 443",
+	} {
+		if _, err := NewQuery(query); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+	}
+	var cached []string
+	for e := Plans.lru.Front(); e != nil; e = e.Next() {
+		cached = append(cached, e.Value.(*plan).q.String())
+	}
+	// Relative times aren't cached, and the least recently used plan is
+	// evicted.
+	if want := []string{"port 443", "(outer host 1.2.3.4-1.2.3.4 or inner host 1.2.3.4-1.2.3.4)"}; !reflect.DeepEqual(cached, want) {
+		t.Errorf("cached %q, want %q", cached, want)
+	}
+	if q, err := NewQuery("port   443"); err != nil || q.String() != "port 443" {
+		t.Errorf("cached query got %v, %v", q, err)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	w := indexfile.NewWriter()
+	for i := byte(0); i < 4; i++ {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make([]byte, 6), DstMAC: make([]byte, 6), EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 1, i}},
+			&layers.UDP{SrcPort: 1000, DstPort: 53}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddPacket(buf.Bytes(), int64(i)*100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	index := w.Index("1420000000000000")
+	index.SetStarted(base.TimeRange{Start: time.Unix(1420000000, 0), End: time.Unix(1420000000, 0)})
+	host := ipQuery{net.IP{10, 0, 1, 2}, net.IP{10, 0, 1, 2}}
+	subnet := ipQuery{net.IP{10, 0, 0, 0}, net.IP{10, 0, 255, 255}}
+	for _, test := range []struct {
+		q    intersectQuery
+		want string
+	}{
+		{intersectQuery{protocolQuery(17), host}, "(outer host 10.0.1.2-10.0.1.2 and ip proto 17)"},
+		// Every address is in the subnet, twice over.
+		{intersectQuery{subnet, protocolQuery(17)}, "(ip proto 17 and outer host 10.0.0.0-10.0.255.255)"},
+		{intersectQuery{protocolQuery(17), timeQuery{}}, "(" + timeQuery{}.String() + " and ip proto 17)"},
+	} {
+		if got := test.q.plan(index).String(); got != test.want {
+			t.Errorf("%v: planned %v, want %v", test.q, got, test.want)
+		}
+		if got, err := test.q.LookupIn(context.Background(), index); err != nil || got.Len() == 0 {
+			t.Errorf("%v: got %v, %v", test.q, got, err)
+		}
+	}
+	if got := Estimate(host, index); got != 2 { // 8 positions for 5 addresses, rounded up.
+		t.Errorf("estimated %d packets for %v, want 2", got, host)
+	}
+}
+
+func TestCaptureSource(t *testing.T) {
+	index := indexfile.NewWriter().Index("IDX0/1420000000000000")
+	ctx := base.WithCaptureSource(context.Background(), base.CaptureSource{Thread: 1, Directory: "/data/disk3/PKT1"})
+	for _, test := range []struct {
+		query string
+		all   bool
+	}{
+		{"thread 1", true},
+		{"thread 0", false},
+		{"disk /data/disk3", true},
+		{"disk /data/disk3/PKT1/", true},
+		{"disk /data/disk", false},
+		{"disk /data/disk3/PKT1/old", false},
+		{"thread 0 or disk /data", true},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := q.LookupIn(ctx, index)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if got.IsAllPositions() != test.all || (!test.all && got.Len() != 0) {
+			t.Errorf("%q: got %v, want all positions %v", test.query, got, test.all)
+		}
+	}
+	if _, err := threadQuery(1).LookupIn(context.Background(), index); err == nil {
+		t.Error("thread query without a capture source succeeded")
+	}
+}
+
+func TestTimeQueryStarted(t *testing.T) {
+	started := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	index := indexfile.NewWriter().Index("IDX0/s1-20150101T000000.000000Z")
+	index.SetStarted(base.TimeRange{Start: started.Add(-time.Minute), End: started.Add(time.Minute)})
+	for _, test := range []struct {
+		query string
+		all   bool
+	}{
+		{"after 2014-01-01T00:00:00Z", true},
+		{"before 2014-01-01T00:00:00Z", false},
+		{"after 2015-01-02T00:00:00Z and tcp", false},
+		// The file may have been started a minute either side of its name's
+		// time.
+		{"after 2015-01-01T00:01:00Z", true},
+		{"after 2015-01-01T00:01:01Z", false},
+		{"before 2014-12-31T23:59:00Z", true},
+		{"before 2014-12-31T23:58:59Z", false},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := q.LookupIn(context.Background(), index)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+		} else if got.IsAllPositions() != test.all || (!test.all && got.Len() != 0) {
+			t.Errorf("%q: got %v, want all positions %v", test.query, got, test.all)
+		}
+	}
+	if _, err := (timeQuery{started, time.Time{}}).LookupIn(context.Background(), indexfile.NewWriter().Index("IDX0/dhcp")); err == nil {
+		t.Error("time query of a file with no start time succeeded")
+	}
+}
+
+func TestDirectedPortFallback(t *testing.T) {
+	w := indexfile.NewWriter()
+	for i, ports := range [][2]layers.UDPPort{{1000, 53}, {53, 1000}, {1000, 123}} {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make([]byte, 6), DstMAC: make([]byte, 6), EthernetType: layers.EthernetTypeIPv4},
+			&layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}},
+			&layers.UDP{SrcPort: ports[0], DstPort: ports[1]}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddPacket(buf.Bytes(), int64(i)*100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Indexes without port direction keys match either direction, and say so.
+	index := w.Index("IDX0/1420000000000000")
+	warnings := &base.QueryWarnings{}
+	got, err := dstPortQuery(53).LookupIn(base.WithQueryWarnings(context.Background(), warnings), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (base.Positions{0, 100}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got positions %v, want %v", got, want)
+	}
+	got, err = srcIPQuery{net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 2}}.LookupIn(base.WithQueryWarnings(context.Background(), warnings), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (base.Positions{0, 100, 200}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got positions %v, want %v", got, want)
+	}
+	if list := warnings.List(); len(list) != 2 || list[0].File != "PKT0/1420000000000000" {
+		t.Errorf("got warnings %+v, want two for PKT0/1420000000000000", list)
+	}
+}
+
+func TestTCPFlagFallback(t *testing.T) {
+	w := indexfile.NewWriter()
+	for i, l := range []gopacket.SerializableLayer{&layers.TCP{SYN: true}, &layers.UDP{}} {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IP{10, 0, 0, 1}, DstIP: net.IP{10, 0, 0, 2}}
+		if _, ok := l.(*layers.UDP); ok {
+			ip.Protocol = layers.IPProtocolUDP
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make([]byte, 6), DstMAC: make([]byte, 6), EthernetType: layers.EthernetTypeIPv4}, ip, l); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.AddPacket(buf.Bytes(), int64(i)*100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Indexes without TCP flag keys match all TCP packets, and say so.
+	warnings := &base.QueryWarnings{}
+	got, err := tcpFlagQuery(indexfile.TCPFlags["syn"]).LookupIn(base.WithQueryWarnings(context.Background(), warnings), w.Index("IDX0/1420000000000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (base.Positions{0}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got positions %v, want %v", got, want)
+	}
+	if list := warnings.List(); len(list) != 1 {
+		t.Errorf("got warnings %+v, want one", list)
+	}
+}
+
+func TestHTTPResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vals := r.URL.Query()
+		if vals.Get("name") != "web01" || vals.Get("start") != "2015-01-01T00:00:00Z" || vals.Get("end") != "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `[{"IP": "10.0.0.1", "Start": "2015-01-01T12:00:00Z"}]`)
+	}))
+	defer srv.Close()
+	r := &HTTPResolver{URL: srv.URL + "/hosts", Client: srv.Client()}
+	got, err := r.Resolve(context.Background(), "web01", time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].IP.Equal(net.ParseIP("10.0.0.1")) || got[0].Start.Hour() != 12 {
+		t.Errorf("got %+v", got)
+	}
+	if _, err := r.Resolve(context.Background(), "db01", time.Time{}, time.Time{}); err == nil {
+		t.Error("resolved with failing server")
+	}
+}
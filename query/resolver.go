@@ -0,0 +1,199 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Assignment is a period during which a host name had an address.  A zero
+// Start or End leaves that end of the period open.
+type Assignment struct {
+	IP         net.IP
+	Start, End time.Time
+}
+
+// Resolver maps host names to the addresses they had at any point between
+// start and end, either of which may be zero for an open range.
+type Resolver interface {
+	Resolve(ctx context.Context, name string, start, end time.Time) ([]Assignment, error)
+}
+
+// resolveTimeout bounds how long resolving all the names in a query may take.
+const resolveTimeout = 30 * time.Second
+
+// formatBound formats one end of a time range for a resolver plugin, as
+// RFC3339 or "" if it's open.
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func decodeAssignments(data []byte) (out []Assignment, _ error) {
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("invalid resolver response: %v", err)
+	}
+	for _, a := range out {
+		if a.IP == nil {
+			return nil, fmt.Errorf("invalid resolver response: assignment with no IP")
+		}
+	}
+	return out, nil
+}
+
+// HTTPResolver resolves names with a GET of its URL, with the name, start, and
+// end as query parameters.  The response is a JSON list of Assignments.
+type HTTPResolver struct {
+	URL    string
+	Client *http.Client
+}
+
+// Resolve implements Resolver.
+func (r *HTTPResolver) Resolve(ctx context.Context, name string, start, end time.Time) ([]Assignment, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	vals := u.Query()
+	vals.Set("name", name)
+	vals.Set("start", formatBound(start))
+	vals.Set("end", formatBound(end))
+	u.RawQuery = vals.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver returned %v: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return decodeAssignments(data)
+}
+
+// ExecResolver resolves names by running its command with the name, start,
+// and end as arguments.  The command writes a JSON list of Assignments to
+// stdout.
+type ExecResolver struct {
+	Command string
+}
+
+// Resolve implements Resolver.
+func (r *ExecResolver) Resolve(ctx context.Context, name string, start, end time.Time) ([]Assignment, error) {
+	cmd := exec.CommandContext(ctx, r.Command, name, formatBound(start), formatBound(end))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("resolver %q failed: %v: %s", r.Command, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return decodeAssignments(data)
+}
+
+// TimeBounds returns the time range a query can match, with zero times for
+// open ends.
+func TimeBounds(q Query) (start, end time.Time) {
+	switch q := q.(type) {
+	case timeQuery:
+		return q[0], q[1]
+	case exceptQuery:
+		return TimeBounds(q.q)
+	case intersectQuery:
+		for _, sub := range q {
+			s, e := TimeBounds(sub)
+			if !s.IsZero() && s.After(start) {
+				start = s
+			}
+			if !e.IsZero() && (end.IsZero() || e.Before(end)) {
+				end = e
+			}
+		}
+	case unionQuery:
+		for i, sub := range q {
+			s, e := TimeBounds(sub)
+			if i == 0 || s.IsZero() || (!start.IsZero() && s.Before(start)) {
+				start = s
+			}
+			if i == 0 || e.IsZero() || (!end.IsZero() && e.After(end)) {
+				end = e
+			}
+		}
+	}
+	return start, end
+}
+
+// resolveHostNames replaces each host name in a query with the addresses it
+// had over the query's time range, each restricted to the time it was
+// assigned.
+func resolveHostNames(q Query, resolver Resolver) (Query, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	r := &nameResolver{ctx: ctx, resolver: resolver}
+	r.start, r.end = TimeBounds(q)
+	return r.resolve(q)
+}
+
+type nameResolver struct {
+	ctx        context.Context
+	resolver   Resolver
+	start, end time.Time
+}
+
+func (r *nameResolver) resolve(q Query) (Query, error) {
+	switch q := q.(type) {
+	case hostNameQuery:
+		return q.resolve(r.ctx, r.resolver, r.start, r.end)
+	case intersectQuery:
+		subs, err := r.resolveAll(q)
+		return intersectQuery(subs), err
+	case unionQuery:
+		subs, err := r.resolveAll(q)
+		return unionQuery(subs), err
+	case exceptQuery:
+		sub, err := r.resolve(q.q)
+		return exceptQuery{sub, q.set}, err
+	}
+	return q, nil
+}
+
+func (r *nameResolver) resolveAll(qs []Query) ([]Query, error) {
+	out := make([]Query, len(qs))
+	for i, q := range qs {
+		var err error
+		if out[i], err = r.resolve(q); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/indexfile"
+	"golang.org/x/net/context"
+)
+
+const (
+	// SetTTL is how long a saved set is kept.
+	SetTTL = 24 * time.Hour
+	// MaxSetPositions bounds the packet positions held by all saved sets, so
+	// sets can't use up the server's memory.
+	MaxSetPositions = 50000000
+)
+
+// FilePositions are the positions of packets in each blockfile, keyed by the
+// name of the file's index.
+type FilePositions map[string]base.Positions
+
+// SetInfo describes a saved set.
+type SetInfo struct {
+	ID      string
+	Query   string
+	Created time.Time
+	Expires time.Time
+	Packets int64 // Packets matched, not counting files matched as a whole.
+	Files   int
+}
+
+type savedSet struct {
+	SetInfo
+	positions FilePositions
+	size      int64 // Positions held, counting whole files as one.
+}
+
+// SetStore holds the results of queries, so later queries can be limited to
+// (or exclude) packets an earlier one matched, with "in set:<id>".
+type SetStore struct {
+	now func() time.Time
+	max int64 // Positions all sets may hold.
+
+	mu    sync.Mutex
+	sets  map[string]*savedSet
+	total int64
+}
+
+// NewSetStore returns an empty SetStore.
+func NewSetStore() *SetStore {
+	return &SetStore{now: time.Now, max: MaxSetPositions, sets: map[string]*savedSet{}}
+}
+
+// Sets holds the sets "in set:<id>" queries refer to.
+var Sets = NewSetStore()
+
+// expire forgets sets past their TTL.
+//
+// This method should only be called once the s.mu has been acquired!
+func (s *SetStore) expire() {
+	now := s.now()
+	for id, set := range s.sets {
+		if !now.Before(set.Expires) {
+			s.total -= set.size
+			delete(s.sets, id)
+		}
+	}
+}
+
+// Save stores the positions a query matched, returning the new set's
+// description.  It fails if saving them would exceed MaxSetPositions.
+func (s *SetStore) Save(query string, positions FilePositions) (SetInfo, error) {
+	set := &savedSet{positions: FilePositions{}}
+	for name, pos := range positions {
+		if pos.Len() == 0 {
+			continue
+		}
+		set.positions[name] = pos
+		set.Files++
+		if pos.IsAllPositions() {
+			set.size++
+		} else {
+			set.Packets += int64(len(pos))
+			set.size += int64(len(pos))
+		}
+	}
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return SetInfo{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	if s.total+set.size > s.max {
+		return SetInfo{}, fmt.Errorf("saving %d positions would exceed the limit of %d held by all sets", set.size, s.max)
+	}
+	set.ID = hex.EncodeToString(id[:])
+	set.Query = query
+	set.Created = s.now()
+	set.Expires = set.Created.Add(SetTTL)
+	s.sets[set.ID] = set
+	s.total += set.size
+	return set.SetInfo, nil
+}
+
+// get returns the set with the given ID, or nil if there isn't one.
+func (s *SetStore) get(id string) *savedSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	return s.sets[id]
+}
+
+// List describes all saved sets, oldest first.
+func (s *SetStore) List() []SetInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	out := []SetInfo{}
+	for _, set := range s.sets {
+		out = append(out, set.SetInfo)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out
+}
+
+// Delete removes a set, returning whether it existed.
+func (s *SetStore) Delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, ok := s.sets[id]
+	if ok {
+		s.total -= set.size
+		delete(s.sets, id)
+	}
+	return ok
+}
+
+// validSetID reports whether c may appear in a set ID.
+func validSetID(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_'
+}
+
+// setQuery matches the packets in a saved set.  It holds the set's positions
+// itself, so deleting the set doesn't affect queries already parsed.
+type setQuery struct {
+	id        string
+	positions FilePositions
+}
+
+func (q setQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	if pos, ok := q.positions[index.Name()]; ok {
+		return pos, nil
+	}
+	return base.NoPositions, nil
+}
+func (q setQuery) String() string { return "in set:" + q.id }
+func (q setQuery) base() bool     { return true }
+
+// exceptQuery matches the packets its query does which aren't in a saved set.
+// Its query must not match whole files (see matchesWholeFiles), since the set
+// may hold only some of their packets.
+type exceptQuery struct {
+	q   Query
+	set setQuery
+}
+
+func (q exceptQuery) LookupIn(ctx context.Context, index *indexfile.IndexFile) (bp base.Positions, err error) {
+	defer log(q, index, &bp, &err)()
+	pos, err := q.q.LookupIn(ctx, index)
+	if err != nil || pos.Len() == 0 {
+		return pos, err
+	}
+	excluded, _ := q.set.LookupIn(ctx, index)
+	if pos.IsAllPositions() && !excluded.IsAllPositions() {
+		return nil, fmt.Errorf("cannot exclude %v from all packets of %q", q.set, index.Name())
+	}
+	return pos.Difference(excluded), nil
+}
+func (q exceptQuery) String() string { return fmt.Sprintf("(%v and not %v)", q.q, q.set) }
+func (q exceptQuery) base() bool     { return false }
+
+// matchesWholeFiles returns whether a query may match all packets in a file
+// without listing them, which only time, thread, and disk queries (or saved
+// sets of them) do.
+func matchesWholeFiles(q Query) bool {
+	switch q := q.(type) {
+	case timeQuery, threadQuery, diskQuery:
+		return true
+	case setQuery:
+		for _, pos := range q.positions {
+			if pos.IsAllPositions() {
+				return true
+			}
+		}
+	case intersectQuery:
+		for _, sub := range q {
+			if !matchesWholeFiles(sub) {
+				return false
+			}
+		}
+		return true
+	case unionQuery:
+		for _, sub := range q {
+			if matchesWholeFiles(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
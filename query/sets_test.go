@@ -0,0 +1,121 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/indexfile"
+	"golang.org/x/net/context"
+)
+
+func TestSets(t *testing.T) {
+	a, err := Sets.Save("port 53", FilePositions{"IDX0/1": {1, 2, 3, 4}, "IDX0/2": {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Sets.Delete(a.ID)
+	if a.Packets != 4 || a.Files != 1 {
+		t.Errorf("saved %d packets in %d files, want 4 in 1", a.Packets, a.Files)
+	}
+	b, err := Sets.Save("host 1.2.3.4", FilePositions{"IDX0/1": {2, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Sets.Delete(b.ID)
+	idx1 := indexfile.NewWriter().Index("IDX0/1")
+	idx2 := indexfile.NewWriter().Index("IDX0/2")
+	for _, test := range []struct {
+		query      string
+		idx        *indexfile.IndexFile
+		want       base.Positions
+		wantString string
+	}{
+		{"in set:" + a.ID, idx1, base.Positions{1, 2, 3, 4}, "in set:" + a.ID},
+		{"in set:" + a.ID, idx2, base.NoPositions, ""},
+		{"in set:" + a.ID + " and in set:" + b.ID, idx1, base.Positions{2, 4}, ""},
+		{"in set:" + a.ID + " and not in set:" + b.ID, idx1, base.Positions{1, 3}, fmt.Sprintf("(in set:%v and not in set:%v)", a.ID, b.ID)},
+		{"port 80 and in set:" + a.ID, idx1, base.NoPositions, fmt.Sprintf("(in set:%v and port 80)", a.ID)},
+	} {
+		q, err := NewQuery(test.query)
+		if err != nil {
+			t.Errorf("%q: %v", test.query, err)
+			continue
+		}
+		got, err := q.LookupIn(context.Background(), test.idx)
+		if err != nil {
+			t.Errorf("%q in %v: %v", test.query, test.idx.Name(), err)
+		} else if len(got) != len(test.want) || len(got) > 0 && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q in %v: got %v, want %v", test.query, test.idx.Name(), got, test.want)
+		}
+		if test.wantString != "" && q.String() != test.wantString {
+			t.Errorf("%q: got string %q, want %q", test.query, q, test.wantString)
+		}
+	}
+	for _, test := range []string{
+		"in set:",
+		"in set:nosuchset",
+		"not in set:" + b.ID,
+		"after 3h ago and not in set:" + b.ID,
+		"(port 80 or before 1h ago) and not in set:" + b.ID,
+	} {
+		if q, err := NewQuery(test); err == nil {
+			t.Errorf("parsed invalid query %q: %v", test, q)
+		}
+	}
+	// Deleting a set doesn't affect queries already parsed.
+	q, err := NewQuery("in set:" + b.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Sets.Delete(b.ID) || Sets.Delete(b.ID) {
+		t.Error("set not deleted exactly once")
+	}
+	if got, _ := q.LookupIn(context.Background(), idx1); !reflect.DeepEqual(got, base.Positions{2, 4}) {
+		t.Errorf("query of deleted set got %v", got)
+	}
+}
+
+func TestSetStoreLimits(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewSetStore()
+	s.now = func() time.Time { return now }
+	s.max = 10
+	first, err := s.Save("after 1h ago", FilePositions{"IDX0/1": base.AllPositions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Packets != 0 || first.Files != 1 {
+		t.Errorf("saved %d packets in %d files, want 0 in 1", first.Packets, first.Files)
+	}
+	now = now.Add(time.Hour)
+	if _, err := s.Save("port 53", FilePositions{"IDX0/1": make(base.Positions, 10)}); err == nil {
+		t.Error("saved set over the position limit")
+	}
+	if got := s.List(); len(got) != 1 || got[0].ID != first.ID {
+		t.Errorf("got sets %v, want just %v", got, first.ID)
+	}
+	now = first.Expires
+	if got := s.List(); len(got) != 0 {
+		t.Errorf("got sets %v after expiry", got)
+	}
+	if _, err := s.Save("port 53", FilePositions{"IDX0/1": make(base.Positions, 10)}); err != nil {
+		t.Errorf("expired set still counted against limit: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package quota enforces per-client limits on how many queries may be run
+// each minute and how many bytes of results may be returned each day, so one
+// misbehaving automation account can't starve everyone else.
+package quota
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/config"
+)
+
+// Headers quota status is returned in.
+const (
+	QueriesLimitHeader     = "Steno-Quota-Queries-Limit"
+	QueriesRemainingHeader = "Steno-Quota-Queries-Remaining"
+	BytesLimitHeader       = "Steno-Quota-Bytes-Limit"
+	BytesRemainingHeader   = "Steno-Quota-Bytes-Remaining"
+	BytesResetHeader       = "Steno-Quota-Bytes-Reset"
+)
+
+// Status is a client's quota at some point in time.  Limits of zero are
+// unlimited, in which case the matching remaining count is meaningless.
+type Status struct {
+	QueriesLimit, QueriesRemaining int
+	BytesLimit, BytesRemaining     int64
+	BytesReset                     time.Time // When BytesRemaining resets.
+}
+
+// SetHeaders reports the status in response headers, skipping unlimited
+// quotas.
+func (s Status) SetHeaders(h http.Header) {
+	if s.QueriesLimit > 0 {
+		h.Set(QueriesLimitHeader, strconv.Itoa(s.QueriesLimit))
+		h.Set(QueriesRemainingHeader, strconv.Itoa(s.QueriesRemaining))
+	}
+	if s.BytesLimit > 0 {
+		h.Set(BytesLimitHeader, strconv.FormatInt(s.BytesLimit, 10))
+		h.Set(BytesRemainingHeader, strconv.FormatInt(s.BytesRemaining, 10))
+		h.Set(BytesResetHeader, s.BytesReset.UTC().Format(time.RFC3339))
+	}
+}
+
+// ExceededError is returned when a client is out of quota.
+type ExceededError struct {
+	Client     string
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("client %q exceeded %s, retry in %v", e.Client, e.Reason, e.RetryAfter)
+}
+
+// usage is what a single client has used so far.
+type usage struct {
+	queries []time.Time // Start times of queries in the last minute.
+	day     time.Time   // Start of the day 'bytes' counts.
+	bytes   int64
+}
+
+// Limiter tracks each client's usage against its limits.
+type Limiter struct {
+	conf config.RateLimitConfig
+	now  func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*usage
+}
+
+// New returns a Limiter enforcing the given limits.
+func New(conf config.RateLimitConfig) *Limiter {
+	return &Limiter{conf: conf, now: time.Now, clients: map[string]*usage{}}
+}
+
+func (l *Limiter) limits(client string) config.RateLimit {
+	if lim, ok := l.conf.Clients[client]; ok {
+		return lim
+	}
+	return l.conf.Default
+}
+
+// usage returns the client's usage as of 'now', forgetting anything which no
+// longer counts against its limits.
+//
+// This method should only be called once the l.mu has been acquired!
+func (l *Limiter) usage(client string, now time.Time) *usage {
+	u := l.clients[client]
+	if u == nil {
+		u = &usage{}
+		l.clients[client] = u
+	}
+	i := 0
+	for i < len(u.queries) && !u.queries[i].After(now.Add(-time.Minute)) {
+		i++
+	}
+	u.queries = u.queries[i:]
+	if day := startOfDay(now); !day.Equal(u.day) {
+		u.day, u.bytes = day, 0
+	}
+	return u
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// status returns the client's current quota status.
+//
+// This method should only be called once the l.mu has been acquired!
+func (l *Limiter) status(client string, now time.Time) Status {
+	lim := l.limits(client)
+	u := l.usage(client, now)
+	s := Status{
+		QueriesLimit: lim.QueriesPerMinute,
+		BytesLimit:   lim.BytesPerDay,
+		BytesReset:   u.day.Add(24 * time.Hour),
+	}
+	if s.QueriesRemaining = lim.QueriesPerMinute - len(u.queries); s.QueriesRemaining < 0 {
+		s.QueriesRemaining = 0
+	}
+	if s.BytesRemaining = lim.BytesPerDay - u.bytes; s.BytesRemaining < 0 {
+		s.BytesRemaining = 0
+	}
+	return s
+}
+
+// Status returns the client's current quota status.
+func (l *Limiter) Status(client string) Status {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.status(client, l.now())
+}
+
+// Start records that a client is starting a query, returning its quota status
+// afterwards, or an *ExceededError if it's out of quota.
+func (l *Limiter) Start(client string) (Status, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	s := l.status(client, now)
+	u := l.clients[client]
+	if s.QueriesLimit > 0 && s.QueriesRemaining == 0 {
+		return s, &ExceededError{
+			Client:     client,
+			Reason:     fmt.Sprintf("%d queries per minute", s.QueriesLimit),
+			RetryAfter: u.queries[0].Add(time.Minute).Sub(now),
+		}
+	}
+	if s.BytesLimit > 0 && s.BytesRemaining == 0 {
+		return s, &ExceededError{
+			Client:     client,
+			Reason:     fmt.Sprintf("%d bytes per day", s.BytesLimit),
+			RetryAfter: s.BytesReset.Sub(now),
+		}
+	}
+	u.queries = append(u.queries, now)
+	if s.QueriesLimit > 0 {
+		s.QueriesRemaining--
+	}
+	return s, nil
+}
+
+// Charge counts bytes returned to a client against its daily quota.
+func (l *Limiter) Charge(client string, bytes int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.usage(client, l.now()).bytes += bytes
+}
@@ -0,0 +1,105 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package quota
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mars-suite/stenographer/config"
+)
+
+func testLimiter(now *time.Time) *Limiter {
+	l := New(config.RateLimitConfig{
+		Default: config.RateLimit{QueriesPerMinute: 2, BytesPerDay: 1000},
+		Clients: map[string]config.RateLimit{
+			"analyst": {},
+		},
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestQueriesPerMinute(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := testLimiter(&now)
+	for i := 0; i < 2; i++ {
+		s, err := l.Start("robot")
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if want := 1 - i; s.QueriesRemaining != want {
+			t.Errorf("query %d: %d queries remaining, want %d", i, s.QueriesRemaining, want)
+		}
+		now = now.Add(10 * time.Second)
+	}
+	_, err := l.Start("robot")
+	if e, ok := err.(*ExceededError); !ok {
+		t.Fatalf("third query in a minute got %v", err)
+	} else if e.RetryAfter != 40*time.Second {
+		t.Errorf("retry after %v, want 40s", e.RetryAfter)
+	}
+	// Other clients aren't affected, and some are unlimited.
+	if _, err := l.Start("other-robot"); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := l.Start("analyst"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(41 * time.Second)
+	if _, err := l.Start("robot"); err != nil {
+		t.Errorf("query after first expired: %v", err)
+	}
+}
+
+func TestBytesPerDay(t *testing.T) {
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	l := testLimiter(&now)
+	l.Charge("robot", 600)
+	if s := l.Status("robot"); s.BytesRemaining != 400 {
+		t.Errorf("%d bytes remaining, want 400", s.BytesRemaining)
+	}
+	l.Charge("robot", 600)
+	now = now.Add(time.Minute)
+	if _, err := l.Start("robot"); err == nil {
+		t.Error("query allowed over byte quota")
+	} else if e := err.(*ExceededError); e.RetryAfter != 59*time.Minute {
+		t.Errorf("retry after %v, want 59m", e.RetryAfter)
+	}
+	now = now.Add(time.Hour)
+	s, err := l.Start("robot")
+	if err != nil {
+		t.Fatalf("query on the next day: %v", err)
+	}
+	if s.BytesRemaining != 1000 {
+		t.Errorf("%d bytes remaining on the next day, want 1000", s.BytesRemaining)
+	}
+	h := http.Header{}
+	s.SetHeaders(h)
+	if got := h.Get(BytesResetHeader); got != "2026-01-03T00:00:00Z" {
+		t.Errorf("bytes reset at %q", got)
+	}
+	if got := h.Get(QueriesRemainingHeader); got != "1" {
+		t.Errorf("%q queries remaining", got)
+	}
+	h = http.Header{}
+	l.Status("analyst").SetHeaders(h)
+	if len(h) != 0 {
+		t.Errorf("unlimited client got quota headers %v", h)
+	}
+}
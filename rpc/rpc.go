@@ -32,8 +32,8 @@ import (
         "google.golang.org/grpc"
         "google.golang.org/grpc/credentials"
 
-        "github.com/google/stenographer/config"
-        pb "github.com/google/stenographer/protobuf"
+        "github.com/mars-suite/stenographer/config"
+        pb "github.com/mars-suite/stenographer/protobuf"
 )
 
 
@@ -128,7 +128,7 @@ func (s *stenographerServer) RetrievePcap(
 
 // Called from main via goroutine, this function opens the gRPC port, loads
 // certificates, and runs the gRPC server.
-func RunStenorpc(rpcCfg *config.RpcConfig) {
+func RunStenorpc(rpcCfg *config.RpcConfig, tlsPolicy *config.TLSConfig) {
         log.Print("Starting stenorpc")
         listener, err := net.Listen("tcp", fmt.Sprintf(":%d", rpcCfg.ServerPort))
         if err != nil {
@@ -160,6 +160,10 @@ func RunStenorpc(rpcCfg *config.RpcConfig) {
                 Certificates: []tls.Certificate{cert},
                 ClientCAs:    pool,
         }
+        if err := tlsPolicy.Apply(tlsCfg); err != nil {
+                log.Printf("Rpc: Invalid TLS policy: %v", err)
+                return
+        }
 
         tlsCreds := grpc.Creds(credentials.NewTLS(tlsCfg))
         grpcServer := grpc.NewServer(tlsCreds)
@@ -0,0 +1,607 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary stenoctl controls a running stenographer server through its
+// authenticated API, using the same client certificate as stenocurl.
+//
+// Usage:
+//
+//	stenoctl [flags] <command> [args...]
+//
+// Run with no command for a list of commands.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/mars-suite/stenographer/audit"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/certs"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/labels"
+	"github.com/mars-suite/stenographer/workload"
+)
+
+var configFilename = flag.String("config", defaultConfig(), "Stenographer config file, defaulting to $STENOGRAPHER_CONFIG")
+
+func defaultConfig() string {
+	if c := os.Getenv("STENOGRAPHER_CONFIG"); c != "" {
+		return c
+	}
+	return "/etc/stenographer/config"
+}
+
+const usage = `Usage: stenoctl [flags] <command> [args...]
+
+Commands:
+  status                     Show server version, uptime, and per-thread files
+  queries                    List running queries
+  cancel <query id>          Cancel a running query
+  reload-certs               Reload the server certificate from disk
+  hold <name> <file>         Place a blockfile under legal hold
+  hold <name> <start> <end>  Place a time range (RFC3339) under legal hold
+  holds                      List legal holds
+  release <hold id>          Remove a legal hold
+  verify                     Verify all indexes, quarantining bad files
+  tier <start> <end> [evict] Export a time range (RFC3339) now, and with
+                             "evict", delete it locally once exported
+  verbosity [level]          Show or set the server's verbose logging level
+  verbosity <module> [level] Show or set one module's level ("reset" clears it)
+  read <query>               Write a query's packets to stdout as PCAP, resuming
+                             where it left off if the connection breaks
+  read-many <dir> <query>... Run queries concurrently over one connection, like
+                             read, writing each to <dir>/<n>.pcap
+  estimate <query>           Estimate how many packets and bytes a query returns
+  seen <host>                Show when a host was first and last seen
+  save-set <query>           Save a query's packets as a set for "in set:<id>"
+  sets                       List saved sets
+  delete-set <set id>        Remove a saved set
+  verify-audit <log> <key>   Check an audit log against its PEM public key
+                             (runs locally, without contacting the server)
+  replay <workload> [old]    Run a recorded workload's queries, writing each
+                             one's packet count and time to stdout, and
+                             reporting differences from an old replay's output
+
+Flags:
+`
+
+// client sends requests to a stenographer server.
+type client struct {
+	http *http.Client
+	base string
+}
+
+func newClient(conf *config.Config) (*client, error) {
+	host := conf.Host
+	if host == "" {
+		host = "localhost"
+	}
+	tlsConfig, err := certs.ClientTLSConfig(
+		filepath.Join(conf.CertPath, "ca_cert.pem"),
+		filepath.Join(conf.CertPath, "client_cert.pem"),
+		filepath.Join(conf.CertPath, "client_key.pem"),
+		host)
+	if err != nil {
+		return nil, err
+	}
+	if conf.TLS != nil && conf.TLS.MinVersion != "" {
+		// Match the server's minimum, so we never offer anything it would refuse.
+		if err := (&config.TLSConfig{MinVersion: conf.TLS.MinVersion}).Apply(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+	return &client{
+		// With HTTP/2, concurrent requests share one connection.
+		http: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}},
+		base: fmt.Sprintf("https://%s:%d", host, conf.Port),
+	}, nil
+}
+
+// do sends a request to the given path, returning the response body if the
+// server succeeded.
+func (c *client) do(method, path string, body interface{}) ([]byte, error) {
+	var in io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		in = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.base+path, in)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// printJSON pretty-prints a JSON response.
+func printJSON(data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return fmt.Errorf("invalid JSON response: %v", err)
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(os.Stdout)
+	return err
+}
+
+func run(c *client, cmd string, args []string) error {
+	nargs := map[string][]int{
+		"status":       {0},
+		"queries":      {0},
+		"cancel":       {1},
+		"reload-certs": {0},
+		"hold":         {2, 3},
+		"holds":        {0},
+		"release":      {1},
+		"verify":       {0},
+		"tier":         {2, 3},
+		"verbosity":    {0, 1, 2},
+		"read":         {1},
+		"read-many":    {2, 1 + maxReadMany},
+		"estimate":     {1},
+		"seen":         {1},
+		"save-set":     {1},
+		"sets":         {0},
+		"delete-set":   {1},
+		"replay":       {1, 2},
+	}
+	want, ok := nargs[cmd]
+	if !ok {
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	if len(args) < want[0] || len(args) > want[len(want)-1] {
+		return fmt.Errorf("wrong number of arguments for %q", cmd)
+	}
+	switch cmd {
+	case "status":
+		out, err := c.do("GET", "/status", nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "queries":
+		out, err := c.do("GET", "/queries", nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "cancel":
+		_, err := c.do("DELETE", "/queries?id="+url.QueryEscape(args[0]), nil)
+		return err
+	case "reload-certs":
+		_, err := c.do("POST", "/reload", nil)
+		return err
+	case "hold":
+		l := labels.Label{Name: args[0], Hold: true}
+		if len(args) == 2 {
+			l.File = args[1]
+		} else {
+			var err error
+			if l.Start, err = time.Parse(time.RFC3339, args[1]); err != nil {
+				return fmt.Errorf("invalid start: %v", err)
+			}
+			if l.End, err = time.Parse(time.RFC3339, args[2]); err != nil {
+				return fmt.Errorf("invalid end: %v", err)
+			}
+		}
+		out, err := c.do("POST", "/labels", l)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "holds":
+		out, err := c.do("GET", "/labels", nil)
+		if err != nil {
+			return err
+		}
+		var all, holds []labels.Label
+		if err := json.Unmarshal(out, &all); err != nil {
+			return fmt.Errorf("invalid labels response: %v", err)
+		}
+		for _, l := range all {
+			if l.Hold {
+				holds = append(holds, l)
+			}
+		}
+		if out, err = json.Marshal(holds); err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "release":
+		_, err := c.do("DELETE", "/labels?id="+url.QueryEscape(args[0]), nil)
+		return err
+	case "verify":
+		out, err := c.do("POST", "/verify", nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "tier":
+		vals := url.Values{}
+		for i, param := range []string{"start", "end"} {
+			if _, err := time.Parse(time.RFC3339, args[i]); err != nil {
+				return fmt.Errorf("invalid %s: %v", param, err)
+			}
+			vals.Set(param, args[i])
+		}
+		if len(args) == 3 {
+			if args[2] != "evict" {
+				return fmt.Errorf("invalid argument %q, want \"evict\"", args[2])
+			}
+			vals.Set("evict", "true")
+		}
+		out, err := c.do("POST", "/tier?"+vals.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "verbosity":
+		method, path := "GET", "/debug/verbosity"
+		if len(args) > 0 {
+			if _, err := strconv.Atoi(args[0]); err == nil {
+				if len(args) == 2 {
+					return fmt.Errorf("invalid module %q", args[0])
+				}
+				method, path = "POST", path+"?level="+url.QueryEscape(args[0])
+			} else {
+				path += "?module=" + url.QueryEscape(args[0])
+				if len(args) == 2 && args[1] == "reset" {
+					method = "DELETE"
+				} else if len(args) == 2 {
+					method, path = "POST", path+"&level="+url.QueryEscape(args[1])
+				}
+			}
+		}
+		out, err := c.do(method, path, nil)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(out)
+		return err
+	case "read":
+		return c.read(args[0], os.Stdout)
+	case "read-many":
+		return c.readMany(args[0], args[1:])
+	case "estimate":
+		out, err := c.do("GET", "/estimate?q="+url.QueryEscape(args[0]), nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "seen":
+		out, err := c.do("GET", "/seen?host="+url.QueryEscape(args[0]), nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "save-set":
+		out, err := c.do("POST", "/sets?q="+url.QueryEscape(args[0]), nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "sets":
+		out, err := c.do("GET", "/sets", nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	case "delete-set":
+		_, err := c.do("DELETE", "/sets?id="+url.QueryEscape(args[0]), nil)
+		return err
+	case "replay":
+		return c.replay(args[0], args[1:])
+	}
+	return nil
+}
+
+// replay runs each query of a workload in turn, writing its results to stdout
+// as it goes.  If an old replay's output is given, it's compared with this
+// one, failing if any query's results changed.
+func (c *client) replay(path string, old []string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	entries, err := workload.ReadEntries(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("invalid workload: %v", err)
+	}
+	var results []workload.Result
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		r := c.replayOne(e.Query)
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+		results = append(results, r)
+	}
+	if len(old) == 0 {
+		return nil
+	}
+	f, err = os.Open(old[0])
+	if err != nil {
+		return err
+	}
+	baseline, err := workload.ReadResults(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("invalid old replay: %v", err)
+	}
+	changed := 0
+	for _, d := range workload.Compare(baseline, results) {
+		fmt.Fprintln(os.Stderr, d)
+		if d.Changed || d.Unmatched {
+			changed++
+		}
+	}
+	if changed > 0 {
+		return fmt.Errorf("%d of %d queries changed results", changed, len(results))
+	}
+	return nil
+}
+
+// replayOne runs a query, counting the packets it returns.
+func (c *client) replayOne(query string) workload.Result {
+	r := workload.Result{Query: query}
+	start := time.Now()
+	err := func() error {
+		resp, err := c.http.Post(c.base+"/query", "text/plain", strings.NewReader(query))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		in, err := pcapgo.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		for {
+			if _, _, err := in.ReadPacketData(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			r.Packets++
+		}
+		if msg := resp.Trailer.Get("Steno-Query-Error"); msg != "" {
+			return fmt.Errorf("query failed: %s", msg)
+		}
+		return nil
+	}()
+	r.Duration = time.Since(start)
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+const (
+	// maxReadRetries is how many times in a row read retries a query without
+	// receiving any more packets before giving up.
+	maxReadRetries = 5
+	// readRetryDelay is how long read waits before its first retry, doubling
+	// for each retry after that.
+	readRetryDelay = time.Second
+	// maxReadMany is how many queries read-many runs at once.
+	maxReadMany = 100
+)
+
+// errQueryFailed marks failures reported by the server, which retrying won't
+// fix.
+type errQueryFailed struct{ error }
+
+// read streams a query's packets to out as PCAP.  If the connection breaks
+// mid-stream, it resumes the query just after the last packet received, so
+// large extractions survive network blips without duplicating packets.
+func (c *client) read(query string, out io.Writer) error {
+	r := &resumableRead{out: out}
+	retries := 0
+	for {
+		received, err := c.readOnce(query, r)
+		if err == nil {
+			return nil
+		} else if _, ok := err.(errQueryFailed); ok {
+			return err
+		}
+		if received > 0 {
+			retries = 0
+		}
+		if retries++; retries > maxReadRetries {
+			return fmt.Errorf("giving up after %d retries: %v", maxReadRetries, err)
+		}
+		delay := readRetryDelay << uint(retries-1)
+		fmt.Fprintf(os.Stderr, "Query interrupted (%v), resuming in %v\n", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// readMany runs queries concurrently, as read, writing the n'th query's
+// packets to <dir>/<n>.pcap.  Over HTTP/2, they share a single connection.
+func (c *client) readMany(dir string, queries []string) error {
+	errs := make([]error, len(queries))
+	var wg sync.WaitGroup
+	for i, query := range queries {
+		wg.Add(1)
+		go func(i int, query string) {
+			defer wg.Done()
+			f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%d.pcap", i+1)))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if errs[i] = c.read(query, f); errs[i] == nil {
+				errs[i] = f.Close()
+			} else {
+				f.Close()
+			}
+		}(i, query)
+	}
+	wg.Wait()
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Query %d (%q) failed: %v\n", i+1, queries[i], err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d queries failed", failed, len(queries))
+	}
+	return nil
+}
+
+// resumableRead is the state of a read, carried across retries.
+type resumableRead struct {
+	out    io.Writer
+	w      *pcapgo.Writer // Created once we know the link type.
+	cursor base.Cursor    // Has Skip > 0 once any packet has been received.
+}
+
+// readOnce runs a query once, resuming from r's cursor if any packets have
+// been received, and copies its packets to r's output.  It returns how many
+// packets it copied.
+func (c *client) readOnce(query string, r *resumableRead) (received int, _ error) {
+	path := "/query"
+	if r.cursor.Skip > 0 {
+		path += "?" + url.Values{
+			"resume_time": {r.cursor.Time.UTC().Format(time.RFC3339Nano)},
+			"resume_skip": {strconv.Itoa(r.cursor.Skip)},
+		}.Encode()
+	}
+	resp, err := c.http.Post(c.base+path, "text/plain", strings.NewReader(query))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return 0, errQueryFailed{fmt.Errorf("POST %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))}
+	}
+	in, err := pcapgo.NewReader(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	if r.w == nil {
+		r.w = pcapgo.NewWriter(r.out)
+		if err := r.w.WriteFileHeader(in.Snaplen(), in.LinkType()); err != nil {
+			return 0, errQueryFailed{err}
+		}
+	}
+	for {
+		data, ci, err := in.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return received, err
+		}
+		if err := r.w.WritePacket(ci, data); err != nil {
+			return received, errQueryFailed{err}
+		}
+		r.cursor.Advance(ci.Timestamp)
+		received++
+	}
+	// Trailers are only available once the body has been read.
+	if msg := resp.Trailer.Get("Steno-Query-Error"); msg != "" {
+		return received, errQueryFailed{fmt.Errorf("query failed: %s", msg)}
+	}
+	return received, nil
+}
+
+// verifyAudit checks every entry of an audit log file.
+func verifyAudit(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for %q", "verify-audit")
+	}
+	pub, err := audit.LoadPublicKey(args[1])
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := audit.Verify(f, pub)
+	if err != nil {
+		return fmt.Errorf("%d entries verified, then: %v", n, err)
+	}
+	fmt.Printf("%d entries verified\n", n)
+	return nil
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if flag.Arg(0) == "verify-audit" {
+		if err := verifyAudit(flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	conf, err := config.ReadConfigFile(*configFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	c, err := newClient(conf)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := run(c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
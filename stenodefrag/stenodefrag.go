@@ -0,0 +1,140 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary stenodefrag rewrites blockfiles offline, packing their packets into
+// as few blocks as possible and rebuilding their indexes to match.  stenotype
+// flushes partially filled blocks when traffic is low, so on quiet links much
+// of each blockfile can be unused padding.
+//
+// Usage:
+//
+//	stenodefrag [flags] /path/to/PKT0/<file> ...
+//
+// Each file's index is expected at the usual IDX path.  stenographer must not
+// be running while files are rewritten, since it holds open handles to and
+// positions within the originals.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/thread"
+)
+
+var (
+	dryRun     = flag.Bool("dry_run", false, "Only report what would be saved, leaving files alone")
+	minSavings = flag.Int("min_savings_pct", 10, "Only replace files which shrink by at least this percentage")
+
+	v = base.V // verbose logging
+)
+
+func hidden(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+}
+
+// defrag compacts a single blockfile and its index, returning the old and new
+// sizes of the blockfile.  With --dry_run, the new size is the size the
+// blockfile would have had.
+func defrag(fc *filecache.Cache, pktPath string) (before, after int64, _ error) {
+	blk, err := blockfile.NewBlockFile(pktPath, fc, blockfile.DefaultOptions())
+	if err != nil {
+		return 0, 0, err
+	}
+	defer blk.Close()
+	idxPath := indexfile.IndexPathFromBlockfilePath(pktPath)
+	newPkt, newIdx := hidden(pktPath), hidden(idxPath)
+	// Clean up temporary files unless they've been moved into place.
+	defer os.Remove(newPkt)
+	defer os.Remove(newIdx)
+	before = blk.Size()
+	if after, err = blk.Compact(newPkt, newIdx); err != nil {
+		return 0, 0, err
+	}
+	if *dryRun {
+		return before, after, nil
+	} else if (before-after)*100 < before*int64(*minSavings) {
+		v(1, "Not replacing %q, only %d -> %d bytes", pktPath, before, after)
+		return before, before, nil
+	}
+	// stenographer uses a blockfile's modification time as the time of its
+	// last packet, so keep it.
+	if mod := blk.ModTime(); os.Chtimes(newPkt, mod, mod) != nil {
+		v(1, "Could not preserve modification time of %q", pktPath)
+	}
+	// Keep stenographer from opening the new blockfile with the old index, or
+	// vice versa, or the new ones with stale derived indexes.
+	unlock, err := indexfile.LockIndex(idxPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer unlock()
+	if err := os.Rename(newPkt, pktPath); err != nil {
+		return 0, 0, fmt.Errorf("could not move blockfile into place: %v", err)
+	}
+	if err := os.Rename(newIdx, idxPath); err != nil {
+		return 0, 0, fmt.Errorf("could not move index into place: %v", err)
+	}
+	// Packets have moved, so any flow, composite, app, or QUIC index is stale.
+	// They're rebuilt when next needed.
+	for _, path := range append(indexfile.CompositeFiles(idxPath), indexfile.FlowPath(idxPath), indexfile.AppPath(idxPath), indexfile.QUICPath(idxPath)) {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove stale derived index %q for %q: %v", path, pktPath, err)
+		}
+	}
+	// The blockfile's size has changed, so the manifest stenographer starts
+	// from is stale too.
+	if err := os.Remove(thread.ManifestPath(filepath.Dir(idxPath))); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove stale manifest for %q: %v", pktPath, err)
+	}
+	return before, after, nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("no blockfiles given")
+	}
+	fc := filecache.NewCache(10)
+	var total, saved int64
+	failed := false
+	for _, path := range flag.Args() {
+		before, after, err := defrag(fc, path)
+		if err != nil {
+			log.Printf("Could not defragment %q: %v", path, err)
+			failed = true
+			continue
+		}
+		log.Printf("%q: %d -> %d bytes", path, before, after)
+		total += before
+		saved += before - after
+	}
+	if total > 0 {
+		verb := "Saved"
+		if *dryRun {
+			verb = "Would save"
+		}
+		log.Printf("%s %d of %d bytes (%.1f%%)", verb, saved, total, float64(saved)*100/float64(total))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
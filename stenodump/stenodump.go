@@ -0,0 +1,165 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary stenodump extracts packets from blockfiles copied off a sensor,
+// without a running stenographer, for offline and air-gapped forensics.  It's
+// pure Go, so runs on Windows and macOS as well as Linux.
+//
+// Usage:
+//
+//	stenodump [--query='host 1.2.3.4 and port 443'] [flags] <blockfile> ... > out.pcap
+//
+// Each blockfile's index is read from --index_dir (under the blockfile's name)
+// if that's set, or from the usual IDX path if the blockfile is still in a PKT
+// directory beside it.  Blockfiles with no index are indexed in memory, which
+// takes a full read of each.  Without a query, all packets are extracted.
+// Packets from several blockfiles are merged in time order.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
+)
+
+var (
+	queryString = flag.String("query", "", "Query for the packets to extract, or all packets if empty")
+	format      = flag.String("format", "pcap", "Output format: pcap, pcapng, or text")
+	output      = flag.String("output", "", "File to write packets to, rather than stdout")
+	indexDir    = flag.String("index_dir", "", "Directory holding the blockfiles' indexes, if they're not at the usual IDX paths")
+	maxPackets  = flag.Int64("max_packets", 0, "Stop after this many packets, if nonzero")
+	maxBytes    = flag.Int64("max_bytes", 0, "Stop after this many bytes of packets, if nonzero")
+
+	v = base.V // verbose logging
+)
+
+// indexPath returns where the index of the given blockfile is, or "" if it
+// has none to be found.
+func indexPath(pktPath string) string {
+	path := indexfile.IndexPathFromBlockfilePath(pktPath)
+	if *indexDir != "" {
+		path = filepath.Join(*indexDir, filepath.Base(pktPath))
+	}
+	if _, err := os.Stat(path); path == pktPath || err != nil {
+		return ""
+	}
+	return path
+}
+
+// open opens each blockfile, with its index.
+func open(fc *filecache.Cache, paths []string) ([]*blockfile.BlockFile, error) {
+	var files []*blockfile.BlockFile
+	for _, path := range paths {
+		idx := indexPath(path)
+		if idx == "" {
+			log.Printf("No index for %q, indexing it in memory", path)
+		}
+		bf, err := blockfile.OpenBlockFile(path, idx, fc, blockfile.DefaultOptions())
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, bf)
+	}
+	return files, nil
+}
+
+func write(packets *base.PacketChan, out io.Writer) error {
+	limit := base.Limit{Packets: *maxPackets, Bytes: *maxBytes}
+	switch *format {
+	case "pcap":
+		return base.PacketsToFile(packets, out, limit)
+	case "pcapng":
+		return base.PacketsToPcapng(packets, out, limit, base.Provenance{Query: *queryString, Version: base.Version})
+	case "text":
+		return base.PacketsToText(packets, out, limit)
+	}
+	return fmt.Errorf("unknown format %q", *format)
+}
+
+func run(paths []string) error {
+	var q query.Query
+	if *queryString != "" {
+		var err error
+		if q, err = query.NewQuery(*queryString); err != nil {
+			return fmt.Errorf("invalid query %q: %v", *queryString, err)
+		}
+	}
+	switch *format {
+	case "pcap", "pcapng", "text":
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	files, err := open(filecache.NewCache(len(paths)+1), paths)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var inputs []*base.PacketChan
+	for _, f := range files {
+		if q == nil {
+			inputs = append(inputs, f.AllPackets(ctx))
+			continue
+		}
+		packets := base.NewPacketChan(100)
+		go f.Lookup(ctx, q, packets)
+		inputs = append(inputs, packets)
+	}
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	packets := base.MergePacketChans(ctx, inputs)
+	if err := write(packets, out); err != nil {
+		return err
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("no blockfiles given")
+	}
+	if err := run(flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+	v(1, "Extracted packets from %d blockfiles", flag.NArg())
+}
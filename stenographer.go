@@ -12,6 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+//go:build !windows
+
 // Binary stenographer reads packets from the given filename based on a set of
 // IPs and spits them out via STDOUT as pcap data, which should be able to be
 // piped into tcpdump.
@@ -19,6 +21,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"log/syslog"
@@ -26,12 +29,10 @@ import (
 	"os"
 	"runtime"
 
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/config"
-	"github.com/google/stenographer/env"
-        "github.com/google/stenographer/rpc"
-
-	_ "net/http/pprof" // server debugging info in /debug/pprof/*
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/env"
+        "github.com/mars-suite/stenographer/rpc"
 )
 
 var (
@@ -43,6 +44,9 @@ var (
 	logToSyslog = flag.Bool(
 		"syslog", true, "If true, log to syslog.  Otherwise, log to stderr")
 
+	checkConfig = flag.Bool(
+		"check_config", false, "If true, check the configuration file and exit, rather than running")
+
 	// Verbose logging.
 	v = base.V
 )
@@ -54,6 +58,19 @@ const (
 func main() {
 	flag.Parse()
 
+	if *checkConfig {
+		conf, err := config.ReadConfigFile(*configFilename)
+		if err == nil {
+			err = conf.Validate()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("configuration %q OK\n", *configFilename)
+		return
+	}
+
 	stenotypeOutput := io.Writer(os.Stderr)
 
 	// Set up syslog logging
@@ -66,8 +83,8 @@ func main() {
 		stenotypeOutput = logwriter // for stenotype
 	}
 
+	base.HandleVerbositySignals()
 	runtime.GOMAXPROCS(runtime.NumCPU() * 2)
-	runtime.SetBlockProfileRate(1000)
 
 	conf, err := config.ReadConfigFile(*configFilename)
 	if err != nil {
@@ -84,7 +101,7 @@ func main() {
 
 	go env.RunStenotype()
         if conf.Rpc != nil {
-                go rpc.RunStenorpc(conf.Rpc)
+                go rpc.RunStenorpc(conf.Rpc, conf.TLS)
         }
 
 	env.ExportDebugHandlers(http.DefaultServeMux)
@@ -0,0 +1,122 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Binary stenoreindex backfills key types into existing indexes offline,
+// reading each blockfile's packets and adding their keys to its index, so
+// queries on key types enabled after capture (like VLANs or MAC addresses)
+// work on historical data too.
+//
+// Usage:
+//
+//	stenoreindex --key_types=vlan,mpls,mac /path/to/PKT0/<file> ...
+//
+// Each file's index is expected at the usual IDX path.  stenographer must not
+// be running while indexes are rewritten, since it holds open handles to the
+// originals.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+	"golang.org/x/net/context"
+)
+
+var (
+	keyTypes = flag.String("key_types", "vlan,mpls", "Comma-separated key types to backfill: vlan, mpls, mac, port_direction, host_direction, tcpflags")
+	dryRun   = flag.Bool("dry_run", false, "Only report how many positions would be added, leaving indexes alone")
+
+	v = base.V // verbose logging
+)
+
+func hidden(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+}
+
+// reindex backfills the index of a single blockfile, returning how many
+// positions were added.  With --dry_run, that's how many would have been.
+func reindex(fc *filecache.Cache, pktPath string, types []byte) (int, error) {
+	blk, err := blockfile.NewBlockFile(pktPath, fc, blockfile.DefaultOptions())
+	if err != nil {
+		return 0, err
+	}
+	defer blk.Close()
+	idxPath := indexfile.IndexPathFromBlockfilePath(pktPath)
+	newIdx := hidden(idxPath)
+	// Clean up the temporary index unless it's been moved into place.
+	defer os.Remove(newIdx)
+	added, err := blk.Backfill(context.Background(), newIdx, types)
+	if err != nil {
+		return 0, err
+	}
+	if *dryRun {
+		return added, nil
+	} else if added == 0 {
+		v(1, "Not replacing index of %q, nothing to add", pktPath)
+		return 0, nil
+	}
+	unlock, err := indexfile.LockIndex(idxPath)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	if err := os.Rename(newIdx, idxPath); err != nil {
+		return 0, fmt.Errorf("could not move index into place: %v", err)
+	}
+	// Any memory-mapped copy of the old index is stale.  It's rebuilt when
+	// next needed.
+	if err := os.Remove(indexfile.MmapPath(idxPath)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove stale mmap index for %q: %v", pktPath, err)
+	}
+	return added, nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		log.Fatal("no blockfiles given")
+	}
+	types, err := indexfile.ParseKeyTypes(*keyTypes)
+	if err != nil {
+		log.Fatalf("invalid --key_types: %v", err)
+	}
+	fc := filecache.NewCache(10)
+	total := 0
+	failed := false
+	for _, path := range flag.Args() {
+		added, err := reindex(fc, path, types)
+		if err != nil {
+			log.Printf("Could not reindex %q: %v", path, err)
+			failed = true
+			continue
+		}
+		log.Printf("%q: %d positions added", path, added)
+		total += added
+	}
+	verb := "Added"
+	if *dryRun {
+		verb = "Would add"
+	}
+	log.Printf("%s %d positions to %d indexes", verb, total, flag.NArg())
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package stenotest generates synthetic blockfiles and matching indexes, in
+// the same TPACKET_V3 block format stenotype writes, so the read and query
+// paths can be tested end to end without a live capture.
+//
+// A Mix describes the traffic to generate:  a set of flows, whose packets are
+// interleaved pseudo-randomly, plus any number of malformed packets of each
+// Malformed kind.  Every generated Packet records the flow it belongs to and,
+// once written, its position in the blockfile, so tests can work out which
+// packets a query should return without trusting the indexer.
+package stenotest
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/indexfile"
+)
+
+// Flow describes a conversation to generate packets for.  Packets alternate
+// direction, starting from Src.
+type Flow struct {
+	// Protocol is TCP, UDP, or ICMPv4 (which is sent as ICMPv6 between IPv6
+	// addresses).
+	Protocol         layers.IPProtocol
+	Src, Dst         net.IP // Both IPv4 or both IPv6.
+	SrcPort, DstPort uint16 // Ignored for ICMP.
+	VLAN             uint16 // If nonzero, packets are 802.1Q tagged with it.
+	Packets          int
+	Payload          int // Bytes of payload in each packet.
+}
+
+func (f *Flow) String() string {
+	return fmt.Sprintf("%v %v:%d -> %v:%d", f.Protocol, f.Src, f.SrcPort, f.Dst, f.DstPort)
+}
+
+// Malformed is a kind of malformed or unusual packet which captures contain,
+// and which readers and indexers have to cope with.
+type Malformed int
+
+const (
+	// Truncated packets are those of a flow captured with fewer bytes than
+	// were on the wire, as with a small snaplen.  Their headers are intact, so
+	// they still belong to their flow.
+	Truncated Malformed = iota
+	// Runt frames are too short to hold an Ethernet header.
+	Runt
+	// BadIPHeader packets claim to be IPv4 but have an invalid header length.
+	BadIPHeader
+	// UnknownEtherType packets have an EtherType nothing decodes.
+	UnknownEtherType
+	// Empty packets have no captured bytes at all.
+	Empty
+)
+
+// MalformedKinds lists every kind of Malformed packet.
+var MalformedKinds = []Malformed{Truncated, Runt, BadIPHeader, UnknownEtherType, Empty}
+
+func (m Malformed) String() string {
+	switch m {
+	case Truncated:
+		return "truncated"
+	case Runt:
+		return "runt"
+	case BadIPHeader:
+		return "bad IP header"
+	case UnknownEtherType:
+		return "unknown EtherType"
+	case Empty:
+		return "empty"
+	}
+	return fmt.Sprintf("malformed(%d)", int(m))
+}
+
+// Mix describes the traffic in a synthetic blockfile.
+type Mix struct {
+	Flows []*Flow
+	// Malformed is how many packets of each kind to add, at random places
+	// among the flows' packets.  Truncated packets are taken from random
+	// flows, so there must be some.
+	Malformed map[Malformed]int
+	Start     time.Time     // Timestamp of the first packet.
+	Gap       time.Duration // Between consecutive packets' timestamps.
+	Seed      int64         // Seeds the interleaving of flows.
+}
+
+// Packet is a generated packet.
+type Packet struct {
+	gopacket.CaptureInfo
+	Data      []byte
+	Flow      *Flow     // nil for malformed packets not belonging to a flow.
+	Reply     bool      // Whether it was sent from the flow's Dst to its Src.
+	Malformed Malformed // Only meaningful if IsMalformed.
+	// IsMalformed is set for packets of any Malformed kind.
+	IsMalformed bool
+	// Position is where the packet was written in its blockfile, once it has
+	// been.
+	Position int64
+}
+
+// RandomFlows returns n flows between random addresses in 10.0.0.0/8 and
+// fd00::/8, with a random mix of protocols, ports, VLAN tags, and sizes.
+func RandomFlows(r *rand.Rand, n int) []*Flow {
+	protos := []layers.IPProtocol{layers.IPProtocolTCP, layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolICMPv4}
+	flows := make([]*Flow, n)
+	for i := range flows {
+		f := &Flow{
+			Protocol: protos[r.Intn(len(protos))],
+			SrcPort:  uint16(1024 + r.Intn(64512)),
+			DstPort:  []uint16{22, 53, 80, 443, 8080}[r.Intn(5)],
+			Packets:  1 + r.Intn(50),
+			Payload:  r.Intn(1400),
+		}
+		if r.Intn(4) == 0 {
+			f.Src, f.Dst = make(net.IP, 16), make(net.IP, 16)
+			f.Src[0], f.Dst[0] = 0xfd, 0xfd
+			r.Read(f.Src[8:])
+			r.Read(f.Dst[8:])
+		} else {
+			f.Src, f.Dst = net.IP{10, 0, 0, 0}, net.IP{10, 0, 0, 0}
+			r.Read(f.Src[1:])
+			r.Read(f.Dst[1:])
+		}
+		if r.Intn(8) == 0 {
+			f.VLAN = uint16(1 + r.Intn(4094))
+		}
+		flows[i] = f
+	}
+	return flows
+}
+
+// Packets generates the packets of the mix, in the order they'd be captured.
+func (m *Mix) Packets() ([]*Packet, error) {
+	r := rand.New(rand.NewSource(m.Seed))
+	var next []*Flow // One entry per packet still to generate.
+	for _, f := range m.Flows {
+		for i := 0; i < f.Packets; i++ {
+			next = append(next, f)
+		}
+	}
+	r.Shuffle(len(next), func(i, j int) { next[i], next[j] = next[j], next[i] })
+	sent := map[*Flow]int{}
+	var packets []*Packet
+	for _, f := range next {
+		data, err := f.packet(sent[f])
+		if err != nil {
+			return nil, fmt.Errorf("flow %v: %v", f, err)
+		}
+		packets = append(packets, &Packet{Data: data, Flow: f, Reply: sent[f]%2 == 1})
+		sent[f]++
+	}
+	for _, kind := range MalformedKinds {
+		for i := 0; i < m.Malformed[kind]; i++ {
+			p, err := m.malformed(r, kind)
+			if err != nil {
+				return nil, err
+			}
+			at := r.Intn(len(packets) + 1)
+			packets = append(packets, nil)
+			copy(packets[at+1:], packets[at:])
+			packets[at] = p
+		}
+	}
+	for i, p := range packets {
+		p.Timestamp = m.Start.Add(time.Duration(i) * m.Gap)
+		p.CaptureLength = len(p.Data)
+		if p.Length < p.CaptureLength {
+			p.Length = p.CaptureLength
+		}
+	}
+	return packets, nil
+}
+
+// packet serializes the i'th packet of the flow.
+func (f *Flow) packet(i int) ([]byte, error) {
+	src, dst, sport, dport := f.Src, f.Dst, f.SrcPort, f.DstPort
+	if i%2 == 1 {
+		src, dst, sport, dport = dst, src, dport, sport
+	}
+	eth := &layers.Ethernet{SrcMAC: mac(src), DstMAC: mac(dst)}
+	ls := []gopacket.SerializableLayer{eth}
+	etherType := &eth.EthernetType
+	if f.VLAN != 0 {
+		eth.EthernetType = layers.EthernetTypeDot1Q
+		tag := &layers.Dot1Q{VLANIdentifier: f.VLAN}
+		ls = append(ls, tag)
+		etherType = &tag.Type
+	}
+	var network gopacket.NetworkLayer
+	proto := f.Protocol
+	if v4 := src.To4(); v4 != nil {
+		*etherType = layers.EthernetTypeIPv4
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: v4, DstIP: dst.To4()}
+		network = ip
+		ls = append(ls, ip)
+	} else {
+		if proto == layers.IPProtocolICMPv4 {
+			proto = layers.IPProtocolICMPv6
+		}
+		*etherType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: src.To16(), DstIP: dst.To16()}
+		network = ip
+		ls = append(ls, ip)
+	}
+	switch proto {
+	case layers.IPProtocolTCP:
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), Seq: uint32(i), ACK: i > 0, SYN: i == 0, PSH: i > 0, Window: 65535}
+		tcp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, tcp)
+	case layers.IPProtocolUDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}
+		udp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, udp)
+	case layers.IPProtocolICMPv4:
+		typ := uint8(layers.ICMPv4TypeEchoRequest)
+		if i%2 == 1 {
+			typ = layers.ICMPv4TypeEchoReply
+		}
+		ls = append(ls, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(typ, 0), Seq: uint16(i / 2)})
+	case layers.IPProtocolICMPv6:
+		typ := uint8(layers.ICMPv6TypeEchoRequest)
+		if i%2 == 1 {
+			typ = layers.ICMPv6TypeEchoReply
+		}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, 0)}
+		icmp.SetNetworkLayerForChecksum(network)
+		ls = append(ls, icmp)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %v", f.Protocol)
+	}
+	payload := make([]byte, f.Payload)
+	for j := range payload {
+		payload[j] = byte(i + j)
+	}
+	ls = append(ls, gopacket.Payload(payload))
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// mac returns a locally administered MAC address derived from an IP.
+func mac(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x02, 0, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// malformed generates a packet of the given kind.
+func (m *Mix) malformed(r *rand.Rand, kind Malformed) (*Packet, error) {
+	p := &Packet{Malformed: kind, IsMalformed: true}
+	switch kind {
+	case Truncated:
+		if len(m.Flows) == 0 {
+			return nil, fmt.Errorf("truncated packets need a flow to come from")
+		}
+		f := m.Flows[r.Intn(len(m.Flows))]
+		data, err := f.packet(0)
+		if err != nil {
+			return nil, fmt.Errorf("flow %v: %v", f, err)
+		}
+		// Keep the headers, but lose the end of the payload.
+		p.Flow, p.Length, p.Data = f, len(data), data[:len(data)-f.Payload/2]
+	case Runt:
+		p.Data = make([]byte, 1+r.Intn(13))
+		r.Read(p.Data)
+	case BadIPHeader:
+		p.Data = make([]byte, 14+20+r.Intn(64))
+		r.Read(p.Data)
+		p.Data[12], p.Data[13] = 0x08, 0x00 // IPv4
+		p.Data[14] = 0x42                   // Version 4, IHL 2.
+	case UnknownEtherType:
+		p.Data = make([]byte, 60+r.Intn(1000))
+		r.Read(p.Data)
+		p.Data[12], p.Data[13] = 0x88, 0xb5 // Local experimental.
+	case Empty:
+		p.Data = []byte{}
+	default:
+		return nil, fmt.Errorf("unknown malformed packet kind %v", kind)
+	}
+	return p, nil
+}
+
+// Write writes the packets to a blockfile at pktPath and an index of it at
+// idxPath, setting each packet's Position.  Both files are written hidden and
+// renamed into place once complete, as stenotype does.
+func Write(pktPath, idxPath string, packets []*Packet) error {
+	hidden := func(path string) string {
+		return filepath.Join(filepath.Dir(path), "."+filepath.Base(path))
+	}
+	f, err := os.Create(hidden(pktPath))
+	if err != nil {
+		return fmt.Errorf("could not create blockfile: %v", err)
+	}
+	defer os.Remove(hidden(pktPath)) // no-op once renamed into place
+	bw := blockfile.NewWriter(f)
+	idx := indexfile.NewWriter()
+	for _, p := range packets {
+		pos, err := bw.WritePacket(p.CaptureInfo, p.Data)
+		if err == nil {
+			err = idx.AddPacket(p.Data, pos)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		p.Position = pos
+	}
+	if err := bw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close blockfile: %v", err)
+	}
+	defer os.Remove(hidden(idxPath))
+	if err := idx.WriteFile(hidden(idxPath)); err != nil {
+		return err
+	}
+	if err := os.Rename(hidden(pktPath), pktPath); err != nil {
+		return fmt.Errorf("could not move blockfile into place: %v", err)
+	}
+	if err := os.Rename(hidden(idxPath), idxPath); err != nil {
+		return fmt.Errorf("could not move index into place: %v", err)
+	}
+	return nil
+}
+
+// WriteMix generates the mix's packets and writes them with Write.
+func WriteMix(pktPath, idxPath string, m *Mix) ([]*Packet, error) {
+	packets, err := m.Packets()
+	if err != nil {
+		return nil, err
+	}
+	return packets, Write(pktPath, idxPath, packets)
+}
+
+// Positions returns the positions of the packets 'match' returns true for, as
+// a lookup for them should.
+func Positions(packets []*Packet, match func(*Packet) bool) base.Positions {
+	var pos base.Positions
+	for _, p := range packets {
+		if match(p) {
+			pos = append(pos, p.Position)
+		}
+	}
+	return pos
+}
+
+// Of returns a matcher for Positions of the packets of any of the given flows.
+func Of(flows ...*Flow) func(*Packet) bool {
+	return func(p *Packet) bool {
+		for _, f := range flows {
+			if p.Flow == f {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stenotest
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/context"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/query"
+	"github.com/mars-suite/stenographer/thread"
+)
+
+var ctx = context.Background()
+
+func testMix(seed int64) *Mix {
+	flows := RandomFlows(rand.New(rand.NewSource(seed)), 40)
+	// Enough large packets to spill over several blocks.
+	flows = append(flows, &Flow{
+		Protocol: layers.IPProtocolTCP,
+		Src:      net.IP{192, 168, 1, 1},
+		Dst:      net.IP{192, 168, 1, 2},
+		SrcPort:  40000,
+		DstPort:  443,
+		VLAN:     100,
+		Packets:  2000,
+		Payload:  1400,
+	})
+	malformed := map[Malformed]int{}
+	for _, kind := range MalformedKinds {
+		malformed[kind] = 5
+	}
+	return &Mix{
+		Flows:     flows,
+		Malformed: malformed,
+		Start:     time.Unix(1420000000, 0),
+		Gap:       time.Millisecond,
+		Seed:      seed,
+	}
+}
+
+func tempDirs(t *testing.T) (dir, pktDir, idxDir string) {
+	dir, err := ioutil.TempDir("", "stenotest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pktDir, idxDir = filepath.Join(dir, "PKT0"), filepath.Join(dir, "IDX0")
+	for _, d := range []string{pktDir, idxDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, pktDir, idxDir
+}
+
+func hasIP(ip net.IP) func(*Packet) bool {
+	return func(p *Packet) bool {
+		return p.Flow != nil && (p.Flow.Src.Equal(ip) || p.Flow.Dst.Equal(ip))
+	}
+}
+
+func hasPort(port uint16) func(*Packet) bool {
+	return func(p *Packet) bool {
+		f := p.Flow
+		return f != nil && (f.Protocol == layers.IPProtocolTCP || f.Protocol == layers.IPProtocolUDP) && (f.SrcPort == port || f.DstPort == port)
+	}
+}
+
+func TestBlockFile(t *testing.T) {
+	dir, pktDir, idxDir := tempDirs(t)
+	defer os.RemoveAll(dir)
+	m := testMix(1)
+	pktPath, idxPath := filepath.Join(pktDir, "1420000000000000"), filepath.Join(idxDir, "1420000000000000")
+	packets, err := WriteMix(pktPath, idxPath, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blk, err := blockfile.NewBlockFile(pktPath, filecache.NewCache(10), blockfile.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blk.Close()
+	if blk.Size() < 3*blockfile.BlockSize {
+		t.Errorf("blockfile only %d bytes", blk.Size())
+	}
+
+	// Every packet reads back intact, malformed or not.
+	i := 0
+	all := blk.AllPackets(ctx)
+	for p := range all.Receive() {
+		if i >= len(packets) {
+			t.Fatalf("more packets read than the %d written", len(packets))
+		}
+		want := packets[i]
+		if !bytes.Equal(p.Data, want.Data) || !p.Timestamp.Equal(want.Timestamp) || p.Length != want.Length || p.CaptureLength != want.CaptureLength {
+			t.Errorf("packet %d (malformed %v) differs: got %d/%d bytes at %v, want %d/%d at %v",
+				i, want.IsMalformed, p.CaptureLength, p.Length, p.Timestamp, want.CaptureLength, want.Length, want.Timestamp)
+		}
+		i++
+	}
+	if err := all.Err(); err != nil {
+		t.Fatal(err)
+	} else if i != len(packets) {
+		t.Errorf("read %d packets, wrote %d", i, len(packets))
+	}
+
+	big := m.Flows[len(m.Flows)-1]
+	v4, v6 := m.Flows[0], m.Flows[0]
+	for _, f := range m.Flows {
+		if f.Src.To4() == nil {
+			v6 = f
+		} else {
+			v4 = f
+		}
+	}
+	isProto := func(proto layers.IPProtocol) func(*Packet) bool {
+		// ICMP flows between IPv6 addresses are ICMPv6.
+		return func(p *Packet) bool {
+			return p.Flow != nil && p.Flow.Protocol == proto && (proto != layers.IPProtocolICMPv4 || p.Flow.Src.To4() != nil)
+		}
+	}
+	for _, test := range []struct {
+		query string
+		want  func(*Packet) bool
+	}{
+		{"host " + v4.Src.String(), hasIP(v4.Src)},
+		{"host " + v6.Dst.String(), hasIP(v6.Dst)},
+		{"port 443", hasPort(443)},
+		{"port 53 or port 22", func(p *Packet) bool { return hasPort(53)(p) || hasPort(22)(p) }},
+		{"vlan 100", Of(big)},
+		{"tcp and host 192.168.1.2 and port 40000", Of(big)},
+		{"udp", isProto(layers.IPProtocolUDP)},
+		{"icmp", isProto(layers.IPProtocolICMPv4)},
+		{"net 10.0.0.0/8 and port 80", func(p *Packet) bool { return hasPort(80)(p) && p.Flow.Src.To4() != nil }},
+	} {
+		q, err := query.NewQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := blk.Positions(ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := Positions(packets, test.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("query %q: got %d positions, want %d", test.query, len(got), len(want))
+		}
+	}
+}
+
+func TestThreadLookup(t *testing.T) {
+	dir, pktDir, idxDir := tempDirs(t)
+	defer os.RemoveAll(dir)
+	var want [][]byte
+	for i, name := range []string{"1420000000000000", "1420000100000000"} {
+		m := testMix(int64(i))
+		m.Start = m.Start.Add(time.Duration(i) * 100 * time.Second)
+		packets, err := WriteMix(filepath.Join(pktDir, name), filepath.Join(idxDir, name), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range packets {
+			if hasPort(443)(p) {
+				want = append(want, p.Data)
+			}
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "base"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	threads, err := thread.Threads([]config.ThreadConfig{{
+		PacketsDirectory:   pktDir,
+		IndexDirectory:     idxDir,
+		DiskFreePercentage: 1,
+		MaxDirectoryFiles:  10,
+	}}, filepath.Join(dir, "base"), filecache.NewCache(10), blockfile.Options{}, &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	threads[0].SyncFiles()
+	q, err := query.NewQuery("port 443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lookupCtx := range []context.Context{ctx, base.WithArrivalOrder(ctx)} {
+		packets := threads[0].Lookup(lookupCtx, q)
+		var got [][]byte
+		for p := range packets.Receive() {
+			got = append(got, append([]byte{}, p.Data...))
+			p.Release()
+		}
+		if err := packets.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got %d packets, want %d", len(got), len(want))
+		}
+		if base.ArrivalOrder(lookupCtx) {
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Fatalf("packet %d differs", i)
+			}
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux && cgo
+
+// Binary stenotype-lite is a pure-Go replacement for stenotype, for low-rate
+// deployments where building and running the C++ binary isn't worth the
+// trouble.  It reads packets with AF_PACKET (TPACKET_V3) and writes the same
+// blockfile and index format stenotype does, so stenographer can run it by
+// pointing StenotypePath at it.  It's much slower than stenotype, and only
+// indexes the outermost IP and transport headers of each packet.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/indexfile"
+	"golang.org/x/net/bpf"
+)
+
+var (
+	dir        = flag.String("dir", "", "Directory to write packets/indexes to")
+	iface      = flag.String("iface", "eth0", "Interface to read packets from")
+	threads    = flag.Int("threads", 1, "Number of capture threads (fanout group members)")
+	fileAge    = flag.Int("fileage_sec", 60, "Max age of a file before rotating")
+	fileSize   = flag.Int("filesize_mb", 4<<10, "Max size of a file before rotating")
+	blocks     = flag.Int("blocks", 64, "Number of 1MB AF_PACKET ring blocks per thread")
+	fanoutID   = flag.Int("fanout_id", 0, "AF_PACKET fanout ID, defaults to our PID")
+	filter     = flag.String("filter", "", "Hex-encoded compiled BPF filter, see compile_bpf.sh")
+	noIndex    = flag.Bool("no_index", false, "Don't write indexes")
+	statsEvery = flag.Duration("stats_every", time.Minute, "How often to log capture stats")
+	templates  = flag.String("filename_templates", "", "Comma-separated file name templates, one per thread, as stenotype takes them")
+
+	v = base.V // verbose logging
+)
+
+// parseFilter decodes a BPF filter in the hex format generated by
+// compile_bpf.sh, which stenotype's --filter flag also takes.
+func parseFilter(s string) ([]bpf.RawInstruction, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data)%8 != 0 {
+		return nil, fmt.Errorf("invalid filter %q", s)
+	}
+	var out []bpf.RawInstruction
+	for ; len(data) > 0; data = data[8:] {
+		out = append(out, bpf.RawInstruction{
+			Op: uint16(data[0])<<8 | uint16(data[1]),
+			Jt: data[2],
+			Jf: data[3],
+			K:  uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7]),
+		})
+	}
+	return out, nil
+}
+
+// output writes packets for a single thread to a rotating set of blockfiles
+// and indexes, named by the time they were started.  Files are written
+// hidden, then renamed into place once complete.
+type output struct {
+	pktDir, idxDir string
+	names          *base.FileNames
+	name           string
+	started        time.Time
+	f              *os.File
+	bw             *blockfile.Writer
+	idx            *indexfile.Writer
+}
+
+func (o *output) open() error {
+	now := time.Now()
+	if !now.After(o.started) {
+		// Times must increase, since stenographer sorts files by their names' times.
+		now = o.started.Add(time.Microsecond)
+	}
+	o.started = now
+	o.name = o.names.Name(now, 0)
+	f, err := os.Create(filepath.Join(o.pktDir, "."+o.name))
+	if err != nil {
+		return fmt.Errorf("could not create blockfile: %v", err)
+	}
+	o.f = f
+	o.bw = blockfile.NewWriter(f)
+	if !*noIndex {
+		o.idx = indexfile.NewWriter()
+	}
+	return nil
+}
+
+func (o *output) write(data []byte, ci gopacket.CaptureInfo) error {
+	pos, err := o.bw.WritePacket(ci, data)
+	if err != nil {
+		return err
+	}
+	if o.idx != nil {
+		return o.idx.AddPacket(data, pos)
+	}
+	return nil
+}
+
+func (o *output) close() error {
+	if err := o.bw.Close(); err != nil {
+		o.f.Close()
+		return err
+	}
+	if err := o.f.Close(); err != nil {
+		return fmt.Errorf("could not close blockfile: %v", err)
+	}
+	if err := os.Rename(filepath.Join(o.pktDir, "."+o.name), filepath.Join(o.pktDir, o.name)); err != nil {
+		return fmt.Errorf("could not move blockfile into place: %v", err)
+	}
+	if o.idx == nil {
+		return nil
+	}
+	hidden := filepath.Join(o.idxDir, "."+o.name)
+	if err := o.idx.WriteFile(hidden); err != nil {
+		return err
+	}
+	v(1, "Wrote index %q for %d packets", o.name, o.idx.Packets())
+	if err := os.Rename(hidden, filepath.Join(o.idxDir, o.name)); err != nil {
+		return fmt.Errorf("could not move index into place: %v", err)
+	}
+	if err := o.idx.WriteStats(filepath.Join(o.idxDir, o.name)); err != nil {
+		log.Printf("Could not write stats for index %q: %v", o.name, err)
+	}
+	return nil
+}
+
+func (o *output) rotate() error {
+	if err := o.close(); err != nil {
+		return err
+	}
+	return o.open()
+}
+
+func newTPacket(fanout uint16, prog []bpf.RawInstruction) (*afpacket.TPacket, error) {
+	tp, err := afpacket.NewTPacket(
+		afpacket.OptInterface(*iface),
+		afpacket.TPacketVersion3,
+		afpacket.OptBlockSize(blockfile.BlockSize),
+		afpacket.OptNumBlocks(*blocks),
+		afpacket.OptPollTimeout(time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("could not open AF_PACKET socket on %q: %v", *iface, err)
+	}
+	if prog != nil {
+		if err := tp.SetBPF(prog); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("could not set filter: %v", err)
+		}
+	}
+	if *threads > 1 {
+		if err := tp.SetFanout(afpacket.FanoutHashWithDefrag, fanout); err != nil {
+			tp.Close()
+			return nil, fmt.Errorf("could not join fanout group %d: %v", fanout, err)
+		}
+	}
+	return tp, nil
+}
+
+func runThread(thread int, names *base.FileNames, tp *afpacket.TPacket, done <-chan struct{}) error {
+	o := &output{
+		pktDir: filepath.Join(*dir, fmt.Sprintf("PKT%d", thread)),
+		idxDir: filepath.Join(*dir, fmt.Sprintf("IDX%d", thread)),
+		names:  names,
+	}
+	if err := o.open(); err != nil {
+		return err
+	}
+	maxAge := time.Duration(*fileAge) * time.Second
+	maxSize := int64(*fileSize) << 20
+	lastStats := time.Now()
+	for {
+		select {
+		case <-done:
+			log.Printf("Thread %d finishing", thread)
+			return o.close()
+		default:
+		}
+		data, ci, err := tp.ZeroCopyReadPacketData()
+		if err != nil && err != afpacket.ErrTimeout {
+			o.close()
+			return fmt.Errorf("reading packets: %v", err)
+		}
+		if err == nil {
+			if err := o.write(data, ci); err != nil {
+				o.close()
+				return fmt.Errorf("writing packet: %v", err)
+			}
+		}
+		now := time.Now()
+		if now.Sub(o.started) > maxAge || o.bw.Size()+blockfile.BlockSize > maxSize {
+			v(1, "Thread %d rotating file %q", thread, o.name)
+			if err := o.rotate(); err != nil {
+				return fmt.Errorf("rotating files: %v", err)
+			}
+		}
+		if now.Sub(lastStats) > *statsEvery {
+			lastStats = now
+			if _, stats, err := tp.SocketStats(); err != nil {
+				log.Printf("Thread %d unable to get stats: %v", thread, err)
+			} else {
+				log.Printf("Thread %d stats: packets=%d drops=%d freezes=%d",
+					thread, stats.Packets(), stats.Drops(), stats.QueueFreezes())
+			}
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *dir == "" {
+		log.Fatal("--dir is required")
+	}
+	if *fileSize <= 1 || *fileSize > 4<<10 {
+		log.Fatalf("--filesize_mb must be within (1, 4096], got %d", *fileSize)
+	}
+	var prog []bpf.RawInstruction
+	if *filter != "" {
+		var err error
+		if prog, err = parseFilter(*filter); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// Each thread's template comes with its thread and sensor already filled
+	// in, so only the time is left.
+	var names []*base.FileNames
+	for i := 0; i < *threads; i++ {
+		tmpl := base.DefaultFileNameTemplate
+		if *templates != "" {
+			all := strings.Split(*templates, ",")
+			if len(all) != *threads {
+				log.Fatalf("--filename_templates has %d templates for %d threads", len(all), *threads)
+			}
+			tmpl = all[i]
+		}
+		n, err := base.NewFileNames(tmpl, "")
+		if err != nil {
+			log.Fatal(err)
+		}
+		names = append(names, n)
+	}
+	fanout := uint16(*fanoutID)
+	if fanout == 0 {
+		fanout = uint16(os.Getpid())
+	}
+	// Open all sockets before starting any threads, so packets are spread
+	// over the whole fanout group from the start.
+	var tps []*afpacket.TPacket
+	for i := 0; i < *threads; i++ {
+		tp, err := newTPacket(fanout, prog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tp.Close()
+		tps = append(tps, tp)
+	}
+	// A failing thread stops all the others, so stenographer notices and
+	// restarts us.
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() { once.Do(func() { close(done) }) }
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		log.Printf("Got signal %v, shutting down", <-sigs)
+		stop()
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(tps))
+	for i, tp := range tps {
+		wg.Add(1)
+		go func(thread int, tp *afpacket.TPacket) {
+			defer wg.Done()
+			log.Printf("Thread %d starting to process packets", thread)
+			if err := runThread(thread, names[thread], tp, done); err != nil {
+				errs <- fmt.Errorf("thread %d failed: %v", thread, err)
+				stop()
+			}
+		}(i, tp)
+	}
+	wg.Wait()
+	close(errs)
+	failed := false
+	for err := range errs {
+		log.Print(err)
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
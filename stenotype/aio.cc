@@ -51,13 +51,14 @@ class PWrite {
 
 class SingleFile {
  public:
-  SingleFile(Output* file, const std::string& dirname, int64_t micros, int fd)
+  SingleFile(Output* file, const std::string& dirname, const std::string& name,
+             int fd)
       : file_(file),
         fd_(fd),
         offset_(0),
         truncate_(-1),
-        hidden_name_(HiddenFile(dirname, micros)),
-        unhidden_name_(UnhiddenFile(dirname, micros)) {}
+        hidden_name_(HiddenFile(dirname, name)),
+        unhidden_name_(UnhiddenFile(dirname, name)) {}
   ~SingleFile();
   void Write(io_context_t ctx, Block* b);
   int Outstanding() { return outstanding_.size(); }
@@ -178,21 +179,21 @@ Error Output::MaybeCloseFile(io::SingleFile* file) {
   return SUCCESS;
 }
 
-Error Output::Rotate(const std::string& dirname, int64_t micros,
+Error Output::Rotate(const std::string& dirname, const std::string& filename,
                      int64_t initial_size) {
   if (current_) {
     current_->RequestClose();
     RETURN_IF_ERROR(MaybeCloseFile(current_), "maybe close");
     current_ = NULL;
   }
-  std::string name = HiddenFile(dirname, micros);
+  std::string name = HiddenFile(dirname, filename);
   int fd = open(name.c_str(), O_CREAT | O_WRONLY | O_DSYNC | O_DIRECT, 0600);
   LOG(INFO) << "Opening packet file " << name << ": " << fd;
   RETURN_IF_ERROR(Errno(fd), "open");
   if (initial_size > 0) {
     LOG_IF_ERROR(Errno(fallocate(fd, 0, 0, initial_size)), "fallocate");
   }
-  current_ = new io::SingleFile(this, dirname, micros, fd);
+  current_ = new io::SingleFile(this, dirname, filename, fd);
   files_.insert(current_);
   return SUCCESS;
 }
@@ -48,8 +48,9 @@ class Output {
   virtual ~Output();
   // Open a new file.  Will fail if a file is already open.
   // If initial_size > 0, will attempt to preallocate the file to be
-  // that many bytes.
-  Error Rotate(const std::string& dirname, int64_t micros,
+  // that many bytes.  Files are written hidden, and renamed to 'name' once
+  // they're complete.
+  Error Rotate(const std::string& dirname, const std::string& name,
                int64_t initial_size);
   // Close and flush all files.
   Error Flush();
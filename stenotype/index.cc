@@ -17,6 +17,7 @@
 #include <memory>
 #include <string>
 
+#include <endian.h>            // htobe64()
 #include <netinet/if_ether.h>  // ethhdr
 #include <netinet/in.h>        // ntohs(), ntohl()
 #include <netinet/tcp.h>       // tcphdr
@@ -46,6 +47,31 @@ namespace st {
 const uint16_t kTypeEthernet = 0;
 const uint32_t kMPLSBottomOfStack = 1 << 8;
 
+// GRE header flags and protocol types, used to find ERSPAN-encapsulated frames.
+const uint16_t kGREChecksumPresent = 0x8000;
+const uint16_t kGREKeyPresent = 0x2000;
+const uint16_t kGRESequencePresent = 0x1000;
+const uint16_t kGRETypeERSPAN2 = 0x88BE;  // ERSPAN type I and II
+const uint16_t kGRETypeERSPAN3 = 0x22EB;  // ERSPAN type III
+
+// GTP-U (GPRS tunneling of user data) port, header flags, and message type.
+const uint16_t kGTPUPort = 2152;
+const uint8_t kGTPVersionMask = 0xE0;
+const uint8_t kGTPVersion1 = 0x20;
+const uint8_t kGTPOptionalFields = 0x07;  // Extension, sequence, N-PDU flags
+const uint8_t kGTPExtensionHeader = 0x04;
+const uint8_t kGTPMessageGPDU = 0xFF;  // Carries a subscriber's packet
+
+// Teredo (IPv6 over UDP through IPv4 NATs) port, and the headers which may
+// precede its IPv6 packets.
+const uint16_t kTeredoPort = 3544;
+const uint8_t kTeredoAuthentication = 1;
+const uint8_t kTeredoOriginIndication = 0;
+
+// IPv6 transition address prefixes, which embed an IPv4 address.
+const uint16_t k6to4Prefix = 0x2002;       // 2002::/16
+const uint32_t kTeredoPrefix = 0x20010000;  // 2001:0::/32
+
 void Index::Process(const Packet& p, int64_t block_offset) {
   packets_++;
   int64_t packet_offset = block_offset + p.offset_in_block;
@@ -54,6 +80,7 @@ void Index::Process(const Packet& p, int64_t block_offset) {
   const char* limit = start + p.data.size();
   uint16_t type = kTypeEthernet;
   uint8_t protocol = 0;
+  bool tunneled = false;  // Set once we've stripped off an IP tunnel header.
 
 // We use a goto loop within this switch statement to strip all pre-IP-header
 // layers off of the given packet.
@@ -64,6 +91,10 @@ pre_ip_encapsulation:
         return;
       }
       auto eth = reinterpret_cast<const struct ethhdr*>(start);
+      if (options_.macs) {
+        AddMAC(eth->h_source, packet_offset);
+        AddMAC(eth->h_dest, packet_offset);
+      }
       start += sizeof(struct ethhdr);
       type = ntohs(eth->h_proto);
       goto pre_ip_encapsulation;
@@ -122,8 +153,12 @@ pre_ip_encapsulation:
         return;
       }
       auto ip4 = reinterpret_cast<const struct iphdr*>(start);
-      AddIPv4(ntohl(ip4->saddr), packet_offset);
-      AddIPv4(ntohl(ip4->daddr), packet_offset);
+      if (tunneled) {
+        AddInnerIPv4(ntohl(ip4->saddr), packet_offset);
+        AddInnerIPv4(ntohl(ip4->daddr), packet_offset);
+      } else {
+        AddIPv4s(ntohl(ip4->saddr), ntohl(ip4->daddr), packet_offset);
+      }
       size_t len = ip4->ihl;
       len *= 4;
       if (len < 20) return;
@@ -138,10 +173,18 @@ pre_ip_encapsulation:
       auto ip6 = reinterpret_cast<const struct ip6_hdr*>(start);
       protocol = ip6->ip6_ctlun.ip6_un1.ip6_un1_nxt;
       start += sizeof(struct ip6_hdr);
-      AddIPv6(leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_src), 16),
-              packet_offset);
-      AddIPv6(leveldb::Slice(reinterpret_cast<const char*>(&ip6->ip6_dst), 16),
-              packet_offset);
+      leveldb::Slice src(reinterpret_cast<const char*>(&ip6->ip6_src), 16);
+      leveldb::Slice dst(reinterpret_cast<const char*>(&ip6->ip6_dst), 16);
+      if (tunneled) {
+        AddInnerIPv6(src, packet_offset);
+        AddInnerIPv6(dst, packet_offset);
+      } else {
+        AddIPv6s(src, dst, packet_offset);
+      }
+      if (options_.tunnels) {
+        AddEmbeddedIPv4(ip6->ip6_src, packet_offset);
+        AddEmbeddedIPv4(ip6->ip6_dst, packet_offset);
+      }
 
     // Here, we use another goto loop to strip off all IPv6 extensions.
     ip6_extensions:
@@ -174,6 +217,17 @@ pre_ip_encapsulation:
           start += (ip6ext->ip6e_len + 1) * 8;
           goto ip6_extensions;
         }
+        case IPPROTO_AH: {
+          // Authentication headers count their length in 4-byte units, not
+          // counting the first 8 bytes.
+          if (start + sizeof(struct ip6_ext) > limit) {
+            return;
+          }
+          auto ip6ext = reinterpret_cast<const struct ip6_ext*>(start);
+          protocol = ip6ext->ip6e_nxt;
+          start += (ip6ext->ip6e_len + 2) * 4;
+          goto ip6_extensions;
+        }
       }
       break;
     }
@@ -187,8 +241,9 @@ pre_ip_encapsulation:
         return;
       }
       auto tcp = reinterpret_cast<const struct tcphdr*>(start);
-      AddPort(ntohs(tcp->source), packet_offset);
-      AddPort(ntohs(tcp->dest), packet_offset);
+      AddPorts(ntohs(tcp->source), ntohs(tcp->dest), packet_offset);
+      // The flags are the 14th byte of the header, CWR and ECE included.
+      AddTCPFlags(static_cast<uint8_t>(start[13]), packet_offset);
       break;
     }
     case IPPROTO_UDP: {
@@ -196,9 +251,141 @@ pre_ip_encapsulation:
         return;
       }
       auto udp = reinterpret_cast<const struct udphdr*>(start);
-      AddPort(ntohs(udp->source), packet_offset);
-      AddPort(ntohs(udp->dest), packet_offset);
-      break;
+      AddPorts(ntohs(udp->source), ntohs(udp->dest), packet_offset);
+      // Teredo hides IPv6 traffic in UDP to get it through IPv4 NATs.  If
+      // tunnels are requested, index the IPv6 packet it carries like 6in4.
+      if (options_.tunnels && !tunneled &&
+          (ntohs(udp->source) == kTeredoPort ||
+           ntohs(udp->dest) == kTeredoPort)) {
+        start += sizeof(struct udphdr);
+        // Authentication and origin indication headers start with a zero
+        // byte, which an IPv6 header can't.
+        if (start + 4 <= limit && start[0] == 0 &&
+            start[1] == kTeredoAuthentication) {
+          // Client ID and authentication value, then an 8-byte nonce and a
+          // confirmation byte.
+          start += 4 + static_cast<uint8_t>(start[2]) +
+                   static_cast<uint8_t>(start[3]) + 9;
+        }
+        if (start + 8 <= limit && start[0] == 0 &&
+            start[1] == kTeredoOriginIndication) {
+          start += 8;
+        }
+        if (start + sizeof(struct ip6_hdr) > limit ||
+            (static_cast<uint8_t>(start[0]) >> 4) != 6) {
+          return;
+        }
+        tunneled = true;
+        type = ETH_P_IPV6;
+        goto pre_ip_encapsulation;
+      }
+      // Mobile packet cores tunnel each subscriber's traffic over GTP-U.  If
+      // requested, index the tunnel ID (TEID), and the subscriber's traffic
+      // as tunneled IPs.
+      if (!options_.gtp || tunneled ||
+          (ntohs(udp->source) != kGTPUPort && ntohs(udp->dest) != kGTPUPort)) {
+        return;
+      }
+      start += sizeof(struct udphdr);
+      if (start + 8 > limit) {
+        return;
+      }
+      uint8_t gtp_flags = start[0];
+      if ((gtp_flags & kGTPVersionMask) != kGTPVersion1) {
+        return;
+      }
+      AddTEID(ntohl(*reinterpret_cast<const uint32_t*>(start + 4)),
+              packet_offset);
+      if (static_cast<uint8_t>(start[1]) != kGTPMessageGPDU) {
+        return;
+      }
+      start += 8;
+      if (gtp_flags & kGTPOptionalFields) {
+        // Sequence number, N-PDU number, and next extension header type.
+        if (start + 4 > limit) {
+          return;
+        }
+        uint8_t next_extension = start[3];
+        start += 4;
+        if (gtp_flags & kGTPExtensionHeader) {
+          // Extension headers are a length (in 4-byte units), contents, and
+          // the type of the next extension header in their last byte.
+          while (next_extension != 0) {
+            if (start + 1 > limit || start[0] == 0) {
+              return;
+            }
+            size_t len = static_cast<uint8_t>(start[0]) * 4;
+            if (start + len > limit) {
+              return;
+            }
+            next_extension = start[len - 1];
+            start += len;
+          }
+        }
+      }
+      if (start + 1 > limit) {
+        return;
+      }
+      switch (static_cast<uint8_t>(start[0]) >> 4) {
+        case 4:
+          type = ETH_P_IP;
+          break;
+        case 6:
+          type = ETH_P_IPV6;
+          break;
+        default:
+          return;
+      }
+      tunneled = true;
+      goto pre_ip_encapsulation;
+    }
+    case IPPROTO_IPIP:
+    case IPPROTO_IPV6: {
+      // IP-in-IP, 6in4, and 4in6 tunnels hide the real conversation inside
+      // the tunnel endpoints' packets.  If requested, index the inner IPs
+      // separately from the outer ones, so queries can select either.
+      if (!options_.tunnels || tunneled) {
+        return;
+      }
+      tunneled = true;
+      type = protocol == IPPROTO_IPIP ? ETH_P_IP : ETH_P_IPV6;
+      goto pre_ip_encapsulation;
+    }
+    case IPPROTO_GRE: {
+      // GRE packets may carry ERSPAN-mirrored frames.  Those frames are what
+      // analysts actually care about, so we strip the GRE/ERSPAN headers and
+      // index the inner frame along with the outer headers.
+      if (start + 4 > limit) {
+        return;
+      }
+      uint16_t flags = ntohs(*reinterpret_cast<const uint16_t*>(start));
+      uint16_t gre_type = ntohs(*reinterpret_cast<const uint16_t*>(start + 2));
+      start += 4;
+      if (flags & kGREChecksumPresent) start += 4;
+      if (flags & kGREKeyPresent) start += 4;
+      bool has_sequence = flags & kGRESequencePresent;
+      if (has_sequence) start += 4;
+      switch (gre_type) {
+        case kGRETypeERSPAN2:
+          // Type II has an 8-byte ERSPAN header, type I (no sequence) has none.
+          if (has_sequence) start += 8;
+          break;
+        case kGRETypeERSPAN3: {
+          if (start + 12 > limit) {
+            return;
+          }
+          // The low bit of the last header byte flags an optional 8-byte
+          // platform-specific subheader.
+          bool has_subheader = start[11] & 1;
+          start += 12;
+          if (has_subheader) start += 8;
+          break;
+        }
+        default:
+          return;
+      }
+      type = kTypeEthernet;
+      goto pre_ip_encapsulation;
     }
     default:
       return;
@@ -251,12 +438,23 @@ const char kIndexVLAN = 3;
 const char kIndexIPv4 = 4;
 const char kIndexMPLS = 5;
 const char kIndexIPv6 = 6;
+const char kIndexInnerIPv4 = 7;
+const char kIndexInnerIPv6 = 8;
+const char kIndexMAC = 9;
+const char kIndexTEID = 10;
+const char kIndexSrcPort = 11;
+const char kIndexDstPort = 12;
+const char kIndexSrcIPv4 = 13;
+const char kIndexDstIPv4 = 14;
+const char kIndexSrcIPv6 = 15;
+const char kIndexDstIPv6 = 16;
+const char kIndexTCPFlag = 17;
 
 }  // namespace
 
 Error Index::Flush() {
   leveldb::WritableFile* file = NULL;
-  std::string filename = HiddenFile(dirname_, micros_);
+  std::string filename = HiddenFile(dirname_, name_);
   auto status = leveldb::Env::Default()->NewWritableFile(filename, &file);
   if (!status.ok()) {
     return ERROR("could not open '" + filename + "': " + status.ToString());
@@ -265,14 +463,19 @@ Error Index::Flush() {
 
   RETURN_IF_ERROR(WriteTo(file), "writing index " + filename);
 
-  std::string unhidden = UnhiddenFile(dirname_, micros_);
+  std::string unhidden = UnhiddenFile(dirname_, name_);
   LOG(INFO) << "Wrote all index files for " << filename << ", moving to "
             << unhidden;
   RETURN_IF_ERROR(Errno(rename(filename.c_str(), unhidden.c_str())), "rename");
   VLOG(1) << "Stored " << packets_ << " with " << ip4_.size() << " IP4 "
           << ip6_.size() << " IP6 " << proto_.size() << " protos "
           << port_.size() << " ports " << vlan_.size() << " vlan "
-          << mpls_.size() << " mpls";
+          << mpls_.size() << " mpls " << inner_ip4_.size() << " inner IP4 "
+          << inner_ip6_.size() << " inner IP6 " << mac_.size() << " MACs " << teid_.size() << " TEIDs "
+          << src_port_.size() << " src ports " << dst_port_.size()
+          << " dst ports " << src_ip4_.size() + src_ip6_.size() << " src IPs "
+          << dst_ip4_.size() + dst_ip6_.size() << " dst IPs "
+          << tcp_flag_.size() << " TCP flags";
   return SUCCESS;
 }
 
@@ -299,18 +502,40 @@ Error Index::WriteTo(leveldb::WritableFile* file) {
     }                                                                     \
   } while (0)
 
+#define WRITE_IP6_TO_INDEX(name, indextype)                            \
+  do {                                                                 \
+    for (auto iter : name##_) {                                        \
+      WriteToIndex(indextype, iter.first.data(), 16, iter.second,      \
+                   &index_ss);                                         \
+    }                                                                  \
+  } while (0)
+
+  // Keys must be added in order, so key types are written in order too.
   WRITE_TO_INDEX(proto, , kIndexProtocol, 1);
   WRITE_TO_INDEX(port, htons, kIndexPort, 2);
   WRITE_TO_INDEX(vlan, htons, kIndexVLAN, 2);
   WRITE_TO_INDEX(ip4, htonl, kIndexIPv4, 4);
   WRITE_TO_INDEX(mpls, htonl, kIndexMPLS, 4);
-
-#undef WRITE_TO_INDEX
-
-  for (auto iter : ip6_) {
-    auto ip6 = iter.first.data();
-    WriteToIndex(kIndexIPv6, ip6, 16, iter.second, &index_ss);
+  WRITE_IP6_TO_INDEX(ip6, kIndexIPv6);
+  WRITE_TO_INDEX(inner_ip4, htonl, kIndexInnerIPv4, 4);
+  WRITE_IP6_TO_INDEX(inner_ip6, kIndexInnerIPv6);
+  for (auto iter : mac_) {
+    // MACs are stored in the low 48 bits, so skip the top two bytes.
+    uint64_t mac = htobe64(iter.first);
+    WriteToIndex(kIndexMAC, reinterpret_cast<const char*>(&mac) + 2, 6,
+                 iter.second, &index_ss);
   }
+  WRITE_TO_INDEX(teid, htonl, kIndexTEID, 4);
+  WRITE_TO_INDEX(src_port, htons, kIndexSrcPort, 2);
+  WRITE_TO_INDEX(dst_port, htons, kIndexDstPort, 2);
+  WRITE_TO_INDEX(src_ip4, htonl, kIndexSrcIPv4, 4);
+  WRITE_TO_INDEX(dst_ip4, htonl, kIndexDstIPv4, 4);
+  WRITE_IP6_TO_INDEX(src_ip6, kIndexSrcIPv6);
+  WRITE_IP6_TO_INDEX(dst_ip6, kIndexDstIPv6);
+  WRITE_TO_INDEX(tcp_flag, , kIndexTCPFlag, 1);
+
+#undef WRITE_IP6_TO_INDEX
+#undef WRITE_TO_INDEX
 
   auto finished = index_ss.Finish();
   if (!finished.ok()) {
@@ -324,17 +549,37 @@ Error Index::WriteTo(leveldb::WritableFile* file) {
   return SUCCESS;
 }
 
-void Index::AddIPv6(leveldb::Slice ip, uint32_t pos) {
+namespace {
+
+void AddIPv6To(std::map<leveldb::Slice, std::vector<uint32_t>>* ip6,
+               SliceSet* pieces, leveldb::Slice ip, uint32_t pos) {
   CHECK(ip.size() == 16);
-  auto finder = ip6_.find(ip);
-  if (finder == ip6_.end()) {
-    ip = ip_pieces_.Store(ip);
-    ip6_[ip].push_back(pos);
+  auto finder = ip6->find(ip);
+  if (finder == ip6->end()) {
+    ip = pieces->Store(ip);
+    (*ip6)[ip].push_back(pos);
   } else {
     finder->second.push_back(pos);
   }
 }
 
+}  // namespace
+
+void Index::AddIPv6(leveldb::Slice ip, uint32_t pos) {
+  AddIPv6To(&ip6_, &ip_pieces_, ip, pos);
+}
+void Index::AddInnerIPv6(leveldb::Slice ip, uint32_t pos) {
+  AddIPv6To(&inner_ip6_, &ip_pieces_, ip, pos);
+}
+void Index::AddIPv6s(leveldb::Slice src, leveldb::Slice dst, uint32_t pos) {
+  AddIPv6(src, pos);
+  AddIPv6(dst, pos);
+  if (options_.host_direction) {
+    AddIPv6To(&src_ip6_, &ip_pieces_, src, pos);
+    AddIPv6To(&dst_ip6_, &ip_pieces_, dst, pos);
+  }
+}
+
 #define ADD_TO_INDEX(name, pos)   \
   do {                            \
     name##_[name].push_back(pos); \
@@ -344,9 +589,61 @@ void Index::AddProtocol(uint8_t proto, uint32_t pos) {
   ADD_TO_INDEX(proto, pos);
 }
 void Index::AddPort(uint16_t port, uint32_t pos) { ADD_TO_INDEX(port, pos); }
+void Index::AddPorts(uint16_t src_port, uint16_t dst_port, uint32_t pos) {
+  AddPort(src_port, pos);
+  AddPort(dst_port, pos);
+  if (options_.port_direction) {
+    ADD_TO_INDEX(src_port, pos);
+    ADD_TO_INDEX(dst_port, pos);
+  }
+}
 void Index::AddVLAN(uint16_t vlan, uint32_t pos) { ADD_TO_INDEX(vlan, pos); }
 void Index::AddMPLS(uint32_t mpls, uint32_t pos) { ADD_TO_INDEX(mpls, pos); }
 void Index::AddIPv4(uint32_t ip4, uint32_t pos) { ADD_TO_INDEX(ip4, pos); }
+void Index::AddIPv4s(uint32_t src_ip4, uint32_t dst_ip4, uint32_t pos) {
+  AddIPv4(src_ip4, pos);
+  AddIPv4(dst_ip4, pos);
+  if (options_.host_direction) {
+    ADD_TO_INDEX(src_ip4, pos);
+    ADD_TO_INDEX(dst_ip4, pos);
+  }
+}
+void Index::AddInnerIPv4(uint32_t inner_ip4, uint32_t pos) {
+  ADD_TO_INDEX(inner_ip4, pos);
+}
+void Index::AddTEID(uint32_t teid, uint32_t pos) { ADD_TO_INDEX(teid, pos); }
+void Index::AddTCPFlags(uint8_t flags, uint32_t pos) {
+  if (!options_.tcp_flags) {
+    return;
+  }
+  for (int bit = 0; bit < 8; bit++) {
+    uint8_t tcp_flag = flags & (1 << bit);
+    if (tcp_flag) {
+      ADD_TO_INDEX(tcp_flag, pos);
+    }
+  }
+}
+void Index::AddEmbeddedIPv4(const struct in6_addr& ip6, uint32_t pos) {
+  const uint8_t* b = ip6.s6_addr;
+  uint32_t prefix = uint32_t(b[0]) << 24 | uint32_t(b[1]) << 16 |
+                    uint32_t(b[2]) << 8 | b[3];
+  uint32_t last = uint32_t(b[12]) << 24 | uint32_t(b[13]) << 16 |
+                  uint32_t(b[14]) << 8 | b[15];
+  if (prefix >> 16 == k6to4Prefix) {
+    // 2002:AABB:CCDD::/48 is the site behind 6to4 router A.B.C.D.
+    AddInnerIPv4(prefix << 16 | uint32_t(b[4]) << 8 | b[5], pos);
+  } else if (prefix == kTeredoPrefix) {
+    // The last 32 bits are the client's public (NAT) address, inverted.
+    AddInnerIPv4(~last, pos);
+  }
+}
+void Index::AddMAC(const unsigned char* addr, uint32_t pos) {
+  uint64_t mac = 0;
+  for (int i = 0; i < ETH_ALEN; i++) {
+    mac = (mac << 8) | addr[i];
+  }
+  ADD_TO_INDEX(mac, pos);
+}
 
 #undef ADD_TO_INDEX
 
@@ -15,7 +15,8 @@
 #ifndef EXPERIMENTAL_USERS_GCONNELL_AFPACKET_INDEX_H_
 #define EXPERIMENTAL_USERS_GCONNELL_AFPACKET_INDEX_H_
 
-#include <string.h>  // memcpy()
+#include <netinet/in.h>  // in6_addr
+#include <string.h>      // memcpy()
 
 #include <map>
 #include <vector>
@@ -97,6 +98,34 @@ class SliceSet {
   size_t last_size_;
 };
 
+// IndexOptions selects which optional attributes an Index computes.
+struct IndexOptions {
+  IndexOptions()
+      : tunnels(false),
+        macs(false),
+        gtp(false),
+        port_direction(false),
+        host_direction(false),
+        tcp_flags(false) {}
+
+  // Index the inner IPs of IP-in-IP, 6in4, 4in6, and Teredo tunneled
+  // packets, and the IPv4 addresses embedded in 6to4 and Teredo addresses.
+  bool tunnels;
+  // Index the source and destination MAC addresses of Ethernet frames.
+  bool macs;
+  // Index the TEIDs of GTP-U packets, and the subscriber IPs they carry as
+  // tunneled IPs.
+  bool gtp;
+  // Index TCP and UDP source and destination ports separately, as well as
+  // together, so queries can ask for one direction.
+  bool port_direction;
+  // Index the outer source and destination IPs separately, as well as
+  // together, so queries can ask for one direction.
+  bool host_direction;
+  // Index which flags are set in each TCP header, one key per flag.
+  bool tcp_flags;
+};
+
 // Index is a simple proof-of-concept for indexing packets seen by stenotype.
 // Its main purpose currently is to determine which indexes we want to use and
 // provide a proving ground for things like "how many IPs that we see are
@@ -104,9 +133,11 @@ class SliceSet {
 // write to disk.
 class Index {
  public:
-  explicit Index(const std::string& dirname, int64_t micros)
+  explicit Index(const std::string& dirname, const std::string& name,
+                 const IndexOptions& options = IndexOptions())
       : dirname_(dirname),
-        micros_(micros),
+        name_(name),
+        options_(options),
         packets_(0),
         ip_pieces_(1 << 20) {}  // Start slice set off at 1MB.
   virtual ~Index() {}
@@ -118,21 +149,47 @@ class Index {
  private:
   void AddIPv4(uint32_t ip, uint32_t pos);
   void AddIPv6(leveldb::Slice ip, uint32_t pos);
+  // Index the outer IPs of a packet, and their directions if requested.
+  void AddIPv4s(uint32_t src, uint32_t dst, uint32_t pos);
+  void AddIPv6s(leveldb::Slice src, leveldb::Slice dst, uint32_t pos);
+  void AddInnerIPv4(uint32_t ip, uint32_t pos);
+  void AddInnerIPv6(leveldb::Slice ip, uint32_t pos);
   void AddProtocol(uint8_t proto, uint32_t pos);
   void AddPort(uint16_t port, uint32_t pos);
+  // Indexes a TCP or UDP header's ports, and their directions if requested.
+  void AddPorts(uint16_t src_port, uint16_t dst_port, uint32_t pos);
   void AddVLAN(uint16_t port, uint32_t pos);
   void AddMPLS(uint32_t mpls, uint32_t pos);
+  void AddMAC(const unsigned char* mac, uint32_t pos);
+  void AddTEID(uint32_t teid, uint32_t pos);
+  // Indexes each flag set in a TCP header's flags byte, if requested.
+  void AddTCPFlags(uint8_t flags, uint32_t pos);
+  // Indexes the IPv4 address embedded in a 6to4 or Teredo address, if any, as
+  // a tunneled IPv4 address.
+  void AddEmbeddedIPv4(const struct in6_addr& ip6, uint32_t pos);
 
   std::string dirname_;
-  int64_t micros_;
+  std::string name_;
+  IndexOptions options_;
   int64_t packets_;
   SliceSet ip_pieces_;
   std::map<uint32_t, std::vector<uint32_t>> ip4_;
   std::map<leveldb::Slice, std::vector<uint32_t>> ip6_;
+  std::map<uint32_t, std::vector<uint32_t>> src_ip4_;
+  std::map<uint32_t, std::vector<uint32_t>> dst_ip4_;
+  std::map<leveldb::Slice, std::vector<uint32_t>> src_ip6_;
+  std::map<leveldb::Slice, std::vector<uint32_t>> dst_ip6_;
+  std::map<uint32_t, std::vector<uint32_t>> inner_ip4_;
+  std::map<leveldb::Slice, std::vector<uint32_t>> inner_ip6_;
   std::map<uint8_t, std::vector<uint32_t>> proto_;
   std::map<uint16_t, std::vector<uint32_t>> port_;
+  std::map<uint16_t, std::vector<uint32_t>> src_port_;
+  std::map<uint16_t, std::vector<uint32_t>> dst_port_;
   std::map<uint16_t, std::vector<uint32_t>> vlan_;
   std::map<uint32_t, std::vector<uint32_t>> mpls_;
+  std::map<uint64_t, std::vector<uint32_t>> mac_;  // 48-bit MACs
+  std::map<uint32_t, std::vector<uint32_t>> teid_;
+  std::map<uint8_t, std::vector<uint32_t>> tcp_flag_;
 
   DISALLOW_COPY_AND_ASSIGN(Index);
 };
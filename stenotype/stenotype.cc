@@ -72,6 +72,7 @@
 #include <string>
 #include <sstream>
 #include <thread>
+#include <vector>
 
 // Due to some weird interactions with <argp.h>, <string>, and --std=c++0x, this
 // header MUST be included AFTER <string>.
@@ -110,12 +111,21 @@ uint16_t flag_fanout_id = 0;
 std::string flag_uid;
 std::string flag_gid;
 bool flag_index = true;
+bool flag_index_tunnels = false;
+bool flag_index_macs = false;
+bool flag_index_gtp = false;
+bool flag_index_port_direction = false;
+bool flag_index_host_direction = false;
+bool flag_index_tcp_flags = false;
 std::string flag_seccomp = "kill";
 int flag_index_nicelevel = 0;
 int flag_preallocate_file_mb = 0;
 bool flag_watchdogs = true;
 bool flag_promisc = true;
 std::string flag_testimony;
+// Per-thread file name templates, see FileName.  Threads without one name
+// files by their microseconds.
+std::vector<std::string> flag_filename_templates;
 
 int ParseOptions(int key, char* arg, struct argp_state* state) {
   switch (key) {
@@ -199,6 +209,32 @@ int ParseOptions(int key, char* arg, struct argp_state* state) {
     case 323:
       flag_stats_sec = atoi(arg);
       break;
+    case 324:
+      flag_index_tunnels = true;
+      break;
+    case 325:
+      flag_index_macs = true;
+      break;
+    case 326:
+      flag_index_gtp = true;
+      break;
+    case 327:
+      flag_index_port_direction = true;
+      break;
+    case 328:
+      flag_index_host_direction = true;
+      break;
+    case 330:
+      flag_index_tcp_flags = true;
+      break;
+    case 329: {
+      std::stringstream templates(arg);
+      std::string tmpl;
+      while (std::getline(templates, tmpl, ',')) {
+        flag_filename_templates.push_back(tmpl);
+      }
+      break;
+    }
   }
   return 0;
 }
@@ -243,6 +279,19 @@ void ParseOptions(int argc, char** argv) {
       {"no_promisc", 321, 0, 0, "Don't set promiscuous mode"},
       {"stats_blocks", 322, n, 0, "Size block stats will be displayed, requires verbose, default 100, 0 disables"},
       {"stats_sec", 323, n, 0, "Seconds stats will be displayed, requires verbose, default 60, 0 disables"},
+      {"index_tunnels", 324, 0, 0,
+       "Index inner IPs of IP-in-IP, 6in4, 4in6, and Teredo tunnels"},
+      {"index_macs", 325, 0, 0, "Index source and destination MAC addresses"},
+      {"index_gtp", 326, 0, 0,
+       "Index GTP-U TEIDs, and subscriber IPs as tunneled IPs"},
+      {"index_port_direction", 327, 0, 0,
+       "Index TCP/UDP source and destination ports separately too"},
+      {"index_host_direction", 328, 0, 0,
+       "Index outer source and destination IPs separately too"},
+      {"filename_templates", 329, s, 0,
+       "Comma-separated file name template of each thread, each with one "
+       "{micros} or {utc} placeholder for the time the file was started"},
+      {"index_tcp_flags", 330, 0, 0, "Index which flags are set in TCP headers"},
       {0},
   };
   struct argp argp = {options, &ParseOptions};
@@ -452,6 +501,17 @@ void HandleSignalsThread() {
   VLOG(1) << "Signal handling done";
 }
 
+IndexOptions GetIndexOptions() {
+  IndexOptions options;
+  options.tunnels = flag_index_tunnels;
+  options.macs = flag_index_macs;
+  options.gtp = flag_index_gtp;
+  options.port_direction = flag_index_port_direction;
+  options.host_direction = flag_index_host_direction;
+  options.tcp_flags = flag_index_tcp_flags;
+  return options;
+}
+
 void RunThread(int thread, st::ProducerConsumerQueue* write_index,
                Packets* v3) {
   if (flag_threads > 1) {
@@ -472,13 +532,20 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
   std::string file_dirname = flag_dir + "PKT" + std::to_string(thread) + "/";
   std::string index_dirname = flag_dir + "IDX" + std::to_string(thread) + "/";
 
+  std::string name_template = "{micros}";
+  if (size_t(thread) < flag_filename_templates.size()) {
+    name_template = flag_filename_templates[thread];
+  }
+
   Packet p;
   int64_t micros = GetCurrentTimeMicros();
+  std::string name = FileName(name_template, micros);
   CHECK_SUCCESS(
-      output.Rotate(file_dirname, micros, flag_preallocate_file_mb << 20));
+      output.Rotate(file_dirname, name, flag_preallocate_file_mb << 20));
+  IndexOptions index_options = GetIndexOptions();
   Index* index = NULL;
   if (flag_index) {
-    index = new Index(index_dirname, micros);
+    index = new Index(index_dirname, name, index_options);
   } else {
     LOG(ERROR) << "Indexing turned off";
   }
@@ -500,12 +567,13 @@ void RunThread(int thread, st::ProducerConsumerQueue* write_index,
               << " blocks";
       // File size got too big, rotate file.
       micros = current_micros;
+      name = FileName(name_template, micros);
       block_offset = 0;
       CHECK_SUCCESS(
-          output.Rotate(file_dirname, micros, flag_preallocate_file_mb << 20));
+          output.Rotate(file_dirname, name, flag_preallocate_file_mb << 20));
       if (flag_index) {
         write_index->Put(index);
-        index = new Index(index_dirname, micros);
+        index = new Index(index_dirname, name, index_options);
       }
     }
     // Read in a new block from AF_PACKET.
@@ -41,6 +41,24 @@ std::string Dirname(const std::string& filename) {
   return std::string(dirname(copy));
 }
 
+std::string FileName(const std::string& tmpl, int64_t micros) {
+  std::string out = tmpl;
+  size_t pos;
+  if ((pos = out.find("{micros}")) != std::string::npos) {
+    out.replace(pos, strlen("{micros}"), std::to_string(micros));
+  } else if ((pos = out.find("{utc}")) != std::string::npos) {
+    time_t secs = micros / kNumMicrosPerSecond;
+    struct tm utc;
+    gmtime_r(&secs, &utc);
+    char buf[32];
+    size_t n = strftime(buf, sizeof(buf), "%Y%m%dT%H%M%S", &utc);
+    snprintf(buf + n, sizeof(buf) - n, ".%06dZ",
+             int(micros % kNumMicrosPerSecond));
+    out.replace(pos, strlen("{utc}"), buf);
+  }
+  return out;
+}
+
 void Barrier::Block() {
   std::unique_lock<std::mutex> lock(mu_);
   count_++;
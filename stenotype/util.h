@@ -333,13 +333,19 @@ inline Error NegErrno(int ret) {
 
 std::string Basename(const std::string& filename);
 std::string Dirname(const std::string& filename);
-inline std::string HiddenFile(const std::string& dirname, int64_t micros) {
+// FileName returns the name of a file started at 'micros', from a template
+// with one {micros} (the microseconds since the epoch) or {utc} (the UTC time,
+// like 20150101T135211.123456Z) placeholder.
+std::string FileName(const std::string& tmpl, int64_t micros);
+inline std::string HiddenFile(const std::string& dirname,
+                              const std::string& name) {
   CHECK(dirname[dirname.size() - 1] == '/');
-  return dirname + "." + std::to_string(micros);
+  return dirname + "." + name;
 }
-inline std::string UnhiddenFile(const std::string& dirname, int64_t micros) {
+inline std::string UnhiddenFile(const std::string& dirname,
+                                const std::string& name) {
   CHECK(dirname[dirname.size() - 1] == '/');
-  return dirname + std::to_string(micros);
+  return dirname + name;
 }
 
 // Watchdog is a simple thread which causes a process crash if certain code
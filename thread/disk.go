@@ -0,0 +1,111 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var diskFailures = stats.S.Get("thread_disk_failures")
+
+// diskProbeTimeout is how long reading a thread's directories may take before
+// its disk is considered to have failed.  Reads from a failed disk can block
+// indefinitely rather than returning errors.
+var diskProbeTimeout = 30 * time.Second
+
+// Degraded returns why the thread's disk has failed, or nil if it's healthy
+// as far as we know.  Degraded threads aren't synced with disk, and should be
+// left out of queries and capture until they recover.
+func (t *Thread) Degraded() error {
+	t.healthMu.Lock()
+	defer t.healthMu.Unlock()
+	return t.degraded
+}
+
+// checkDisk probes the thread's disk, marking the thread degraded if it's
+// failed and healthy again once it recovers, and returns whether it's
+// healthy.
+func (t *Thread) checkDisk() bool {
+	err := t.probeDisk()
+	t.healthMu.Lock()
+	was := t.degraded
+	t.degraded = err
+	t.healthMu.Unlock()
+	switch {
+	case err != nil && was == nil:
+		diskFailures.Increment()
+		log.Printf("Thread %v disk failed, isolating thread: %v", t.id, err)
+		events.H.Add(events.Error, "Thread %v disk failed, isolating thread: %v", t.id, err)
+	case err == nil && was != nil:
+		log.Printf("Thread %v disk recovered", t.id)
+		events.H.Add(events.Error, "Thread %v disk recovered after: %v", t.id, was)
+		t.mu.Lock()
+		t.fileLastSeen = time.Now() // Don't count the outage as stenotype stalling.
+		t.mu.Unlock()
+	}
+	return err == nil
+}
+
+// probeDisk checks that the thread's packets and index directories can still
+// be read, giving up after diskProbeTimeout.  Only one probe runs at a time,
+// so a disk that blocks reads doesn't pile up goroutines; while one is
+// blocked, later probes fail immediately.
+func (t *Thread) probeDisk() error {
+	t.healthMu.Lock()
+	if t.probing {
+		t.healthMu.Unlock()
+		return fmt.Errorf("disk unresponsive for over %v", diskProbeTimeout)
+	}
+	t.probing = true
+	t.healthMu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		err := readDir(t.packetPath)
+		if err == nil {
+			err = readDir(t.indexPath)
+		}
+		t.healthMu.Lock()
+		t.probing = false
+		t.healthMu.Unlock()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(diskProbeTimeout):
+		return fmt.Errorf("disk unresponsive for over %v", diskProbeTimeout)
+	}
+}
+
+// readDir reads an entry of the given directory, which fails if its disk has
+// gone offline or been unmounted out from under it.
+func readDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		return fmt.Errorf("could not read %q: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"log"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/export"
+)
+
+type exportState int
+
+const (
+	exportQueued exportState = iota + 1
+	exportDone
+)
+
+const (
+	// exportQueueSize is how many files may wait for export at once.  Only the
+	// oldest files are queued, so exports happen shortly before the files would
+	// be deleted rather than as soon as they're written.
+	exportQueueSize = 4
+	// exportAttempts is how many times each exporter is tried on a file before
+	// giving up on it.
+	exportAttempts = 3
+	exportTimeout  = time.Hour
+)
+
+var exportRetryDelay = 10 * time.Second
+
+// SetExporters sets the exporters every file must go through before the disk
+// cleaner deletes it, and starts exporting.  If 'required', files whose export
+// fails are kept and retried, otherwise they're deleted anyway.  It should be
+// called at most once, before the first SyncFiles.
+func (t *Thread) SetExporters(exporters []export.Exporter, required bool) {
+	if len(exporters) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exporters = exporters
+	t.exportRequired = required
+	t.exports = make(chan string, exportQueueSize)
+	t.exportStates = map[string]exportState{}
+	go t.runExports()
+}
+
+// queueExports queues the oldest deletable files which haven't been exported
+// yet, as long as there's room in the queue.  When exports fall behind, the
+// queue fills up and files wait, undeletable, until they catch up.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) queueExports() {
+	if t.exporters == nil {
+		return
+	}
+	for _, name := range t.getDeletableFiles() {
+		if len(t.exports) == cap(t.exports) {
+			return
+		}
+		if _, ok := t.exportStates[name]; ok {
+			continue
+		}
+		t.exportStates[name] = exportQueued
+		t.exports <- name
+	}
+}
+
+// runExports exports queued files, one at a time, marking them as done so the
+// disk cleaner can delete them.  Each is pinned while it's exported, so it
+// stays readable even if it's deleted meanwhile.
+func (t *Thread) runExports() {
+	for name := range t.exports {
+		t.mu.RLock()
+		bf := t.files[name]
+		pinned := bf != nil && bf.Pin()
+		t.mu.RUnlock()
+		if !pinned {
+			continue // Quarantined or deleted since it was queued.
+		}
+		err := t.exportFile(export.File{Thread: t.id, Name: name, Blockfile: bf})
+		bf.Unpin()
+		t.mu.Lock()
+		switch _, tracked := t.exportStates[name]; {
+		case !tracked:
+			// Untracked during export, nothing left to do.
+		case err == nil:
+			t.exportStates[name] = exportDone
+			exportedFiles.Increment()
+		case t.exportRequired:
+			log.Printf("Thread %v keeping %q for retry: %v", t.id, name, err)
+			events.H.Add(events.Error, "Thread %v keeping %q for retry: %v", t.id, name, err)
+			delete(t.exportStates, name) // Queued again on the next sync.
+		default:
+			log.Printf("Thread %v will delete %q without export: %v", t.id, name, err)
+			events.H.Add(events.Error, "Thread %v will delete %q without export: %v", t.id, name, err)
+			t.exportStates[name] = exportDone
+		}
+		t.mu.Unlock()
+	}
+}
+
+// exportFile runs every exporter on a file, retrying failures a few times.
+func (t *Thread) exportFile(f export.File) error {
+	for _, e := range t.exporters {
+		var err error
+		for i := 0; i < exportAttempts; i++ {
+			if i > 0 {
+				time.Sleep(exportRetryDelay)
+			}
+			ctx := base.NewContext(exportTimeout)
+			err = e.Export(ctx, f)
+			ctx.Cancel()
+			if err == nil {
+				break
+			}
+			exportFailures.Increment()
+			v(0, "Thread %v %v of %q failed: %v", t.id, e, f.Name, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	v(1, "Thread %v exported %q", t.id, f.Name)
+	return nil
+}
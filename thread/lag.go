@@ -0,0 +1,206 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/query"
+	"github.com/mars-suite/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	indexLagWaits    = stats.S.Get("index_lag_waits")
+	indexLagWarnings = stats.S.Get("index_lag_warnings")
+)
+
+// Index lag policies, for what lookups do about lagging files:  finished
+// blockfiles whose indexes stenotype hasn't written yet.
+const (
+	// LagReport searches the other files, warning about each lagging one.
+	LagReport = "report"
+	// LagWait waits a while for lagging files' indexes, then reports those
+	// still missing.
+	LagWait = "wait"
+	// LagScan follows lagging files like files stenotype is still writing,
+	// indexing them in memory, so they're searched anyway.
+	LagScan = "scan"
+)
+
+// lagPollInterval is how often LagWait checks for lagging files' indexes.
+var lagPollInterval = 250 * time.Millisecond
+
+// SetIndexLag sets the thread's index lag policy, one of the Lag constants,
+// and how long LagWait waits.  The default is LagReport.
+func (t *Thread) SetIndexLag(policy string, maxWait time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lagPolicy, t.lagWait = policy, maxWait
+}
+
+// syncLaggingFiles records which of the finished blockfiles in 'names' aren't
+// tracked yet, and when each was first seen.  Most are lagging, but some may
+// have had their indexes written since the last sync.  With LagScan, lagging
+// files which aren't being followed already start to be.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) syncLaggingFiles(names []string) {
+	lagging := map[string]time.Time{}
+	for _, name := range names {
+		if t.files[name] != nil {
+			continue
+		}
+		seen, ok := t.lagging[name]
+		if !ok {
+			seen = time.Now()
+		}
+		lagging[name] = seen
+		if t.lagPolicy != LagScan || t.active[name] != nil {
+			continue
+		} else if _, err := os.Stat(t.getIndexFilePath(name)); err == nil {
+			continue // It'll be tracked on the next sync.
+		}
+		af, err := blockfile.OpenActive(t.getPacketFilePath(name), t.fc, t.opts)
+		if err != nil {
+			v(1, "Thread %v: %v", t.id, err)
+			continue
+		}
+		v(1, "Thread %v indexing %q in memory, its index isn't written yet", t.id, name)
+		t.active[name] = af
+	}
+	t.lagging = lagging
+}
+
+// laggingFiles returns the lagging files which could hold packets matching
+// q, and which aren't being indexed in memory instead, in order.
+func (t *Thread) laggingFiles(q query.Query) (names []string) {
+	_, end := query.TimeBounds(q)
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for name := range t.lagging {
+		if t.active[name] != nil {
+			continue
+		} else if ts, err := t.fileTimestamp(name); err == nil && !end.IsZero() && ts.After(end) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return t.startedBefore(names[i], names[j]) })
+	return names
+}
+
+// addLaggingFiles handles the untracked files a lookup of q would miss.  Any
+// whose index has been written are opened and added to 'files' (and
+// 'untracked'), and with LagWait, so are any whose index is written in time.
+// The rest are reported as query warnings.
+func (t *Thread) addLaggingFiles(ctx context.Context, q query.Query, files []*blockfile.BlockFile, untracked map[*blockfile.BlockFile]bool) []*blockfile.BlockFile {
+	lagging := t.laggingFiles(q)
+	if len(lagging) == 0 {
+		return files
+	}
+	// openIndexed opens the lagging files whose indexes exist, leaving the
+	// rest in 'lagging'.
+	openIndexed := func() {
+		var still []string
+		for _, name := range lagging {
+			if _, err := os.Stat(t.getIndexFilePath(name)); err != nil {
+				still = append(still, name)
+				continue
+			}
+			bf, err := blockfile.NewBlockFile(t.getPacketFilePath(name), t.fc, t.opts)
+			if err != nil {
+				v(1, "Thread %v could not open untracked file: %v", t.id, err)
+				still = append(still, name)
+				continue
+			}
+			files = append(files, bf)
+			untracked[bf] = true
+		}
+		lagging = still
+	}
+	openIndexed()
+	t.mu.RLock()
+	policy, maxWait := t.lagPolicy, t.lagWait
+	t.mu.RUnlock()
+	if policy == LagWait && len(lagging) > 0 {
+		indexLagWaits.Increment()
+		deadline := time.NewTimer(maxWait)
+		defer deadline.Stop()
+		ticker := time.NewTicker(lagPollInterval)
+		defer ticker.Stop()
+	wait:
+		for len(lagging) > 0 {
+			select {
+			case <-ctx.Done():
+				break wait
+			case <-deadline.C:
+				break wait
+			case <-ticker.C:
+				openIndexed()
+			}
+		}
+	}
+	for _, name := range lagging {
+		indexLagWarnings.Increment()
+		start, _ := t.fileTimestamp(name)
+		t.mu.RLock()
+		lag := time.Since(t.lagging[name]).Round(time.Second)
+		t.mu.RUnlock()
+		base.QueryWarningsFrom(ctx).Add(base.QueryWarning{
+			File:   t.getPacketFilePath(name),
+			Start:  start,
+			Reason: fmt.Sprintf("index not written yet (for %v), file not searched", lag),
+		})
+	}
+	// Keep files in time order, with those opened among the tracked ones.
+	sort.SliceStable(files, func(i, j int) bool {
+		return t.startedBefore(strings.TrimPrefix(filepath.Base(files[i].Name()), "."), strings.TrimPrefix(filepath.Base(files[j].Name()), "."))
+	})
+	return files
+}
+
+// startedBefore returns whether the blockfile named a was started before the
+// one named b, by the times in their names, as getSortedFiles orders tracked
+// files.  Names aren't in time order once they have more than the time in
+// them (see base.FileNames).
+func (t *Thread) startedBefore(a, b string) bool {
+	sa, _ := t.fileTimestamp(a)
+	sb, _ := t.fileTimestamp(b)
+	if !sa.Equal(sb) {
+		return sa.Before(sb)
+	}
+	return a < b
+}
+
+// indexLag returns how many lagging files the thread has, and how long the
+// oldest has been waiting for its index.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) indexLag() (n int, lag time.Duration) {
+	for _, seen := range t.lagging {
+		if d := time.Since(seen); d > lag {
+			lag = d
+		}
+	}
+	return len(t.lagging), lag
+}
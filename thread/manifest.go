@@ -0,0 +1,166 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/stats"
+)
+
+var manifestFiles = stats.S.Get("manifest_known_files")
+
+const (
+	// manifestDir is the hidden subdirectory of each thread's index directory
+	// its manifest of blockfiles is kept in.  Being a directory, it survives
+	// the removal of hidden files at startup.
+	manifestDir  = ".manifest"
+	manifestName = "blockfiles.json"
+	// manifestInterval is the most often the manifest is rewritten as files
+	// come and go.  Files missing from it are just opened as new at startup.
+	manifestInterval = 5 * time.Minute
+	// fileOpeners is how many blockfiles are opened at once when syncing.
+	fileOpeners = 16
+)
+
+// manifestEntry is what the manifest records of each blockfile:  enough to
+// track it at startup without touching it or its index.  The file's time
+// extent runs from the timestamp in its name to its ModTime.
+type manifestEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ManifestPath returns where the manifest of the blockfiles whose indexes are
+// in indexDir is kept.  Tools which rewrite blockfiles in place should remove
+// it, so their new sizes are picked up.
+func ManifestPath(indexDir string) string {
+	return filepath.Join(indexDir, manifestDir, manifestName)
+}
+
+func (t *Thread) manifestPath() string {
+	return ManifestPath(t.conf.IndexDirectory)
+}
+
+// readManifest returns the entries of the manifest written by an earlier
+// run, by name, or nil if there isn't one.
+func (t *Thread) readManifest() map[string]manifestEntry {
+	data, err := ioutil.ReadFile(t.manifestPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		v(0, "Thread %v could not read manifest: %v", t.id, err)
+		return nil
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		v(0, "Thread %v ignoring invalid manifest: %v", t.id, err)
+		return nil
+	}
+	out := make(map[string]manifestEntry, len(entries))
+	for _, e := range entries {
+		out[e.Name] = e
+	}
+	return out
+}
+
+// writeManifest records the files the thread's tracking in its manifest.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) writeManifest() error {
+	entries := make([]manifestEntry, 0, len(t.files))
+	for name, bf := range t.files {
+		entries = append(entries, manifestEntry{Name: name, Size: bf.Size(), ModTime: bf.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	path := t.manifestPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("could not create manifest directory: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("could not write manifest: %v", err)
+	}
+	defer os.Remove(tmp) // no-op once renamed into place
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("could not move manifest into place: %v", err)
+	}
+	t.manifestWritten = time.Now()
+	t.manifestDirty = false
+	return nil
+}
+
+// maybeWriteManifest rewrites the manifest if files have come or gone since
+// it was last written, at most every manifestInterval.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) maybeWriteManifest() {
+	if !t.manifestDirty || time.Since(t.manifestWritten) < manifestInterval {
+		return
+	}
+	if err := t.writeManifest(); err != nil {
+		v(0, "Thread %v: %v", t.id, err)
+		t.manifestWritten = time.Now() // Don't retry on every sync.
+	}
+}
+
+// openFiles opens the named blockfiles concurrently, returning each file (or
+// why it couldn't be opened) in the same order.  done is called as each is
+// opened.
+func (t *Thread) openFiles(names []string, done func()) ([]*blockfile.BlockFile, []error) {
+	files := make([]*blockfile.BlockFile, len(names))
+	errs := make([]error, len(names))
+	next := make(chan int)
+	finished := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < fileOpeners && w < len(names); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				path := t.getPacketFilePath(names[i])
+				if files[i], errs[i] = blockfile.NewBlockFile(path, t.fc, t.opts); errs[i] != nil {
+					errs[i] = fmt.Errorf("could not open blockfile %q: %v", path, errs[i])
+				}
+				finished <- struct{}{}
+			}
+		}()
+	}
+	go func() {
+		for i := range names {
+			next <- i
+		}
+		close(next)
+		wg.Wait()
+		close(finished)
+	}()
+	for range finished {
+		done()
+	}
+	return files, errs
+}
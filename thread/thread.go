@@ -18,7 +18,9 @@ package thread
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -26,17 +28,24 @@ import (
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/stenographer/base"
-	"github.com/google/stenographer/blockfile"
-	"github.com/google/stenographer/config"
-	"github.com/google/stenographer/filecache"
-	"github.com/google/stenographer/httputil"
-	"github.com/google/stenographer/indexfile"
-	"github.com/google/stenographer/query"
-	"github.com/google/stenographer/stats"
+	"github.com/mars-suite/stenographer/archive"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/export"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/httputil"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/labels"
+	"github.com/mars-suite/stenographer/query"
+	"github.com/mars-suite/stenographer/stats"
+	"github.com/mars-suite/stenographer/tracing"
 	"golang.org/x/net/context"
 )
 
@@ -44,6 +53,12 @@ var (
 	v            = base.V // verbose logging
 	currentFiles = stats.S.Get("current_files")
 	agedFiles    = stats.S.Get("aged_files")
+	skewedFiles  = stats.S.Get("clock_skewed_files")
+
+	quarantinedFiles = stats.S.Get("quarantined_files")
+
+	exportedFiles  = stats.S.Get("exported_files")
+	exportFailures = stats.S.Get("export_failures")
 )
 
 const (
@@ -62,13 +77,74 @@ type Thread struct {
 	indexPath    string
 	packetPath   string
 	files        map[string]*blockfile.BlockFile
+	starts       map[string]time.Time // Tracked files' start times, for sorting.
 	mu           sync.RWMutex
 	fileLastSeen time.Time
 	fc           *filecache.Cache
+	opts         blockfile.Options // How the thread's blockfiles are read.
+	parser       *query.Parser     // Parses queries given to debug handlers.
+	labels       *labels.Store
+	skewed       map[string]string // Files with clock skew, to the reason why.
+	synced       bool              // Whether we've done our initial sync with disk.
+	queryCPUs    []int             // CPUs to run blockfile lookups on, or nil for any.
+	queryIOPrio  *base.IOPriority  // I/O priority of blockfile lookups, or nil to inherit ours.
+	// active holds the files stenotype is still writing, by their finished
+	// names, see syncActiveFiles.
+	active map[string]*blockfile.ActiveFile
+	// lagging holds the finished files which aren't tracked yet, usually
+	// because their indexes aren't written, to when each was first seen, see
+	// syncLaggingFiles.
+	lagging   map[string]time.Time
+	lagPolicy string        // How lookups handle lagging files, see SetIndexLag.
+	lagWait   time.Duration // How long LagWait waits for lagging files.
+
+	exporters      []export.Exporter
+	exportRequired bool
+	exports        chan string            // Files queued for export, oldest first.
+	exportStates   map[string]exportState // Files queued or done, see queueExports.
+
+	flowShipper FlowShipper
+	archive     *archive.Fetcher
+
+	manifestWritten time.Time // When the manifest was last written.
+	manifestDirty   bool      // Whether files have come or gone since.
+
+	pruned bool // Whether deleteOldestThreadFiles has deleted anything.
+	// unlinkPending is the bytes of files deleted while queries had them
+	// pinned, which are only unlinked once they're unpinned.
+	unlinkPending atomic.Int64
+
+	healthMu sync.Mutex
+	// protected by healthMu
+	degraded error // Why the thread's disk has failed, see Degraded.
+	probing  bool  // Whether a disk probe is still running.
+}
+
+// FlowShipper is given each new file once the thread starts tracking it.
+type FlowShipper interface {
+	Add(export.File)
+}
+
+// SetFlowShipper sets where new files are sent to have their flows shipped.
+// Files found by the initial sync at startup aren't sent.
+func (t *Thread) SetFlowShipper(s FlowShipper) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flowShipper = s
+}
+
+// SetArchive sets where the thread's archived files are fetched from for
+// queries naming them, see FetchArchived.
+func (t *Thread) SetArchive(a *archive.Fetcher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.archive = a
 }
 
 // Threads creates a set of thread objects based on a set of ThreadConfigs.
-func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache) ([]*Thread, error) {
+// Their blockfiles are read as 'opts' say, and queries given to their debug
+// handlers are parsed by 'parser'.
+func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache, opts blockfile.Options, parser *query.Parser) ([]*Thread, error) {
 	threads := make([]*Thread, len(configs))
 	for i, conf := range configs {
 		thread := &Thread{
@@ -77,8 +153,27 @@ func Threads(configs []config.ThreadConfig, baseDir string, fc *filecache.Cache)
 			indexPath:    filepath.Join(baseDir, indexPrefix+strconv.Itoa(i)),
 			packetPath:   filepath.Join(baseDir, packetPrefix+strconv.Itoa(i)),
 			files:        map[string]*blockfile.BlockFile{},
+			starts:       map[string]time.Time{},
+			active:       map[string]*blockfile.ActiveFile{},
+			lagging:      map[string]time.Time{},
 			fileLastSeen: time.Now(),
 			fc:           fc,
+			opts:         opts,
+			parser:       parser,
+		}
+		if conf.QueryCPUs != "" {
+			cpus, err := base.ParseCPUList(conf.QueryCPUs)
+			if err != nil {
+				return nil, fmt.Errorf("thread %d: %v", i, err)
+			}
+			thread.queryCPUs = cpus
+		}
+		if conf.QueryIOPriority != "" {
+			prio, err := base.ParseIOPriority(conf.QueryIOPriority)
+			if err != nil {
+				return nil, fmt.Errorf("thread %d: %v", i, err)
+			}
+			thread.queryIOPrio = &prio
 		}
 		if err := thread.createSymlinks(); err != nil {
 			return nil, err
@@ -105,14 +200,20 @@ func (t *Thread) createSymlinks() error {
 	if err := makeDirIfNecessary(t.conf.PacketsDirectory); err != nil {
 		return fmt.Errorf("thread %v could not create packet directory: %v", t.id, err)
 	}
-	if err := os.Symlink(t.conf.PacketsDirectory, t.packetPath); err != nil {
-		return fmt.Errorf("couldn't create symlink for thread %d to directory %q: %v",
-			t.id, t.conf.PacketsDirectory, err)
-	}
 	if err := makeDirIfNecessary(t.conf.IndexDirectory); err != nil {
 		return fmt.Errorf("thread %v could not create index directory: %v", t.id, err)
 	}
-	if err := os.Symlink(t.conf.IndexDirectory, t.indexPath); err != nil {
+	return t.Link(filepath.Dir(t.packetPath), t.id)
+}
+
+// Link links the thread's packets and index directories into dir as those of
+// stenotype thread 'id', so stenotype can be run with a subset of threads.
+func (t *Thread) Link(dir string, id int) error {
+	if err := os.Symlink(t.conf.PacketsDirectory, filepath.Join(dir, packetPrefix+strconv.Itoa(id))); err != nil {
+		return fmt.Errorf("couldn't create symlink for thread %d to directory %q: %v",
+			t.id, t.conf.PacketsDirectory, err)
+	}
+	if err := os.Symlink(t.conf.IndexDirectory, filepath.Join(dir, indexPrefix+strconv.Itoa(id))); err != nil {
 		return fmt.Errorf("couldn't create symlink for index %d to directory %q: %v",
 			t.id, t.conf.IndexDirectory, err)
 	}
@@ -127,32 +228,221 @@ func (t *Thread) getIndexFilePath(filename string) string {
 	return filepath.Join(t.indexPath, filename)
 }
 
+// syncFilesWithDisk starts tracking the blockfiles stenotype has finished
+// since the last sync.  At startup, files in the manifest written by the last
+// run are tracked without being opened, and the rest are opened concurrently.
 func (t *Thread) syncFilesWithDisk() {
 	fido := base.Watchdog(time.Minute*5, "syncing files with disk") // 5 min for initial list of files
 	defer fido.Stop()
-	newFilesCnt := 0
+	var known map[string]manifestEntry
+	if !t.synced {
+		known = t.readManifest()
+	}
+	newFilesCnt, knownFilesCnt := 0, 0
+	var names []string
 	for _, filename := range t.listPacketFilesOnDisk() {
-		fido.Reset(time.Minute) // 1 minute for opening each new file
 		if t.files[filename] != nil {
 			continue
 		}
-		if err := t.trackNewFile(filename); err != nil {
+		if e, ok := known[filename]; ok {
+			t.trackFile(filename, blockfile.OpenKnownBlockFile(t.getPacketFilePath(filename), t.fc, t.opts, e.Size, e.ModTime))
+			knownFilesCnt++
+			continue
+		}
+		names = append(names, filename)
+	}
+	// 1 minute for opening each new file
+	files, errs := t.openFiles(names, func() { fido.Reset(time.Minute) })
+	for i, filename := range names {
+		if err := errs[i]; err != nil {
 			log.Printf("Thread %v error tracking %q: %v", t.id, filename, err)
+			events.H.Add(events.Error, "Thread %v error tracking %q: %v", t.id, filename, err)
 			continue
 		}
+		t.trackFile(filename, files[i])
+		if t.synced {
+			events.H.Add(events.NewFile, "Thread %v new blockfile %q", t.id, filename)
+			if t.flowShipper != nil {
+				t.flowShipper.Add(export.File{Thread: t.id, Name: filename, Blockfile: t.files[filename]})
+			}
+			if indexfile.AppProtocolIndexes || indexfile.QUICConnectionIDIndexes {
+				go t.buildDerivedIndexes(t.files[filename])
+			}
+		}
 		newFilesCnt++
 		t.fileLastSeen = time.Now()
 	}
+	if knownFilesCnt > 0 {
+		v(0, "Thread %v found %d blockfiles from its manifest", t.id, knownFilesCnt)
+		manifestFiles.IncrementBy(int64(knownFilesCnt))
+		t.fileLastSeen = time.Now()
+	}
 	if newFilesCnt > 0 {
 		v(0, "Thread %v found %d new blockfiles", t.id, newFilesCnt)
 	}
+	if newFilesCnt+knownFilesCnt > 0 {
+		t.checkClockSkew()
+	}
+	if !t.synced {
+		// Don't flood event history with every file found at startup.
+		events.H.Add(events.NewFile, "Thread %v found %d existing blockfiles", t.id, newFilesCnt+knownFilesCnt)
+		t.synced = true
+		t.manifestDirty = newFilesCnt > 0 || len(known) != knownFilesCnt
+	}
+	t.reopenReplacedFiles()
+	t.quarantineCorruptFiles()
+}
+
+// reopenReplacedFiles reopens files which have been replaced on disk (as by
+// stenodefrag or stenoreindex) since they were opened, which lookups fail on
+// rather than mixing up old and new data.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) reopenReplacedFiles() {
+	for name, bf := range t.files {
+		if !bf.Replaced() {
+			continue
+		}
+		v(0, "Thread %v reopening replaced file %q", t.id, name)
+		reopened, err := blockfile.NewBlockFile(t.getPacketFilePath(name), t.fc, t.opts)
+		if err != nil {
+			log.Printf("Thread %v could not reopen replaced file %q: %v", t.id, name, err)
+			continue
+		}
+		bf.Close()
+		t.files[name] = reopened
+		t.manifestDirty = true
+	}
+}
+
+// quarantineDir is the subdirectory of each thread's packets and index
+// directories that files with corrupt indexes are moved to.  They can still
+// be queried explicitly, as "quarantine/".
+const quarantineDir = "quarantine"
+
+// quarantineCorruptFiles stops tracking files whose index lookups have failed,
+// moving them and their indexes to quarantineDir for later examination.  Files
+// derived from their indexes are deleted, since they'd otherwise be left
+// behind with nothing to clean them up.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) quarantineCorruptFiles() {
+	for name, bf := range t.files {
+		reason := bf.Corrupt()
+		if reason == nil {
+			continue
+		}
+		log.Printf("Thread %v quarantining %q: %v", t.id, name, reason)
+		events.H.Add(events.Error, "Thread %v quarantining %q: %v", t.id, name, reason)
+		if err := t.untrackFile(name); err != nil {
+			log.Printf("Thread %v could not untrack %q: %v", t.id, name, err)
+			continue
+		}
+		quarantinedFiles.Increment()
+		t.deleteDerivedFiles(t.getIndexFilePath(name))
+		for _, path := range []string{t.getPacketFilePath(name), t.getIndexFilePath(name)} {
+			dir := filepath.Join(filepath.Dir(path), quarantineDir)
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				log.Printf("Thread %v could not create quarantine directory: %v", t.id, err)
+			} else if err := os.Rename(path, filepath.Join(dir, name)); err != nil {
+				log.Printf("Thread %v could not quarantine %q: %v", t.id, path, err)
+			}
+		}
+	}
+}
+
+// clockSkewReason returns why a file which started at 'start' and was last
+// written at 'end' appears to have been written with a clock that's not
+// monotonic, or "" if it looks fine.  prevEnd is when the file preceding it
+// was last written, if any.
+func clockSkewReason(prevEnd, start, end time.Time, skew time.Duration) string {
+	if end.Before(start.Add(-skew)) {
+		return fmt.Sprintf("last written %v before it was started", start.Sub(end))
+	}
+	if !prevEnd.IsZero() && start.Before(prevEnd.Add(-skew)) {
+		return fmt.Sprintf("started %v before the previous file was last written", prevEnd.Sub(start))
+	}
+	return ""
+}
+
+// checkClockSkew flags files whose timestamps show the clock jumping
+// backwards, which can make time-based queries skip their packets.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) checkClockSkew() {
+	skewed := map[string]string{}
+	var prevEnd time.Time
+	for _, name := range t.getSortedFiles() {
+		start, err := t.fileTimestamp(name)
+		if err != nil {
+			continue
+		}
+		end := t.files[name].ModTime()
+		if reason := clockSkewReason(prevEnd, start, end, t.opts.ClockSkew); reason != "" {
+			if _, ok := t.skewed[name]; !ok {
+				log.Printf("Thread %v file %q has skewed timestamps: %v", t.id, name, reason)
+				skewedFiles.Increment()
+			}
+			skewed[name] = reason
+		}
+		prevEnd = end
+	}
+	t.skewed = skewed
+}
+
+// syncActiveFiles follows the hidden files stenotype is still writing, so
+// lookups include their newest packets.  Each is followed until it's been
+// renamed and its index written, at which point it's tracked like any other.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) syncActiveFiles() {
+	files, err := ioutil.ReadDir(t.packetPath)
+	if err != nil {
+		log.Printf("Thread %v could not read dir %q: %v", t.id, t.packetPath, err)
+		return
+	}
+	hidden := map[string]bool{}
+	var finished []string
+	for _, file := range files {
+		name := strings.TrimPrefix(file.Name(), ".")
+		if !file.Mode().IsRegular() {
+			continue
+		} else if _, err := t.fileTimestamp(name); err != nil {
+			continue
+		} else if name == file.Name() {
+			finished = append(finished, name)
+			continue
+		}
+		hidden[name] = true
+		if t.active[name] != nil || t.files[name] != nil {
+			continue
+		}
+		af, err := blockfile.OpenActive(t.getPacketFilePath(file.Name()), t.fc, t.opts)
+		if err != nil {
+			v(1, "Thread %v: %v", t.id, err)
+			continue
+		}
+		t.active[name] = af
+	}
+	t.syncLaggingFiles(finished)
+	for name, af := range t.active {
+		if hidden[name] {
+			continue
+		} else if _, err := os.Stat(t.getPacketFilePath(name)); err == nil && t.files[name] == nil {
+			continue // Renamed, but its index isn't written yet.
+		}
+		v(1, "Thread %v no longer following %q", t.id, af.Name())
+		af.Close()
+		delete(t.active, name)
+	}
 }
 
 func (t *Thread) listPacketFilesOnDisk() (out []string) {
 	// Since indexes tend to be written after blockfiles, we list index files,
 	// then translate them back to blockfiles.  This way, we don't get spurious
 	// errors when we find blockfiles that indexes haven't been written for yet.
-	files, err := ioutil.ReadDir(t.indexPath)
+	// os.ReadDir doesn't stat each file, which adds up over a whole disk.
+	files, err := os.ReadDir(t.indexPath)
 	if err != nil {
 		log.Printf("Thread %v could not read dir %q: %v", t.id, t.indexPath, err)
 		return nil
@@ -166,17 +456,38 @@ func (t *Thread) listPacketFilesOnDisk() (out []string) {
 	return
 }
 
-// This method should only be called once the t.mu has been acquired!
-func (t *Thread) trackNewFile(filename string) error {
-	filepath := filepath.Join(t.packetPath, filename)
-	bf, err := blockfile.NewBlockFile(filepath, t.fc)
-	if err != nil {
-		return fmt.Errorf("could not open blockfile %q: %v", filepath, err)
+// derivedIndexBuilds limits how many blockfiles have derived indexes built at
+// once, so a burst of new files doesn't compete with stenotype for CPU.
+var derivedIndexBuilds = make(chan struct{}, 1)
+
+// buildDerivedIndexes builds a new blockfile's app index (see
+// indexfile.AppProtocolIndexes) and QUIC index (see
+// indexfile.QUICConnectionIDIndexes), whichever are enabled, in the
+// background, so they're ready before the first query needs them.
+func (t *Thread) buildDerivedIndexes(bf *blockfile.BlockFile) {
+	derivedIndexBuilds <- struct{}{}
+	defer func() { <-derivedIndexBuilds }()
+	if indexfile.AppProtocolIndexes {
+		if err := bf.BuildAppIndex(context.Background()); err != nil {
+			log.Printf("Thread %v could not build app index for %q: %v", t.id, bf.Name(), err)
+		}
 	}
-	v(1, "new blockfile %q", filepath)
+	if indexfile.QUICConnectionIDIndexes {
+		if err := bf.BuildQUICIndex(context.Background()); err != nil {
+			log.Printf("Thread %v could not build QUIC index for %q: %v", t.id, bf.Name(), err)
+		}
+	}
+}
+
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) trackFile(filename string, bf *blockfile.BlockFile) {
+	v(1, "new blockfile %q", bf.Name())
 	t.files[filename] = bf
+	if ts, err := t.fileTimestamp(filename); err == nil {
+		t.starts[filename] = ts
+	}
+	t.manifestDirty = true
 	currentFiles.Increment()
-	return nil
 }
 
 func (t *Thread) cleanUpOnLowDiskSpace() {
@@ -189,21 +500,31 @@ func (t *Thread) cleanUpOnLowDiskSpace() {
 		fido.Reset(time.Minute)
 		if len(t.files) > t.conf.MaxDirectoryFiles {
 			v(1, "Thread %v has too many files. %d > %d, deleting", t.id, len(t.files), t.conf.MaxDirectoryFiles)
-			t.deleteOldestThreadFiles(len(t.files)-t.conf.MaxDirectoryFiles, nil)
+			if t.deleteOldestThreadFiles(len(t.files)-t.conf.MaxDirectoryFiles, nil) == 0 {
+				t.logAllFilesHeld()
+				return
+			}
 			continue
 		}
-		df, err := base.PathDiskFreePercentage(t.packetPath)
-		if err != nil {
+		avail, total, err := base.PathDiskSpace(t.packetPath)
+		if err != nil || total == 0 {
 			log.Printf("Thread %v could not get the free disk percentage for %q: %v", t.id, t.packetPath, err)
+			events.H.Add(events.Error, "Thread %v could not get the free disk percentage for %q: %v", t.id, t.packetPath, err)
 			return
 		}
+		// Count files already deleted but still pinned by queries as free, or
+		// a long query would have us delete everything.
+		df := int(100 * (avail + t.unlinkPending.Load()) / total)
 		if df > t.conf.DiskFreePercentage {
 			v(1, "Thread %v disk space is sufficient (packet path=%q): %d%% free > %d%% threshold", t.id, t.packetPath, df, t.conf.DiskFreePercentage)
 			return
 		}
 		v(0, "Thread %v disk usage is high (packet path=%q): %d%% free <= %d%% threshold", t.id, t.packetPath, df, t.conf.DiskFreePercentage)
 		// Delete enough files to match newest file size.
-		t.pruneOldestThreadFiles()
+		if !t.pruneOldestThreadFiles() {
+			t.logAllFilesHeld()
+			return
+		}
 		// After deleting files, it may take a while for disk stats to be updated.
 		// We add this sleep so we don't accidentally delete WAY more files than
 		// we need to.
@@ -215,25 +536,56 @@ func tryToDeleteFile(filename string) {
 	v(2, "Deleting %q", filename)
 	if err := os.Remove(filename); err != nil {
 		log.Printf("Unable to delete file %q: %v", filename, err)
+		events.H.Add(events.Error, "Unable to delete file %q: %v", filename, err)
+	}
+}
+
+// tryToDeleteDerivedFile is like tryToDeleteFile, for files like flow indexes
+// which are only built when needed, so usually don't exist.
+func tryToDeleteDerivedFile(filename string) {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to delete file %q: %v", filename, err)
+		events.H.Add(events.Error, "Unable to delete file %q: %v", filename, err)
 	}
 }
 
+// deleteDerivedFiles deletes the files built from the index at indexPath and
+// kept beside it, like its mmapped, sharded, and flow indexes.
+func (t *Thread) deleteDerivedFiles(indexPath string) {
+	if t.opts.Index.Mmap {
+		tryToDeleteFile(indexfile.MmapPath(indexPath))
+	}
+	for _, shard := range indexfile.ShardFiles(indexPath) {
+		tryToDeleteDerivedFile(shard)
+	}
+	tryToDeleteDerivedFile(indexfile.FlowPath(indexPath))
+	tryToDeleteDerivedFile(indexfile.AppPath(indexPath))
+	tryToDeleteDerivedFile(indexfile.QUICPath(indexPath))
+	for _, composite := range indexfile.CompositeFiles(indexPath) {
+		tryToDeleteDerivedFile(composite)
+	}
+	tryToDeleteDerivedFile(indexfile.StatsPath(indexPath))
+	tryToDeleteDerivedFile(indexfile.LockPath(indexPath))
+}
+
 // pruneOldestThreadFiles deletes enough of the oldest files held by this
 // thread to free up bytes >= the size of the newest file.
 // It should only exceed the newest size by no more than the size of the last
 // deleted file.
 // It should only be called if the thread has at least one file (should be
-// checked by the caller beforehand).
-func (t *Thread) pruneOldestThreadFiles() {
-	files := t.getSortedFiles()
+// checked by the caller beforehand).  It returns false if no files could be
+// deleted, because all of them are under legal hold or awaiting export.
+func (t *Thread) pruneOldestThreadFiles() bool {
+	files := t.getCleanableFiles()
 	v(2, "pruneOldestThreadFiles - files count %v, t.files count %v", len(files), len(t.files))
 	if len(files) == 0 || len(t.files) == 0 {
-		return
+		return false
 	}
-	firstName := files[len(files)-1]
+	sorted := t.getSortedFiles()
+	firstName := sorted[len(sorted)-1]
 	v(3, "pruneOldestThreadFiles - firstName %v", firstName)
 	if len(firstName) == 0 {
-		return
+		return false
 	}
 	firstSize := t.files[firstName].Size()
 	v(3, "pruneOldestThreadFiles - firstSize %v", firstSize)
@@ -248,21 +600,39 @@ func (t *Thread) pruneOldestThreadFiles() {
 	}
 	v(1, "Thread %v deleting %v files to free up %v bytes.", t.id, delCnt, delSize)
 	t.deleteOldestThreadFiles(delCnt, files)
+	return true
 }
 
-// deleteOldestThreadFiles deletes n of the oldest files held by this thread.
+// deleteOldestThreadFiles deletes n of the oldest files held by this thread,
+// skipping files under legal hold or awaiting export, and returns how many it
+// deleted.
 // It should only be called if the thread has at least one file (should be
 // checked by the caller beforehand).
-// The list of sorted files can be passed if it has already been generated.
-func (t *Thread) deleteOldestThreadFiles(n int, files []string) {
+// The list of deletable files can be passed if it has already been generated.
+func (t *Thread) deleteOldestThreadFiles(n int, files []string) int {
 	if files == nil {
-		files = t.getSortedFiles()
+		files = t.getCleanableFiles()
+	}
+	if n > len(files) {
+		n = len(files)
+	}
+	if n > 0 {
+		t.pruned = true
 	}
 	for i := 0; i < n && i < len(files); i++ {
 		toDelete := files[i]
 		v(1, "Thread %v removing %q", t.id, toDelete)
-		go tryToDeleteFile(t.getPacketFilePath(toDelete))
-		go tryToDeleteFile(t.getIndexFilePath(toDelete))
+		events.H.Add(events.DeleteFile, "Thread %v removing %q", t.id, toDelete)
+		packetPath, indexPath := t.getPacketFilePath(toDelete), t.getIndexFilePath(toDelete)
+		// Queries with the file pinned can still read it until they're done.
+		size := t.files[toDelete].Size()
+		t.unlinkPending.Add(size)
+		t.files[toDelete].AfterClose(func() {
+			t.unlinkPending.Add(-size)
+			go tryToDeleteFile(packetPath)
+			go tryToDeleteFile(indexPath)
+			go t.deleteDerivedFiles(indexPath)
+		})
 	}
 	for i := 0; i < n && i < len(files); i++ {
 		toDelete := files[i]
@@ -270,6 +640,50 @@ func (t *Thread) deleteOldestThreadFiles(n int, files []string) {
 			log.Fatalf("Failure to untrack file: %v", err)
 		}
 	}
+	return n
+}
+
+// getDeletableFiles returns files from the thread in the order they were
+// created, leaving out any under legal hold.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) getDeletableFiles() []string {
+	files := t.getSortedFiles()
+	if t.labels == nil {
+		return files
+	}
+	var out []string
+	for _, name := range files {
+		if !t.fileHeld(name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// getCleanableFiles returns the deletable files which have also been exported,
+// and so can be deleted right now.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) getCleanableFiles() []string {
+	files := t.getDeletableFiles()
+	if t.exporters == nil {
+		return files
+	}
+	var out []string
+	for _, name := range files {
+		if t.exportStates[name] == exportDone {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// logAllFilesHeld reports that the disk cleaner can't make space because all
+// remaining files are under legal hold or still awaiting export.
+func (t *Thread) logAllFilesHeld() {
+	log.Printf("Thread %v cannot free disk space: all %d remaining files are under legal hold or awaiting export", t.id, len(t.files))
+	events.H.Add(events.Error, "Thread %v cannot free disk space: all %d remaining files are under legal hold or awaiting export", t.id, len(t.files))
 }
 
 // getSortedFiles returns files from the thread in the order they were created,
@@ -281,11 +695,24 @@ func (t *Thread) getSortedFiles() []string {
 	for name := range t.files {
 		sortedFiles = append(sortedFiles, name)
 	}
-	// We guarantee elsewhere that filename ordering corresponds to creation ordering
-	sort.Strings(sortedFiles)
+	// Within a naming scheme, filename ordering corresponds to creation
+	// ordering, but names from before the scheme changed may sort either way.
+	sort.Slice(sortedFiles, func(i, j int) bool {
+		a, b := sortedFiles[i], sortedFiles[j]
+		if sa, sb := t.starts[a], t.starts[b]; !sa.Equal(sb) {
+			return sa.Before(sb)
+		}
+		return a < b
+	})
 	return sortedFiles
 }
 
+// fileTimestamp returns the time encoded in a blockfile's name, which is the
+// time stenotype started writing it.
+func (t *Thread) fileTimestamp(name string) (time.Time, error) {
+	return t.opts.Names().Time(name)
+}
+
 // OldestFileTimestamp returns timestamp of the oldest file we have.
 func (t *Thread) OldestFileTimestamp() time.Time {
 	t.mu.Lock()
@@ -294,11 +721,50 @@ func (t *Thread) OldestFileTimestamp() time.Time {
 	if len(files) == 0 {
 		return time.Time{}
 	}
-	ts, err := strconv.ParseInt(files[0], 10, 64)
+	ts, err := t.fileTimestamp(files[0])
 	if err != nil {
 		return time.Time{}
 	}
-	return time.Unix(0, ts*1000 /* micros to nanos */)
+	return ts
+}
+
+// SetLabels sets the label store used to annotate this thread's file
+// listings.
+func (t *Thread) SetLabels(l *labels.Store) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.labels = l
+}
+
+// fileLabels returns the names of all labels applying to the given file.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) fileLabels(name string) (out []string) {
+	if t.labels == nil {
+		return nil
+	}
+	start, err := t.fileTimestamp(name)
+	if err != nil {
+		return nil
+	}
+	for _, l := range t.labels.Matching(name, start, t.files[name].ModTime()) {
+		out = append(out, l.Name)
+	}
+	return out
+}
+
+// fileHeld returns true if the given file is under legal hold.
+//
+// This method should only be called once the t.mu has been acquired!
+func (t *Thread) fileHeld(name string) bool {
+	if t.labels == nil {
+		return false
+	}
+	start, err := t.fileTimestamp(name)
+	if err != nil {
+		start = t.files[name].ModTime()
+	}
+	return t.labels.Held(name, start, t.files[name].ModTime())
 }
 
 // This method should only be called once the t.mu has been acquired!
@@ -312,11 +778,93 @@ func (t *Thread) untrackFile(filename string) error {
 	v(1, "Thread %v old blockfile %q", t.id, b.Name())
 	b.Close()
 	delete(t.files, filename)
+	delete(t.starts, filename)
+	delete(t.skewed, filename)
+	delete(t.exportStates, filename)
+	t.manifestDirty = true
 	agedFiles.Increment()
 	currentFiles.IncrementBy(-1)
 	return nil
 }
 
+// ID returns the thread's ID, its position in the config's thread list.
+func (t *Thread) ID() int {
+	return t.id
+}
+
+// Status summarizes what a thread is currently storing.
+type Status struct {
+	ID           int
+	Files        int
+	Bytes        int64
+	Oldest       time.Time // When the oldest file was started.
+	FileLastSeen time.Time
+	// Pruned is whether any files have been deleted to make room since the
+	// thread started, so Oldest is limited by the thread's disk space.
+	Pruned bool
+	// Degraded is why the thread's disk has failed, if it has, see
+	// Thread.Degraded.
+	Degraded string `json:",omitempty"`
+	// Unindexed is how many finished files aren't tracked yet, usually
+	// because their indexes haven't been written, and IndexLag how long the
+	// oldest has been waiting.
+	Unindexed int    `json:",omitempty"`
+	IndexLag  string `json:",omitempty"`
+}
+
+// Status returns a summary of the files this thread is tracking.
+func (t *Thread) Status() Status {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	s := Status{ID: t.id, Files: len(t.files), FileLastSeen: t.fileLastSeen, Pruned: t.pruned}
+	if err := t.Degraded(); err != nil {
+		s.Degraded = err.Error()
+	}
+	if n, lag := t.indexLag(); n > 0 {
+		s.Unindexed, s.IndexLag = n, lag.Round(time.Second).String()
+	}
+	for name, b := range t.files {
+		s.Bytes += b.Size()
+		if ts, err := t.fileTimestamp(name); err == nil && (s.Oldest.IsZero() || ts.Before(s.Oldest)) {
+			s.Oldest = ts
+		}
+	}
+	return s
+}
+
+// VerifyIndexes reads through the index of every file this thread tracks,
+// returning how many it checked and why each bad one failed.  Bad files are
+// quarantined the next time the thread syncs with disk.  Files are pinned
+// rather than verified under t.mu, so syncing and cleanup carry on meanwhile,
+// and each is unpinned once checked, so deleted files' space is freed.
+func (t *Thread) VerifyIndexes(ctx context.Context) (checked int, failed map[string]error, _ error) {
+	var names []string
+	var files []*blockfile.BlockFile
+	t.mu.RLock()
+	for _, name := range t.getSortedFiles() {
+		if bf := t.files[name]; bf.Pin() {
+			names = append(names, name)
+			files = append(files, bf)
+		}
+	}
+	t.mu.RUnlock()
+	failed = map[string]error{}
+	for i, bf := range files {
+		err := bf.Verify(ctx)
+		bf.Unpin()
+		if ctx.Err() != nil {
+			for _, rest := range files[i+1:] {
+				rest.Unpin()
+			}
+			return checked, failed, ctx.Err()
+		} else if err != nil {
+			failed[names[i]] = err
+		}
+		checked++
+	}
+	return checked, failed, nil
+}
+
 // FileLastSeen returns the last timne this thread saw a new file from
 // stenotype.
 func (t *Thread) FileLastSeen() time.Time {
@@ -325,43 +873,630 @@ func (t *Thread) FileLastSeen() time.Time {
 	return t.fileLastSeen
 }
 
-const concurrentBlockfileReadsPerThread = 10
+// lookupReadAheadPerThread bounds how many files' index lookups may finish
+// ahead of the file whose packets are being read.
+const lookupReadAheadPerThread = 4
+
+// maxCleanupCycles limits how far ahead /debug/t<id>/cleanup will simulate.
+const maxCleanupCycles = 10000
 
 // Lookup looks up packets that match a given query within the files owned by a
-// single stenotype thread.
+// single stenotype thread, including the completed blocks of files stenotype
+// is still writing.
 func (t *Thread) Lookup(ctx context.Context, q query.Query) *base.PacketChan {
+	_, span := tracing.Start(ctx, "plan")
+	files, untracked := t.currentFiles()
+	files = t.addLaggingFiles(ctx, q, files, untracked)
+	t.endPlan(span, files)
+	return t.lookup(ctx, q, files, untracked)
+}
+
+// endPlan ends the span of choosing which files a lookup reads.
+func (t *Thread) endPlan(span *tracing.Span, files []*blockfile.BlockFile) {
+	span.SetAttribute("steno.thread", t.id)
+	span.SetAttribute("steno.files", len(files))
+	span.End()
+}
+
+// Estimate estimates the size of the results of Lookup, from index lookups
+// and the lengths of at most 'samples' packets per file.
+func (t *Thread) Estimate(ctx context.Context, q query.Query, samples int) (est base.Estimate, err error) {
+	files, untracked := t.currentFiles()
+	for _, file := range files {
+		if err == nil {
+			var e base.Estimate
+			e, err = file.Estimate(ctx, q, samples)
+			est.Add(e)
+		}
+		release(file, untracked)
+	}
+	return est, err
+}
+
+// Histogram adds the packets matching a query in the thread's files to 'h'.
+func (t *Thread) Histogram(ctx context.Context, q query.Query, h *base.Histogram) (err error) {
+	files, untracked := t.currentFiles()
+	for _, file := range files {
+		if err == nil {
+			err = file.Histogram(ctx, q, h)
+		}
+		release(file, untracked)
+	}
+	return err
+}
+
+// sourceContext returns the context for looking up a query in one of the
+// thread's files, so it can be limited to the thread or the file's disk.
+func (t *Thread) sourceContext(ctx context.Context, file *blockfile.BlockFile) context.Context {
+	return base.WithCaptureSource(ctx, base.CaptureSource{Thread: t.id, Directory: filepath.Dir(file.Name())})
+}
+
+// Positions returns the positions of packets matching a query in each of the
+// thread's files, keyed by the file's index name, for saving as a query set.
+func (t *Thread) Positions(ctx context.Context, q query.Query) (query.FilePositions, error) {
+	files, untracked := t.currentFiles()
+	defer releaseFiles(files, untracked)
+	out := query.FilePositions{}
+	for _, file := range files {
+		name, pos, err := file.SetPositions(t.sourceContext(ctx, file), q)
+		if err != nil {
+			return nil, err
+		} else if pos.Len() > 0 {
+			out[name] = pos
+		}
+	}
+	return out, nil
+}
+
+// Seen returns when packets matching a query were first and last seen in the
+// thread's files, or false if they weren't.  Only the oldest and newest files
+// with matches have their packets read, and only one packet header each.
+func (t *Thread) Seen(ctx context.Context, q query.Query) (first, last time.Time, ok bool, err error) {
+	files, untracked := t.currentFiles()
+	defer releaseFiles(files, untracked)
+	i := 0
+	for ; i < len(files) && !ok; i++ {
+		if first, last, ok, err = files[i].Seen(t.sourceContext(ctx, files[i]), q); err != nil {
+			return first, last, false, err
+		}
+	}
+	for j := len(files) - 1; j >= i && ok; j-- {
+		_, l, found, err := files[j].Seen(t.sourceContext(ctx, files[j]), q)
+		if err != nil {
+			return first, last, false, err
+		} else if found {
+			last = l
+			break
+		}
+	}
+	return first, last, ok, nil
+}
+
+// Drops counts the blocks of the thread's files covering the time range from
+// start to end (either of which may be zero for an open range), and those with
+// packets in the range which were written while the kernel was dropping
+// packets (see BlockFile.Drops).  Files whose blocks can't be read are
+// skipped.
+func (t *Thread) Drops(ctx context.Context, start, end time.Time) (base.DropStats, error) {
+	files, untracked := t.currentFiles()
+	defer releaseFiles(files, untracked)
+	var out base.DropStats
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		first, err := t.fileTimestamp(strings.TrimPrefix(filepath.Base(file.Name()), "."))
+		if err != nil {
+			continue
+		}
+		covers := base.TimeRange{Start: first.Add(-t.opts.ClockSkew), End: file.ModTime().Add(t.opts.ClockSkew)}
+		if !covers.Overlaps(start, end) {
+			continue
+		}
+		d, err := file.Drops()
+		if err != nil {
+			v(1, "Thread %v skipping drops of %q: %v", t.id, file.Name(), err)
+			continue
+		}
+		out.Add(d.Within(start, end))
+	}
+	return out, nil
+}
+
+// currentFiles returns all the files Lookup looks at, in order, along with
+// snapshots of active files.  Tracked files are pinned, so the set stays the
+// same however files are cleaned up while a query reads it.  The caller must
+// release each file with release once it's done with it.
+func (t *Thread) currentFiles() (files []*blockfile.BlockFile, untracked map[*blockfile.BlockFile]bool) {
 	t.mu.RLock()
-	inputs := make(chan *base.PacketChan, concurrentBlockfileReadsPerThread)
-	out := base.ConcatPacketChans(ctx, inputs)
-	var files []*blockfile.BlockFile
 	for _, file := range t.getSortedFiles() {
-		files = append(files, t.files[file])
+		if bf := t.files[file]; bf.Pin() {
+			files = append(files, bf)
+		}
+	}
+	var activeNames []string
+	for name := range t.active {
+		activeNames = append(activeNames, name)
+	}
+	sort.Strings(activeNames)
+	var active []*blockfile.ActiveFile
+	for _, name := range activeNames {
+		active = append(active, t.active[name])
 	}
 	t.mu.RUnlock()
+	// Snapshots index new blocks, so take them outside the lock.
+	untracked = map[*blockfile.BlockFile]bool{}
+	for _, af := range active {
+		bf, err := af.Snapshot()
+		if err != nil {
+			v(1, "Thread %v: %v", t.id, err)
+			continue
+		}
+		files = append(files, bf)
+		untracked[bf] = true
+	}
+	return files, untracked
+}
+
+// release releases a file from currentFiles or LookupFiles once a query is
+// done with it, closing it if it's untracked, and otherwise unpinning it.
+func release(file *blockfile.BlockFile, untracked map[*blockfile.BlockFile]bool) {
+	if untracked[file] {
+		file.Close()
+	} else {
+		file.Unpin()
+	}
+}
+
+// releaseFiles releases all of the given files, see release.
+func releaseFiles(files []*blockfile.BlockFile, untracked map[*blockfile.BlockFile]bool) {
+	for _, file := range files {
+		release(file, untracked)
+	}
+}
+
+// SelectFiles resolves an explicit list of blockfiles to query, instead of all
+// files the thread tracks.  Each spec is a path relative to the thread's
+// packets directory, naming either a single blockfile or a directory, which
+// selects every blockfile directly within it.  Blockfiles need an index at
+// the same path relative to the index directory.  This allows querying files
+// stenographer doesn't track, like those restored from an archive into a
+// subdirectory.  SelectFiles returns the selected files, in the order
+// stenotype wrote them, and which specs matched at least one file.
+func (t *Thread) SelectFiles(specs []string) (files []string, matched []bool, _ error) {
+	seen := map[string]bool{}
+	matched = make([]bool, len(specs))
+	for i, spec := range specs {
+		name, err := relativeName(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		fi, err := os.Stat(t.getIndexFilePath(name))
+		if err != nil {
+			continue
+		}
+		names := []string{name}
+		if fi.IsDir() {
+			entries, err := ioutil.ReadDir(t.getIndexFilePath(name))
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not read index directory for %q: %v", spec, err)
+			}
+			names = nil
+			for _, e := range entries {
+				if !e.IsDir() && e.Name()[0] != '.' {
+					names = append(names, filepath.Join(name, e.Name()))
+				}
+			}
+		}
+		for _, name := range names {
+			if _, err := os.Stat(t.getPacketFilePath(name)); err != nil {
+				continue
+			}
+			matched[i] = true
+			if !seen[name] {
+				seen[name] = true
+				files = append(files, name)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if a, b := filepath.Base(files[i]), filepath.Base(files[j]); a != b {
+			return a < b
+		}
+		return files[i] < files[j]
+	})
+	return files, matched, nil
+}
+
+// relativeName returns the cleaned name of a file spec, which must be
+// relative to the packets directory.
+func relativeName(spec string) (string, error) {
+	name := filepath.Clean(spec)
+	if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("file %q must be relative to the packets directory", spec)
+	}
+	return name, nil
+}
+
+// ArchivePrefix marks a name passed to LookupFiles as that of an archived
+// file, see FetchArchived.
+const ArchivePrefix = "archive:"
+
+// FetchArchived fetches the file the thread wrote as 'name' (relative to its
+// packets directory) from its archive, returning false if the archive doesn't
+// have it.  Fetched files may be queried by passing LookupFiles their names
+// prefixed with ArchivePrefix.  Archived files are named individually:  there's
+// no way to list the archive.
+func (t *Thread) FetchArchived(ctx context.Context, name string) (bool, error) {
+	name, err := relativeName(name)
+	if err != nil {
+		return false, err
+	}
+	t.mu.RLock()
+	a := t.archive
+	t.mu.RUnlock()
+	if a == nil {
+		return false, fmt.Errorf("no archive to fetch %q from", name)
+	}
+	if _, _, err := a.Fetch(ctx, t.id, name); err == archive.ErrNotArchived {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("thread %v could not fetch archived %q: %v", t.id, name, err)
+	}
+	return true, nil
+}
+
+// openArchived opens an archived file, fetching it again if it's been evicted
+// from the archive's scratch directory since FetchArchived.
+func (t *Thread) openArchived(ctx context.Context, name string) (*blockfile.BlockFile, error) {
+	t.mu.RLock()
+	a := t.archive
+	t.mu.RUnlock()
+	if a == nil {
+		return nil, fmt.Errorf("no archive to fetch %q from", name)
+	}
+	packets, index, err := a.Fetch(ctx, t.id, name)
+	if err != nil {
+		return nil, err
+	}
+	return blockfile.OpenBlockFile(packets, index, t.fc, t.opts)
+}
+
+// LookupFiles is like Lookup, but only looks at the given files, as returned by
+// SelectFiles, or archived files named with ArchivePrefix.  Files the thread
+// doesn't track are opened for the duration of the lookup, and those it does
+// are pinned, as by Lookup.
+func (t *Thread) LookupFiles(ctx context.Context, q query.Query, names []string) (*base.PacketChan, error) {
+	untracked := map[*blockfile.BlockFile]bool{}
+	var files []*blockfile.BlockFile
+	fail := func(name string, err error) (*base.PacketChan, error) {
+		for bf := range untracked {
+			bf.Close()
+		}
+		for _, bf := range files {
+			if !untracked[bf] {
+				bf.Unpin()
+			}
+		}
+		return nil, fmt.Errorf("could not open blockfile %q: %v", name, err)
+	}
+	// Archived files may need fetching again, so open them before taking the
+	// lock.
+	archived := map[string]*blockfile.BlockFile{}
+	for _, name := range names {
+		if strings.HasPrefix(name, ArchivePrefix) && archived[name] == nil {
+			bf, err := t.openArchived(ctx, strings.TrimPrefix(name, ArchivePrefix))
+			if err != nil {
+				return fail(name, err)
+			}
+			archived[name] = bf
+			untracked[bf] = true
+		}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, span := tracing.Start(ctx, "plan")
+	defer span.End()
+	for _, name := range names {
+		if bf := archived[name]; bf != nil {
+			files = append(files, bf)
+			continue
+		} else if bf := t.files[name]; bf != nil && bf.Pin() {
+			files = append(files, bf)
+			continue
+		}
+		bf, err := blockfile.NewBlockFile(t.getPacketFilePath(name), t.fc, t.opts)
+		if err != nil {
+			return fail(name, err)
+		}
+		files = append(files, bf)
+		untracked[bf] = true
+	}
+	t.endPlan(span, files)
+	return t.lookup(ctx, q, files, untracked), nil
+}
+
+// ReadPackets reads packets from one blockfile by position, as
+// blockfile.ReadPackets does.  The file is named relative to the thread's
+// packets directory, as for SelectFiles, so files the thread doesn't track can
+// be read too.
+func (t *Thread) ReadPackets(ctx context.Context, name string, positions []int64, count int) (*base.PacketChan, error) {
+	files, _, err := t.SelectFiles([]string{name})
+	if err != nil {
+		return nil, err
+	} else if len(files) != 1 || files[0] != filepath.Clean(name) {
+		return nil, fmt.Errorf("no blockfile %q", name)
+	}
+	// Tracked files are pinned, so cleanup can't close them while they're
+	// read at the client's pace.
+	t.mu.RLock()
+	bf := t.files[files[0]]
+	pinned := bf != nil && bf.Pin()
+	t.mu.RUnlock()
+	if !pinned {
+		if bf, err = blockfile.NewBlockFile(t.getPacketFilePath(files[0]), t.fc, t.opts); err != nil {
+			return nil, fmt.Errorf("could not open blockfile %q: %v", name, err)
+		}
+	}
+	out := base.NewPacketChan(100)
 	go func() {
+		bf.ReadPackets(ctx, positions, count, out)
+		if pinned {
+			bf.Unpin()
+		} else {
+			bf.Close()
+		}
+	}()
+	return out, nil
+}
+
+// lookup looks up packets in each of the given files in turn, releasing each
+// once it's been looked at (see release).  If the context has a
+// base.QuerySnapshot, the files are recorded in it.
+//
+// Lookups are pipelined: one goroutine runs index lookups, staying up to
+// lookupReadAheadPerThread files ahead of another, which reads packets from
+// one file at a time.  This hides index latency behind packet reads, without
+// having many files' reads compete for the disk.
+//
+// If the context allows results in arrival order (see base.WithArrivalOrder),
+// up to lookupReadAheadPerThread files are read at once instead, and each
+// one's packets are returned as they're read, so a file with few matches
+// doesn't hold up the first packets of those after it.
+func (t *Thread) lookup(ctx context.Context, q query.Query, files []*blockfile.BlockFile, untracked map[*blockfile.BlockFile]bool) *base.PacketChan {
+	inputs := make(chan *base.PacketChan, 1)
+	arrival := base.ArrivalOrder(ctx)
+	var out *base.PacketChan
+	if arrival {
+		out = base.FanInPacketChans(ctx, inputs)
+	} else {
+		out = base.ConcatPacketChans(ctx, inputs)
+	}
+	timings := base.QueryTimingsFrom(ctx)
+	progress := base.QueryProgressFrom(ctx)
+	snapshot := base.QuerySnapshotFrom(ctx)
+	fileStart := func(file *blockfile.BlockFile) time.Time {
+		ts, _ := t.fileTimestamp(strings.TrimPrefix(filepath.Base(file.Name()), "."))
+		return ts
+	}
+	fileCtxs := make([]context.Context, len(files))
+	for i, file := range files {
+		snapshot.Add(base.SnapshotFile{Thread: t.id, File: file.Name(), Size: file.Size(), ModTime: file.ModTime()})
+		fileCtxs[i] = t.sourceContext(ctx, file)
+		if timings != nil {
+			fileCtxs[i] = base.WithFileTimings(fileCtxs[i], timings.File(t.id, file.Name()))
+		}
+		if progress != nil {
+			progress.Start(t.id, file.Name(), fileStart(file))
+		}
+	}
+	pin := func() {
+		if t.queryCPUs != nil {
+			if err := base.PinToCPUs(t.queryCPUs); err != nil {
+				v(1, "Thread %v: %v", t.id, err)
+			}
+		}
+		if t.queryIOPrio != nil {
+			if err := base.SetIOPriority(*t.queryIOPrio); err != nil {
+				v(1, "Thread %v: %v", t.id, err)
+			}
+		}
+	}
+
+	pending := make(chan *blockfile.PendingLookup, lookupReadAheadPerThread)
+	go func() {
+		defer close(pending)
+		pin()
+		for i, file := range files {
+			p := file.LookupPositions(fileCtxs[i], q)
+			select {
+			case pending <- p:
+			case <-ctx.Done():
+				p.Discard()
+				return
+			}
+		}
+	}()
+	go func() {
+		read := 0
+		var reading sync.WaitGroup // Reads of files in arrival order.
+		readers := make(chan struct{}, lookupReadAheadPerThread)
 		defer func() {
 			close(inputs)
+			for p := range pending {
+				p.Discard()
+			}
 			<-out.Done()
+			reading.Wait()
+			for _, file := range files[read:] {
+				release(file, untracked)
+			}
 		}()
-		for _, file := range files {
+		pin()
+		for p := range pending {
+			i, file := read, files[read]
 			packets := base.NewPacketChan(100)
 			select {
 			case inputs <- packets:
-				go file.Lookup(ctx, q, packets)
 			case <-ctx.Done():
+				p.Discard()
 				return
 			}
+			read++
+			p := p // May be read concurrently, in arrival order.
+			readFile := func() {
+				p.Read(fileCtxs[i], packets)
+				if progress != nil && ctx.Err() == nil {
+					progress.Finish(t.id, file.Name(), fileStart(file))
+				}
+				release(file, untracked)
+			}
+			if !arrival {
+				readFile()
+				continue
+			}
+			readers <- struct{}{}
+			reading.Add(1)
+			go func() {
+				defer func() {
+					<-readers
+					reading.Done()
+				}()
+				pin()
+				readFile()
+			}()
 		}
 	}()
 	return out
 }
 
+// cleanupFile describes a blockfile for cleanup simulation.  Future files,
+// which haven't been written yet, have no name.
+type cleanupFile struct {
+	name       string
+	start, end time.Time
+	size       int64
+}
+
+// cleanupCycle describes what a single simulated cleanup cycle would do.
+type cleanupCycle struct {
+	at          time.Time
+	freePercent int
+	deleted     []cleanupFile
+}
+
+// simulateCleanup predicts the files deleted by the next 'cycles' cleanup
+// cycles, assuming that a new file of the same size as the average of the
+// last few is written each cycle, at the same rate as those last few were.
+// It follows the same rules as cleanUpOnLowDiskSpace.  'files' must be sorted
+// oldest first.
+func simulateCleanup(files []cleanupFile, avail, total int64, conf config.ThreadConfig, cycles int, now time.Time) (out []cleanupCycle) {
+	const recentFiles = 10
+	var size int64
+	interval := time.Minute
+	recent := files
+	if len(recent) > recentFiles {
+		recent = recent[len(recent)-recentFiles:]
+	}
+	for _, f := range recent {
+		size += f.size
+	}
+	if len(recent) > 0 {
+		size /= int64(len(recent))
+	}
+	if len(recent) > 1 {
+		interval = recent[len(recent)-1].start.Sub(recent[0].start) / time.Duration(len(recent)-1)
+	}
+	files = append([]cleanupFile{}, files...)
+	percent := func() int {
+		if total <= 0 {
+			return 0
+		}
+		return int(100 * avail / total)
+	}
+	for i := 1; i <= cycles; i++ {
+		c := cleanupCycle{at: now.Add(time.Duration(i) * interval)}
+		files = append(files, cleanupFile{start: c.at, end: c.at.Add(interval), size: size})
+		avail -= size
+		deleteOldest := func(n int) {
+			for _, f := range files[:n] {
+				avail += f.size
+				c.deleted = append(c.deleted, f)
+			}
+			files = files[n:]
+		}
+		if len(files) > conf.MaxDirectoryFiles {
+			deleteOldest(len(files) - conf.MaxDirectoryFiles)
+		}
+		for len(files) > 0 && percent() <= conf.DiskFreePercentage {
+			// Like pruneOldestThreadFiles, free up at least the newest file's
+			// size.
+			var freed int64
+			n := 0
+			for freed <= files[len(files)-1].size && n < len(files) {
+				freed += files[n].size
+				n++
+			}
+			deleteOldest(n)
+		}
+		c.freePercent = percent()
+		out = append(out, c)
+	}
+	return out
+}
+
+// SimulateCleanup writes out which files the next 'cycles' cleanup cycles
+// would delete at current disk usage and write rates.
+func (t *Thread) SimulateCleanup(out io.Writer, cycles int) error {
+	avail, total, err := base.PathDiskSpace(t.packetPath)
+	if err != nil {
+		return fmt.Errorf("could not get disk space for %q: %v", t.packetPath, err)
+	}
+	t.mu.RLock()
+	var files []cleanupFile
+	// Files under legal hold keep using their disk space, but are never deleted.
+	for _, name := range t.getDeletableFiles() {
+		start, err := t.fileTimestamp(name)
+		if err != nil {
+			continue
+		}
+		bf := t.files[name]
+		files = append(files, cleanupFile{name: name, start: start, end: bf.ModTime(), size: bf.Size()})
+	}
+	t.mu.RUnlock()
+	if total <= 0 {
+		return fmt.Errorf("no disk space reported for %q", t.packetPath)
+	}
+	fmt.Fprintf(out, "Thread %d (PKT: %q): %d files, %d%% free, deleting at or below %d%% free or above %d files\n",
+		t.id, t.packetPath, len(files), 100*avail/total, t.conf.DiskFreePercentage, t.conf.MaxDirectoryFiles)
+	for i, c := range simulateCleanup(files, avail, total, t.conf, cycles, time.Now()) {
+		fmt.Fprintf(out, "Cycle %d (~%v): %d%% free after deleting %d files\n",
+			i+1, c.at.Format(time.RFC3339), c.freePercent, len(c.deleted))
+		for _, f := range c.deleted {
+			name := f.name
+			if name == "" {
+				name = "(future file)"
+			}
+			fmt.Fprintf(out, "\t%v\t%v - %v\t%d bytes\n",
+				name, f.start.Format(time.RFC3339), f.end.Format(time.RFC3339), f.size)
+		}
+	}
+	return nil
+}
+
 // SyncFiles checks the disk to see if stenotype has created any new files, or
-// if old files should be deleted.
+// if old files should be deleted.  If the thread's disk has failed, it's
+// marked degraded instead (see Degraded), and isn't synced until it recovers.
 func (t *Thread) SyncFiles() {
+	if !t.checkDisk() {
+		return
+	}
 	t.mu.Lock()
 	t.syncFilesWithDisk()
+	t.syncActiveFiles()
+	t.queueExports()
 	t.cleanUpOnLowDiskSpace()
+	t.maybeWriteManifest()
 	t.mu.Unlock()
 }
 
@@ -376,10 +1511,39 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 		fmt.Fprintf(w, "Thread %d (IDX: %q, PKT: %q)\n", t.id, t.indexPath, t.packetPath)
 		t.mu.RLock()
 		for name := range t.files {
-			fmt.Fprintf(w, "\t%v\n", name)
+			line := "\t" + name
+			if labels := t.fileLabels(name); len(labels) > 0 {
+				line += fmt.Sprintf("\t%q", labels)
+			}
+			if reason, ok := t.skewed[name]; ok {
+				line += "\tclock skew: " + reason
+			}
+			switch t.exportStates[name] {
+			case exportQueued:
+				line += "\texport queued"
+			case exportDone:
+				line += "\texported"
+			}
+			fmt.Fprintln(w, line)
 		}
 		t.mu.RUnlock()
 	})
+	mux.HandleFunc(prefix+"/cleanup", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		cycles := 10
+		if c := r.URL.Query().Get("cycles"); c != "" {
+			var err error
+			if cycles, err = strconv.Atoi(c); err != nil || cycles < 1 || cycles > maxCleanupCycles {
+				http.Error(w, "bad cycles", http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		if err := t.SimulateCleanup(w, cycles); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
 	mux.HandleFunc(prefix+"/index", func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, false)
 		defer log.Print(w)
@@ -407,8 +1571,35 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 				return
 			}
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		file.DumpIndex(w, start, finish)
+		format := vals.Get("format")
+		switch format {
+		case "", indexfile.DumpText:
+			format = indexfile.DumpText
+			w.Header().Set("Content-Type", "text/plain")
+		case indexfile.DumpJSON:
+			w.Header().Set("Content-Type", "application/json")
+		case indexfile.DumpCSV:
+			w.Header().Set("Content-Type", "text/csv")
+		default:
+			http.Error(w, "bad format", http.StatusBadRequest)
+			return
+		}
+		if err := file.DumpIndex(w, start, finish, format); err != nil {
+			fmt.Fprintf(w, "ERROR: %v", err)
+		}
+	})
+	mux.HandleFunc(prefix+"/stats", func(w http.ResponseWriter, r *http.Request) {
+		w = httputil.Log(w, r, false)
+		defer log.Print(w)
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		file := t.files[r.URL.Query().Get("name")]
+		if file == nil {
+			http.Error(w, "file not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(file.IndexStats())
 	})
 	mux.HandleFunc(prefix+"/packets", func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, false)
@@ -427,7 +1618,7 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 			return
 		}
 		w.Header().Set("Content-Type", "application/octet-stream")
-		base.PacketsToFile(file.AllPackets(), w, limit)
+		base.PacketsToFile(file.AllPackets(r.Context()), w, limit)
 	})
 	mux.HandleFunc(prefix+"/positions", func(w http.ResponseWriter, r *http.Request) {
 		w = httputil.Log(w, r, true)
@@ -446,13 +1637,13 @@ func (t *Thread) ExportDebugHandlers(mux *http.ServeMux) {
 			return
 		}
 		queryStr := string(queryBytes)
-		q, err := query.NewQuery(queryStr)
+		q, err := t.parser.Parse(queryStr)
 		if err != nil {
 			http.Error(w, "could not parse query", http.StatusBadRequest)
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain")
-		positions, err := file.Positions(context.Background(), q)
+		positions, err := file.Positions(t.sourceContext(context.Background(), file), q)
 		if err != nil {
 			fmt.Fprintf(w, "ERROR: %v", err)
 			return
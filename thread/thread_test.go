@@ -15,17 +15,33 @@
 package thread
 
 import (
+	"bytes"
+	"compress/gzip"
 	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/google/stenographer/config"
-	"github.com/google/stenographer/filecache"
+	"github.com/mars-suite/stenographer/archive"
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/blockfile"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/export"
+	"github.com/mars-suite/stenographer/filecache"
+	"github.com/mars-suite/stenographer/indexfile"
+	"github.com/mars-suite/stenographer/labels"
+	"github.com/mars-suite/stenographer/query"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -38,9 +54,14 @@ const (
 
 func createThreads(t *testing.T, tempDir string) []*Thread {
 	var tc = []config.ThreadConfig{
-		{tempDir + pktDir, tempDir + idxDir, 10, 10},
+		{
+			PacketsDirectory:   tempDir + pktDir,
+			IndexDirectory:     tempDir + idxDir,
+			DiskFreePercentage: 10,
+			MaxDirectoryFiles:  10,
+		},
 	}
-	threads, err := Threads(tc, tempDir+baseDir, filecache.NewCache(10))
+	threads, err := Threads(tc, tempDir+baseDir, filecache.NewCache(10), blockfile.DefaultOptions(), &query.Parser{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -177,3 +198,690 @@ func TestExportDebugHandlers(t *testing.T) {
 		}
 	}
 }
+
+func TestClockSkewReason(t *testing.T) {
+	at := func(sec int64) time.Time { return time.Unix(sec, 0) }
+	for _, test := range []struct {
+		prevEnd, start, end time.Time
+		skewed              bool
+	}{
+		{time.Time{}, at(100), at(160), false},
+		{at(99), at(100), at(160), false},
+		{at(130), at(100), at(160), false},   // within skew
+		{at(200), at(100), at(160), true},    // clock stepped back between files
+		{time.Time{}, at(100), at(30), true}, // clock stepped back within file
+	} {
+		reason := clockSkewReason(test.prevEnd, test.start, test.end, time.Minute)
+		if got := reason != ""; got != test.skewed {
+			t.Errorf("clockSkewReason(%v, %v, %v) = %q, want skewed=%v", test.prevEnd, test.start, test.end, reason, test.skewed)
+		}
+	}
+}
+
+func TestSimulateCleanup(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var files []cleanupFile
+	for i := 0; i < 5; i++ {
+		at := start.Add(time.Duration(i) * time.Minute)
+		files = append(files, cleanupFile{name: strconv.Itoa(i), start: at, end: at.Add(time.Minute), size: 10})
+	}
+	conf := config.ThreadConfig{DiskFreePercentage: 10, MaxDirectoryFiles: 4}
+	// 25/100 free, each new file takes 10.
+	cycles := simulateCleanup(files, 25, 100, conf, 3, start.Add(5*time.Minute))
+	var got [][]string
+	for _, c := range cycles {
+		var names []string
+		for _, f := range c.deleted {
+			names = append(names, f.name)
+		}
+		got = append(got, names)
+	}
+	// Cycle 1: 6 files > 4, delete 2 (35% free).  Cycle 2: too many files
+	// again, delete 1 (35% free).  Cycle 3: same again.
+	want := [][]string{{"0", "1"}, {"2"}, {"3"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong deletions:\nwant: %q\ngot:  %q", want, got)
+	}
+	if at := cycles[0].at; !at.Equal(start.Add(6 * time.Minute)) {
+		t.Errorf("wrong cycle time %v", at)
+	}
+	// With plenty of files allowed, only disk space matters: 5% free after
+	// the first new file, so delete the oldest two (freeing more than the
+	// newest file's size).
+	conf.MaxDirectoryFiles = 100
+	cycles = simulateCleanup(files, 15, 100, conf, 1, start.Add(5*time.Minute))
+	if n := len(cycles[0].deleted); n != 2 || cycles[0].freePercent != 25 {
+		t.Errorf("wrong disk space cleanup: deleted %d, %d%% free", n, cycles[0].freePercent)
+	}
+}
+
+func TestSelectFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	for src, dst := range map[string]string{
+		testBlockFile: tempDir + pktDir + "restored/",
+		testIndexFile: tempDir + idxDir + "restored/",
+	} {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := exec.Command("cp", src, dst+"1420000000000000").Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	thread := createThreads(t, tempDir)[0]
+	thread.SyncFiles()
+	for _, test := range []struct {
+		specs   []string
+		files   []string
+		matched []bool
+	}{
+		{[]string{"dhcp"}, []string{"dhcp"}, []bool{true}},
+		{[]string{"restored/", "missing"}, []string{"restored/1420000000000000"}, []bool{true, false}},
+		// Directories aren't searched recursively.
+		{[]string{"."}, []string{"dhcp"}, []bool{true}},
+		{[]string{"restored/1420000000000000", "dhcp"}, []string{"restored/1420000000000000", "dhcp"}, []bool{true, true}},
+	} {
+		files, matched, err := thread.SelectFiles(test.specs)
+		if err != nil {
+			t.Errorf("%q: %v", test.specs, err)
+			continue
+		}
+		if !reflect.DeepEqual(files, test.files) || !reflect.DeepEqual(matched, test.matched) {
+			t.Errorf("%q: want %q %v got %q %v", test.specs, test.files, test.matched, files, matched)
+		}
+	}
+	for _, bad := range []string{"/etc/passwd", "../idx/dhcp"} {
+		if _, _, err := thread.SelectFiles([]string{bad}); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := thread.LookupFiles(context.Background(), q, []string{"restored/1420000000000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for range packets.Receive() {
+		count++
+	}
+	if err := packets.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("wrong number of packets: want 4 got %d", count)
+	}
+}
+
+func TestArchivedFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	data, err := ioutil.ReadFile(testBlockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	index, err := ioutil.ReadFile(testIndexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/0/packets/2015/dhcp.gz":
+			w.Write(gz.Bytes())
+		case "/0/index/2015/dhcp":
+			w.Write(index)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	a, err := archive.NewFetcher(srv.URL, tempDir+"/scratch", 8<<20, srv.Client(), "zstd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thread := createThreads(t, tempDir)[0]
+	thread.SetArchive(a)
+	ctx := context.Background()
+	if ok, err := thread.FetchArchived(ctx, "2015/dhcp"); !ok || err != nil {
+		t.Fatalf("fetching archived file got %v, %v", ok, err)
+	}
+	if ok, err := thread.FetchArchived(ctx, "2015/missing"); ok || err != nil {
+		t.Errorf("fetching missing file got %v, %v", ok, err)
+	}
+	if _, err := thread.FetchArchived(ctx, "../idx/dhcp"); err == nil {
+		t.Error("fetched file outside the packets directory")
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, err := thread.LookupFiles(ctx, q, []string{ArchivePrefix + "2015/dhcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for range packets.Receive() {
+		count++
+	}
+	if err := packets.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("wrong number of packets: want 4 got %d", count)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	thread := createThreads(t, tempDir)[0]
+	thread.SyncFiles()
+	// Break the index's data blocks, which are only read on lookup.
+	if err := os.Truncate(tempDir+idxDir+"dhcp", 100); err != nil {
+		t.Fatal(err)
+	}
+	statsPath := indexfile.StatsPath(tempDir + idxDir + "dhcp")
+	if err := os.MkdirAll(filepath.Dir(statsPath), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(statsPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := &base.QueryWarnings{}
+	packets := thread.Lookup(base.WithQueryWarnings(context.Background(), warnings), q)
+	for range packets.Receive() {
+		t.Errorf("got packet from corrupt file")
+	}
+	if err := packets.Err(); err != nil {
+		t.Errorf("corrupt file failed query: %v", err)
+	}
+	if list := warnings.List(); len(list) != 1 || !strings.HasSuffix(list[0].File, "dhcp") {
+		t.Errorf("wrong warnings: %+v", list)
+	}
+	thread.SyncFiles()
+	if len(thread.files) != 0 {
+		t.Errorf("corrupt file still tracked")
+	}
+	for _, dir := range []string{pktDir, idxDir} {
+		if _, err := os.Stat(tempDir + dir + "quarantine/dhcp"); err != nil {
+			t.Errorf("file not quarantined: %v", err)
+		}
+	}
+	if _, err := os.Stat(statsPath); !os.IsNotExist(err) {
+		t.Errorf("derived file left behind: %v", err)
+	}
+	if files, _, err := thread.SelectFiles([]string{"quarantine/"}); err != nil || len(files) != 1 {
+		t.Errorf("quarantined file not selectable: %v %v", files, err)
+	}
+}
+
+func TestDiskFailure(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	thread := createThreads(t, tempDir)[0]
+	thread.SyncFiles()
+	if err := thread.Degraded(); err != nil {
+		t.Fatalf("healthy thread degraded: %v", err)
+	}
+	// Take the disk away, as unmounting it would.
+	if err := os.Rename(tempDir+idxDir, tempDir+"/offline"); err != nil {
+		t.Fatal(err)
+	}
+	thread.SyncFiles()
+	if thread.Degraded() == nil {
+		t.Fatalf("thread not degraded without its index directory")
+	} else if st := thread.Status(); st.Degraded == "" || st.Files != 1 {
+		t.Errorf("wrong status of degraded thread: %+v", st)
+	}
+	if err := os.Rename(tempDir+"/offline", tempDir+idxDir); err != nil {
+		t.Fatal(err)
+	}
+	thread.SyncFiles()
+	if err := thread.Degraded(); err != nil {
+		t.Errorf("thread still degraded after recovery: %v", err)
+	}
+	// Stenotype can be pointed at just this thread, renumbered.
+	linked := filepath.Join(tempDir, "linked")
+	if err := os.Mkdir(linked, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := thread.Link(linked, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(linked, "IDX3", "dhcp")); err != nil {
+		t.Errorf("index not linked: %v", err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	thread := createThreads(t, tempDir)[0]
+	thread.SyncFiles()
+	if _, err := os.Stat(ManifestPath(tempDir + idxDir)); err != nil {
+		t.Fatalf("manifest not written: %v", err)
+	}
+	size, mod := thread.files["dhcp"].Size(), thread.files["dhcp"].ModTime()
+	for _, link := range []string{packetPrefix + "0", indexPrefix + "0"} {
+		if err := os.Remove(tempDir + baseDir + link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A restarted thread tracks the file from its manifest, without opening
+	// it, so a broken index isn't noticed until it's used.
+	restarted := createThreads(t, tempDir)[0]
+	if err := os.Truncate(tempDir+idxDir+"dhcp", 100); err != nil {
+		t.Fatal(err)
+	}
+	restarted.SyncFiles()
+	bf := restarted.files["dhcp"]
+	if bf == nil {
+		t.Fatal("file in manifest not tracked")
+	} else if bf.Size() != size || !bf.ModTime().Equal(mod) {
+		t.Errorf("file from manifest has size %d, mod %v, want %d, %v", bf.Size(), bf.ModTime(), size, mod)
+	}
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := &base.QueryWarnings{}
+	packets := restarted.Lookup(base.WithQueryWarnings(context.Background(), warnings), q)
+	for range packets.Receive() {
+		t.Errorf("got packet from corrupt file")
+	}
+	if list := warnings.List(); len(list) != 1 {
+		t.Errorf("wrong warnings: %+v", list)
+	}
+}
+
+func TestLegalHold(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	// Make three copies of the test file, the oldest of which is held.
+	names := []string{"1000000", "2000000", "3000000"}
+	for _, dir := range []string{pktDir, idxDir} {
+		for _, name := range names {
+			if err := exec.Command("cp", tempDir+dir+"dhcp", tempDir+dir+name).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Remove(tempDir + dir + "dhcp")
+	}
+	threads, err := Threads([]config.ThreadConfig{{
+		PacketsDirectory:   tempDir + pktDir,
+		IndexDirectory:     tempDir + idxDir,
+		DiskFreePercentage: 0,
+		MaxDirectoryFiles:  2,
+	}}, tempDir+baseDir, filecache.NewCache(10), blockfile.DefaultOptions(), &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := labels.Open(tempDir + "/labels.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Add(labels.Label{Name: "case-1", File: names[0], Hold: true}); err != nil {
+		t.Fatal(err)
+	}
+	thread := threads[0]
+	thread.SetLabels(store)
+	thread.SyncFiles()
+	var got []string
+	for name := range thread.files {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	if want := []string{names[0], names[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v after cleanup, want %v", got, want)
+	}
+}
+
+// fakeExporter fails to export the files in 'fail'.
+type fakeExporter struct {
+	fail map[string]bool
+}
+
+func (e fakeExporter) String() string { return "fake export" }
+
+func (e fakeExporter) Export(ctx context.Context, f export.File) error {
+	if e.fail[f.Name] {
+		return errors.New("export failed")
+	}
+	return nil
+}
+
+func TestExportBeforeDelete(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	names := []string{"1000000", "2000000", "3000000"}
+	for _, dir := range []string{pktDir, idxDir} {
+		for _, name := range names {
+			if err := exec.Command("cp", tempDir+dir+"dhcp", tempDir+dir+name).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Remove(tempDir + dir + "dhcp")
+	}
+	threads, err := Threads([]config.ThreadConfig{{
+		PacketsDirectory:   tempDir + pktDir,
+		IndexDirectory:     tempDir + idxDir,
+		DiskFreePercentage: 0,
+		MaxDirectoryFiles:  2,
+	}}, tempDir+baseDir, filecache.NewCache(10), blockfile.DefaultOptions(), &query.Parser{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exportRetryDelay = 0 // Left as is, since the export goroutine outlives the test.
+	thread := threads[0]
+	thread.SetExporters([]export.Exporter{fakeExporter{fail: map[string]bool{names[0]: true}}}, true)
+	files := func() (out []string) {
+		for name := range thread.files {
+			out = append(out, name)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	// Nothing has been exported yet, so nothing can be deleted.
+	thread.SyncFiles()
+	if got := files(); !reflect.DeepEqual(got, names) {
+		t.Errorf("got files %v before export, want %v", got, names)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		thread.mu.RLock()
+		done := thread.exportStates[names[0]] == 0 && thread.exportStates[names[1]] == exportDone
+		thread.mu.RUnlock()
+		if done {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("exports didn't finish")
+		}
+	}
+
+	// The failed export is kept for retry, so the next oldest file goes.
+	thread.SyncFiles()
+	if got, want := files(), []string{names[0], names[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v after cleanup, want %v", got, want)
+	}
+}
+
+func TestTier(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	names := []string{"1000000", "2000000", "3000000"}
+	for _, dir := range []string{pktDir, idxDir} {
+		for _, name := range names {
+			if err := exec.Command("cp", tempDir+dir+"dhcp", tempDir+dir+name).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Remove(tempDir + dir + "dhcp")
+	}
+	thread := createThreads(t, tempDir)[0]
+	if _, err := thread.Tier(context.Background(), time.Time{}, time.Unix(10, 0), false); err == nil {
+		t.Errorf("tiered without exporters")
+	}
+	// Track the files without queueing them for export.
+	thread.mu.Lock()
+	thread.syncFilesWithDisk()
+	thread.mu.Unlock()
+	thread.SetExporters([]export.Exporter{fakeExporter{fail: map[string]bool{names[0]: true}}}, true)
+	exportRetryDelay = 0
+
+	// Only files started by the end of the range are tiered.
+	got, err := thread.Tier(context.Background(), time.Time{}, time.Unix(2, 500e6), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TieredFile{
+		{Thread: 0, File: names[0], Error: "export failed"},
+		{Thread: 0, File: names[1], Evicted: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got tiered files %+v, want %+v", got, want)
+	}
+	thread.mu.RLock()
+	defer thread.mu.RUnlock()
+	if thread.files[names[1]] != nil || thread.files[names[0]] == nil || thread.files[names[2]] == nil {
+		t.Errorf("wrong files evicted")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	names := []string{"1000000", "2000000", "3000000"}
+	for _, dir := range []string{pktDir, idxDir} {
+		for _, name := range names {
+			if err := exec.Command("cp", tempDir+dir+"dhcp", tempDir+dir+name).Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Remove(tempDir + dir + "dhcp")
+	}
+	thread := createThreads(t, tempDir)[0]
+	thread.SyncFiles()
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &base.QuerySnapshot{}
+	packets := thread.Lookup(base.WithQuerySnapshot(context.Background(), snapshot), q)
+
+	// Files cleaned up while the query runs are still read by it.
+	thread.conf.MaxDirectoryFiles = 1
+	thread.SyncFiles()
+	if len(thread.files) != 1 {
+		t.Fatalf("got %d files after cleanup, want 1", len(thread.files))
+	}
+	count := 0
+	for range packets.Receive() {
+		count++
+	}
+	if err := packets.Err(); err != nil {
+		t.Fatal(err)
+	} else if count != 12 {
+		t.Errorf("got %d packets, want 12", count)
+	}
+	var got []string
+	for _, f := range snapshot.List() {
+		got = append(got, filepath.Base(f.File))
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("got snapshot %v, want %v", got, names)
+	}
+	// Once the query's done with them, they're deleted.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := os.Stat(tempDir + pktDir + names[0])
+		if os.IsNotExist(err) {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("cleaned up file not deleted after query")
+		}
+	}
+}
+
+func TestActiveFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	thread := createThreads(t, tempDir)[0]
+	count := func() int {
+		q, err := query.NewQuery("port 67")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := thread.Lookup(context.Background(), q)
+		n := 0
+		for range out.Receive() {
+			n++
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	thread.SyncFiles()
+	if got := count(); got != 4 {
+		t.Fatalf("got %d packets from finished file, want 4", got)
+	}
+	// Stenotype writes to a hidden file, renames it when done, then writes its
+	// index.  Its packets should be found exactly once at each step.
+	pkt := tempDir + pktDir
+	if err := exec.Command("cp", pkt+"dhcp", pkt+".4000000").Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []func() error{
+		func() error { return nil },
+		func() error { return os.Rename(pkt+".4000000", pkt+"4000000") },
+		func() error { return exec.Command("cp", tempDir+idxDir+"dhcp", tempDir+idxDir+"4000000").Run() },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+		thread.SyncFiles()
+		if got := count(); got != 8 {
+			t.Errorf("got %d packets, want 8", got)
+		}
+	}
+	if len(thread.active) != 0 {
+		t.Errorf("still following %d files once finished", len(thread.active))
+	}
+}
+
+func TestArrivalOrder(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyData(t, tempDir)
+	defer rmData(t, tempDir)
+	for _, dir := range []string{pktDir, idxDir} {
+		if err := exec.Command("cp", tempDir+dir+"dhcp", tempDir+dir+"dhcp2").Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	thread := createThreads(t, tempDir)[0]
+	thread.SyncFiles()
+	q, err := query.NewQuery("port 67")
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func(ctx context.Context) int {
+		packets := thread.Lookup(ctx, q)
+		n := 0
+		for range packets.Receive() {
+			n++
+		}
+		if err := packets.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	ordered, arrival := count(context.Background()), count(base.WithArrivalOrder(context.Background()))
+	if ordered == 0 || arrival != ordered {
+		t.Errorf("got %d packets in arrival order, %d in time order", arrival, ordered)
+	}
+}
+
+func TestIndexLag(t *testing.T) {
+	for _, test := range []struct {
+		policy   string
+		index    bool // Whether the index is written between sync and lookup.
+		want     int
+		warnings int
+	}{
+		{LagReport, false, 4, 1},
+		{LagReport, true, 8, 0},
+		{LagWait, false, 4, 1},
+		{LagScan, false, 8, 0},
+	} {
+		tempDir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copyData(t, tempDir)
+		// A finished file whose index hasn't been written yet.
+		if err := exec.Command("cp", tempDir+pktDir+"dhcp", tempDir+pktDir+"4000000").Run(); err != nil {
+			t.Fatal(err)
+		}
+		thread := createThreads(t, tempDir)[0]
+		thread.SetIndexLag(test.policy, 10*time.Millisecond)
+		thread.SyncFiles()
+		if s := thread.Status(); s.Unindexed != 1 {
+			t.Errorf("%v: got %d unindexed files, want 1", test.policy, s.Unindexed)
+		}
+		if test.index {
+			if err := exec.Command("cp", tempDir+idxDir+"dhcp", tempDir+idxDir+"4000000").Run(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		q, err := query.NewQuery("port 67")
+		if err != nil {
+			t.Fatal(err)
+		}
+		warnings := &base.QueryWarnings{}
+		out := thread.Lookup(base.WithQueryWarnings(context.Background(), warnings), q)
+		n := 0
+		for range out.Receive() {
+			n++
+		}
+		if err := out.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if n != test.want || len(warnings.List()) != test.warnings {
+			t.Errorf("%v (index %v): got %d packets and warnings %v, want %d packets and %d warnings", test.policy, test.index, n, warnings.List(), test.want, test.warnings)
+		}
+		rmData(t, tempDir)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package thread
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mars-suite/stenographer/events"
+	"github.com/mars-suite/stenographer/export"
+	"github.com/mars-suite/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	tieredFiles  = stats.S.Get("tiered_files")
+	evictedFiles = stats.S.Get("evicted_files")
+)
+
+// TieredFile reports on one file Tier exported.
+type TieredFile struct {
+	Thread int
+	File   string
+	// Evicted is whether the local copy was deleted once it was exported.
+	Evicted bool `json:",omitempty"`
+	// Error is why the file couldn't be exported, if it couldn't.
+	Error string `json:",omitempty"`
+}
+
+// Tier runs the thread's exporters now on every file with packets between
+// start and end (either of which may be zero for an open range), rather than
+// waiting until the files are about to be deleted, so an operator can move a
+// time range to the export tier ahead of time, like before a planned traffic
+// surge.  Files already exported are skipped.  With 'evict', each file is then
+// deleted locally, unless it's under legal hold, freeing its space straight
+// away.  It fails if the thread has no exporters.
+func (t *Thread) Tier(ctx context.Context, start, end time.Time, evict bool) ([]TieredFile, error) {
+	t.mu.Lock()
+	if t.exporters == nil {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("thread %v has no exporters", t.id)
+	}
+	var names []string
+	for _, name := range t.getSortedFiles() {
+		first, err := t.fileTimestamp(name)
+		if err != nil || t.exportStates[name] == exportDone {
+			continue
+		} else if !end.IsZero() && first.After(end) {
+			continue
+		} else if !start.IsZero() && t.files[name].ModTime().Before(start) {
+			continue
+		}
+		names = append(names, name)
+	}
+	t.mu.Unlock()
+
+	var out []TieredFile
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+		t.mu.Lock()
+		bf := t.files[name]
+		if bf == nil || !bf.Pin() {
+			t.mu.Unlock()
+			continue // Deleted since we listed it.
+		}
+		if t.exportStates[name] != exportDone {
+			t.exportStates[name] = exportQueued
+		}
+		t.mu.Unlock()
+		tiered := TieredFile{Thread: t.id, File: name}
+		err := t.exportFile(export.File{Thread: t.id, Name: name, Blockfile: bf})
+		bf.Unpin()
+		t.mu.Lock()
+		switch {
+		case t.files[name] != bf:
+			// Untracked during export, nothing left to do.
+		case err != nil:
+			log.Printf("Thread %v could not tier %q: %v", t.id, name, err)
+			events.H.Add(events.Error, "Thread %v could not tier %q: %v", t.id, name, err)
+			tiered.Error = err.Error()
+			delete(t.exportStates, name) // Queued again when it's oldest.
+		default:
+			t.exportStates[name] = exportDone
+			tieredFiles.Increment()
+			if evict && !t.fileHeld(name) {
+				t.deleteOldestThreadFiles(1, []string{name})
+				evictedFiles.Increment()
+				tiered.Evicted = true
+			}
+		}
+		t.mu.Unlock()
+		out = append(out, tiered)
+	}
+	return out, nil
+}
@@ -0,0 +1,434 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records OpenTelemetry-compatible spans of the query path
+// (parsing, planning, per-blockfile index lookups and packet reads, and
+// streaming results) and exports them to an OTLP/HTTP collector as JSON, so
+// sensor latency can be lined up with the timings of whatever asked for the
+// packets.  Traces continue those of clients which send a W3C traceparent
+// header.
+//
+// A nil *Span is valid and does nothing, so code on the query path can create
+// spans unconditionally, and pays almost nothing when tracing is off.
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/config"
+	"github.com/mars-suite/stenographer/stats"
+	"golang.org/x/net/context"
+)
+
+var (
+	v             = base.V // verbose logging
+	exportedSpans = stats.S.Get("trace_spans_exported")
+	droppedSpans  = stats.S.Get("trace_spans_dropped")
+)
+
+const (
+	defaultBatchSize     = 512
+	defaultFlushInterval = 5 * time.Second
+	// queueSize is how many finished spans may wait to be exported.  Spans
+	// finishing while it's full are dropped.
+	queueSize     = 4096
+	exportTimeout = 30 * time.Second
+)
+
+// OTLP span kinds.
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+// Tracer starts traces and exports their spans.
+type Tracer struct {
+	client     *http.Client
+	endpoint   string
+	headers    map[string]string
+	sampleRate float64
+	sensor     string
+	batchSize  int
+	interval   time.Duration
+	spans      chan *Span
+}
+
+// New returns a Tracer configured by c, which exports spans with 'client',
+// labeled with 'sensor'.  Its background goroutine is started immediately.
+func New(c config.TracingConfig, client *http.Client, sensor string) (*Tracer, error) {
+	t := &Tracer{
+		client:     client,
+		endpoint:   c.Endpoint,
+		headers:    c.Headers,
+		sampleRate: c.SampleRate,
+		sensor:     sensor,
+		batchSize:  c.BatchSize,
+		spans:      make(chan *Span, queueSize),
+	}
+	if t.sampleRate == 0 {
+		t.sampleRate = 1
+	}
+	if t.batchSize == 0 {
+		t.batchSize = defaultBatchSize
+	}
+	var err error
+	if t.interval, err = c.FlushIntervalDuration(); err != nil {
+		return nil, err
+	} else if t.interval == 0 {
+		t.interval = defaultFlushInterval
+	}
+	go t.run()
+	return t, nil
+}
+
+// Span is a timed operation within a trace.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte // Zero for the trace's first span.
+	name    string
+	kind    int
+	start   time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   string
+}
+
+type attribute struct {
+	key   string
+	value interface{} // string, int64, float64, or bool
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// Very unlikely, and IDs only need to be unique, not unpredictable.
+		mrand.Read(b)
+	}
+}
+
+// parseTraceParent parses a W3C traceparent header, like
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceParent(h string) (traceID [16]byte, parent [8]byte, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parent, false, false
+	} else if parts[0] == "00" && len(parts) != 4 {
+		return traceID, parent, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parent, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parent, false, false
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil || parent == [8]byte{} {
+		return traceID, parent, false, false
+	}
+	return traceID, parent, flags[0]&1 != 0, true
+}
+
+// StartRequest starts a span for an incoming request, continuing the trace
+// in its traceparent header if it has one.  Requests are sampled as their
+// traceparent says, or else at the configured SampleRate.  Returns nil if the
+// request isn't traced.
+func (t *Tracer) StartRequest(r *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kindServer, start: time.Now()}
+	traceID, parent, sampled, ok := parseTraceParent(r.Header.Get("traceparent"))
+	if ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parent = traceID, parent
+	} else if mrand.Float64() >= t.sampleRate {
+		return nil
+	} else {
+		randomID(s.traceID[:])
+	}
+	randomID(s.spanID[:])
+	return s
+}
+
+// StartChild starts a span within s.
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parent: s.spanID, name: name, kind: kindInternal, start: time.Now()}
+	randomID(c.spanID[:])
+	return c
+}
+
+// TraceID returns the hex ID of the span's trace, or "" for a nil span.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttribute records a string, integer, float, or boolean attribute of the
+// span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	switch x := value.(type) {
+	case int:
+		value = int64(x)
+	case string, int64, float64, bool:
+	default:
+		value = fmt.Sprint(x)
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed, if err isn't nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export.  Only the first call has
+// any effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if ended {
+		return
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		droppedSpans.Increment()
+	}
+}
+
+type spanKey struct{}
+
+// WithSpan returns a context whose spans (see Start) are children of s.
+func WithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// FromContext returns the span attached to the context, or nil.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start starts a child of the context's span, returning a context carrying
+// it.  If the context has no span, it returns the context unchanged and nil.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	s := FromContext(ctx).StartChild(name)
+	return WithSpan(ctx, s), s
+}
+
+func (t *Tracer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) < t.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			v(0, "Exporting %d spans failed: %v", len(batch), err)
+			droppedSpans.IncrementBy(int64(len(batch)))
+		} else {
+			exportedSpans.IncrementBy(int64(len(batch)))
+		}
+		batch = nil
+	}
+}
+
+// The OTLP/HTTP JSON encoding of spans.  See
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64s are strings in JSON.
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is an error.
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpAttr(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch x := value.(type) {
+	case string:
+		a.Value.StringValue = &x
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &x
+	case bool:
+		a.Value.BoolValue = &x
+	}
+	return a
+}
+
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := otlpSpan{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.spanID[:]),
+		Name:    s.name,
+		Kind:    s.kind,
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	for _, a := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttr(a.key, a.value))
+	}
+	if s.err != "" {
+		out.Status = otlpStatus{Code: 2, Message: s.err}
+	}
+	return out
+}
+
+// request encodes spans as an OTLP export request.
+func (t *Tracer) request(spans []*Span) ([]byte, error) {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/mars-suite/stenographer", Version: base.Version}}
+	for _, s := range spans {
+		scope.Spans = append(scope.Spans, s.otlp())
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpAttr("service.name", "stenographer"),
+			otlpAttr("service.version", base.Version),
+			otlpAttr("host.name", t.sensor),
+		}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+}
+
+func (t *Tracer) export(spans []*Span) error {
+	body, err := t.request(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	ctx := base.NewContext(exportTimeout)
+	defer ctx.Cancel()
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v: %s", resp.Status, bytes.TrimSpace(respBody))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mars-suite/stenographer/config"
+	"golang.org/x/net/context"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	for _, test := range []struct {
+		header      string
+		ok, sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	} {
+		_, _, sampled, ok := parseTraceParent(test.header)
+		if ok != test.ok || sampled != test.sampled {
+			t.Errorf("%q: got ok %v sampled %v, want %v %v", test.header, ok, sampled, test.ok, test.sampled)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	got := make(chan otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("missing configured header")
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid export request: %v", err)
+		}
+		got <- req
+	}))
+	defer srv.Close()
+	tr, err := New(config.TracingConfig{
+		Endpoint:      srv.URL,
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		BatchSize:     2,
+		FlushInterval: "1h",
+	}, srv.Client(), "sensor-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/query", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	root := tr.StartRequest(r, "query")
+	if root.TraceID() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace not continued, got ID %q", root.TraceID())
+	}
+	ctx, child := Start(WithSpan(context.Background(), root), "lookup")
+	if FromContext(ctx) != child {
+		t.Errorf("child span not in context")
+	}
+	child.SetAttribute("steno.file", "PKT0/1")
+	child.SetAttribute("steno.positions", 3)
+	child.SetError(errors.New("broken index"))
+	child.End()
+	root.End()
+	root.End() // No-op.
+
+	var req otlpRequest
+	select {
+	case req = <-got:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no spans exported")
+	}
+	if len(req.ResourceSpans) != 1 || len(req.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request structure: %+v", req)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "lookup" || p.Name != "query" || c.TraceID != p.TraceID || c.ParentSpanID != p.SpanID || p.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("wrong span relationships: %+v", spans)
+	}
+	if c.Kind != kindInternal || p.Kind != kindServer || c.Status.Code != 2 || p.Status.Code != 0 {
+		t.Errorf("wrong span kinds or statuses: %+v", spans)
+	}
+	if len(c.Attributes) != 2 || *c.Attributes[1].Value.IntValue != "3" {
+		t.Errorf("wrong attributes: %+v", c.Attributes)
+	}
+
+	// Unsampled parents aren't traced, and nil spans do nothing.
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if s := tr.StartRequest(r, "query"); s != nil {
+		t.Errorf("unsampled request traced")
+	}
+	var nilTracer *Tracer
+	s := nilTracer.StartRequest(r, "query")
+	s.StartChild("parse").End()
+	s.End()
+}
@@ -0,0 +1,219 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package workload records anonymized query workloads, and compares the
+// results of replaying them, so a new version of stenographer can be checked
+// for changed results or slower queries before it's rolled out.
+//
+// A workload is a file of JSON Entry lines.  Replaying it against a test
+// corpus (see stenoctl's "replay" command) gives a file of JSON Result lines,
+// and Compare finds the differences between two such files.
+package workload
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+	"github.com/mars-suite/stenographer/query"
+)
+
+// Entry is a query as recorded, with how it went at the time.
+type Entry struct {
+	Time     time.Time
+	Query    string // Anonymized.
+	Packets  int64
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+}
+
+// Recorder appends anonymized queries to a workload file.
+type Recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	pan   *base.CryptoPAN
+	names []byte // HMAC key for host names.
+}
+
+// Open opens a workload file for appending.  Addresses in queries are
+// anonymized with CryptoPAn under 'key', which must be base.CryptoPANKeySize
+// bytes, and host names with an HMAC under it.  If 'key' is nil, a random one
+// is used, so workloads recorded by different runs can't be correlated.
+func Open(path string, key []byte) (*Recorder, error) {
+	if key == nil {
+		key = make([]byte, base.CryptoPANKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	pan, err := base.NewCryptoPAN(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{f: f, pan: pan, names: key}, nil
+}
+
+// Record anonymizes an entry's query and appends it to the workload.
+func (r *Recorder) Record(e Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	q, err := query.Anonymize(e.Query, r.anonymizeIP, r.anonymizeName)
+	if err != nil {
+		return err
+	}
+	e.Query = q
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = r.f.Write(append(data, '\n'))
+	return err
+}
+
+func (r *Recorder) anonymizeIP(ip net.IP) net.IP { return r.pan.Anonymize(ip) }
+
+func (r *Recorder) anonymizeName(name string) string {
+	mac := hmac.New(sha256.New, r.names)
+	mac.Write([]byte(name))
+	return "host-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// Close closes the workload file.
+func (r *Recorder) Close() error {
+	return r.f.Close()
+}
+
+// ReadEntries reads a workload file's entries.
+func ReadEntries(in io.Reader) (out []Entry, _ error) {
+	return out, readLines(in, func(line []byte) error {
+		var e Entry
+		err := json.Unmarshal(line, &e)
+		out = append(out, e)
+		return err
+	})
+}
+
+// Result is the outcome of replaying one query.
+type Result struct {
+	Query    string
+	Packets  int64
+	Duration time.Duration
+	Error    string `json:",omitempty"`
+}
+
+// ReadResults reads a file of replay results.
+func ReadResults(in io.Reader) (out []Result, _ error) {
+	return out, readLines(in, func(line []byte) error {
+		var r Result
+		err := json.Unmarshal(line, &r)
+		out = append(out, r)
+		return err
+	})
+}
+
+func readLines(in io.Reader, fn func([]byte) error) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Thresholds for Compare to report a query as slower:  it must have taken
+// SlowdownFactor times as long as before, and at least MinSlowdown longer, so
+// the noise in timing quick queries isn't reported.
+const (
+	SlowdownFactor = 2
+	MinSlowdown    = 100 * time.Millisecond
+)
+
+// Difference is a query whose replay results changed.
+type Difference struct {
+	Query     string
+	Old, New  Result
+	Changed   bool // Whether the packets matched or the error changed.
+	Slower    bool
+	Unmatched bool // Whether the query is only in one of the results.
+}
+
+func (d Difference) String() string {
+	switch {
+	case d.Unmatched:
+		return fmt.Sprintf("%q: only replayed once", d.Query)
+	case d.Changed && d.Old.Error != d.New.Error:
+		return fmt.Sprintf("%q: error changed from %q to %q", d.Query, d.Old.Error, d.New.Error)
+	case d.Changed:
+		return fmt.Sprintf("%q: matched %d packets, was %d", d.Query, d.New.Packets, d.Old.Packets)
+	}
+	return fmt.Sprintf("%q: took %v, was %v", d.Query, d.New.Duration, d.Old.Duration)
+}
+
+// Compare returns the differences between two replays of the same workload,
+// in order.  Results are matched up by query, in order, so a workload may
+// repeat a query.
+func Compare(old, new []Result) (out []Difference) {
+	seen := map[string]int{} // How many of each query have been matched.
+	byQuery := map[string][]Result{}
+	for _, r := range old {
+		byQuery[r.Query] = append(byQuery[r.Query], r)
+	}
+	for _, n := range new {
+		olds := byQuery[n.Query]
+		i := seen[n.Query]
+		if i >= len(olds) {
+			out = append(out, Difference{Query: n.Query, New: n, Unmatched: true})
+			continue
+		}
+		seen[n.Query]++
+		o := olds[i]
+		d := Difference{
+			Query:   n.Query,
+			Old:     o,
+			New:     n,
+			Changed: o.Packets != n.Packets || o.Error != n.Error,
+			Slower:  n.Duration > SlowdownFactor*o.Duration && n.Duration-o.Duration >= MinSlowdown,
+		}
+		if d.Changed || d.Slower {
+			out = append(out, d)
+		}
+	}
+	for _, o := range old {
+		if seen[o.Query] > 0 {
+			seen[o.Query]--
+			continue
+		}
+		out = append(out, Difference{Query: o.Query, Old: o, Unmatched: true})
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+// Copyright 2026 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workload
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mars-suite/stenographer/base"
+)
+
+func TestRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workload_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "workload")
+	r, err := Open(path, bytes.Repeat([]byte{7}, base.CryptoPANKeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"host 10.1.2.3 and port 53", "net 10.1.0.0/16", "host db01"} {
+		if err := r.Record(Entry{Query: q, Packets: 5, Duration: time.Second}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Record(Entry{Query: "host 10.1.2"}); err == nil {
+		t.Errorf("invalid query recorded")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ReadEntries(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Packets != 5 || entries[0].Duration != time.Second {
+		t.Fatalf("got entries %+v", entries)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Query, "10.1.") || strings.Contains(e.Query, "db01") {
+			t.Errorf("query not anonymized: %q", e.Query)
+		}
+	}
+	// Addresses are anonymized consistently, keeping their prefixes.
+	var host, subnet string
+	if _, err := fmt.Sscanf(entries[0].Query, "host %s and port 53", &host); err != nil {
+		t.Fatalf("unexpected anonymized query %q", entries[0].Query)
+	}
+	if _, err := fmt.Sscanf(entries[1].Query, "net %s", &subnet); err != nil {
+		t.Fatalf("unexpected anonymized query %q", entries[1].Query)
+	}
+	if hostParts, netParts := strings.Split(host, "."), strings.Split(subnet, "."); hostParts[0] != netParts[0] || hostParts[1] != netParts[1] {
+		t.Errorf("prefix not preserved: host %s, net %s", host, subnet)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	old := []Result{
+		{Query: "port 53", Packets: 10, Duration: time.Second},
+		{Query: "port 80", Packets: 3, Duration: 10 * time.Millisecond},
+		{Query: "port 80", Packets: 3, Duration: 10 * time.Millisecond},
+		{Query: "port 22", Error: "no"},
+		{Query: "tcp", Packets: 1},
+	}
+	new := []Result{
+		{Query: "port 53", Packets: 10, Duration: 3 * time.Second},      // Slower.
+		{Query: "port 80", Packets: 3, Duration: 50 * time.Millisecond}, // Too quick to matter.
+		{Query: "port 80", Packets: 4, Duration: 10 * time.Millisecond}, // Changed.
+		{Query: "port 22"}, // Error fixed.
+		{Query: "udp"},     // Only new.
+	}
+	var got []string
+	for _, d := range Compare(old, new) {
+		got = append(got, d.String())
+	}
+	want := []string{
+		`"port 53": took 3s, was 1s`,
+		`"port 80": matched 4 packets, was 3`,
+		`"port 22": error changed from "no" to ""`,
+		`"udp": only replayed once`,
+		`"tcp": only replayed once`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got differences:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}